@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+)
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// diff prints the differences between the records file at path and the records in Unbound to stdout, and
+// returns the exit code: 0 without differences, 1 with some, 2 on failure.
+func diff(ctx context.Context, prov webhookProvider, path, output string, stdout *os.File) int {
+	if path == "" {
+		slog.Error("diff requires -file")
+		return 2
+	}
+	if output != "text" && output != "json" {
+		slog.Error("invalid -output, must be text or json", slog.String("output", output))
+		return 2
+	}
+
+	desired, err := provider.LoadRecordsFile(path)
+	if err != nil {
+		slog.Error("failed to load records file", slog.Any("error", err))
+		return 2
+	}
+
+	diffs, err := provider.Diff(ctx, prov, desired)
+	if err != nil {
+		slog.Error("failed to compare records", slog.Any("error", err))
+		return 2
+	}
+
+	if output == "json" {
+		if diffs == nil {
+			diffs = []provider.RecordDiff{}
+		}
+		err = json.NewEncoder(stdout).Encode(diffs)
+	} else {
+		err = printDiffs(stdout, diffs, useColor(stdout))
+	}
+	if err != nil {
+		slog.Error("failed to print differences", slog.Any("error", err))
+		return 2
+	}
+
+	if len(diffs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printDiffs prints diffs one record per line, prefixed with +, ~ or - as they are to be created, updated or deleted,
+// followed by a line per changed field.
+func printDiffs(w io.Writer, diffs []provider.RecordDiff, color bool) error {
+	counts := map[string]int{}
+	for _, d := range diffs {
+		counts[d.Action]++
+
+		sign, c := "~", colorYellow
+		switch d.Action {
+		case "create":
+			sign, c = "+", colorGreen
+		case "delete":
+			sign, c = "-", colorRed
+		}
+		start, end := "", ""
+		if color {
+			start, end = c, colorReset
+		}
+
+		if _, err := fmt.Fprintf(w, "%s%s %s %s%s\n", start, sign, d.RecordType, d.DNSName, end); err != nil {
+			return err
+		}
+		for _, f := range d.Fields {
+			var err error
+			switch d.Action {
+			case "create":
+				_, err = fmt.Fprintf(w, "    %s: %s\n", f.Field, f.New)
+			case "delete":
+				_, err = fmt.Fprintf(w, "    %s: %s\n", f.Field, f.Old)
+			default:
+				_, err = fmt.Fprintf(w, "    %s: %q -> %q\n", f.Field, f.Old, f.New)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(diffs) == 0 {
+		_, err := fmt.Fprintln(w, "No differences")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d to create, %d to update, %d to delete\n", counts["create"], counts["update"], counts["delete"])
+	return err
+}
+
+// useColor tells whether to color output to f: only terminals are, unless NO_COLOR is set.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	// recordsFile writes a records file holding content, returning its path
+	recordsFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "records.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	// run runs diff, returning its exit code and what it printed
+	run := func(t *testing.T, prov webhookProvider, path, output string) (int, string) {
+		stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+		require.NoError(t, err)
+		defer stdout.Close()
+
+		code := diff(ctx, prov, path, output, stdout)
+		b, err := os.ReadFile(stdout.Name())
+		require.NoError(t, err)
+		return code, string(b)
+	}
+
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+		endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+	}
+	same := recordsFile(t, `
+records:
+  - dnsName: nas.example.com
+    recordType: A
+    targets: [192.168.1.10]
+  - dnsName: old.example.com
+    recordType: A
+    targets: [192.168.1.20]
+`)
+	changed := recordsFile(t, `
+records:
+  - dnsName: nas.example.com
+    recordType: A
+    targets: [192.168.1.11]
+  - dnsName: printer.example.com
+    recordType: A
+    targets: [192.168.1.30]
+`)
+
+	t.Run("no differences", func(t *testing.T) {
+		code, out := run(t, &fakeProvider{records: current}, same, "text")
+		require.Equal(t, 0, code)
+		require.Equal(t, "No differences\n", out)
+
+		code, out = run(t, &fakeProvider{records: current}, same, "json")
+		require.Equal(t, 0, code)
+		require.Equal(t, "[]\n", out)
+	})
+
+	t.Run("differences as text", func(t *testing.T) {
+		code, out := run(t, &fakeProvider{records: current}, changed, "text")
+		require.Equal(t, 1, code)
+		require.Equal(t, `~ A nas.example.com
+    targets: "192.168.1.10" -> "192.168.1.11"
+- A old.example.com
+    targets: 192.168.1.20
++ A printer.example.com
+    targets: 192.168.1.30
+1 to create, 1 to update, 1 to delete
+`, out)
+	})
+
+	t.Run("differences as JSON", func(t *testing.T) {
+		code, out := run(t, &fakeProvider{records: current}, changed, "json")
+		require.Equal(t, 1, code)
+		var diffs []provider.RecordDiff
+		require.NoError(t, json.Unmarshal([]byte(out), &diffs))
+		require.Equal(t, []provider.RecordDiff{
+			{Action: "update", DNSName: "nas.example.com", RecordType: "A",
+				Fields: []provider.FieldChange{{Field: "targets", Old: "192.168.1.10", New: "192.168.1.11"}}},
+			{Action: "delete", DNSName: "old.example.com", RecordType: "A",
+				Fields: []provider.FieldChange{{Field: "targets", Old: "192.168.1.20"}}},
+			{Action: "create", DNSName: "printer.example.com", RecordType: "A",
+				Fields: []provider.FieldChange{{Field: "targets", New: "192.168.1.30"}}},
+		}, diffs)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		prov   *fakeProvider
+		path   string
+		output string
+	}{
+		{name: "without -file", prov: &fakeProvider{}, output: "text"},
+		{name: "invalid -output", prov: &fakeProvider{}, path: same, output: "yaml"},
+		{name: "missing records file", prov: &fakeProvider{}, path: filepath.Join(t.TempDir(), "missing.yaml"), output: "text"},
+		{name: "invalid records file", prov: &fakeProvider{}, path: recordsFile(t, "records: {}\n"), output: "text"},
+		{name: "failing to list records", prov: &fakeProvider{recordsErr: errors.New("OPNsense unreachable")}, path: same, output: "json"},
+	} {
+		t.Run("fails "+tc.name, func(t *testing.T) {
+			code, out := run(t, tc.prov, tc.path, tc.output)
+			require.Equal(t, 2, code)
+			require.Empty(t, out)
+		})
+	}
+}
+
+func TestPrintDiffs(t *testing.T) {
+	diffs := []provider.RecordDiff{
+		{Action: "create", DNSName: "a.example.com", RecordType: "A", Fields: []provider.FieldChange{{Field: "targets", New: "192.0.2.1"}}},
+		{Action: "update", DNSName: "b.example.com", RecordType: "A", Fields: []provider.FieldChange{{Field: "description", Old: "x", New: "y"}}},
+		{Action: "delete", DNSName: "c.example.com", RecordType: "CNAME", Fields: []provider.FieldChange{{Field: "targets", Old: "a.example.com"}}},
+	}
+
+	t.Run("colors records by action", func(t *testing.T) {
+		var out strings.Builder
+		require.NoError(t, printDiffs(&out, diffs, true))
+		require.Equal(t, colorGreen+"+ A a.example.com"+colorReset+`
+    targets: 192.0.2.1
+`+colorYellow+"~ A b.example.com"+colorReset+`
+    description: "x" -> "y"
+`+colorRed+"- CNAME c.example.com"+colorReset+`
+    targets: a.example.com
+1 to create, 1 to update, 1 to delete
+`, out.String())
+	})
+
+	t.Run("without color", func(t *testing.T) {
+		var out strings.Builder
+		require.NoError(t, printDiffs(&out, diffs, false))
+		require.NotContains(t, out.String(), "\x1b[")
+	})
+}
+
+func TestUseColor(t *testing.T) {
+	// /dev/null is a character device, like terminals
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { devNull.Close() })
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+
+	t.Run("colors terminals", func(t *testing.T) {
+		t.Setenv("NO_COLOR", "")
+		require.True(t, useColor(devNull))
+		require.False(t, useColor(file))
+	})
+
+	t.Run("colors nothing under NO_COLOR", func(t *testing.T) {
+		t.Setenv("NO_COLOR", "1")
+		require.False(t, useColor(devNull))
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+)
+
+// importRecords creates or updates the records of the records file at path, such as a backup written with
+// -backup-path, and returns the exit code: 0 once imported, 2 without path, 1 on failure to load or import
+// the records, like restore. Records in Unbound but not in the file are left as they are.
+func importRecords(ctx context.Context, prov webhookProvider, path string) int {
+	if path == "" {
+		slog.Error("import requires -file")
+		return 2
+	}
+
+	records, err := provider.LoadRecordsFile(path)
+	if err != nil {
+		slog.Error("failed to load records file", slog.Any("error", err))
+		return 1
+	}
+
+	// Seeding applies the records whatever external-dns plans; the seeds are forgotten as the command exits
+	if err := prov.Seed(ctx, records); err != nil {
+		slog.Error("failed to import records", slog.Any("error", err))
+		return 1
+	}
+	slog.Info("import done", slog.Int("total", len(records)))
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestImportRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+records:
+  - dnsName: nas.example.com
+    recordType: A
+    targets: [192.168.1.10]
+`), 0o600))
+	invalid := filepath.Join(t.TempDir(), "invalid.yaml")
+	require.NoError(t, os.WriteFile(invalid, []byte("records: {}\n"), 0o600))
+
+	t.Run("seeds the records of the file", func(t *testing.T) {
+		prov := &fakeProvider{}
+		require.Equal(t, 0, importRecords(ctx, prov, path))
+		require.Len(t, prov.seeded, 1)
+		require.Equal(t, "nas.example.com", prov.seeded[0].DNSName)
+		require.Equal(t, endpoint.Targets{"192.168.1.10"}, prov.seeded[0].Targets)
+	})
+
+	for _, tc := range []struct {
+		name string
+		prov *fakeProvider
+		path string
+		want int
+	}{
+		{name: "without -file", prov: &fakeProvider{}, want: 2},
+		{name: "missing records file", prov: &fakeProvider{}, path: filepath.Join(t.TempDir(), "missing.yaml"), want: 1},
+		{name: "invalid records file", prov: &fakeProvider{}, path: invalid, want: 1},
+		{name: "failing to import", prov: &fakeProvider{seedErr: errors.New("OPNsense unreachable")}, path: path, want: 1},
+	} {
+		t.Run("fails "+tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, importRecords(ctx, tc.prov, tc.path))
+		})
+	}
+}
@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/v-yarotksy/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
-	"sigs.k8s.io/external-dns/provider/webhook/api"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/health"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/servertls"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/webhook"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	externaldnsprovider "sigs.k8s.io/external-dns/provider"
 )
 
+// version and commit are set by goreleaser; otherwise, the build info reports those Go stamps the binary with.
+var version, commit string
+
 type stringSliceFlag []string
 
 func (i *stringSliceFlag) String() string {
@@ -22,15 +42,260 @@ func (i *stringSliceFlag) Set(value string) error {
 	return nil
 }
 
+// webhookProvider is a provider serving one OPNsense or several.
+type webhookProvider interface {
+	externaldnsprovider.Provider
+	Ready() error
+	Status() provider.Status
+	RunRefresh(ctx context.Context)
+	RunGC(ctx context.Context)
+	RunCanary(ctx context.Context)
+	RunBackups(ctx context.Context)
+	CanaryReady() error
+	WaitForOPNsense(ctx context.Context, timeout, interval time.Duration) error
+	Restore(ctx context.Context, names []string, dryRun bool) ([]provider.RestoredRecord, error)
+	Seed(ctx context.Context, seeds []*endpoint.Endpoint) error
+	Shutdown(ctx context.Context) error
+}
+
 func main() {
-	var baseURL, apiKey, apiSecret string
-	var domains stringSliceFlag
+	// webhook mock-server serves a fake OPNsense for local development, with flags of its own
+	if len(os.Args) > 1 && os.Args[1] == "mock-server" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := mockServer(ctx, os.Args[2:])
+		stop()
+		os.Exit(code)
+	}
+
+	// webhook restore, diff and import take the same flags as serving, to reach OPNsense the same way, and a few of their own
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && (args[0] == "restore" || args[0] == "diff" || args[0] == "import") {
+		command, args = args[0], args[1:]
+	}
+
+	// diff exits with 1 when there are differences, so failures exit with 2 instead
+	failed := 1
+	if command == "diff" {
+		failed = 2
+	}
+
+	var baseURL, apiKey, apiSecret, listenAddress, listenSocket, listenSocketMode, metricsAddress, diffFile, diffOutput string
+	var fallbackBaseURL, fallbackAPIKey, fallbackAPISecret, journalFile, driftStateFile, instancesFile, webhooksFile, credentialsCommand, credentialsFile, seedRecordsFile, backupPath string
+	var webhookTLSCert, webhookTLSKey, metricsTLSCert, metricsTLSKey, webhookAuthToken, webhookAuthTokenFile string
+	var tlsCAFile, tlsServerName, tlsMinVersion, renameStrategy, readOnlyResponse, resolverAddress, ownerID, canaryDomain string
+	var notifyURL, notifyEventNames string
+	var notifyLargeChange, backupKeep int
+	var domains, allowedTargetCIDRs, targetRewrites, excludeRecordPatterns, restoreNames, tlsPins, lockMessages stringSliceFlag
+	var debugHTTP, fallbackWrites, tlsSkipVerify, listFromSettings, disableDeletes, resolveHostnameTargets, softDelete, zoneEndpoint bool
+	var restoreAll, dryRun, verifyStrict, detectDrift, readOnly, fixDanglingAliases, unprocessableValidation bool
+	var maxResponseSize, maxRequestSize int64
+	var reconfigureDebounce, slowRequestThreshold, slowCallThreshold, cacheTTL, serveStaleMaxAge, snapshotMaxAge, refreshInterval time.Duration
+	var verifyRecords, dnsPort int
+	var reconfigureFailureThreshold, applyFailureThreshold, listConcurrency, maxRecords, applyConcurrency, bulkApplyThreshold, retryAttempts, circuitThreshold, maxInflight int
+	var retryBaseDelay, retryMaxDelay, circuitCooldown, callTimeout time.Duration
+	var startupTimeout, startupRetryInterval, resolveTimeout, resolveCacheTTL, softDeleteGrace, credentialsTimeout, gcMaxAge, minRecordAgeForDelete, verifyWindow time.Duration
+	var webhookReadTimeout, webhookWriteTimeout time.Duration
+	var canaryInterval, canaryTimeout, shutdownGrace, applyTimeout, minOperationTimeout, maxOperationTimeout, backupInterval time.Duration
 
 	flag.StringVar(&baseURL, "base-url", "https://192.168.1.1", "OPNSense API base URL")
 	flag.StringVar(&apiKey, "api-key", "", "OPNSense API key")
 	flag.StringVar(&apiSecret, "api-secret", "", "OPNSense API secret")
+	flag.StringVar(&credentialsCommand, "credentials-command", "", "Command printing the OPNSense API key and secret "+
+		`as JSON, {"apiKey": "...", "apiSecret": "..."}, run at startup, on SIGHUP and when OPNSense rejects them. `+
+		"Replaces -api-key and -api-secret. Run without a shell, its output is never logged")
+	flag.DurationVar(&credentialsTimeout, "credentials-timeout", 10*time.Second, "How long -credentials-command may run")
+	flag.StringVar(&credentialsFile, "api-credentials-file", "", "API key file as downloaded from OPNSense, "+
+		"with key= and secret= lines, read at startup, on SIGHUP and when OPNSense rejects the credentials. "+
+		"Replaces -api-key and -api-secret")
+	flag.StringVar(&fallbackBaseURL, "fallback-base-url", "", "Standby OPNSense API base URL to list records from "+
+		"while the primary is unavailable")
+	flag.StringVar(&fallbackAPIKey, "fallback-api-key", "", "Standby OPNSense API key. Defaults to -api-key")
+	flag.StringVar(&fallbackAPISecret, "fallback-api-secret", "", "Standby OPNSense API secret. Defaults to -api-secret")
+	flag.BoolVar(&fallbackWrites, "fallback-writes", false, "Also apply changes to the standby OPNSense "+
+		"while the primary is unavailable")
+	flag.BoolVar(&tlsSkipVerify, "tls-skip-verify", true, "Don't verify the OPNSense certificate, which is self-signed "+
+		"by default. Ignored when -tls-ca-file is set")
+	flag.StringVar(&tlsCAFile, "tls-ca-file", "", "PEM file with the CA certificates to verify the OPNSense certificate against")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version to connect to OPNsense with, 1.2 or 1.3")
+	flag.Var(&tlsPins, "tls-pin-sha256", "SHA-256 fingerprint of the public key of the OPNsense certificate, in hex or base64. "+
+		"Can be used multiple times, to rotate certificates. Only certificates matching one are accepted, "+
+		"on top of CA verification unless -tls-skip-verify")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "Name to verify the OPNSense certificate against, "+
+		"if not the base URL host")
 	flag.Var(&domains, "domains", "Domain filter. Can be used multiple times. "+
 		"foo.com means foo.com and anything that ends in .foo.com")
+	flag.Var(&allowedTargetCIDRs, "allowed-target-cidrs", "CIDR to allow the targets of A records in, "+
+		"such as 192.168.0.0/16. Can be used multiple times. Targets outside every one are dropped. Empty allows every target")
+	flag.Var(&targetRewrites, "target-rewrite", "CIDR=IP rule to replace the targets of A records in CIDR with IP, "+
+		"such as 203.0.113.0/24=192.168.10.5. Can be used multiple times, the first matching rule applies. "+
+		"Rewritten targets are checked against -allowed-target-cidrs")
+	flag.Var(&excludeRecordPatterns, "exclude-record-regex", "Regular expression matching the DNS names of records "+
+		"to keep external-dns away from, such as '^vpn\\..*'. Can be used multiple times. "+
+		"Matching records are neither listed nor changed")
+	flag.BoolVar(&resolveHostnameTargets, "resolve-hostname-targets", false, "Replace hostname targets of A records, "+
+		"such as DynDNS names, by their lowest address. Records with a target that fails to resolve are ignored")
+	flag.StringVar(&resolverAddress, "resolver", "", "DNS server to resolve hostname targets with, such as 192.168.1.1:53. "+
+		"Empty resolves as the system does")
+	flag.DurationVar(&resolveTimeout, "resolve-timeout", 2*time.Second, "Maximum time to resolve a hostname target. 0 disables")
+	flag.DurationVar(&resolveCacheTTL, "resolve-cache-ttl", time.Minute, "Reuse the address a hostname target "+
+		"resolved to for this long. 0 disables")
+	flag.BoolVar(&debugHTTP, "debug-http", false, "Log OPNSense API requests and responses, with credentials redacted. "+
+		"Implies debug log level")
+	flag.StringVar(&listenAddress, "listen-address", ":8888", "Address to serve the webhook API on")
+	flag.StringVar(&listenSocket, "listen-socket", "", "Path of a unix domain socket to serve the webhook API on, "+
+		"such as one in a volume shared with external-dns, instead of -listen-address")
+	flag.StringVar(&listenSocketMode, "listen-socket-mode", "0660", "Permissions of the -listen-socket socket, in octal")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 25*time.Second, "On SIGTERM, how long to let the webhook "+
+		"requests in flight, applies included, finish and Unbound be reconfigured for their changes before exiting. "+
+		"Keep it below the pod's termination grace period")
+	flag.DurationVar(&webhookReadTimeout, "webhook-read-timeout", 5*time.Second, "Maximum time to read a webhook request")
+	flag.DurationVar(&webhookWriteTimeout, "webhook-write-timeout", 0, "Maximum time to answer a webhook request, "+
+		"applies included. Must cover -apply-timeout and -verify-window. 0 sets it from them, or disables it without "+
+		"-apply-timeout, as applies then take as long as they take")
+	flag.DurationVar(&slowRequestThreshold, "slow-request-threshold", 2*time.Second, "Log webhook requests slower than this. 0 disables")
+	flag.Int64Var(&maxRequestSize, "webhook-max-request-size", 4<<20, "Maximum size in bytes of a webhook request body, "+
+		"such as a plan of changes. Larger requests are answered with 413. 0 disables")
+	flag.DurationVar(&slowCallThreshold, "slow-call-threshold", time.Second, "Log OPNSense API calls slower than this, "+
+		"retries included. 0 disables")
+	flag.StringVar(&metricsAddress, "metrics-address", ":8080", "Address to serve Prometheus metrics and health checks on")
+	flag.StringVar(&webhookTLSCert, "webhook-tls-cert", "", "PEM certificate file to serve the webhook API over HTTPS with, "+
+		"along with -webhook-tls-key. Loaded again when it changes")
+	flag.StringVar(&webhookTLSKey, "webhook-tls-key", "", "PEM key file of -webhook-tls-cert")
+	flag.StringVar(&metricsTLSCert, "metrics-tls-cert", "", "PEM certificate file to serve metrics and health checks over HTTPS "+
+		"with, along with -metrics-tls-key. Loaded again when it changes")
+	flag.StringVar(&metricsTLSKey, "metrics-tls-key", "", "PEM key file of -metrics-tls-cert")
+	flag.StringVar(&webhookAuthToken, "webhook-auth-token", "", "Token webhook requests must carry as "+
+		"\"Authorization: Bearer <token>\". Health checks and metrics are exempt")
+	flag.StringVar(&webhookAuthTokenFile, "webhook-auth-token-file", "", "File to read -webhook-auth-token from")
+	flag.BoolVar(&unprocessableValidation, "unprocessable-validation-failures", false, "Answer applies failing only because "+
+		"OPNsense rejected records with 422 rather than 500. external-dns up to at least v0.14 exits on it rather than retrying")
+	flag.DurationVar(&reconfigureDebounce, "reconfigure-debounce", 0, "Coalesce Unbound reconfigures requested within this interval. "+
+		"0 reconfigures at the end of every apply")
+	flag.IntVar(&reconfigureFailureThreshold, "reconfigure-failure-threshold", 3, "Report not ready after this many "+
+		"consecutive Unbound reconfigure failures. 0 disables")
+	flag.IntVar(&applyFailureThreshold, "apply-failure-threshold", 0, "Report not ready, with the last error, after "+
+		"this many consecutive failures to apply changes, until one succeeds. 0 disables")
+	flag.IntVar(&verifyRecords, "verify-records", 0, "After applying changes, query up to this many of the records "+
+		"created or updated from Unbound on the OPNsense host, to report records saved but not served. 0 disables")
+	flag.IntVar(&dnsPort, "dns-port", 53, "Port Unbound serves DNS on the OPNsense host, for -verify-records and -canary-interval")
+	flag.DurationVar(&verifyWindow, "verify-window", 10*time.Second, "Keep querying records that don't resolve as "+
+		"applied for this long, for -verify-records. Must cover -reconfigure-debounce, and holds up the apply")
+	flag.BoolVar(&verifyStrict, "verify-strict", false, "Fail applies when records applied don't resolve, for -verify-records")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "Serve records from memory for this long after listing them from OPNSense. "+
+		"Changes made outside external-dns show up after at most this long. 0 disables")
+	flag.DurationVar(&serveStaleMaxAge, "serve-stale-max-age", 0, "Serve the last records listed from OPNSense, "+
+		"if younger than this, when OPNSense can't be reached. Changes still fail to apply. 0 disables")
+	flag.IntVar(&listConcurrency, "list-concurrency", 5, "Maximum number of concurrent host alias listing requests to OPNSense")
+	flag.IntVar(&maxRecords, "max-records", 0, "Fail listings of more host overrides and aliases than this, "+
+		"rather than have external-dns plan against them. 0 means no limit")
+	flag.BoolVar(&listFromSettings, "list-from-settings", false, "List records with a single read of the Unbound settings "+
+		"instead of searching for overrides and the aliases of each. Falls back to searching if OPNSense doesn't support it")
+	flag.DurationVar(&snapshotMaxAge, "snapshot-max-age", 30*time.Second, "Apply changes against the records listed by "+
+		"the preceding poll if it is younger than this, instead of listing them again. 0 disables")
+	flag.IntVar(&applyConcurrency, "apply-concurrency", 1, "Maximum number of independent changes applied to OPNSense at once")
+	flag.IntVar(&bulkApplyThreshold, "bulk-apply-threshold", 0, "Apply plans of at least this many changes with a single "+
+		"write of the Unbound settings instead of one API call per record. 0 disables")
+	flag.IntVar(&maxInflight, "api-max-inflight", 10, "Maximum number of concurrent requests to OPNSense, "+
+		"however high -list-concurrency and -apply-concurrency are. 0 means no limit")
+	flag.Int64Var(&maxResponseSize, "max-response-size", 32<<20, "Maximum size in bytes of an OPNSense API response")
+	flag.DurationVar(&refreshInterval, "refresh-interval", 0, "Re-list records in the background this often, "+
+		"keeping the cache and metrics current between polls. 0 disables")
+	flag.IntVar(&retryAttempts, "retry-attempts", 3, "Attempts per OPNSense API call failing with a network error, 5xx, 429 "+
+		"or one of -lock-message. 1 disables retries")
+	flag.Var(&lockMessages, "lock-message", "Message, or part of one, OPNSense refuses changes with while another session "+
+		"holds the configuration, to retry them on. Matching ignores case. Can be used multiple times")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", 200*time.Millisecond, "Delay before the first retry, doubled for each next one")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", 5*time.Second, "Maximum delay between retries")
+	flag.DurationVar(&callTimeout, "opnsense-call-timeout", 0, "Maximum time for a single OPNSense API call, "+
+		"including its retries. 0 disables")
+	flag.DurationVar(&applyTimeout, "apply-timeout", 0, "Maximum time to apply a batch of changes, shared across them "+
+		"so that a slow change doesn't use up the time of the rest. Changes left are retried by the next sync. 0 disables")
+	flag.DurationVar(&minOperationTimeout, "operation-timeout-min", time.Second, "Least time each change gets of -apply-timeout, "+
+		"however many remain")
+	flag.DurationVar(&maxOperationTimeout, "operation-timeout-max", 0, "Most time each change gets of -apply-timeout. 0 disables")
+	flag.IntVar(&circuitThreshold, "circuit-failure-threshold", 5, "Stop calling OPNSense for a cooldown after this many "+
+		"consecutive failed API calls. 0 disables")
+	flag.DurationVar(&circuitCooldown, "circuit-cooldown", 30*time.Second, "How long to stop calling OPNSense once the "+
+		"failure threshold is reached, before probing it again")
+	flag.DurationVar(&startupTimeout, "startup-timeout", 0, "Exit if OPNSense can't be reached for this long after starting. "+
+		"Until then the webhook is not ready. 0 waits forever")
+	flag.DurationVar(&startupRetryInterval, "startup-retry-interval", 5*time.Second, "How often to check whether OPNSense "+
+		"is reachable while starting up")
+	flag.BoolVar(&disableDeletes, "disable-deletes", false, "Never delete records, whatever external-dns plans, "+
+		"including the old record of one changing type. Creates and updates are still made")
+	flag.DurationVar(&minRecordAgeForDelete, "min-record-age-for-delete", 0, "Stamp records created with the time "+
+		"of creation, in their description, and skip deleting records created less than this ago, such as those of "+
+		"flapping sources. external-dns deletes them on a later sync. Records never stamped are deleted as usual. 0 disables")
+	flag.BoolVar(&readOnly, "read-only", false, "List records and adjust endpoints, but never write to OPNSense: "+
+		"changes external-dns plans are logged instead of applied, and garbage collection and the canary don't run")
+	flag.StringVar(&readOnlyResponse, "read-only-response", string(provider.ReadOnlyRefuse), "What to answer external-dns "+
+		"with in read-only mode: error fails applies so that external-dns reports them, skip succeeds without applying")
+	flag.BoolVar(&softDelete, "soft-delete", false, "Disable records instead of deleting them, tagging their description "+
+		"with the time of deletion. Disabled records are ignored, and enabled again when created again")
+	flag.DurationVar(&softDeleteGrace, "soft-delete-grace", 7*24*time.Hour, "Delete records soft-deleted longer than this ago "+
+		"for good. 0 never deletes them")
+	flag.DurationVar(&gcMaxAge, "gc-max-age", 0, "Stamp records external-dns desires with the time they were last "+
+		"seen desired, in their description, and delete records stamped longer than this ago, such as those of clusters "+
+		"torn down before external-dns could delete them. Records never stamped are kept. 0 disables")
+	flag.StringVar(&notifyURL, "notify-url", "", "URL to POST a JSON notification to, with a Slack-compatible text, "+
+		"on the events of -notify-events, such as an ntfy topic or a Slack webhook. Credentials are redacted from "+
+		"notifications, and failing to send them never fails an apply. Empty disables")
+	flag.StringVar(&notifyEventNames, "notify-events", strings.Join([]string{provider.NotifyApplyFailed, provider.NotifyDeletesSkipped,
+		provider.NotifyLargeChange}, ","), "Comma-separated events to notify -notify-url of: apply-failed, deletes-skipped by "+
+		"-disable-deletes or -min-record-age-for-delete, and large-change, an apply of more changes than -notify-large-change")
+	flag.IntVar(&notifyLargeChange, "notify-large-change", 0, "Notify of applies changing more records than this, "+
+		"with large-change in -notify-events. 0 disables")
+	flag.BoolVar(&detectDrift, "detect-drift", false, "Log and count records changed since the webhook wrote them, "+
+		"such as by hand in the OPNsense UI, naming the fields changed. Drift is reported once, and not corrected")
+	flag.StringVar(&driftStateFile, "drift-state-file", "", "File to keep the records the webhook wrote in, so that "+
+		"drift while it was down is reported after a restart. Empty keeps them in memory only")
+	flag.DurationVar(&canaryInterval, "canary-interval", 0, "Create a canary record, _canary-<owner ID>.<domain> "+
+		"pointing to 127.0.0.1, this often, query it from Unbound and delete it, reporting at /canaryz and in metrics. 0 disables")
+	flag.DurationVar(&canaryTimeout, "canary-timeout", 30*time.Second, "Maximum time for Unbound to serve the canary record. "+
+		"Must cover -reconfigure-debounce")
+	flag.StringVar(&canaryDomain, "canary-domain", "", "Domain of the canary record. Defaults to the first domain of the domain filter")
+	flag.StringVar(&renameStrategy, "rename-strategy", string(provider.RenameUpdate), "How to apply changes of a record's name: "+
+		"update updates the record in place, recreate creates a new record, re-points aliases to it and deletes the old one")
+	flag.BoolVar(&fixDanglingAliases, "fix-dangling-aliases", false, "Re-point aliases that target the old name of a record "+
+		"renamed in place to its new name, instead of only warning about them")
+	flag.StringVar(&instancesFile, "instances-file", "", "JSON file listing OPNSense instances, each with a name, "+
+		"baseURL, apiKey, apiSecret and domains, to route the records of each domain to. "+
+		"Replaces -base-url, -api-key, -api-secret and -domains. Journal, drift state and records backup files are suffixed "+
+		"with the instance name")
+	flag.StringVar(&webhooksFile, "webhooks-file", "", "JSON file listing webhooks to serve from this process, "+
+		"each for an external-dns of its own, with a name, baseURL, apiKey, apiSecret, domains, and optionally an ownerID "+
+		"and a listenAddress and pathPrefix to serve it at, defaulting to -listen-address and /. Webhooks sharing an "+
+		"address need a path prefix each. Replaces -base-url, -api-key, -api-secret and -domains. "+
+		"Journal, drift state and records backup files are suffixed with the webhook name, and metrics are labeled with it")
+	flag.StringVar(&ownerID, "owner-id", "", "Identifies this webhook, such as by its cluster name, where several "+
+		"share an OPNSense: logs, the User-Agent of API requests, soft-delete tags and metrics carry it")
+	flag.BoolVar(&zoneEndpoint, "zone-endpoint", false, "Serve the records listed, as zone file lines or JSON, "+
+		"at /zone on the metrics address, narrowed down to a domain with ?domain=. Exposes internal hostnames")
+	flag.StringVar(&seedRecordsFile, "seed-records-file", "", "Records file, in YAML or JSON, of records to create "+
+		"or update at startup and on SIGHUP, whatever external-dns plans. external-dns is kept from changing or deleting them")
+	flag.StringVar(&journalFile, "journal-file", "", "File to keep track of changes being applied in, so that changes "+
+		"interrupted by a restart are recovered from. Empty keeps track in memory only")
+	flag.StringVar(&backupPath, "backup-path", "", "File to back up the records to, as a records file, "+
+		"after every successful apply and every -backup-interval, to import them again should OPNSense lose them. Empty disables")
+	flag.DurationVar(&backupInterval, "backup-interval", time.Hour, "Back up the records to -backup-path "+
+		"this often, besides after applies. 0 only writes them after applies")
+	flag.IntVar(&backupKeep, "backup-keep", 5, "Number of previous backups to keep, as -backup-path.1 and so on")
+	// Backups were called snapshots at first, unrelated to -snapshot-max-age
+	flag.StringVar(&backupPath, "snapshot-path", "", "Deprecated, same as -backup-path")
+	flag.DurationVar(&backupInterval, "snapshot-interval", time.Hour, "Deprecated, same as -backup-interval")
+	flag.Var(&restoreNames, "name", "restore: DNS name of a soft-deleted record to enable again. Can be used multiple times")
+	flag.BoolVar(&restoreAll, "all", false, "restore: Enable every soft-deleted record again")
+	flag.BoolVar(&dryRun, "dry-run", false, "restore: Only list the records to enable again")
+	flag.StringVar(&diffFile, "file", "", "diff, import: Records file, in YAML or JSON, such as a backup, to compare "+
+		"the records in Unbound to, or to import. Without it, both exit with 2; failing to load or import it, import exits with 1 "+
+		"and diff with 2, as diff exits with 1 on differences")
+	flag.StringVar(&diffOutput, "output", "text", "diff: Output format, text or json")
+	flag.CommandLine.Parse(args)
+	flag.Visit(func(f *flag.Flag) {
+		if replacement, ok := map[string]string{"snapshot-path": "backup-path", "snapshot-interval": "backup-interval"}[f.Name]; ok {
+			slog.Warn("deprecated flag", slog.String("flag", "-"+f.Name), slog.String("use", "-"+replacement))
+		}
+	})
 
 	if baseURL == "" {
 		baseURL = os.Getenv("UNBOUND_BASE_URL")
@@ -44,36 +309,585 @@ func main() {
 		apiSecret = os.Getenv("UNBOUND_API_SECRET")
 	}
 
+	if fallbackBaseURL == "" {
+		fallbackBaseURL = os.Getenv("UNBOUND_FALLBACK_BASE_URL")
+	}
+
+	if fallbackAPIKey == "" {
+		fallbackAPIKey = os.Getenv("UNBOUND_FALLBACK_API_KEY")
+	}
+
+	if fallbackAPISecret == "" {
+		fallbackAPISecret = os.Getenv("UNBOUND_FALLBACK_API_SECRET")
+	}
+
 	if len(domains) == 0 {
 		domains = strings.Split(os.Getenv("UNBOUND_DOMAIN_FILTER"), ",")
 	}
 
-	if baseURL == "" {
+	if instancesFile == "" {
+		instancesFile = os.Getenv("UNBOUND_INSTANCES_FILE")
+	}
+
+	if webhooksFile == "" {
+		webhooksFile = os.Getenv("UNBOUND_WEBHOOKS_FILE")
+	}
+
+	if ownerID == "" {
+		ownerID = os.Getenv("UNBOUND_OWNER_ID")
+	}
+
+	if notifyURL == "" {
+		notifyURL = os.Getenv("UNBOUND_NOTIFY_URL")
+	}
+
+	if webhookAuthToken == "" && webhookAuthTokenFile == "" {
+		webhookAuthToken = os.Getenv("UNBOUND_WEBHOOK_AUTH_TOKEN")
+	}
+
+	var instances []provider.Instance
+	if instancesFile != "" {
+		var err error
+		if instances, err = provider.LoadInstances(instancesFile); err != nil {
+			slog.Error("failed to load -instances-file", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		if fallbackBaseURL != "" {
+			slog.Error("-fallback-base-url can't be used with -instances-file")
+			os.Exit(failed)
+		}
+		if credentialsCommand != "" || credentialsFile != "" {
+			slog.Error("-credentials-command and -api-credentials-file can't be used with -instances-file")
+			os.Exit(failed)
+		}
+	}
+
+	socketMode, err := strconv.ParseUint(listenSocketMode, 8, 32)
+	if err != nil || fs.FileMode(socketMode)&^fs.ModePerm != 0 {
+		slog.Error("invalid -listen-socket-mode, expected octal permissions such as 0660", slog.String("mode", listenSocketMode))
+		os.Exit(failed)
+	}
+	if listenSocket != "" {
+		listenAddress = webhook.UnixPrefix + listenSocket
+	}
+
+	// Sockets passed by systemd replace the ones of -listen-address and -metrics-address
+	webhookListener, metricsListener, err := webhook.ListenActivated()
+	if err != nil {
+		slog.Error("invalid sockets passed by systemd", slog.Any("error", err))
+		os.Exit(failed)
+	}
+	if webhookListener != nil {
+		slog.Info("serving the webhook API on the socket passed by systemd", slog.String("address", webhookListener.Addr().String()))
+	}
+	if metricsListener != nil {
+		slog.Info("serving metrics on the socket passed by systemd", slog.String("address", metricsListener.Addr().String()))
+	}
+
+	webhookTLS, err := loadServerTLS("webhook", webhookTLSCert, webhookTLSKey)
+	if err != nil {
+		slog.Error("invalid webhook TLS certificate", slog.Any("error", err))
+		os.Exit(failed)
+	}
+	metricsTLS, err := loadServerTLS("metrics", metricsTLSCert, metricsTLSKey)
+	if err != nil {
+		slog.Error("invalid metrics TLS certificate", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	authToken, err := loadAuthToken(webhookAuthToken, webhookAuthTokenFile)
+	if err != nil {
+		slog.Error("invalid webhook auth token", slog.Any("error", err))
+		os.Exit(failed)
+	}
+	var verifying time.Duration
+	if verifyRecords > 0 {
+		verifying = verifyWindow
+	}
+	writeTimeout, err := webhookWriteTimeoutFor(webhookWriteTimeout, applyTimeout, verifying)
+	if err != nil {
+		slog.Error("invalid -webhook-write-timeout", slog.Any("error", err))
+		os.Exit(failed)
+	}
+	timeouts := serverTimeouts{read: webhookReadTimeout, write: writeTimeout}
+
+	handlerOpts := []webhook.Option{
+		webhook.WithSlowRequestThreshold(slowRequestThreshold),
+		webhook.WithAuthToken(authToken),
+		webhook.WithMaxRequestSize(maxRequestSize),
+	}
+	if unprocessableValidation {
+		handlerOpts = append(handlerOpts, webhook.WithUnprocessableValidation())
+	}
+
+	var webhooks []webhookConfig
+	if webhooksFile != "" {
+		var err error
+		if webhooks, err = loadWebhooks(webhooksFile, listenAddress); err != nil {
+			slog.Error("failed to load -webhooks-file", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		switch {
+		case command != "serve":
+			slog.Error("-webhooks-file can only be used to serve webhooks, not with " + command)
+			os.Exit(failed)
+		case instancesFile != "":
+			slog.Error("-instances-file can't be used with -webhooks-file")
+			os.Exit(failed)
+		case fallbackBaseURL != "":
+			slog.Error("-fallback-base-url can't be used with -webhooks-file")
+			os.Exit(failed)
+		case credentialsCommand != "" || credentialsFile != "":
+			slog.Error("-credentials-command and -api-credentials-file can't be used with -webhooks-file")
+			os.Exit(failed)
+		case seedRecordsFile != "":
+			slog.Error("-seed-records-file can't be used with -webhooks-file")
+			os.Exit(failed)
+		case zoneEndpoint:
+			slog.Error("-zone-endpoint can't be used with -webhooks-file")
+			os.Exit(failed)
+		}
+	}
+
+	var credentials *provider.Credentials
+	switch {
+	case credentialsCommand != "" && credentialsFile != "":
+		slog.Error("-credentials-command can't be used with -api-credentials-file")
+		os.Exit(failed)
+	case credentialsCommand != "":
+		var err error
+		if credentials, err = provider.NewCredentialsCommand(credentialsCommand, credentialsTimeout); err != nil {
+			slog.Error("invalid -credentials-command", slog.Any("error", err))
+			os.Exit(failed)
+		}
+	case credentialsFile != "":
+		credentials = provider.NewCredentialsFile(credentialsFile)
+	}
+	if credentials != nil {
+		if err := credentials.Refresh(context.Background()); err != nil {
+			slog.Error("failed to get credentials", slog.Any("error", err))
+			os.Exit(failed)
+		}
+	}
+
+	if baseURL == "" && instances == nil && webhooks == nil {
 		slog.Error("-base-url or UNBOUND_BASE_URL is required")
-		os.Exit(1)
+		os.Exit(failed)
 	}
 
-	if apiKey == "" {
+	if apiKey == "" && instances == nil && webhooks == nil && credentials == nil {
 		slog.Error("-api-key or UNBOUND_API_KEY is required")
-		os.Exit(1)
+		os.Exit(failed)
 	}
 
-	if apiSecret == "" {
+	if apiSecret == "" && instances == nil && webhooks == nil && credentials == nil {
 		slog.Error("-api-secret or UNBOUND_API_SECRET is required")
-		os.Exit(1)
+		os.Exit(failed)
 	}
 
-	prov, err := provider.NewUnboundProvider(
-		baseURL,
-		apiKey,
-		apiSecret,
-		provider.WithInsecureClient(),
-		provider.WithDomainFilter(domains),
-	)
+	if ownerID != "" {
+		if err := provider.ValidateOwnerID(ownerID); err != nil {
+			slog.Error("invalid -owner-id", slog.Any("error", err))
+			os.Exit(failed)
+		}
+	}
+
+	if seedRecordsFile != "" {
+		if _, err := provider.LoadRecordsFile(seedRecordsFile); err != nil {
+			slog.Error("invalid -seed-records-file", slog.Any("error", err))
+			os.Exit(failed)
+		}
+	}
+
+	renames, err := provider.ParseRenameStrategy(renameStrategy)
+	if err != nil {
+		slog.Error("invalid -rename-strategy", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	readOnlyAnswer, err := provider.ParseReadOnlyResponse(readOnlyResponse)
+	if err != nil {
+		slog.Error("invalid -read-only-response", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	notifyEvents, err := provider.ParseNotifyEvents(notifyEventNames)
 	if err != nil {
-		slog.Error("failed to create Unbound provider", slog.Any("error", err))
+		slog.Error("invalid -notify-events", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	allowedTargets, err := provider.ParseCIDRs(allowedTargetCIDRs)
+	if err != nil {
+		slog.Error("invalid -allowed-target-cidrs", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	excluded, err := provider.ParseExcludePatterns(excludeRecordPatterns)
+	if err != nil {
+		slog.Error("invalid -exclude-record-regex", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	minTLSVersion, err := provider.ParseTLSVersion(tlsMinVersion)
+	if err != nil {
+		slog.Error("invalid -tls-min-version", slog.Any("error", err))
+		os.Exit(failed)
+	}
+
+	pins := make([]unbound.Pin, 0, len(tlsPins))
+	for _, s := range tlsPins {
+		pin, err := unbound.ParsePin(s)
+		if err != nil {
+			slog.Error("invalid -tls-pin-sha256", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		pins = append(pins, pin)
+	}
+
+	rewrites := make([]provider.TargetRewrite, 0, len(targetRewrites))
+	for _, s := range targetRewrites {
+		rewrite, err := provider.ParseTargetRewrite(s)
+		if err != nil {
+			slog.Error("invalid -target-rewrite", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+
+	opts := []provider.Option{
+		provider.WithOwnerID(ownerID),
+		provider.WithTLSServerName(tlsServerName),
+		provider.WithTLSPins(pins),
+		provider.WithTLSMinVersion(minTLSVersion),
+		provider.WithReconfigureDebounce(reconfigureDebounce),
+		provider.WithReconfigureFailureThreshold(reconfigureFailureThreshold),
+		provider.WithApplyFailureThreshold(applyFailureThreshold),
+		provider.WithDNSPort(dnsPort),
+		provider.WithCacheTTL(cacheTTL),
+		provider.WithServeStale(serveStaleMaxAge),
+		provider.WithListConcurrency(listConcurrency),
+		provider.WithMaxRecords(maxRecords),
+		provider.WithSnapshotReuse(snapshotMaxAge),
+		provider.WithApplyConcurrency(applyConcurrency),
+		provider.WithBulkApply(bulkApplyThreshold),
+		provider.WithRenameStrategy(renames),
+		provider.WithAllowedTargetCIDRs(allowedTargets),
+		provider.WithTargetRewrites(rewrites),
+		provider.WithExcludeRecords(excluded),
+		provider.WithMaxResponseSize(maxResponseSize),
+		provider.WithMaxInflight(maxInflight),
+		provider.WithBackgroundRefresh(refreshInterval),
+		provider.WithRetry(retryAttempts, retryBaseDelay, retryMaxDelay),
+		provider.WithLockMessages(lockMessages),
+		provider.WithPerCallTimeout(callTimeout),
+		provider.WithApplyTimeout(applyTimeout),
+		provider.WithOperationTimeouts(minOperationTimeout, maxOperationTimeout),
+		provider.WithSlowCallThreshold(slowCallThreshold),
+		provider.WithCircuitBreaker(circuitThreshold, circuitCooldown),
+		provider.WithJournalFile(journalFile),
+		provider.WithNotifications(notifyURL, notifyEvents, notifyLargeChange),
+		provider.WithRecordBackups(backupPath, backupInterval, backupKeep),
+	}
+
+	switch {
+	case tlsCAFile != "":
+		pem, err := os.ReadFile(tlsCAFile)
+		if err != nil {
+			slog.Error("failed to read -tls-ca-file", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			slog.Error("no certificates found in -tls-ca-file", slog.String("path", tlsCAFile))
+			os.Exit(failed)
+		}
+		opts = append(opts, provider.WithRootCAs(pool))
+	case tlsSkipVerify:
+		opts = append(opts, provider.WithInsecureClient())
+	}
+
+	if fallbackBaseURL != "" {
+		if fallbackAPIKey == "" {
+			fallbackAPIKey = apiKey
+		}
+		if fallbackAPISecret == "" {
+			fallbackAPISecret = apiSecret
+		}
+		opts = append(opts, provider.WithFallback(fallbackBaseURL, fallbackAPIKey, fallbackAPISecret))
+		if fallbackWrites {
+			opts = append(opts, provider.WithFallbackWrites())
+		}
+	}
+
+	if disableDeletes {
+		opts = append(opts, provider.WithDisableDeletes())
+	}
+
+	if fixDanglingAliases {
+		opts = append(opts, provider.WithFixDanglingAliases())
+	}
+
+	if minRecordAgeForDelete > 0 {
+		opts = append(opts, provider.WithMinRecordAgeForDelete(minRecordAgeForDelete))
+	}
+
+	if readOnly {
+		opts = append(opts, provider.WithReadOnly(readOnlyAnswer))
+	}
+
+	if resolveHostnameTargets {
+		opts = append(opts, provider.WithHostnameResolution(provider.NewResolver(resolverAddress), resolveTimeout, resolveCacheTTL))
+	}
+
+	if gcMaxAge > 0 {
+		opts = append(opts, provider.WithGarbageCollection(gcMaxAge))
+	}
+
+	if detectDrift {
+		opts = append(opts, provider.WithDriftDetection(driftStateFile))
+	}
+
+	if canaryInterval > 0 {
+		opts = append(opts, provider.WithCanary(canaryInterval, canaryTimeout, canaryDomain))
+	}
+
+	if verifyRecords > 0 {
+		opts = append(opts, provider.WithApplyVerification(verifyRecords, verifyWindow))
+		if verifyStrict {
+			opts = append(opts, provider.WithStrictVerification())
+		}
+	}
+
+	if softDelete {
+		opts = append(opts, provider.WithSoftDelete(softDeleteGrace))
+	}
+
+	if listFromSettings {
+		opts = append(opts, provider.WithSettingsListing())
+	}
+
+	if credentials != nil {
+		opts = append(opts, provider.WithCredentials(credentials))
+	}
+
+	if debugHTTP {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+		opts = append(opts, provider.WithDebugHTTP())
+	}
+
+	var served webhookSet
+	for _, wh := range webhooks {
+		whOpts := append(slices.Clone(opts),
+			provider.WithDomainFilter(wh.Domains),
+			provider.WithLogger(slog.Default().With(slog.String("webhook", wh.Name))),
+			provider.WithStateFileSuffix(wh.Name),
+			provider.WithWebhookName(wh.Name),
+		)
+		if wh.OwnerID != "" {
+			whOpts = append(whOpts, provider.WithOwnerID(wh.OwnerID))
+		}
+		// Each webhook runs its own canary, in a domain of its own
+		if canaryInterval > 0 && !endpoint.NewDomainFilter(wh.Domains).Match(canaryDomain) {
+			whOpts = append(whOpts, provider.WithCanary(canaryInterval, canaryTimeout, ""))
+		}
+		prov, err := provider.NewUnboundProvider(wh.BaseURL, wh.APIKey, wh.APISecret, whOpts...)
+		if err != nil {
+			slog.Error("failed to create Unbound provider", slog.String("webhook", wh.Name), slog.Any("error", err))
+			os.Exit(failed)
+		}
+		whHandlerOpts := append(slices.Clone(handlerOpts), webhook.WithPathPrefix(wh.PathPrefix), webhook.WithWebhookName(wh.Name))
+		served = append(served, &servedWebhook{
+			name:          wh.Name,
+			listenAddress: wh.ListenAddress,
+			pathPrefix:    wh.PathPrefix,
+			prov:          prov,
+			handler:       webhook.NewHandler(prov, whHandlerOpts...),
+		})
+	}
+
+	var prov webhookProvider
+	if webhooks == nil {
+		opts = append(opts, provider.WithDomainFilter(domains))
+		if instances != nil {
+			prov, err = provider.NewMultiProvider(instances, opts...)
+		} else {
+			prov, err = provider.NewUnboundProvider(baseURL, apiKey, apiSecret, opts...)
+		}
+		if err != nil {
+			slog.Error("failed to create Unbound provider", slog.Any("error", err))
+			os.Exit(failed)
+		}
+		served = webhookSet{{
+			listenAddress: listenAddress,
+			prov:          prov,
+			handler:       webhook.NewHandler(prov, handlerOpts...),
+		}}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A second signal ends the process right away, rather than after the shutdown grace
+	context.AfterFunc(ctx, stop)
+
+	switch command {
+	case "restore":
+		os.Exit(restore(ctx, prov, restoreNames, restoreAll, dryRun))
+	case "diff":
+		os.Exit(diff(ctx, prov, diffFile, diffOutput, os.Stdout))
+	case "import":
+		os.Exit(importRecords(ctx, prov, diffFile))
+	}
+
+	for _, wh := range served {
+		go wh.prov.RunRefresh(ctx)
+		go wh.prov.RunGC(ctx)
+		go wh.prov.RunBackups(ctx)
+
+		go func() {
+			err := wh.prov.WaitForOPNsense(ctx, startupTimeout, startupRetryInterval)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("failed to start", slog.Any("error", err))
+				os.Exit(1)
+			}
+			if err == nil && seedRecordsFile != "" {
+				seed(ctx, wh.prov, seedRecordsFile)
+			}
+			if err == nil {
+				wh.prov.RunCanary(ctx)
+			}
+		}()
+	}
+
+	var hangups []func(context.Context)
+	if credentials != nil {
+		hangups = append(hangups, func(ctx context.Context) {
+			if err := credentials.Refresh(ctx); err != nil {
+				slog.Error("failed to refresh credentials", slog.Any("error", err))
+				return
+			}
+			slog.Info("refreshed credentials")
+		})
+	}
+	if seedRecordsFile != "" {
+		hangups = append(hangups, func(ctx context.Context) { seed(ctx, prov, seedRecordsFile) })
+	}
+	if len(hangups) > 0 {
+		go onHangup(ctx, hangups...)
+	}
+
+	// A single webhook reports its own status, rather than as one of a set
+	var checked health.Provider = served
+	var canaryChecked health.Canary = served
+	if prov != nil {
+		checked, canaryChecked = prov, prov
+	}
+
+	metrics.SetBuildInfo(version, commit)
+	healthOpts := []health.Option{health.WithOwnerID(ownerID)}
+	if zoneEndpoint {
+		healthOpts = append(healthOpts, health.WithZoneExport(prov))
+	}
+	if canaryInterval > 0 {
+		healthOpts = append(healthOpts, health.WithCanaryCheck(canaryChecked))
+	}
+	if prov == nil {
+		healthOpts = append(healthOpts, health.WithWebhookMetrics(served.names()...))
+	}
+
+	go func() {
+		srv := &http.Server{Addr: metricsAddress, Handler: health.NewHandler(checked, healthOpts...), TLSConfig: metricsTLS}
+		var err error
+		switch {
+		case metricsListener != nil && metricsTLS != nil:
+			err = srv.ServeTLS(metricsListener, "", "")
+		case metricsListener != nil:
+			err = srv.Serve(metricsListener)
+		case metricsTLS != nil:
+			err = srv.ListenAndServeTLS("", "")
+		default:
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
+			slog.Error("health server failed", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}()
+
+	listen := func(address string) (net.Listener, error) {
+		if address == listenAddress && webhookListener != nil {
+			return webhookListener, nil
+		}
+		return webhook.Listen(address, fs.FileMode(socketMode))
+	}
+	if err := serveWebhooks(ctx, served, listen, webhookTLS, timeouts, shutdownGrace); err != nil {
+		slog.Error("webhook server failed", slog.Any("error", err))
 		os.Exit(1)
 	}
+}
 
-	api.StartHTTPApi(prov, nil, 5*time.Second, 5*time.Second, ":8888")
+// loadServerTLS returns the TLS configuration serving the pair in certFile and keyFile, for the server named,
+// or nil when neither is set.
+func loadServerTLS(server, certFile, keyFile string) (*tls.Config, error) {
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, fmt.Errorf("-%s-tls-cert and -%s-tls-key must be set together", server, server)
+	}
+	cert, err := servertls.Load(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Config(), nil
+}
+
+// loadAuthToken returns the webhook auth token set with -webhook-auth-token, or read from -webhook-auth-token-file.
+func loadAuthToken(token, file string) (string, error) {
+	if file == "" {
+		return token, nil
+	}
+	if token != "" {
+		return "", fmt.Errorf("-webhook-auth-token and -webhook-auth-token-file can't be set together")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read -webhook-auth-token-file: %w", err)
+	}
+	token = strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("-webhook-auth-token-file %s is empty", file)
+	}
+	return token, nil
+}
+
+// onHangup calls each of fns on every SIGHUP.
+func onHangup(ctx context.Context, fns ...func(context.Context)) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			for _, fn := range fns {
+				fn(ctx)
+			}
+		}
+	}
+}
+
+// seed seeds the records of the records file at path, logging failures: the webhook keeps serving
+// without them, and with the previous seeds if the file can't be loaded.
+func seed(ctx context.Context, prov webhookProvider, path string) {
+	seeds, err := provider.LoadRecordsFile(path)
+	if err != nil {
+		slog.Error("failed to load -seed-records-file", slog.Any("error", err))
+		return
+	}
+	if err := prov.Seed(ctx, seeds); err != nil {
+		slog.Error("failed to seed records", slog.Any("error", err))
+	}
 }
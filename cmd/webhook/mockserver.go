@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// mockServer serves a fake OPNsense, keeping records in memory, until ctx is done, and returns the exit code.
+func mockServer(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("mock-server", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8443", "Address to serve the OPNsense API on")
+	seedFile := flags.String("seed", "", "Records file, as for -seed-records-file, to start with")
+	useTLS := flags.Bool("tls", false, "Serve HTTPS with a self-signed certificate")
+	apiKey := flags.String("api-key", opnsensetest.DefaultAPIKey, "API key to accept")
+	apiSecret := flags.String("api-secret", opnsensetest.DefaultAPISecret, "API secret to accept")
+	version := flags.String("opnsense-version", opnsensetest.DefaultVersion, "OPNsense version to report")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	server := opnsensetest.NewUnstartedServer(opnsensetest.WithCredentials(*apiKey, *apiSecret), opnsensetest.WithVersion(*version))
+	if *seedFile != "" {
+		seeds, err := provider.LoadRecordsFile(*seedFile)
+		if err != nil {
+			slog.Error("failed to load seed records", slog.Any("error", err))
+			return 2
+		}
+		if err := seedMockServer(server, seeds); err != nil {
+			slog.Error("failed to seed records", slog.Any("error", err))
+			return 2
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		slog.Error("failed to listen", slog.String("address", *listen), slog.Any("error", err))
+		return 1
+	}
+	server.Listener.Close()
+	server.Listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/", server.Config.Handler)
+	mux.HandleFunc("GET /dump", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(dumpMockServer(server))
+	})
+	server.Config.Handler = mux
+
+	if *useTLS {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	slog.Info("serving a mock OPNsense",
+		slog.String("url", server.URL),
+		slog.String("apiKey", *apiKey),
+		slog.String("apiSecret", *apiSecret),
+		slog.String("dump", server.URL+"/dump"),
+	)
+
+	<-ctx.Done()
+	server.Close()
+	return 0
+}
+
+// seedMockServer adds a host override for every target of the A records of seeds, and an alias
+// for every CNAME record, of the first host override of its target.
+func seedMockServer(server *opnsensetest.Server, seeds []*endpoint.Endpoint) error {
+	hosts := map[string]unbound.HostOverrideID{}
+	for _, ep := range seeds {
+		if ep.RecordType != endpoint.RecordTypeA {
+			continue
+		}
+		for _, target := range ep.Targets {
+			single := *ep
+			single.Targets = endpoint.Targets{target}
+			var ho unbound.HostOverride
+			ho.Update(&single)
+			ho = server.AddHostOverride(ho)
+			if _, ok := hosts[state.Normalize(ep.DNSName)]; !ok {
+				hosts[state.Normalize(ep.DNSName)] = ho.ID
+			}
+		}
+	}
+
+	for _, ep := range seeds {
+		if ep.RecordType != endpoint.RecordTypeCNAME {
+			continue
+		}
+		hostID, ok := hosts[state.Normalize(ep.Targets[0])]
+		if !ok {
+			return fmt.Errorf("record %s: target %s is not an A record of the file", ep.DNSName, ep.Targets[0])
+		}
+		ha := unbound.HostAlias{HostID: hostID}
+		ha.Update(ep)
+		server.AddHostAlias(ha)
+	}
+	return nil
+}
+
+// mockRecord is a record of the mock server, as /dump lists it.
+type mockRecord struct {
+	ID          string `json:"uuid"`
+	Enabled     bool   `json:"enabled"`
+	DNSName     string `json:"dnsName"`
+	RecordType  string `json:"recordType"`
+	Target      string `json:"target"`
+	Description string `json:"description,omitempty"`
+}
+
+type mockDump struct {
+	Records   []mockRecord `json:"records"`
+	Unapplied bool         `json:"unapplied"`
+}
+
+func dumpMockServer(server *opnsensetest.Server) mockDump {
+	dump := mockDump{Records: []mockRecord{}, Unapplied: server.Unapplied()}
+	for _, ho := range server.HostOverrides() {
+		dump.Records = append(dump.Records, mockRecord{
+			ID: string(ho.ID), Enabled: ho.Enabled == "1", DNSName: ho.DNSName(), RecordType: endpoint.RecordTypeA,
+			Target: ho.Server, Description: ho.Description,
+		})
+	}
+	for _, ha := range server.HostAliases() {
+		dump.Records = append(dump.Records, mockRecord{
+			ID: string(ha.ID), Enabled: ha.Enabled == "1", DNSName: ha.DNSName(), RecordType: endpoint.RecordTypeCNAME,
+			Target: ha.Host, Description: ha.Description,
+		})
+	}
+	return dump
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestMockServer(t *testing.T) {
+	seeds := filepath.Join(t.TempDir(), "records.yaml")
+	require.NoError(t, os.WriteFile(seeds, []byte(`
+records:
+  - dnsName: nas.example.com
+    recordType: A
+    targets: [192.168.1.10]
+  - dnsName: files.example.com
+    recordType: CNAME
+    targets: [nas.example.com]
+`), 0o600))
+
+	// A free port, as mockServer listens on the address it is given
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	serving, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	exited := make(chan int, 1)
+	go func() { exited <- mockServer(serving, []string{"-listen", address, "-seed", seeds}) }()
+
+	url := "http://" + address
+	dump := func(t *testing.T) mockDump {
+		res, err := http.Get(url + "/dump")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var d mockDump
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&d))
+		return d
+	}
+	require.Eventually(t, func() bool {
+		res, err := http.Get(url + "/dump")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p, err := provider.NewUnboundProvider(url, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret,
+		provider.WithDomainFilter([]string{"example.com"}))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	t.Run("serves the records seeded", func(t *testing.T) {
+		records, err := p.Records(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"nas.example.com A 192.168.1.10", "files.example.com CNAME nas.example.com"},
+			recordStrings(records))
+	})
+
+	t.Run("applies changes", func(t *testing.T) {
+		require.NoError(t, p.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("printer.example.com", endpoint.RecordTypeA, "192.168.1.30")},
+			Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com")},
+		}))
+
+		records, err := p.Records(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"nas.example.com A 192.168.1.10", "printer.example.com A 192.168.1.30"},
+			recordStrings(records))
+
+		d := dump(t)
+		require.False(t, d.Unapplied, "Unbound is reconfigured")
+		require.Len(t, d.Records, 2)
+	})
+
+	t.Run("exits once canceled", func(t *testing.T) {
+		cancel()
+		select {
+		case code := <-exited:
+			require.Equal(t, 0, code)
+		case <-time.After(5 * time.Second):
+			t.Fatal("mockServer didn't exit")
+		}
+	})
+}
+
+func TestMockServerFlags(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, 2, mockServer(ctx, []string{"-unknown"}))
+	require.Equal(t, 2, mockServer(ctx, []string{"-seed", filepath.Join(t.TempDir(), "missing.yaml")}))
+}
+
+// recordStrings returns records as "name type targets" strings.
+func recordStrings(records []*endpoint.Endpoint) []string {
+	var s []string
+	for _, ep := range records {
+		s = append(s, ep.DNSName+" "+ep.RecordType+" "+ep.Targets.String())
+	}
+	return s
+}
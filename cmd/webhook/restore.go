@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+)
+
+// restore enables soft-deleted records again, logging each of them, and returns the exit code.
+func restore(ctx context.Context, prov webhookProvider, names []string, all, dryRun bool) int {
+	if all == (len(names) > 0) {
+		slog.Error("restore requires either -name or -all")
+		return 2
+	}
+
+	restored, err := prov.Restore(ctx, names, dryRun)
+	msg := "restored record"
+	if dryRun {
+		msg = "would restore record"
+	}
+	for _, r := range restored {
+		slog.Info(msg, recordAttrs(r)...)
+	}
+	if err != nil {
+		slog.Error("failed to restore records", slog.Any("error", err))
+		return 1
+	}
+	slog.Info("restore done", slog.Int("total", len(restored)), slog.Bool("dryRun", dryRun))
+	return 0
+}
+
+func recordAttrs(r provider.RestoredRecord) []any {
+	attrs := []any{slog.String("dnsName", r.DNSName), slog.String("recordType", r.RecordType)}
+	if r.Instance != "" {
+		attrs = append(attrs, slog.String("instance", r.Instance))
+	}
+	return attrs
+}
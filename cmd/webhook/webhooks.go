@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"golang.org/x/sync/errgroup"
+)
+
+// webhookConfig is a webhook served next to others by the same process, for an external-dns of its own,
+// with the OPNsense, credentials and domains of its own.
+type webhookConfig struct {
+	// Name tells webhooks apart in logs and status, and suffixes their journal and drift state files
+	Name string `json:"name"`
+	// ListenAddress defaults to -listen-address
+	ListenAddress string `json:"listenAddress"`
+	// PathPrefix is where the webhook API is served on its address, such as /cluster-a. Empty serves it at /,
+	// in which case the webhook is alone on its address
+	PathPrefix string `json:"pathPrefix"`
+	// OwnerID defaults to -owner-id
+	OwnerID   string   `json:"ownerID"`
+	BaseURL   string   `json:"baseURL"`
+	APIKey    string   `json:"apiKey"`
+	APISecret string   `json:"apiSecret"`
+	Domains   []string `json:"domains"`
+}
+
+// loadWebhooks reads a JSON list of webhooks from the file at path, defaulting their listen address to listenAddress.
+func loadWebhooks(path, listenAddress string) ([]webhookConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var webhooks []webhookConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&webhooks); err != nil {
+		return nil, fmt.Errorf("failed to read webhooks from %s: %w", path, err)
+	}
+	for i := range webhooks {
+		if webhooks[i].ListenAddress == "" {
+			webhooks[i].ListenAddress = listenAddress
+		}
+		webhooks[i].PathPrefix = strings.TrimSuffix(webhooks[i].PathPrefix, "/")
+	}
+	if err := validateWebhooks(webhooks); err != nil {
+		return nil, fmt.Errorf("invalid webhooks in %s: %w", path, err)
+	}
+	return webhooks, nil
+}
+
+func validateWebhooks(webhooks []webhookConfig) error {
+	if len(webhooks) == 0 {
+		return errors.New("no webhooks")
+	}
+
+	names := map[string]bool{}
+	shared := map[string][]webhookConfig{}
+	for i, wh := range webhooks {
+		switch {
+		case wh.Name == "":
+			return fmt.Errorf("webhook %d has no name", i)
+		case names[wh.Name]:
+			return fmt.Errorf("webhook %s is defined twice", wh.Name)
+		case wh.BaseURL == "" || wh.APIKey == "" || wh.APISecret == "":
+			return fmt.Errorf("webhook %s needs a base URL, an API key and an API secret", wh.Name)
+		case len(wh.Domains) == 0:
+			return fmt.Errorf("webhook %s has no domains", wh.Name)
+		case wh.PathPrefix != "" && !strings.HasPrefix(wh.PathPrefix, "/"):
+			return fmt.Errorf("webhook %s has a path prefix not starting with /", wh.Name)
+		}
+		if wh.OwnerID != "" {
+			if err := provider.ValidateOwnerID(wh.OwnerID); err != nil {
+				return fmt.Errorf("webhook %s: %w", wh.Name, err)
+			}
+		}
+		for _, other := range shared[wh.ListenAddress] {
+			switch {
+			case other.PathPrefix == wh.PathPrefix:
+				return fmt.Errorf("webhooks %s and %s are both served at %s%s", other.Name, wh.Name, wh.ListenAddress, wh.PathPrefix)
+			case other.PathPrefix == "" || wh.PathPrefix == "":
+				return fmt.Errorf("webhooks %s and %s share %s, so both need a path prefix", other.Name, wh.Name, wh.ListenAddress)
+			}
+		}
+		names[wh.Name] = true
+		shared[wh.ListenAddress] = append(shared[wh.ListenAddress], wh)
+	}
+	return nil
+}
+
+// servedWebhook is a webhook the process serves, with its provider.
+type servedWebhook struct {
+	name          string
+	listenAddress string
+	pathPrefix    string
+	prov          webhookProvider
+	handler       http.Handler
+}
+
+// webhookSet is what the health server checks of every webhook the process serves.
+type webhookSet []*servedWebhook
+
+// names returns the name of every webhook.
+func (s webhookSet) names() []string {
+	names := make([]string, 0, len(s))
+	for _, wh := range s {
+		names = append(names, wh.name)
+	}
+	return names
+}
+
+// Ready returns an error when any webhook isn't ready.
+func (s webhookSet) Ready() error {
+	var errs []error
+	for _, wh := range s {
+		if err := wh.prov.Ready(); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", wh.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the status of every webhook, by name.
+func (s webhookSet) Status() provider.Status {
+	status := provider.Status{Webhooks: make(map[string]provider.Status, len(s))}
+	for _, wh := range s {
+		status.Webhooks[wh.name] = wh.prov.Status()
+	}
+	return status
+}
+
+// CanaryReady returns an error when the last canary run of any webhook failed.
+func (s webhookSet) CanaryReady() error {
+	var errs []error
+	for _, wh := range s {
+		if err := wh.prov.CanaryReady(); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", wh.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts every webhook's provider down, see provider.unboundProvider.Shutdown.
+func (s webhookSet) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, wh := range s {
+		if err := wh.prov.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", wh.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// answerTimeout is how long answering a webhook request takes besides applying and verifying changes, such as
+// listing records to apply them against.
+const answerTimeout = 5 * time.Second
+
+// serverTimeouts are the timeouts of the webhook servers, see http.Server.
+type serverTimeouts struct {
+	read, write time.Duration
+}
+
+// webhookWriteTimeoutFor returns the write timeout of the webhook servers: write, or if 0, long enough to apply
+// changes for applyTimeout and verify them for verifyWindow, 0 if verification is disabled. Without an apply
+// timeout, applies aren't bounded, and neither are answers. It fails if write doesn't cover them.
+func webhookWriteTimeoutFor(write, applyTimeout, verifyWindow time.Duration) (time.Duration, error) {
+	if write == 0 {
+		if applyTimeout == 0 {
+			return 0, nil
+		}
+		return applyTimeout + verifyWindow + answerTimeout, nil
+	}
+	if write <= applyTimeout+verifyWindow {
+		return 0, fmt.Errorf("%s doesn't cover -apply-timeout %s and -verify-window %s of the apply it answers",
+			write, applyTimeout, verifyWindow)
+	}
+	return write, nil
+}
+
+// serveWebhooks serves every webhook, with a server per listen address, until ctx is done or a server fails.
+// Either way the servers stop accepting requests, and those in flight, applies included, get grace to finish,
+// after which they are canceled and waited for. Then the providers reconfigure Unbound for the changes they
+// saved, within the same grace unless it ran out. Each listen address is listened on with listen. Webhooks
+// are served over HTTPS with tlsConfig, if any, and with timeouts.
+func serveWebhooks(ctx context.Context, webhooks webhookSet, listen func(address string) (net.Listener, error),
+	tlsConfig *tls.Config, timeouts serverTimeouts, grace time.Duration) error {
+	var addresses []string
+	handlers := map[string]*http.ServeMux{}
+	for _, wh := range webhooks {
+		mux := handlers[wh.listenAddress]
+		if mux == nil {
+			mux = http.NewServeMux()
+			handlers[wh.listenAddress] = mux
+			addresses = append(addresses, wh.listenAddress)
+		}
+		if wh.pathPrefix == "" {
+			mux.Handle("/", wh.handler)
+			continue
+		}
+		mux.Handle(wh.pathPrefix, wh.handler)
+		mux.Handle(wh.pathPrefix+"/", wh.handler)
+	}
+
+	// Requests, and the applies they make, are canceled once the shutdown grace runs out
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	g, served := errgroup.WithContext(ctx)
+	servers := make([]*http.Server, 0, len(addresses))
+	for _, address := range addresses {
+		srv := &http.Server{
+			Addr:         address,
+			Handler:      handlers[address],
+			ReadTimeout:  timeouts.read,
+			WriteTimeout: timeouts.write,
+			BaseContext:  func(net.Listener) context.Context { return requests },
+		}
+		servers = append(servers, srv)
+		g.Go(func() error {
+			l, err := listen(address)
+			if err != nil {
+				return fmt.Errorf("%s: %w", address, err)
+			}
+			if tlsConfig != nil {
+				l = tls.NewListener(l, tlsConfig)
+			}
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("%s: %w", address, err)
+			}
+			return nil
+		})
+	}
+
+	<-served.Done()
+	slog.Info("shutting down", slog.Duration("grace", grace))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("webhook server didn't shut down cleanly", slog.String("address", srv.Addr), slog.Any("error", err))
+			}
+		}()
+	}
+	wg.Wait()
+	cancelRequests()
+	err := g.Wait()
+
+	// Applies canceled for running out of grace stop between operations, then reconfigure Unbound for the
+	// changes they made. They are waited for, rather than left running against OPNsense as the process exits.
+	// A second signal still ends the process right away
+	stopping := shutdownCtx
+	if shutdownCtx.Err() != nil {
+		slog.Warn("shutdown grace ran out, waiting for the requests in flight to stop")
+		stopping = context.Background()
+	}
+	if err := webhooks.Shutdown(stopping); err != nil {
+		slog.Warn("webhook didn't shut down cleanly", slog.Any("error", err))
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/webhook"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// fakeProvider is a webhook provider with canned answers. Methods not overridden panic.
+type fakeProvider struct {
+	webhookProvider
+	ready, canaryReady error
+	status             provider.Status
+	shutdown           error
+	shutDown           bool
+	records            []*endpoint.Endpoint
+	recordsErr         error
+	seeded             []*endpoint.Endpoint
+	seedErr            error
+}
+
+func (p *fakeProvider) Seed(_ context.Context, seeds []*endpoint.Endpoint) error {
+	p.seeded = seeds
+	return p.seedErr
+}
+
+func (p *fakeProvider) Records(context.Context) ([]*endpoint.Endpoint, error) {
+	return p.records, p.recordsErr
+}
+
+func (p *fakeProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	return endpoints, nil
+}
+
+func (p *fakeProvider) GetDomainFilter() endpoint.DomainFilter { return endpoint.DomainFilter{} }
+
+func (p *fakeProvider) Ready() error            { return p.ready }
+func (p *fakeProvider) CanaryReady() error      { return p.canaryReady }
+func (p *fakeProvider) Status() provider.Status { return p.status }
+
+func (p *fakeProvider) Shutdown(context.Context) error {
+	p.shutDown = true
+	return p.shutdown
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	const listenAddress = ":8888"
+	for _, tc := range []struct {
+		name    string
+		file    string
+		want    []webhookConfig
+		wantErr string
+	}{
+		{
+			name: "defaults the listen address and trims the path prefix",
+			file: `[
+				{"name": "a", "pathPrefix": "/a/", "baseURL": "https://o", "apiKey": "k", "apiSecret": "s", "domains": ["a"]},
+				{"name": "b", "pathPrefix": "/b", "baseURL": "https://o", "apiKey": "k", "apiSecret": "s", "domains": ["b"]},
+				{"name": "c", "listenAddress": ":8889", "ownerID": "c", "baseURL": "https://o", "apiKey": "k", "apiSecret": "s", "domains": ["c"]}
+			]`,
+			want: []webhookConfig{
+				{Name: "a", ListenAddress: listenAddress, PathPrefix: "/a", BaseURL: "https://o", APIKey: "k", APISecret: "s", Domains: []string{"a"}},
+				{Name: "b", ListenAddress: listenAddress, PathPrefix: "/b", BaseURL: "https://o", APIKey: "k", APISecret: "s", Domains: []string{"b"}},
+				{Name: "c", ListenAddress: ":8889", OwnerID: "c", BaseURL: "https://o", APIKey: "k", APISecret: "s", Domains: []string{"c"}},
+			},
+		},
+		{
+			name: "webhooks sharing the default listen address without a path prefix",
+			file: `[
+				{"name": "a", "baseURL": "https://o", "apiKey": "k", "apiSecret": "s", "domains": ["a"]},
+				{"name": "b", "baseURL": "https://o", "apiKey": "k", "apiSecret": "s", "domains": ["b"]}
+			]`,
+			wantErr: "webhooks a and b are both served at :8888",
+		},
+		{name: "unknown fields", file: `[{"name": "a", "domain": "a.example"}]`, wantErr: `unknown field "domain"`},
+		{name: "not a list", file: `{"name": "a"}`, wantErr: "failed to read webhooks"},
+		{name: "empty", file: `[]`, wantErr: "no webhooks"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "webhooks.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.file), 0o600))
+
+			got, err := loadWebhooks(path, listenAddress)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := loadWebhooks(filepath.Join(t.TempDir(), "webhooks.json"), listenAddress)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	webhook := func(name, listenAddress, pathPrefix string) webhookConfig {
+		return webhookConfig{
+			Name: name, ListenAddress: listenAddress, PathPrefix: pathPrefix,
+			BaseURL: "https://opnsense.example", APIKey: "key", APISecret: "secret", Domains: []string{"example.com"},
+		}
+	}
+	withOwner := func(wh webhookConfig, ownerID string) webhookConfig {
+		wh.OwnerID = ownerID
+		return wh
+	}
+
+	for _, tc := range []struct {
+		name     string
+		webhooks []webhookConfig
+		wantErr  string
+	}{
+		{name: "one webhook", webhooks: []webhookConfig{webhook("a", ":8888", "")}},
+		{name: "webhooks on ports of their own", webhooks: []webhookConfig{webhook("a", ":8888", ""), webhook("b", ":8889", "")}},
+		{name: "webhooks sharing a port under path prefixes",
+			webhooks: []webhookConfig{webhook("a", ":8888", "/a"), webhook("b", ":8888", "/b"), webhook("c", ":8889", "")}},
+		{name: "webhooks with owner IDs",
+			webhooks: []webhookConfig{withOwner(webhook("a", ":8888", ""), "cluster-a"), withOwner(webhook("b", ":8889", ""), "cluster_b.2")}},
+		{name: "none", wantErr: "no webhooks"},
+		{name: "no name", webhooks: []webhookConfig{webhook("a", ":8888", ""), webhook("", ":8889", "")}, wantErr: "webhook 1 has no name"},
+		{name: "duplicate names", webhooks: []webhookConfig{webhook("a", ":8888", ""), webhook("a", ":8889", "")},
+			wantErr: "webhook a is defined twice"},
+		{name: "duplicate ports", webhooks: []webhookConfig{webhook("a", ":8888", ""), webhook("b", ":8888", "")},
+			wantErr: "webhooks a and b are both served at :8888"},
+		{name: "duplicate path prefixes on a port", webhooks: []webhookConfig{webhook("a", ":8888", "/dns"), webhook("b", ":8888", "/dns")},
+			wantErr: "webhooks a and b are both served at :8888/dns"},
+		{name: "a port shared with a webhook without a path prefix",
+			webhooks: []webhookConfig{webhook("a", ":8888", ""), webhook("b", ":8888", "/b")},
+			wantErr:  "webhooks a and b share :8888, so both need a path prefix"},
+		{name: "a path prefix not starting with /", webhooks: []webhookConfig{webhook("a", ":8888", "a")},
+			wantErr: "webhook a has a path prefix not starting with /"},
+		{name: "no credentials", webhooks: []webhookConfig{{Name: "a", BaseURL: "https://opnsense.example", Domains: []string{"example.com"}}},
+			wantErr: "webhook a needs a base URL, an API key and an API secret"},
+		{name: "no domains", webhooks: []webhookConfig{{Name: "a", BaseURL: "https://opnsense.example", APIKey: "key", APISecret: "secret"}},
+			wantErr: "webhook a has no domains"},
+		{name: "an owner ID with spaces", webhooks: []webhookConfig{withOwner(webhook("a", ":8888", ""), "cluster a")},
+			wantErr: `webhook a: invalid owner ID "cluster a"`},
+		{name: "an owner ID starting with a dash", webhooks: []webhookConfig{withOwner(webhook("a", ":8888", ""), "-a")},
+			wantErr: `webhook a: invalid owner ID "-a"`},
+		{name: "an owner ID too long", webhooks: []webhookConfig{withOwner(webhook("a", ":8888", ""), strings.Repeat("a", 64))},
+			wantErr: "webhook a: invalid owner ID"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateWebhooks(tc.webhooks)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestWebhookSet(t *testing.T) {
+	a := &fakeProvider{status: provider.Status{OPNsenseVersion: "24.7"}}
+	b := &fakeProvider{status: provider.Status{OPNsenseVersion: "24.1", ReadOnly: true}}
+	webhooks := webhookSet{{name: "a", prov: a}, {name: "b", prov: b}}
+
+	t.Run("names", func(t *testing.T) {
+		require.Equal(t, []string{"a", "b"}, webhooks.names())
+	})
+
+	t.Run("ready when every webhook is", func(t *testing.T) {
+		require.NoError(t, webhooks.Ready())
+		require.NoError(t, webhooks.CanaryReady())
+	})
+
+	t.Run("not ready while any webhook isn't, naming it", func(t *testing.T) {
+		b.ready, b.canaryReady = errors.New("OPNsense unreachable"), errors.New("canary failed")
+		t.Cleanup(func() { b.ready, b.canaryReady = nil, nil })
+
+		require.EqualError(t, webhooks.Ready(), "webhook b: OPNsense unreachable")
+		require.EqualError(t, webhooks.CanaryReady(), "webhook b: canary failed")
+
+		a.ready = errors.New("not synced yet")
+		t.Cleanup(func() { a.ready = nil })
+		require.EqualError(t, webhooks.Ready(), "webhook a: not synced yet\nwebhook b: OPNsense unreachable")
+	})
+
+	t.Run("status of every webhook by name", func(t *testing.T) {
+		require.Equal(t, provider.Status{Webhooks: map[string]provider.Status{"a": a.status, "b": b.status}}, webhooks.Status())
+	})
+
+	t.Run("shuts every webhook down, even past one failing to", func(t *testing.T) {
+		a.shutdown = errors.New("reconfigure failed")
+		require.EqualError(t, webhooks.Shutdown(context.Background()), "webhook a: reconfigure failed")
+		require.True(t, a.shutDown)
+		require.True(t, b.shutDown)
+	})
+}
+
+func TestServeWebhooks(t *testing.T) {
+	// serve serves a webhook for opnsense with serveWebhooks until SIGTERM, returning its URL and what
+	// serveWebhooks returns
+	serve := func(t *testing.T, opnsense *opnsensetest.Server, grace time.Duration) (string, <-chan error) {
+		t.Helper()
+
+		p, err := provider.NewUnboundProvider(opnsense.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret)
+		require.NoError(t, err)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+		t.Cleanup(stop)
+
+		webhooks := webhookSet{{name: "test", listenAddress: l.Addr().String(), prov: p, handler: webhook.NewHandler(p)}}
+		served := make(chan error, 1)
+		go func() {
+			served <- serveWebhooks(ctx, webhooks, func(string) (net.Listener, error) { return l, nil }, nil, serverTimeouts{}, grace)
+		}()
+		return "http://" + l.Addr().String(), served
+	}
+
+	// apply posts a plan creating n records to url, returning the status answered, or 0 on failure
+	apply := func(url string, n int) <-chan int {
+		var creates []string
+		for i := 1; i <= n; i++ {
+			creates = append(creates, fmt.Sprintf(`{"dnsName":"r%d.example.com","recordType":"A","targets":["10.0.0.%d"]}`, i, i))
+		}
+		answered := make(chan int, 1)
+		go func() {
+			res, err := http.Post(url+"/records", "application/json", strings.NewReader(`{"Create":[`+strings.Join(creates, ",")+`]}`))
+			if err != nil {
+				answered <- 0
+				return
+			}
+			res.Body.Close()
+			answered <- res.StatusCode
+		}()
+		return answered
+	}
+
+	sigtermWhileApplying := func(t *testing.T, opnsense *opnsensetest.Server) {
+		t.Helper()
+		require.Eventually(t, func() bool { return opnsense.Calls("addHostOverride") > 0 }, 5*time.Second, time.Millisecond)
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	}
+
+	t.Run("lets the apply in flight finish within the grace", func(t *testing.T) {
+		opnsense := opnsensetest.NewServer()
+		t.Cleanup(opnsense.Close)
+		opnsense.InjectFault("addHostOverride", opnsensetest.Fault{Delay: 20 * time.Millisecond})
+
+		url, served := serve(t, opnsense, 10*time.Second)
+		answered := apply(url, 5)
+		sigtermWhileApplying(t, opnsense)
+
+		require.NoError(t, <-served)
+		require.Equal(t, http.StatusNoContent, <-answered)
+		require.Len(t, opnsense.HostOverrides(), 5)
+		require.False(t, opnsense.Unapplied(), "Unbound is reconfigured before returning")
+	})
+
+	t.Run("cancels the apply in flight once the grace runs out, and waits for it to stop", func(t *testing.T) {
+		opnsense := opnsensetest.NewServer()
+		t.Cleanup(opnsense.Close)
+		// Two records are created within the grace, the third is canceled
+		opnsense.InjectFault("addHostOverride", opnsensetest.Fault{Delay: 200 * time.Millisecond})
+		opnsense.InjectFault("reconfigure", opnsensetest.Fault{Delay: 200 * time.Millisecond})
+
+		url, served := serve(t, opnsense, 500*time.Millisecond)
+		answered := apply(url, 5)
+		sigtermWhileApplying(t, opnsense)
+
+		require.NoError(t, <-served)
+		calls := opnsense.Calls("addHostOverride")
+		require.NotEmpty(t, opnsense.HostOverrides())
+		require.Less(t, len(opnsense.HostOverrides()), 5)
+		require.False(t, opnsense.Unapplied(), "Unbound is reconfigured for the changes made before returning")
+
+		<-answered
+		time.Sleep(400 * time.Millisecond)
+		require.Equal(t, calls, opnsense.Calls("addHostOverride"), "no change is made once serveWebhooks returned")
+	})
+}
+
+func TestWebhookWriteTimeoutFor(t *testing.T) {
+	for _, tc := range []struct {
+		name                              string
+		write, applyTimeout, verifyWindow time.Duration
+		want                              time.Duration
+		wantErr                           bool
+	}{
+		{name: "disabled for applies without a timeout", want: 0},
+		{name: "disabled for verified applies without a timeout", verifyWindow: 10 * time.Second, want: 0},
+		{name: "covers the apply timeout", applyTimeout: time.Minute, want: time.Minute + answerTimeout},
+		{name: "covers the apply timeout and verify window", applyTimeout: time.Minute, verifyWindow: 10 * time.Second,
+			want: time.Minute + 10*time.Second + answerTimeout},
+		{name: "as set", write: 2 * time.Minute, applyTimeout: time.Minute, verifyWindow: 10 * time.Second, want: 2 * time.Minute},
+		{name: "set shorter than the verify window", write: 5 * time.Second, verifyWindow: 10 * time.Second, wantErr: true},
+		{name: "set shorter than the apply timeout", write: 30 * time.Second, applyTimeout: time.Minute, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := webhookWriteTimeoutFor(tc.write, tc.applyTimeout, tc.verifyWindow)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+)
+
+// Provider is what the health server needs to know about the provider.
+type Provider interface {
+	Ready() error
+	Status() provider.Status
+}
+
+// Canary is what the canary check needs of the provider.
+type Canary interface {
+	CanaryReady() error
+}
+
+type config struct {
+	metricLabels prometheus.Labels
+	webhooks     []string
+	zone         Zone
+	canary       Canary
+}
+
+type Option func(*config)
+
+// WithOwnerID labels every metric with owner_id=id, to tell apart the webhooks of several clusters
+// sharing an OPNsense.
+func WithOwnerID(id string) Option {
+	return func(c *config) {
+		if id != "" {
+			c.metricLabels = prometheus.Labels{"owner_id": id}
+		}
+	}
+}
+
+// WithWebhookMetrics serves the metrics of each of the webhooks named, labeled with webhook=name, instead
+// of those of the single webhook of the process.
+func WithWebhookMetrics(names ...string) Option {
+	return func(c *config) {
+		c.webhooks = names
+	}
+}
+
+// WithCanaryCheck serves /canaryz, failing while the last canary run of c failed. It is apart from /readyz,
+// as a failing canary doesn't keep external-dns from working.
+func WithCanaryCheck(c Canary) Option {
+	return func(cfg *config) {
+		cfg.canary = c
+	}
+}
+
+// NewHandler serves metrics, health checks and operational status for p.
+func NewHandler(p Provider, opts ...Option) http.Handler {
+	var config config
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(config.metricLabels, config.webhooks...))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p.Status())
+	})
+	if config.canary != nil {
+		mux.HandleFunc("/canaryz", func(w http.ResponseWriter, r *http.Request) {
+			if err := config.canary.CanaryReady(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
+	if config.zone != nil {
+		mux.HandleFunc("/zone", zoneHandler(config.zone))
+	}
+	return mux
+}
@@ -0,0 +1,164 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/health"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+)
+
+type fakeProvider struct {
+	readyErr error
+	status   provider.Status
+}
+
+func (f *fakeProvider) Ready() error {
+	return f.readyErr
+}
+
+func (f *fakeProvider) Status() provider.Status {
+	return f.status
+}
+
+func TestReadyz(t *testing.T) {
+	t.Run("reports ready", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("reports not ready with the reason", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{readyErr: errors.New("reconfigure failed")}).
+			ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Contains(t, w.Body.String(), "reconfigure failed")
+	})
+}
+
+type fakeCanary struct {
+	err error
+}
+
+func (f *fakeCanary) CanaryReady() error {
+	return f.err
+}
+
+func TestCanaryz(t *testing.T) {
+	t.Run("reports the canary working", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}, health.WithCanaryCheck(&fakeCanary{})).
+			ServeHTTP(w, httptest.NewRequest("GET", "/canaryz", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("reports the canary failing apart from readiness", func(t *testing.T) {
+		handler := health.NewHandler(&fakeProvider{}, health.WithCanaryCheck(&fakeCanary{err: errors.New("canary not served")}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/canaryz", nil))
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Contains(t, w.Body.String(), "canary not served")
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestStatus(t *testing.T) {
+	t.Run("serves the provider status as JSON", func(t *testing.T) {
+		now := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+		p := &fakeProvider{
+			status: provider.Status{
+				LastRecords: &provider.RecordsStatus{
+					SyncStatus: provider.SyncStatus{Time: now, Duration: "1s", Success: true},
+					Records:    3,
+				},
+				LastApply: &provider.ApplyStatus{
+					SyncStatus: provider.SyncStatus{Time: now, Duration: "2s", Error: "boom"},
+					Created:    map[string]int{"A": 1},
+				},
+				LastError:          "boom",
+				OPNsenseVersion:    "24.7.1",
+				ReconfigurePending: true,
+			},
+		}
+
+		w := httptest.NewRecorder()
+		health.NewHandler(p).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var got map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		require.Equal(t, "24.7.1", got["opnsenseVersion"])
+		require.Equal(t, "boom", got["lastError"])
+		require.Equal(t, true, got["reconfigurePending"])
+		require.Equal(t, map[string]interface{}{
+			"time":     "2024-09-01T12:00:00Z",
+			"duration": "1s",
+			"success":  true,
+			"records":  float64(3),
+		}, got["lastRecords"])
+		require.Equal(t, map[string]interface{}{"A": float64(1)}, got["lastApply"].(map[string]interface{})["created"])
+	})
+
+	t.Run("is read-only", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}).ServeHTTP(w, httptest.NewRequest("POST", "/status", nil))
+
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("labels every metric with the owner ID", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}, health.WithOwnerID("cluster-a")).
+			ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `opnsense_reconfigure_pending{owner_id="cluster-a"} 0`)
+		require.Contains(t, w.Body.String(), `go_goroutines{owner_id="cluster-a"}`)
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				require.Contains(t, line, `owner_id="cluster-a"`)
+			}
+		}
+	})
+
+	t.Run("leaves the label out without an owner ID", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+		require.Contains(t, w.Body.String(), "opnsense_reconfigure_pending 0")
+		require.NotContains(t, w.Body.String(), "owner_id")
+	})
+
+	t.Run("labels the metrics of each webhook with its name", func(t *testing.T) {
+		metrics.For("cluster-b").ReconfigurePending.Set(1)
+		t.Cleanup(func() { metrics.For("cluster-b").ReconfigurePending.Set(0) })
+
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}, health.WithWebhookMetrics("cluster-a", "cluster-b")).
+			ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `opnsense_reconfigure_pending{webhook="cluster-a"} 0`)
+		require.Contains(t, w.Body.String(), `opnsense_reconfigure_pending{webhook="cluster-b"} 1`)
+		require.NotContains(t, w.Body.String(), "opnsense_reconfigure_pending 0")
+	})
+}
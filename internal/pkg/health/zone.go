@@ -0,0 +1,163 @@
+package health
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Zone is what the zone export needs of the provider.
+type Zone interface {
+	Records(ctx context.Context) ([]*endpoint.Endpoint, error)
+	GetDomainFilter() endpoint.DomainFilter
+}
+
+// WithZoneExport serves the records z lists, as Records does for external-dns, at /zone: zone file lines
+// by default, or a records file in JSON when asked for with Accept: application/json. ?domain= narrows
+// them down to a domain within the domain filter. It exposes internal hostnames, so it is off by default.
+func WithZoneExport(z Zone) Option {
+	return func(c *config) {
+		c.zone = z
+	}
+}
+
+func zoneHandler(z Zone) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		contentType, ok := negotiate(r.Header.Get("Accept"), "text/plain", "application/json")
+		if !ok {
+			http.Error(w, "only text/plain and application/json are available", http.StatusNotAcceptable)
+			return
+		}
+
+		filter := z.GetDomainFilter()
+		domain := state.Normalize(r.URL.Query().Get("domain"))
+		if domain != "" && filter.IsConfigured() && !filter.Match(domain) {
+			http.Error(w, fmt.Sprintf("domain %s is outside the domain filter", domain), http.StatusBadRequest)
+			return
+		}
+
+		endpoints, err := z.Records(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		var records []*endpoint.Endpoint
+		for _, ep := range endpoints {
+			name := state.Normalize(ep.DNSName)
+			if filter.IsConfigured() && !filter.Match(name) {
+				continue
+			}
+			if domain != "" && name != domain && !strings.HasSuffix(name, "."+domain) {
+				continue
+			}
+			records = append(records, ep)
+		}
+		slices.SortFunc(records, func(a, b *endpoint.Endpoint) int {
+			return cmp.Or(strings.Compare(state.Normalize(a.DNSName), state.Normalize(b.DNSName)), strings.Compare(a.RecordType, b.RecordType))
+		})
+
+		if contentType == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			writeZoneJSON(w, records)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeZoneText(w, records)
+	}
+}
+
+// writeZoneText writes records as zone file lines, with their description as a comment:
+//
+//	nas.example.com.	IN	A	192.168.1.10	; NAS
+func writeZoneText(w http.ResponseWriter, records []*endpoint.Endpoint) {
+	for _, ep := range records {
+		description, _ := ep.GetProviderSpecificProperty(unbound.DescriptionProperty)
+		for _, target := range ep.Targets {
+			if ep.RecordType == endpoint.RecordTypeCNAME {
+				target = fqdn(target)
+			}
+			line := fqdn(ep.DNSName) + "\tIN\t" + ep.RecordType + "\t" + target
+			if description != "" {
+				line += "\t; " + description
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// writeZoneJSON writes records as a records file, as read by the diff command.
+func writeZoneJSON(w http.ResponseWriter, records []*endpoint.Endpoint) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(provider.NewRecordsFile(records))
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// negotiate returns the offer the Accept header gives the highest quality, the earliest of them on a tie.
+// Each offer takes the quality of the most specific media range matching it.
+func negotiate(accept string, offers ...string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			s := matchSpecificity(mediaRange, offer)
+			if s <= specificity {
+				continue
+			}
+			rangeQ := 1.0
+			if v, ok := params["q"]; ok {
+				if rangeQ, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			q, specificity = rangeQ, s
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// matchSpecificity returns how specifically mediaRange matches mediaType: 2 exactly, 1 as type/*,
+// 0 as */*, or -1 if it doesn't.
+func matchSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+		return 1
+	}
+	return -1
+}
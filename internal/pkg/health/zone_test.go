@@ -0,0 +1,141 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/health"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+type fakeZone struct {
+	records []*endpoint.Endpoint
+	err     error
+	domains []string
+	listed  int
+}
+
+func (f *fakeZone) Records(context.Context) ([]*endpoint.Endpoint, error) {
+	f.listed++
+	return f.records, f.err
+}
+
+func (f *fakeZone) GetDomainFilter() endpoint.DomainFilter {
+	return endpoint.NewDomainFilter(f.domains)
+}
+
+func TestZone(t *testing.T) {
+	zone := func() *fakeZone {
+		nas := endpoint.NewEndpoint("nas.home.example.com", endpoint.RecordTypeA, "192.168.1.10")
+		nas.SetProviderSpecificProperty(unbound.DescriptionProperty, "NAS")
+		return &fakeZone{
+			domains: []string{"example.com"},
+			records: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("www.lab.example.com", endpoint.RecordTypeCNAME, "web.lab.example.com"),
+				nas,
+				endpoint.NewEndpoint("vpn.home.example.com", endpoint.RecordTypeA, "192.168.1.2", "192.168.1.3"),
+				endpoint.NewEndpoint("home.example.com", endpoint.RecordTypeA, "192.168.1.1"),
+				endpoint.NewEndpoint("printer.example.org", endpoint.RecordTypeA, "192.168.1.20"),
+			},
+		}
+	}
+
+	get := func(z health.Zone, target, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}, health.WithZoneExport(z)).ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("serves zone file lines", func(t *testing.T) {
+		w := get(zone(), "/zone", "")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		require.Equal(t, ""+
+			"home.example.com.\tIN\tA\t192.168.1.1\n"+
+			"nas.home.example.com.\tIN\tA\t192.168.1.10\t; NAS\n"+
+			"vpn.home.example.com.\tIN\tA\t192.168.1.2\n"+
+			"vpn.home.example.com.\tIN\tA\t192.168.1.3\n"+
+			"www.lab.example.com.\tIN\tCNAME\tweb.lab.example.com.\n",
+			w.Body.String())
+	})
+
+	t.Run("narrows records down to a domain", func(t *testing.T) {
+		w := get(zone(), "/zone?domain=Home.Example.com.", "")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, ""+
+			"home.example.com.\tIN\tA\t192.168.1.1\n"+
+			"nas.home.example.com.\tIN\tA\t192.168.1.10\t; NAS\n"+
+			"vpn.home.example.com.\tIN\tA\t192.168.1.2\n"+
+			"vpn.home.example.com.\tIN\tA\t192.168.1.3\n",
+			w.Body.String())
+	})
+
+	t.Run("refuses domains outside the domain filter", func(t *testing.T) {
+		z := zone()
+		w := get(z, "/zone?domain=example.org", "")
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), "outside the domain filter")
+		require.Zero(t, z.listed)
+	})
+
+	t.Run("serves a records file in JSON when asked", func(t *testing.T) {
+		w := get(zone(), "/zone?domain=nas.home.example.com", "application/json")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var file provider.RecordsFile
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+		description := "NAS"
+		require.Equal(t, []provider.FileRecord{
+			{DNSName: "nas.home.example.com", RecordType: endpoint.RecordTypeA, Targets: []string{"192.168.1.10"}, Description: &description},
+		}, file.Records)
+	})
+
+	t.Run("negotiates the content type", func(t *testing.T) {
+		for accept, contentType := range map[string]string{
+			"*/*":                                "text/plain; charset=utf-8",
+			"text/*":                             "text/plain; charset=utf-8",
+			"application/*":                      "application/json",
+			"text/plain;q=0.5, application/json": "application/json",
+			"application/json;q=0.1, */*;q=0.9":  "text/plain; charset=utf-8",
+			"text/html, */*;q=0.8":               "text/plain; charset=utf-8",
+			"*/*, text/plain;q=0":                "application/json",
+		} {
+			w := get(zone(), "/zone", accept)
+			require.Equal(t, http.StatusOK, w.Code, accept)
+			require.Equal(t, contentType, w.Header().Get("Content-Type"), accept)
+		}
+
+		w := get(zone(), "/zone", "text/html")
+		require.Equal(t, http.StatusNotAcceptable, w.Code)
+	})
+
+	t.Run("fails when records can't be listed", func(t *testing.T) {
+		w := get(&fakeZone{err: errors.New("opnsense unavailable")}, "/zone", "")
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Contains(t, w.Body.String(), "opnsense unavailable")
+	})
+
+	t.Run("is off by default", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		health.NewHandler(&fakeProvider{}).ServeHTTP(w, httptest.NewRequest("GET", "/zone", nil))
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
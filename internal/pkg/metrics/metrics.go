@@ -0,0 +1,413 @@
+package metrics
+
+import (
+	"cmp"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "opnsense"
+
+// Set is the metrics of one webhook: those of its provider, OPNsense API clients and handler.
+type Set struct {
+	EndpointAdjustments      *prometheus.CounterVec
+	ReconfigureTotal         *prometheus.CounterVec
+	ReconfigureDuration      prometheus.Histogram
+	ReconfigurePending       prometheus.Gauge
+	ApplyConsecutiveFailures prometheus.Gauge
+	ApplyFailing             prometheus.Gauge
+	VerifiedRecords          *prometheus.CounterVec
+	CanaryRuns               *prometheus.CounterVec
+	CanaryDuration           prometheus.Gauge
+	CanaryLastSuccess        prometheus.Gauge
+	Records                  *prometheus.GaugeVec
+	RecordsLimitExceeded     prometheus.Counter
+	LastContact              prometheus.Gauge
+	LastSuccessfulRecords    prometheus.Gauge
+	LastSuccessfulApply      prometheus.Gauge
+	RecordBackups            *prometheus.CounterVec
+	APIRetries               *prometheus.CounterVec
+	APIValidationWarnings    *prometheus.CounterVec
+	APICircuitState          prometheus.Gauge
+	FallbackListings         *prometheus.CounterVec
+	StaleListings            prometheus.Counter
+	CacheHits                prometheus.Counter
+	CacheMisses              prometheus.Counter
+	CacheAge                 prometheus.Gauge
+	CacheInvalidations       *prometheus.CounterVec
+	AliasesUnavailable       prometheus.Gauge
+	SkippedDeletes           *prometheus.CounterVec
+	ExcludedChanges          *prometheus.CounterVec
+	SeedConflicts            *prometheus.CounterVec
+	GCExpiredRecords         *prometheus.CounterVec
+	BudgetExhausted          *prometheus.CounterVec
+	YoungDeletes             *prometheus.CounterVec
+	ReadOnlyChanges          *prometheus.CounterVec
+	DriftedRecords           *prometheus.CounterVec
+	UpdatesCreated           *prometheus.CounterVec
+	DanglingAliases          *prometheus.CounterVec
+	Notifications            *prometheus.CounterVec
+	WebhookRequests          *prometheus.CounterVec
+	WebhookRequestDuration   *prometheus.HistogramVec
+	WebhookPanics            *prometheus.CounterVec
+}
+
+// NewSet returns a new set of metrics, registered with nothing yet.
+func NewSet() *Set {
+	return &Set{
+		EndpointAdjustments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "endpoint_adjustments_total",
+			Help:      "Number of changes made to desired endpoints by AdjustEndpoints, by kind of adjustment.",
+		}, []string{"kind"}),
+
+		ReconfigureTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconfigure_total",
+			Help:      "Number of Unbound reconfigure attempts, by result.",
+		}, []string{"result"}),
+
+		ReconfigureDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "reconfigure_duration_seconds",
+			Help:      "Time taken by Unbound reconfigure calls.",
+			Buckets:   []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}),
+
+		ReconfigurePending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reconfigure_pending",
+			Help:      "1 while an Unbound reconfigure is waiting to run, 0 otherwise.",
+		}),
+
+		ApplyConsecutiveFailures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "apply_consecutive_failures",
+			Help:      "Number of times in a row applying changes has failed, 0 after a success.",
+		}),
+
+		ApplyFailing: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "apply_failing",
+			Help:      "1 while applies have failed too many times in a row and the provider reports not ready, 0 otherwise.",
+		}),
+
+		VerifiedRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verified_records_total",
+			Help:      "Number of records applied then queried from Unbound, by whether they resolved as planned.",
+		}, []string{"result"}),
+
+		CanaryRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "canary_runs_total",
+			Help:      "Number of canary records created, resolved and deleted, by result.",
+		}, []string{"result"}),
+
+		CanaryDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "canary_duration_seconds",
+			Help:      "Time the last successful canary run took, from creating the canary record to deleting it.",
+		}),
+
+		CanaryLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "canary_last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful canary run.",
+		}),
+
+		Records: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "records",
+			Help:      "Number of records in Unbound as of the last listing, by record type.",
+		}, []string{"type"}),
+
+		RecordsLimitExceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "records_limit_exceeded_total",
+			Help:      "Number of record listings failed for holding more records than the maximum.",
+		}),
+
+		LastContact: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_contact_timestamp_seconds",
+			Help:      "Unix time of the last successful call to the OPNsense API.",
+		}),
+
+		LastSuccessfulRecords: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_successful_records_timestamp_seconds",
+			Help:      "Unix time of the last successful listing of records.",
+		}),
+
+		LastSuccessfulApply: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_successful_apply_timestamp_seconds",
+			Help:      "Unix time of the last successful apply of changes.",
+		}),
+
+		RecordBackups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "record_backups_total",
+			Help:      "Number of backups of the records written to -backup-path, by result: written, unchanged or failure.",
+		}, []string{"result"}),
+
+		APIRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_retries_total",
+			Help:      "Number of OPNsense API requests retried, by reason.",
+		}, []string{"reason"}),
+
+		APIValidationWarnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_validation_warnings_total",
+			Help:      "Number of OPNsense API calls that saved records along with validation warnings, by call.",
+		}, []string{"op"}),
+
+		APICircuitState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "api_circuit_state",
+			Help:      "State of the OPNsense API circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}),
+
+		FallbackListings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fallback_listings_total",
+			Help:      "Number of record listings made from the fallback OPNsense while the primary was unavailable, by result.",
+		}, []string{"result"}),
+
+		StaleListings: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stale_listings_total",
+			Help:      "Number of record listings served from the last successful listing while OPNsense was unavailable.",
+		}),
+
+		CacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_hits_total",
+			Help:      "Number of record listings served from the records cache.",
+		}),
+
+		CacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_misses_total",
+			Help:      "Number of record listings the records cache couldn't serve, fresh listings included.",
+		}),
+
+		CacheAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_age_seconds",
+			Help:      "Age of the records last served from the records cache, 0 when they were listed from OPNsense.",
+		}),
+
+		CacheInvalidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_invalidations_total",
+			Help:      "Number of times cached records were dropped, by reason: apply, ttl or manual.",
+		}, []string{"reason"}),
+
+		AliasesUnavailable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aliases_unavailable",
+			Help:      "1 while OPNsense doesn't support host aliases and only A records are managed, 0 otherwise.",
+		}),
+
+		SkippedDeletes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "skipped_deletes_total",
+			Help:      "Number of record deletions planned by external-dns and skipped because deletes are disabled, by record type.",
+		}, []string{"type"}),
+
+		ExcludedChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "excluded_changes_total",
+			Help:      "Number of changes planned by external-dns and refused because the record is excluded, by operation.",
+		}, []string{"op"}),
+
+		SeedConflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "seed_conflicts_total",
+			Help:      "Number of changes planned by external-dns and refused because the record is seeded, by operation.",
+		}, []string{"op"}),
+
+		GCExpiredRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_expired_records_total",
+			Help:      "Number of records garbage collection found not desired for longer than the maximum age, by record type.",
+		}, []string{"type"}),
+
+		BudgetExhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "apply_budget_exhausted_total",
+			Help:      "Number of changes that ran out of their share of the apply deadline, by operation.",
+		}, []string{"op"}),
+
+		YoungDeletes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "young_deletes_total",
+			Help:      "Number of deletions planned by external-dns and skipped because the record was created less than the minimum age ago, by record type.",
+		}, []string{"type"}),
+
+		ReadOnlyChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_only_changes_total",
+			Help:      "Number of changes planned by external-dns and not applied in read-only mode, by operation.",
+		}, []string{"op"}),
+
+		DriftedRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "drifted_records_total",
+			Help:      "Number of records found changed since the provider wrote them, by record type and field changed.",
+		}, []string{"type", "field"}),
+
+		UpdatesCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "updates_created_total",
+			Help:      "Number of updates planned by external-dns of records not found, created instead, by record type.",
+		}, []string{"type"}),
+
+		DanglingAliases: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dangling_aliases_total",
+			Help:      "Number of aliases found targeting the old name of a record renamed in place, by action: repointed, or warned when not fixed.",
+		}, []string{"action"}),
+
+		Notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_total",
+			Help:      "Number of notifications of events, by event and result: success, failure or suppressed as a repeat.",
+		}, []string{"event", "result"}),
+
+		WebhookRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_requests_total",
+			Help:      "Number of webhook requests served, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+
+		WebhookRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "webhook_request_duration_seconds",
+			Help:      "Time taken to serve webhook requests, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		WebhookPanics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_panics_total",
+			Help:      "Number of webhook requests that panicked, answered with a 500, by route.",
+		}, []string{"route"}),
+	}
+}
+
+var (
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webhook_build_info",
+		Help:      "Always 1, labeled with the version and commit the webhook was built from.",
+	}, []string{"version", "commit"})
+
+	// Default is the set of metrics of the unnamed webhook, that of a process serving a single one.
+	Default = NewSet()
+
+	setsMu sync.Mutex
+	sets   = map[string]*Set{"": Default}
+)
+
+// For returns the set of metrics of the webhook named, made on first use, or Default for the unnamed one.
+func For(webhook string) *Set {
+	setsMu.Lock()
+	defer setsMu.Unlock()
+
+	s, ok := sets[webhook]
+	if !ok {
+		s = NewSet()
+		sets[webhook] = s
+	}
+	return s
+}
+
+// Register registers the metrics of s with r.
+func (s *Set) Register(r prometheus.Registerer) {
+	r.MustRegister(
+		s.EndpointAdjustments,
+		s.ReconfigureTotal,
+		s.ReconfigureDuration,
+		s.ReconfigurePending,
+		s.ApplyConsecutiveFailures,
+		s.ApplyFailing,
+		s.VerifiedRecords,
+		s.CanaryRuns,
+		s.CanaryDuration,
+		s.CanaryLastSuccess,
+		s.Records,
+		s.RecordsLimitExceeded,
+		s.LastContact,
+		s.LastSuccessfulRecords,
+		s.LastSuccessfulApply,
+		s.RecordBackups,
+		s.APIRetries,
+		s.APIValidationWarnings,
+		s.APICircuitState,
+		s.FallbackListings,
+		s.StaleListings,
+		s.CacheHits,
+		s.CacheMisses,
+		s.CacheAge,
+		s.CacheInvalidations,
+		s.AliasesUnavailable,
+		s.SkippedDeletes,
+		s.ExcludedChanges,
+		s.SeedConflicts,
+		s.GCExpiredRecords,
+		s.BudgetExhausted,
+		s.YoungDeletes,
+		s.ReadOnlyChanges,
+		s.DriftedRecords,
+		s.UpdatesCreated,
+		s.DanglingAliases,
+		s.Notifications,
+		s.WebhookRequests,
+		s.WebhookRequestDuration,
+		s.WebhookPanics,
+	)
+}
+
+// SetBuildInfo labels BuildInfo with version and commit, or, if they are empty, with the module version and
+// VCS revision Go stamped the binary with, if any.
+func SetBuildInfo(version, commit string) {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = cmp.Or(version, info.Main.Version)
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = cmp.Or(commit, setting.Value)
+			}
+		}
+	}
+	BuildInfo.Reset()
+	BuildInfo.WithLabelValues(cmp.Or(version, "unknown"), cmp.Or(commit, "unknown")).Set(1)
+}
+
+// Handler serves the metrics registered with a new registry, along with the Go runtime metrics,
+// all of them carrying the static labels given, if any. The metrics of each of the webhooks named
+// are labeled with webhook=name; with none named, those of Default are served unlabeled.
+func Handler(labels prometheus.Labels, webhooks ...string) http.Handler {
+	reg := prometheus.NewRegistry()
+	r := prometheus.WrapRegistererWith(labels, reg)
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		BuildInfo,
+	)
+	if len(webhooks) == 0 {
+		Default.Register(r)
+	}
+	for _, name := range webhooks {
+		For(name).Register(prometheus.WrapRegistererWith(prometheus.Labels{"webhook": name}, r))
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetBuildInfo(t *testing.T) {
+	t.Run("labels the build info with the version and commit given", func(t *testing.T) {
+		SetBuildInfo("1.2.3", "0123abc")
+
+		require.Equal(t, 1, testutil.CollectAndCount(BuildInfo))
+		require.Equal(t, float64(1), testutil.ToFloat64(BuildInfo.WithLabelValues("1.2.3", "0123abc")))
+	})
+
+	t.Run("falls back to what Go stamped the binary with", func(t *testing.T) {
+		SetBuildInfo("", "")
+
+		// Test binaries are stamped with no revision, and as the (devel) version of the module
+		require.Equal(t, 1, testutil.CollectAndCount(BuildInfo))
+		require.Equal(t, float64(1), testutil.ToFloat64(BuildInfo.WithLabelValues("(devel)", "unknown")))
+	})
+}
+
+func TestHandler(t *testing.T) {
+	// scrape returns what h serves
+	scrape := func(t *testing.T, h http.Handler) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		b, err := io.ReadAll(rec.Result().Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("labels the metrics of each webhook with its name, apart from the others", func(t *testing.T) {
+		a, b := For("isolated-a"), For("isolated-b")
+		require.Same(t, a, For("isolated-a"))
+		require.NotSame(t, a, b)
+		// Counters outlive the test, and keep counting when it's run again
+		a.WebhookRequests.Reset()
+		b.WebhookRequests.Reset()
+		hitsA, hitsB := testutil.ToFloat64(a.CacheHits), testutil.ToFloat64(b.CacheHits)
+		a.CacheHits.Add(2)
+		a.WebhookRequests.WithLabelValues("records", "GET", "200").Inc()
+		b.CacheHits.Add(5)
+
+		got := scrape(t, Handler(prometheus.Labels{"instance": "gw"}, "isolated-a", "isolated-b"))
+		require.Contains(t, got, fmt.Sprintf(`opnsense_cache_hits_total{instance="gw",webhook="isolated-a"} %g`, hitsA+2))
+		require.Contains(t, got, fmt.Sprintf(`opnsense_cache_hits_total{instance="gw",webhook="isolated-b"} %g`, hitsB+5))
+		require.Contains(t, got, `opnsense_webhook_requests_total{code="200",instance="gw",method="GET",route="records",webhook="isolated-a"} 1`)
+		require.NotContains(t, got, `opnsense_webhook_requests_total{code="200",instance="gw",method="GET",route="records",webhook="isolated-b"}`)
+		require.NotContains(t, got, `opnsense_cache_hits_total{instance="gw"}`, "Default isn't served next to named webhooks")
+	})
+
+	t.Run("serves Default unlabeled without webhooks named", func(t *testing.T) {
+		require.Same(t, Default, For(""))
+
+		got := scrape(t, Handler(nil))
+		require.Contains(t, got, "opnsense_cache_hits_total ")
+		require.NotContains(t, got, `webhook="`)
+	})
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// aliasReprobeInterval is how often host aliases are listed again while OPNsense doesn't support them,
+// so that an upgrade restores CNAME support without a restart.
+const aliasReprobeInterval = 10 * time.Minute
+
+var errAliasesUnavailable = errors.New("CNAME records are not supported: OPNsense doesn't provide the host alias API")
+
+// aliasSupport tracks whether OPNsense provides the host alias API. Older versions don't,
+// in which case the provider manages A records only.
+type aliasSupport struct {
+	webhook string
+
+	mu          sync.Mutex
+	unavailable bool
+	lastProbe   time.Time
+}
+
+// shouldList reports whether aliases should be listed: always while they are supported,
+// and every aliasReprobeInterval otherwise.
+func (a *aliasSupport) shouldList(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.unavailable {
+		return true
+	}
+	if now.Sub(a.lastProbe) < aliasReprobeInterval {
+		return false
+	}
+	a.lastProbe = now
+	return true
+}
+
+func (a *aliasSupport) markUnavailable(now time.Time, err error, logger *slog.Logger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.unavailable {
+		logger.Warn("OPNsense doesn't support host aliases, managing A records only", slog.Any("error", err))
+		metrics.For(a.webhook).AliasesUnavailable.Set(1)
+	}
+	a.unavailable = true
+	a.lastProbe = now
+}
+
+func (a *aliasSupport) markAvailable(logger *slog.Logger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.unavailable {
+		logger.Info("OPNsense supports host aliases again, managing CNAME records")
+		metrics.For(a.webhook).AliasesUnavailable.Set(0)
+	}
+	a.unavailable = false
+}
+
+func (a *aliasSupport) available() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !a.unavailable
+}
+
+// isUnimplemented reports whether err means OPNsense doesn't have the endpoint called.
+func isUnimplemented(err error) bool {
+	if errors.Is(err, unbound.ErrNotFound) {
+		return true
+	}
+	var statusErr *unbound.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotImplemented
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// aliaslessAPI is an OPNsense without the host alias API until upgraded.
+type aliaslessAPI struct {
+	*unboundtest.Fake
+
+	mu       sync.Mutex
+	upgraded bool
+}
+
+func (a *aliaslessAPI) ListHostAliases(ctx context.Context, id unbound.HostOverrideID) ([]unbound.HostAlias, error) {
+	a.mu.Lock()
+	upgraded := a.upgraded
+	a.mu.Unlock()
+
+	if !upgraded {
+		a.Fake.ListHostAliases(ctx, id)
+		return nil, &unbound.StatusError{StatusCode: http.StatusNotFound}
+	}
+	return a.Fake.ListHostAliases(ctx, id)
+}
+
+func (a *aliaslessAPI) upgrade() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.upgraded = true
+}
+
+func TestAliasesUnavailable(t *testing.T) {
+	newProvider := func() (*unboundProvider, *aliaslessAPI) {
+		fake := &aliaslessAPI{Fake: &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "2", HostID: "1", Hostname: "b", Domain: "example.com", Host: "a.example.com"},
+			},
+		}}
+		t.Cleanup(func() { metrics.Default.AliasesUnavailable.Set(0) })
+		return &unboundProvider{api: fake}, fake
+	}
+
+	t.Run("manages A records only", func(t *testing.T) {
+		provider, fake := newProvider()
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"a.example.com"}, dnsNames(records))
+		require.True(t, provider.Status().AliasesUnavailable)
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.Default.AliasesUnavailable))
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, fake.Calls("ListHostAliases"), "aliases are not listed again before the reprobe interval")
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("c.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			endpoint.NewEndpoint("d.example.com", endpoint.RecordTypeCNAME, "c.example.com"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"c.example.com"}, dnsNames(adjusted))
+
+		err = provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("d.example.com", endpoint.RecordTypeCNAME, "a.example.com")},
+		})
+		require.ErrorIs(t, err, errAliasesUnavailable)
+	})
+
+	t.Run("restores aliases once OPNsense supports them", func(t *testing.T) {
+		provider, fake := newProvider()
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.upgrade()
+		provider.aliases.lastProbe = time.Now().Add(-aliasReprobeInterval)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"a.example.com", "b.example.com"}, dnsNames(records))
+		require.False(t, provider.Status().AliasesUnavailable)
+		require.Equal(t, 0.0, testutil.ToFloat64(metrics.Default.AliasesUnavailable))
+	})
+}
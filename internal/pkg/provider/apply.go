@@ -0,0 +1,591 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+type applyOp func(ctx context.Context) error
+
+// EndpointError is the failure of the change of one endpoint, returned by ApplyChanges among the errors of the
+// others that failed. Its message is the one of Err.
+type EndpointError struct {
+	// Op is create, update or delete
+	Op       string
+	Endpoint *endpoint.Endpoint
+	Err      error
+}
+
+func (e *EndpointError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EndpointError) Unwrap() error {
+	return e.Err
+}
+
+// EndpointErrors returns the failures of the changes of endpoints err holds, in the order they were joined in.
+func EndpointErrors(err error) []*EndpointError {
+	var errs []*EndpointError
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *EndpointError:
+			errs = append(errs, e)
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return errs
+}
+
+// failing wraps the error of fn, the change of ep, in an *EndpointError.
+func failing(op string, ep *endpoint.Endpoint, fn func() error) error {
+	if err := fn(); err != nil {
+		return &EndpointError{Op: op, Endpoint: ep, Err: err}
+	}
+	return nil
+}
+
+// applyState is what the operations of one ApplyChanges share.
+// API calls are made without holding any lock, so operations can run concurrently.
+type applyState struct {
+	api     unbound.API
+	state   *state.State
+	journal *journal
+	logger  *slog.Logger
+
+	recreateRenames bool
+	fixDangling     bool
+	disableDeletes  bool
+	softDelete      bool
+	ownerID         string
+	webhook         string
+
+	// createdAt stamps the records created, when deletes of records too young are skipped
+	createdAt time.Time
+
+	// budget shares the apply deadline across the changes, if there is one
+	budget *budget
+
+	mu    sync.Mutex
+	stats applyStats
+}
+
+// applyChanges applies changes to the primary, or to the fallback if fallback writes are enabled and
+// the primary is unavailable. It returns the API changes were applied to. Changes are resolved against
+// the listing first, and the resolved plan logged, before any change is made.
+func (p *unboundProvider) applyChanges(ctx context.Context, changes *plan.Changes, stats applyStats) (unbound.API, error) {
+	s, err := p.prepareApply(ctx, stats)
+	if err != nil {
+		return p.api, err
+	}
+	if p.drift != nil {
+		defer p.drift.wrote(s.state, changes, p.log())
+	}
+
+	if p.log().Enabled(ctx, slog.LevelDebug) {
+		p.log().Debug("resolved plan", slog.Any("plan", s.resolve(changes)))
+	}
+
+	return s.api, p.execute(ctx, s, changes)
+}
+
+// prepareApply lists records to apply changes against, unless a recent listing can be reused, and picks the API
+// to apply them to.
+func (p *unboundProvider) prepareApply(ctx context.Context, stats applyStats) (*applyState, error) {
+	// After an interrupted apply, only a fresh listing shows what it actually did
+	recovering := p.journal != nil && p.journal.pendingRecovery() > 0
+
+	var snap *snapshot
+	if p.snapshots != nil && !recovering {
+		if snap = p.snapshots.take(time.Now()); snap != nil {
+			p.log().Debug("reusing records listing", slog.Duration("age", time.Since(snap.taken)))
+		}
+	}
+	if snap == nil {
+		var err error
+		if p.fallbackWrites {
+			snap, _, err = p.listSnapshotWithFallback(ctx)
+		} else {
+			snap, err = p.listSnapshot(ctx, p.api)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if recovering {
+		interrupted := p.journal.takeInterrupted()
+		p.log().Info("recovering from an interrupted apply", slog.Int("operations", len(interrupted)))
+		p.log().Debug("interrupted operations", slog.Any("operations", interrupted))
+	}
+
+	target := p.api
+	if snap.fromFallback {
+		p.log().Warn("primary OPNsense unavailable, applying changes to fallback")
+		target = p.fallback
+	}
+
+	return p.newApplyState(target, snap.state, stats), nil
+}
+
+// newApplyState returns the state of an apply of changes to api, against the records in st.
+func (p *unboundProvider) newApplyState(api unbound.API, st *state.State, stats applyStats) *applyState {
+	s := &applyState{
+		api:             api,
+		state:           st,
+		journal:         p.journal,
+		logger:          p.log(),
+		recreateRenames: p.renameStrategy == RenameRecreate,
+		fixDangling:     p.fixDangling,
+		disableDeletes:  p.disableDeletes,
+		softDelete:      p.softDelete,
+		ownerID:         p.ownerID,
+		webhook:         p.webhook,
+		stats:           stats,
+	}
+	if p.minDeleteAge > 0 {
+		s.createdAt = p.now()
+	}
+	return s
+}
+
+// execute makes changes, in bulk if they are enough to, or else record by record, in phases.
+func (p *unboundProvider) execute(ctx context.Context, s *applyState, changes *plan.Changes) error {
+	if !p.aliases.available() && changesCNAMEs(changes) {
+		p.log().Error("not applying changes to CNAME records", slog.Any("error", errAliasesUnavailable))
+		return errAliasesUnavailable
+	}
+
+	if bulk, ok := p.bulkTarget(s.api, changes); ok {
+		return s.applyBulk(ctx, bulk, changes)
+	}
+	s.budget = p.newBudget(ctx, countChanges(changes))
+
+	// Operations within a phase are independent of each other. Phases run in order so that
+	// aliases are deleted before their overrides, and overrides are created before their aliases.
+	// Record type changes are handled for us via delete/create.
+	var deleteCNAMEs, deleteAs, createAs, createCNAMEs, updateAs, updateCNAMEs []applyOp
+	for _, ep := range changes.Delete {
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			deleteAs = append(deleteAs, s.operation("delete", ep, s.deleteA(ep)))
+		case endpoint.RecordTypeCNAME:
+			deleteCNAMEs = append(deleteCNAMEs, s.operation("delete", ep, s.deleteCNAME(ep)))
+		default:
+			p.log().Warn("unsupported record type", slog.String("op", "delete"), slog.Any("endpoint", ep))
+		}
+	}
+	for _, ep := range changes.Create {
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			createAs = append(createAs, s.operation("create", ep, s.createA(ep)))
+		case endpoint.RecordTypeCNAME:
+			createCNAMEs = append(createCNAMEs, s.operation("create", ep, s.createCNAME(ep)))
+		default:
+			p.log().Warn("unsupported record type", slog.String("op", "create"), slog.Any("endpoint", ep))
+		}
+	}
+	for i, oldEP := range changes.UpdateOld {
+		newEP := changes.UpdateNew[i]
+		switch oldEP.RecordType {
+		case endpoint.RecordTypeA:
+			updateAs = append(updateAs, s.operation("update", newEP, s.updateA(oldEP, newEP)))
+		case endpoint.RecordTypeCNAME:
+			updateCNAMEs = append(updateCNAMEs, s.operation("update", newEP, s.updateCNAME(oldEP, newEP)))
+		default:
+			p.log().Warn("unsupported record type", slog.String("op", "update"),
+				slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+		}
+	}
+
+	for _, phase := range [][]applyOp{deleteCNAMEs, deleteAs, createAs, createCNAMEs, updateAs, updateCNAMEs} {
+		if err := runPhase(ctx, p.applyConcurrency, phase); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findHostOverride lists the overrides again to find the one of dnsName.
+func (s *applyState) findHostOverride(ctx context.Context, dnsName string) (unbound.HostOverride, bool) {
+	overrides, err := s.api.ListHostOverrides(ctx)
+	if err != nil {
+		s.logger.Warn("failed to list host overrides", slog.Any("error", err))
+		return unbound.HostOverride{}, false
+	}
+	for _, ho := range overrides {
+		if state.Normalize(ho.DNSName()) == state.Normalize(dnsName) {
+			return ho, true
+		}
+	}
+	return unbound.HostOverride{}, false
+}
+
+// createInstead logs and counts the update to newEP of a record not found, made as a create instead:
+// the record was likely deleted by hand since external-dns listed it, and would otherwise stay missing
+// until external-dns plans from a listing without it. Creating respects soft-deleted records as usual.
+func (s *applyState) createInstead(logger *slog.Logger, newEP *endpoint.Endpoint) {
+	logger.Warn("record to update not found, creating it")
+	metrics.For(s.webhook).UpdatesCreated.WithLabelValues(newEP.RecordType).Inc()
+}
+
+// skipDeletes returns changes without their deletions, logging and counting each of them.
+func (p *unboundProvider) skipDeletes(changes *plan.Changes) *plan.Changes {
+	if len(changes.Delete) == 0 {
+		return changes
+	}
+
+	for _, ep := range changes.Delete {
+		skipDelete(p.log(), metrics.For(p.webhook), ep)
+	}
+
+	skipped := *changes
+	skipped.Delete = nil
+	return &skipped
+}
+
+// skipDelete logs and counts with m the deletion of ep, not made because deletes are disabled.
+func skipDelete(logger *slog.Logger, m *metrics.Set, ep *endpoint.Endpoint) {
+	logger.Warn("not deleting record, deletes are disabled", slog.Any("endpoint", ep))
+	m.SkippedDeletes.WithLabelValues(ep.RecordType).Inc()
+}
+
+func changesCNAMEs(changes *plan.Changes) bool {
+	for _, eps := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateOld, changes.UpdateNew, changes.Delete} {
+		for _, ep := range eps {
+			if ep.RecordType == endpoint.RecordTypeCNAME {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runPhase runs ops, at most limit at a time. Once an op fails, or ctx is done, no further ops are started.
+// Errors are joined in the order of ops, regardless of the order they happened in, followed by the error of ctx
+// if ops were left unstarted because of it.
+func runPhase(ctx context.Context, limit int, ops []applyOp) error {
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, len(ops))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+
+	var interrupted error
+	for i, op := range ops {
+		sem <- struct{}{}
+		if failed.Load() {
+			<-sem
+			break
+		}
+		if interrupted = ctx.Err(); interrupted != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := op(ctx); err != nil {
+				errs[i] = err
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(append(errs, interrupted)...)
+}
+
+// operation returns fn, the change op of ep, run within its share of the apply deadline and journaled.
+func (s *applyState) operation(op string, ep *endpoint.Endpoint, fn applyOp) applyOp {
+	return s.journaled(op, ep, s.budgeted(op, fn))
+}
+
+// journaled records op in the journal while it runs. Operations failing in a way that leaves
+// their outcome unknown stay in the journal, so that the next apply recovers from them.
+// Errors are returned as *EndpointError.
+func (s *applyState) journaled(op string, ep *endpoint.Endpoint, fn applyOp) applyOp {
+	if s.journal == nil {
+		return func(ctx context.Context) error {
+			return failing(op, ep, func() error { return fn(ctx) })
+		}
+	}
+
+	return func(ctx context.Context) error {
+		id := s.journal.begin(op, ep)
+		err := failing(op, ep, func() error { return fn(ctx) })
+		if err != nil && (ctx.Err() != nil || unbound.IsTransient(err)) {
+			s.journal.abandon(id)
+		} else {
+			s.journal.finish(id)
+		}
+		return err
+	}
+}
+
+func (s *applyState) add(op, recordType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.add(op, recordType)
+}
+
+func (s *applyState) deleteA(ep *endpoint.Endpoint) applyOp {
+	if s.softDelete {
+		return s.softDeleteA(ep)
+	}
+
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+		ho, ok := s.state.HostOverride(ep.DNSName)
+		if !ok {
+			logger.Warn("Host Override not found")
+			return nil
+		}
+
+		err := s.api.DeleteHostOverride(ctx, ho)
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Debug("Host Override already deleted", slog.Any("hostOverride", ho))
+			s.state.DeleteHostOverride(ho)
+			return nil
+		}
+		if err != nil {
+			logger.Error("failed to delete host override", slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to delete host override: %w", err)
+		}
+
+		logger.Debug("deleted Host Override", slog.Any("hostOverride", ho))
+		s.add("deleted", endpoint.RecordTypeA)
+		s.state.DeleteHostOverride(ho)
+		return nil
+	}
+}
+
+func (s *applyState) deleteCNAME(ep *endpoint.Endpoint) applyOp {
+	if s.softDelete {
+		return s.softDeleteCNAME(ep)
+	}
+
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+		ha, ok := s.state.HostAlias(ep.DNSName)
+		if !ok {
+			logger.Warn("Host Alias not found")
+			return nil
+		}
+
+		err := s.api.DeleteHostAlias(ctx, ha)
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Debug("Host Alias already deleted", slog.Any("hostAlias", ha))
+			s.state.DeleteHostAlias(ha)
+			return nil
+		}
+		if err != nil {
+			logger.Error("failed to delete host alias", slog.Any("hostAlias", ha))
+			return fmt.Errorf("failed to delete host alias: %w", err)
+		}
+
+		logger.Debug("deleted Host Alias", slog.Any("hostAlias", ha))
+		s.add("deleted", endpoint.RecordTypeCNAME)
+		s.state.DeleteHostAlias(ha)
+		return nil
+	}
+}
+
+func (s *applyState) createA(ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+		// The override may have been created by an apply interrupted before it could tell
+		if existing, ok := s.state.HostOverride(ep.DNSName); ok {
+			if overrideSoftDeleted(existing) {
+				return s.restoreA(existing, ep)(ctx)
+			}
+			if existing.Server == ep.Targets[0] {
+				logger.Info("Host Override already exists", slog.Any("hostOverride", existing))
+				return nil
+			}
+			logger.Info("Host Override already exists with another target, updating it", slog.Any("hostOverride", existing))
+			return s.updateA(ep, ep)(ctx)
+		}
+
+		ho := unbound.HostOverride{}
+		ho.Update(ep)
+		ho.Description = s.stampCreated(ho.Description)
+		ho, err := s.api.CreateHostOverride(ctx, ho)
+		if errors.Is(err, unbound.ErrValidation) {
+			// The override may have been created since the listing, such as when it is reused
+			if existing, ok := s.findHostOverride(ctx, ep.DNSName); ok {
+				logger.Info("Host Override created since listing, not creating it again", slog.Any("hostOverride", existing))
+				s.state.PutHostOverride(existing)
+				return s.createA(ep)(ctx)
+			}
+		}
+		if err != nil {
+			logger.Error("failed to create host override", slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to create host override: %w", err)
+		}
+
+		logger.Debug("created Host Override", slog.Any("hostOverride", ho))
+		s.add("created", endpoint.RecordTypeA)
+		s.state.PutHostOverride(ho)
+		return nil
+	}
+}
+
+func (s *applyState) createCNAME(ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+		ho, ok := s.state.HostOverride(ep.Targets[0])
+		if !ok {
+			logger.Warn("Target Host Override not found for Host Alias")
+			return fmt.Errorf("failed to create host alias: target host override not found")
+		}
+
+		// The alias may have been created by an apply interrupted before it could tell
+		if existing, ok := s.state.HostAlias(ep.DNSName); ok {
+			if aliasSoftDeleted(existing) {
+				return s.restoreCNAME(existing, ho, ep)(ctx)
+			}
+			if existing.HostID == ho.ID {
+				logger.Info("Host Alias already exists", slog.Any("hostAlias", existing))
+				return nil
+			}
+			logger.Info("Host Alias already exists with another target, updating it", slog.Any("hostAlias", existing))
+			return s.updateCNAME(ep, ep)(ctx)
+		}
+
+		ha := unbound.HostAlias{HostID: ho.ID}
+		ha.Update(ep)
+		ha.Description = s.stampCreated(ha.Description)
+		ha, err := s.api.CreateHostAlias(ctx, ha)
+		if err != nil {
+			logger.Error("failed to create host alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to create host alias: %w", err)
+		}
+
+		logger.Debug("created Host Alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
+		s.add("created", endpoint.RecordTypeCNAME)
+		s.state.PutHostAlias(ha)
+		return nil
+	}
+}
+
+func (s *applyState) updateA(oldEP, newEP *endpoint.Endpoint) applyOp {
+	if s.recreateRenames && renamed(oldEP, newEP) {
+		return s.recreateA(oldEP, newEP)
+	}
+
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "update"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+		ho, ok := s.state.HostOverride(oldEP.DNSName)
+		if !ok {
+			s.createInstead(logger, newEP)
+			return s.createA(newEP)(ctx)
+		}
+		var targeting []unbound.HostAlias
+		if renamed(oldEP, newEP) {
+			targeting = s.state.HostAliasesTargeting(oldEP.DNSName)
+		}
+
+		// Re-read the override, so that the fields external-dns doesn't manage are kept as they are now
+		current, err := s.api.GetHostOverride(ctx, ho.ID)
+		if err == nil {
+			before := current.Description
+			current.Update(newEP)
+			current.Description = keepCreated(before, current.Description)
+			err = s.api.UpdateHostOverride(ctx, current)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("Host Override deleted meanwhile, creating it again", slog.Any("hostOverride", ho))
+			metrics.For(s.webhook).UpdatesCreated.WithLabelValues(endpoint.RecordTypeA).Inc()
+			s.state.DeleteHostOverride(ho)
+			return s.createA(newEP)(ctx)
+		}
+		if err != nil {
+			logger.Error("failed to update host override", slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to update host override: %w", err)
+		}
+
+		logger.Debug("updated Host Override", slog.Any("hostOverride", current))
+		s.add("updated", endpoint.RecordTypeA)
+		s.state.PutHostOverride(current)
+		return s.followRename(ctx, logger, targeting, current)
+	}
+}
+
+func (s *applyState) updateCNAME(oldEP, newEP *endpoint.Endpoint) applyOp {
+	if s.recreateRenames && renamed(oldEP, newEP) {
+		return s.recreateCNAME(oldEP, newEP)
+	}
+
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "update"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+		haOld, ok := s.state.HostAlias(oldEP.DNSName)
+		if !ok {
+			s.createInstead(logger, newEP)
+			return s.createCNAME(newEP)(ctx)
+		}
+
+		ho, ok := s.state.HostOverride(newEP.Targets[0])
+		if !ok {
+			logger.Warn("Target Host Override not found for Host Alias")
+			return fmt.Errorf("failed to update host alias: target host override not found")
+		}
+
+		// Re-read the alias, so that the fields external-dns doesn't manage are kept as they are now
+		ha, err := s.api.GetHostAlias(ctx, haOld.ID)
+		if err == nil {
+			before := ha.Description
+			ha.Update(newEP)
+			ha.Description = keepCreated(before, ha.Description)
+			ha.HostID = ho.ID
+			err = s.api.UpdateHostAlias(ctx, ha)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("Host Alias deleted meanwhile, creating it again", slog.Any("hostAlias", haOld))
+			metrics.For(s.webhook).UpdatesCreated.WithLabelValues(endpoint.RecordTypeCNAME).Inc()
+			s.state.DeleteHostAlias(haOld)
+			return s.createCNAME(newEP)(ctx)
+		}
+		if err != nil {
+			logger.Error("failed to update host alias", slog.Any("hostAlias", haOld), slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to update host alias: %w", err)
+		}
+
+		logger.Debug("updated Host Alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
+		s.add("updated", endpoint.RecordTypeCNAME)
+		s.state.PutHostAlias(ha)
+		return nil
+	}
+}
@@ -0,0 +1,474 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+type applyEvent struct {
+	op    string
+	start bool
+}
+
+// recordingAPI slows down mutations and records when each of them starts and ends.
+type recordingAPI struct {
+	*unboundtest.Fake
+	delay   time.Duration
+	failFor map[string]bool
+
+	mu          sync.Mutex
+	events      []applyEvent
+	inFlight    int
+	maxInFlight int
+}
+
+func (r *recordingAPI) call(op string) error {
+	r.mu.Lock()
+	r.events = append(r.events, applyEvent{op: op, start: true})
+	r.inFlight++
+	r.maxInFlight = max(r.maxInFlight, r.inFlight)
+	r.mu.Unlock()
+
+	time.Sleep(r.delay)
+
+	r.mu.Lock()
+	r.events = append(r.events, applyEvent{op: op})
+	r.inFlight--
+	r.mu.Unlock()
+
+	if r.failFor[op] {
+		return errors.New(op + " failed")
+	}
+	return nil
+}
+
+func (r *recordingAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	if err := r.call("create A " + ho.DNSName()); err != nil {
+		return ho, err
+	}
+	return r.Fake.CreateHostOverride(ctx, ho)
+}
+
+func (r *recordingAPI) DeleteHostOverride(ctx context.Context, ho unbound.HostOverride) error {
+	if err := r.call("delete A " + ho.DNSName()); err != nil {
+		return err
+	}
+	return r.Fake.DeleteHostOverride(ctx, ho)
+}
+
+func (r *recordingAPI) CreateHostAlias(ctx context.Context, ha unbound.HostAlias) (unbound.HostAlias, error) {
+	if err := r.call("create CNAME " + ha.DNSName()); err != nil {
+		return ha, err
+	}
+	return r.Fake.CreateHostAlias(ctx, ha)
+}
+
+func (r *recordingAPI) DeleteHostAlias(ctx context.Context, ha unbound.HostAlias) error {
+	if err := r.call("delete CNAME " + ha.DNSName()); err != nil {
+		return err
+	}
+	return r.Fake.DeleteHostAlias(ctx, ha)
+}
+
+// requireBefore checks that every op with prefix a ended before any op with prefix b started.
+func (r *recordingAPI) requireBefore(t *testing.T, a, b string) {
+	t.Helper()
+
+	lastEnd, firstStart := -1, len(r.events)
+	for i, e := range r.events {
+		if !e.start && len(e.op) >= len(a) && e.op[:len(a)] == a {
+			lastEnd = i
+		}
+		if e.start && len(e.op) >= len(b) && e.op[:len(b)] == b && i < firstStart {
+			firstStart = i
+		}
+	}
+	require.Less(t, lastEnd, firstStart, "%q must finish before %q starts", a, b)
+}
+
+func TestApplyConcurrency(t *testing.T) {
+	newChanges := func() (*unboundtest.Fake, *plan.Changes) {
+		fake := &unboundtest.Fake{}
+		changes := &plan.Changes{}
+		for i := 0; i < 5; i++ {
+			ho := unbound.HostOverride{
+				ID: unbound.HostOverrideID(fmt.Sprint(i)), Hostname: fmt.Sprintf("old%d", i), Domain: "example.com", Server: "127.0.0.1",
+			}
+			fake.HostOverrides = append(fake.HostOverrides, ho)
+			fake.HostAliases = append(fake.HostAliases, unbound.HostAlias{
+				ID: unbound.HostAliasID(fmt.Sprint(i)), HostID: ho.ID, Hostname: fmt.Sprintf("oldalias%d", i), Domain: "example.com",
+			})
+
+			changes.Delete = append(changes.Delete,
+				endpoint.NewEndpoint(fmt.Sprintf("old%d.example.com", i), endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint(fmt.Sprintf("oldalias%d.example.com", i), endpoint.RecordTypeCNAME, ho.DNSName()),
+			)
+			changes.Create = append(changes.Create,
+				endpoint.NewEndpoint(fmt.Sprintf("alias%d.example.com", i), endpoint.RecordTypeCNAME, fmt.Sprintf("new%d.example.com", i)),
+				endpoint.NewEndpoint(fmt.Sprintf("new%d.example.com", i), endpoint.RecordTypeA, "127.0.0.2"),
+			)
+		}
+		return fake, changes
+	}
+
+	t.Run("keeps dependency ordering under concurrency", func(t *testing.T) {
+		fake, changes := newChanges()
+		rec := &recordingAPI{Fake: fake, delay: 2 * time.Millisecond}
+		provider := &unboundProvider{api: rec, applyConcurrency: 4}
+
+		err := provider.ApplyChanges(context.Background(), changes)
+		require.NoError(t, err)
+
+		require.Equal(t, 4, rec.maxInFlight)
+		rec.requireBefore(t, "delete CNAME", "delete A")
+		rec.requireBefore(t, "delete A", "create A")
+		rec.requireBefore(t, "create A", "create CNAME")
+		require.Len(t, fake.HostOverrides, 5)
+		require.Len(t, fake.HostAliases, 5)
+	})
+
+	t.Run("applies one change at a time by default", func(t *testing.T) {
+		fake, changes := newChanges()
+		rec := &recordingAPI{Fake: fake}
+		provider := &unboundProvider{api: rec}
+
+		err := provider.ApplyChanges(context.Background(), changes)
+		require.NoError(t, err)
+		require.Equal(t, 1, rec.maxInFlight)
+	})
+
+	t.Run("stops at the first failure when applying serially", func(t *testing.T) {
+		fake, changes := newChanges()
+		rec := &recordingAPI{Fake: fake, failFor: map[string]bool{"create A new1.example.com": true}}
+		provider := &unboundProvider{api: rec, applyConcurrency: 1}
+
+		err := provider.ApplyChanges(context.Background(), changes)
+		require.EqualError(t, err, "failed to create host override: create A new1.example.com failed")
+		require.Len(t, fake.HostOverrides, 1)
+		require.Len(t, fake.HostAliases, 0)
+	})
+
+	t.Run("reports errors in plan order", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			fake, changes := newChanges()
+			rec := &recordingAPI{Fake: fake, delay: time.Millisecond, failFor: map[string]bool{
+				"create A new3.example.com": true,
+				"create A new1.example.com": true,
+			}}
+			provider := &unboundProvider{api: rec, applyConcurrency: 5}
+
+			err := provider.ApplyChanges(context.Background(), changes)
+			require.EqualError(t, err, "failed to create host override: create A new1.example.com failed\n"+
+				"failed to create host override: create A new3.example.com failed")
+			require.Len(t, fake.HostAliases, 0)
+		}
+	})
+}
+
+func TestDisableDeletes(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "kept", Domain: "example.com", Server: "127.0.0.1"},
+				{ID: "2", Hostname: "updated", Domain: "example.com", Server: "127.0.0.1"},
+				{ID: "3", Hostname: "retyped", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+	}
+
+	changes := func() *plan.Changes {
+		return &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				// A record changing type comes as the deletion of the old record and the creation of the new one
+				endpoint.NewEndpoint("retyped.example.com", endpoint.RecordTypeCNAME, "new.example.com"),
+			},
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("updated.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("updated.example.com", endpoint.RecordTypeA, "127.0.0.3")},
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("kept.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint("retyped.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			},
+		}
+	}
+
+	t.Run("skips deletes and makes creates and updates", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithDisableDeletes()(provider)
+		before := testutil.ToFloat64(metrics.Default.SkippedDeletes.WithLabelValues(endpoint.RecordTypeA))
+
+		err := provider.ApplyChanges(context.Background(), changes())
+		require.NoError(t, err)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{
+			"kept.example.com", "updated.example.com", "retyped.example.com", "new.example.com", "retyped.example.com",
+		}, dnsNames(records))
+		require.Equal(t, "127.0.0.3", fake.HostOverrides[1].Server)
+		require.Equal(t, 2.0, testutil.ToFloat64(metrics.Default.SkippedDeletes.WithLabelValues(endpoint.RecordTypeA))-before)
+
+		stats := provider.Status().LastApply
+		require.Empty(t, stats.Deleted)
+		require.Equal(t, map[string]int{"A": 1, "CNAME": 1}, stats.Created)
+	})
+
+	t.Run("doesn't change the plan given", func(t *testing.T) {
+		provider := &unboundProvider{api: existing()}
+		WithDisableDeletes()(provider)
+
+		given := changes()
+		require.NoError(t, provider.ApplyChanges(context.Background(), given))
+		require.Len(t, given.Delete, 2)
+	})
+
+	t.Run("does nothing for a plan of deletes only", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		provider.reconfigurer = newReconfigurer(fake, 0, 3, slog.Default())
+		WithDisableDeletes()(provider)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{Delete: changes().Delete})
+		require.NoError(t, err)
+		require.Zero(t, fake.Calls("ListHostOverrides"))
+		require.Zero(t, fake.Calls("Reconfigure"))
+		require.Len(t, fake.HostOverrides, 3)
+	})
+
+	t.Run("doesn't count skipped deletes towards the bulk apply threshold", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := &unboundProvider{api: api, bulkThreshold: 4}
+		WithDisableDeletes()(provider)
+
+		err := provider.ApplyChanges(context.Background(), changes())
+		require.NoError(t, err)
+		require.Zero(t, api.setCount())
+	})
+
+	t.Run("skips deletes of bulk applies", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+		WithDisableDeletes()(provider)
+
+		err := provider.ApplyChanges(context.Background(), changes())
+		require.NoError(t, err)
+		require.Equal(t, 1, api.setCount())
+		require.Len(t, api.HostOverrides, 4)
+	})
+}
+
+// deleteFailingAPI fails every delete with err.
+type deleteFailingAPI struct {
+	*unboundtest.Fake
+	err error
+}
+
+func (d deleteFailingAPI) DeleteHostOverride(context.Context, unbound.HostOverride) error {
+	return d.err
+}
+
+func (d deleteFailingAPI) DeleteHostAlias(context.Context, unbound.HostAlias) error { return d.err }
+
+func TestDeleteMissingRecord(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Enabled: "1"}},
+			HostAliases:   []unbound.HostAlias{{ID: "2", HostID: "1", Hostname: "b", Domain: "example.com", Enabled: "1"}},
+		}
+	}
+	deletes := &plan.Changes{Delete: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+	}}
+
+	t.Run("succeeds for records deleted already, as by a retried apply", func(t *testing.T) {
+		logs := recordLogs(t)
+		provider := &unboundProvider{api: deleteFailingAPI{existing(), fmt.Errorf("delHostOverride failed: %w", unbound.ErrNotFound)}}
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), deletes))
+		require.Empty(t, provider.Status().LastApply.Deleted)
+		level, _, ok := logs.find("Host Override already deleted")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+		_, _, ok = logs.find("Host Alias already deleted")
+		require.True(t, ok)
+	})
+
+	t.Run("fails for records that fail to delete", func(t *testing.T) {
+		provider := &unboundProvider{api: deleteFailingAPI{existing(), errors.New("delHostAlias failed: failed")}}
+
+		require.Error(t, provider.ApplyChanges(context.Background(), deletes))
+	})
+}
+
+// duplicateRejectingAPI refuses to create a host override for a DNS name one already has, as OPNsense does.
+type duplicateRejectingAPI struct {
+	*unboundtest.Fake
+}
+
+func (d duplicateRejectingAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	overrides, _ := d.Fake.ListHostOverrides(ctx)
+	for _, existing := range overrides {
+		if existing.DNSName() == ho.DNSName() {
+			return unbound.HostOverride{}, &unbound.ValidationError{Fields: map[string]string{"host.hostname": "duplicate"}}
+		}
+	}
+	return d.Fake.CreateHostOverride(ctx, ho)
+}
+
+func TestCreateExistingRecord(t *testing.T) {
+	// The listing changes are applied against is reused, so it misses the override created since
+	createdSinceListing := func(t *testing.T, existing unbound.HostOverride) *unboundtest.Fake {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: duplicateRejectingAPI{fake}}
+		WithSnapshotReuse(time.Hour)(provider)
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.HostOverrides = append(fake.HostOverrides, existing)
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		return fake
+	}
+
+	t.Run("updates the override created since listing with another target", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := createdSinceListing(t, unbound.HostOverride{ID: "1", Hostname: "a", Domain: "example.com", Server: "10.0.0.1", Enabled: "1"})
+
+		require.Equal(t, []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Enabled: "1"},
+		}, fake.HostOverrides)
+		_, _, ok := logs.find("Host Override created since listing, not creating it again")
+		require.True(t, ok)
+		_, _, ok = logs.find("Host Override already exists with another target, updating it")
+		require.True(t, ok)
+	})
+
+	t.Run("updates an override created by hand alike, keeping what external-dns doesn't manage", func(t *testing.T) {
+		fake := createdSinceListing(t, unbound.HostOverride{ID: "1", Hostname: "a", Domain: "example.com", Server: "10.0.0.1",
+			Description: "by hand", Enabled: "1"})
+
+		require.Equal(t, []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Description: "by hand", Enabled: "1"},
+		}, fake.HostOverrides)
+	})
+
+	t.Run("fails when no override explains the refusal", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		fake.Fail("CreateHostOverride", &unbound.ValidationError{Fields: map[string]string{"host.hostname": "invalid"}})
+		provider := &unboundProvider{api: fake}
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.ErrorIs(t, err, unbound.ErrValidation)
+	})
+}
+
+func TestEndpointErrors(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Enabled: "1"},
+			{ID: "2", Hostname: "b", Domain: "example.com", Server: "127.0.0.1", Enabled: "1"},
+		}}
+	}
+	deletes := &plan.Changes{Delete: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+	}}
+	rejected := fmt.Errorf("delHostOverride failed: %w", &unbound.ValidationError{Fields: map[string]string{"host.hostname": "in use"}})
+
+	t.Run("lists each change that failed", func(t *testing.T) {
+		provider := &unboundProvider{api: deleteFailingAPI{existing(), rejected}, applyConcurrency: 2}
+
+		err := provider.ApplyChanges(context.Background(), deletes)
+
+		errs := EndpointErrors(err)
+		require.Len(t, errs, 2)
+		for i, e := range errs {
+			require.Equal(t, "delete", e.Op)
+			require.Equal(t, deletes.Delete[i].DNSName, e.Endpoint.DNSName)
+			require.Contains(t, e.Error(), "host.hostname: in use")
+			var validation *unbound.ValidationError
+			require.ErrorAs(t, e, &validation)
+		}
+	})
+
+	t.Run("lists changes that failed in bulk", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("c.example.com", endpoint.RecordTypeCNAME, "missing.example.com"),
+		}})
+
+		errs := EndpointErrors(err)
+		require.Len(t, errs, 1)
+		require.Equal(t, "create", errs[0].Op)
+		require.Equal(t, "c.example.com", errs[0].Endpoint.DNSName)
+		require.Zero(t, api.sets)
+	})
+
+	t.Run("finds none in other errors", func(t *testing.T) {
+		require.Empty(t, EndpointErrors(errors.New("boom")))
+		require.Empty(t, EndpointErrors(nil))
+	})
+}
+
+// cancelingAPI cancels the apply once it has created its after-th override.
+type cancelingAPI struct {
+	*unboundtest.Fake
+	after   int
+	cancel  context.CancelFunc
+	created int
+}
+
+func (c *cancelingAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	if err := ctx.Err(); err != nil {
+		return unbound.HostOverride{}, err
+	}
+	ho, err := c.Fake.CreateHostOverride(ctx, ho)
+	c.created++
+	if c.created == c.after {
+		c.cancel()
+	}
+	return ho, err
+}
+
+func TestApplyCanceled(t *testing.T) {
+	logs := recordLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := &unboundtest.Fake{}
+	provider := &unboundProvider{api: &cancelingAPI{Fake: fake, after: 2, cancel: cancel}}
+	provider.reconfigurer = newReconfigurer(fake, 0, 3, slog.Default())
+
+	changes := &plan.Changes{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		changes.Create = append(changes.Create, endpoint.NewEndpoint(name+".example.com", endpoint.RecordTypeA, "127.0.0.1"))
+	}
+	err := provider.ApplyChanges(ctx, changes)
+
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, EndpointErrors(err), "no change should fail for being started after the cancellation")
+	require.Len(t, fake.HostOverrides, 2)
+	require.Equal(t, map[string]int{endpoint.RecordTypeA: 2}, provider.Status().LastApply.Created)
+
+	_, attrs, ok := logs.find("applied changes")
+	require.True(t, ok)
+	require.Equal(t, map[string]int64{"applied": 2, "planned": 5}, groupValue(t, attrs["interrupted"]))
+
+	// The changes saved go live all the same
+	require.Equal(t, 1, fake.Calls("Reconfigure"))
+}
@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// WithApplyFailureThreshold makes the provider not ready once ApplyChanges has failed n times in a row,
+// such as when OPNsense rejects a record on every attempt, until an apply succeeds. 0 disables.
+func WithApplyFailureThreshold(n int) Option {
+	return func(p *unboundProvider) {
+		p.applyHealth.threshold = n
+	}
+}
+
+// applyHealth tracks consecutive ApplyChanges failures and the latest of their errors.
+type applyHealth struct {
+	threshold int
+	webhook   string
+
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+}
+
+// done records the outcome of an apply, logging when the failure streak reaches the threshold.
+func (h *applyHealth) done(err error, logger *slog.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if h.threshold > 0 && h.failures >= h.threshold {
+			logger.Info("changes applied again", slog.Int("failuresBefore", h.failures))
+		}
+		h.failures, h.lastErr = 0, nil
+	} else {
+		h.failures++
+		h.lastErr = err
+		if h.threshold > 0 && h.failures == h.threshold {
+			logger.Error("applying changes keeps failing, reporting not ready",
+				slog.Int("consecutiveFailures", h.failures), slog.Any("error", err))
+		}
+	}
+
+	metrics.For(h.webhook).ApplyConsecutiveFailures.Set(float64(h.failures))
+	if h.threshold > 0 && h.failures >= h.threshold {
+		metrics.For(h.webhook).ApplyFailing.Set(1)
+	} else {
+		metrics.For(h.webhook).ApplyFailing.Set(0)
+	}
+}
+
+// Ready returns the latest error once applies have failed threshold times in a row.
+func (h *applyHealth) Ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.threshold > 0 && h.failures >= h.threshold {
+		return fmt.Errorf("applying changes failed %d times in a row: %w", h.failures, h.lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestApplyHealth(t *testing.T) {
+	failing := func(threshold int) (*unboundtest.Fake, *unboundProvider) {
+		fake := &unboundtest.Fake{}
+		fake.Fail("CreateHostOverride", errors.New("validation failed: hostname is invalid"))
+		provider := &unboundProvider{api: fake}
+		WithApplyFailureThreshold(threshold)(provider)
+		return fake, provider
+	}
+
+	t.Run("becomes not ready after consecutive failures and recovers on success", func(t *testing.T) {
+		fake, provider := failing(3)
+
+		for i := 0; i < 2; i++ {
+			require.Error(t, provider.ApplyChanges(context.Background(), createChanges("bad_name.example.com")))
+			require.NoError(t, provider.Ready())
+		}
+		require.Equal(t, float64(2), testutil.ToFloat64(metrics.Default.ApplyConsecutiveFailures))
+		require.Equal(t, float64(0), testutil.ToFloat64(metrics.Default.ApplyFailing))
+
+		require.Error(t, provider.ApplyChanges(context.Background(), createChanges("bad_name.example.com")))
+		err := provider.Ready()
+		require.ErrorContains(t, err, "applying changes failed 3 times in a row")
+		require.ErrorContains(t, err, "hostname is invalid")
+		require.Equal(t, float64(1), testutil.ToFloat64(metrics.Default.ApplyFailing))
+
+		fake.Fail("CreateHostOverride", nil)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("good.example.com")))
+		require.NoError(t, provider.Ready())
+		require.Equal(t, float64(0), testutil.ToFloat64(metrics.Default.ApplyConsecutiveFailures))
+		require.Equal(t, float64(0), testutil.ToFloat64(metrics.Default.ApplyFailing))
+	})
+
+	t.Run("stays ready when disabled", func(t *testing.T) {
+		_, provider := failing(0)
+
+		for i := 0; i < 5; i++ {
+			require.Error(t, provider.ApplyChanges(context.Background(), createChanges("bad_name.example.com")))
+		}
+		require.NoError(t, provider.Ready())
+		require.Equal(t, float64(0), testutil.ToFloat64(metrics.Default.ApplyFailing))
+	})
+}
@@ -0,0 +1,269 @@
+package provider
+
+import (
+	"slices"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// resolvedPlan is what an apply is about to do, as resolved against the listing before any change is made:
+// the OPNsense records changes matched, and the records to be sent for them. It is a single object, so that
+// it can be pulled out of logs as JSON and replayed.
+type resolvedPlan struct {
+	Creates   []resolvedChange `json:"creates,omitempty"`
+	Updates   []resolvedChange `json:"updates,omitempty"`
+	Deletes   []resolvedChange `json:"deletes,omitempty"`
+	Unmatched []resolvedChange `json:"unmatched,omitempty"`
+}
+
+// resolvedChange is a change of a plan, as resolved.
+type resolvedChange struct {
+	// Op is create, update, recreate, restore, delete or soft-delete, or none when the record is already as planned
+	Op         string `json:"op"`
+	Type       string `json:"type"`
+	DNSName    string `json:"dnsName"`
+	OldDNSName string `json:"oldDNSName,omitempty"`
+
+	// UUID is that of the record matched
+	UUID string `json:"uuid,omitempty"`
+
+	// Record is what is sent for the change, with the fields external-dns doesn't manage as of the listing
+	Record *resolvedRecord `json:"record,omitempty"`
+
+	// Reason tells why an unmatched change didn't match
+	Reason string `json:"reason,omitempty"`
+}
+
+// resolvedRecord is a Host Override or a Host Alias, as sent to OPNsense.
+type resolvedRecord struct {
+	Enabled     string `json:"enabled"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Server      string `json:"server,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Description string `json:"description"`
+
+	// HostUUID is that of the override an alias points to, empty when it is created by the same apply
+	HostUUID string `json:"hostUUID,omitempty"`
+}
+
+func overrideRecord(ho unbound.HostOverride) *resolvedRecord {
+	return &resolvedRecord{Enabled: enabledFlag(ho.Enabled), Hostname: ho.Hostname, Domain: ho.Domain, Server: ho.Server, Description: ho.Description}
+}
+
+func aliasRecord(ha unbound.HostAlias) *resolvedRecord {
+	return &resolvedRecord{Enabled: enabledFlag(ha.Enabled), Hostname: ha.Hostname, Domain: ha.Domain, Host: ha.Host,
+		Description: ha.Description, HostUUID: string(ha.HostID)}
+}
+
+// resolve resolves changes against s.state the way applying them would, without changing anything.
+func (s *applyState) resolve(changes *plan.Changes) resolvedPlan {
+	var rp resolvedPlan
+	unmatched := func(op string, ep *endpoint.Endpoint, reason string) {
+		rp.Unmatched = append(rp.Unmatched, resolvedChange{Op: op, Type: ep.RecordType, DNSName: ep.DNSName, Reason: reason})
+	}
+
+	// Updates of records not found are made as creates
+	creates := slices.Clone(changes.Create)
+	createdInstead := make([]bool, len(changes.UpdateOld))
+	for i, oldEP := range changes.UpdateOld {
+		if s.missingForUpdate(oldEP) {
+			createdInstead[i] = true
+			creates = append(creates, changes.UpdateNew[i])
+		}
+	}
+
+	// Aliases may point to overrides created by the same apply, before aliases are created and updated
+	createdAs := map[string]bool{}
+	for _, ep := range creates {
+		if ep.RecordType == endpoint.RecordTypeA {
+			createdAs[state.Normalize(ep.DNSName)] = true
+		}
+	}
+	updatedAs := map[string]bool{}
+	for i, ep := range changes.UpdateNew {
+		if !createdInstead[i] && ep.RecordType == endpoint.RecordTypeA {
+			updatedAs[state.Normalize(ep.DNSName)] = true
+		}
+	}
+	hostOf := func(target string, created map[string]bool) (unbound.HostOverrideID, bool) {
+		if ho, ok := s.state.HostOverride(target); ok {
+			return ho.ID, true
+		}
+		return "", created[state.Normalize(target)]
+	}
+
+	for _, ep := range changes.Delete {
+		op := "delete"
+		if s.softDelete {
+			op = "soft-delete"
+		}
+		change := resolvedChange{Op: op, Type: ep.RecordType, DNSName: ep.DNSName}
+
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			ho, ok := s.state.HostOverride(ep.DNSName)
+			if !ok {
+				unmatched(op, ep, "host override not found")
+				continue
+			}
+			change.UUID = string(ho.ID)
+			if s.softDelete {
+				ho.Enabled = "0"
+				ho.Description = tagSoftDeleted(ho.Description, time.Now(), s.ownerID)
+				change.Record = overrideRecord(ho)
+			}
+		case endpoint.RecordTypeCNAME:
+			ha, ok := s.state.HostAlias(ep.DNSName)
+			if !ok {
+				unmatched(op, ep, "host alias not found")
+				continue
+			}
+			change.UUID = string(ha.ID)
+			if s.softDelete {
+				ha.Enabled = "0"
+				ha.Description = tagSoftDeleted(ha.Description, time.Now(), s.ownerID)
+				change.Record = aliasRecord(ha)
+			}
+		default:
+			unmatched(op, ep, "unsupported record type")
+			continue
+		}
+		rp.Deletes = append(rp.Deletes, change)
+	}
+
+	for _, ep := range creates {
+		change := resolvedChange{Op: "create", Type: ep.RecordType, DNSName: ep.DNSName}
+
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			ho, ok := s.state.HostOverride(ep.DNSName)
+			switch {
+			case !ok:
+				ho = unbound.HostOverride{}
+				ho.Update(ep)
+				ho.Description = s.stampCreated(ho.Description)
+			case overrideSoftDeleted(ho):
+				change.Op = "restore"
+				ho.Description = untagSoftDeleted(ho.Description)
+				ho.Update(ep)
+				ho.Description = s.stampCreated(ho.Description)
+				ho.Enabled = "1"
+			case ho.Server == ep.Targets[0]:
+				change.Op = "none"
+			default:
+				change.Op = "update"
+				before := ho.Description
+				ho.Update(ep)
+				ho.Description = keepCreated(before, ho.Description)
+			}
+			change.UUID = string(ho.ID)
+			change.Record = overrideRecord(ho)
+		case endpoint.RecordTypeCNAME:
+			hostID, ok := hostOf(ep.Targets[0], createdAs)
+			if !ok {
+				unmatched("create", ep, "target host override not found")
+				continue
+			}
+			ha, ok := s.state.HostAlias(ep.DNSName)
+			switch {
+			case !ok:
+				ha = unbound.HostAlias{}
+				ha.Update(ep)
+				ha.Description = s.stampCreated(ha.Description)
+			case aliasSoftDeleted(ha):
+				change.Op = "restore"
+				ha.Description = untagSoftDeleted(ha.Description)
+				ha.Update(ep)
+				ha.Description = s.stampCreated(ha.Description)
+				ha.Enabled = "1"
+			case ha.HostID == hostID:
+				change.Op = "none"
+			default:
+				change.Op = "update"
+				before := ha.Description
+				ha.Update(ep)
+				ha.Description = keepCreated(before, ha.Description)
+			}
+			ha.HostID = hostID
+			change.UUID = string(ha.ID)
+			change.Record = aliasRecord(ha)
+		default:
+			unmatched("create", ep, "unsupported record type")
+			continue
+		}
+		rp.Creates = append(rp.Creates, change)
+	}
+
+	for i, oldEP := range changes.UpdateOld {
+		if createdInstead[i] {
+			continue
+		}
+		newEP := changes.UpdateNew[i]
+		op := "update"
+		if s.recreateRenames && renamed(oldEP, newEP) {
+			op = "recreate"
+		}
+		change := resolvedChange{Op: op, Type: newEP.RecordType, DNSName: newEP.DNSName}
+		if renamed(oldEP, newEP) {
+			change.OldDNSName = oldEP.DNSName
+		}
+
+		switch oldEP.RecordType {
+		case endpoint.RecordTypeA:
+			ho, _ := s.state.HostOverride(oldEP.DNSName)
+			before := ho.Description
+			ho.Update(newEP)
+			ho.Description = keepCreated(before, ho.Description)
+			change.UUID = string(ho.ID)
+			change.Record = overrideRecord(ho)
+		case endpoint.RecordTypeCNAME:
+			ha, _ := s.state.HostAlias(oldEP.DNSName)
+			hostID, ok := hostOf(newEP.Targets[0], mergeSets(createdAs, updatedAs))
+			if !ok {
+				unmatched(op, newEP, "target host override not found")
+				continue
+			}
+			before := ha.Description
+			ha.Update(newEP)
+			ha.Description = keepCreated(before, ha.Description)
+			ha.HostID = hostID
+			change.UUID = string(ha.ID)
+			change.Record = aliasRecord(ha)
+		default:
+			unmatched(op, newEP, "unsupported record type")
+			continue
+		}
+		rp.Updates = append(rp.Updates, change)
+	}
+
+	return rp
+}
+
+// missingForUpdate tells whether the update of oldEP finds no record to update, and so creates one instead.
+func (s *applyState) missingForUpdate(oldEP *endpoint.Endpoint) bool {
+	switch oldEP.RecordType {
+	case endpoint.RecordTypeA:
+		_, ok := s.state.HostOverride(oldEP.DNSName)
+		return !ok
+	case endpoint.RecordTypeCNAME:
+		_, ok := s.state.HostAlias(oldEP.DNSName)
+		return !ok
+	}
+	return false
+}
+
+func mergeSets(a, b map[string]bool) map[string]bool {
+	merged := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		merged[k] = true
+	}
+	for k := range b {
+		merged[k] = true
+	}
+	return merged
+}
@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestResolvePlan(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	listing := func() *state.State {
+		return state.FromListing(
+			[]unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: "NAS", Enabled: "1"},
+				{ID: "2", Hostname: "app", Domain: "example.com", Server: "10.0.0.1", Enabled: "1"},
+				{ID: "3", Hostname: "old", Domain: "example.com", Server: "10.0.0.3", Enabled: "0",
+					Description: tagSoftDeleted("Old", deletedAt, "")},
+			},
+			[][]unbound.HostAlias{
+				nil,
+				{{ID: "4", HostID: "2", Hostname: "www", Domain: "example.com", Host: "app.example.com", Enabled: "1"}},
+			},
+		)
+	}
+	resolving := func(opts ...Option) *applyState {
+		provider := &unboundProvider{}
+		for _, opt := range opts {
+			opt(provider)
+		}
+		return provider.newApplyState(nil, listing(), applyStats{})
+	}
+
+	t.Run("matches creates to the records listed", func(t *testing.T) {
+		rp := resolving().resolve(&plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "10.0.0.9"),
+			endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "10.0.0.4"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeCNAME, "new.example.com"),
+			endpoint.NewEndpoint("docs.example.com", endpoint.RecordTypeCNAME, "missing.example.com"),
+		}})
+
+		require.Equal(t, []resolvedChange{
+			{Op: "create", Type: "A", DNSName: "new.example.com",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "new", Domain: "example.com", Server: "10.0.0.9"}},
+			{Op: "restore", Type: "A", DNSName: "old.example.com", UUID: "3",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "old", Domain: "example.com", Server: "10.0.0.4", Description: "Old"}},
+			{Op: "none", Type: "A", DNSName: "nas.example.com", UUID: "1",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: "NAS"}},
+			{Op: "create", Type: "CNAME", DNSName: "api.example.com",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "api", Domain: "example.com", Host: "new.example.com"}},
+		}, rp.Creates)
+		require.Equal(t, []resolvedChange{
+			{Op: "create", Type: "CNAME", DNSName: "docs.example.com", Reason: "target host override not found"},
+		}, rp.Unmatched)
+	})
+
+	t.Run("matches updates to the records listed", func(t *testing.T) {
+		rp := resolving(WithRenameStrategy(RenameRecreate)).resolve(&plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "app.example.com"),
+				endpoint.NewEndpoint("gone.example.com", endpoint.RecordTypeA, "10.0.0.5"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.11"),
+				endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+				endpoint.NewEndpoint("gone.example.com", endpoint.RecordTypeA, "10.0.0.6"),
+			},
+		})
+
+		require.Equal(t, []resolvedChange{
+			{Op: "update", Type: "A", DNSName: "nas.example.com", UUID: "1",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.11", Description: "NAS"}},
+			{Op: "recreate", Type: "CNAME", DNSName: "web.example.com", OldDNSName: "www.example.com", UUID: "4",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "web", Domain: "example.com", Host: "nas.example.com", HostUUID: "1"}},
+		}, rp.Updates)
+		require.Equal(t, []resolvedChange{
+			{Op: "create", Type: "A", DNSName: "gone.example.com",
+				Record: &resolvedRecord{Enabled: "1", Hostname: "gone", Domain: "example.com", Server: "10.0.0.6"}},
+		}, rp.Creates, "updates of records not found are made as creates")
+		require.Empty(t, rp.Unmatched)
+	})
+
+	t.Run("matches deletes to the records listed", func(t *testing.T) {
+		rp := resolving().resolve(&plan.Changes{Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "app.example.com"),
+			endpoint.NewEndpoint("gone.example.com", endpoint.RecordTypeA, "10.0.0.5"),
+		}})
+
+		require.Equal(t, []resolvedChange{{Op: "delete", Type: "CNAME", DNSName: "www.example.com", UUID: "4"}}, rp.Deletes)
+		require.Equal(t, []resolvedChange{
+			{Op: "delete", Type: "A", DNSName: "gone.example.com", Reason: "host override not found"},
+		}, rp.Unmatched)
+	})
+
+	t.Run("sends soft deletes as updates of the record", func(t *testing.T) {
+		rp := resolving(WithSoftDelete(0)).resolve(&plan.Changes{Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+		}})
+
+		require.Len(t, rp.Deletes, 1)
+		require.Equal(t, "soft-delete", rp.Deletes[0].Op)
+		require.Equal(t, "0", rp.Deletes[0].Record.Enabled)
+		_, ok := softDeletedAt(rp.Deletes[0].Record.Enabled, rp.Deletes[0].Record.Description)
+		require.True(t, ok)
+	})
+
+	t.Run("marshals to JSON", func(t *testing.T) {
+		rp := resolving().resolve(createChanges("a.example.com"))
+
+		b, err := json.Marshal(rp)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"creates": [{"op": "create", "type": "A", "dnsName": "a.example.com",
+			"record": {"enabled": "1", "hostname": "a", "domain": "example.com", "server": "127.0.0.1", "description": ""}}]}`, string(b))
+	})
+}
+
+func TestApplyLogsResolvedPlan(t *testing.T) {
+	logs := recordLogs(t)
+	fake := &unboundtest.Fake{}
+	fake.Fail("CreateHostOverride", errors.New("boom"))
+	provider := &unboundProvider{api: fake}
+
+	require.Error(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+
+	level, attrs, ok := logs.find("resolved plan")
+	require.True(t, ok)
+	require.Equal(t, slog.LevelDebug, level)
+	require.Len(t, attrs["plan"].Any().(resolvedPlan).Creates, 1)
+}
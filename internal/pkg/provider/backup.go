@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// WithRecordBackups makes RunBackups write the records Records lists, as a records file, to path after
+// every successful apply, and every interval if above 0, so that they can be imported again should the OPNsense
+// configuration be lost. The file is replaced at once, and the keep backups before it are kept as path.1, path.2
+// and so on, the oldest last. Unchanged backups are not written again, so they don't rotate older ones out.
+func WithRecordBackups(path string, interval time.Duration, keep int) Option {
+	return func(p *unboundProvider) {
+		if path == "" {
+			p.backupWriter = nil
+			return
+		}
+		p.backupWriter = &backupWriter{path: path, interval: interval, keep: keep, requests: make(chan struct{}, 1)}
+	}
+}
+
+// backupWriter writes backups of the records to a records file.
+type backupWriter struct {
+	path     string
+	interval time.Duration
+	keep     int
+
+	// requests asks for a backup after an apply; a request pending covers later ones
+	requests chan struct{}
+}
+
+// request asks for a backup, unless one is already asked for.
+func (w *backupWriter) request() {
+	select {
+	case w.requests <- struct{}{}:
+	default:
+	}
+}
+
+// write replaces the backup at w.path with file, rotating the previous one, unless it holds the same records.
+// It tells whether the backup was written.
+func (w *backupWriter) write(file RecordsFile) (bool, error) {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	b = append(b, '\n')
+
+	current, err := os.ReadFile(w.path)
+	switch {
+	case err == nil && bytes.Equal(current, b):
+		return false, nil
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return false, fmt.Errorf("failed to read the previous backup: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if current != nil {
+		if err := w.rotate(); err != nil {
+			return false, fmt.Errorf("failed to rotate backups: %w", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return true, nil
+}
+
+// rotate shifts the previous backups, dropping the oldest, and links the current one as path.1,
+// so that path always holds a complete backup.
+func (w *backupWriter) rotate() error {
+	if w.keep <= 0 {
+		return nil
+	}
+	rotated := func(i int) string { return w.path + "." + strconv.Itoa(i) }
+
+	for i := w.keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(rotated(1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Link(w.path, rotated(1))
+}
+
+// RunBackups writes a backup of the records after every successful apply, and every backup interval,
+// until ctx is done. It returns immediately if backups are disabled.
+func (p *unboundProvider) RunBackups(ctx context.Context) {
+	w := p.backupWriter
+	if w == nil {
+		return
+	}
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-w.requests:
+		}
+		if err := p.writeBackup(ctx); err != nil && ctx.Err() == nil {
+			metrics.For(p.webhook).RecordBackups.WithLabelValues("failure").Inc()
+			p.log().Error("failed to back up records", slog.String("path", w.path), slog.Any("error", err))
+		}
+	}
+}
+
+// writeBackup lists the records and writes them to the backup. A listing without records doesn't replace
+// a backup with some, as it is more likely OPNsense lost them than that every record was deleted.
+func (p *unboundProvider) writeBackup(ctx context.Context) error {
+	w := p.backupWriter
+	records, err := p.Records(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list records: %w", err)
+	}
+
+	if len(records) == 0 {
+		if previous, err := LoadRecordsFile(w.path); err == nil && len(previous) > 0 {
+			p.log().Warn("listed no records, keeping the previous backup", slog.String("path", w.path),
+				slog.Int("records", len(previous)))
+			metrics.For(p.webhook).RecordBackups.WithLabelValues("unchanged").Inc()
+			return nil
+		}
+	}
+
+	written, err := w.write(NewRecordsFile(records))
+	if err != nil {
+		return err
+	}
+	if !written {
+		metrics.For(p.webhook).RecordBackups.WithLabelValues("unchanged").Inc()
+		p.log().Debug("records unchanged since the last backup", slog.String("path", w.path))
+		return nil
+	}
+	metrics.For(p.webhook).RecordBackups.WithLabelValues("written").Inc()
+	p.log().Info("wrote records backup", slog.String("path", w.path), slog.Int("records", len(records)))
+	return nil
+}
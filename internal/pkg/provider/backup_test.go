@@ -0,0 +1,172 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestBackups(t *testing.T) {
+	newProvider := func(t *testing.T, fake *unboundtest.Fake, keep int) (*unboundProvider, string) {
+		path := filepath.Join(t.TempDir(), "records.json")
+		p, err := NewUnboundProviderWithAPI(fake, WithRecordBackups(path, 0, keep))
+		require.NoError(t, err)
+		return p, path
+	}
+	load := func(t *testing.T, path string) []string {
+		t.Helper()
+		records, err := LoadRecordsFile(path)
+		require.NoError(t, err)
+		return dnsNames(records)
+	}
+
+	t.Run("writes records that import as they were listed", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 0)
+		require.NoError(t, p.ApplyChanges(context.Background(), &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10").
+				WithProviderSpecific(unbound.DescriptionProperty, "NAS"),
+			endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+		}}))
+
+		require.NoError(t, p.writeBackup(context.Background()))
+
+		listed, err := p.Records(context.Background())
+		require.NoError(t, err)
+		imported, err := LoadRecordsFile(path)
+		require.NoError(t, err)
+		require.Equal(t, NewRecordsFile(listed), NewRecordsFile(imported))
+		require.Equal(t, []string{"files.example.com", "nas.example.com"}, dnsNames(imported))
+	})
+
+	t.Run("replaces the backup at once, leaving no temporary files", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 0)
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.NoError(t, p.writeBackup(context.Background()))
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("b.example.com")))
+		require.NoError(t, p.writeBackup(context.Background()))
+
+		require.Equal(t, []string{"a.example.com", "b.example.com"}, load(t, path))
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("keeps the previous backup when it can't replace it", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 1)
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.NoError(t, p.writeBackup(context.Background()))
+
+		// A directory in the way of the rotation
+		require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0o700))
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("b.example.com")))
+		require.ErrorContains(t, p.writeBackup(context.Background()), "failed to rotate backups")
+
+		require.Equal(t, []string{"a.example.com"}, load(t, path))
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+
+	t.Run("rotates previous backups, dropping the oldest", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 2)
+		for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+			require.NoError(t, p.ApplyChanges(context.Background(), createChanges(name)))
+			require.NoError(t, p.writeBackup(context.Background()))
+		}
+
+		require.Len(t, load(t, path), 4)
+		require.Len(t, load(t, path+".1"), 3)
+		require.Len(t, load(t, path+".2"), 2)
+		require.NoFileExists(t, path+".3")
+	})
+
+	t.Run("doesn't rotate unchanged backups", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 2)
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.NoError(t, p.writeBackup(context.Background()))
+		require.NoError(t, p.writeBackup(context.Background()))
+
+		require.FileExists(t, path)
+		require.NoFileExists(t, path+".1")
+	})
+
+	t.Run("doesn't replace a backup with records by one without", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 2)
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.NoError(t, p.writeBackup(context.Background()))
+
+		fake.HostOverrides = nil
+		require.NoError(t, p.writeBackup(context.Background()))
+		require.Equal(t, []string{"a.example.com"}, load(t, path))
+		require.NoFileExists(t, path+".1")
+	})
+
+	t.Run("doesn't write a backup when records can't be listed", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 0)
+		fake.Fail("ListHostOverrides", errors.New("unreachable"))
+
+		require.ErrorContains(t, p.writeBackup(context.Background()), "unreachable")
+		require.NoFileExists(t, path)
+	})
+
+	t.Run("writes a backup after successful applies", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, path := newProvider(t, fake, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			p.RunBackups(ctx)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		require.NoError(t, p.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.Eventually(t, func() bool {
+			records, err := LoadRecordsFile(path)
+			return err == nil && len(records) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("writes a backup every interval", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "records.json")
+		fake := &unboundtest.Fake{}
+		p, err := NewUnboundProviderWithAPI(fake, WithRecordBackups(path, 10*time.Millisecond, 0))
+		require.NoError(t, err)
+		fake.HostOverrides = []unbound.HostOverride{{ID: "1", Enabled: "1", Hostname: "a", Domain: "example.com", Server: "192.168.1.10"}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			p.RunBackups(ctx)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		require.Eventually(t, func() bool {
+			records, err := LoadRecordsFile(path)
+			return err == nil && len(records) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
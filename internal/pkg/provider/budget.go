@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// ErrBudgetExhausted is returned for changes that ran out of their share of the apply deadline,
+// as opposed to the apply running out of time as a whole.
+var ErrBudgetExhausted = errors.New("change ran out of its share of the apply deadline")
+
+// defaultMinOperationTimeout is the least time a change gets of the apply deadline, however many remain.
+const defaultMinOperationTimeout = time.Second
+
+// WithApplyTimeout bounds every ApplyChanges to d, shared across its changes as set by WithOperationTimeouts.
+// Changes left when it runs out are left to the next sync. 0 disables the timeout.
+func WithApplyTimeout(d time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.applyTimeout = d
+	}
+}
+
+// WithOperationTimeouts bounds the share of the deadline of an apply each of its changes gets to between
+// least and most, so that a slow change doesn't use up the time of the changes after it. The share is the time
+// left split across the changes left, as many running at once as set by WithApplyConcurrency. 0 leaves a bound
+// unset. Only applies with a deadline, such as set by WithApplyTimeout, are shared. The least defaults to a second.
+func WithOperationTimeouts(least, most time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.minOperationTimeout = least
+		p.maxOperationTimeout = most
+	}
+}
+
+// budget shares the time left before the deadline of an apply across its changes.
+type budget struct {
+	deadline    time.Time
+	least, most time.Duration
+	concurrency int
+	now         func() time.Time
+
+	// pending counts the changes not started yet
+	pending atomic.Int64
+}
+
+// newBudget returns the budget of the changes of an apply run with ctx, or nil if ctx has no deadline.
+func (p *unboundProvider) newBudget(ctx context.Context, changes int) *budget {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	b := &budget{
+		deadline:    deadline,
+		least:       p.minOperationTimeout,
+		most:        p.maxOperationTimeout,
+		concurrency: max(p.applyConcurrency, 1),
+		now:         p.now,
+	}
+	b.pending.Store(int64(changes))
+	return b
+}
+
+// share returns the timeout of the next of pending changes.
+func (b *budget) share(pending int) time.Duration {
+	rounds := (max(pending, 1) + b.concurrency - 1) / b.concurrency
+	d := b.deadline.Sub(b.now()) / time.Duration(rounds)
+	if b.most > 0 && d > b.most {
+		d = b.most
+	}
+	if d < b.least {
+		d = b.least
+	}
+	return d
+}
+
+// budgeted runs fn, the change op, within its share of the budget, if any.
+func (s *applyState) budgeted(op string, fn applyOp) applyOp {
+	b := s.budget
+	if b == nil {
+		return fn
+	}
+
+	return func(ctx context.Context) error {
+		d := b.share(int(b.pending.Add(-1)) + 1)
+		opCtx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		err := fn(opCtx)
+		if err != nil && ctx.Err() == nil && errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+			metrics.For(s.webhook).BudgetExhausted.WithLabelValues(op).Inc()
+			return fmt.Errorf("%w after %s: %w", ErrBudgetExhausted, d.Round(time.Millisecond), err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestBudgetShare(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	for name, tc := range map[string]struct {
+		left        time.Duration
+		least, most time.Duration
+		concurrency int
+		pending     int
+		want        time.Duration
+	}{
+		"splits the time left across the changes left":  {left: 10 * time.Second, concurrency: 1, pending: 5, want: 2 * time.Second},
+		"gives the last change all the time left":       {left: 10 * time.Second, concurrency: 1, pending: 1, want: 10 * time.Second},
+		"splits it across rounds of concurrent changes": {left: 10 * time.Second, concurrency: 2, pending: 5, want: 10 * time.Second / 3},
+		"gives at most the ceiling":                     {left: 10 * time.Second, most: 3 * time.Second, concurrency: 1, pending: 1, want: 3 * time.Second},
+		"gives at least the floor":                      {left: 10 * time.Second, least: time.Second, concurrency: 1, pending: 100, want: time.Second},
+		"gives the floor past the deadline as well":     {left: -time.Second, least: time.Second, concurrency: 1, pending: 1, want: time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := &budget{deadline: now.Add(tc.left), least: tc.least, most: tc.most, concurrency: tc.concurrency, now: clock}
+			require.Equal(t, tc.want, b.share(tc.pending))
+		})
+	}
+
+	t.Run("shares the time left as time goes by", func(t *testing.T) {
+		b := &budget{deadline: now.Add(10 * time.Second), concurrency: 1, now: clock}
+		require.Equal(t, 2*time.Second, b.share(5))
+		now = now.Add(6 * time.Second)
+		require.Equal(t, time.Second, b.share(4))
+	})
+}
+
+// slowAPI blocks creating the override of slow until the call is canceled.
+type slowAPI struct {
+	*unboundtest.Fake
+	slow string
+}
+
+func (s slowAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	if ho.Hostname == s.slow {
+		<-ctx.Done()
+		return unbound.HostOverride{}, ctx.Err()
+	}
+	return s.Fake.CreateHostOverride(ctx, ho)
+}
+
+func TestApplyBudget(t *testing.T) {
+	changes := func() *plan.Changes {
+		return &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+		}}
+	}
+
+	t.Run("fails the slow change alone, once out of its share", func(t *testing.T) {
+		exhausted := testutil.ToFloat64(metrics.Default.BudgetExhausted.WithLabelValues("create"))
+		fake := &unboundtest.Fake{}
+		provider := newUnboundProvider([]Option{
+			WithApplyConcurrency(2),
+			WithApplyTimeout(10 * time.Second),
+			WithOperationTimeouts(0, 50*time.Millisecond),
+		})
+		provider.api = slowAPI{Fake: fake, slow: "a"}
+
+		start := time.Now()
+		err := provider.ApplyChanges(context.Background(), changes())
+
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.ErrorIs(t, err, ErrBudgetExhausted)
+		errs := EndpointErrors(err)
+		require.Len(t, errs, 1)
+		require.Equal(t, "a.example.com", errs[0].Endpoint.DNSName)
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, exhausted+1, testutil.ToFloat64(metrics.Default.BudgetExhausted.WithLabelValues("create")))
+	})
+
+	t.Run("leaves changes unbounded without a deadline", func(t *testing.T) {
+		provider := newUnboundProvider([]Option{WithOperationTimeouts(0, 50*time.Millisecond)})
+		provider.api = &unboundtest.Fake{}
+		ctx := context.Background()
+
+		require.Nil(t, provider.newBudget(ctx, 2))
+		require.NoError(t, provider.ApplyChanges(ctx, changes()))
+	})
+
+	t.Run("tells the apply deadline apart from the share", func(t *testing.T) {
+		provider := newUnboundProvider([]Option{WithApplyTimeout(50 * time.Millisecond), WithOperationTimeouts(time.Minute, 0)})
+		provider.api = slowAPI{Fake: &unboundtest.Fake{}, slow: "a"}
+
+		err := provider.ApplyChanges(context.Background(), changes())
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, ErrBudgetExhausted)
+	})
+}
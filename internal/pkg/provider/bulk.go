@@ -0,0 +1,338 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// WithBulkApply applies plans of at least threshold changes by reading the Unbound settings,
+// making the changes to them, and writing them back in one call, instead of calling the API for every record.
+// Host overrides and aliases the plan doesn't touch are written back as they were read. 0 disables bulk applies.
+func WithBulkApply(threshold int) Option {
+	return func(p *unboundProvider) {
+		p.bulkThreshold = threshold
+	}
+}
+
+// bulkTarget returns the settings API to apply changes to in bulk, if they are enough to.
+func (p *unboundProvider) bulkTarget(target unbound.API, changes *plan.Changes) (unbound.SettingsAPI, bool) {
+	if p.bulkThreshold <= 0 {
+		return nil, false
+	}
+	if countChanges(changes) < p.bulkThreshold {
+		return nil, false
+	}
+	api, ok := target.(unbound.SettingsAPI)
+	return api, ok
+}
+
+// bulkChange is a change made to the settings as part of a bulk apply.
+type bulkChange struct {
+	op string
+	ep *endpoint.Endpoint
+}
+
+// applyBulk makes changes to the host settings read from api, in the same order as the per-record phases,
+// and writes them back once. Nothing is written when any change can't be made.
+func (s *applyState) applyBulk(ctx context.Context, api unbound.SettingsAPI, changes *plan.Changes) error {
+	settings, err := api.GetHostSettings(ctx)
+	if err != nil {
+		s.logger.Error("failed to read unbound settings", slog.Any("error", err))
+		return fmt.Errorf("failed to read unbound settings: %w", err)
+	}
+
+	b := &bulkApply{settings: settings, applyState: s, stats: applyStats{}}
+
+	var deleteCNAMEs, deleteAs, createAs, createCNAMEs, updateAs, updateCNAMEs []func() error
+	for _, ep := range changes.Delete {
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			deleteAs = append(deleteAs, b.change("delete", ep, func() error { return b.deleteA(ep) }))
+		case endpoint.RecordTypeCNAME:
+			deleteCNAMEs = append(deleteCNAMEs, b.change("delete", ep, func() error { return b.deleteCNAME(ep) }))
+		default:
+			s.logger.Warn("unsupported record type", slog.String("op", "delete"), slog.Any("endpoint", ep))
+		}
+	}
+	for _, ep := range changes.Create {
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			createAs = append(createAs, b.change("create", ep, func() error { return b.createA(ep) }))
+		case endpoint.RecordTypeCNAME:
+			createCNAMEs = append(createCNAMEs, b.change("create", ep, func() error { return b.createCNAME(ep) }))
+		default:
+			s.logger.Warn("unsupported record type", slog.String("op", "create"), slog.Any("endpoint", ep))
+		}
+	}
+	for i, oldEP := range changes.UpdateOld {
+		newEP := changes.UpdateNew[i]
+		switch oldEP.RecordType {
+		case endpoint.RecordTypeA:
+			updateAs = append(updateAs, b.change("update", newEP, func() error { return b.updateA(oldEP, newEP) }))
+		case endpoint.RecordTypeCNAME:
+			updateCNAMEs = append(updateCNAMEs, b.change("update", newEP, func() error { return b.updateCNAME(oldEP, newEP) }))
+		default:
+			s.logger.Warn("unsupported record type", slog.String("op", "update"),
+				slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+		}
+	}
+
+	for _, phase := range [][]func() error{deleteCNAMEs, deleteAs, createAs, createCNAMEs, updateAs, updateCNAMEs} {
+		for _, change := range phase {
+			if err := change(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.logger.Info("applying changes in bulk", slog.Int("changes", len(b.changes)),
+		slog.Int("hostOverrides", len(settings.Hosts)), slog.Int("hostAliases", len(settings.Aliases)))
+
+	var ids []uint64
+	if s.journal != nil {
+		for _, c := range b.changes {
+			ids = append(ids, s.journal.begin(c.op, c.ep))
+		}
+	}
+
+	err = api.SetHostSettings(ctx, settings)
+
+	for _, id := range ids {
+		if err != nil && (ctx.Err() != nil || unbound.IsTransient(err)) {
+			s.journal.abandon(id)
+		} else {
+			s.journal.finish(id)
+		}
+	}
+	if err != nil {
+		s.logger.Error("failed to write unbound settings", slog.Any("error", err))
+		return fmt.Errorf("failed to write unbound settings: %w", err)
+	}
+	b.followWrittenIDs()
+
+	for op, types := range b.stats {
+		for recordType, n := range types {
+			for range n {
+				s.add(op, recordType)
+			}
+		}
+	}
+	return nil
+}
+
+// bulkApply is a bulk apply in progress. The state follows the changes made to the settings,
+// so that aliases created or updated later resolve the overrides created earlier.
+type bulkApply struct {
+	*applyState
+	settings *unbound.HostSettings
+	changes  []bulkChange
+	stats    applyStats
+}
+
+// followWrittenIDs updates the state to the IDs OPNsense gave the records written, where they differ from
+// the ones they were put under.
+func (b *bulkApply) followWrittenIDs() {
+	for _, ho := range b.state.HostOverrides() {
+		if id := b.settings.WrittenHostOverrideID(ho.ID); id != ho.ID {
+			b.state.DeleteHostOverride(ho)
+			ho.ID = id
+			b.state.PutHostOverride(ho)
+		}
+	}
+	for _, ha := range b.state.HostAliases() {
+		id, hostID := b.settings.WrittenHostAliasID(ha.ID), b.settings.WrittenHostOverrideID(ha.HostID)
+		if id != ha.ID || hostID != ha.HostID {
+			b.state.DeleteHostAlias(ha)
+			ha.ID, ha.HostID = id, hostID
+			b.state.PutHostAlias(ha)
+		}
+	}
+}
+
+// change records the change of ep made by fn, to journal it once the settings are written.
+// Errors are returned as *EndpointError.
+func (b *bulkApply) change(op string, ep *endpoint.Endpoint, fn func() error) func() error {
+	return func() error {
+		b.changes = append(b.changes, bulkChange{op: op, ep: ep})
+		return failing(op, ep, fn)
+	}
+}
+
+func (b *bulkApply) deleteA(ep *endpoint.Endpoint) error {
+	if b.softDelete {
+		return b.softDeleteA(ep)
+	}
+
+	logger := b.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+	ho, ok := b.state.HostOverride(ep.DNSName)
+	if !ok {
+		logger.Warn("Host Override not found")
+		return nil
+	}
+
+	b.state.DeleteHostOverride(ho)
+	if _, ok := b.settings.HostOverride(ho.ID); !ok {
+		logger.Debug("Host Override already deleted", slog.Any("hostOverride", ho))
+		return nil
+	}
+	b.settings.DeleteHostOverride(ho.ID)
+	b.stats.add("deleted", endpoint.RecordTypeA)
+	return nil
+}
+
+func (b *bulkApply) deleteCNAME(ep *endpoint.Endpoint) error {
+	if b.softDelete {
+		return b.softDeleteCNAME(ep)
+	}
+
+	logger := b.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+	ha, ok := b.state.HostAlias(ep.DNSName)
+	if !ok {
+		logger.Warn("Host Alias not found")
+		return nil
+	}
+
+	b.state.DeleteHostAlias(ha)
+	if _, ok := b.settings.HostAlias(ha.ID); !ok {
+		logger.Debug("Host Alias already deleted", slog.Any("hostAlias", ha))
+		return nil
+	}
+	b.settings.DeleteHostAlias(ha.ID)
+	b.stats.add("deleted", endpoint.RecordTypeCNAME)
+	return nil
+}
+
+func (b *bulkApply) createA(ep *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+	if existing, ok := b.state.HostOverride(ep.DNSName); ok {
+		if overrideSoftDeleted(existing) {
+			return b.restoreA(existing, ep)
+		}
+		if existing.Server == ep.Targets[0] {
+			logger.Info("Host Override already exists", slog.Any("hostOverride", existing))
+			return nil
+		}
+		logger.Info("Host Override already exists with another target, updating it", slog.Any("hostOverride", existing))
+		return b.updateA(ep, ep)
+	}
+
+	ho := unbound.HostOverride{}
+	ho.Update(ep)
+	ho.Description = b.stampCreated(ho.Description)
+	ho = b.settings.PutHostOverride(ho)
+	b.stats.add("created", endpoint.RecordTypeA)
+	b.state.PutHostOverride(ho)
+	return nil
+}
+
+func (b *bulkApply) createCNAME(ep *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+	ho, ok := b.state.HostOverride(ep.Targets[0])
+	if !ok {
+		logger.Warn("Target Host Override not found for Host Alias")
+		return fmt.Errorf("failed to create host alias: target host override not found")
+	}
+
+	if existing, ok := b.state.HostAlias(ep.DNSName); ok {
+		if aliasSoftDeleted(existing) {
+			return b.restoreCNAME(existing, ho, ep)
+		}
+		if existing.HostID == ho.ID {
+			logger.Info("Host Alias already exists", slog.Any("hostAlias", existing))
+			return nil
+		}
+		logger.Info("Host Alias already exists with another target, updating it", slog.Any("hostAlias", existing))
+		return b.updateCNAME(ep, ep)
+	}
+
+	ha := unbound.HostAlias{HostID: ho.ID}
+	ha.Update(ep)
+	ha.Description = b.stampCreated(ha.Description)
+	ha = b.settings.PutHostAlias(ha)
+	b.stats.add("created", endpoint.RecordTypeCNAME)
+	b.state.PutHostAlias(ha)
+	return nil
+}
+
+func (b *bulkApply) updateA(oldEP, newEP *endpoint.Endpoint) error {
+	if b.recreateRenames && renamed(oldEP, newEP) {
+		return b.recreateA(oldEP, newEP)
+	}
+
+	logger := b.logger.With(slog.String("op", "update"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+	ho, ok := b.state.HostOverride(oldEP.DNSName)
+	if !ok {
+		b.createInstead(logger, newEP)
+		return b.createA(newEP)
+	}
+	var targeting []unbound.HostAlias
+	if renamed(oldEP, newEP) {
+		targeting = b.state.HostAliasesTargeting(oldEP.DNSName)
+	}
+
+	// The settings hold the fields external-dns doesn't manage as they are now
+	current, ok := b.settings.HostOverride(ho.ID)
+	if !ok {
+		logger.Info("Host Override deleted meanwhile, creating it again", slog.Any("hostOverride", ho))
+		metrics.For(b.webhook).UpdatesCreated.WithLabelValues(endpoint.RecordTypeA).Inc()
+		b.state.DeleteHostOverride(ho)
+		return b.createA(newEP)
+	}
+
+	before := current.Description
+	current.Update(newEP)
+	current.Description = keepCreated(before, current.Description)
+	b.settings.PutHostOverride(current)
+	b.stats.add("updated", endpoint.RecordTypeA)
+	b.state.PutHostOverride(current)
+	b.followRename(logger, targeting, current)
+	return nil
+}
+
+func (b *bulkApply) updateCNAME(oldEP, newEP *endpoint.Endpoint) error {
+	if b.recreateRenames && renamed(oldEP, newEP) {
+		return b.recreateCNAME(oldEP, newEP)
+	}
+
+	logger := b.logger.With(slog.String("op", "update"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+	haOld, ok := b.state.HostAlias(oldEP.DNSName)
+	if !ok {
+		b.createInstead(logger, newEP)
+		return b.createCNAME(newEP)
+	}
+
+	ho, ok := b.state.HostOverride(newEP.Targets[0])
+	if !ok {
+		logger.Warn("Target Host Override not found for Host Alias")
+		return fmt.Errorf("failed to update host alias: target host override not found")
+	}
+
+	ha, ok := b.settings.HostAlias(haOld.ID)
+	if !ok {
+		logger.Info("Host Alias deleted meanwhile, creating it again", slog.Any("hostAlias", haOld))
+		metrics.For(b.webhook).UpdatesCreated.WithLabelValues(endpoint.RecordTypeCNAME).Inc()
+		b.state.DeleteHostAlias(haOld)
+		return b.createCNAME(newEP)
+	}
+
+	before := ha.Description
+	ha.Update(newEP)
+	ha.Description = keepCreated(before, ha.Description)
+	ha.HostID = ho.ID
+	b.settings.PutHostAlias(ha)
+	b.stats.add("updated", endpoint.RecordTypeCNAME)
+	b.state.PutHostAlias(ha)
+	return nil
+}
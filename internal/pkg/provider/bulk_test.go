@@ -0,0 +1,272 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// settingsAPI serves the records of a fake as Unbound settings too, next to records external-dns doesn't manage.
+type settingsAPI struct {
+	*unboundtest.Fake
+	unmanaged map[unbound.HostOverrideID]unbound.SettingsFields
+	gets      int
+	getErr    error
+	sets      int
+	setErr    error
+}
+
+func (s *settingsAPI) GetSettings(_ context.Context) (*unbound.Settings, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.gets++
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	return &unbound.Settings{HostOverrides: slices.Clone(s.HostOverrides), HostAliases: slices.Clone(s.HostAliases)}, nil
+}
+
+func (s *settingsAPI) getCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.gets
+}
+
+func (s *settingsAPI) GetHostSettings(_ context.Context) (*unbound.HostSettings, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	settings := &unbound.HostSettings{
+		Hosts:   map[unbound.HostOverrideID]unbound.SettingsFields{},
+		Aliases: map[unbound.HostAliasID]unbound.SettingsFields{},
+	}
+	for id, f := range s.unmanaged {
+		settings.Hosts[id] = cloneFields(f)
+	}
+	for _, ho := range s.HostOverrides {
+		settings.PutHostOverride(ho)
+		if ho.Enabled == "0" {
+			settings.ToggleHostOverride(ho.ID, false)
+		}
+	}
+	for _, ha := range s.HostAliases {
+		settings.PutHostAlias(ha)
+		if ha.Enabled == "0" {
+			settings.ToggleHostAlias(ha.ID, false)
+		}
+	}
+	return settings, nil
+}
+
+func (s *settingsAPI) SetHostSettings(_ context.Context, settings *unbound.HostSettings) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.setErr != nil {
+		return s.setErr
+	}
+	s.sets++
+
+	s.HostOverrides, s.HostAliases = nil, nil
+	s.unmanaged = map[unbound.HostOverrideID]unbound.SettingsFields{}
+	for id, f := range settings.Hosts {
+		if f["rr"] != "A" {
+			s.unmanaged[id] = cloneFields(f)
+			continue
+		}
+		ho, _ := settings.HostOverride(id)
+		s.HostOverrides = append(s.HostOverrides, ho)
+	}
+	for id := range settings.Aliases {
+		ha, _ := settings.HostAlias(id)
+		s.HostAliases = append(s.HostAliases, ha)
+	}
+	return nil
+}
+
+func (s *settingsAPI) setCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sets
+}
+
+func cloneFields(f unbound.SettingsFields) unbound.SettingsFields {
+	c := make(unbound.SettingsFields, len(f))
+	for k, v := range f {
+		c[k] = v
+	}
+	return c
+}
+
+var _ unbound.SettingsAPI = &settingsAPI{}
+
+func TestBulkApply(t *testing.T) {
+	aaaa := unbound.SettingsFields{
+		"enabled":     "0",
+		"hostname":    "nas",
+		"domain":      "example.com",
+		"rr":          "AAAA",
+		"mxprio":      "",
+		"mx":          "",
+		"server":      "fd00::20",
+		"description": "Added in the UI",
+	}
+
+	existing := func() *settingsAPI {
+		return &settingsAPI{
+			Fake: &unboundtest.Fake{
+				HostOverrides: []unbound.HostOverride{
+					{ID: "1", Hostname: "ha", Domain: "example.com", Server: "127.0.0.1", Description: "Home Assistant"},
+					{ID: "2", Hostname: "old", Domain: "example.com", Server: "127.0.0.1"},
+				},
+				HostAliases: []unbound.HostAlias{
+					{ID: "3", HostID: "2", Hostname: "www", Domain: "example.com", Host: "old.example.com"},
+				},
+			},
+			unmanaged: map[unbound.HostOverrideID]unbound.SettingsFields{"4": cloneFields(aaaa)},
+		}
+	}
+
+	migration := func() *plan.Changes {
+		return &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeCNAME, "new.example.com"),
+			},
+			UpdateOld: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("ha.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "old.example.com"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("ha.example.com", endpoint.RecordTypeA, "127.0.0.3"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "new.example.com"),
+			},
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			},
+		}
+	}
+
+	t.Run("writes the settings once and reconfigures once", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api, bulkThreshold: 5, journal: newJournal(slog.Default())}
+		provider.reconfigurer = newReconfigurer(api, 0, 3, slog.Default())
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+		require.Equal(t, 1, api.setCount())
+		require.Equal(t, 1, api.Calls("Reconfigure"))
+		require.Zero(t, provider.journal.pendingRecovery())
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		targets := map[string]string{}
+		for _, ep := range records {
+			targets[ep.DNSName] = ep.Targets[0]
+		}
+		require.Equal(t, map[string]string{
+			"ha.example.com":  "127.0.0.3",
+			"new.example.com": "127.0.0.2",
+			"app.example.com": "new.example.com",
+			"www.example.com": "new.example.com",
+		}, targets)
+
+		stats := provider.Status().LastApply
+		require.Equal(t, map[string]int{"A": 1, "CNAME": 1}, stats.Created)
+		require.Equal(t, map[string]int{"A": 1, "CNAME": 1}, stats.Updated)
+		require.Equal(t, map[string]int{"A": 1}, stats.Deleted)
+	})
+
+	t.Run("leaves records the plan doesn't touch as they are", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+
+		require.Equal(t, map[unbound.HostOverrideID]unbound.SettingsFields{"4": aaaa}, api.unmanaged)
+		ha, err := api.GetHostOverride(context.Background(), "1")
+		require.NoError(t, err)
+		require.Equal(t, "Home Assistant", ha.Description)
+	})
+
+	t.Run("resolves aliases of overrides created in the same write", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+
+		var created unbound.HostOverride
+		for _, ho := range api.HostOverrides {
+			if ho.Hostname == "new" {
+				created = ho
+			}
+		}
+		require.NotEmpty(t, created.ID)
+		for _, ha := range api.HostAliases {
+			require.Equal(t, created.ID, ha.HostID, "alias %s", ha.DNSName())
+		}
+	})
+
+	t.Run("applies plans below the threshold record by record", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api, bulkThreshold: 6}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+		require.Zero(t, api.setCount())
+		require.Equal(t, map[unbound.HostOverrideID]unbound.SettingsFields{"4": aaaa}, api.unmanaged)
+	})
+
+	t.Run("applies plans record by record when disabled", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+		require.Zero(t, api.setCount())
+	})
+
+	t.Run("writes nothing when a change can't be made", func(t *testing.T) {
+		api := existing()
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+
+		changes := migration()
+		changes.Create = append(changes.Create, endpoint.NewEndpoint("dangling.example.com", endpoint.RecordTypeCNAME, "missing.example.com"))
+		err := provider.ApplyChanges(context.Background(), changes)
+		require.ErrorContains(t, err, "target host override not found")
+		require.Zero(t, api.setCount())
+		require.Len(t, api.HostOverrides, 2)
+	})
+
+	t.Run("keeps changes in the journal when the write has an unknown outcome", func(t *testing.T) {
+		api := existing()
+		api.setErr = fmt.Errorf("setSettings failed: %w", unbound.ErrUnavailable)
+		provider := &unboundProvider{api: api, bulkThreshold: 1, journal: newJournal(slog.Default())}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+		require.Equal(t, 5, provider.journal.pendingRecovery())
+		require.Empty(t, provider.Status().LastApply.Created)
+	})
+
+	t.Run("doesn't keep changes in the journal when the write is rejected", func(t *testing.T) {
+		api := existing()
+		api.setErr = fmt.Errorf("setSettings failed: %w", unbound.ErrValidation)
+		provider := &unboundProvider{api: api, bulkThreshold: 1, journal: newJournal(slog.Default())}
+
+		err := provider.ApplyChanges(context.Background(), migration())
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.Zero(t, provider.journal.pendingRecovery())
+	})
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+type freshRecordsKey struct{}
+
+// WithFreshRecords returns a context that makes Records bypass the cache.
+func WithFreshRecords(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshRecordsKey{}, true)
+}
+
+func wantsFreshRecords(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshRecordsKey{}).(bool)
+	return fresh
+}
+
+// recordsCache holds the last listing of records for up to ttl.
+// Every invalidation bumps the generation, so that a listing which started
+// before an apply can't repopulate the cache with pre-apply state.
+type recordsCache struct {
+	ttl     time.Duration
+	webhook string
+
+	mu         sync.Mutex
+	records    []*endpoint.Endpoint
+	listed     time.Time
+	expires    time.Time
+	generation uint64
+}
+
+// get returns a copy of the cached records, if they haven't expired and fresh records aren't wanted,
+// and the current generation. It counts a hit or a miss, and the expiry of the records it finds expired.
+func (c *recordsCache) get(now time.Time, fresh bool) ([]*endpoint.Endpoint, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.records != nil && !now.Before(c.expires) {
+		c.records = nil
+		metrics.For(c.webhook).CacheInvalidations.WithLabelValues("ttl").Inc()
+	}
+	if c.records == nil || fresh {
+		// The records served are listed now
+		metrics.For(c.webhook).CacheMisses.Inc()
+		metrics.For(c.webhook).CacheAge.Set(0)
+		return nil, c.generation, false
+	}
+	metrics.For(c.webhook).CacheHits.Inc()
+	metrics.For(c.webhook).CacheAge.Set(now.Sub(c.listed).Seconds())
+	return copyEndpoints(c.records), c.generation, true
+}
+
+// put caches records listed during generation, unless the cache was invalidated since.
+func (c *recordsCache) put(now time.Time, generation uint64, records []*endpoint.Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.records = copyEndpoints(records)
+	c.listed = now
+	c.expires = now.Add(c.ttl)
+}
+
+// invalidate drops the cached records, counting the invalidation by reason: "apply" for records written
+// by the provider, "manual" for records written on request, such as restores.
+func (c *recordsCache) invalidate(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.records = nil
+	c.generation++
+	metrics.For(c.webhook).CacheInvalidations.WithLabelValues(reason).Inc()
+}
+
+func copyEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	res := make([]*endpoint.Endpoint, len(endpoints))
+	for i, e := range endpoints {
+		res[i] = e.DeepCopy()
+	}
+	return res
+}
+
+// lastListing keeps the last successful listing from the primary, to serve in place of a failed one
+// while it is younger than maxAge. Unlike recordsCache, it survives applies: stale records are only
+// served when OPNsense can't be reached, and then changes planned against them fail to apply anyway.
+type lastListing struct {
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	records []*endpoint.Endpoint
+	listed  time.Time
+}
+
+// get returns a copy of the last listing and its age, if it is younger than maxAge.
+func (l *lastListing) get(now time.Time) ([]*endpoint.Endpoint, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	age := now.Sub(l.listed)
+	if l.records == nil || age > l.maxAge {
+		return nil, age, false
+	}
+	return copyEndpoints(l.records), age, true
+}
+
+func (l *lastListing) put(now time.Time, records []*endpoint.Endpoint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = copyEndpoints(records)
+	l.listed = now
+}
@@ -0,0 +1,305 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestRecordsCache(t *testing.T) {
+	newProvider := func(ttl time.Duration) (*unboundProvider, *unboundtest.Fake) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithCacheTTL(ttl)(provider)
+		return provider, fake
+	}
+
+	t.Run("serves records from memory within the TTL", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		first, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		second, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		require.Equal(t, first, second)
+		require.Equal(t, 1, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("picks up out-of-band changes once the TTL expires", func(t *testing.T) {
+		provider, fake := newProvider(20 * time.Millisecond)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.HostOverrides = append(fake.HostOverrides,
+			unbound.HostOverride{ID: "2", Hostname: "b", Domain: "example.com", Server: "127.0.0.2"})
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+
+		time.Sleep(30 * time.Millisecond)
+
+		records, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+	})
+
+	t.Run("is invalidated by ApplyChanges", func(t *testing.T) {
+		provider, _ := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+	})
+
+	t.Run("is bypassed for fresh records", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		_, err = provider.Records(WithFreshRecords(context.Background()))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("is not affected by callers modifying the returned records", func(t *testing.T) {
+		provider, _ := newProvider(time.Hour)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		records[0].Targets[0] = "10.0.0.1"
+
+		records, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("127.0.0.1"), records[0].Targets)
+	})
+
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		provider, _ := newProvider(time.Millisecond)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, err := provider.Records(context.Background())
+					require.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("discards listings that started before an invalidation", func(t *testing.T) {
+		cache := &recordsCache{ttl: time.Hour}
+		now := time.Now()
+
+		_, generation, ok := cache.get(now, false)
+		require.False(t, ok)
+
+		cache.invalidate("apply")
+		cache.put(now, generation, []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", "A", "127.0.0.1")})
+
+		_, _, ok = cache.get(now, false)
+		require.False(t, ok)
+	})
+}
+
+func TestRecordsCacheMetrics(t *testing.T) {
+	type counts struct{ hits, misses, apply, ttl, manual float64 }
+	current := func() counts {
+		return counts{
+			hits:   testutil.ToFloat64(metrics.Default.CacheHits),
+			misses: testutil.ToFloat64(metrics.Default.CacheMisses),
+			apply:  testutil.ToFloat64(metrics.Default.CacheInvalidations.WithLabelValues("apply")),
+			ttl:    testutil.ToFloat64(metrics.Default.CacheInvalidations.WithLabelValues("ttl")),
+			manual: testutil.ToFloat64(metrics.Default.CacheInvalidations.WithLabelValues("manual")),
+		}
+	}
+	since := func(before counts) counts {
+		now := current()
+		return counts{now.hits - before.hits, now.misses - before.misses, now.apply - before.apply, now.ttl - before.ttl, now.manual - before.manual}
+	}
+	records := []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1")}
+
+	t.Run("counts hits, misses and expiries, and the age of records served", func(t *testing.T) {
+		cache := &recordsCache{ttl: time.Minute}
+		listed := time.Now()
+		before := current()
+
+		_, generation, ok := cache.get(listed, false)
+		require.False(t, ok)
+		require.Equal(t, 0.0, testutil.ToFloat64(metrics.Default.CacheAge))
+		cache.put(listed, generation, records)
+
+		_, _, ok = cache.get(listed.Add(10*time.Second), false)
+		require.True(t, ok)
+		require.Equal(t, 10.0, testutil.ToFloat64(metrics.Default.CacheAge))
+		_, _, ok = cache.get(listed.Add(30*time.Second), false)
+		require.True(t, ok)
+		require.Equal(t, 30.0, testutil.ToFloat64(metrics.Default.CacheAge))
+
+		_, _, ok = cache.get(listed.Add(time.Minute), false)
+		require.False(t, ok)
+		_, _, ok = cache.get(listed.Add(2*time.Minute), false)
+		require.False(t, ok)
+		require.Equal(t, 0.0, testutil.ToFloat64(metrics.Default.CacheAge))
+
+		require.Equal(t, counts{hits: 2, misses: 3, ttl: 1}, since(before), "an expiry is counted once")
+	})
+
+	t.Run("counts fresh listings as misses", func(t *testing.T) {
+		cache := &recordsCache{ttl: time.Minute}
+		now := time.Now()
+		_, generation, _ := cache.get(now, false)
+		cache.put(now, generation, records)
+		before := current()
+
+		_, _, ok := cache.get(now, true)
+		require.False(t, ok)
+		_, _, ok = cache.get(now, false)
+		require.True(t, ok)
+
+		require.Equal(t, counts{hits: 1, misses: 1}, since(before))
+	})
+
+	t.Run("counts invalidations by applies", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake}
+		WithCacheTTL(time.Hour)(provider)
+		before := current()
+
+		for range 2 {
+			_, err := provider.Records(context.Background())
+			require.NoError(t, err)
+		}
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("b.example.com")))
+		for range 2 {
+			_, err := provider.Records(context.Background())
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, counts{hits: 2, misses: 2, apply: 1}, since(before))
+	})
+
+	t.Run("counts invalidations by restores as manual", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{{
+			ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10",
+			Description: tagSoftDeleted("", time.Now(), ""), Enabled: "0",
+		}}}
+		provider := &unboundProvider{api: fake}
+		WithCacheTTL(time.Hour)(provider)
+		before := current()
+
+		_, err := provider.Restore(context.Background(), nil, false)
+		require.NoError(t, err)
+
+		require.Equal(t, counts{manual: 1}, since(before))
+	})
+}
+
+func TestServeStale(t *testing.T) {
+	unavailable := &unbound.StatusError{StatusCode: http.StatusBadGateway}
+
+	newProvider := func(maxAge time.Duration) (*unboundProvider, *unboundtest.Fake) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithServeStale(maxAge)(provider)
+		return provider, fake
+	}
+
+	t.Run("serves the last listing while OPNsense is unavailable", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		listed, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.Fail("ListHostOverrides", unavailable)
+		stale, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, listed, stale)
+		require.False(t, provider.Status().LastRecords.Success)
+	})
+
+	t.Run("fails once the last listing is too old", func(t *testing.T) {
+		provider, fake := newProvider(20 * time.Millisecond)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		time.Sleep(30 * time.Millisecond)
+
+		fake.Fail("ListHostOverrides", unavailable)
+		_, err = provider.Records(context.Background())
+		require.ErrorIs(t, err, unavailable)
+	})
+
+	t.Run("fails without a previous listing", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		fake.Fail("ListHostOverrides", unavailable)
+		_, err := provider.Records(context.Background())
+		require.Error(t, err)
+	})
+
+	t.Run("fails on errors other than OPNsense being unavailable", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.Fail("ListHostOverrides", &unbound.StatusError{StatusCode: http.StatusUnauthorized})
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+	})
+
+	t.Run("fails for fresh records", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.Fail("ListHostOverrides", unavailable)
+		_, err = provider.Records(WithFreshRecords(context.Background()))
+		require.Error(t, err)
+	})
+
+	t.Run("does not let ApplyChanges succeed", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		fake.Fail("ListHostOverrides", unavailable)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.Error(t, err)
+		require.Len(t, fake.HostOverrides, 1)
+	})
+}
@@ -0,0 +1,232 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const (
+	// canaryAddress is what the canary record resolves to.
+	canaryAddress = "127.0.0.1"
+
+	// canaryDescription labels canary records in OPNsense.
+	canaryDescription = "[external-dns canary, safe to delete]"
+)
+
+// WithCanary makes RunCanary create a canary Host Override every interval, _canary-<owner ID>.<domain> pointing
+// to 127.0.0.1, wait up to timeout for Unbound to serve it, and delete it, to monitor applies end to end.
+// domain defaults to the first domain of the domain filter. Reconfigures go through the reconfigure debounce.
+// The canary is left out of Records, and its failures show in CanaryReady, not in Ready.
+func WithCanary(interval, timeout time.Duration, domain string) Option {
+	return func(p *unboundProvider) {
+		p.canary = &canary{interval: interval, timeout: timeout, domain: domain, retryInterval: verifyRetryInterval}
+	}
+}
+
+// canary creates, resolves and deletes a canary record, remembering how the last run went.
+type canary struct {
+	resolver      Resolver
+	interval      time.Duration
+	timeout       time.Duration
+	domain        string
+	retryInterval time.Duration
+
+	mu   sync.Mutex
+	last *SyncStatus
+}
+
+func (c *canary) done(start time.Time, err error) {
+	s := newSyncStatus(start, err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = &s
+}
+
+func (c *canary) lastRun() *SyncStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// setupCanary settles the domain of the canary, which must be within the domain filter.
+func (p *unboundProvider) setupCanary() error {
+	if p.canary == nil {
+		return nil
+	}
+	if p.canary.domain == "" && len(p.domains) > 0 {
+		p.canary.domain = p.domains[0]
+	}
+	if p.canary.domain == "" {
+		return errors.New("the canary needs a domain, or a domain filter")
+	}
+	if filter := p.GetDomainFilter(); filter.IsConfigured() && !filter.Match(p.canaryDNSName()) {
+		return fmt.Errorf("canary domain %s is outside the domain filter", p.canary.domain)
+	}
+	return nil
+}
+
+// canaryHostname is named after the owner ID, so that canaries of webhooks sharing an OPNsense don't collide,
+// and starts with an underscore, which names of real hosts don't.
+func (p *unboundProvider) canaryHostname() string {
+	if p.ownerID == "" {
+		return "_canary"
+	}
+	return "_canary-" + p.ownerID
+}
+
+func (p *unboundProvider) canaryDNSName() string {
+	return p.canaryHostname() + "." + state.Normalize(p.canary.domain)
+}
+
+// isCanary tells whether dnsName is the name of the canary record.
+func (p *unboundProvider) isCanary(dnsName string) bool {
+	return p.canary != nil && state.Normalize(dnsName) == p.canaryDNSName()
+}
+
+// withoutCanary leaves the canary record out of endpoints, so that external-dns never plans changes to it.
+func (p *unboundProvider) withoutCanary(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	return slices.DeleteFunc(endpoints, func(e *endpoint.Endpoint) bool {
+		return p.isCanary(e.DNSName)
+	})
+}
+
+// RunCanary runs the canary every interval until ctx is done, after deleting canaries left over by a restart.
+// It returns immediately if the canary is disabled, or in read-only mode.
+func (p *unboundProvider) RunCanary(ctx context.Context) {
+	if p.canary == nil || p.readOnly != "" {
+		return
+	}
+
+	if err := p.removeLeftoverCanaries(ctx); err != nil && ctx.Err() == nil {
+		p.log().Warn("failed to remove leftover canary records", slog.Any("error", err))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.canary.interval):
+		}
+
+		if err := p.runCanary(ctx); err != nil && ctx.Err() == nil {
+			p.log().Warn("canary failed", slog.String("dnsName", p.canaryDNSName()), slog.Any("error", err))
+		}
+	}
+}
+
+// runCanary creates the canary record, waits for Unbound to serve it and deletes it.
+func (p *unboundProvider) runCanary(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		p.canary.done(start, err)
+		m := metrics.For(p.webhook)
+		if err != nil {
+			m.CanaryRuns.WithLabelValues("failure").Inc()
+			return
+		}
+		m.CanaryRuns.WithLabelValues("success").Inc()
+		m.CanaryDuration.Set(time.Since(start).Seconds())
+		m.CanaryLastSuccess.Set(float64(time.Now().Unix()))
+	}()
+
+	ho, err := p.api.CreateHostOverride(ctx, unbound.HostOverride{
+		Enabled:     "1",
+		Hostname:    p.canaryHostname(),
+		Domain:      state.Normalize(p.canary.domain),
+		Server:      canaryAddress,
+		Description: canaryDescription,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create canary: %w", err)
+	}
+	if err := p.requestReconfigure(ctx); err != nil {
+		return errors.Join(err, p.deleteCanary(ctx, ho))
+	}
+
+	waitErr := p.waitForCanary(ctx)
+	return errors.Join(waitErr, p.deleteCanary(ctx, ho))
+}
+
+// waitForCanary queries Unbound for the canary until it resolves or the timeout is over.
+func (p *unboundProvider) waitForCanary(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.canary.timeout)
+	defer cancel()
+
+	want := netip.MustParseAddr(canaryAddress)
+	for {
+		addrs, err := p.canary.resolver.LookupNetIP(ctx, "ip4", p.canaryDNSName())
+		if err == nil && slices.Contains(addrs, want) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("resolved to %v", addrs)
+			}
+			return fmt.Errorf("canary not served within %s: %w", p.canary.timeout, err)
+		case <-time.After(p.canary.retryInterval):
+		}
+	}
+}
+
+func (p *unboundProvider) deleteCanary(ctx context.Context, ho unbound.HostOverride) error {
+	if err := p.api.DeleteHostOverride(ctx, ho); err != nil && !errors.Is(err, unbound.ErrNotFound) {
+		return fmt.Errorf("failed to delete canary: %w", err)
+	}
+	return p.requestReconfigure(ctx)
+}
+
+// removeLeftoverCanaries deletes the canary records of runs interrupted before deleting them.
+func (p *unboundProvider) removeLeftoverCanaries(ctx context.Context) error {
+	snap, err := p.listSnapshot(ctx, p.api)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, ho := range snap.state.HostOverrides() {
+		if !p.isCanary(ho.DNSName()) {
+			continue
+		}
+		if err := p.api.DeleteHostOverride(ctx, ho); err != nil && !errors.Is(err, unbound.ErrNotFound) {
+			return fmt.Errorf("failed to delete canary: %w", err)
+		}
+		removed++
+	}
+	if removed == 0 {
+		return nil
+	}
+	p.log().Info("removed leftover canary records", slog.Int("records", removed))
+	return p.requestReconfigure(ctx)
+}
+
+// requestReconfigure reconfigures Unbound through the debounce, if the provider has a reconfigurer.
+func (p *unboundProvider) requestReconfigure(ctx context.Context) error {
+	if p.reconfigurer == nil {
+		return nil
+	}
+	return p.reconfigurer.Request(ctx)
+}
+
+// CanaryReady returns the error of the last canary run, or nil if it succeeded, hasn't run yet or is disabled.
+func (p *unboundProvider) CanaryReady() error {
+	if p.canary == nil {
+		return nil
+	}
+	if last := p.canary.lastRun(); last != nil && !last.Success {
+		return fmt.Errorf("canary %s failed at %s: %s", p.canaryDNSName(), last.Time.Format(time.RFC3339), last.Error)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestCanary(t *testing.T) {
+	canarying := func(t *testing.T, fake *unboundtest.Fake, resolver Resolver) *unboundProvider {
+		t.Helper()
+		provider, err := NewUnboundProviderWithAPI(fake,
+			WithCanary(time.Minute, 50*time.Millisecond, ""),
+			WithDomainFilter([]string{"home.example.com"}),
+			WithOwnerID("cluster-a"),
+		)
+		require.NoError(t, err)
+		provider.canary.resolver = resolver
+		provider.canary.retryInterval = 5 * time.Millisecond
+		return provider
+	}
+
+	t.Run("creates, resolves and deletes the canary", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := canarying(t, fake, servingResolver{fake})
+		successes := testutil.ToFloat64(metrics.Default.CanaryRuns.WithLabelValues("success"))
+
+		require.NoError(t, provider.runCanary(context.Background()))
+		require.Empty(t, fake.HostOverrides)
+		require.Equal(t, 2, fake.Calls("Reconfigure"))
+		require.NoError(t, provider.CanaryReady())
+		require.True(t, provider.Status().Canary.Success)
+		require.Equal(t, successes+1, testutil.ToFloat64(metrics.Default.CanaryRuns.WithLabelValues("success")))
+	})
+
+	t.Run("reports a canary not served apart from readiness", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := canarying(t, fake, &fakeResolver{})
+		failures := testutil.ToFloat64(metrics.Default.CanaryRuns.WithLabelValues("failure"))
+
+		require.ErrorContains(t, provider.runCanary(context.Background()), "canary not served within 50ms")
+		require.Empty(t, fake.HostOverrides)
+		require.ErrorContains(t, provider.CanaryReady(), "canary _canary-cluster-a.home.example.com failed")
+		require.NoError(t, provider.Ready())
+		require.Equal(t, failures+1, testutil.ToFloat64(metrics.Default.CanaryRuns.WithLabelValues("failure")))
+	})
+
+	t.Run("is left out of records", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "_canary-cluster-a", Domain: "home.example.com", Server: "127.0.0.1", Enabled: "1"},
+			{ID: "2", Hostname: "_canary-cluster-b", Domain: "home.example.com", Server: "127.0.0.1", Enabled: "1"},
+		}}
+		provider := canarying(t, fake, &fakeResolver{})
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"_canary-cluster-b.home.example.com"}, dnsNames(records))
+	})
+
+	t.Run("removes its leftover canaries only", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "_canary-cluster-a", Domain: "home.example.com", Server: "127.0.0.1", Enabled: "1"},
+			{ID: "2", Hostname: "_canary-cluster-b", Domain: "home.example.com", Server: "127.0.0.1", Enabled: "1"},
+		}}
+		provider := canarying(t, fake, &fakeResolver{})
+
+		require.NoError(t, provider.removeLeftoverCanaries(context.Background()))
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, "_canary-cluster-b", fake.HostOverrides[0].Hostname)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("takes its domain from the domain filter", func(t *testing.T) {
+		provider, err := NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithCanary(time.Minute, time.Second, ""),
+			WithDomainFilter([]string{"lab.example.com", "home.example.com"}))
+		require.NoError(t, err)
+		require.Equal(t, "_canary.lab.example.com", provider.canaryDNSName())
+
+		_, err = NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithCanary(time.Minute, time.Second, "example.org"),
+			WithDomainFilter([]string{"example.com"}))
+		require.ErrorContains(t, err, "outside the domain filter")
+
+		_, err = NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithCanary(time.Minute, time.Second, ""))
+		require.ErrorContains(t, err, "needs a domain")
+	})
+
+	t.Run("runs a canary in each instance", func(t *testing.T) {
+		multi, err := NewMultiProvider([]Instance{
+			{Name: "home", BaseURL: "https://192.168.1.1", APIKey: "key", APISecret: "secret", Domains: []string{"home.example.com"}},
+			{Name: "lab", BaseURL: "https://10.0.0.1", APIKey: "key", APISecret: "secret", Domains: []string{"lab.example.com"}},
+		}, WithCanary(time.Minute, time.Second, "home.example.com"), WithLogger(slog.Default()))
+		require.NoError(t, err)
+		require.Equal(t, "_canary.home.example.com", multi.instances[0].canaryDNSName())
+		require.Equal(t, "_canary.lab.example.com", multi.instances[1].canaryDNSName())
+	})
+}
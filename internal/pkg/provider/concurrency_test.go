@@ -0,0 +1,196 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// These tests are meant for the race detector: go test -race.
+func TestConcurrency(t *testing.T) {
+	t.Run("lists, applies, refreshes and reloads credentials at the same time", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		defer server.Close()
+
+		path := filepath.Join(t.TempDir(), "apikey.txt")
+		writeKeyFile := func() error {
+			tmp := path + ".tmp"
+			content := fmt.Sprintf("key=%s\nsecret=%s\n", opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret)
+			if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+				return err
+			}
+			return os.Rename(tmp, path)
+		}
+		require.NoError(t, writeKeyFile())
+		creds := NewCredentialsFile(path)
+		require.NoError(t, creds.Refresh(context.Background()))
+
+		p, err := NewUnboundProvider(server.URL, "", "",
+			WithCredentials(creds),
+			WithCacheTTL(time.Millisecond),
+			WithServeStale(time.Minute),
+			WithSnapshotReuse(time.Minute),
+			WithBackgroundRefresh(time.Millisecond),
+			WithReconfigureDebounce(time.Millisecond),
+			WithApplyConcurrency(4),
+			WithListConcurrency(4),
+		)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.RunRefresh(ctx)
+
+		const workers, rounds = 4, 10
+		var wg sync.WaitGroup
+		errs := make(chan error, workers*rounds*2)
+		for w := range workers {
+			wg.Add(1)
+			// Each worker moves its own record from name to name, ending with the last one
+			go func() {
+				defer wg.Done()
+				var previous *endpoint.Endpoint
+				for r := range rounds {
+					ep := endpoint.NewEndpoint(fmt.Sprintf("w%d-%d.example.com", w, r), endpoint.RecordTypeA, fmt.Sprintf("10.0.%d.%d", w, r))
+					changes := &plan.Changes{Create: []*endpoint.Endpoint{ep}}
+					if previous != nil {
+						changes.Delete = []*endpoint.Endpoint{previous}
+					}
+					if err := p.ApplyChanges(ctx, changes); err != nil {
+						errs <- err
+					}
+					previous = ep
+				}
+			}()
+		}
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range rounds {
+					if _, err := p.Records(ctx); err != nil {
+						errs <- err
+					}
+					if _, err := p.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpoint("NAS.example.com.", endpoint.RecordTypeA, "10.0.0.2")}); err != nil {
+						errs <- err
+					}
+					p.Status()
+					p.Ready()
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if err := writeKeyFile(); err != nil {
+					errs <- err
+				}
+				if err := creds.Refresh(ctx); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		records, err := p.Records(WithFreshRecords(ctx))
+		require.NoError(t, err)
+		var names []string
+		for w := range workers {
+			names = append(names, fmt.Sprintf("w%d-%d.example.com", w, rounds-1))
+		}
+		require.ElementsMatch(t, names, dnsNames(records))
+		require.Eventually(t, func() bool { return !server.Unapplied() }, time.Second, time.Millisecond,
+			"the debounced reconfigure catches up")
+	})
+
+	t.Run("doesn't interleave applies", func(t *testing.T) {
+		api := &blockingAPI{Fake: &unboundtest.Fake{}, entered: make(chan string, 2), release: make(chan struct{})}
+		p, err := NewUnboundProviderWithAPI(api)
+		require.NoError(t, err)
+		apply := func(name string) <-chan error {
+			done := make(chan error, 1)
+			go func() {
+				done <- p.ApplyChanges(context.Background(), &plan.Changes{
+					Create: []*endpoint.Endpoint{endpoint.NewEndpoint(name, endpoint.RecordTypeA, "10.0.0.2")},
+				})
+			}()
+			return done
+		}
+
+		first := apply("first.example.com")
+		require.Equal(t, "first", <-api.entered)
+		second := apply("second.example.com")
+		select {
+		case hostname := <-api.entered:
+			t.Fatalf("%s was created while the first apply was in progress", hostname)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(api.release)
+		require.NoError(t, <-first)
+		require.Equal(t, "second", <-api.entered)
+		require.NoError(t, <-second)
+		require.Equal(t, 2, api.Calls("Reconfigure"))
+	})
+
+	t.Run("lists while applying concurrently", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		p, err := NewUnboundProviderWithAPI(fake, WithApplyConcurrency(8))
+		require.NoError(t, err)
+
+		var creates []*endpoint.Endpoint
+		for i := range 32 {
+			creates = append(creates, endpoint.NewEndpoint(fmt.Sprintf("h%d.example.com", i), endpoint.RecordTypeA, "10.0.0.2"))
+		}
+		var applyErr, listErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			applyErr = p.ApplyChanges(context.Background(), &plan.Changes{Create: creates})
+		}()
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := p.Records(context.Background()); err != nil {
+					listErr = err
+				}
+			}
+		}()
+		wg.Wait()
+
+		require.NoError(t, applyErr)
+		require.NoError(t, listErr)
+		fake.Lock()
+		defer fake.Unlock()
+		require.Len(t, fake.HostOverrides, 32)
+	})
+}
+
+// blockingAPI holds host overrides being created until release is closed, telling their hostnames to entered.
+type blockingAPI struct {
+	*unboundtest.Fake
+	entered chan string
+	release chan struct{}
+}
+
+func (b *blockingAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	b.entered <- ho.Hostname
+	<-b.release
+	return b.Fake.CreateHostOverride(ctx, ho)
+}
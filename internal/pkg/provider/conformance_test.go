@@ -0,0 +1,190 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// syncOnce runs a sync loop of external-dns against p: it lists the records, adjusts the desired endpoints,
+// plans the changes between them under the sync policy, and applies them. It returns the changes applied,
+// nil if there were none.
+func syncOnce(t *testing.T, p *unboundProvider, desired []*endpoint.Endpoint) *plan.Changes {
+	t.Helper()
+	ctx := context.Background()
+
+	current, err := p.Records(ctx)
+	require.NoError(t, err)
+	desired, err = p.AdjustEndpoints(desired)
+	require.NoError(t, err)
+
+	domainFilter := p.GetDomainFilter()
+	changes := (&plan.Plan{
+		Current:        current,
+		Desired:        desired,
+		Policies:       []plan.Policy{&plan.SyncPolicy{}},
+		DomainFilter:   endpoint.MatchAllDomainFilters{&domainFilter},
+		ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA, endpoint.RecordTypeCNAME},
+	}).Calculate().Changes
+	if !changes.HasChanges() {
+		return nil
+	}
+	require.NoError(t, p.ApplyChanges(ctx, changes))
+	return changes
+}
+
+// converge syncs p until there are no more changes to desired, failing if that takes more than two syncs.
+func converge(t *testing.T, p *unboundProvider, desired func() []*endpoint.Endpoint) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		changes := syncOnce(t, p, desired())
+		if changes == nil {
+			return
+		}
+		require.Less(t, i, 2, "still changing after %d syncs: %s", i+1, describeChanges(changes))
+	}
+}
+
+func describeChanges(c *plan.Changes) string {
+	return fmt.Sprintf("create %v, update %v to %v, delete %v", c.Create, c.UpdateOld, c.UpdateNew, c.Delete)
+}
+
+// recordKeys returns records as "type name targets" strings, to compare them regardless of order.
+func recordKeys(records []*endpoint.Endpoint) []string {
+	keys := make([]string, 0, len(records))
+	for _, ep := range records {
+		targets := slices.Clone(ep.Targets)
+		slices.Sort(targets)
+		keys = append(keys, ep.RecordType+" "+ep.DNSName+" "+strings.Join(targets, ","))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestConformance(t *testing.T) {
+	a := func(name string, targets ...string) *endpoint.Endpoint {
+		return endpoint.NewEndpoint(name, endpoint.RecordTypeA, targets...)
+	}
+	cname := func(name, target string) *endpoint.Endpoint {
+		return endpoint.NewEndpoint(name, endpoint.RecordTypeCNAME, target)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		from, to func() []*endpoint.Endpoint
+		// expected are the records listed once converged, if not those of to
+		expected []string
+	}{
+		{
+			name: "create",
+			from: func() []*endpoint.Endpoint { return nil },
+			to: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{a("nas.example.com", "10.0.0.2"), cname("files.example.com", "nas.example.com")}
+			},
+		},
+		{
+			name: "retarget",
+			from: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					a("nas.example.com", "10.0.0.2"), a("web.example.com", "10.0.0.3"), cname("files.example.com", "nas.example.com"),
+				}
+			},
+			to: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					a("nas.example.com", "10.0.0.4"), a("web.example.com", "10.0.0.3"), cname("files.example.com", "web.example.com"),
+				}
+			},
+		},
+		{
+			name: "rename",
+			from: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{a("nas.example.com", "10.0.0.2"), cname("files.example.com", "nas.example.com")}
+			},
+			to: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{a("storage.example.com", "10.0.0.2"), cname("share.example.com", "storage.example.com")}
+			},
+		},
+		{
+			name: "type change",
+			from: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					a("nas.example.com", "10.0.0.2"), a("files.example.com", "10.0.0.2"), cname("www.example.com", "nas.example.com"),
+				}
+			},
+			to: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					a("nas.example.com", "10.0.0.2"), cname("files.example.com", "nas.example.com"), a("www.example.com", "10.0.0.5"),
+				}
+			},
+		},
+		{
+			name: "delete",
+			from: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{a("nas.example.com", "10.0.0.2"), cname("files.example.com", "nas.example.com")}
+			},
+			to: func() []*endpoint.Endpoint { return nil },
+		},
+		{
+			name: "endpoints the provider adjusts",
+			from: func() []*endpoint.Endpoint { return nil },
+			to: func() []*endpoint.Endpoint {
+				files := cname("files.example.com", "NAS.example.com.")
+				files.Labels[endpoint.ResourceLabelKey] = "ingress/default/files"
+				return []*endpoint.Endpoint{
+					endpoint.NewEndpointWithTTL("NAS.example.com.", endpoint.RecordTypeA, 300, "10.0.0.3", "10.0.0.2"),
+					files,
+				}
+			},
+			expected: []string{"A nas.example.com 10.0.0.2", "CNAME files.example.com nas.example.com"},
+		},
+		{
+			name: "descriptions",
+			from: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{a("nas.example.com", "10.0.0.2"), a("web.example.com", "10.0.0.3")}
+			},
+			to: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					a("nas.example.com", "10.0.0.2").WithProviderSpecific(unbound.DescriptionProperty, "NAS"),
+					a("web.example.com", "10.0.0.3"),
+				}
+			},
+		},
+	} {
+		for _, mode := range []struct {
+			name string
+			opts []Option
+		}{
+			{name: "record by record"},
+			{name: "in bulk", opts: []Option{WithBulkApply(1)}},
+		} {
+			t.Run(tc.name+" "+mode.name, func(t *testing.T) {
+				server := opnsensetest.NewServer()
+				defer server.Close()
+				p, err := NewUnboundProvider(server.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret,
+					append([]Option{WithDomainFilter([]string{"example.com"})}, mode.opts...)...)
+				require.NoError(t, err)
+				converge(t, p, tc.from)
+
+				converge(t, p, tc.to)
+
+				records, err := p.Records(context.Background())
+				require.NoError(t, err)
+				expected := tc.expected
+				if expected == nil {
+					expected = recordKeys(tc.to())
+				}
+				require.Equal(t, expected, recordKeys(records))
+				require.False(t, server.Unapplied())
+			})
+		}
+	}
+}
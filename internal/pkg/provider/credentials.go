@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// credentialsRefreshInterval is how long to wait after refreshing credentials before an authentication
+// failure refreshes them again, so that a key revoked for good doesn't run a command on every call.
+const credentialsRefreshInterval = time.Minute
+
+// maxCredentialsStderr caps how much of the command's standard error its failures include.
+const maxCredentialsStderr = 512
+
+// Credentials are an OPNsense API key and secret got from outside the webhook, such as an executable or
+// a file, and got again when refreshed. They are never logged.
+type Credentials struct {
+	fetch func(ctx context.Context) (apiKey, apiSecret string, err error)
+
+	mu        sync.Mutex
+	apiKey    string
+	apiSecret string
+	attempted time.Time
+}
+
+// NewCredentialsCommand returns Credentials got from an executable, such as a script reading them from
+// a secrets manager. command is split on spaces into the executable and its arguments, run without a shell,
+// for at most timeout, or without limit if timeout is 0. The executable must print a JSON object to its
+// standard output:
+//
+//	{"apiKey": "...", "apiSecret": "..."}
+func NewCredentialsCommand(command string, timeout time.Duration) (*Credentials, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty credentials command")
+	}
+	return &Credentials{fetch: func(ctx context.Context) (string, string, error) {
+		return runCredentialsCommand(ctx, args, timeout)
+	}}, nil
+}
+
+// Refresh gets the credentials again, and uses them from then on. The previous ones are kept on failure.
+func (c *Credentials) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	c.attempted = time.Now()
+	c.mu.Unlock()
+
+	apiKey, apiSecret, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKey, c.apiSecret = apiKey, apiSecret
+	return nil
+}
+
+// Credentials returns the API key and secret last got.
+func (c *Credentials) Credentials() (apiKey, apiSecret string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.apiKey, c.apiSecret
+}
+
+// attemptedWithin tells whether the credentials were refreshed less than d ago, whether that succeeded or not.
+func (c *Credentials) attemptedWithin(d time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.attempted) < d
+}
+
+func runCredentialsCommand(ctx context.Context, args []string, timeout time.Duration) (apiKey, apiSecret string, err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "", "", fmt.Errorf("credentials command timed out after %s", timeout)
+	case errors.As(err, &exitErr):
+		msg := bytes.TrimSpace(stderr.Bytes())
+		if len(msg) > maxCredentialsStderr {
+			msg = msg[:maxCredentialsStderr]
+		}
+		return "", "", fmt.Errorf("credentials command exited with status %d: %q", exitErr.ExitCode(), msg)
+	case err != nil:
+		return "", "", fmt.Errorf("failed to run credentials command: %w", err)
+	}
+
+	// Decoding errors may quote the output, so they are left out
+	var creds struct {
+		APIKey    string `json:"apiKey"`
+		APISecret string `json:"apiSecret"`
+	}
+	if json.Unmarshal(stdout.Bytes(), &creds) != nil {
+		return "", "", errors.New(`credentials command output is not a JSON object like {"apiKey": "...", "apiSecret": "..."}`)
+	}
+	if creds.APIKey == "" || creds.APISecret == "" {
+		return "", "", errors.New("credentials command output lacks apiKey or apiSecret")
+	}
+	return creds.APIKey, creds.APISecret, nil
+}
+
+// WithCredentials authenticates to OPNsense with creds, refreshing them when OPNsense rejects them.
+// The fallback uses them too, unless given its own. creds must have been refreshed already.
+func WithCredentials(creds *Credentials) Option {
+	return func(p *unboundProvider) {
+		p.credentials = creds
+	}
+}
+
+// refreshCredentials refreshes the credentials after err, if OPNsense rejected them,
+// unless they were refreshed just before.
+func (p *unboundProvider) refreshCredentials(ctx context.Context, err error) {
+	if p.credentials == nil || !errors.Is(err, unbound.ErrUnauthorized) || p.credentials.attemptedWithin(credentialsRefreshInterval) {
+		return
+	}
+	if err := p.credentials.Refresh(ctx); err != nil {
+		p.log().Error("failed to refresh credentials", slog.Any("error", err))
+		return
+	}
+	p.log().Info("refreshed credentials after OPNsense rejected them")
+}
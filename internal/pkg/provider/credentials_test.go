@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// credentialsScript writes a shell script running body, and returns its path.
+func credentialsScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "credentials.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755))
+	return path
+}
+
+func TestCredentialsCommand(t *testing.T) {
+	refresh := func(t *testing.T, body string, timeout time.Duration) (*Credentials, error) {
+		t.Helper()
+		cmd, err := NewCredentialsCommand(credentialsScript(t, body), timeout)
+		require.NoError(t, err)
+		return cmd, cmd.Refresh(context.Background())
+	}
+
+	t.Run("gets the credentials the command prints", func(t *testing.T) {
+		cmd, err := refresh(t, `echo '{"apiKey": "key", "apiSecret": "secret"}'`, time.Second)
+		require.NoError(t, err)
+		apiKey, apiSecret := cmd.Credentials()
+		require.Equal(t, "key", apiKey)
+		require.Equal(t, "secret", apiSecret)
+	})
+
+	t.Run("passes arguments to the command", func(t *testing.T) {
+		script := credentialsScript(t, `printf '{"apiKey": "%s", "apiSecret": "%s"}' "$1" "$2"`)
+		cmd, err := NewCredentialsCommand(script+"  key secret", time.Second)
+		require.NoError(t, err)
+		require.NoError(t, cmd.Refresh(context.Background()))
+		apiKey, apiSecret := cmd.Credentials()
+		require.Equal(t, "key", apiKey)
+		require.Equal(t, "secret", apiSecret)
+	})
+
+	t.Run("fails with the exit status and standard error of the command", func(t *testing.T) {
+		_, err := refresh(t, `echo '{"apiKey": "leaked"}'; echo 'vault is sealed' >&2; exit 3`, time.Second)
+		require.ErrorContains(t, err, "exited with status 3")
+		require.ErrorContains(t, err, "vault is sealed")
+		require.NotContains(t, err.Error(), "leaked")
+	})
+
+	t.Run("fails when the command takes too long", func(t *testing.T) {
+		_, err := refresh(t, `exec sleep 5`, 50*time.Millisecond)
+		require.ErrorContains(t, err, "timed out after 50ms")
+	})
+
+	t.Run("fails without quoting invalid output", func(t *testing.T) {
+		for _, output := range []string{`apiKey=leaked`, `{"apiKey": "leaked"`, `["leaked"]`} {
+			_, err := refresh(t, fmt.Sprintf("echo '%s'", output), time.Second)
+			require.ErrorContains(t, err, "not a JSON object")
+			require.NotContains(t, err.Error(), "leaked")
+		}
+	})
+
+	t.Run("fails when the output lacks a credential", func(t *testing.T) {
+		_, err := refresh(t, `echo '{"apiKey": "leaked", "apiSecret": ""}'`, time.Second)
+		require.ErrorContains(t, err, "lacks apiKey or apiSecret")
+		require.NotContains(t, err.Error(), "leaked")
+	})
+
+	t.Run("keeps the previous credentials when failing", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "credentials.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{"apiKey": "key", "apiSecret": "secret"}`), 0o600))
+		cmd, err := NewCredentialsCommand(credentialsScript(t, "cat "+file), time.Second)
+		require.NoError(t, err)
+		require.NoError(t, cmd.Refresh(context.Background()))
+
+		require.NoError(t, os.Remove(file))
+		require.Error(t, cmd.Refresh(context.Background()))
+		apiKey, apiSecret := cmd.Credentials()
+		require.Equal(t, "key", apiKey)
+		require.Equal(t, "secret", apiSecret)
+	})
+
+	t.Run("rejects an empty command", func(t *testing.T) {
+		_, err := NewCredentialsCommand("  ", time.Second)
+		require.Error(t, err)
+	})
+}
+
+func TestWithCredentials(t *testing.T) {
+	var currentKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKey, _, _ := r.BasicAuth(); apiKey != currentKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"rows":[],"total":0}`)
+	}))
+	t.Cleanup(server.Close)
+
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	rotate := func(apiKey string) {
+		currentKey = apiKey
+		require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf(`{"apiKey": %q, "apiSecret": "secret"}`, apiKey)), 0o600))
+	}
+
+	rotate("first")
+	cmd, err := NewCredentialsCommand(credentialsScript(t, "cat "+file), time.Second)
+	require.NoError(t, err)
+	require.NoError(t, cmd.Refresh(context.Background()))
+
+	provider, err := NewUnboundProvider(server.URL, "", "", WithCredentials(cmd))
+	require.NoError(t, err)
+
+	_, err = provider.Records(context.Background())
+	require.NoError(t, err)
+
+	t.Run("refreshes the credentials OPNsense rejects", func(t *testing.T) {
+		rotate("second")
+		cmd.attempted = time.Now().Add(-credentialsRefreshInterval)
+
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+	})
+
+	t.Run("doesn't refresh them again right away", func(t *testing.T) {
+		rotate("third")
+
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+		apiKey, _ := cmd.Credentials()
+		require.Equal(t, "second", apiKey)
+	})
+}
@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NewCredentialsFile returns Credentials read from the API key file OPNsense offers for download when creating
+// a key, such as one mounted from a Kubernetes secret, read again when refreshed.
+func NewCredentialsFile(path string) *Credentials {
+	return &Credentials{fetch: func(context.Context) (string, string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", "", err
+		}
+		defer f.Close()
+
+		apiKey, apiSecret, err := ParseAPIKeyFile(f)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid API key file %s: %w", path, err)
+		}
+		return apiKey, apiSecret, nil
+	}}
+}
+
+// ParseAPIKeyFile reads an API key file, as OPNsense offers for download:
+//
+//	key=...
+//	secret=...
+//
+// Blank lines and lines starting with # or ; are skipped, values may be quoted, and other keys are ignored.
+// Errors never quote the file, as it holds the secret.
+func ParseAPIKeyFile(r io.Reader) (apiKey, apiSecret string, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return "", "", fmt.Errorf("line %d: expected key=value", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "key":
+			apiKey = value
+		case "secret":
+			apiSecret = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	var missing []string
+	if apiKey == "" {
+		missing = append(missing, "key")
+	}
+	if apiSecret == "" {
+		missing = append(missing, "secret")
+	}
+	if len(missing) > 0 {
+		return "", "", errors.New("missing " + strings.Join(missing, " and "))
+	}
+	return apiKey, apiSecret, nil
+}
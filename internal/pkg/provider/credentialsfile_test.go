@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPIKeyFile(t *testing.T) {
+	const (
+		key    = "w86XNZob/8Oq8aC5r0kbNarNtdpoQU781fyoeaOBQsBwkXUt6uvv6NvX2ElGMQhfS5rT+bEqzUDswQ6b"
+		secret = "XeD26XVrJ5ilAc/EmglCRC+0j2e57tRsjHwFepOseySWLM53pJASeTA3KdXtQm/eTGafR3yiHxo8P1=="
+	)
+
+	t.Run("parses files in various shapes", func(t *testing.T) {
+		for name, contents := range map[string]string{
+			"as downloaded":       "key=" + key + "\nsecret=" + secret + "\n",
+			"without final break": "key=" + key + "\nsecret=" + secret,
+			"with CRLF breaks":    "key=" + key + "\r\nsecret=" + secret + "\r\n",
+			"with a BOM":          "\ufeffkey=" + key + "\nsecret=" + secret + "\n",
+			"with comments":       "# external-dns on opnsense.example.com\n; rotated 2024-05-01\n\nkey=" + key + "\nsecret=" + secret + "\n",
+			"with whitespace":     "  key = " + key + "  \t\nsecret =" + secret + " \n\n",
+			"double-quoted":       `key="` + key + "\"\nsecret=\"" + secret + "\"\n",
+			"single-quoted":       "key='" + key + "'\nsecret='" + secret + "'\n",
+			"in another order":    "secret=" + secret + "\nKEY=" + key + "\n",
+			"with other keys":     "key=" + key + "\nsecret=" + secret + "\ndescription=external-dns\n",
+		} {
+			t.Run(name, func(t *testing.T) {
+				apiKey, apiSecret, err := ParseAPIKeyFile(strings.NewReader(contents))
+				require.NoError(t, err)
+				require.Equal(t, key, apiKey)
+				require.Equal(t, secret, apiSecret)
+			})
+		}
+	})
+
+	t.Run("names missing fields", func(t *testing.T) {
+		for contents, msg := range map[string]string{
+			"key=" + key + "\n":                 "missing secret",
+			"secret=" + secret + "\n":           "missing key",
+			"key=\nsecret=" + secret + "\n":     "missing key",
+			"key=" + key + "\nsecret=\"\"\n":    "missing secret",
+			"# key=" + key + "\n# secret=abc\n": "missing key and secret",
+			"":                                  "missing key and secret",
+		} {
+			_, _, err := ParseAPIKeyFile(strings.NewReader(contents))
+			require.EqualError(t, err, msg)
+		}
+	})
+
+	t.Run("rejects malformed lines without quoting them", func(t *testing.T) {
+		_, _, err := ParseAPIKeyFile(strings.NewReader("secret=" + secret + "\n" + key + "\n"))
+		require.EqualError(t, err, "line 2: expected key=value")
+	})
+}
+
+func TestNewCredentialsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikey.txt")
+	require.NoError(t, os.WriteFile(path, []byte("key=first\nsecret=secret\n"), 0o600))
+
+	creds := NewCredentialsFile(path)
+	require.NoError(t, creds.Refresh(context.Background()))
+	apiKey, apiSecret := creds.Credentials()
+	require.Equal(t, "first", apiKey)
+	require.Equal(t, "secret", apiSecret)
+
+	t.Run("reads the file again when refreshed", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("key=second\nsecret=secret\n"), 0o600))
+		require.NoError(t, creds.Refresh(context.Background()))
+		apiKey, _ := creds.Credentials()
+		require.Equal(t, "second", apiKey)
+	})
+
+	t.Run("keeps the previous credentials when the file is invalid", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("key=third\n"), 0o600))
+		err := creds.Refresh(context.Background())
+		require.ErrorContains(t, err, path)
+		require.ErrorContains(t, err, "missing secret")
+		apiKey, _ := creds.Credentials()
+		require.Equal(t, "second", apiKey)
+	})
+}
@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Records return descriptions as unbound.DescriptionProperty, and ApplyChanges sets them from it.
+// Endpoints without the property leave descriptions as they are, and an empty property clears them.
+//
+// external-dns plans an update whenever the provider-specific properties of a desired endpoint
+// differ from the listed one, so adjustDescription makes them match the last listing when
+// the desired endpoint leaves the description as it is.
+func (p *unboundProvider) adjustDescription(e *endpoint.Endpoint, listed *state.State) {
+	var current string
+	if listed != nil {
+		switch e.RecordType {
+		case endpoint.RecordTypeA:
+			if ho, ok := listed.HostOverride(e.DNSName); ok {
+				current = bareDescription(ho.Description)
+			}
+		case endpoint.RecordTypeCNAME:
+			if ha, ok := listed.HostAlias(e.DNSName); ok {
+				current = bareDescription(ha.Description)
+			}
+		}
+	}
+
+	desired, ok := e.GetProviderSpecificProperty(unbound.DescriptionProperty)
+	switch {
+	case !ok && current != "":
+		e.SetProviderSpecificProperty(unbound.DescriptionProperty, current)
+	case ok && desired == "" && current == "":
+		// Records leave the property out for records without a description
+		e.DeleteProviderSpecificProperty(unbound.DescriptionProperty)
+	}
+}
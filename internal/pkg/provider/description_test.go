@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestDescriptions(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "described", Domain: "example.com", Server: "127.0.0.1", Description: "Home Assistant"},
+				{ID: "2", Hostname: "plain", Domain: "example.com", Server: "127.0.0.1"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "3", HostID: "1", Hostname: "www", Domain: "example.com", Host: "described.example.com", Description: "Dashboard"},
+			},
+		}
+	}
+
+	withDescription := func(ep *endpoint.Endpoint, description string) *endpoint.Endpoint {
+		return ep.WithProviderSpecific(unbound.DescriptionProperty, description)
+	}
+
+	// sync runs a cycle of external-dns against provider, and returns the changes it planned
+	sync := func(t *testing.T, provider *unboundProvider, desired ...*endpoint.Endpoint) *plan.Changes {
+		t.Helper()
+
+		current, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		desired, err = provider.AdjustEndpoints(desired)
+		require.NoError(t, err)
+
+		changes := (&plan.Plan{
+			Current:        current,
+			Desired:        desired,
+			Policies:       []plan.Policy{&plan.SyncPolicy{}},
+			ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeCNAME},
+		}).Calculate().Changes
+		require.NoError(t, provider.ApplyChanges(context.Background(), changes))
+		return changes
+	}
+
+	t.Run("returns descriptions from Records", func(t *testing.T) {
+		provider := &unboundProvider{api: existing()}
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		descriptions := map[string]string{}
+		for _, ep := range records {
+			if description, ok := ep.GetProviderSpecificProperty(unbound.DescriptionProperty); ok {
+				descriptions[ep.DNSName] = description
+			}
+		}
+		require.Equal(t, map[string]string{"described.example.com": "Home Assistant", "www.example.com": "Dashboard"}, descriptions)
+	})
+
+	t.Run("creates records with the description given", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake}
+
+		sync(t, provider, withDescription(endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "127.0.0.1"), "Grafana"))
+
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, "Grafana", fake.HostOverrides[0].Description)
+	})
+
+	for _, tc := range []struct {
+		name        string
+		desired     func() []*endpoint.Endpoint
+		description string
+		alias       string
+	}{
+		{
+			name: "keeps descriptions of endpoints without the property",
+			desired: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					endpoint.NewEndpoint("described.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+					endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "described.example.com"),
+				}
+			},
+			description: "Home Assistant",
+			alias:       "Dashboard",
+		},
+		{
+			name: "sets descriptions from the property",
+			desired: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					withDescription(endpoint.NewEndpoint("described.example.com", endpoint.RecordTypeA, "127.0.0.1"), "Hass"),
+					withDescription(endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "described.example.com"), "Homepage"),
+				}
+			},
+			description: "Hass",
+			alias:       "Homepage",
+		},
+		{
+			name: "clears descriptions of endpoints with an empty property",
+			desired: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					withDescription(endpoint.NewEndpoint("described.example.com", endpoint.RecordTypeA, "127.0.0.1"), ""),
+					withDescription(endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "described.example.com"), ""),
+				}
+			},
+		},
+		{
+			name: "keeps descriptions when updating targets",
+			desired: func() []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					endpoint.NewEndpoint("described.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+					endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "described.example.com"),
+				}
+			},
+			description: "Home Assistant",
+			alias:       "Dashboard",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := existing()
+			provider := &unboundProvider{api: fake}
+			desired := func() []*endpoint.Endpoint {
+				return append(tc.desired(), endpoint.NewEndpoint("plain.example.com", endpoint.RecordTypeA, "127.0.0.1"))
+			}
+
+			sync(t, provider, desired()...)
+			require.Equal(t, tc.description, fake.HostOverrides[0].Description)
+			require.Equal(t, tc.alias, fake.HostAliases[0].Description)
+			require.Empty(t, fake.HostOverrides[1].Description)
+
+			// Once applied, external-dns must see nothing left to change
+			changes := sync(t, provider, desired()...)
+			require.False(t, changes.HasChanges(), "changes: %+v", changes)
+		})
+	}
+}
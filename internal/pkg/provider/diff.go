@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// RecordDiff is a record that syncing would create, update or delete.
+type RecordDiff struct {
+	Action     string        `json:"action"`
+	DNSName    string        `json:"dnsName"`
+	RecordType string        `json:"recordType"`
+	Fields     []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is a field of a record that syncing would change. Old is empty for created records,
+// and New for deleted ones.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Diff returns the records syncing p to desired would change, planned as external-dns does with the sync policy:
+// desired endpoints are adjusted, and records outside the domain filter or excluded are left alone.
+// Diffs are sorted by DNS name and record type.
+func Diff(ctx context.Context, p provider.Provider, desired []*endpoint.Endpoint) ([]RecordDiff, error) {
+	// Listing first, so that descriptions left as they are get adjusted against the records listed
+	current, err := p.Records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	adjusted, err := p.AdjustEndpoints(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := p.GetDomainFilter()
+	changes := (&plan.Plan{
+		Current:        current,
+		Desired:        adjusted,
+		Policies:       []plan.Policy{&plan.SyncPolicy{}},
+		DomainFilter:   endpoint.MatchAllDomainFilters{&filter},
+		ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeCNAME},
+	}).Calculate().Changes
+
+	var diffs []RecordDiff
+	for _, ep := range changes.Create {
+		diffs = append(diffs, RecordDiff{Action: "create", DNSName: ep.DNSName, RecordType: ep.RecordType, Fields: fieldChanges(nil, ep)})
+	}
+	for i, ep := range changes.UpdateNew {
+		diffs = append(diffs, RecordDiff{Action: "update", DNSName: ep.DNSName, RecordType: ep.RecordType, Fields: fieldChanges(changes.UpdateOld[i], ep)})
+	}
+	for _, ep := range changes.Delete {
+		diffs = append(diffs, RecordDiff{Action: "delete", DNSName: ep.DNSName, RecordType: ep.RecordType, Fields: fieldChanges(ep, nil)})
+	}
+	slices.SortFunc(diffs, func(a, b RecordDiff) int {
+		return cmp.Or(strings.Compare(a.DNSName, b.DNSName), strings.Compare(a.RecordType, b.RecordType))
+	})
+	return diffs, nil
+}
+
+// fieldChanges returns the fields differing between the endpoints before and after, either of which may be nil.
+func fieldChanges(before, after *endpoint.Endpoint) []FieldChange {
+	fields := func(ep *endpoint.Endpoint) (targets, description string) {
+		if ep == nil {
+			return "", ""
+		}
+		sorted := slices.Clone(ep.Targets)
+		slices.Sort(sorted)
+		description, _ = ep.GetProviderSpecificProperty(unbound.DescriptionProperty)
+		return strings.Join(sorted, ","), description
+	}
+	oldTargets, oldDescription := fields(before)
+	newTargets, newDescription := fields(after)
+
+	var changes []FieldChange
+	if oldTargets != newTargets {
+		changes = append(changes, FieldChange{Field: "targets", Old: oldTargets, New: newTargets})
+	}
+	if oldDescription != newDescription {
+		changes = append(changes, FieldChange{Field: "description", Old: oldDescription, New: newDescription})
+	}
+	return changes
+}
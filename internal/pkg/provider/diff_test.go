@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestDiff(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: "NAS", Enabled: "1"},
+				{ID: "2", Hostname: "vpn", Domain: "example.com", Server: "192.168.1.2", Enabled: "1"},
+				{ID: "3", Hostname: "printer", Domain: "example.com", Server: "192.168.1.20", Enabled: "1"},
+				{ID: "4", Hostname: "router", Domain: "example.org", Server: "192.168.1.1", Enabled: "1"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "5", HostID: "1", Hostname: "files", Domain: "example.com", Host: "nas.example.com", Enabled: "1"},
+			},
+		}
+	}
+
+	newProvider := func(t *testing.T, api unbound.API) *unboundProvider {
+		provider := &unboundProvider{api: api}
+		WithDomainFilter([]string{"example.com"})(provider)
+		excluded, err := ParseExcludePatterns([]string{`^vpn\.`})
+		require.NoError(t, err)
+		WithExcludeRecords(excluded)(provider)
+		return provider
+	}
+
+	t.Run("lists records to create, update and delete", func(t *testing.T) {
+		fake := existing()
+
+		diffs, err := Diff(context.Background(), newProvider(t, fake), []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.11"),
+			endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com").
+				WithProviderSpecific(unbound.DescriptionProperty, "File shares"),
+			endpoint.NewEndpoint("app.example.com.", endpoint.RecordTypeA, "192.168.1.30"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []RecordDiff{
+			{Action: "create", DNSName: "app.example.com", RecordType: endpoint.RecordTypeA, Fields: []FieldChange{
+				{Field: "targets", New: "192.168.1.30"},
+			}},
+			{Action: "update", DNSName: "files.example.com", RecordType: endpoint.RecordTypeCNAME, Fields: []FieldChange{
+				{Field: "description", New: "File shares"},
+			}},
+			{Action: "update", DNSName: "nas.example.com", RecordType: endpoint.RecordTypeA, Fields: []FieldChange{
+				{Field: "targets", Old: "192.168.1.10", New: "192.168.1.11"},
+			}},
+			{Action: "delete", DNSName: "printer.example.com", RecordType: endpoint.RecordTypeA, Fields: []FieldChange{
+				{Field: "targets", Old: "192.168.1.20"},
+			}},
+		}, diffs)
+
+		require.Len(t, fake.HostOverrides, 4, "nothing is changed")
+		require.Equal(t, "192.168.1.10", fake.HostOverrides[0].Server)
+	})
+
+	t.Run("finds no differences with records in sync", func(t *testing.T) {
+		diffs, err := Diff(context.Background(), newProvider(t, existing()), []*endpoint.Endpoint{
+			endpoint.NewEndpoint("NAS.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+			endpoint.NewEndpoint("printer.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+			endpoint.NewEndpoint("vpn.example.com", endpoint.RecordTypeA, "192.168.1.3"),
+			endpoint.NewEndpoint("nas.example.net", endpoint.RecordTypeA, "192.168.1.10"),
+		})
+		require.NoError(t, err)
+		require.Empty(t, diffs)
+	})
+
+	t.Run("fails when records can't be listed", func(t *testing.T) {
+		fake := existing()
+		fake.Fail("ListHostOverrides", unbound.ErrUnavailable)
+
+		_, err := Diff(context.Background(), newProvider(t, fake), nil)
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+	})
+}
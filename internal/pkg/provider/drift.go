@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// WithDriftDetection makes Records report the records the provider wrote that were changed since by someone
+// else, such as by hand in the OPNsense UI, naming the fields changed. Drift is reported once per change,
+// and left for external-dns to reconcile. With a path, what the provider wrote is kept in the file there
+// too, so that drift while the provider was down is reported after a restart.
+func WithDriftDetection(path string) Option {
+	return func(p *unboundProvider) {
+		p.drift = &driftDetector{path: path}
+	}
+}
+
+// writtenRecord is what the provider last wrote of a record, or last saw of it after reporting drift.
+type writtenRecord struct {
+	Target      string `json:"target"`
+	Description string `json:"description,omitempty"`
+	Enabled     string `json:"enabled"`
+}
+
+// driftDetector keeps the records the provider wrote, by record type and DNS name.
+type driftDetector struct {
+	path    string
+	webhook string
+
+	mu      sync.Mutex
+	written map[string]writtenRecord
+}
+
+func driftKey(recordType, dnsName string) string {
+	return recordType + " " + state.Normalize(dnsName)
+}
+
+// load reads what the provider wrote from the drift state file, if there is one.
+func (d *driftDetector) load() error {
+	d.written = map[string]writtenRecord{}
+	if d.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read drift state: %w", err)
+	}
+	if err := json.Unmarshal(b, &d.written); err != nil {
+		return fmt.Errorf("failed to parse drift state %s: %w", d.path, err)
+	}
+	return nil
+}
+
+// save writes what the provider wrote to the drift state file, replacing it at once. d.mu must be held.
+func (d *driftDetector) save() error {
+	if d.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(d.written)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save drift state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save drift state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save drift state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		return fmt.Errorf("failed to save drift state: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the record st holds for recordType and dnsName as the provider would have written it.
+func lookup(st *state.State, recordType, dnsName string) (writtenRecord, bool) {
+	switch recordType {
+	case endpoint.RecordTypeA:
+		if ho, ok := st.HostOverride(dnsName); ok {
+			return writtenRecord{Target: ho.Server, Description: bareDescription(ho.Description), Enabled: enabledFlag(ho.Enabled)}, true
+		}
+	case endpoint.RecordTypeCNAME:
+		if ha, ok := st.HostAlias(dnsName); ok {
+			return writtenRecord{Target: state.Normalize(ha.Host), Description: bareDescription(ha.Description), Enabled: enabledFlag(ha.Enabled)}, true
+		}
+	}
+	return writtenRecord{}, false
+}
+
+// enabledFlag returns "0" for disabled records and "1" for the others, as records created or updated
+// are enabled whatever they are sent with.
+func enabledFlag(enabled string) string {
+	if enabled == "0" {
+		return "0"
+	}
+	return "1"
+}
+
+// wrote notes the records changes created or updated as st holds them after applying changes, and
+// forgets the ones deleted. Creates and updates that failed to apply leave st as it was.
+func (d *driftDetector) wrote(st *state.State, changes *plan.Changes, logger *slog.Logger) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Soft-deleted records are left in Unbound, disabled, but no longer the provider's to compare
+	for _, ep := range append(changes.Delete, changes.UpdateOld...) {
+		delete(d.written, driftKey(ep.RecordType, ep.DNSName))
+	}
+	for _, ep := range append(changes.Create, changes.UpdateNew...) {
+		if r, ok := lookup(st, ep.RecordType, ep.DNSName); ok {
+			d.written[driftKey(ep.RecordType, ep.DNSName)] = r
+		}
+	}
+
+	if err := d.save(); err != nil {
+		logger.Warn("failed to save drift state", slog.Any("error", err))
+	}
+}
+
+// check reports the records the provider wrote that st shows changed since, and takes their current
+// state as the one to compare with from then on.
+func (d *driftDetector) check(st *state.State, logger *slog.Logger) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	before := maps.Clone(d.written)
+	for key, written := range before {
+		recordType, dnsName, _ := strings.Cut(key, " ")
+		current, ok := lookup(st, recordType, dnsName)
+		fields := driftedFields(written, current, ok)
+		if len(fields) == 0 {
+			continue
+		}
+
+		logger.Warn("record changed outside external-dns",
+			slog.String("dnsName", dnsName),
+			slog.String("type", recordType),
+			slog.Any("fields", fields),
+		)
+		for _, field := range fields {
+			metrics.For(d.webhook).DriftedRecords.WithLabelValues(recordType, field).Inc()
+		}
+
+		if ok {
+			d.written[key] = current
+		} else {
+			delete(d.written, key)
+		}
+	}
+
+	if !maps.Equal(before, d.written) {
+		if err := d.save(); err != nil {
+			logger.Warn("failed to save drift state", slog.Any("error", err))
+		}
+	}
+}
+
+// driftedFields names the fields of a written record that current differs in, or "deleted" if it is gone.
+func driftedFields(written, current writtenRecord, exists bool) []string {
+	if !exists {
+		return []string{"deleted"}
+	}
+	var fields []string
+	if current.Target != written.Target {
+		fields = append(fields, "target")
+	}
+	if current.Description != written.Description {
+		fields = append(fields, "description")
+	}
+	if current.Enabled != written.Enabled {
+		fields = append(fields, "enabled")
+	}
+	return fields
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestDriftDetection(t *testing.T) {
+	detecting := func(t *testing.T, fake *unboundtest.Fake, path string) *unboundProvider {
+		t.Helper()
+		provider := &unboundProvider{api: fake}
+		WithDriftDetection(path)(provider)
+		require.NoError(t, provider.drift.load())
+		return provider
+	}
+
+	apply := func(t *testing.T, provider *unboundProvider, changes *plan.Changes) {
+		t.Helper()
+		require.NoError(t, provider.ApplyChanges(context.Background(), changes))
+	}
+
+	list := func(t *testing.T, provider *unboundProvider) {
+		t.Helper()
+		_, err := provider.Records(WithFreshRecords(context.Background()))
+		require.NoError(t, err)
+	}
+
+	t.Run("keeps track of records created, updated and deleted", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := detecting(t, fake, "")
+
+		apply(t, provider, &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+		}})
+		require.Equal(t, map[string]writtenRecord{
+			"A a.example.com":       {Target: "10.0.0.1", Enabled: "1"},
+			"A b.example.com":       {Target: "10.0.0.2", Enabled: "1"},
+			"CNAME www.example.com": {Target: "a.example.com", Enabled: "1"},
+		}, provider.drift.written)
+
+		apply(t, provider, &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.3")},
+			Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2")},
+		})
+		require.Equal(t, map[string]writtenRecord{
+			"A a.example.com":       {Target: "10.0.0.3", Enabled: "1"},
+			"CNAME www.example.com": {Target: "a.example.com", Enabled: "1"},
+		}, provider.drift.written)
+	})
+
+	t.Run("reports records changed since once, naming the fields changed", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{}
+		provider := detecting(t, fake, "")
+		target := testutil.ToFloat64(metrics.Default.DriftedRecords.WithLabelValues("A", "target"))
+		description := testutil.ToFloat64(metrics.Default.DriftedRecords.WithLabelValues("A", "description"))
+
+		apply(t, provider, createChanges("a.example.com"))
+		fake.HostOverrides[0].Server = "10.0.0.9"
+		fake.HostOverrides[0].Description = "edited by hand"
+
+		list(t, provider)
+		level, attrs, ok := logs.find("record changed outside external-dns")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "a.example.com", attrs["dnsName"].String())
+		require.Equal(t, "A", attrs["type"].String())
+		require.Equal(t, []string{"target", "description"}, attrs["fields"].Any())
+		require.Equal(t, target+1, testutil.ToFloat64(metrics.Default.DriftedRecords.WithLabelValues("A", "target")))
+		require.Equal(t, description+1, testutil.ToFloat64(metrics.Default.DriftedRecords.WithLabelValues("A", "description")))
+
+		list(t, provider)
+		require.Equal(t, target+1, testutil.ToFloat64(metrics.Default.DriftedRecords.WithLabelValues("A", "target")))
+	})
+
+	t.Run("reports records deleted since", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{}
+		provider := detecting(t, fake, "")
+
+		apply(t, provider, &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+		}})
+		fake.HostAliases = nil
+
+		list(t, provider)
+		_, attrs, ok := logs.find("record changed outside external-dns")
+		require.True(t, ok)
+		require.Equal(t, "www.example.com", attrs["dnsName"].String())
+		require.Equal(t, []string{"deleted"}, attrs["fields"].Any())
+		require.NotContains(t, provider.drift.written, "CNAME www.example.com")
+	})
+
+	t.Run("ignores records the provider didn't write and seen stamps", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "router", Domain: "example.com", Server: "192.168.1.1", Enabled: "1"},
+			},
+		}
+		provider := detecting(t, fake, "")
+
+		apply(t, provider, createChanges("a.example.com"))
+		fake.HostOverrides[1].Description = stampSeen(fake.HostOverrides[1].Description, time.Now())
+		fake.HostOverrides[0].Server = "192.168.1.2"
+
+		list(t, provider)
+		_, _, ok := logs.find("record changed outside external-dns")
+		require.False(t, ok)
+	})
+
+	t.Run("keeps what the provider wrote across restarts in the drift state file", func(t *testing.T) {
+		logs := recordLogs(t)
+		path := filepath.Join(t.TempDir(), "drift.json")
+		fake := &unboundtest.Fake{}
+
+		apply(t, detecting(t, fake, path), createChanges("a.example.com"))
+		fake.HostOverrides[0].Enabled = "0"
+
+		restarted := detecting(t, fake, path)
+		require.Equal(t, map[string]writtenRecord{"A a.example.com": {Target: "127.0.0.1", Enabled: "1"}}, restarted.drift.written)
+
+		list(t, restarted)
+		_, attrs, ok := logs.find("record changed outside external-dns")
+		require.True(t, ok)
+		require.Equal(t, []string{"enabled"}, attrs["fields"].Any())
+		require.Equal(t, map[string]writtenRecord{"A a.example.com": {Target: "127.0.0.1", Enabled: "0"}}, detecting(t, fake, path).drift.written)
+	})
+
+	t.Run("fails on a corrupt drift state file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "drift.json")
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+		provider := &unboundProvider{}
+		WithDriftDetection(path)(provider)
+		require.ErrorContains(t, provider.drift.load(), "failed to parse drift state")
+	})
+}
@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// ParseExcludePatterns compiles regular expressions matching the DNS names of records to exclude.
+func ParseExcludePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	excluded := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		excluded = append(excluded, re)
+	}
+	return excluded, nil
+}
+
+// WithExcludeRecords keeps external-dns away from records whose DNS name, lowercase and without a trailing dot,
+// matches any of patterns: AdjustEndpoints drops them, Records leaves them out, and ApplyChanges refuses to change them.
+func WithExcludeRecords(patterns []*regexp.Regexp) Option {
+	return func(p *unboundProvider) {
+		p.excluded = append(p.excluded, patterns...)
+	}
+}
+
+// isExcluded tells whether dnsName matches any of the exclude patterns.
+func (p *unboundProvider) isExcluded(dnsName string) bool {
+	name := state.Normalize(dnsName)
+	for _, re := range p.excluded {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutExcluded returns endpoints without the excluded ones.
+func (p *unboundProvider) withoutExcluded(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !p.isExcluded(e.DNSName) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// dropExcluded leaves excluded endpoints out of the desired ones.
+func (p *unboundProvider) dropExcluded(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !p.isExcluded(e.DNSName) {
+			kept = append(kept, e)
+			continue
+		}
+		metrics.For(p.webhook).EndpointAdjustments.WithLabelValues(adjustDropExcluded).Inc()
+		p.log().Debug("ignoring excluded record", slog.String("dnsName", e.DNSName), slog.String("recordType", e.RecordType))
+	}
+	return kept
+}
+
+// refuseExcluded returns changes without the ones to excluded records, logging and counting each of them.
+// Updates are refused when either the old or the new DNS name is excluded.
+func (p *unboundProvider) refuseExcluded(changes *plan.Changes) *plan.Changes {
+	refuse := func(op string, ep *endpoint.Endpoint) {
+		p.log().Warn("not changing excluded record", slog.String("op", op), slog.Any("endpoint", ep))
+		metrics.For(p.webhook).ExcludedChanges.WithLabelValues(op).Inc()
+	}
+
+	allowed := &plan.Changes{}
+	for _, ep := range changes.Create {
+		if p.isExcluded(ep.DNSName) {
+			refuse("create", ep)
+			continue
+		}
+		allowed.Create = append(allowed.Create, ep)
+	}
+	for i, oldEP := range changes.UpdateOld {
+		newEP := changes.UpdateNew[i]
+		if p.isExcluded(oldEP.DNSName) || p.isExcluded(newEP.DNSName) {
+			refuse("update", newEP)
+			continue
+		}
+		allowed.UpdateOld = append(allowed.UpdateOld, oldEP)
+		allowed.UpdateNew = append(allowed.UpdateNew, newEP)
+	}
+	for _, ep := range changes.Delete {
+		if p.isExcluded(ep.DNSName) {
+			refuse("delete", ep)
+			continue
+		}
+		allowed.Delete = append(allowed.Delete, ep)
+	}
+	return allowed
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestExcludeRecords(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "vpn", Domain: "example.com", Server: "192.168.1.2"},
+				{ID: "2", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "3", HostID: "1", Hostname: "wg", Domain: "example.com", Host: "vpn.example.com"},
+			},
+		}
+	}
+
+	excluding := func(t *testing.T, api *unboundtest.Fake, patterns ...string) *unboundProvider {
+		excluded, err := ParseExcludePatterns(patterns)
+		require.NoError(t, err)
+		provider := &unboundProvider{api: api}
+		WithExcludeRecords(excluded)(provider)
+		return provider
+	}
+
+	t.Run("leaves excluded records out of Records", func(t *testing.T) {
+		provider := excluding(t, existing(), `^vpn\.`, `^wg\.`)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(records))
+	})
+
+	t.Run("drops excluded endpoints in AdjustEndpoints", func(t *testing.T) {
+		provider := excluding(t, existing(), `^vpn\.`)
+		dropped := testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustDropExcluded))
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("VPN.example.com.", endpoint.RecordTypeA, "192.168.1.3"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(adjusted))
+		require.Equal(t, dropped+1, testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustDropExcluded)))
+	})
+
+	t.Run("refuses changes to excluded records", func(t *testing.T) {
+		fake := existing()
+		provider := excluding(t, fake, `^vpn\.`, `^wg\.`)
+		refused := func(op string) float64 {
+			return testutil.ToFloat64(metrics.Default.ExcludedChanges.WithLabelValues(op))
+		}
+		before := map[string]float64{"create": refused("create"), "update": refused("update"), "delete": refused("delete")}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("wg.example.com", endpoint.RecordTypeA, "192.168.1.4"),
+				endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+			},
+			UpdateOld: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("vpn.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.11"),
+			},
+			Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("vpn.example.com", endpoint.RecordTypeA, "192.168.1.2")},
+		})
+		require.NoError(t, err)
+
+		servers := map[string]string{}
+		for _, ho := range fake.HostOverrides {
+			servers[ho.DNSName()] = ho.Server
+		}
+		require.Equal(t, map[string]string{
+			"vpn.example.com": "192.168.1.2",
+			"nas.example.com": "192.168.1.11",
+			"app.example.com": "192.168.1.20",
+		}, servers)
+		require.Len(t, fake.HostAliases, 1)
+
+		require.Equal(t, before["create"]+1, refused("create"))
+		require.Equal(t, before["update"]+1, refused("update"))
+		require.Equal(t, before["delete"]+1, refused("delete"))
+	})
+
+	t.Run("lets aliases of other records point to excluded ones", func(t *testing.T) {
+		fake := existing()
+		provider := excluding(t, fake, `^vpn\.`)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("tunnel.example.com", endpoint.RecordTypeCNAME, "vpn.example.com")},
+		})
+		require.NoError(t, err)
+		require.Len(t, fake.HostAliases, 2)
+		require.Equal(t, unbound.HostOverrideID("1"), fake.HostAliases[1].HostID)
+	})
+
+	t.Run("rejects invalid patterns", func(t *testing.T) {
+		_, err := ParseExcludePatterns([]string{`^vpn\.`, `(`})
+		require.ErrorContains(t, err, `invalid exclude pattern "("`)
+	})
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestFallback(t *testing.T) {
+	newProvider := func(primaryErr error, opts ...Option) (*unboundProvider, *unboundtest.Fake, *unboundtest.Fake) {
+		hostOverrides := []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+		}
+		primary := &unboundtest.Fake{HostOverrides: hostOverrides}
+		primary.Fail("ListHostOverrides", primaryErr)
+		fallback := &unboundtest.Fake{HostOverrides: hostOverrides}
+		provider := &unboundProvider{api: primary, fallback: fallback, reconfigurer: newReconfigurer(primary, 0, 3, slog.Default())}
+		for _, opt := range opts {
+			opt(provider)
+		}
+		return provider, primary, fallback
+	}
+
+	t.Run("lists records from the fallback when the primary is unavailable", func(t *testing.T) {
+		provider, _, fallback := newProvider(&unbound.StatusError{StatusCode: 502}, WithCacheTTL(time.Hour))
+		before := testutil.ToFloat64(metrics.Default.FallbackListings.WithLabelValues("success"))
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, 1, fallback.Calls("ListHostOverrides"))
+		require.Equal(t, before+1, testutil.ToFloat64(metrics.Default.FallbackListings.WithLabelValues("success")))
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 2, fallback.Calls("ListHostOverrides"), "fallback listings are not cached")
+	})
+
+	t.Run("does not fall back on definitive errors", func(t *testing.T) {
+		provider, _, fallback := newProvider(&unbound.StatusError{StatusCode: 401})
+
+		_, err := provider.Records(context.Background())
+		require.Error(t, err)
+		require.Equal(t, 0, fallback.Calls("ListHostOverrides"))
+	})
+
+	t.Run("never writes to the fallback by default", func(t *testing.T) {
+		provider, primary, fallback := newProvider(unbound.ErrCircuitOpen, WithSnapshotReuse(time.Hour))
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.ErrorIs(t, err, unbound.ErrCircuitOpen)
+		require.Len(t, fallback.HostOverrides, 1)
+		require.Equal(t, 0, fallback.Calls("Reconfigure"))
+		require.Equal(t, 2, primary.Calls("ListHostOverrides"))
+	})
+
+	t.Run("writes to the fallback in HA write mode", func(t *testing.T) {
+		provider, primary, fallback := newProvider(unbound.ErrCallTimeout, WithFallbackWrites())
+
+		err := provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+		require.Len(t, fallback.HostOverrides, 2)
+		require.Len(t, primary.HostOverrides, 1)
+		require.Equal(t, 1, fallback.Calls("Reconfigure"))
+		require.Equal(t, 0, primary.Calls("Reconfigure"))
+	})
+
+	t.Run("does not reuse a fallback listing once the primary recovers", func(t *testing.T) {
+		provider, primary, fallback := newProvider(unbound.ErrCallTimeout, WithFallbackWrites(), WithSnapshotReuse(time.Hour))
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, fallback.Calls("ListHostOverrides"))
+
+		primary.Fail("ListHostOverrides", nil)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+		require.Len(t, primary.HostOverrides, 2)
+		require.Len(t, fallback.HostOverrides, 1)
+		require.Equal(t, 1, primary.Calls("Reconfigure"))
+		require.Equal(t, 0, fallback.Calls("Reconfigure"))
+	})
+}
@@ -0,0 +1,246 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// WithGarbageCollection makes RunGC stamp the records external-dns desires with the time they were last seen
+// desired, at the end of their description, and delete records stamped longer than maxAge ago, such as those
+// of a cluster torn down before external-dns could delete them. Records without a stamp are never collected.
+// Deletes go through ApplyChanges, so they are soft deletes with WithSoftDelete, and skipped with
+// WithDisableDeletes, and seed and excluded records are kept.
+func WithGarbageCollection(maxAge time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.gcMaxAge = maxAge
+	}
+}
+
+// seenTag prefixes the time a record was last seen desired, at the end of its description.
+const seenTag = "[external-dns seen "
+
+// stampSeen returns description stamped as seen desired at the given time, instead of any previous time.
+func stampSeen(description string, at time.Time) string {
+	stamp := seenTag + at.UTC().Format(time.RFC3339) + "]"
+	if description = unstampSeen(description); description == "" {
+		return stamp
+	}
+	return description + " " + stamp
+}
+
+// unstampSeen returns description without its seen stamp.
+func unstampSeen(description string) string {
+	if i := strings.LastIndex(description, seenTag); i >= 0 && strings.HasSuffix(description, "]") {
+		return strings.TrimSuffix(description[:i], " ")
+	}
+	return description
+}
+
+// seenAt returns when a record was last seen desired, if its description is stamped.
+func seenAt(description string) (time.Time, bool) {
+	i := strings.LastIndex(description, seenTag)
+	if i < 0 || !strings.HasSuffix(description, "]") {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(time.RFC3339, description[i+len(seenTag):len(description)-1])
+	return at, err == nil
+}
+
+// withoutStamps removes seen and created stamps from the descriptions of endpoints, which external-dns would
+// otherwise plan to update whenever they change.
+func withoutStamps(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	for _, e := range endpoints {
+		for i, ps := range e.ProviderSpecific {
+			if ps.Name != unbound.DescriptionProperty || !strings.Contains(ps.Value, seenTag) && !strings.Contains(ps.Value, createdTag) {
+				continue
+			}
+			if value := unstampCreated(unstampSeen(ps.Value)); value != "" {
+				e.ProviderSpecific[i].Value = value
+			} else {
+				e.ProviderSpecific = append(e.ProviderSpecific[:i:i], e.ProviderSpecific[i+1:]...)
+			}
+			break
+		}
+	}
+	return endpoints
+}
+
+// desiredRecords are the records external-dns last passed to AdjustEndpoints, by record type and DNS name.
+type desiredRecords struct {
+	mu      sync.Mutex
+	records map[string]bool
+}
+
+func (d *desiredRecords) set(endpoints []*endpoint.Endpoint) {
+	records := make(map[string]bool, len(endpoints))
+	for _, e := range endpoints {
+		records[e.RecordType+" "+state.Normalize(e.DNSName)] = true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records = records
+}
+
+// get returns the desired records, or false if external-dns hasn't passed any yet.
+func (d *desiredRecords) get() (map[string]bool, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.records, d.records != nil
+}
+
+// now returns the time, as told by the provider's clock.
+func (p *unboundProvider) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+// RunGC collects garbage every quarter of the maximum age until ctx is done. It returns immediately if
+// garbage collection is disabled, or in read-only mode.
+func (p *unboundProvider) RunGC(ctx context.Context) {
+	if p.gcMaxAge <= 0 || p.readOnly != "" {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.gcMaxAge / 4):
+		}
+
+		if err := p.collectGarbage(ctx); err != nil && ctx.Err() == nil {
+			p.log().Warn("garbage collection failed", slog.Any("error", err))
+		}
+	}
+}
+
+// collectGarbage stamps the desired records whose stamp is older than a quarter of the maximum age,
+// and deletes the records not desired whose stamp is older than the maximum age. It does nothing until
+// external-dns has passed the desired records to AdjustEndpoints, as every record would seem undesired.
+func (p *unboundProvider) collectGarbage(ctx context.Context) error {
+	desired, ok := p.desired.get()
+	if !ok {
+		p.log().Debug("not collecting garbage until external-dns plans")
+		return nil
+	}
+
+	snap, err := p.listSnapshot(ctx, p.api)
+	if err != nil {
+		return err
+	}
+	st := snap.state
+
+	now := p.now()
+	filter := p.GetDomainFilter()
+	managed := func(dnsName, enabled string) bool {
+		return enabled != "0" && (!filter.IsConfigured() || filter.Match(dnsName)) && !p.isExcluded(dnsName)
+	}
+	isDesired := func(recordType, dnsName string) bool {
+		return desired[recordType+" "+state.Normalize(dnsName)] || p.isSeeded(dnsName)
+	}
+	// stale tells whether a desired record's stamp is due a refresh, and expired whether
+	// an undesired one's is old enough to be collected
+	stale := func(description string) bool {
+		seen, ok := seenAt(description)
+		return !ok || now.Sub(seen) >= p.gcMaxAge/4
+	}
+	expired := func(description string) bool {
+		seen, ok := seenAt(description)
+		return ok && now.Sub(seen) > p.gcMaxAge
+	}
+
+	var errs []error
+	stamped := 0
+	collect := &plan.Changes{}
+
+	expiredAliases := map[unbound.HostAliasID]bool{}
+	for _, ha := range st.HostAliases() {
+		switch {
+		case !managed(ha.DNSName(), ha.Enabled):
+		case isDesired(endpoint.RecordTypeCNAME, ha.DNSName()):
+			if !stale(ha.Description) {
+				continue
+			}
+			current, err := p.api.GetHostAlias(ctx, ha.ID)
+			if err == nil {
+				current.Description = stampSeen(current.Description, now)
+				err = p.api.UpdateHostAlias(ctx, current)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to stamp %s: %w", ha.DNSName(), err))
+				continue
+			}
+			stamped++
+		case expired(ha.Description):
+			expiredAliases[ha.ID] = true
+			collect.Delete = append(collect.Delete, endpoint.NewEndpoint(ha.DNSName(), endpoint.RecordTypeCNAME, ha.Host))
+		}
+	}
+
+	for _, ho := range st.HostOverrides() {
+		switch {
+		case !managed(ho.DNSName(), ho.Enabled):
+		case isDesired(endpoint.RecordTypeA, ho.DNSName()):
+			if !stale(ho.Description) {
+				continue
+			}
+			current, err := p.api.GetHostOverride(ctx, ho.ID)
+			if err == nil {
+				current.Description = stampSeen(current.Description, now)
+				err = p.api.UpdateHostOverride(ctx, current)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to stamp %s: %w", ho.DNSName(), err))
+				continue
+			}
+			stamped++
+		case expired(ho.Description):
+			// Deleting the override would take aliases still in use along
+			kept := false
+			for _, ha := range st.HostAliasesOf(ho.ID) {
+				kept = kept || !expiredAliases[ha.ID]
+			}
+			if kept {
+				p.log().Warn("not collecting expired Host Override with aliases in use", slog.String("dnsName", ho.DNSName()))
+				continue
+			}
+			collect.Delete = append(collect.Delete, endpoint.NewEndpoint(ho.DNSName(), endpoint.RecordTypeA, ho.Server))
+		}
+	}
+
+	if stamped > 0 {
+		// Stamps don't change what Records returns, but listings taken before hold the descriptions they replaced
+		if p.cache != nil {
+			p.cache.invalidate("apply")
+		}
+		if p.snapshots != nil {
+			p.snapshots.invalidate()
+		}
+		p.log().Debug("stamped records seen desired", slog.Int("records", stamped))
+	}
+
+	if len(collect.Delete) > 0 {
+		p.log().Info("collecting records not desired for longer than the maximum age",
+			countsByType(collect.Delete), slog.Duration("maxAge", p.gcMaxAge))
+		for _, e := range collect.Delete {
+			metrics.For(p.webhook).GCExpiredRecords.WithLabelValues(e.RecordType).Inc()
+		}
+		if err := p.ApplyChanges(ctx, collect); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
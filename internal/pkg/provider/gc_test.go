@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestGarbageCollection(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seen := func(ago time.Duration, description string) string {
+		return stampSeen(description, now.Add(-ago))
+	}
+
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: seen(time.Hour, "NAS"), Enabled: "1"},
+				{ID: "2", Hostname: "app", Domain: "example.com", Server: "10.0.0.1", Description: seen(48*time.Hour, ""), Enabled: "1"},
+				{ID: "3", Hostname: "router", Domain: "example.com", Server: "192.168.1.1", Description: "Router", Enabled: "1"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "4", HostID: "2", Hostname: "www", Domain: "example.com", Host: "app.example.com", Description: seen(48*time.Hour, ""), Enabled: "1"},
+			},
+		}
+	}
+
+	collecting := func(api unbound.API, opts ...Option) *unboundProvider {
+		provider := &unboundProvider{api: api, clock: func() time.Time { return now }}
+		WithGarbageCollection(24 * time.Hour)(provider)
+		for _, opt := range opts {
+			opt(provider)
+		}
+		return provider
+	}
+
+	desire := func(t *testing.T, provider *unboundProvider, dnsNames ...string) {
+		t.Helper()
+		var endpoints []*endpoint.Endpoint
+		for _, name := range dnsNames {
+			endpoints = append(endpoints, endpoint.NewEndpoint(name, endpoint.RecordTypeA, "10.0.0.1"))
+		}
+		_, err := provider.AdjustEndpoints(endpoints)
+		require.NoError(t, err)
+	}
+
+	descriptions := func(fake *unboundtest.Fake) map[string]string {
+		records := map[string]string{}
+		for _, ho := range fake.HostOverrides {
+			records[ho.DNSName()] = ho.Description
+		}
+		for _, ha := range fake.HostAliases {
+			records[ha.DNSName()] = ha.Description
+		}
+		return records
+	}
+
+	t.Run("does nothing until external-dns plans", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Len(t, fake.HostOverrides, 3)
+		require.Zero(t, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("deletes records not desired for longer than the maximum age", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+		desire(t, provider, "nas.example.com")
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Equal(t, map[string]string{
+			"nas.example.com":    seen(time.Hour, "NAS"),
+			"router.example.com": "Router",
+		}, descriptions(fake))
+	})
+
+	t.Run("keeps records not desired for less than the maximum age", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+		desire(t, provider)
+		now = now.Add(-25 * time.Hour)
+		defer func() { now = now.Add(25 * time.Hour) }()
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Len(t, fake.HostOverrides, 3)
+		require.Len(t, fake.HostAliases, 1)
+	})
+
+	t.Run("never deletes records without a stamp", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+		desire(t, provider, "nas.example.com", "app.example.com", "www.example.com")
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Contains(t, descriptions(fake), "router.example.com")
+	})
+
+	t.Run("refreshes stale stamps of desired records", func(t *testing.T) {
+		fake := existing()
+		fake.HostAliases[0].Description = ""
+		provider := collecting(fake)
+		provider.desired.set([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("router.example.com", endpoint.RecordTypeA, "192.168.1.1"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "app.example.com"),
+		})
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Equal(t, map[string]string{
+			"nas.example.com":    seen(time.Hour, "NAS"),
+			"app.example.com":    seen(0, ""),
+			"router.example.com": seen(0, "Router"),
+			"www.example.com":    seen(0, ""),
+		}, descriptions(fake))
+		require.Zero(t, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("soft-deletes in soft-delete mode", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake, WithSoftDelete(time.Hour))
+		desire(t, provider, "nas.example.com")
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Len(t, fake.HostOverrides, 3)
+		app := fake.HostOverrides[1]
+		require.Equal(t, "0", app.Enabled)
+		require.NotContains(t, app.Description, seenTag)
+		_, ok := softDeletedAt(app.Enabled, app.Description)
+		require.True(t, ok)
+		require.Equal(t, "0", fake.HostAliases[0].Enabled)
+	})
+
+	t.Run("deletes nothing with deletes disabled", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake, WithDisableDeletes())
+		desire(t, provider, "nas.example.com")
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Len(t, fake.HostOverrides, 3)
+		require.Len(t, fake.HostAliases, 1)
+	})
+
+	t.Run("keeps and refreshes seed records", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+		provider.seeds = map[string]bool{"app.example.com": true}
+		desire(t, provider, "nas.example.com")
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Equal(t, seen(0, ""), descriptions(fake)["app.example.com"])
+		require.NotContains(t, descriptions(fake), "www.example.com")
+	})
+
+	t.Run("keeps overrides whose aliases are still desired", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+		provider.desired.set([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "app.example.com"),
+		})
+
+		require.NoError(t, provider.collectGarbage(context.Background()))
+		require.Contains(t, descriptions(fake), "app.example.com")
+		require.Equal(t, seen(0, ""), descriptions(fake)["www.example.com"])
+	})
+
+	t.Run("hides stamps from external-dns", func(t *testing.T) {
+		fake := existing()
+		provider := collecting(fake)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		for _, e := range records {
+			description, _ := e.GetProviderSpecificProperty(unbound.DescriptionProperty)
+			require.NotContains(t, description, seenTag, e.DNSName)
+		}
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+		})
+		require.NoError(t, err)
+		description, _ := adjusted[0].GetProviderSpecificProperty(unbound.DescriptionProperty)
+		require.Equal(t, "NAS", description)
+	})
+}
+
+func TestSeenStamp(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	require.Equal(t, "NAS [external-dns seen 2024-05-01T10:00:00Z]", stampSeen("NAS", at))
+	require.Equal(t, "[external-dns seen 2024-05-01T10:00:00Z]", stampSeen("", at))
+	require.Equal(t, "NAS [external-dns seen 2024-05-01T10:00:00Z]", stampSeen(stampSeen("NAS", at.Add(-time.Hour)), at))
+	require.Equal(t, "NAS", unstampSeen(stampSeen("NAS", at)))
+	require.Equal(t, "NAS [external-dns seen", unstampSeen("NAS [external-dns seen"))
+
+	seen, ok := seenAt(stampSeen("NAS", at))
+	require.True(t, ok)
+	require.True(t, at.Equal(seen))
+	_, ok = seenAt("NAS")
+	require.False(t, ok)
+	_, ok = seenAt("NAS [external-dns seen yesterday]")
+	require.False(t, ok)
+}
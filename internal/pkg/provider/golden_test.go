@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of tests with the output they get")
+
+// syntheticZone generates a zone of the given number of host overrides and as many aliases, the same every time,
+// in the order OPNsense lists them: by domain, then hostname. Among the records are mixed case names, wildcards,
+// IPv6 addresses, names shared by several overrides, disabled records, descriptions, seen stamps, and overrides
+// with no aliases, or several, some in another domain than theirs.
+func syntheticZone(overrides int) ([]unbound.HostOverride, []unbound.HostAlias) {
+	domains := []string{"home.example.com", "Lab.Example.com", "xn--bcher-kva.example"}
+	stamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	hos := make([]unbound.HostOverride, 0, overrides)
+	for i := range overrides {
+		ho := unbound.HostOverride{
+			ID:       unbound.HostOverrideID(fmt.Sprintf("%08d-0000-0000-0000-000000000000", i)),
+			Enabled:  "1",
+			Hostname: fmt.Sprintf("host%d", i),
+			Domain:   domains[i%len(domains)],
+			Server:   fmt.Sprintf("192.168.%d.%d", i/250, i%250+1),
+		}
+		switch {
+		case i%50 == 7:
+			ho.Hostname = "*"
+		case i%13 == 0:
+			ho.Hostname = fmt.Sprintf("Host%d", i)
+		case i%17 == 0 && i > 0:
+			// Shares the name of the override before the previous one, in the same domain
+			ho.Hostname = fmt.Sprintf("host%d", i-len(domains))
+		}
+		if i%11 == 0 {
+			ho.Server = fmt.Sprintf("fd00::%x", i+1)
+		}
+		if i%19 == 0 {
+			ho.Enabled = "0"
+		}
+		switch i % 7 {
+		case 0:
+			ho.Description = fmt.Sprintf("host %d", i)
+		case 1:
+			ho.Description = stampSeen("", stamp)
+		case 2:
+			ho.Description = stampSeen(fmt.Sprintf("host %d", i), stamp)
+		}
+		hos = append(hos, ho)
+	}
+
+	has := make([]unbound.HostAlias, 0, overrides)
+	for i := range overrides {
+		// Every fourth override has no aliases, and the one before it two
+		host := hos[i]
+		if i%4 == 3 {
+			host = hos[i-1]
+		}
+		ha := unbound.HostAlias{
+			ID:       unbound.HostAliasID(fmt.Sprintf("%08d-1111-1111-1111-111111111111", i)),
+			Enabled:  "1",
+			HostID:   host.ID,
+			Hostname: fmt.Sprintf("alias%d", i),
+			Domain:   host.Domain,
+			Host:     host.DNSName(),
+		}
+		if i%9 == 0 {
+			ha.Domain = domains[(i+1)%len(domains)]
+		}
+		if i%23 == 0 {
+			ha.Hostname = fmt.Sprintf("Alias%d", i)
+			ha.Enabled = "0"
+		}
+		if i%5 == 0 {
+			ha.Description = fmt.Sprintf("alias %d", i)
+		}
+		has = append(has, ha)
+	}
+
+	slices.SortFunc(hos, func(a, b unbound.HostOverride) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), strings.Compare(a.Hostname, b.Hostname), strings.Compare(string(a.ID), string(b.ID)))
+	})
+	slices.SortFunc(has, func(a, b unbound.HostAlias) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), strings.Compare(a.Hostname, b.Hostname), strings.Compare(string(a.ID), string(b.ID)))
+	})
+	return hos, has
+}
+
+// requireGolden compares got with testdata/<name>.golden, or updates it with got with -update.
+func requireGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err, "run the test with -update to create it")
+	require.Equal(t, string(want), string(got), "run the test with -update if the change is expected")
+}
+
+// serializeRecords returns records one per line, as external-dns prints endpoints.
+func serializeRecords(records []*endpoint.Endpoint) []byte {
+	var b strings.Builder
+	for _, ep := range records {
+		b.WriteString(ep.String())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+func TestRecordsGolden(t *testing.T) {
+	hos, has := syntheticZone(300)
+
+	t.Run("lists a large zone", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: hos, HostAliases: has}
+		provider, err := NewUnboundProviderWithAPI(fake)
+		require.NoError(t, err)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		requireGolden(t, "records", serializeRecords(records))
+	})
+
+	t.Run("lists a large zone in order, however OPNsense stores it", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		defer server.Close()
+		for i := len(hos) - 1; i >= 0; i-- {
+			server.AddHostOverride(hos[i])
+		}
+		for i := len(has) - 1; i >= 0; i-- {
+			server.AddHostAlias(has[i])
+		}
+		provider, err := NewUnboundProvider(server.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret)
+		require.NoError(t, err)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		requireGolden(t, "records", serializeRecords(records))
+	})
+}
@@ -0,0 +1,435 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// Instance is an OPNsense serving the records of some domains.
+type Instance struct {
+	// Name tells instances apart in logs, errors and status
+	Name      string   `json:"name"`
+	BaseURL   string   `json:"baseURL"`
+	APIKey    string   `json:"apiKey"`
+	APISecret string   `json:"apiSecret"`
+	Domains   []string `json:"domains"`
+}
+
+// LoadInstances reads a JSON list of instances from the file at path.
+func LoadInstances(path string) ([]Instance, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var instances []Instance
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&instances); err != nil {
+		return nil, fmt.Errorf("failed to read instances from %s: %w", path, err)
+	}
+	if err := validateInstances(instances); err != nil {
+		return nil, fmt.Errorf("invalid instances in %s: %w", path, err)
+	}
+	return instances, nil
+}
+
+func validateInstances(instances []Instance) error {
+	if len(instances) == 0 {
+		return errors.New("no instances")
+	}
+
+	names := map[string]bool{}
+	for i, in := range instances {
+		switch {
+		case in.Name == "":
+			return fmt.Errorf("instance %d has no name", i)
+		case names[in.Name]:
+			return fmt.Errorf("instance %s is defined twice", in.Name)
+		case in.BaseURL == "" || in.APIKey == "" || in.APISecret == "":
+			return fmt.Errorf("instance %s needs a base URL, an API key and an API secret", in.Name)
+		case len(in.Domains) == 0:
+			return fmt.Errorf("instance %s has no domains", in.Name)
+		}
+		names[in.Name] = true
+	}
+	return nil
+}
+
+// instance is a provider for the records of an Instance's domains.
+type instance struct {
+	*unboundProvider
+	name    string
+	domains []string
+}
+
+// multiProvider routes records to the instance serving their domain. Records merges the listings of
+// every instance, and ApplyChanges applies the changes of each instance independently of the others.
+type multiProvider struct {
+	instances []*instance
+	logger    *slog.Logger
+}
+
+// NewMultiProvider makes a provider for the records of every instance, with a provider per instance
+// configured by opts. The domain filter of each is that of its instance, and its logs carry its name.
+// Journal files given with WithJournalFile are suffixed with the instance name. WithFallback doesn't apply.
+func NewMultiProvider(instances []Instance, opts ...Option) (*multiProvider, error) {
+	if err := validateInstances(instances); err != nil {
+		return nil, err
+	}
+
+	base := newUnboundProvider(opts)
+	m := &multiProvider{logger: base.log()}
+	for _, in := range instances {
+		instanceOpts := append(slices.Clone(opts), WithLogger(m.logger.With(slog.String("instance", in.Name))), forInstance(in))
+		p, err := NewUnboundProvider(in.BaseURL, in.APIKey, in.APISecret, instanceOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", in.Name, err)
+		}
+		m.instances = append(m.instances, &instance{unboundProvider: p, name: in.Name, domains: in.Domains})
+	}
+	m.logger = withOwnerID(m.logger, base.ownerID).With(slog.String("component", "provider"))
+	return m, nil
+}
+
+// forInstance overrides the options that can't be shared between instances.
+func forInstance(in Instance) Option {
+	return func(p *unboundProvider) {
+		p.domains = slices.Clone(in.Domains)
+		WithStateFileSuffix(in.Name)(p)
+		p.fallbackURL = ""
+		p.fallbackWrites = false
+		// Each instance runs its own canary, in a domain of its own
+		if p.canary != nil && !endpoint.NewDomainFilter(in.Domains).Match(p.canary.domain) {
+			p.canary.domain = ""
+		}
+	}
+}
+
+// WithStateFileSuffix suffixes the journal, drift state and records backup files with "." and name, so that
+// providers configured alike in one process don't share them. It must come after WithJournalFile,
+// WithDriftDetection and WithRecordBackups.
+func WithStateFileSuffix(name string) Option {
+	return func(p *unboundProvider) {
+		if p.journalPath != "" {
+			p.journalPath += "." + name
+		}
+		if p.drift != nil && p.drift.path != "" {
+			p.drift.path += "." + name
+		}
+		if p.backupWriter != nil {
+			p.backupWriter.path += "." + name
+		}
+	}
+}
+
+// route returns the instance serving dnsName: the one with the longest domain dnsName is in.
+func (m *multiProvider) route(dnsName string) *instance {
+	name := state.Normalize(dnsName)
+
+	var best *instance
+	longest := -1
+	for _, in := range m.instances {
+		for _, domain := range in.domains {
+			domain = state.Normalize(domain)
+			if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > longest {
+				best, longest = in, len(domain)
+			}
+		}
+	}
+	return best
+}
+
+// Records lists the records of every instance. It fails if any instance fails to list, as it would for
+// a single instance: external-dns would otherwise plan to create the records of that instance anew.
+// An instance that serves stale records while its OPNsense is unavailable doesn't fail.
+func (m *multiProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	records := make([][]*endpoint.Endpoint, len(m.instances))
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		records[i], errs[i] = in.Records(ctx)
+	})
+
+	var merged []*endpoint.Endpoint
+	failed := false
+	for i, in := range m.instances {
+		if errs[i] != nil {
+			failed = true
+			m.logger.Error("failed to list records of instance", slog.String("instance", in.name), slog.Any("error", errs[i]))
+			errs[i] = fmt.Errorf("instance %s: %w", in.name, errs[i])
+			continue
+		}
+		merged = append(merged, records[i]...)
+	}
+	if failed {
+		return nil, joinApplyErrors(errs)
+	}
+	return merged, nil
+}
+
+// ApplyChanges applies the changes of each instance to it, all at once. An instance failing doesn't
+// keep the changes of the others from being applied. Updates that move a record to another instance
+// are applied as a deletion from one and a creation on the other.
+func (m *multiProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	changes = pairUpdates(changes, m.logger)
+
+	routed := make(map[*instance]*plan.Changes, len(m.instances))
+	changesOf := func(dnsName, op string) *plan.Changes {
+		in := m.route(dnsName)
+		if in == nil {
+			m.logger.Warn("no instance serves record, not applying change", slog.String("op", op), slog.String("dnsName", dnsName))
+			return nil
+		}
+		if routed[in] == nil {
+			routed[in] = &plan.Changes{}
+		}
+		return routed[in]
+	}
+
+	for _, ep := range changes.Create {
+		if c := changesOf(ep.DNSName, "create"); c != nil {
+			c.Create = append(c.Create, ep)
+		}
+	}
+	for i, oldEP := range changes.UpdateOld {
+		newEP := changes.UpdateNew[i]
+		if m.route(oldEP.DNSName) == m.route(newEP.DNSName) {
+			if c := changesOf(newEP.DNSName, "update"); c != nil {
+				c.UpdateOld = append(c.UpdateOld, oldEP)
+				c.UpdateNew = append(c.UpdateNew, newEP)
+			}
+			continue
+		}
+		if c := changesOf(oldEP.DNSName, "delete"); c != nil {
+			c.Delete = append(c.Delete, oldEP)
+		}
+		if c := changesOf(newEP.DNSName, "create"); c != nil {
+			c.Create = append(c.Create, newEP)
+		}
+	}
+	for _, ep := range changes.Delete {
+		if c := changesOf(ep.DNSName, "delete"); c != nil {
+			c.Delete = append(c.Delete, ep)
+		}
+	}
+
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		if c := routed[in]; c != nil {
+			if err := in.ApplyChanges(ctx, c); err != nil {
+				errs[i] = fmt.Errorf("instance %s: %w", in.name, err)
+			}
+		}
+	})
+	return joinApplyErrors(errs)
+}
+
+// joinApplyErrors joins errs, leaving out soft errors when there are others, so that external-dns
+// doesn't take a failure for a soft one because another instance is merely unavailable.
+// Records joins listing errors the same way.
+func joinApplyErrors(errs []error) error {
+	var hard []error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, provider.SoftError) {
+			hard = append(hard, err)
+		}
+	}
+	if len(hard) > 0 {
+		return errors.Join(hard...)
+	}
+	return errors.Join(errs...)
+}
+
+// AdjustEndpoints adjusts endpoints as the instance serving each of them does. Endpoints no instance serves are kept as they are.
+func (m *multiProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	routed := make(map[*instance][]*endpoint.Endpoint, len(m.instances))
+	var unrouted []*endpoint.Endpoint
+	for _, ep := range endpoints {
+		if in := m.route(ep.DNSName); in != nil {
+			routed[in] = append(routed[in], ep)
+		} else {
+			unrouted = append(unrouted, ep)
+		}
+	}
+
+	adjusted := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, in := range m.instances {
+		if len(routed[in]) == 0 {
+			continue
+		}
+		eps, err := in.AdjustEndpoints(routed[in])
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", in.name, err)
+		}
+		adjusted = append(adjusted, eps...)
+	}
+	return append(adjusted, unrouted...), nil
+}
+
+// GetDomainFilter matches the domains of every instance.
+func (m *multiProvider) GetDomainFilter() endpoint.DomainFilter {
+	var domains []string
+	for _, in := range m.instances {
+		domains = append(domains, in.domains...)
+	}
+	return endpoint.NewDomainFilter(domains)
+}
+
+// Ready returns an error when any instance isn't ready.
+func (m *multiProvider) Ready() error {
+	var errs []error
+	for _, in := range m.instances {
+		if err := in.Ready(); err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: %w", in.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the status of every instance, by name.
+func (m *multiProvider) Status() Status {
+	s := Status{Instances: make(map[string]Status, len(m.instances))}
+	for _, in := range m.instances {
+		s.Instances[in.name] = in.Status()
+	}
+	return s
+}
+
+// RunRefresh runs the background refresh of every instance until ctx is done.
+func (m *multiProvider) RunRefresh(ctx context.Context) {
+	m.each(func(_ int, in *instance) {
+		in.RunRefresh(ctx)
+	})
+}
+
+// RunCanary runs the canary of every instance until ctx is done.
+func (m *multiProvider) RunCanary(ctx context.Context) {
+	m.each(func(_ int, in *instance) {
+		in.RunCanary(ctx)
+	})
+}
+
+// CanaryReady returns an error when the last canary run of any instance failed.
+func (m *multiProvider) CanaryReady() error {
+	var errs []error
+	for _, in := range m.instances {
+		if err := in.CanaryReady(); err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: %w", in.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunGC runs the garbage collection of every instance until ctx is done.
+func (m *multiProvider) RunGC(ctx context.Context) {
+	m.each(func(_ int, in *instance) {
+		in.RunGC(ctx)
+	})
+}
+
+// RunBackups writes the records backups of every instance until ctx is done.
+func (m *multiProvider) RunBackups(ctx context.Context) {
+	m.each(func(_ int, in *instance) {
+		in.RunBackups(ctx)
+	})
+}
+
+// WaitForOPNsense waits for every instance, see unboundProvider.WaitForOPNsense.
+func (m *multiProvider) WaitForOPNsense(ctx context.Context, timeout, interval time.Duration) error {
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		if err := in.WaitForOPNsense(ctx, timeout, interval); err != nil {
+			errs[i] = fmt.Errorf("instance %s: %w", in.name, err)
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// each runs fn for every instance concurrently, and waits for all of them.
+func (m *multiProvider) each(fn func(i int, in *instance)) {
+	var wg sync.WaitGroup
+	for i, in := range m.instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(i, in)
+		}()
+	}
+	wg.Wait()
+}
+
+var _ provider.Provider = &multiProvider{}
+
+// Restore restores soft-deleted records on the instance each of names is routed to, or on every instance
+// when names is empty. Names no instance serves are refused before anything is restored.
+func (m *multiProvider) Restore(ctx context.Context, names []string, dryRun bool) ([]RestoredRecord, error) {
+	routed := make(map[*instance][]string, len(m.instances))
+	var unrouted []error
+	for _, name := range names {
+		in := m.route(name)
+		if in == nil {
+			unrouted = append(unrouted, fmt.Errorf("%s: no instance serves this domain", name))
+			continue
+		}
+		routed[in] = append(routed[in], name)
+	}
+	if len(unrouted) > 0 {
+		return nil, errors.Join(unrouted...)
+	}
+
+	restored := make([][]RestoredRecord, len(m.instances))
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		if len(names) > 0 && len(routed[in]) == 0 {
+			return
+		}
+		restored[i], errs[i] = in.Restore(ctx, routed[in], dryRun)
+		for j := range restored[i] {
+			restored[i][j].Instance = in.name
+		}
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("instance %s: %w", in.name, errs[i])
+		}
+	})
+	return slices.Concat(restored...), errors.Join(errs...)
+}
+
+// Seed seeds the records of seeds on the instance each of them is routed to. Seeds no instance serves are
+// refused before anything is seeded. Instances without seeds left have their previous ones cleared.
+func (m *multiProvider) Seed(ctx context.Context, seeds []*endpoint.Endpoint) error {
+	routed := make(map[*instance][]*endpoint.Endpoint, len(m.instances))
+	var unrouted []error
+	for _, ep := range seeds {
+		in := m.route(ep.DNSName)
+		if in == nil {
+			unrouted = append(unrouted, fmt.Errorf("%s: no instance serves this domain", ep.DNSName))
+			continue
+		}
+		routed[in] = append(routed[in], ep)
+	}
+	if len(unrouted) > 0 {
+		return errors.Join(unrouted...)
+	}
+
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		if err := in.Seed(ctx, routed[in]); err != nil {
+			errs[i] = fmt.Errorf("instance %s: %w", in.name, err)
+		}
+	})
+	return errors.Join(errs...)
+}
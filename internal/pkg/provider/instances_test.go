@@ -0,0 +1,245 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+func TestMultiProvider(t *testing.T) {
+	setup := func() (*multiProvider, *unboundtest.Fake, *unboundtest.Fake) {
+		home := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "ha", Domain: "home.example.com", Server: "192.168.1.10"},
+			},
+		}
+		lab := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "lab.home.example.com", Server: "10.0.0.10"},
+			},
+		}
+		m := &multiProvider{
+			logger: slog.Default(),
+			instances: []*instance{
+				{name: "home", domains: []string{"home.example.com"}, unboundProvider: &unboundProvider{api: home, domains: []string{"home.example.com"}}},
+				{name: "lab", domains: []string{"lab.home.example.com"}, unboundProvider: &unboundProvider{api: lab, domains: []string{"lab.home.example.com"}}},
+			},
+		}
+		return m, home, lab
+	}
+
+	t.Run("merges the records of every instance", func(t *testing.T) {
+		m, _, _ := setup()
+
+		records, err := m.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"ha.home.example.com", "nas.lab.home.example.com"}, dnsNames(records))
+	})
+
+	t.Run("fails to list when one instance fails", func(t *testing.T) {
+		m, _, lab := setup()
+		lab.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrUnavailable))
+
+		records, err := m.Records(context.Background())
+		require.ErrorContains(t, err, "instance lab")
+		require.NotContains(t, err.Error(), "instance home")
+		require.ErrorIs(t, err, provider.SoftError)
+		require.Nil(t, records)
+	})
+
+	t.Run("lists stale records of an instance that is unavailable", func(t *testing.T) {
+		m, _, lab := setup()
+		WithServeStale(time.Hour)(m.instances[1].unboundProvider)
+
+		_, err := m.Records(context.Background())
+		require.NoError(t, err)
+
+		lab.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrUnavailable))
+		records, err := m.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"ha.home.example.com", "nas.lab.home.example.com"}, dnsNames(records))
+	})
+
+	t.Run("fails to list when every instance fails", func(t *testing.T) {
+		m, home, lab := setup()
+		home.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrUnavailable))
+		lab.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrUnavailable))
+
+		_, err := m.Records(context.Background())
+		require.ErrorContains(t, err, "instance home")
+		require.ErrorContains(t, err, "instance lab")
+	})
+
+	t.Run("applies changes to the instance with the most specific domain", func(t *testing.T) {
+		m, home, lab := setup()
+
+		err := m.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("app.home.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+				endpoint.NewEndpoint("ci.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+			},
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.10")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.11")},
+			Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("ha.home.example.com", endpoint.RecordTypeA, "192.168.1.10")},
+		})
+		require.NoError(t, err)
+
+		require.Len(t, home.HostOverrides, 1)
+		require.Equal(t, "app.home.example.com", home.HostOverrides[0].DNSName())
+		require.Len(t, lab.HostOverrides, 2)
+		require.Equal(t, "10.0.0.11", lab.HostOverrides[0].Server)
+		require.Equal(t, "ci.lab.home.example.com", lab.HostOverrides[1].DNSName())
+	})
+
+	t.Run("moves records renamed into the domain of another instance", func(t *testing.T) {
+		m, home, lab := setup()
+
+		err := m.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("ha.home.example.com", endpoint.RecordTypeA, "192.168.1.10")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("ha.lab.home.example.com", endpoint.RecordTypeA, "192.168.1.10")},
+		})
+		require.NoError(t, err)
+
+		require.Empty(t, home.HostOverrides)
+		require.Len(t, lab.HostOverrides, 2)
+		require.Equal(t, "ha.lab.home.example.com", lab.HostOverrides[1].DNSName())
+	})
+
+	t.Run("skips changes no instance serves", func(t *testing.T) {
+		m, home, lab := setup()
+
+		err := m.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.org", endpoint.RecordTypeA, "192.168.1.20")},
+		})
+		require.NoError(t, err)
+		require.Len(t, home.HostOverrides, 1)
+		require.Len(t, lab.HostOverrides, 1)
+	})
+
+	t.Run("applies changes to the other instances when one fails", func(t *testing.T) {
+		m, home, lab := setup()
+		lab.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrValidation))
+
+		err := m.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("app.home.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+				endpoint.NewEndpoint("ci.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+			},
+		})
+		require.ErrorContains(t, err, "instance lab")
+		require.NotContains(t, err.Error(), "instance home")
+		require.Len(t, home.HostOverrides, 2)
+	})
+
+	t.Run("fails hard when any instance fails hard", func(t *testing.T) {
+		m, home, lab := setup()
+		home.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrUnavailable))
+		lab.Fail("ListHostOverrides", fmt.Errorf("searchHostOverride failed: %w", unbound.ErrValidation))
+
+		err := m.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("app.home.example.com", endpoint.RecordTypeA, "192.168.1.20"),
+				endpoint.NewEndpoint("ci.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+			},
+		})
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.NotErrorIs(t, err, provider.SoftError)
+	})
+
+	t.Run("adjusts endpoints as their instance does", func(t *testing.T) {
+		m, _, _ := setup()
+
+		adjusted, err := m.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("App.Home.Example.com.", endpoint.RecordTypeA, "192.168.1.20"),
+			endpoint.NewEndpoint("CI.lab.home.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"app.home.example.com", "ci.lab.home.example.com"}, dnsNames(adjusted))
+	})
+
+	t.Run("filters the domains of every instance", func(t *testing.T) {
+		m, _, _ := setup()
+
+		filter := m.GetDomainFilter()
+		require.True(t, filter.Match("ha.home.example.com"))
+		require.True(t, filter.Match("nas.lab.home.example.com"))
+		require.False(t, filter.Match("example.org"))
+	})
+
+	t.Run("reports the status of every instance", func(t *testing.T) {
+		m, _, _ := setup()
+
+		_, err := m.Records(context.Background())
+		require.NoError(t, err)
+		status := m.Status()
+		require.Len(t, status.Instances, 2)
+		require.Equal(t, 1, status.Instances["lab"].LastRecords.Records)
+	})
+}
+
+func TestNewMultiProvider(t *testing.T) {
+	dir := t.TempDir()
+	instances := []Instance{
+		{Name: "home", BaseURL: "https://192.168.1.1", APIKey: "key", APISecret: "secret", Domains: []string{"home.example.com"}},
+		{Name: "lab", BaseURL: "https://10.0.0.1", APIKey: "key", APISecret: "secret", Domains: []string{"lab.example.com"}},
+	}
+
+	m, err := NewMultiProvider(instances,
+		WithDomainFilter([]string{"example.org"}),
+		WithJournalFile(filepath.Join(dir, "journal")),
+		WithRecordBackups(filepath.Join(dir, "records.json"), 0, 1),
+		WithFallback("https://192.168.1.2", "key", "secret"))
+	require.NoError(t, err)
+
+	require.Len(t, m.instances, 2)
+	for _, in := range m.instances {
+		require.Equal(t, filepath.Join(dir, "journal."+in.name), in.journalPath)
+		require.Equal(t, filepath.Join(dir, "records.json."+in.name), in.backupWriter.path)
+		require.Nil(t, in.fallback)
+	}
+	require.Equal(t, []string{"home.example.com"}, m.instances[0].unboundProvider.domains)
+	require.Equal(t, []string{"lab.example.com"}, m.instances[1].unboundProvider.domains)
+}
+
+func TestLoadInstances(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "instances.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("loads instances", func(t *testing.T) {
+		instances, err := LoadInstances(write(t, `[
+			{"name": "home", "baseURL": "https://192.168.1.1", "apiKey": "key", "apiSecret": "secret", "domains": ["home.example.com"]}
+		]`))
+		require.NoError(t, err)
+		require.Equal(t, []Instance{
+			{Name: "home", BaseURL: "https://192.168.1.1", APIKey: "key", APISecret: "secret", Domains: []string{"home.example.com"}},
+		}, instances)
+	})
+
+	for name, content := range map[string]string{
+		"no instances":    `[]`,
+		"unknown fields":  `[{"name": "home", "baseURL": "https://192.168.1.1", "apiKey": "key", "apiSecret": "secret", "domains": ["home.example.com"], "domain": "x"}]`,
+		"no name":         `[{"baseURL": "https://192.168.1.1", "apiKey": "key", "apiSecret": "secret", "domains": ["home.example.com"]}]`,
+		"no credentials":  `[{"name": "home", "baseURL": "https://192.168.1.1", "domains": ["home.example.com"]}]`,
+		"no domains":      `[{"name": "home", "baseURL": "https://192.168.1.1", "apiKey": "key", "apiSecret": "secret"}]`,
+		"duplicate names": `[{"name": "home", "baseURL": "https://192.168.1.1", "apiKey": "key", "apiSecret": "secret", "domains": ["a.example.com"]}, {"name": "home", "baseURL": "https://10.0.0.1", "apiKey": "key", "apiSecret": "secret", "domains": ["b.example.com"]}]`,
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			_, err := LoadInstances(write(t, content))
+			require.Error(t, err)
+		})
+	}
+}
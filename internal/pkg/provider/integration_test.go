@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// TestOPNsense runs the provider against an OPNsense served over HTTP, through the client it makes itself.
+func TestOPNsense(t *testing.T) {
+	ctx := context.Background()
+
+	newProvider := func(t *testing.T, server *opnsensetest.Server, opts ...Option) *unboundProvider {
+		t.Helper()
+
+		provider, err := NewUnboundProvider(server.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret, opts...)
+		require.NoError(t, err)
+		return provider
+	}
+	changes := func() *plan.Changes {
+		return &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+				endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+			},
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "10.0.0.9"),
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "record by record"},
+		{name: "in bulk", opts: []Option{WithBulkApply(1)}},
+	} {
+		t.Run("applies changes "+tc.name, func(t *testing.T) {
+			server := opnsensetest.NewServer()
+			defer server.Close()
+			server.AddHostOverride(unbound.HostOverride{Hostname: "old", Domain: "example.com", Server: "10.0.0.9"})
+			provider := newProvider(t, server, tc.opts...)
+
+			require.NoError(t, provider.ApplyChanges(ctx, changes()))
+
+			overrides := server.HostOverrides()
+			require.Len(t, overrides, 1)
+			require.Equal(t, "nas.example.com", overrides[0].DNSName())
+			require.Equal(t, "10.0.0.2", overrides[0].Server)
+			aliases := server.HostAliases()
+			require.Len(t, aliases, 1)
+			require.Equal(t, "files.example.com", aliases[0].DNSName())
+			require.Equal(t, overrides[0].ID, aliases[0].HostID)
+			require.False(t, server.Unapplied(), "unbound is reconfigured")
+
+			records, err := provider.Records(ctx)
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"nas.example.com", "files.example.com"}, dnsNames(records))
+		})
+	}
+
+	t.Run("recovers from an apply OPNsense failed partway", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		defer server.Close()
+		server.FailNext("addHostAlias", 1, http.StatusServiceUnavailable)
+		provider := newProvider(t, server)
+
+		err := provider.ApplyChanges(ctx, changes())
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+		records, err := provider.Records(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(records))
+		require.False(t, server.Unapplied(), "the changes made are applied")
+
+		// external-dns plans what is left from the records listed
+		err = provider.ApplyChanges(ctx, &plan.Changes{Create: changes().Create[1:]})
+		require.NoError(t, err)
+		records, err = provider.Records(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"nas.example.com", "files.example.com"}, dnsNames(records))
+	})
+
+	t.Run("leaves records it can't apply out", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		defer server.Close()
+		provider := newProvider(t, server)
+
+		err := provider.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "fd00::2")},
+		})
+
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.Empty(t, server.HostOverrides())
+	})
+}
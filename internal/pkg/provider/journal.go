@@ -0,0 +1,200 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// JournalEntry is an operation of ApplyChanges whose outcome is unknown:
+// it was started, but the provider stopped or lost contact with OPNsense before it finished.
+type JournalEntry struct {
+	ID         uint64    `json:"id"`
+	Op         string    `json:"op,omitempty"`
+	RecordType string    `json:"recordType,omitempty"`
+	DNSName    string    `json:"dnsName,omitempty"`
+	Targets    []string  `json:"targets,omitempty"`
+	Started    time.Time `json:"started,omitempty"`
+
+	// Done marks the line finishing the entry in the journal file
+	Done bool `json:"done,omitempty"`
+}
+
+// journal tracks the operations in flight, in memory and optionally in a file, so that an apply
+// interrupted by a crash or an outage is noticed by the next one. Operations themselves are
+// idempotent, so recovering only takes listing records afresh and applying the plan again.
+//
+// The file holds one JSON entry per line: an entry when an operation starts, and a Done entry
+// with the same ID when it finishes. It is truncated whenever nothing is in flight.
+type journal struct {
+	mu          sync.Mutex
+	file        *os.File
+	nextID      uint64
+	inFlight    map[uint64]JournalEntry
+	interrupted []JournalEntry
+	logger      *slog.Logger
+}
+
+func newJournal(logger *slog.Logger) *journal {
+	return &journal{nextID: 1, inFlight: map[uint64]JournalEntry{}, logger: logger}
+}
+
+// openJournal loads the operations left in flight in the file at path, creating it if needed.
+func openJournal(path string, logger *slog.Logger) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	j := newJournal(logger)
+	j.file = f
+
+	left := map[uint64]JournalEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line may be torn by a crash while writing it
+			j.logger.Warn("skipping unreadable journal entry", slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+		if e.Done {
+			delete(left, e.ID)
+		} else {
+			left[e.ID] = e
+		}
+		j.nextID = max(j.nextID, e.ID+1)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	for _, e := range left {
+		j.interrupted = append(j.interrupted, e)
+	}
+	sort.Slice(j.interrupted, func(a, b int) bool { return j.interrupted[a].ID < j.interrupted[b].ID })
+
+	if len(j.interrupted) > 0 {
+		j.logger.Warn("found operations of an interrupted apply, the next apply will recover",
+			slog.String("path", path), slog.Any("operations", j.interrupted))
+	}
+
+	return j, nil
+}
+
+// begin records that op on ep is starting, and returns the ID to finish it with.
+func (j *journal) begin(op string, ep *endpoint.Endpoint) uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e := JournalEntry{
+		ID:         j.nextID,
+		Op:         op,
+		RecordType: ep.RecordType,
+		DNSName:    ep.DNSName,
+		Targets:    ep.Targets,
+		Started:    time.Now(),
+	}
+	j.nextID++
+	j.inFlight[e.ID] = e
+	j.write(e)
+	return e.ID
+}
+
+// finish records that the operation has a known outcome.
+func (j *journal) finish(id uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.inFlight, id)
+	j.write(JournalEntry{ID: id, Done: true})
+}
+
+// abandon keeps the operation for recovery, as its outcome is unknown.
+func (j *journal) abandon(id uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if e, ok := j.inFlight[id]; ok {
+		delete(j.inFlight, id)
+		j.interrupted = append(j.interrupted, e)
+	}
+}
+
+// takeInterrupted returns the operations left by interrupted applies, and forgets them
+// once nothing is in flight, as the caller is about to recover from them.
+func (j *journal) takeInterrupted() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	interrupted := j.interrupted
+	j.interrupted = nil
+	j.compact()
+	return interrupted
+}
+
+func (j *journal) pendingRecovery() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.interrupted)
+}
+
+// close syncs and closes the file, if any. Operations are only journaled in memory afterwards.
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := errors.Join(j.file.Sync(), j.file.Close())
+	j.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close journal: %w", err)
+	}
+	return nil
+}
+
+// write appends e to the file. j.mu must be held.
+func (j *journal) write(e JournalEntry) {
+	if j.file == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = j.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		j.logger.Error("failed to write journal", slog.Any("error", err))
+	}
+
+	if e.Done {
+		j.compact()
+	}
+}
+
+// compact empties the file when there is nothing to recover from it. j.mu must be held.
+func (j *journal) compact() {
+	if j.file == nil || len(j.inFlight) > 0 || len(j.interrupted) > 0 {
+		return
+	}
+
+	err := j.file.Truncate(0)
+	if err == nil {
+		_, err = j.file.Seek(0, io.SeekStart)
+	}
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		j.logger.Error("failed to compact journal", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// goneAPI answers deletes as OPNsense does for records deleted behind the provider's back.
+type goneAPI struct {
+	*unboundtest.Fake
+}
+
+func (g goneAPI) DeleteHostOverride(context.Context, unbound.HostOverride) error {
+	return fmt.Errorf("delHostOverride failed: %w", unbound.ErrNotFound)
+}
+
+func (g goneAPI) DeleteHostAlias(context.Context, unbound.HostAlias) error {
+	return fmt.Errorf("delHostAlias failed: %w", unbound.ErrNotFound)
+}
+
+func (g goneAPI) UpdateHostOverride(context.Context, unbound.HostOverride) error {
+	return fmt.Errorf("setHostOverride failed: %w", unbound.ErrNotFound)
+}
+
+func TestJournal(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "old1", Domain: "example.com", Server: "127.0.0.1"},
+				{ID: "2", Hostname: "old2", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+	}
+
+	migration := func() *plan.Changes {
+		return &plan.Changes{
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("old1.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint("old2.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			},
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("new1.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				endpoint.NewEndpoint("new2.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "new1.example.com"),
+			},
+		}
+	}
+
+	t.Run("replays a plan interrupted halfway after a restart", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "journal")
+		fake := existing()
+
+		// The first provider loses OPNsense after creating new1, leaving new2 in flight
+		crashing := &recordingAPI{
+			Fake:    fake,
+			failFor: map[string]bool{"create A new2.example.com": true},
+		}
+		first := &unboundProvider{api: transientFailures{crashing}}
+		first.journal, _ = openJournal(path, slog.Default())
+
+		err := first.ApplyChanges(context.Background(), migration())
+		require.Error(t, err)
+		require.Equal(t, 1, first.Status().InterruptedOperations)
+		first.journal.file.Close()
+
+		// The restarted provider finds the operation in the journal and converges on the same plan
+		second, err := NewUnboundProvider("https://opnsense.example.com", "fakeapikey", "fakeapisecret", WithJournalFile(path))
+		require.NoError(t, err)
+		second.api = fake
+		second.reconfigurer = newReconfigurer(fake, 0, 3, slog.Default())
+		require.Equal(t, 1, second.Status().InterruptedOperations)
+
+		err = second.ApplyChanges(context.Background(), migration())
+		require.NoError(t, err)
+
+		records, err := second.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"new1.example.com", "new2.example.com", "www.example.com"}, dnsNames(records))
+		require.Zero(t, second.Status().InterruptedOperations)
+
+		journal, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Empty(t, journal)
+	})
+
+	t.Run("lists afresh instead of reusing a snapshot when recovering", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake, journal: newJournal(slog.Default())}
+		WithSnapshotReuse(time.Hour)(provider)
+
+		id := provider.journal.begin("create", endpoint.NewEndpoint("new1.example.com", endpoint.RecordTypeA, "127.0.0.2"))
+		provider.journal.abandon(id)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		err = provider.ApplyChanges(context.Background(), createChanges("new1.example.com"))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, fake.Calls("ListHostOverrides"))
+		require.Zero(t, provider.journal.pendingRecovery())
+	})
+
+	t.Run("treats deleting missing records as done", func(t *testing.T) {
+		provider := &unboundProvider{api: goneAPI{existing()}, journal: newJournal(slog.Default())}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{Delete: migration().Delete})
+		require.NoError(t, err)
+		require.Zero(t, provider.journal.pendingRecovery())
+	})
+
+	t.Run("creates records deleted before their update again", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: goneAPI{fake}}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("old1.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("old1.example.com", endpoint.RecordTypeA, "127.0.0.9")},
+		})
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 3)
+		require.Equal(t, "old1.example.com", fake.HostOverrides[2].DNSName())
+		require.Equal(t, "127.0.0.9", fake.HostOverrides[2].Server)
+	})
+
+	t.Run("does not create existing records again", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		err := provider.ApplyChanges(context.Background(), createChanges("old1.example.com"))
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 2)
+	})
+}
+
+// transientFailures makes failures of the wrapped API look like OPNsense going away.
+type transientFailures struct {
+	*recordingAPI
+}
+
+func (t transientFailures) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	ho, err := t.recordingAPI.CreateHostOverride(ctx, ho)
+	if err != nil {
+		return ho, fmt.Errorf("%w: %w", unbound.ErrCircuitOpen, err)
+	}
+	return ho, nil
+}
+
+func dnsNames(endpoints []*endpoint.Endpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		names = append(names, ep.DNSName)
+	}
+	return names
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultListConcurrency = 5
+
+// ErrTooManyRecords is returned by Records when OPNsense lists more records than the maximum set by WithMaxRecords.
+var ErrTooManyRecords = errors.New("too many records")
+
+// WithMaxRecords makes Records fail when OPNsense lists more than n host overrides and aliases together,
+// rather than have external-dns plan against a runaway zone, or one cut short. 0 means no limit.
+func WithMaxRecords(n int) Option {
+	return func(p *unboundProvider) {
+		p.maxRecords = n
+	}
+}
+
+// checkMaxRecords fails listings of more records than the maximum, counting them.
+func (p *unboundProvider) checkMaxRecords(st *state.State) error {
+	if p.maxRecords <= 0 {
+		return nil
+	}
+	if n := st.Len(); n > p.maxRecords {
+		metrics.For(p.webhook).RecordsLimitExceeded.Inc()
+		p.log().Error("OPNsense listed more records than the maximum", slog.Int("records", n), slog.Int("maxRecords", p.maxRecords))
+		return fmt.Errorf("listed %d records, more than the maximum of %d: %w", n, p.maxRecords, ErrTooManyRecords)
+	}
+	return nil
+}
+
+// listHostAliases lists the aliases of every override from a, at most listConcurrency at a time.
+// Aliases are returned in the order of hostOverrides. The first error cancels the remaining calls.
+//
+// Aliases of overrides outside the domain filter are not listed, so aliases in managed domains
+// are only seen when their override is in a managed domain too.
+func (p *unboundProvider) listHostAliases(ctx context.Context, a unbound.API, hostOverrides []unbound.HostOverride) ([][]unbound.HostAlias, error) {
+	limit := p.listConcurrency
+	if limit < 1 {
+		limit = defaultListConcurrency
+	}
+
+	res := make([][]unbound.HostAlias, len(hostOverrides))
+
+	todo := make([]int, 0, len(hostOverrides))
+	filter := p.GetDomainFilter()
+	for i, ho := range hostOverrides {
+		if !filter.IsConfigured() || filter.Match(ho.DNSName()) {
+			todo = append(todo, i)
+		}
+	}
+
+	// A fixed set of workers rather than a goroutine per override keeps large zones cheap to list
+	var next atomic.Int64
+	g, ctx := errgroup.WithContext(ctx)
+	for w := 0; w < min(limit, len(todo)); w++ {
+		g.Go(func() error {
+			for ctx.Err() == nil {
+				n := int(next.Add(1)) - 1
+				if n >= len(todo) {
+					return nil
+				}
+
+				ho := hostOverrides[todo[n]]
+				aliases, err := a.ListHostAliases(ctx, ho.ID)
+				if err != nil {
+					p.log().Error("failed to list CNAME records", slog.Any("hostOverride", ho), slog.Any("error", err))
+					return err
+				}
+				res[todo[n]] = aliases
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Only a successful call shows that OPNsense supports aliases
+	if len(todo) > 0 {
+		p.aliases.markAvailable(p.log())
+	}
+
+	if skipped := len(hostOverrides) - len(todo); skipped > 0 {
+		p.log().Debug("skipped listing aliases of overrides outside the domain filter", slog.Int("skipped", skipped))
+	}
+	return res, nil
+}
+
+// settingsLister returns a as a SettingsAPI if records are to be listed from the Unbound settings.
+func (p *unboundProvider) settingsLister(a unbound.API) (unbound.SettingsAPI, bool) {
+	if !p.settingsListing || p.settingsListingUnsupported.Load() {
+		return nil, false
+	}
+	sa, ok := a.(unbound.SettingsAPI)
+	return sa, ok
+}
+
+// listSettings lists records from the Unbound settings in one call, returning them like ListHostOverrides
+// and listHostAliases would. Like there, aliases of overrides outside the domain filter are left out.
+func (p *unboundProvider) listSettings(ctx context.Context, sa unbound.SettingsAPI) ([]unbound.HostOverride, [][]unbound.HostAlias, error) {
+	settings, err := sa.GetSettings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filter := p.GetDomainFilter()
+	index := make(map[unbound.HostOverrideID]int, len(settings.HostOverrides))
+	for i, ho := range settings.HostOverrides {
+		if !filter.IsConfigured() || filter.Match(ho.DNSName()) {
+			index[ho.ID] = i
+		}
+	}
+
+	hostAliases := make([][]unbound.HostAlias, len(settings.HostOverrides))
+	for _, ha := range settings.HostAliases {
+		if i, ok := index[ha.HostID]; ok {
+			hostAliases[i] = append(hostAliases[i], ha)
+		}
+	}
+	return settings.HostOverrides, hostAliases, nil
+}
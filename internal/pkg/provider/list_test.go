@@ -0,0 +1,409 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+// slowAliasesAPI serves each override's aliases after a delay, tracking how many listings overlap.
+type slowAliasesAPI struct {
+	*unboundtest.Fake
+	delay   time.Duration
+	failFor unbound.HostOverrideID
+
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+	cancelled   atomic.Int32
+}
+
+func (f *slowAliasesAPI) ListHostAliases(ctx context.Context, id unbound.HostOverrideID) ([]unbound.HostAlias, error) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		max := f.maxInFlight.Load()
+		if n <= max || f.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+
+	if id == f.failFor {
+		return nil, errors.New("boom")
+	}
+
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		f.cancelled.Add(1)
+		return nil, ctx.Err()
+	}
+
+	var res []unbound.HostAlias
+	for _, ha := range f.HostAliases {
+		if ha.HostID == id {
+			res = append(res, ha)
+		}
+	}
+	return res, nil
+}
+
+func newSlowAliasesAPI(overrides int, delay time.Duration) *slowAliasesAPI {
+	fake := &unboundtest.Fake{}
+	for i := 0; i < overrides; i++ {
+		id := unbound.HostOverrideID(fmt.Sprint(i))
+		fake.HostOverrides = append(fake.HostOverrides, unbound.HostOverride{
+			ID: id, Hostname: fmt.Sprintf("host%d", i), Domain: "example.com", Server: "127.0.0.1",
+		})
+		fake.HostAliases = append(fake.HostAliases, unbound.HostAlias{
+			ID: unbound.HostAliasID(fmt.Sprint(i)), HostID: id, Hostname: fmt.Sprintf("alias%d", i), Domain: "example.com",
+		})
+	}
+	return &slowAliasesAPI{Fake: fake, delay: delay}
+}
+
+func TestListHostAliases(t *testing.T) {
+	t.Run("lists aliases concurrently, up to the limit", func(t *testing.T) {
+		fake := newSlowAliasesAPI(20, 5*time.Millisecond)
+		provider := &unboundProvider{api: fake, listConcurrency: 4}
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int32(4), fake.maxInFlight.Load())
+	})
+
+	t.Run("preserves ordering", func(t *testing.T) {
+		fake := newSlowAliasesAPI(20, time.Millisecond)
+		serial := &unboundProvider{api: fake, listConcurrency: 1}
+		parallel := &unboundProvider{api: fake, listConcurrency: 8}
+
+		want, err := serial.Records(context.Background())
+		require.NoError(t, err)
+
+		for i := 0; i < 5; i++ {
+			got, err := parallel.Records(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+		require.Equal(t, "host0.example.com", want[0].DNSName)
+		require.Equal(t, "alias0.example.com", want[1].DNSName)
+	})
+
+	t.Run("returns the first error and cancels the remaining listings", func(t *testing.T) {
+		fake := newSlowAliasesAPI(20, time.Second)
+		fake.failFor = "3"
+		provider := &unboundProvider{api: fake, listConcurrency: 5}
+
+		start := time.Now()
+		_, err := provider.Records(context.Background())
+		require.EqualError(t, err, "boom")
+		require.Less(t, time.Since(start), time.Second)
+		require.Positive(t, fake.cancelled.Load())
+	})
+
+	t.Run("is safe under concurrent Records calls", func(t *testing.T) {
+		fake := newSlowAliasesAPI(10, time.Millisecond)
+		provider := &unboundProvider{api: fake, listConcurrency: 3}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				records, err := provider.Records(context.Background())
+				require.NoError(t, err)
+				require.Len(t, records, 20)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestListHostAliasesDomainFilter(t *testing.T) {
+	newProvider := func() (*unboundProvider, *unboundtest.Fake) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+				{ID: "2", Hostname: "b", Domain: "other.com", Server: "127.0.0.2"},
+				{ID: "3", Hostname: "c", Domain: "sub.other.com", Server: "127.0.0.3"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithDomainFilter([]string{"example.com"})(provider)
+		return provider, fake
+	}
+
+	t.Run("skips overrides outside the domain filter in Records", func(t *testing.T) {
+		provider, fake := newProvider()
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		require.Equal(t, 1, fake.Calls("ListHostAliases"))
+	})
+
+	t.Run("skips overrides outside the domain filter in ApplyChanges", func(t *testing.T) {
+		provider, fake := newProvider()
+
+		err := provider.ApplyChanges(context.Background(), createChanges("d.example.com"))
+		require.NoError(t, err)
+		require.Equal(t, 1, fake.Calls("ListHostAliases"))
+	})
+
+	t.Run("lists every override without a domain filter", func(t *testing.T) {
+		provider, fake := newProvider()
+		provider.domains = []string{""}
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 3, fake.Calls("ListHostAliases"))
+	})
+}
+
+func discardLogs(b *testing.B) {
+	b.Helper()
+
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(prev) })
+}
+
+// zoneAPI serves a large zone with aliases indexed by override, so that listing it is cheap.
+type zoneAPI struct {
+	*unboundtest.Fake
+	aliasesByHost map[unbound.HostOverrideID][]unbound.HostAlias
+}
+
+func (z *zoneAPI) ListHostAliases(_ context.Context, id unbound.HostOverrideID) ([]unbound.HostAlias, error) {
+	return z.aliasesByHost[id], nil
+}
+
+// newZoneAPI serves a synthetic zone of the given number of overrides and as many aliases.
+func newZoneAPI(overrides int) *zoneAPI {
+	hos, has := syntheticZone(overrides)
+	z := &zoneAPI{Fake: &unboundtest.Fake{HostOverrides: hos}, aliasesByHost: make(map[unbound.HostOverrideID][]unbound.HostAlias, overrides)}
+	for _, ha := range has {
+		z.aliasesByHost[ha.HostID] = append(z.aliasesByHost[ha.HostID], ha)
+	}
+	return z
+}
+
+// BenchmarkRecords lists a zone of 10k records: 5k overrides and as many aliases.
+func BenchmarkRecords(b *testing.B) {
+	discardLogs(b)
+
+	provider := &unboundProvider{api: newZoneAPI(5000)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := provider.Records(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecordsConcurrency(b *testing.B) {
+	discardLogs(b)
+
+	for _, concurrency := range []int{1, 5, 10} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			fake := newSlowAliasesAPI(50, time.Millisecond)
+			provider := &unboundProvider{api: fake, listConcurrency: concurrency}
+
+			for i := 0; i < b.N; i++ {
+				if _, err := provider.Records(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxRecords(t *testing.T) {
+	t.Run("lists up to the maximum", func(t *testing.T) {
+		provider := &unboundProvider{api: newZoneAPI(10)}
+		WithMaxRecords(20)(provider)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 20)
+	})
+
+	t.Run("fails listings of more records than the maximum", func(t *testing.T) {
+		provider := &unboundProvider{api: newZoneAPI(10)}
+		WithMaxRecords(19)(provider)
+		before := testutil.ToFloat64(metrics.Default.RecordsLimitExceeded)
+
+		_, err := provider.Records(context.Background())
+		require.ErrorIs(t, err, ErrTooManyRecords)
+		require.ErrorContains(t, err, "listed 20 records, more than the maximum of 19")
+		require.Equal(t, before+1, testutil.ToFloat64(metrics.Default.RecordsLimitExceeded))
+		require.False(t, provider.Status().LastRecords.Success)
+	})
+
+	t.Run("doesn't serve an earlier listing in place of one too large", func(t *testing.T) {
+		api := newZoneAPI(10)
+		provider := &unboundProvider{api: api}
+		WithMaxRecords(20)(provider)
+		WithServeStale(time.Hour)(provider)
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		api.HostOverrides = append(api.HostOverrides, unbound.HostOverride{ID: "new", Hostname: "new", Domain: "home.example.com", Server: "192.168.1.2"})
+		_, err = provider.Records(context.Background())
+		require.ErrorIs(t, err, ErrTooManyRecords)
+	})
+}
+
+// settingsZoneAPI serves a zone from the Unbound settings too, counting calls as round trips to OPNsense.
+type settingsZoneAPI struct {
+	*zoneAPI
+	latency time.Duration
+	getErr  error
+
+	calls atomic.Int32
+	gets  atomic.Int32
+}
+
+func newSettingsZoneAPI(overrides int, latency time.Duration) *settingsZoneAPI {
+	return &settingsZoneAPI{zoneAPI: newZoneAPI(overrides), latency: latency}
+}
+
+func (z *settingsZoneAPI) roundTrip() {
+	z.calls.Add(1)
+	time.Sleep(z.latency)
+}
+
+func (z *settingsZoneAPI) ListHostOverrides(ctx context.Context) ([]unbound.HostOverride, error) {
+	z.roundTrip()
+	return z.zoneAPI.ListHostOverrides(ctx)
+}
+
+func (z *settingsZoneAPI) ListHostAliases(ctx context.Context, id unbound.HostOverrideID) ([]unbound.HostAlias, error) {
+	z.roundTrip()
+	return z.zoneAPI.ListHostAliases(ctx, id)
+}
+
+func (z *settingsZoneAPI) GetSettings(_ context.Context) (*unbound.Settings, error) {
+	z.roundTrip()
+	z.gets.Add(1)
+	if z.getErr != nil {
+		return nil, z.getErr
+	}
+
+	settings := &unbound.Settings{HostOverrides: z.HostOverrides}
+	for _, ho := range z.HostOverrides {
+		settings.HostAliases = append(settings.HostAliases, z.aliasesByHost[ho.ID]...)
+	}
+	return settings, nil
+}
+
+func (z *settingsZoneAPI) GetHostSettings(context.Context) (*unbound.HostSettings, error) {
+	return nil, errors.New("not served")
+}
+
+func (z *settingsZoneAPI) SetHostSettings(context.Context, *unbound.HostSettings) error {
+	return errors.New("not served")
+}
+
+func TestSettingsListing(t *testing.T) {
+	t.Run("lists records with a single call", func(t *testing.T) {
+		api := newSettingsZoneAPI(20, 0)
+		provider := &unboundProvider{api: api}
+		WithSettingsListing()(provider)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, records, 40)
+		require.Equal(t, int32(1), api.calls.Load())
+	})
+
+	for _, domains := range [][]string{nil, {"host1.home.example.com"}} {
+		t.Run(fmt.Sprintf("lists the same records as searches with domain filter %v", domains), func(t *testing.T) {
+			api := newSettingsZoneAPI(20, 0)
+			search := &unboundProvider{api: api}
+			settings := &unboundProvider{api: api}
+			WithDomainFilter(domains)(search)
+			WithDomainFilter(domains)(settings)
+			WithSettingsListing()(settings)
+
+			want, err := search.Records(context.Background())
+			require.NoError(t, err)
+			got, err := settings.Records(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		})
+	}
+
+	t.Run("searches for good once the settings can't be listed from", func(t *testing.T) {
+		api := newSettingsZoneAPI(20, 0)
+		api.getErr = fmt.Errorf("getSettings failed: %w", unbound.ErrBadResponse)
+		provider := &unboundProvider{api: api}
+		WithSettingsListing()(provider)
+
+		for i := 0; i < 2; i++ {
+			records, err := provider.Records(context.Background())
+			require.NoError(t, err)
+			require.Len(t, records, 40)
+		}
+		require.Equal(t, int32(1), api.gets.Load())
+	})
+
+	t.Run("doesn't search when OPNsense is unavailable", func(t *testing.T) {
+		api := newSettingsZoneAPI(20, 0)
+		api.getErr = fmt.Errorf("getSettings failed: %w", unbound.ErrUnavailable)
+		provider := &unboundProvider{api: api}
+		WithSettingsListing()(provider)
+
+		_, err := provider.Records(context.Background())
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+		require.Equal(t, int32(1), api.calls.Load())
+
+		api.getErr = nil
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int32(2), api.gets.Load())
+	})
+}
+
+// BenchmarkRecordsListing compares the round trips to OPNsense of listing records with searches
+// and from the Unbound settings, for a zone of 500 overrides and as many aliases.
+func BenchmarkRecordsListing(b *testing.B) {
+	discardLogs(b)
+
+	for _, listing := range []struct {
+		name string
+		opts []Option
+	}{
+		{"search", nil},
+		{"settings", []Option{WithSettingsListing()}},
+	} {
+		b.Run(listing.name, func(b *testing.B) {
+			api := newSettingsZoneAPI(500, 50*time.Microsecond)
+			provider := &unboundProvider{api: api}
+			for _, opt := range listing.opts {
+				opt(provider)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := provider.Records(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(api.calls.Load())/float64(b.N), "calls/op")
+		})
+	}
+}
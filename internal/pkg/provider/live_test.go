@@ -0,0 +1,126 @@
+//go:build integration
+
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// TestLiveProvider runs the provider against the OPNsense set by OPNSENSE_TEST_BASE_URL, OPNSENSE_TEST_KEY,
+// OPNSENSE_TEST_SECRET and OPNSENSE_TEST_DOMAIN, making records in that domain, and checks what Unbound
+// answers at OPNSENSE_TEST_DNS_ADDRESS, the base URL host on port 53 by default.
+func TestLiveProvider(t *testing.T) {
+	baseURL, apiKey, apiSecret, domain := os.Getenv("OPNSENSE_TEST_BASE_URL"), os.Getenv("OPNSENSE_TEST_KEY"),
+		os.Getenv("OPNSENSE_TEST_SECRET"), os.Getenv("OPNSENSE_TEST_DOMAIN")
+	if baseURL == "" || apiKey == "" || apiSecret == "" || domain == "" {
+		t.Skip("set OPNSENSE_TEST_BASE_URL, OPNSENSE_TEST_KEY, OPNSENSE_TEST_SECRET and OPNSENSE_TEST_DOMAIN to test against an OPNsense")
+	}
+	address := os.Getenv("OPNSENSE_TEST_DNS_ADDRESS")
+	if address == "" {
+		u, err := url.Parse(baseURL)
+		require.NoError(t, err)
+		address = net.JoinHostPort(u.Hostname(), "53")
+	}
+	resolver := NewResolver(address)
+
+	provider, err := NewUnboundProvider(baseURL, apiKey, apiSecret, WithInsecureClient(), WithDomainFilter([]string{domain}))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var b [4]byte
+	rand.Read(b[:])
+	run := hex.EncodeToString(b[:])
+	hostName, aliasName := "test-a-"+run+"."+domain, "test-cname-"+run+"."+domain
+
+	// Deletes whatever is left of the records, even when the test fails halfway
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		records, err := provider.Records(WithFreshRecords(ctx))
+		if err != nil {
+			t.Errorf("failed to clean up: %v", err)
+			return
+		}
+		var left []*endpoint.Endpoint
+		for _, ep := range records {
+			if ep.DNSName == hostName || ep.DNSName == aliasName {
+				left = append(left, ep)
+			}
+		}
+		if len(left) > 0 {
+			if err := provider.ApplyChanges(ctx, &plan.Changes{Delete: left}); err != nil {
+				t.Errorf("failed to clean up: %v", err)
+			}
+		}
+	})
+
+	requireResolves := func(t *testing.T, name string, addrs ...string) {
+		t.Helper()
+
+		require.EventuallyWithT(t, func(c *assert.CollectT) {
+			ips, err := resolver.LookupNetIP(ctx, "ip4", name)
+			if len(addrs) == 0 {
+				var dnsErr *net.DNSError
+				assert.True(c, errors.As(err, &dnsErr) && dnsErr.IsNotFound, "%s resolves to %v (%v), expected nothing", name, ips, err)
+				return
+			}
+			got := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			slices.Sort(got)
+			assert.NoError(c, err)
+			assert.Equal(c, addrs, got, "%s resolves", name)
+		}, 30*time.Second, 500*time.Millisecond)
+	}
+	requireRecords := func(t *testing.T, expected ...*endpoint.Endpoint) {
+		t.Helper()
+
+		records, err := provider.Records(WithFreshRecords(ctx))
+		require.NoError(t, err)
+		var got []string
+		for _, ep := range records {
+			if ep.DNSName == hostName || ep.DNSName == aliasName {
+				got = append(got, ep.RecordType+" "+ep.DNSName+" "+ep.Targets.String())
+			}
+		}
+		var want []string
+		for _, ep := range expected {
+			want = append(want, ep.RecordType+" "+ep.DNSName+" "+ep.Targets.String())
+		}
+		require.ElementsMatch(t, want, got)
+	}
+
+	a := endpoint.NewEndpoint(hostName, endpoint.RecordTypeA, "192.0.2.10")
+	cname := endpoint.NewEndpoint(aliasName, endpoint.RecordTypeCNAME, hostName)
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{a, cname}}))
+	requireRecords(t, a, cname)
+	requireResolves(t, hostName, "192.0.2.10")
+	requireResolves(t, aliasName, "192.0.2.10")
+
+	updated := endpoint.NewEndpoint(hostName, endpoint.RecordTypeA, "192.0.2.11")
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{UpdateOld: []*endpoint.Endpoint{a}, UpdateNew: []*endpoint.Endpoint{updated}}))
+	requireRecords(t, updated, cname)
+	requireResolves(t, hostName, "192.0.2.11")
+	requireResolves(t, aliasName, "192.0.2.11")
+
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{Delete: []*endpoint.Endpoint{cname, updated}}))
+	requireRecords(t)
+	requireResolves(t, aliasName)
+	requireResolves(t, hostName)
+}
@@ -0,0 +1,44 @@
+package provider
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+)
+
+// ownerIDPattern keeps owner IDs fit for logs, descriptions, User-Agent headers and metric labels alike.
+var ownerIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// ValidateOwnerID tells whether id can identify a webhook: up to 63 letters, digits, dots, underscores
+// and dashes, starting with a letter or digit.
+func ValidateOwnerID(id string) error {
+	if !ownerIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid owner ID %q: up to 63 letters, digits, '.', '_' and '-' are allowed, starting with a letter or digit", id)
+	}
+	return nil
+}
+
+// WithOwnerID identifies the webhook, such as by the name of its cluster, where several share an OPNsense:
+// logs carry ownerID=id, the OPNsense API requests' User-Agent names it, and soft-deleted records are tagged
+// with it. id must be valid by ValidateOwnerID.
+func WithOwnerID(id string) Option {
+	return func(p *unboundProvider) {
+		p.ownerID = id
+	}
+}
+
+// withOwnerID returns l logging with the owner ID, if any.
+func withOwnerID(l *slog.Logger, ownerID string) *slog.Logger {
+	if ownerID == "" {
+		return l
+	}
+	return l.With(slog.String("ownerID", ownerID))
+}
+
+// agent returns the User-Agent of the provider's requests.
+func (p *unboundProvider) agent() string {
+	if p.ownerID == "" {
+		return userAgent
+	}
+	return userAgent + " (owner-id " + p.ownerID + ")"
+}
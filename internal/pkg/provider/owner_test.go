@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestOwnerID(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"rows":[],"total":0}`)
+	}))
+	t.Cleanup(server.Close)
+
+	// ownerIDs returns the owner IDs logged with msg, repeated as many times as the record carries them.
+	ownerIDs := func(logs *recordingHandler, msg string) []string {
+		logs.mu.Lock()
+		defer logs.mu.Unlock()
+		var ids []string
+		for _, r := range logs.records {
+			if r.Message != msg {
+				continue
+			}
+			r.Attrs(func(a slog.Attr) bool {
+				if a.Key == "ownerID" {
+					ids = append(ids, a.Value.String())
+				}
+				return true
+			})
+		}
+		return ids
+	}
+
+	t.Run("validates owner IDs", func(t *testing.T) {
+		for _, id := range []string{"cluster-a", "prod.eu-west-1", "k8s_01", "A"} {
+			require.NoError(t, ValidateOwnerID(id), id)
+		}
+		for _, id := range []string{"", "-cluster", "cluster a", "cluster]", "cluster/a", string(make([]byte, 64))} {
+			require.Error(t, ValidateOwnerID(id), id)
+		}
+	})
+
+	t.Run("names the owner in logs and the User-Agent", func(t *testing.T) {
+		logs := &recordingHandler{}
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret",
+			WithOwnerID("cluster-a"), WithLogger(slog.New(logs)), WithDebugHTTP())
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "external-dns-opnsense-unbound-webhook-provider (owner-id cluster-a)", userAgent)
+		require.Equal(t, []string{"cluster-a"}, ownerIDs(logs, "listed records"))
+		require.Equal(t, []string{"cluster-a"}, ownerIDs(logs, "http exchange"))
+	})
+
+	t.Run("leaves the owner out when not given", func(t *testing.T) {
+		logs := &recordingHandler{}
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret", WithLogger(slog.New(logs)))
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "external-dns-opnsense-unbound-webhook-provider", userAgent)
+		require.Empty(t, ownerIDs(logs, "listed records"))
+	})
+
+	t.Run("names the owner once in the logs of each instance", func(t *testing.T) {
+		logs := &recordingHandler{}
+		multi, err := NewMultiProvider([]Instance{
+			{Name: "home", BaseURL: server.URL, APIKey: "fakeapikey", APISecret: "fakeapisecret", Domains: []string{"example.com"}},
+		}, WithOwnerID("cluster-a"), WithLogger(slog.New(logs)))
+		require.NoError(t, err)
+
+		_, err = multi.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"cluster-a"}, ownerIDs(logs, "listed records"))
+
+		multi.logger.Info("multi")
+		require.Equal(t, []string{"cluster-a"}, ownerIDs(logs, "multi"))
+	})
+
+	t.Run("tags soft-deleted records with the owner", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: "NAS", Enabled: "1"},
+		}}
+		provider := &unboundProvider{api: fake}
+		WithSoftDelete(time.Hour)(provider)
+		WithOwnerID("cluster-a")(provider)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10")},
+		})
+		require.NoError(t, err)
+
+		nas := fake.HostOverrides[0]
+		require.Regexp(t, `^NAS \[external-dns deleted \S+ by cluster-a\]$`, nas.Description)
+		require.True(t, overrideSoftDeleted(nas))
+		require.Equal(t, "NAS", untagSoftDeleted(nas.Description))
+	})
+}
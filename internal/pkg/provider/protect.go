@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// WithMinRecordAgeForDelete makes ApplyChanges stamp the records it creates with the time they were created at,
+// at the end of their description, and skip deleting stamped records created less than minAge ago, such as those
+// of flapping sources, sparing Unbound a reconfigure for each flap. external-dns plans skipped deletes again
+// on its next sync, and they are made once the record is old enough. Records without a stamp are deleted as usual.
+func WithMinRecordAgeForDelete(minAge time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.minDeleteAge = minAge
+	}
+}
+
+// createdTag prefixes the time a record was created at, at the end of its description, before any seen stamp.
+const createdTag = "[external-dns created "
+
+// stampCreated returns description stamped as created at the given time, instead of any previous time.
+// Any seen stamp goes too, as it follows the created stamp.
+func stampCreated(description string, at time.Time) string {
+	stamp := createdTag + at.UTC().Format(time.RFC3339) + "]"
+	if description = unstampCreated(unstampSeen(description)); description == "" {
+		return stamp
+	}
+	return description + " " + stamp
+}
+
+// unstampCreated returns description without its created stamp, once any seen stamp is gone.
+func unstampCreated(description string) string {
+	if i := strings.LastIndex(description, createdTag); i >= 0 && strings.HasSuffix(description, "]") {
+		return strings.TrimSuffix(description[:i], " ")
+	}
+	return description
+}
+
+// createdAt returns when a record was created, if its description is stamped.
+func createdAt(description string) (time.Time, bool) {
+	description = unstampSeen(untagSoftDeleted(description))
+	i := strings.LastIndex(description, createdTag)
+	if i < 0 || !strings.HasSuffix(description, "]") {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(time.RFC3339, description[i+len(createdTag):len(description)-1])
+	return at, err == nil
+}
+
+// bareDescription returns description without any of the stamps and tags the provider adds to it.
+func bareDescription(description string) string {
+	return unstampCreated(unstampSeen(untagSoftDeleted(description)))
+}
+
+// stampCreated stamps description with the time of the apply, if deletes of records too young are skipped.
+func (s *applyState) stampCreated(description string) string {
+	if s.createdAt.IsZero() {
+		return description
+	}
+	return stampCreated(description, s.createdAt)
+}
+
+// keepCreated returns the description after an update with the created stamp of the one before, if the update
+// replaced the description.
+func keepCreated(before, after string) string {
+	at, ok := createdAt(before)
+	if !ok {
+		return after
+	}
+	if _, ok := createdAt(after); ok {
+		return after
+	}
+	return stampCreated(after, at)
+}
+
+// skipYoungDeletes returns changes without the deletions of records created less than the minimum age ago,
+// as of the last listing, logging and counting each of them.
+func (p *unboundProvider) skipYoungDeletes(changes *plan.Changes) *plan.Changes {
+	listed := p.listed.Load()
+	if len(changes.Delete) == 0 || listed == nil {
+		return changes
+	}
+
+	now := p.now()
+	skipped := *changes
+	skipped.Delete = nil
+	for _, ep := range changes.Delete {
+		at, ok := recordCreatedAt(listed, ep)
+		if !ok || now.Sub(at) >= p.minDeleteAge {
+			skipped.Delete = append(skipped.Delete, ep)
+			continue
+		}
+		p.log().Warn("not deleting record created less than the minimum age ago",
+			slog.Any("endpoint", ep), slog.Time("createdAt", at), slog.Duration("minAge", p.minDeleteAge))
+		metrics.For(p.webhook).YoungDeletes.WithLabelValues(ep.RecordType).Inc()
+	}
+	return &skipped
+}
+
+// recordCreatedAt returns when the record of ep in st was created, if it is stamped.
+func recordCreatedAt(st *state.State, ep *endpoint.Endpoint) (time.Time, bool) {
+	switch ep.RecordType {
+	case endpoint.RecordTypeA:
+		if ho, ok := st.HostOverride(ep.DNSName); ok {
+			return createdAt(ho.Description)
+		}
+	case endpoint.RecordTypeCNAME:
+		if ha, ok := st.HostAlias(ep.DNSName); ok {
+			return createdAt(ha.Description)
+		}
+	}
+	return time.Time{}, false
+}
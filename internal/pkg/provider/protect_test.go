@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestMinRecordAgeForDelete(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	protecting := func(fake *unboundtest.Fake) *unboundProvider {
+		provider := &unboundProvider{api: fake, clock: func() time.Time { return now }}
+		WithMinRecordAgeForDelete(time.Minute)(provider)
+		return provider
+	}
+
+	list := func(t *testing.T, provider *unboundProvider) []*endpoint.Endpoint {
+		t.Helper()
+		records, err := provider.Records(WithFreshRecords(context.Background()))
+		require.NoError(t, err)
+		return records
+	}
+
+	deleteChanges := func(name string) *plan.Changes {
+		return &plan.Changes{Delete: []*endpoint.Endpoint{endpoint.NewEndpoint(name, endpoint.RecordTypeA, "127.0.0.1")}}
+	}
+
+	t.Run("stamps records created, hiding the stamp from external-dns", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := protecting(fake)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1").
+				WithProviderSpecific(unbound.DescriptionProperty, "app"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+		}}))
+		require.Equal(t, "app [external-dns created 2024-05-01T12:00:00Z]", fake.HostOverrides[0].Description)
+		require.Equal(t, "[external-dns created 2024-05-01T12:00:00Z]", fake.HostAliases[0].Description)
+
+		for _, e := range list(t, provider) {
+			description, ok := e.GetProviderSpecificProperty(unbound.DescriptionProperty)
+			require.Equal(t, e.DNSName == "a.example.com", ok, e.DNSName)
+			require.NotContains(t, description, createdTag, e.DNSName)
+		}
+	})
+
+	t.Run("skips deleting records younger than the minimum age", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := protecting(fake)
+		skipped := testutil.ToFloat64(metrics.Default.YoungDeletes.WithLabelValues("A"))
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		now = now.Add(time.Minute - time.Second)
+		defer func() { now = now.Add(-time.Minute + time.Second) }()
+		list(t, provider)
+
+		logs := recordLogs(t)
+		require.NoError(t, provider.ApplyChanges(context.Background(), deleteChanges("a.example.com")))
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, skipped+1, testutil.ToFloat64(metrics.Default.YoungDeletes.WithLabelValues("A")))
+		_, attrs, ok := logs.find("not deleting record created less than the minimum age ago")
+		require.True(t, ok)
+		require.Equal(t, time.Minute, attrs["minAge"].Duration())
+	})
+
+	t.Run("deletes records as old as the minimum age", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := protecting(fake)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		now = now.Add(time.Minute)
+		defer func() { now = now.Add(-time.Minute) }()
+		list(t, provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), deleteChanges("a.example.com")))
+		require.Empty(t, fake.HostOverrides)
+	})
+
+	t.Run("deletes records without a stamp", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Description: "by hand", Enabled: "1"},
+		}}
+		provider := protecting(fake)
+		list(t, provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), deleteChanges("a.example.com")))
+		require.Empty(t, fake.HostOverrides)
+	})
+
+	t.Run("keeps the stamp through updates", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := protecting(fake)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		now = now.Add(time.Second)
+		defer func() { now = now.Add(-time.Second) }()
+		require.NoError(t, provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1").
+				WithProviderSpecific(unbound.DescriptionProperty, "app")},
+		}))
+		require.Equal(t, "app [external-dns created 2024-05-01T12:00:00Z]", fake.HostOverrides[0].Description)
+	})
+}
+
+func TestCreatedStamp(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	created := stampCreated("NAS", at)
+
+	require.Equal(t, "NAS [external-dns created 2024-05-01T10:00:00Z]", created)
+	require.Equal(t, created, stampCreated(stampSeen(stampCreated("NAS", at.Add(-time.Hour)), at), at))
+	require.Equal(t, "NAS", bareDescription(tagSoftDeleted(stampSeen(created, at), at, "")))
+	require.Equal(t, created, keepCreated(created, created))
+	require.Equal(t, "app [external-dns created 2024-05-01T10:00:00Z]", keepCreated(stampSeen(created, at), "app"))
+	require.Equal(t, "app", keepCreated("NAS", "app"))
+
+	stamped, ok := createdAt(stampSeen(created, at.Add(time.Hour)))
+	require.True(t, ok)
+	require.True(t, at.Equal(stamped))
+	_, ok = createdAt("NAS")
+	require.False(t, ok)
+	_, ok = createdAt("NAS [external-dns created yesterday]")
+	require.False(t, ok)
+}
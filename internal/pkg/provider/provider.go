@@ -3,11 +3,22 @@ package provider
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-
-	"github.com/v-yarotksy/external-dns-opnsense-unbound-webhook-provider/internal/pkg/api"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 	"sigs.k8s.io/external-dns/provider"
@@ -15,13 +26,301 @@ import (
 
 type Option func(*unboundProvider)
 
+// userAgent identifies the provider's requests in the OPNsense logs.
+const userAgent = "external-dns-opnsense-unbound-webhook-provider"
+
+// recentValidationWarnings is how many of the last validation warnings of OPNsense Status holds.
+const recentValidationWarnings = 10
+
+// WithAPIOptions configures the OPNsense API clients with opts, on top of what the other options set up.
+func WithAPIOptions(opts ...unbound.Option) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, opts...)
+	}
+}
+
 // OPNSense runs with self-signed cert
 func WithInsecureClient() Option {
 	return func(p *unboundProvider) {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		p.tlsConfig().InsecureSkipVerify = true
+	}
+}
+
+// WithRootCAs verifies the OPNsense certificate against the CAs in pool instead of the system ones.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(p *unboundProvider) {
+		p.tlsConfig().RootCAs = pool
+	}
+}
+
+// WithTLSServerName verifies the OPNsense certificate against name instead of the base URL host.
+func WithTLSServerName(name string) Option {
+	return func(p *unboundProvider) {
+		if name != "" {
+			p.tlsConfig().ServerName = name
+		}
+	}
+}
+
+// WithTLSPins only accepts OPNsense certificates whose public key matches one of pins, in addition to
+// verifying them against CAs, or instead of it with WithInsecureClient.
+func WithTLSPins(pins []unbound.Pin) Option {
+	return func(p *unboundProvider) {
+		if len(pins) > 0 {
+			p.tlsConfig().VerifyPeerCertificate = unbound.VerifyPins(pins)
 		}
-		p.client.Transport = tr
+	}
+}
+
+// WithTLSMinVersion refuses TLS versions older than version, such as tls.VersionTLS13, when connecting to OPNsense.
+func WithTLSMinVersion(version uint16) Option {
+	return func(p *unboundProvider) {
+		if version != 0 {
+			p.tlsConfig().MinVersion = version
+		}
+	}
+}
+
+// ParseTLSVersion parses a TLS version as -tls-min-version takes it: 1.2 or 1.3.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, must be 1.2 or 1.3", s)
+}
+
+// tlsConfig returns the TLS configuration for OPNsense connections, setting it up if needed.
+func (p *unboundProvider) tlsConfig() *tls.Config {
+	if p.tls == nil {
+		p.tls = &tls.Config{}
+	}
+	return p.tls
+}
+
+// WithDebugHTTP logs every OPNsense API exchange at Debug level, with credentials redacted.
+func WithDebugHTTP() Option {
+	return func(p *unboundProvider) {
+		p.debugHTTP = true
+	}
+}
+
+// httpClient returns the client for OPNsense API requests, as set up by the TLS options.
+func (p *unboundProvider) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = p.clientTLSConfig()
+	return &http.Client{Transport: transport}
+}
+
+// clientTLSConfig returns the TLS configuration of OPNsense connections as set up by the TLS options,
+// logging what the first connection negotiated.
+func (p *unboundProvider) clientTLSConfig() *tls.Config {
+	config := p.tlsConfig().Clone()
+	var once sync.Once
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		once.Do(func() {
+			p.log().Debug("negotiated TLS with OPNsense",
+				slog.String("version", tls.VersionName(cs.Version)),
+				slog.String("cipherSuite", tls.CipherSuiteName(cs.CipherSuite)),
+			)
+		})
+		return nil
+	}
+	return config
+}
+
+// WithLogger logs with l instead of slog.Default(), for the provider and its OPNsense API clients alike.
+// Records carry component=provider or component=api.
+func WithLogger(l *slog.Logger) Option {
+	return func(p *unboundProvider) {
+		if l != nil {
+			p.logger = l
+		}
+	}
+}
+
+// log returns the provider's logger, or slog.Default() for providers not made by NewUnboundProvider.
+func (p *unboundProvider) log() *slog.Logger {
+	if p.logger == nil {
+		return slog.Default()
+	}
+	return p.logger
+}
+
+// WithWebhookName reports the metrics of the provider and its OPNsense API clients as those of the webhook
+// named, for processes serving several webhooks. They are metrics.Default otherwise.
+func WithWebhookName(name string) Option {
+	return func(p *unboundProvider) {
+		p.webhook = name
+	}
+}
+
+// WithReconfigureDebounce coalesces Unbound reconfigures requested within d of each other.
+// By default Unbound is reconfigured at the end of every ApplyChanges.
+func WithReconfigureDebounce(d time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.reconfigureDebounce = d
+	}
+}
+
+// WithReconfigureFailureThreshold sets how many consecutive reconfigure failures make the provider not ready.
+func WithReconfigureFailureThreshold(n int) Option {
+	return func(p *unboundProvider) {
+		p.reconfigureFailureThreshold = n
+	}
+}
+
+// WithCacheTTL serves Records from memory for up to ttl after a listing. ApplyChanges invalidates the cache.
+// Out-of-band changes made in the OPNsense UI are picked up once the TTL expires. 0 disables caching.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(p *unboundProvider) {
+		if ttl > 0 {
+			p.cache = &recordsCache{ttl: ttl}
+		}
+	}
+}
+
+// WithServeStale makes Records return the last successful listing, if it is younger than maxAge,
+// when listing fails because OPNsense is unavailable. ApplyChanges still fails. 0 disables serving stale records.
+func WithServeStale(maxAge time.Duration) Option {
+	return func(p *unboundProvider) {
+		if maxAge > 0 {
+			p.last = &lastListing{maxAge: maxAge}
+		}
+	}
+}
+
+// WithListConcurrency sets how many host alias listings may be in flight at once. Defaults to 5.
+func WithListConcurrency(n int) Option {
+	return func(p *unboundProvider) {
+		p.listConcurrency = n
+	}
+}
+
+// WithSettingsListing lists records with a single read of the Unbound settings instead of a search for
+// overrides and one for the aliases of each. Listing falls back to searches for good once OPNsense
+// doesn't serve the settings as expected.
+func WithSettingsListing() Option {
+	return func(p *unboundProvider) {
+		p.settingsListing = true
+	}
+}
+
+// WithDisableDeletes makes ApplyChanges skip every deletion external-dns plans, including that of the old record
+// when a record changes type, while still making creates and updates. Skipped deletions are logged and counted.
+func WithDisableDeletes() Option {
+	return func(p *unboundProvider) {
+		p.disableDeletes = true
+	}
+}
+
+// WithSnapshotReuse lets ApplyChanges reuse the listing made by the preceding Records call
+// when it is younger than maxAge, instead of listing everything again. 0 disables reuse.
+func WithSnapshotReuse(maxAge time.Duration) Option {
+	return func(p *unboundProvider) {
+		if maxAge > 0 {
+			p.snapshots = &snapshotStore{maxAge: maxAge}
+		}
+	}
+}
+
+// WithApplyConcurrency sets how many independent changes ApplyChanges may make at once. Defaults to 1.
+func WithApplyConcurrency(n int) Option {
+	return func(p *unboundProvider) {
+		p.applyConcurrency = n
+	}
+}
+
+// WithMaxResponseSize limits the size of OPNsense API responses. Defaults to unbound.DefaultMaxResponseSize.
+func WithMaxResponseSize(n int64) Option {
+	return func(p *unboundProvider) {
+		if n > 0 {
+			p.apiOptions = append(p.apiOptions, unbound.WithMaxResponseSize(n))
+		}
+	}
+}
+
+// WithRetry retries failed OPNsense API calls, see unbound.WithRetry.
+func WithRetry(maxAttempts int, baseDelay, maxDelay time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, unbound.WithRetry(maxAttempts, baseDelay, maxDelay))
+	}
+}
+
+// WithLockMessages retries changes OPNsense refuses with one of messages, see unbound.WithLockMessages.
+func WithLockMessages(messages []string) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, unbound.WithLockMessages(messages...))
+	}
+}
+
+// WithMaxInflight caps the number of concurrent OPNsense API requests, see unbound.WithMaxInflight. 0 means no limit.
+func WithMaxInflight(n int) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, unbound.WithMaxInflight(n))
+	}
+}
+
+// WithPerCallTimeout bounds every OPNsense API call to d, see unbound.WithPerCallTimeout. 0 disables the timeout.
+func WithPerCallTimeout(d time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, unbound.WithPerCallTimeout(d))
+	}
+}
+
+// WithSlowCallThreshold logs a warning for OPNsense API calls slower than d, see unbound.WithSlowCallThreshold.
+// 0 disables.
+func WithSlowCallThreshold(d time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.apiOptions = append(p.apiOptions, unbound.WithSlowCallThreshold(d))
+	}
+}
+
+// WithCircuitBreaker fails OPNsense API calls fast for cooldown after threshold consecutive failures,
+// see unbound.CircuitBreaker. Records and ApplyChanges then return soft errors. 0 disables the breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(p *unboundProvider) {
+		if threshold > 0 {
+			p.breaker = unbound.NewCircuitBreaker(threshold, cooldown)
+		}
+	}
+}
+
+// WithFallback lists records from a standby OPNsense when listing from the primary fails with a transient error.
+// Such listings are neither cached nor reused by ApplyChanges. Changes are only applied to the standby
+// with WithFallbackWrites.
+func WithFallback(baseURL, apiKey, apiSecret string) Option {
+	return func(p *unboundProvider) {
+		p.fallbackURL = baseURL
+		p.fallbackAPIKey = apiKey
+		p.fallbackAPISecret = apiSecret
+	}
+}
+
+// WithFallbackWrites makes ApplyChanges apply changes to the standby OPNsense set with WithFallback
+// when listing from the primary fails with a transient error. Only enable it when the standby's
+// configuration is synced back to the primary.
+func WithFallbackWrites() Option {
+	return func(p *unboundProvider) {
+		p.fallbackWrites = true
+	}
+}
+
+// WithJournalFile keeps the journal of operations in flight in the file at path too, so that
+// an apply interrupted by a restart is recovered from by the next one.
+func WithJournalFile(path string) Option {
+	return func(p *unboundProvider) {
+		p.journalPath = path
+	}
+}
+
+// WithBackgroundRefresh makes RunRefresh re-list records every interval. 0 disables background refresh.
+// Once enabled, the provider is not ready when OPNsense hasn't been reached for a few intervals.
+func WithBackgroundRefresh(interval time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.refreshInterval = interval
 	}
 }
 
@@ -32,217 +331,693 @@ func WithDomainFilter(domains []string) Option {
 }
 
 func NewUnboundProvider(baseURL, apiKey, apiSecret string, opts ...Option) (*unboundProvider, error) {
-	client := http.DefaultClient
+	provider := newUnboundProvider(opts)
+	apiOptions := provider.clientOptions()
+
+	// The breaker only guards the primary, so that it doesn't keep the fallback from being tried
+	primaryOptions := apiOptions
+	if provider.breaker != nil {
+		primaryOptions = append(primaryOptions[:len(primaryOptions):len(primaryOptions)], unbound.WithCircuitBreaker(provider.breaker))
+	}
+	if provider.credentials != nil {
+		primaryOptions = append(primaryOptions[:len(primaryOptions):len(primaryOptions)], unbound.WithCredentials(provider.credentials.Credentials))
+	}
 
-	api, err := api.NewUnboundClient(baseURL, apiKey, apiSecret, client)
+	primary, err := unbound.New(baseURL, apiKey, apiSecret, primaryOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make unbound API client: %w", err)
 	}
+	if provider.verifier != nil || provider.canary != nil {
+		resolver, err := unboundResolver(baseURL, provider.dnsPort)
+		if err != nil {
+			return nil, err
+		}
+		if provider.verifier != nil {
+			provider.verifier.resolver = resolver
+		}
+		if provider.canary != nil {
+			provider.canary.resolver = resolver
+		}
+	}
+
+	if err := provider.assemble(primary, apiOptions); err != nil {
+		return nil, err
+	}
+	provider.setupNotifier(apiKey, apiSecret)
+	return provider, nil
+}
+
+// NewUnboundProviderWithAPI makes a provider on top of a, such as a client wrapped with caching or a fake,
+// instead of a client it makes itself. Options for the OPNsense API clients, such as WithRetry,
+// WithCircuitBreaker or the TLS ones, only apply to the fallback client made for WithFallback.
+func NewUnboundProviderWithAPI(a unbound.API, opts ...Option) (*unboundProvider, error) {
+	if a == nil {
+		return nil, errors.New("no unbound API given")
+	}
+
+	provider := newUnboundProvider(opts)
+	apiOptions := provider.clientOptions()
+
+	// The breaker would only be reported on, as a doesn't go through it
+	provider.breaker = nil
+
+	if err := provider.assemble(a, apiOptions); err != nil {
+		return nil, err
+	}
+	provider.setupNotifier("", "")
+	return provider, nil
+}
 
-	provider := &unboundProvider{api: api, client: client}
+// newUnboundProvider makes a provider configured by opts, yet to be assembled.
+func newUnboundProvider(opts []Option) *unboundProvider {
+	provider := &unboundProvider{
+		logger:                      slog.Default(),
+		reconfigureFailureThreshold: defaultReconfigureFailureThreshold,
+		dnsPort:                     53,
+		warnings:                    unbound.NewValidationWarnings(recentValidationWarnings),
+		minOperationTimeout:         defaultMinOperationTimeout,
+	}
 
 	for _, opt := range opts {
 		opt(provider)
 	}
+	return provider
+}
 
-	return provider, nil
+// clientOptions returns the options for the OPNsense API clients the provider makes, as set up by its options.
+func (p *unboundProvider) clientOptions() []unbound.Option {
+	// The provider's options come first, so that client options given with WithAPIOptions override them
+	apiOptions := []unbound.Option{
+		unbound.WithHTTPClient(p.httpClient()),
+		unbound.WithUserAgent(p.agent()),
+		unbound.WithLogger(withOwnerID(p.log(), p.ownerID)),
+		unbound.WithValidationWarnings(p.warnings),
+		unbound.WithWebhookName(p.webhook),
+	}
+	if p.debugHTTP {
+		apiOptions = append(apiOptions, unbound.WithDebugHTTP())
+	}
+	return append(apiOptions, p.apiOptions...)
+}
+
+// assemble sets the provider up on top of primary: its journal, its reconfigurer, the metrics of its parts,
+// and the fallback client, made with apiOptions.
+func (p *unboundProvider) assemble(primary unbound.API, apiOptions []unbound.Option) error {
+	p.logger = withOwnerID(p.log(), p.ownerID).With(slog.String("component", "provider"))
+
+	if err := p.setupCanary(); err != nil {
+		return err
+	}
+	if p.readOnly != "" {
+		p.logger.Warn("read-only mode, changes are not applied", slog.String("response", string(p.readOnly)))
+	}
+
+	p.journal = newJournal(p.logger)
+	if p.journalPath != "" {
+		journal, err := openJournal(p.journalPath, p.logger)
+		if err != nil {
+			return err
+		}
+		p.journal = journal
+	}
+
+	if p.drift != nil {
+		if err := p.drift.load(); err != nil {
+			return err
+		}
+	}
+
+	p.api = primary
+	p.reconfigurer = newReconfigurer(primary, p.reconfigureDebounce, p.reconfigureFailureThreshold, p.logger)
+	p.reportMetrics()
+
+	if p.fallbackURL != "" {
+		if p.credentials != nil && p.fallbackAPIKey == "" {
+			apiOptions = append(apiOptions[:len(apiOptions):len(apiOptions)], unbound.WithCredentials(p.credentials.Credentials))
+		}
+		fallback, err := unbound.New(p.fallbackURL, p.fallbackAPIKey, p.fallbackAPISecret, apiOptions...)
+		if err != nil {
+			return fmt.Errorf("failed to make fallback unbound API client: %w", err)
+		}
+		p.fallback = fallback
+	}
+
+	return nil
+}
+
+// reportMetrics has the parts of the provider report their metrics to the set of its webhook.
+func (p *unboundProvider) reportMetrics() {
+	p.reconfigurer.webhook = p.webhook
+	p.applyHealth.webhook = p.webhook
+	p.aliases.webhook = p.webhook
+	p.status.webhook = p.webhook
+	if p.cache != nil {
+		p.cache.webhook = p.webhook
+	}
+	if p.drift != nil {
+		p.drift.webhook = p.webhook
+	}
+	if p.notifier != nil {
+		p.notifier.webhook = p.webhook
+	}
 }
 
 type unboundProvider struct {
-	api     api.API
-	client  *http.Client
-	domains []string
+	api        unbound.API
+	apiOptions []unbound.Option
+	breaker    *unbound.CircuitBreaker
+	warnings   *unbound.ValidationWarnings
+	tls        *tls.Config
+	debugHTTP  bool
+	logger     *slog.Logger
+	domains    []string
+	ownerID    string
+
+	// webhook names the set of metrics the provider and its parts report to, metrics.Default if empty
+	webhook string
+
+	credentials *Credentials
+
+	fallback          unbound.API
+	fallbackURL       string
+	fallbackAPIKey    string
+	fallbackAPISecret string
+	fallbackWrites    bool
+
+	reconfigurer                *reconfigurer
+	reconfigureDebounce         time.Duration
+	reconfigureFailureThreshold int
+
+	applyHealth applyHealth
+
+	verifier           *verifier
+	strictVerification bool
+	dnsPort            int
+	canary             *canary
+	drift              *driftDetector
+
+	listConcurrency  int
+	maxRecords       int
+	applyConcurrency int
+	bulkThreshold    int
+	refreshInterval  time.Duration
+	disableDeletes   bool
+	renameStrategy   RenameStrategy
+	fixDangling      bool
+	readOnly         ReadOnlyResponse
+	allowedTargets   []netip.Prefix
+	targetRewrites   []TargetRewrite
+	resolver         *targetResolver
+	excluded         []*regexp.Regexp
+	softDelete       bool
+	softDeleteGrace  time.Duration
+	notifier         *notifier
+	backupWriter     *backupWriter
+
+	applyMu sync.Mutex
+
+	applyTimeout        time.Duration
+	minOperationTimeout time.Duration
+	maxOperationTimeout time.Duration
+
+	gcMaxAge time.Duration
+	desired  desiredRecords
+	clock    func() time.Time
+
+	// minDeleteAge is how old stamped records must be for ApplyChanges to delete them
+	minDeleteAge time.Duration
+
+	// seeds are the normalized DNS names of the records given to Seed
+	seedMu sync.RWMutex
+	seeds  map[string]bool
+
+	settingsListing            bool
+	settingsListingUnsupported atomic.Bool
+
+	journal     *journal
+	journalPath string
+
+	aliases aliasSupport
+
+	waitingForStartup atomic.Bool
+
+	// listed is the state of the last listing, for AdjustEndpoints
+	listed atomic.Pointer[state.State]
+
+	status    statusTracker
+	cache     *recordsCache
+	last      *lastListing
+	snapshots *snapshotStore
 }
 
-func (p *unboundProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
-	res, err := p.api.ListHostOverrides(ctx)
-	if err != nil {
-		slog.Error("failed to list A records", slog.Any("error", err))
-		return nil, err
+// Ready returns an error when records are known not to be served as planned.
+func (p *unboundProvider) Ready() error {
+	if err := p.startupReady(); err != nil {
+		return err
+	}
+	if p.reconfigurer != nil {
+		if err := p.reconfigurer.Ready(); err != nil {
+			return err
+		}
+	}
+	if err := p.applyHealth.Ready(); err != nil {
+		return err
 	}
-	result := make([]*endpoint.Endpoint, 0, len(res))
-	for _, r := range res {
-		result = append(result, r.Endpoint())
+	return p.refreshReady()
+}
 
-		cnameRes, err := p.api.ListHostAliases(ctx, r.ID)
-		if err != nil {
-			slog.Error("failed to list CNAME records", slog.Any("hostOverride", r), slog.Any("error", err))
-			return nil, err
+func (p *unboundProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	start := time.Now()
+
+	var generation uint64
+	if p.cache != nil {
+		var cached []*endpoint.Endpoint
+		var ok bool
+		cached, generation, ok = p.cache.get(start, wantsFreshRecords(ctx))
+		if ok {
+			p.log().Debug("listed records from cache", slog.Int("total", len(cached)))
+			return cached, nil
 		}
+	}
 
-		for _, cr := range cnameRes {
-			result = append(result, cr.Endpoint())
+	result, fromFallback, err := p.records(ctx)
+	p.status.recordsDone(start, len(result), err)
+	if err != nil {
+		p.refreshCredentials(ctx, err)
+		p.recheckPrivileges(ctx, err)
+		if stale, ok := p.staleRecords(ctx, err); ok {
+			return stale, nil
 		}
+		return nil, soften(err)
+	}
+
+	// The primary is expected back soon, and its records are the ones changes are planned against
+	if p.cache != nil && !fromFallback {
+		p.cache.put(time.Now(), generation, result)
+	}
+	if p.last != nil && !fromFallback {
+		p.last.put(time.Now(), result)
 	}
 
-	slog.Info("list records", slog.Any("result", result))
+	records := metrics.For(p.webhook).Records
+	records.Reset()
+	for recordType, n := range countByType(result) {
+		records.WithLabelValues(recordType).Set(float64(n))
+	}
+
+	p.log().Info("listed records",
+		slog.Int("total", len(result)),
+		countsByType(result),
+		slog.Bool("fromFallback", fromFallback),
+		slog.Duration("duration", time.Since(start)),
+	)
+	p.log().Debug("list records", slog.Any("result", result))
 
 	return result, nil
 }
 
+// staleRecords returns the last successful listing in place of one that failed because OPNsense is unavailable.
+// Callers asking for fresh records, such as the background refresh, get the failure instead.
+func (p *unboundProvider) staleRecords(ctx context.Context, err error) ([]*endpoint.Endpoint, bool) {
+	if p.last == nil || wantsFreshRecords(ctx) || !unbound.IsTransient(err) {
+		return nil, false
+	}
+
+	stale, age, ok := p.last.get(time.Now())
+	if !ok {
+		p.log().Warn("last listing too old to serve while OPNsense is unavailable",
+			slog.Duration("age", age.Round(time.Second)), slog.Duration("maxAge", p.last.maxAge))
+		return nil, false
+	}
+
+	metrics.For(p.webhook).StaleListings.Inc()
+	p.log().Warn("OPNsense unavailable, serving stale records from the last listing",
+		slog.Int("total", len(stale)),
+		slog.Duration("age", age.Round(time.Second)),
+		slog.Any("error", err),
+	)
+	return stale, true
+}
+
+// records lists records from the primary, or from the fallback if the primary is unavailable.
+func (p *unboundProvider) records(ctx context.Context) ([]*endpoint.Endpoint, bool, error) {
+	var generation uint64
+	if p.snapshots != nil {
+		generation = p.snapshots.currentGeneration()
+	}
+
+	snap, fromFallback, err := p.listSnapshotWithFallback(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	// Nothing is planned against a listing too large, nor kept of it
+	if err := p.checkMaxRecords(snap.state); err != nil {
+		return nil, false, err
+	}
+	p.listed.Store(snap.state)
+
+	// A fallback listing is never reused, so that the first apply after the primary recovers lists it afresh
+	if p.snapshots != nil && !fromFallback {
+		p.snapshots.put(generation, snap)
+	}
+
+	if p.softDelete && p.softDeleteGrace > 0 && !p.disableDeletes && p.readOnly == "" && !fromFallback {
+		p.pruneSoftDeleted(ctx, snap.state)
+	}
+	if p.drift != nil && !fromFallback {
+		p.drift.check(snap.state, p.log())
+	}
+
+	endpoints := withoutStamps(withoutSoftDeleted(snap.state, snap.state.Endpoints()))
+	if len(p.excluded) > 0 {
+		endpoints = p.withoutExcluded(endpoints)
+	}
+	if p.canary != nil {
+		endpoints = p.withoutCanary(endpoints)
+	}
+	return endpoints, fromFallback, nil
+}
+
+// listSnapshotWithFallback lists from the primary, retrying against the fallback if that fails with a transient error.
+func (p *unboundProvider) listSnapshotWithFallback(ctx context.Context) (*snapshot, bool, error) {
+	snap, err := p.listSnapshot(ctx, p.api)
+	if err == nil || p.fallback == nil || !unbound.IsTransient(err) {
+		return snap, false, err
+	}
+
+	p.log().Warn("primary OPNsense unavailable, listing records from fallback", slog.Any("error", err))
+	snap, ferr := p.listSnapshot(ctx, p.fallback)
+	if ferr != nil {
+		metrics.For(p.webhook).FallbackListings.WithLabelValues("failure").Inc()
+		return nil, false, fmt.Errorf("fallback failed: %w (primary: %w)", ferr, err)
+	}
+
+	metrics.For(p.webhook).FallbackListings.WithLabelValues("success").Inc()
+	snap.fromFallback = true
+	return snap, true, nil
+}
+
 func (p *unboundProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	changes = sortChangedTargets(pairUpdates(changes, p.log()))
+	if len(p.excluded) > 0 {
+		changes = p.refuseExcluded(changes)
+	}
+	deletes := changes.Delete
+	if p.disableDeletes {
+		changes = p.skipDeletes(changes)
+	}
+	if p.minDeleteAge > 0 {
+		changes = p.skipYoungDeletes(changes)
+	}
+	p.notifySkippedDeletes(deletes, changes.Delete)
+	if p.hasSeeds() {
+		changes = p.refuseSeeded(changes)
+	}
+	return p.applyAll(ctx, changes)
+}
+
+// applyAll applies changes as they are, updating the status and reconfiguring Unbound.
+// Applies are serialized, as seeding may apply changes alongside external-dns.
+func (p *unboundProvider) applyAll(ctx context.Context, changes *plan.Changes) error {
 	if !changes.HasChanges() {
-		slog.Debug("No changes")
+		p.log().Debug("No changes")
 		return nil
 	}
+	if p.readOnly != "" {
+		return p.refuseReadOnly(changes)
+	}
 
-	hostOverrides, err := p.api.ListHostOverrides(ctx)
-	if err != nil {
-		slog.Error("failed to list A records", slog.Any("error", err))
-		return fmt.Errorf("failed to list A records: %w", err)
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+
+	if p.applyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.applyTimeout)
+		defer cancel()
 	}
 
-	aRecordsByDNSName := make(map[string]api.HostOverride, len(hostOverrides))
-	for _, ho := range hostOverrides {
-		aRecordsByDNSName[ho.DNSName()] = ho
+	start := time.Now()
+	stats := applyStats{}
+	calls := &unbound.CallDurations{}
+	ctx = unbound.WithCallDurations(ctx, calls)
+
+	target, err := p.applyChanges(ctx, changes, stats)
+
+	// Whatever was applied, even partially, makes the cached records and listing stale
+	if p.cache != nil {
+		p.cache.invalidate("apply")
+	}
+	if p.snapshots != nil {
+		p.snapshots.invalidate()
 	}
 
-	cnameRecordsByDNSName := make(map[string]api.HostAlias, 100)
-	for _, ho := range hostOverrides {
-		res, err := p.api.ListHostAliases(ctx, ho.ID)
-		if err != nil {
-			slog.Error("failed to list CNAME records", slog.Any("hostOverride", ho), slog.Any("error", err))
-			return err
+	// Even a partially applied plan has saved changes that Unbound needs to pick up,
+	// interrupted applies included, or they would only go live with the next changes
+	var interrupted slog.Attr
+	rctx := ctx
+	if err != nil && ctx.Err() != nil {
+		interrupted = slog.Group("interrupted", slog.Int("applied", stats.total()), slog.Int("planned", countChanges(changes)))
+		rctx = context.WithoutCancel(ctx)
+	}
+	if len(stats) > 0 && target == p.fallback {
+		if rerr := p.fallback.Reconfigure(rctx); rerr != nil && err == nil {
+			err = rerr
 		}
-		for _, ha := range res {
-			cnameRecordsByDNSName[ha.DNSName()] = ha
+	} else if len(stats) > 0 && p.reconfigurer != nil {
+		if rerr := p.reconfigurer.Request(rctx); rerr != nil && err == nil {
+			err = rerr
 		}
 	}
 
-	for _, ep := range changes.Delete {
-		logger := slog.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+	// The verifier queries the primary, and records of a failed apply may well not resolve
+	var verified slog.Attr
+	if p.verifier != nil && p.verifier.resolver != nil && err == nil && target != p.fallback {
+		verified, err = p.verifyApplied(ctx, changes)
+	}
 
-		switch ep.RecordType {
-		case endpoint.RecordTypeA:
-			if ho, ok := aRecordsByDNSName[ep.DNSName]; ok {
-				if err := p.api.DeleteHostOverride(ctx, ho); err != nil {
-					logger.Error("failed to delete host override", slog.Any("hostOverride", ho))
-					return fmt.Errorf("failed to delete host override: %w", err)
-				} else {
-					logger.Info("deleted Host Override", slog.Any("hostOverride", ho))
-					delete(aRecordsByDNSName, ep.DNSName)
-				}
+	p.log().Info("applied changes",
+		stats.attr("created"),
+		stats.attr("updated"),
+		stats.attr("deleted"),
+		interrupted,
+		verified,
+		callsAttr(calls),
+		slog.Duration("duration", time.Since(start)),
+	)
+
+	p.status.applyDone(start, stats, err)
+	p.applyHealth.done(err, p.log())
+	p.notifyApplied(countChanges(changes), stats, err)
+	if p.backupWriter != nil && err == nil {
+		p.backupWriter.request()
+	}
+	p.refreshCredentials(ctx, err)
+	p.recheckPrivileges(ctx, err)
 
-			} else {
-				logger.Warn("Host Override not found")
-			}
-		case endpoint.RecordTypeCNAME:
-			if ha, ok := cnameRecordsByDNSName[ep.DNSName]; ok {
-				if err := p.api.DeleteHostAlias(ctx, ha); err != nil {
-					logger.Error("failed to delete host alias", slog.Any("hostAlias", ha))
-					return fmt.Errorf("failed to delete host alias: %w", err)
-				} else {
-					logger.Info("deleted Host Alias", slog.Any("hostAlias", ha))
-					delete(cnameRecordsByDNSName, ep.DNSName)
-				}
+	return soften(err)
+}
 
-			} else {
-				logger.Warn("Host Alias not found")
-			}
-		default:
-			logger.Warn("unsupported record type")
-		}
+// callsAttr summarizes the OPNsense API calls of an apply as a log group of their count and duration percentiles.
+func callsAttr(calls *unbound.CallDurations) slog.Attr {
+	if calls.Len() == 0 {
+		return slog.Attr{}
 	}
+	return slog.Group("calls",
+		slog.Int("count", calls.Len()),
+		slog.Duration("p50", calls.Percentile(50)),
+		slog.Duration("p95", calls.Percentile(95)),
+	)
+}
 
-	for _, ep := range changes.Create {
-		logger := slog.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+// soften turns failures caused by OPNsense being unavailable, including the circuit breaker refusing calls,
+// into soft errors, which external-dns only logs instead of treating as fatal: OPNsense being down for a while is expected.
+func soften(err error) error {
+	if errors.Is(err, unbound.ErrUnavailable) {
+		return provider.NewSoftError(err)
+	}
+	return err
+}
 
-		var err error
+// applyStats counts successfully applied operations by operation and record type.
+type applyStats map[string]map[string]int
 
-		switch ep.RecordType {
-		case endpoint.RecordTypeA:
-			ho := api.HostOverride{}
-			ho.Update(ep)
-			if ho, err = p.api.CreateHostOverride(ctx, ho); err != nil {
-				logger.Error("failed to create host override", slog.Any("hostOverride", ho))
-				return fmt.Errorf("failed to create host override: %w", err)
-			} else {
-				logger.Info("created Host Override", slog.Any("hostOverride", ho))
-				aRecordsByDNSName[ho.DNSName()] = ho
-			}
-		case endpoint.RecordTypeCNAME:
-			if ho, ok := aRecordsByDNSName[ep.Targets[0]]; ok {
-				ha := api.HostAlias{HostID: ho.ID}
-				ha.Update(ep)
-				if ha, err = p.api.CreateHostAlias(ctx, ha); err != nil {
-					logger.Error("failed to create host alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
-					return fmt.Errorf("failed to create host alias: %w", err)
-				} else {
-					logger.Info("created Host Alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
-					cnameRecordsByDNSName[ha.DNSName()] = ha
-				}
-			} else {
-				logger.Warn("Target Host Override not found for Host Alias")
-				return fmt.Errorf("failed to create host alias: target host override not found")
-			}
-		default:
-			logger.Warn("unsupported record type")
+func (s applyStats) add(op, recordType string) {
+	if s[op] == nil {
+		s[op] = map[string]int{}
+	}
+	s[op][recordType]++
+}
+
+func (s applyStats) attr(op string) slog.Attr {
+	return countsAttr(op, s[op])
+}
+
+func (s applyStats) count(op string) int {
+	n := 0
+	for _, c := range s[op] {
+		n += c
+	}
+	return n
+}
+
+func (s applyStats) total() int {
+	n := 0
+	for _, counts := range s {
+		for _, c := range counts {
+			n += c
 		}
 	}
+	return n
+}
+
+// countChanges returns how many records changes change.
+func countChanges(changes *plan.Changes) int {
+	return len(changes.Create) + len(changes.UpdateNew) + len(changes.Delete)
+}
+
+// countsByType summarizes endpoints as a log group of per record type counts.
+func countsByType(endpoints []*endpoint.Endpoint) slog.Attr {
+	return countsAttr("counts", countByType(endpoints))
+}
+
+func countByType(endpoints []*endpoint.Endpoint) map[string]int {
+	counts := make(map[string]int)
+	for _, ep := range endpoints {
+		counts[ep.RecordType]++
+	}
+	return counts
+}
+
+func countsAttr(key string, counts map[string]int) slog.Attr {
+	recordTypes := make([]string, 0, len(counts))
+	for recordType := range counts {
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+
+	attrs := make([]any, 0, len(recordTypes))
+	for _, recordType := range recordTypes {
+		attrs = append(attrs, slog.Int(recordType, counts[recordType]))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// Kinds of adjustments made by AdjustEndpoints.
+const (
+	adjustTruncateTargets  = "truncate_targets"
+	adjustClearTTL         = "clear_ttl"
+	adjustStripTrailingDot = "strip_trailing_dot"
+	adjustLowercase        = "lowercase"
+	adjustDropUnsupported  = "drop_unsupported"
+	adjustDropTarget       = "drop_disallowed_target"
+	adjustDropEndpoint     = "drop_disallowed_endpoint"
+	adjustRewriteTarget    = "rewrite_target"
+	adjustResolveTarget    = "resolve_target"
+	adjustDropUnresolved   = "drop_unresolved"
+	adjustDropExcluded     = "drop_excluded"
+)
+
+func (u *unboundProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	endpoints, err := u.adjustEndpoints(endpoints)
+	if err == nil && u.gcMaxAge > 0 {
+		// external-dns passes every record it desires, which garbage collection keeps
+		u.desired.set(endpoints)
+	}
+	return endpoints, err
+}
+
+// adjustEndpoints adjusts endpoints as AdjustEndpoints does, without taking them for the records external-dns desires.
+func (u *unboundProvider) adjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	if !u.aliases.available() {
+		endpoints = u.dropCNAMEs(endpoints)
+	}
+	if len(u.excluded) > 0 {
+		endpoints = u.dropExcluded(endpoints)
+	}
+	if u.resolver != nil {
+		endpoints = u.resolveTargets(endpoints)
+	}
+	if len(u.targetRewrites) > 0 {
+		u.rewriteTargets(endpoints)
+	}
+	if len(u.allowedTargets) > 0 {
+		endpoints = u.dropDisallowedTargets(endpoints)
+	}
+
+	listed := u.listed.Load()
+	for _, e := range endpoints {
+		if dnsName := strings.TrimSuffix(e.DNSName, "."); dnsName != e.DNSName {
+			u.recordAdjustment(e, adjustStripTrailingDot, e.DNSName, dnsName)
+			e.DNSName = dnsName
+		}
 
-	// Record type changes are handled for us via delete/create
-	for i, oldEP := range changes.UpdateOld {
-		newEP := changes.UpdateNew[i]
+		if dnsName := strings.ToLower(e.DNSName); dnsName != e.DNSName {
+			u.recordAdjustment(e, adjustLowercase, e.DNSName, dnsName)
+			e.DNSName = dnsName
+		}
 
-		logger := slog.With(slog.String("op", "update"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+		// Neither Host Overrides nor Host Aliases carry a TTL
+		if e.RecordTTL != 0 {
+			u.recordAdjustment(e, adjustClearTTL, e.RecordTTL, endpoint.TTL(0))
+			e.RecordTTL = 0
+		}
 
-		switch oldEP.RecordType {
+		switch e.RecordType {
 		case endpoint.RecordTypeA:
-			if ho, ok := aRecordsByDNSName[oldEP.DNSName]; ok {
-				ho.Update(newEP)
-				if err := p.api.UpdateHostOverride(ctx, ho); err != nil {
-					logger.Error("failed to update host override", slog.Any("hostOverride", ho))
-					return fmt.Errorf("failed to update host override: %w", err)
-				} else {
-					logger.Info("updated Host Override", slog.Any("hostOverride", ho))
-					aRecordsByDNSName[ho.DNSName()] = ho
-				}
-			} else {
-				logger.Warn("Host Override not found")
+			// Unbound only supports one IP address per A record
+			sortTargets(e)
+			if len(e.Targets) > 1 {
+				targets := endpoint.NewTargets(e.Targets[0])
+				u.recordAdjustment(e, adjustTruncateTargets, e.Targets, targets)
+				e.Targets = targets
 			}
 		case endpoint.RecordTypeCNAME:
-			if haOld, ok := cnameRecordsByDNSName[oldEP.DNSName]; ok {
-				if ho, ok := aRecordsByDNSName[newEP.Targets[0]]; ok {
-					ha := haOld
-					ha.Update(newEP)
-					ha.HostID = ho.ID
-					if err := p.api.UpdateHostAlias(ctx, ha); err != nil {
-						logger.Error("failed to update host alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
-						return fmt.Errorf("failed to update host alias: %w", err)
-					} else {
-						logger.Info("updated Host Alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
-						cnameRecordsByDNSName[ha.DNSName()] = ha
-					}
-				} else {
-					logger.Warn("Target Host Override not found for Host Alias")
-					return fmt.Errorf("failed to update host alias: target host override not found")
+			for i, target := range e.Targets {
+				if t := strings.TrimSuffix(target, "."); t != target {
+					u.recordAdjustment(e, adjustStripTrailingDot, target, t)
+					target = t
+				}
+				if t := strings.ToLower(target); t != target {
+					u.recordAdjustment(e, adjustLowercase, target, t)
+					target = t
 				}
-			} else {
-				logger.Warn("Host Alias not found")
-				return fmt.Errorf("host alias not found")
+				e.Targets[i] = target
 			}
-		default:
-			logger.Warn("unsupported record type")
+			sortTargets(e)
 		}
-	}
 
-	return nil
+		u.adjustDescription(e, listed)
+	}
+	return endpoints, nil
 }
 
-func (u *unboundProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+// dropCNAMEs leaves CNAME endpoints out, for OPNsense versions without host aliases.
+func (u *unboundProvider) dropCNAMEs(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints))
 	for _, e := range endpoints {
-		if e.RecordType == endpoint.RecordTypeA {
-			// Unbound only supports one IP address per A record
-			e.Targets = endpoint.NewTargets(e.Targets[0])
+		if e.RecordType != endpoint.RecordTypeCNAME {
+			kept = append(kept, e)
+			continue
 		}
+		metrics.For(u.webhook).EndpointAdjustments.WithLabelValues(adjustDropUnsupported).Inc()
+		u.log().Warn("ignoring CNAME record", slog.String("dnsName", e.DNSName), slog.Any("error", errAliasesUnavailable))
 	}
-	return endpoints, nil
+	return kept
+}
+
+func (u *unboundProvider) recordAdjustment(e *endpoint.Endpoint, kind string, before, after any) {
+	metrics.For(u.webhook).EndpointAdjustments.WithLabelValues(kind).Inc()
+	u.log().Debug("adjusted endpoint",
+		slog.String("kind", kind),
+		slog.String("dnsName", e.DNSName),
+		slog.String("recordType", e.RecordType),
+		slog.Any("before", before),
+		slog.Any("after", after),
+	)
 }
 
 func (u *unboundProvider) GetDomainFilter() endpoint.DomainFilter {
-	return endpoint.DomainFilter{
-		Filters: u.domains,
-	}
+	return endpoint.NewDomainFilter(u.domains)
 }
 
 var _ provider.Provider = &unboundProvider{}
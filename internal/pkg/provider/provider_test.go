@@ -2,79 +2,288 @@ package provider
 
 import (
 	"context"
-	"math/rand"
-	"slices"
-	"strconv"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
-	"github.com/v-yarotksy/external-dns-opnsense-unbound-webhook-provider/internal/pkg/api"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 )
 
-type fakeAPI struct {
-	hostOverrides []api.HostOverride
-	hostAliases   []api.HostAlias
-}
+// recordingHandler is a slog.Handler that keeps every record it handles, with the attributes of its loggers.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
 
-func (f *fakeAPI) ListHostOverrides(_ context.Context) ([]api.HostOverride, error) {
-	return f.hostOverrides, nil
+	parent *recordingHandler
+	attrs  []slog.Attr
 }
 
-func (f *fakeAPI) CreateHostOverride(_ context.Context, ho api.HostOverride) (api.HostOverride, error) {
-	ho.ID = api.HostOverrideID(strconv.Itoa(rand.Int()))
-	f.hostOverrides = append(f.hostOverrides, ho)
-	return ho, nil
-}
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
 
-func (f *fakeAPI) DeleteHostOverride(_ context.Context, ho api.HostOverride) error {
-	f.hostOverrides = slices.DeleteFunc(f.hostOverrides, func(e api.HostOverride) bool {
-		return e == ho
-	})
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	r = r.Clone()
+	root := h
+	for ; root.parent != nil; root = root.parent {
+		r.AddAttrs(root.attrs...)
+	}
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.records = append(root.records, r)
 	return nil
 }
 
-func (f *fakeAPI) UpdateHostOverride(_ context.Context, ho api.HostOverride) error {
-	for i, h := range f.hostOverrides {
-		if ho.ID == h.ID {
-			f.hostOverrides[i] = ho
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordingHandler{parent: h, attrs: attrs}
+}
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// find returns the attributes of the first record with the given message.
+func (h *recordingHandler) find(msg string) (slog.Level, map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
 		}
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		return r.Level, attrs, true
 	}
-	return nil
+	return 0, nil, false
 }
 
-func (f *fakeAPI) ListHostAliases(_ context.Context, _ api.HostOverrideID) ([]api.HostAlias, error) {
-	return f.hostAliases, nil
-}
+// recordLogs captures the default logger output for the duration of the test.
+func recordLogs(t *testing.T) *recordingHandler {
+	t.Helper()
 
-func (f *fakeAPI) CreateHostAlias(_ context.Context, ha api.HostAlias) (api.HostAlias, error) {
-	ha.ID = api.HostAliasID(strconv.Itoa(rand.Int()))
-	f.hostAliases = append(f.hostAliases, ha)
-	return ha, nil
+	h := &recordingHandler{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return h
 }
 
-func (f *fakeAPI) UpdateHostAlias(_ context.Context, ha api.HostAlias) error {
-	for i, h := range f.hostAliases {
-		if ha.ID == h.ID {
-			f.hostAliases[i] = ha
-		}
+func groupValue(t *testing.T, v slog.Value) map[string]int64 {
+	t.Helper()
+
+	require.Equal(t, slog.KindGroup, v.Kind())
+	res := map[string]int64{}
+	for _, a := range v.Group() {
+		res[a.Key] = a.Value.Int64()
 	}
-	return nil
+	return res
 }
 
-func (f *fakeAPI) DeleteHostAlias(_ context.Context, ha api.HostAlias) error {
-	f.hostAliases = slices.DeleteFunc(f.hostAliases, func(e api.HostAlias) bool {
-		return e == ha
+func TestAPIClient(t *testing.T) {
+	var userAgent string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"rows":[],"total":0}`)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Run("applies the TLS options whatever their order", func(t *testing.T) {
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret", WithDebugHTTP(), WithInsecureClient())
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "external-dns-opnsense-unbound-webhook-provider", userAgent)
+	})
+
+	t.Run("logs with the logger given, apart from its clients", func(t *testing.T) {
+		logs := &recordingHandler{}
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret",
+			WithLogger(slog.New(logs)), WithDebugHTTP(), WithInsecureClient())
+		require.NoError(t, err)
+		defaults := recordLogs(t)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+
+		_, attrs, ok := logs.find("listed records")
+		require.True(t, ok)
+		require.Equal(t, "provider", attrs["component"].String())
+
+		_, attrs, ok = logs.find("http exchange")
+		require.True(t, ok)
+		require.Equal(t, "api", attrs["component"].String())
+		require.Equal(t, "/api/unbound/settings/searchHostOverride/", attrs["path"].String())
+
+		require.Empty(t, defaults.records)
+	})
+
+	t.Run("lets client options override its own", func(t *testing.T) {
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret",
+			WithAPIOptions(unbound.WithHTTPClient(server.Client()), unbound.WithUserAgent("custom")))
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "custom", userAgent)
 	})
-	return nil
 }
 
-var _ api.API = &fakeAPI{}
+func TestTLSConfig(t *testing.T) {
+	tls12Server := func(t *testing.T) *httptest.Server {
+		// Closing connections makes each request a new handshake
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"rows":[],"total":0}`)
+		}))
+		server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("parses minimum versions", func(t *testing.T) {
+		v, err := ParseTLSVersion("1.2")
+		require.NoError(t, err)
+		require.Equal(t, uint16(tls.VersionTLS12), v)
+		v, err = ParseTLSVersion("1.3")
+		require.NoError(t, err)
+		require.Equal(t, uint16(tls.VersionTLS13), v)
+
+		for _, s := range []string{"", "1.0", "1.1", "TLS1.3", "13"} {
+			_, err := ParseTLSVersion(s)
+			require.ErrorContains(t, err, "must be 1.2 or 1.3", s)
+		}
+	})
+
+	t.Run("refuses versions older than the minimum", func(t *testing.T) {
+		server := tls12Server(t)
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret",
+			WithInsecureClient(), WithTLSMinVersion(tls.VersionTLS13), WithRetry(1, 0, 0))
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		var tlsErr *unbound.TLSError
+		require.ErrorAs(t, err, &tlsErr)
+		require.Contains(t, tlsErr.Error(), "-tls-min-version")
+	})
+
+	t.Run("combines the TLS options", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pin := unbound.Pin{1}
+		provider := newUnboundProvider([]Option{
+			WithTLSMinVersion(tls.VersionTLS13), WithRootCAs(pool), WithTLSServerName("opnsense.example.com"), WithTLSPins([]unbound.Pin{pin}),
+		})
+
+		config := provider.clientTLSConfig()
+		require.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+		require.Same(t, pool, config.RootCAs)
+		require.Equal(t, "opnsense.example.com", config.ServerName)
+		require.NotNil(t, config.VerifyPeerCertificate)
+		require.False(t, config.InsecureSkipVerify)
+		require.Nil(t, provider.tlsConfig().VerifyConnection, "the options' configuration is left alone")
+	})
+
+	t.Run("logs the version negotiated by the first connection", func(t *testing.T) {
+		server := tls12Server(t)
+		logs := &recordingHandler{}
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret",
+			WithInsecureClient(), WithLogger(slog.New(logs)))
+		require.NoError(t, err)
+
+		for range 2 {
+			_, err = provider.Records(context.Background())
+			require.NoError(t, err)
+		}
+
+		level, attrs, ok := logs.find("negotiated TLS with OPNsense")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+		require.Equal(t, "TLS 1.2", attrs["version"].String())
+
+		logs.mu.Lock()
+		defer logs.mu.Unlock()
+		negotiated := 0
+		for _, r := range logs.records {
+			if r.Message == "negotiated TLS with OPNsense" {
+				negotiated++
+			}
+		}
+		require.Equal(t, 1, negotiated)
+	})
+}
+
+func TestNewUnboundProviderWithAPI(t *testing.T) {
+	t.Run("lists records from and applies changes to the API given", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider, err := NewUnboundProviderWithAPI(fake)
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("new.example.com"))
+		require.NoError(t, err)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"new.example.com"}, dnsNames(records))
+	})
+
+	t.Run("applies the provider's options", func(t *testing.T) {
+		logs := &recordingHandler{}
+		provider, err := NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithLogger(slog.New(logs)), WithDomainFilter([]string{"example.com"}))
+		require.NoError(t, err)
+		require.Equal(t, []string{"example.com"}, provider.GetDomainFilter().Filters)
+
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		_, attrs, ok := logs.find("listed records")
+		require.True(t, ok)
+		require.Equal(t, "provider", attrs["component"].String())
+	})
+
+	t.Run("reports metrics as those of the webhook named", func(t *testing.T) {
+		provider, err := NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithWebhookName("metrics-test"))
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("new.example.com"))
+		require.NoError(t, err)
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+
+		m := metrics.For("metrics-test")
+		require.Equal(t, float64(1), testutil.ToFloat64(m.ReconfigureTotal.WithLabelValues("success")))
+		require.Equal(t, float64(1), testutil.ToFloat64(m.Records.WithLabelValues(endpoint.RecordTypeA)))
+		require.NotZero(t, testutil.ToFloat64(m.LastSuccessfulApply))
+	})
+
+	t.Run("doesn't report a circuit breaker the API doesn't go through", func(t *testing.T) {
+		provider, err := NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithCircuitBreaker(1, time.Minute))
+		require.NoError(t, err)
+		require.Empty(t, provider.Status().Circuit)
+	})
+
+	t.Run("requires an API", func(t *testing.T) {
+		_, err := NewUnboundProviderWithAPI(nil)
+		require.Error(t, err)
+	})
+}
 
 func TestRecords(t *testing.T) {
 	t.Run("returns an empty list when there are no records", func(t *testing.T) {
-		fake := &fakeAPI{}
+		fake := &unboundtest.Fake{}
 		provider := &unboundProvider{api: fake}
 
 		res, err := provider.Records(context.Background())
@@ -83,22 +292,22 @@ func TestRecords(t *testing.T) {
 	})
 
 	t.Run("returns A records from Host Overrides and CNAME records from Host Aliases", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("berkin"),
+					ID:       unbound.HostOverrideID("berkin"),
 					Hostname: "berkin",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
 				},
 			},
-			hostAliases: []api.HostAlias{
+			HostAliases: []unbound.HostAlias{
 				{
-					ID:       api.HostAliasID("derkin"),
+					ID:       unbound.HostAliasID("derkin"),
 					Hostname: "derkin",
 					Domain:   "example.com",
 					Host:     "berkin.example.com",
-					HostID:   api.HostOverrideID("berkin"),
+					HostID:   unbound.HostOverrideID("berkin"),
 				},
 			},
 		}
@@ -121,9 +330,51 @@ func TestRecords(t *testing.T) {
 	})
 }
 
+func TestRecordsLogging(t *testing.T) {
+	t.Run("logs a summary at Info and the full listing at Debug", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{
+					ID:       unbound.HostOverrideID("berkin"),
+					Hostname: "berkin",
+					Domain:   "example.com",
+					Server:   "127.0.0.1",
+				},
+			},
+			HostAliases: []unbound.HostAlias{
+				{
+					ID:       unbound.HostAliasID("derkin"),
+					Hostname: "derkin",
+					Domain:   "example.com",
+					Host:     "berkin.example.com",
+					HostID:   unbound.HostOverrideID("berkin"),
+				},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		level, attrs, ok := logs.find("listed records")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelInfo, level)
+		require.Equal(t, int64(2), attrs["total"].Int64())
+		require.Equal(t, map[string]int64{"A": 1, "CNAME": 1}, groupValue(t, attrs["counts"]))
+		require.Contains(t, attrs, "duration")
+		require.NotContains(t, attrs, "result")
+
+		level, attrs, ok = logs.find("list records")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+		require.Contains(t, attrs, "result")
+	})
+}
+
 func TestAdjustEndpoints(t *testing.T) {
 	t.Run("removes anything but the first IP from A records", func(t *testing.T) {
-		fake := &fakeAPI{}
+		fake := &unboundtest.Fake{}
 		provider := &unboundProvider{api: fake}
 
 		endpoints := []*endpoint.Endpoint{
@@ -156,12 +407,86 @@ func TestAdjustEndpoints(t *testing.T) {
 	})
 }
 
+func TestAdjustEndpointsObservability(t *testing.T) {
+	adjustments := func(kind string) float64 {
+		return testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(kind))
+	}
+
+	t.Run("counts and logs each kind of adjustment", func(t *testing.T) {
+		logs := recordLogs(t)
+		provider := &unboundProvider{api: &unboundtest.Fake{}}
+
+		before := map[string]float64{}
+		for _, kind := range []string{adjustTruncateTargets, adjustClearTTL, adjustStripTrailingDot, adjustLowercase} {
+			before[kind] = adjustments(kind)
+		}
+
+		endpoints := []*endpoint.Endpoint{
+			{
+				DNSName:    "A.example.com.",
+				Targets:    endpoint.NewTargets("127.0.0.1", "127.0.0.2"),
+				RecordType: endpoint.RecordTypeA,
+				RecordTTL:  300,
+			},
+			{
+				DNSName:    "cname.example.com",
+				Targets:    endpoint.NewTargets("A.example.com."),
+				RecordType: endpoint.RecordTypeCNAME,
+			},
+		}
+
+		_, err := provider.AdjustEndpoints(endpoints)
+		require.NoError(t, err)
+		require.Equal(t, []*endpoint.Endpoint{
+			{
+				DNSName:    "a.example.com",
+				Targets:    endpoint.NewTargets("127.0.0.1"),
+				RecordType: endpoint.RecordTypeA,
+			},
+			{
+				DNSName:    "cname.example.com",
+				Targets:    endpoint.NewTargets("a.example.com"),
+				RecordType: endpoint.RecordTypeCNAME,
+			},
+		}, endpoints)
+
+		require.Equal(t, before[adjustTruncateTargets]+1, adjustments(adjustTruncateTargets))
+		require.Equal(t, before[adjustClearTTL]+1, adjustments(adjustClearTTL))
+		require.Equal(t, before[adjustStripTrailingDot]+2, adjustments(adjustStripTrailingDot))
+		require.Equal(t, before[adjustLowercase]+2, adjustments(adjustLowercase))
+
+		level, attrs, ok := logs.find("adjusted endpoint")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+		require.Equal(t, adjustStripTrailingDot, attrs["kind"].String())
+		require.Equal(t, "A.example.com.", attrs["before"].Any())
+		require.Equal(t, "A.example.com", attrs["after"].Any())
+	})
+
+	t.Run("leaves canonical endpoints alone", func(t *testing.T) {
+		logs := recordLogs(t)
+		provider := &unboundProvider{api: &unboundtest.Fake{}}
+
+		_, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			{
+				DNSName:    "a.example.com",
+				Targets:    endpoint.NewTargets("127.0.0.1"),
+				RecordType: endpoint.RecordTypeA,
+			},
+		})
+		require.NoError(t, err)
+
+		_, _, ok := logs.find("adjusted endpoint")
+		require.False(t, ok)
+	})
+}
+
 func TestApplyChanges(t *testing.T) {
 	t.Run("deletes Host Overrides when an A record is deleted", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("berkin"),
+					ID:       unbound.HostOverrideID("berkin"),
 					Hostname: "berkin",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
@@ -180,26 +505,26 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.ElementsMatch(t, fake.hostOverrides, []api.HostOverride{})
+		require.ElementsMatch(t, fake.HostOverrides, []unbound.HostOverride{})
 	})
 
 	t.Run("deletes Host Alias when a CNAME record is deleted", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("berkin"),
+					ID:       unbound.HostOverrideID("berkin"),
 					Hostname: "berkin",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
 				},
 			},
-			hostAliases: []api.HostAlias{
+			HostAliases: []unbound.HostAlias{
 				{
-					ID:       api.HostAliasID("derkin"),
+					ID:       unbound.HostAliasID("derkin"),
 					Hostname: "derkin",
 					Domain:   "example.com",
 					Host:     "berkin.example.com",
-					HostID:   api.HostOverrideID("berkin"),
+					HostID:   unbound.HostOverrideID("berkin"),
 				},
 			},
 		}
@@ -215,11 +540,11 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.ElementsMatch(t, fake.hostAliases, []api.HostOverride{})
+		require.ElementsMatch(t, fake.HostAliases, []unbound.HostOverride{})
 	})
 
 	t.Run("creates a Host Override when an A record is created", func(t *testing.T) {
-		fake := &fakeAPI{}
+		fake := &unboundtest.Fake{}
 		provider := &unboundProvider{api: fake}
 
 		err := provider.ApplyChanges(context.Background(), &plan.Changes{
@@ -232,18 +557,18 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.Len(t, fake.hostOverrides, 1)
-		require.Equal(t, "berkin", fake.hostOverrides[0].Hostname)
-		require.Equal(t, "example.com", fake.hostOverrides[0].Domain)
-		require.Equal(t, "127.0.0.1", fake.hostOverrides[0].Server)
-		require.NotEmpty(t, fake.hostOverrides[0].ID)
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, "berkin", fake.HostOverrides[0].Hostname)
+		require.Equal(t, "example.com", fake.HostOverrides[0].Domain)
+		require.Equal(t, "127.0.0.1", fake.HostOverrides[0].Server)
+		require.NotEmpty(t, fake.HostOverrides[0].ID)
 	})
 
 	t.Run("creates a Host Alias when a CNAME record is created", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("a"),
+					ID:       unbound.HostOverrideID("a"),
 					Hostname: "a",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
@@ -262,19 +587,19 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.Len(t, fake.hostAliases, 1)
-		require.Equal(t, "cname", fake.hostAliases[0].Hostname)
-		require.Equal(t, "example.com", fake.hostAliases[0].Domain)
-		require.Equal(t, "a.example.com", fake.hostAliases[0].Host)
-		require.Equal(t, api.HostOverrideID("a"), fake.hostAliases[0].HostID)
-		require.NotEmpty(t, fake.hostAliases[0].ID)
+		require.Len(t, fake.HostAliases, 1)
+		require.Equal(t, "cname", fake.HostAliases[0].Hostname)
+		require.Equal(t, "example.com", fake.HostAliases[0].Domain)
+		require.Equal(t, "a.example.com", fake.HostAliases[0].Host)
+		require.Equal(t, unbound.HostOverrideID("a"), fake.HostAliases[0].HostID)
+		require.NotEmpty(t, fake.HostAliases[0].ID)
 	})
 
 	t.Run("updates Host Overrides when an A record is updated", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("a"),
+					ID:       unbound.HostOverrideID("a"),
 					Hostname: "a",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
@@ -300,9 +625,9 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.ElementsMatch(t, fake.hostOverrides, []api.HostOverride{
+		require.ElementsMatch(t, fake.HostOverrides, []unbound.HostOverride{
 			{
-				ID:       api.HostOverrideID("a"),
+				ID:       unbound.HostOverrideID("a"),
 				Hostname: "a",
 				Domain:   "example.com",
 				Server:   "127.0.0.2",
@@ -311,22 +636,22 @@ func TestApplyChanges(t *testing.T) {
 	})
 
 	t.Run("updates Host Alias when a CNAME record is updated", func(t *testing.T) {
-		fake := &fakeAPI{
-			hostOverrides: []api.HostOverride{
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
 				{
-					ID:       api.HostOverrideID("a"),
+					ID:       unbound.HostOverrideID("a"),
 					Hostname: "a",
 					Domain:   "example.com",
 					Server:   "127.0.0.1",
 				},
 			},
-			hostAliases: []api.HostAlias{
+			HostAliases: []unbound.HostAlias{
 				{
-					ID:       api.HostAliasID("cname"),
+					ID:       unbound.HostAliasID("cname"),
 					Hostname: "cname",
 					Domain:   "example.com",
 					Host:     "a.example.com",
-					HostID:   api.HostOverrideID("a"),
+					HostID:   unbound.HostOverrideID("a"),
 				},
 			},
 		}
@@ -349,14 +674,129 @@ func TestApplyChanges(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
-		require.ElementsMatch(t, fake.hostAliases, []api.HostAlias{
+		require.ElementsMatch(t, fake.HostAliases, []unbound.HostAlias{
 			{
-				ID:       api.HostAliasID("cname"),
+				ID:       unbound.HostAliasID("cname"),
 				Hostname: "cname2",
 				Domain:   "example.com",
 				Host:     "a.example.com",
-				HostID:   api.HostOverrideID("a"),
+				HostID:   unbound.HostOverrideID("a"),
+			},
+		})
+	})
+
+	t.Run("keeps fields external-dns doesn't manage as they are when updating", func(t *testing.T) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "a", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithSnapshotReuse(time.Hour)(provider)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		// Edited in the OPNsense UI after the listing the update is planned against
+		fake.HostOverrides[0].Description = "Home Assistant"
+
+		err = provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.2")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostOverride{
+			{ID: "a", Hostname: "a", Domain: "example.com", Server: "127.0.0.2", Description: "Home Assistant"},
+		}, fake.HostOverrides)
+	})
+
+	t.Run("creates records an update doesn't find, as deleted by hand since listing", func(t *testing.T) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "a", Hostname: "a", Domain: "example.com", Server: "127.0.0.1", Enabled: "1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		createdAs := testutil.ToFloat64(metrics.Default.UpdatesCreated.WithLabelValues(endpoint.RecordTypeA))
+		createdCNAMEs := testutil.ToFloat64(metrics.Default.UpdatesCreated.WithLabelValues(endpoint.RecordTypeCNAME))
+		logs := recordLogs(t)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "b.example.com"),
 			},
 		})
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 2)
+		require.Equal(t, "b.example.com", fake.HostOverrides[1].DNSName())
+		require.Equal(t, "127.0.0.2", fake.HostOverrides[1].Server)
+		require.Len(t, fake.HostAliases, 1)
+		require.Equal(t, fake.HostOverrides[1].ID, fake.HostAliases[0].HostID)
+
+		require.Equal(t, createdAs+1, testutil.ToFloat64(metrics.Default.UpdatesCreated.WithLabelValues(endpoint.RecordTypeA)))
+		require.Equal(t, createdCNAMEs+1, testutil.ToFloat64(metrics.Default.UpdatesCreated.WithLabelValues(endpoint.RecordTypeCNAME)))
+		level, _, ok := logs.find("record to update not found, creating it")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+	})
+
+	t.Run("logs per-operation details at Debug and a summary at Info", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{
+					ID:       unbound.HostOverrideID("a"),
+					Hostname: "a",
+					Domain:   "example.com",
+					Server:   "127.0.0.1",
+				},
+				{
+					ID:       unbound.HostOverrideID("old"),
+					Hostname: "old",
+					Domain:   "example.com",
+					Server:   "127.0.0.3",
+				},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				{
+					DNSName:    "b.example.com",
+					Targets:    endpoint.NewTargets("127.0.0.2"),
+					RecordType: endpoint.RecordTypeA,
+				},
+				{
+					DNSName:    "cname.example.com",
+					Targets:    endpoint.NewTargets("a.example.com"),
+					RecordType: endpoint.RecordTypeCNAME,
+				},
+			},
+			Delete: []*endpoint.Endpoint{
+				{
+					DNSName:    "old.example.com",
+					Targets:    endpoint.NewTargets("127.0.0.3"),
+					RecordType: endpoint.RecordTypeA,
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		level, _, ok := logs.find("created Host Override")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+
+		level, attrs, ok := logs.find("applied changes")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelInfo, level)
+		require.Equal(t, map[string]int64{"A": 1, "CNAME": 1}, groupValue(t, attrs["created"]))
+		require.NotContains(t, attrs, "updated")
+		require.Equal(t, map[string]int64{"A": 1}, groupValue(t, attrs["deleted"]))
 	})
 }
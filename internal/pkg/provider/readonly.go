@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// ReadOnlyResponse is what ApplyChanges answers with in read-only mode.
+type ReadOnlyResponse string
+
+const (
+	// ReadOnlyRefuse fails every apply with ErrReadOnly, so that external-dns reports changes aren't applied.
+	// This is the default.
+	ReadOnlyRefuse ReadOnlyResponse = "error"
+	// ReadOnlySkip succeeds without applying anything, so that external-dns carries on quietly.
+	ReadOnlySkip ReadOnlyResponse = "skip"
+)
+
+// ErrReadOnly is returned for changes refused in read-only mode.
+var ErrReadOnly = errors.New("read-only mode, changes are not applied")
+
+// ParseReadOnlyResponse returns the read-only response named s.
+func ParseReadOnlyResponse(s string) (ReadOnlyResponse, error) {
+	switch response := ReadOnlyResponse(s); response {
+	case ReadOnlyRefuse, ReadOnlySkip:
+		return response, nil
+	default:
+		return "", fmt.Errorf("unknown read-only response %q, expected %q or %q", s, ReadOnlyRefuse, ReadOnlySkip)
+	}
+}
+
+// WithReadOnly makes the provider list records and adjust endpoints as usual, but never write to OPNsense:
+// ApplyChanges and Seed log the changes they would have applied and answer with response, Restore refuses
+// anything but a dry run, and garbage collection, the canary and pruning soft-deleted records don't run.
+// Unlike a dry run, it is meant to be left on, such as while rolling the webhook out next to records
+// managed by hand.
+func WithReadOnly(response ReadOnlyResponse) Option {
+	return func(p *unboundProvider) {
+		p.readOnly = response
+	}
+}
+
+// refuseReadOnly logs and counts changes not applied in read-only mode, along with how they resolve against
+// the last listing, and answers as configured.
+func (p *unboundProvider) refuseReadOnly(changes *plan.Changes) error {
+	p.log().Warn("not applying changes in read-only mode",
+		slog.Any("create", changes.Create),
+		slog.Any("updateOld", changes.UpdateOld),
+		slog.Any("updateNew", changes.UpdateNew),
+		slog.Any("delete", changes.Delete),
+	)
+	if listed := p.listed.Load(); listed != nil {
+		p.log().Info("resolved plan", slog.Any("plan", p.newApplyState(p.api, listed, nil).resolve(changes)))
+	}
+	m := metrics.For(p.webhook)
+	m.ReadOnlyChanges.WithLabelValues("create").Add(float64(len(changes.Create)))
+	m.ReadOnlyChanges.WithLabelValues("update").Add(float64(len(changes.UpdateNew)))
+	m.ReadOnlyChanges.WithLabelValues("delete").Add(float64(len(changes.Delete)))
+
+	if p.readOnly == ReadOnlySkip {
+		return nil
+	}
+	return ErrReadOnly
+}
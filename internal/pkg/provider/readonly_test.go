@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestReadOnly(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Enabled: "1"},
+				{ID: "2", Hostname: "old", Domain: "example.com", Server: "10.0.0.1", Enabled: "0",
+					Description: tagSoftDeleted("", time.Now().Add(-time.Hour), "")},
+			},
+		}
+	}
+
+	readOnly := func(fake *unboundtest.Fake, response ReadOnlyResponse) *unboundProvider {
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 3, slog.Default())}
+		WithReadOnly(response)(provider)
+		return provider
+	}
+
+	t.Run("refuses changes, logging them", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := existing()
+		provider := readOnly(fake, ReadOnlyRefuse)
+		created := testutil.ToFloat64(metrics.Default.ReadOnlyChanges.WithLabelValues("create"))
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.ErrorIs(t, err, ErrReadOnly)
+		require.Len(t, fake.HostOverrides, 2)
+		require.Zero(t, fake.Calls("Reconfigure"))
+		require.Equal(t, created+1, testutil.ToFloat64(metrics.Default.ReadOnlyChanges.WithLabelValues("create")))
+
+		level, attrs, ok := logs.find("not applying changes in read-only mode")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Len(t, attrs["create"].Any(), 1)
+	})
+
+	t.Run("skips changes when told to, logging how they resolve", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := existing()
+		provider := readOnly(fake, ReadOnlySkip)
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.Len(t, fake.HostOverrides, 2)
+
+		level, attrs, ok := logs.find("resolved plan")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelInfo, level)
+		require.Len(t, attrs["plan"].Any().(resolvedPlan).Creates, 1)
+	})
+
+	t.Run("lists records and tells its mode", func(t *testing.T) {
+		fake := existing()
+		provider := readOnly(fake, ReadOnlyRefuse)
+		WithSoftDelete(time.Minute)(provider)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(records))
+		require.Len(t, fake.HostOverrides, 2, "soft-deleted records are not pruned")
+		require.True(t, provider.Status().ReadOnly)
+	})
+
+	t.Run("restores only in a dry run", func(t *testing.T) {
+		fake := existing()
+		provider := readOnly(fake, ReadOnlyRefuse)
+
+		_, err := provider.Restore(context.Background(), nil, false)
+		require.ErrorIs(t, err, ErrReadOnly)
+		require.Equal(t, "0", fake.HostOverrides[1].Enabled)
+
+		restored, err := provider.Restore(context.Background(), nil, true)
+		require.NoError(t, err)
+		require.Equal(t, []RestoredRecord{{DNSName: "old.example.com", RecordType: endpoint.RecordTypeA}}, restored)
+	})
+
+	t.Run("runs neither garbage collection nor the canary", func(t *testing.T) {
+		fake := existing()
+		provider := readOnly(fake, ReadOnlyRefuse)
+		WithGarbageCollection(time.Nanosecond)(provider)
+		WithCanary(time.Nanosecond, time.Second, "example.com")(provider)
+
+		provider.RunGC(context.Background())
+		provider.RunCanary(context.Background())
+		require.Zero(t, fake.Calls("ListHostOverrides"))
+		require.Len(t, fake.HostOverrides, 2)
+	})
+}
+
+func TestParseReadOnlyResponse(t *testing.T) {
+	response, err := ParseReadOnlyResponse("skip")
+	require.NoError(t, err)
+	require.Equal(t, ReadOnlySkip, response)
+
+	_, err = ParseReadOnlyResponse("ignore")
+	require.ErrorContains(t, err, `unknown read-only response "ignore"`)
+}
@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+const (
+	// reconfigureRetryInterval is the minimum delay before retrying a failed reconfigure.
+	reconfigureRetryInterval = 10 * time.Second
+
+	defaultReconfigureFailureThreshold = 3
+)
+
+// reconfigurer applies saved OPNsense settings to the running Unbound service.
+//
+// With a zero debounce, every request reconfigures immediately. Otherwise requests
+// arriving within the debounce window are coalesced into a single reconfigure.
+// Failed reconfigures are retried in the background until one succeeds,
+// since external-dns won't call ApplyChanges again for records that are already saved.
+type reconfigurer struct {
+	api       unbound.API
+	debounce  time.Duration
+	threshold int
+	logger    *slog.Logger
+	webhook   string
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	pending  bool
+	failures int
+	lastErr  error
+}
+
+func newReconfigurer(a unbound.API, debounce time.Duration, threshold int, logger *slog.Logger) *reconfigurer {
+	return &reconfigurer{api: a, debounce: debounce, threshold: threshold, logger: logger}
+}
+
+// Request asks for a reconfigure. Errors are only returned when reconfiguring immediately.
+func (r *reconfigurer) Request(ctx context.Context) error {
+	if r.debounce == 0 {
+		r.setPending(true)
+		return r.run(ctx)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.pending {
+		r.pending = true
+		metrics.For(r.webhook).ReconfigurePending.Set(1)
+		r.schedule(r.debounce)
+	}
+	return nil
+}
+
+// Flush runs the reconfigure waiting for the debounce or a retry now, if any.
+func (r *reconfigurer) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mu.Unlock()
+
+	if !pending {
+		return nil
+	}
+	return r.run(ctx)
+}
+
+// Pending reports whether a reconfigure is waiting to run.
+func (r *reconfigurer) Pending() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pending
+}
+
+// Ready returns an error once reconfigure has failed threshold times in a row.
+func (r *reconfigurer) Ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.threshold > 0 && r.failures >= r.threshold {
+		return fmt.Errorf("unbound reconfigure failed %d times in a row: %w", r.failures, r.lastErr)
+	}
+	return nil
+}
+
+// schedule must be called with r.mu held.
+func (r *reconfigurer) schedule(d time.Duration) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(d, func() {
+		r.run(context.Background())
+	})
+}
+
+func (r *reconfigurer) setPending(pending bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = pending
+	if pending {
+		metrics.For(r.webhook).ReconfigurePending.Set(1)
+	} else {
+		metrics.For(r.webhook).ReconfigurePending.Set(0)
+	}
+}
+
+func (r *reconfigurer) run(ctx context.Context) error {
+	start := time.Now()
+	err := r.api.Reconfigure(ctx)
+	duration := time.Since(start)
+	metrics.For(r.webhook).ReconfigureDuration.Observe(duration.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		metrics.For(r.webhook).ReconfigureTotal.WithLabelValues("failure").Inc()
+		r.failures++
+		r.lastErr = err
+		r.logger.Error("failed to reconfigure unbound",
+			slog.Int("consecutiveFailures", r.failures),
+			slog.Duration("duration", duration),
+			slog.Any("error", err),
+		)
+		r.schedule(max(r.debounce, reconfigureRetryInterval))
+		return fmt.Errorf("failed to reconfigure unbound: %w", err)
+	}
+
+	metrics.For(r.webhook).ReconfigureTotal.WithLabelValues("success").Inc()
+	r.failures = 0
+	r.lastErr = nil
+	r.pending = false
+	metrics.For(r.webhook).ReconfigurePending.Set(0)
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.logger.Info("reconfigured unbound", slog.Duration("duration", duration))
+	return nil
+}
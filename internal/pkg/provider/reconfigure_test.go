@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func createChanges(name string) *plan.Changes {
+	return &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			{
+				DNSName:    name,
+				Targets:    endpoint.NewTargets("127.0.0.1"),
+				RecordType: endpoint.RecordTypeA,
+			},
+		},
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Run("reconfigures unbound after applying changes", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 3, slog.Default())}
+		successes := testutil.ToFloat64(metrics.Default.ReconfigureTotal.WithLabelValues("success"))
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.NoError(t, err)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+		require.Equal(t, successes+1, testutil.ToFloat64(metrics.Default.ReconfigureTotal.WithLabelValues("success")))
+		require.False(t, provider.reconfigurer.Pending())
+	})
+
+	t.Run("does not reconfigure when nothing was applied", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 3, slog.Default())}
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Delete: []*endpoint.Endpoint{
+				{
+					DNSName:    "missing.example.com",
+					Targets:    endpoint.NewTargets("127.0.0.1"),
+					RecordType: endpoint.RecordTypeA,
+				},
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 0, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("becomes not ready after consecutive failures and recovers on success", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		fake.Fail("Reconfigure", errors.New("boom"))
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 2, slog.Default())}
+		t.Cleanup(func() { provider.reconfigurer.timer.Stop() })
+		failures := testutil.ToFloat64(metrics.Default.ReconfigureTotal.WithLabelValues("failure"))
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.ErrorContains(t, err, "failed to reconfigure unbound: boom")
+		require.NoError(t, provider.Ready())
+		require.True(t, provider.reconfigurer.Pending())
+		require.Equal(t, float64(1), testutil.ToFloat64(metrics.Default.ReconfigurePending))
+
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.Error(t, err)
+		require.ErrorContains(t, provider.Ready(), "unbound reconfigure failed 2 times in a row: boom")
+		require.Equal(t, failures+2, testutil.ToFloat64(metrics.Default.ReconfigureTotal.WithLabelValues("failure")))
+
+		fake.Fail("Reconfigure", nil)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("c.example.com"))
+		require.NoError(t, err)
+		require.NoError(t, provider.Ready())
+		require.False(t, provider.reconfigurer.Pending())
+		require.Equal(t, float64(0), testutil.ToFloat64(metrics.Default.ReconfigurePending))
+	})
+
+	t.Run("coalesces requests within the debounce window", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 50*time.Millisecond, 3, slog.Default())}
+
+		for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+			err := provider.ApplyChanges(context.Background(), createChanges(name))
+			require.NoError(t, err)
+		}
+		require.True(t, provider.reconfigurer.Pending())
+		require.Equal(t, 0, fake.Calls("Reconfigure"))
+
+		require.Eventually(t, func() bool {
+			return !provider.reconfigurer.Pending()
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+}
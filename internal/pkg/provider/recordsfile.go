@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// RecordsFile lists records, in YAML or JSON:
+//
+//	records:
+//	  - dnsName: nas.example.com
+//	    recordType: A
+//	    targets: [192.168.1.10]
+//	    description: NAS
+type RecordsFile struct {
+	Records []FileRecord `yaml:"records" json:"records"`
+}
+
+// FileRecord is a record of a RecordsFile. Records without a description leave the one in Unbound as it is.
+type FileRecord struct {
+	DNSName     string   `yaml:"dnsName" json:"dnsName"`
+	RecordType  string   `yaml:"recordType" json:"recordType"`
+	Targets     []string `yaml:"targets" json:"targets"`
+	Description *string  `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// LoadRecordsFile reads the records of the RecordsFile at path as endpoints.
+func LoadRecordsFile(path string) ([]*endpoint.Endpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file RecordsFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid records file %s: %w", path, err)
+	}
+	if err := validateRecords(file.Records); err != nil {
+		return nil, fmt.Errorf("invalid records file %s: %w", path, err)
+	}
+
+	endpoints := make([]*endpoint.Endpoint, 0, len(file.Records))
+	for _, r := range file.Records {
+		ep := endpoint.NewEndpoint(r.DNSName, r.RecordType, r.Targets...)
+		if r.Description != nil {
+			ep.SetProviderSpecificProperty(unbound.DescriptionProperty, *r.Description)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// NewRecordsFile returns a RecordsFile of endpoints, sorted by DNS name and record type, as LoadRecordsFile reads them.
+func NewRecordsFile(endpoints []*endpoint.Endpoint) RecordsFile {
+	file := RecordsFile{Records: make([]FileRecord, 0, len(endpoints))}
+	for _, ep := range endpoints {
+		record := FileRecord{DNSName: ep.DNSName, RecordType: ep.RecordType, Targets: slices.Clone(ep.Targets)}
+		if description, ok := ep.GetProviderSpecificProperty(unbound.DescriptionProperty); ok {
+			record.Description = &description
+		}
+		file.Records = append(file.Records, record)
+	}
+	slices.SortFunc(file.Records, func(a, b FileRecord) int {
+		return cmp.Or(strings.Compare(state.Normalize(a.DNSName), state.Normalize(b.DNSName)), strings.Compare(a.RecordType, b.RecordType))
+	})
+	return file
+}
+
+func validateRecords(records []FileRecord) error {
+	seen := map[string]bool{}
+	for i, r := range records {
+		switch {
+		case r.DNSName == "":
+			return fmt.Errorf("record %d: dnsName is required", i)
+		case r.RecordType != endpoint.RecordTypeA && r.RecordType != endpoint.RecordTypeCNAME:
+			return fmt.Errorf("record %s: unsupported recordType %q, only A and CNAME are", r.DNSName, r.RecordType)
+		case len(r.Targets) == 0:
+			return fmt.Errorf("record %s: targets are required", r.DNSName)
+		case r.RecordType == endpoint.RecordTypeCNAME && len(r.Targets) > 1:
+			return fmt.Errorf("record %s: CNAME records have a single target", r.DNSName)
+		}
+
+		key := r.RecordType + " " + state.Normalize(r.DNSName)
+		if seen[key] {
+			return fmt.Errorf("record %s: duplicate %s record", r.DNSName, r.RecordType)
+		}
+		seen[key] = true
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestLoadRecordsFile(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "records.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("loads records as endpoints", func(t *testing.T) {
+		endpoints, err := LoadRecordsFile(write(t, `
+records:
+  - dnsName: nas.example.com
+    recordType: A
+    targets: [192.168.1.10]
+    description: NAS
+  - dnsName: files.example.com
+    recordType: CNAME
+    targets: [nas.example.com]
+`))
+		require.NoError(t, err)
+		require.Equal(t, []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10").
+				WithProviderSpecific(unbound.DescriptionProperty, "NAS"),
+			endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+		}, endpoints)
+	})
+
+	t.Run("loads JSON", func(t *testing.T) {
+		endpoints, err := LoadRecordsFile(write(t, `{"records": [{"dnsName": "nas.example.com", "recordType": "A", "targets": ["192.168.1.10"]}]}`))
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(endpoints))
+	})
+
+	t.Run("loads an empty file", func(t *testing.T) {
+		endpoints, err := LoadRecordsFile(write(t, ""))
+		require.NoError(t, err)
+		require.Empty(t, endpoints)
+	})
+
+	t.Run("rejects invalid records", func(t *testing.T) {
+		for content, msg := range map[string]string{
+			"records: [{recordType: A, targets: [192.168.1.10]}]":                         "dnsName is required",
+			"records: [{dnsName: nas.example.com, recordType: TXT, targets: [nas]}]":      `unsupported recordType "TXT"`,
+			"records: [{dnsName: nas.example.com, recordType: A}]":                        "targets are required",
+			"records: [{dnsName: a.example.com, recordType: CNAME, targets: [b, c]}]":     "single target",
+			"records: [{dnsName: nas.example.com, recordType: A, targets: [x], ttl: 60}]": "field ttl not found",
+			`records:
+  - {dnsName: nas.example.com, recordType: A, targets: [192.168.1.10]}
+  - {dnsName: NAS.example.com., recordType: A, targets: [192.168.1.11]}`: "duplicate A record",
+		} {
+			_, err := LoadRecordsFile(write(t, content))
+			require.ErrorContains(t, err, msg)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// refreshMaxBackoff caps how far repeated refresh failures stretch the refresh interval.
+const refreshMaxBackoff = 8
+
+// refreshStaleAfter is how many refresh intervals may pass without successful contact before the provider is not ready.
+const refreshStaleAfter = 3
+
+// RunRefresh re-lists records every refresh interval until ctx is done, keeping the cache,
+// the record gauges and the last successful contact current between external-dns polls.
+// Consecutive failures back off exponentially. It returns immediately if background refresh is disabled.
+func (p *unboundProvider) RunRefresh(ctx context.Context) {
+	if p.refreshInterval <= 0 {
+		return
+	}
+
+	failures := 0
+	for {
+		if _, err := p.Records(WithFreshRecords(ctx)); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			p.log().Warn("background refresh failed", slog.Int("failures", failures), slog.Any("error", err))
+		} else {
+			failures = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refreshDelay(p.refreshInterval, failures)):
+		}
+	}
+}
+
+// refreshDelay doubles interval for every consecutive failure, up to refreshMaxBackoff times interval.
+func refreshDelay(interval time.Duration, failures int) time.Duration {
+	factor := 1
+	for i := 0; i < failures && factor < refreshMaxBackoff; i++ {
+		factor *= 2
+	}
+	return interval * time.Duration(factor)
+}
+
+// refreshReady reports an error when background refresh hasn't reached OPNsense for too long.
+func (p *unboundProvider) refreshReady() error {
+	if p.refreshInterval <= 0 {
+		return nil
+	}
+
+	last := p.status.lastContact()
+	if last.IsZero() {
+		return fmt.Errorf("no successful contact with OPNsense yet")
+	}
+	if since := time.Since(last); since > refreshStaleAfter*p.refreshInterval {
+		return fmt.Errorf("no successful contact with OPNsense for %s", since.Round(time.Second))
+	}
+	return nil
+}
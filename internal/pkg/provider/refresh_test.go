@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestRunRefresh(t *testing.T) {
+	newProvider := func(interval time.Duration) (*unboundProvider, *unboundtest.Fake) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithCacheTTL(time.Hour)(provider)
+		WithBackgroundRefresh(interval)(provider)
+		return provider, fake
+	}
+
+	run := func(t *testing.T, provider *unboundProvider) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			provider.RunRefresh(ctx)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+		return cancel
+	}
+
+	t.Run("keeps the cache, gauges and readiness current", func(t *testing.T) {
+		provider, fake := newProvider(10 * time.Millisecond)
+		require.Error(t, provider.Ready())
+
+		run(t, provider)
+
+		require.Eventually(t, func() bool { return provider.Ready() == nil }, time.Second, 5*time.Millisecond)
+		require.Equal(t, float64(1), testutil.ToFloat64(metrics.Default.Records.WithLabelValues("A")))
+		require.NotNil(t, provider.Status().LastContact)
+
+		fake.Lock()
+		fake.HostOverrides = append(fake.HostOverrides,
+			unbound.HostOverride{ID: "2", Hostname: "b", Domain: "example.com", Server: "127.0.0.2"})
+		fake.Unlock()
+
+		require.Eventually(t, func() bool {
+			records, err := provider.Records(context.Background())
+			return err == nil && len(records) == 2
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, float64(2), testutil.ToFloat64(metrics.Default.Records.WithLabelValues("A")))
+	})
+
+	t.Run("becomes not ready when OPNsense can't be reached", func(t *testing.T) {
+		provider, fake := newProvider(5 * time.Millisecond)
+
+		run(t, provider)
+		require.Eventually(t, func() bool { return provider.Ready() == nil }, time.Second, time.Millisecond)
+
+		fake.Fail("ListHostOverrides", errors.New("connection refused"))
+		require.Eventually(t, func() bool { return provider.Ready() != nil }, time.Second, time.Millisecond)
+		require.ErrorContains(t, provider.Ready(), "no successful contact with OPNsense for")
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		provider, fake := newProvider(time.Millisecond)
+
+		cancel := run(t, provider)
+		require.Eventually(t, func() bool { return fake.Calls("ListHostOverrides") > 0 }, time.Second, time.Millisecond)
+		cancel()
+
+		time.Sleep(10 * time.Millisecond)
+		listings := fake.Calls("ListHostOverrides")
+		time.Sleep(10 * time.Millisecond)
+		require.Equal(t, listings, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("does nothing when disabled", func(t *testing.T) {
+		provider, fake := newProvider(0)
+
+		provider.RunRefresh(context.Background())
+		require.Equal(t, 0, fake.Calls("ListHostOverrides"))
+		require.NoError(t, provider.Ready())
+	})
+
+	t.Run("backs off on repeated failures", func(t *testing.T) {
+		require.Equal(t, time.Second, refreshDelay(time.Second, 0))
+		require.Equal(t, 2*time.Second, refreshDelay(time.Second, 1))
+		require.Equal(t, 4*time.Second, refreshDelay(time.Second, 2))
+		require.Equal(t, 8*time.Second, refreshDelay(time.Second, 3))
+		require.Equal(t, 8*time.Second, refreshDelay(time.Second, 10))
+	})
+}
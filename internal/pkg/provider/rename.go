@@ -0,0 +1,242 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// RenameStrategy is how ApplyChanges makes updates that change the DNS name of a record.
+type RenameStrategy string
+
+const (
+	// RenameUpdate updates renamed records in place, keeping their UUIDs. This is the default.
+	RenameUpdate RenameStrategy = "update"
+	// RenameRecreate creates renamed records under a new UUID and deletes the old ones.
+	// Aliases of a renamed host override are re-pointed to the new one.
+	RenameRecreate RenameStrategy = "recreate"
+)
+
+// ParseRenameStrategy returns the rename strategy named s.
+func ParseRenameStrategy(s string) (RenameStrategy, error) {
+	switch strategy := RenameStrategy(s); strategy {
+	case RenameUpdate, RenameRecreate:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown rename strategy %q, expected %q or %q", s, RenameUpdate, RenameRecreate)
+	}
+}
+
+// WithRenameStrategy sets how updates that change the DNS name of a record are made. Defaults to RenameUpdate.
+func WithRenameStrategy(strategy RenameStrategy) Option {
+	return func(p *unboundProvider) {
+		p.renameStrategy = strategy
+	}
+}
+
+// WithFixDanglingAliases re-points the aliases targeting the old name of a record renamed in place to it.
+// OPNsense points aliases to their override by ID, so the aliases of the renamed override follow it anyway;
+// this also re-points aliases left targeting the name after their own override was deleted, and saves every
+// one of them with the new name. Otherwise they are logged and counted.
+func WithFixDanglingAliases() Option {
+	return func(p *unboundProvider) {
+		p.fixDangling = true
+	}
+}
+
+// renamed tells whether an update from oldEP to newEP changes the DNS name.
+func renamed(oldEP, newEP *endpoint.Endpoint) bool {
+	return state.Normalize(oldEP.DNSName) != state.Normalize(newEP.DNSName)
+}
+
+// recreateA creates the override of newEP, re-points the aliases of the override of oldEP to it,
+// then deletes the latter, unless deletes are disabled.
+func (s *applyState) recreateA(oldEP, newEP *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "rename"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+		ho, ok := s.state.HostOverride(oldEP.DNSName)
+		if !ok {
+			s.createInstead(logger, newEP)
+			return s.createA(newEP)(ctx)
+		}
+
+		if err := s.createA(newEP)(ctx); err != nil {
+			return err
+		}
+		created, ok := s.state.HostOverride(newEP.DNSName)
+		if !ok {
+			return fmt.Errorf("failed to rename host override: %s not found once created", newEP.DNSName)
+		}
+
+		for _, ha := range s.state.HostAliasesOf(ho.ID) {
+			if err := s.repointAlias(ctx, logger, ha, created); err != nil {
+				return err
+			}
+		}
+
+		if s.disableDeletes {
+			skipDelete(logger, metrics.For(s.webhook), oldEP)
+			return nil
+		}
+		return s.deleteA(oldEP)(ctx)
+	}
+}
+
+// followRename re-points aliases, which targeted the old name of ho before it was renamed in place, to ho
+// when dangling aliases are fixed, or else logs and counts them.
+func (s *applyState) followRename(ctx context.Context, logger *slog.Logger, aliases []unbound.HostAlias, ho unbound.HostOverride) error {
+	for _, ha := range aliases {
+		if !s.fixDangling {
+			s.warnDangling(logger, ha, ho)
+			continue
+		}
+		if err := s.repointAlias(ctx, logger, ha, ho); err != nil {
+			return err
+		}
+		metrics.For(s.webhook).DanglingAliases.WithLabelValues("repointed").Inc()
+	}
+	return nil
+}
+
+// warnDangling logs and counts ha, which targeted the old name of ho before it was renamed in place.
+func (s *applyState) warnDangling(logger *slog.Logger, ha unbound.HostAlias, ho unbound.HostOverride) {
+	logger.Warn("alias targeted the old name of a renamed record, external-dns may plan to point it back",
+		slog.String("alias", ha.DNSName()), slog.String("target", ho.DNSName()),
+		slog.Bool("followed", ha.HostID == ho.ID))
+	metrics.For(s.webhook).DanglingAliases.WithLabelValues("warned").Inc()
+}
+
+// repointAlias points ha to the override ho.
+func (s *applyState) repointAlias(ctx context.Context, logger *slog.Logger, ha unbound.HostAlias, ho unbound.HostOverride) error {
+	// Re-read the alias, so that the fields external-dns doesn't manage are kept as they are now
+	current, err := s.api.GetHostAlias(ctx, ha.ID)
+	if err == nil {
+		current.HostID = ho.ID
+		current.Host = ho.DNSName()
+		err = s.api.UpdateHostAlias(ctx, current)
+	}
+	if errors.Is(err, unbound.ErrNotFound) {
+		logger.Info("Host Alias deleted meanwhile", slog.Any("hostAlias", ha))
+		s.state.DeleteHostAlias(ha)
+		return nil
+	}
+	if err != nil {
+		logger.Error("failed to re-point host alias", slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
+		return fmt.Errorf("failed to re-point host alias: %w", err)
+	}
+
+	logger.Debug("re-pointed Host Alias", slog.Any("hostAlias", current), slog.Any("hostOverride", ho))
+	s.add("updated", endpoint.RecordTypeCNAME)
+	s.state.PutHostAlias(current)
+	return nil
+}
+
+// recreateCNAME creates the alias of newEP, then deletes the alias of oldEP, unless deletes are disabled.
+func (s *applyState) recreateCNAME(oldEP, newEP *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "rename"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+		if _, ok := s.state.HostAlias(oldEP.DNSName); !ok {
+			s.createInstead(logger, newEP)
+			return s.createCNAME(newEP)(ctx)
+		}
+
+		if err := s.createCNAME(newEP)(ctx); err != nil {
+			return err
+		}
+
+		if s.disableDeletes {
+			skipDelete(logger, metrics.For(s.webhook), oldEP)
+			return nil
+		}
+		return s.deleteCNAME(oldEP)(ctx)
+	}
+}
+
+// recreateA is applyState.recreateA for bulk applies.
+func (b *bulkApply) recreateA(oldEP, newEP *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "rename"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+	ho, ok := b.state.HostOverride(oldEP.DNSName)
+	if !ok {
+		b.createInstead(logger, newEP)
+		return b.createA(newEP)
+	}
+
+	if err := b.createA(newEP); err != nil {
+		return err
+	}
+	created, ok := b.state.HostOverride(newEP.DNSName)
+	if !ok {
+		return fmt.Errorf("failed to rename host override: %s not found once created", newEP.DNSName)
+	}
+
+	for _, ha := range b.state.HostAliasesOf(ho.ID) {
+		current, ok := b.settings.HostAlias(ha.ID)
+		if !ok {
+			logger.Info("Host Alias deleted meanwhile", slog.Any("hostAlias", ha))
+			b.state.DeleteHostAlias(ha)
+			continue
+		}
+		current.HostID = created.ID
+		current.Host = created.DNSName()
+		b.settings.PutHostAlias(current)
+		b.stats.add("updated", endpoint.RecordTypeCNAME)
+		b.state.PutHostAlias(current)
+	}
+
+	if b.disableDeletes {
+		skipDelete(logger, metrics.For(b.webhook), oldEP)
+		return nil
+	}
+	return b.deleteA(oldEP)
+}
+
+// followRename is applyState.followRename for bulk applies.
+func (b *bulkApply) followRename(logger *slog.Logger, aliases []unbound.HostAlias, ho unbound.HostOverride) {
+	for _, ha := range aliases {
+		if !b.fixDangling {
+			b.warnDangling(logger, ha, ho)
+			continue
+		}
+		current, ok := b.settings.HostAlias(ha.ID)
+		if !ok {
+			logger.Info("Host Alias deleted meanwhile", slog.Any("hostAlias", ha))
+			b.state.DeleteHostAlias(ha)
+			continue
+		}
+		current.HostID = ho.ID
+		current.Host = ho.DNSName()
+		b.settings.PutHostAlias(current)
+		b.stats.add("updated", endpoint.RecordTypeCNAME)
+		b.state.PutHostAlias(current)
+		metrics.For(b.webhook).DanglingAliases.WithLabelValues("repointed").Inc()
+	}
+}
+
+// recreateCNAME is applyState.recreateCNAME for bulk applies.
+func (b *bulkApply) recreateCNAME(oldEP, newEP *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "rename"), slog.Any("oldEndpoint", oldEP), slog.Any("newEndpoint", newEP))
+
+	if _, ok := b.state.HostAlias(oldEP.DNSName); !ok {
+		b.createInstead(logger, newEP)
+		return b.createCNAME(newEP)
+	}
+
+	if err := b.createCNAME(newEP); err != nil {
+		return err
+	}
+
+	if b.disableDeletes {
+		skipDelete(logger, metrics.For(b.webhook), oldEP)
+		return nil
+	}
+	return b.deleteCNAME(oldEP)
+}
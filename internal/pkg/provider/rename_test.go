@@ -0,0 +1,244 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestRenameStrategy(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "old", Domain: "example.com", Server: "127.0.0.1", Description: "Old name"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "2", HostID: "1", Hostname: "www", Domain: "example.com", Host: "old.example.com"},
+			},
+		}
+	}
+
+	renameA := func() *plan.Changes {
+		return &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+		}
+	}
+
+	renameCNAME := func() *plan.Changes {
+		return &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "old.example.com")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeCNAME, "old.example.com")},
+		}
+	}
+
+	t.Run("updates renamed overrides in place by default", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameA()))
+
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, unbound.HostOverrideID("1"), fake.HostOverrides[0].ID)
+		require.Equal(t, "new.example.com", fake.HostOverrides[0].DNSName())
+		require.Equal(t, "Old name", fake.HostOverrides[0].Description)
+		require.Equal(t, unbound.HostOverrideID("1"), fake.HostAliases[0].HostID)
+	})
+
+	t.Run("updates renamed aliases in place by default", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameCNAME()))
+
+		require.Len(t, fake.HostAliases, 1)
+		require.Equal(t, unbound.HostAliasID("2"), fake.HostAliases[0].ID)
+		require.Equal(t, "web.example.com", fake.HostAliases[0].DNSName())
+	})
+
+	t.Run("recreates renamed overrides and re-points their aliases", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithRenameStrategy(RenameRecreate)(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameA()))
+
+		require.Len(t, fake.HostOverrides, 1)
+		created := fake.HostOverrides[0]
+		require.NotEqual(t, unbound.HostOverrideID("1"), created.ID)
+		require.Equal(t, "new.example.com", created.DNSName())
+		require.Empty(t, created.Description)
+
+		require.Len(t, fake.HostAliases, 1)
+		require.Equal(t, unbound.HostAliasID("2"), fake.HostAliases[0].ID)
+		require.Equal(t, created.ID, fake.HostAliases[0].HostID)
+		require.Equal(t, "new.example.com", fake.HostAliases[0].Host)
+
+		stats := provider.Status().LastApply
+		require.Equal(t, map[string]int{"A": 1}, stats.Created)
+		require.Equal(t, map[string]int{"A": 1}, stats.Deleted)
+		require.Equal(t, map[string]int{"CNAME": 1}, stats.Updated)
+	})
+
+	t.Run("recreates renamed aliases", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithRenameStrategy(RenameRecreate)(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameCNAME()))
+
+		require.Len(t, fake.HostAliases, 1)
+		require.NotEqual(t, unbound.HostAliasID("2"), fake.HostAliases[0].ID)
+		require.Equal(t, "web.example.com", fake.HostAliases[0].DNSName())
+		require.Equal(t, unbound.HostOverrideID("1"), fake.HostAliases[0].HostID)
+	})
+
+	t.Run("updates records that keep their name in place when recreating renames", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithRenameStrategy(RenameRecreate)(provider)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("OLD.example.com.", endpoint.RecordTypeA, "127.0.0.2")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverrideID("1"), fake.HostOverrides[0].ID)
+		require.Equal(t, "127.0.0.2", fake.HostOverrides[0].Server)
+	})
+
+	t.Run("keeps the old records when deletes are disabled", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithRenameStrategy(RenameRecreate)(provider)
+		WithDisableDeletes()(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameA()))
+
+		require.Len(t, fake.HostOverrides, 2)
+		require.Equal(t, fake.HostOverrides[1].ID, fake.HostAliases[0].HostID)
+	})
+
+	t.Run("recreates renamed overrides and re-points their aliases in bulk", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+		WithRenameStrategy(RenameRecreate)(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), renameA()))
+		require.Equal(t, 1, api.setCount())
+
+		require.Len(t, api.HostOverrides, 1)
+		created := api.HostOverrides[0]
+		require.NotEqual(t, unbound.HostOverrideID("1"), created.ID)
+		require.Equal(t, "new.example.com", created.DNSName())
+
+		require.Len(t, api.HostAliases, 1)
+		require.Equal(t, unbound.HostAliasID("2"), api.HostAliases[0].ID)
+		require.Equal(t, created.ID, api.HostAliases[0].HostID)
+	})
+
+	t.Run("parses strategies", func(t *testing.T) {
+		for _, name := range []string{"update", "recreate"} {
+			strategy, err := ParseRenameStrategy(name)
+			require.NoError(t, err)
+			require.Equal(t, RenameStrategy(name), strategy)
+		}
+
+		_, err := ParseRenameStrategy("rename")
+		require.Error(t, err)
+	})
+}
+
+func TestDanglingAliases(t *testing.T) {
+	// www follows the override it points to, api was left pointing to the override that had its name before
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "old", Domain: "example.com", Server: "127.0.0.1"},
+				{ID: "9", Hostname: "older", Domain: "example.com", Server: "127.0.0.9"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "2", HostID: "1", Hostname: "www", Domain: "example.com", Host: "old.example.com"},
+				{ID: "3", HostID: "9", Hostname: "api", Domain: "example.com", Host: "old.example.com"},
+			},
+		}
+	}
+
+	rename := func(from, to string) *plan.Changes {
+		return &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint(from, endpoint.RecordTypeA, "127.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint(to, endpoint.RecordTypeA, "127.0.0.1")},
+		}
+	}
+
+	dangling := func(action string) float64 {
+		return testutil.ToFloat64(metrics.Default.DanglingAliases.WithLabelValues(action))
+	}
+
+	t.Run("warns about aliases targeting the old name by default", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		warned := dangling("warned")
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), rename("old.example.com", "new.example.com")))
+
+		require.Equal(t, warned+2, dangling("warned"))
+		require.Equal(t, unbound.HostOverrideID("9"), fake.HostAliases[1].HostID)
+		level, attrs, ok := logs.find("alias targeted the old name of a renamed record, external-dns may plan to point it back")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "www.example.com", attrs["alias"].String())
+		require.True(t, attrs["followed"].Bool())
+	})
+
+	t.Run("re-points them when fixing dangling aliases", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithFixDanglingAliases()(provider)
+		repointed := dangling("repointed")
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), rename("old.example.com", "new.example.com")))
+
+		require.Equal(t, repointed+2, dangling("repointed"))
+		for _, ha := range fake.HostAliases {
+			require.Equal(t, unbound.HostOverrideID("1"), ha.HostID, ha.DNSName())
+			require.Equal(t, "new.example.com", ha.Host, ha.DNSName())
+		}
+	})
+
+	t.Run("follows renames of renames", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+		WithFixDanglingAliases()(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), rename("old.example.com", "new.example.com")))
+		require.NoError(t, provider.ApplyChanges(context.Background(), rename("new.example.com", "newer.example.com")))
+
+		for _, ha := range fake.HostAliases {
+			require.Equal(t, unbound.HostOverrideID("1"), ha.HostID, ha.DNSName())
+			require.Equal(t, "newer.example.com", ha.Host, ha.DNSName())
+		}
+	})
+
+	t.Run("re-points them in bulk", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := &unboundProvider{api: api, bulkThreshold: 1}
+		WithFixDanglingAliases()(provider)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), rename("old.example.com", "new.example.com")))
+		require.Equal(t, 1, api.setCount())
+
+		for _, ha := range api.HostAliases {
+			require.Equal(t, unbound.HostOverrideID("1"), ha.HostID, ha.DNSName())
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Resolver looks up the IP addresses of hostnames, as net.Resolver does.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// NewResolver returns a resolver querying the DNS server at address, such as 192.168.1.1:53.
+// An empty address resolves as the system does.
+func NewResolver(address string) Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// WithHostnameResolution makes AdjustEndpoints replace the targets of A and AAAA endpoints that are hostnames
+// by their lowest address, looked up with resolver within timeout and cached for ttl.
+// Endpoints with a target that fails to resolve are left out.
+func WithHostnameResolution(resolver Resolver, timeout, ttl time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.resolver = &targetResolver{resolver: resolver, timeout: timeout, ttl: ttl}
+	}
+}
+
+// targetResolver resolves hostname targets, caching the addresses resolved.
+type targetResolver struct {
+	resolver Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[resolvedKey]resolvedAddr
+}
+
+type resolvedKey struct {
+	network string
+	host    string
+}
+
+type resolvedAddr struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+// resolve returns the lowest address of host in network, ip4 or ip6. The lowest rather than the first
+// returned, so that the target doesn't change between syncs when the resolver shuffles addresses.
+func (r *targetResolver) resolve(now time.Time, network, host string) (netip.Addr, error) {
+	key := resolvedKey{network: network, host: host}
+
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.addr, nil
+	}
+
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	addrs, err := r.resolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}, fmt.Errorf("no addresses found for %s", host)
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	addr := slices.MinFunc(addrs, netip.Addr.Compare)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = map[resolvedKey]resolvedAddr{}
+	}
+	r.cache[key] = resolvedAddr{addr: addr, expires: now.Add(r.ttl)}
+	return addr, nil
+}
+
+// resolveTargets replaces the hostname targets of A and AAAA endpoints by their address,
+// and leaves out the endpoints with a target that fails to resolve.
+func (u *unboundProvider) resolveTargets(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	now := time.Now()
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		network := "ip4"
+		switch e.RecordType {
+		case endpoint.RecordTypeA:
+		case endpoint.RecordTypeAAAA:
+			network = "ip6"
+		default:
+			kept = append(kept, e)
+			continue
+		}
+
+		resolved := make(endpoint.Targets, 0, len(e.Targets))
+		var err error
+		for _, target := range e.Targets {
+			if _, parseErr := netip.ParseAddr(target); parseErr == nil {
+				resolved = append(resolved, target)
+				continue
+			}
+
+			var addr netip.Addr
+			if addr, err = u.resolver.resolve(now, network, target); err != nil {
+				metrics.For(u.webhook).EndpointAdjustments.WithLabelValues(adjustDropUnresolved).Inc()
+				u.log().Warn("ignoring record with a target that failed to resolve",
+					slog.String("dnsName", e.DNSName), slog.String("target", target), slog.Any("error", err))
+				break
+			}
+			u.recordAdjustment(e, adjustResolveTarget, target, addr.String())
+			if !slices.Contains(resolved, addr.String()) {
+				resolved = append(resolved, addr.String())
+			}
+		}
+		if err != nil {
+			continue
+		}
+		e.Targets = resolved
+		kept = append(kept, e)
+	}
+	return kept
+}
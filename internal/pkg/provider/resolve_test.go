@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// fakeResolver resolves hostnames from a table, in the order given.
+type fakeResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]string
+	lookups int
+}
+
+func (f *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lookups++
+	var addrs []netip.Addr
+	for _, s := range f.hosts[host] {
+		addr := netip.MustParseAddr(s)
+		if (network == "ip4") == addr.Is4() {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func (f *fakeResolver) lookupCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups
+}
+
+func TestHostnameResolution(t *testing.T) {
+	resolving := func(resolver Resolver, ttl time.Duration) *unboundProvider {
+		provider := &unboundProvider{api: &unboundtest.Fake{}}
+		WithHostnameResolution(resolver, time.Second, ttl)(provider)
+		return provider
+	}
+
+	t.Run("replaces hostname targets by their lowest address", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: map[string][]string{
+			"home.dyndns.example.org": {"203.0.113.20", "2001:db8::1", "203.0.113.10"},
+		}}
+		provider := resolving(resolver, time.Minute)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("home.example.com", endpoint.RecordTypeA, "home.dyndns.example.org"),
+			endpoint.NewEndpoint("v6.example.com", endpoint.RecordTypeAAAA, "home.dyndns.example.org"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "home.example.com"),
+		})
+		require.NoError(t, err)
+		require.Len(t, adjusted, 4)
+		require.Equal(t, endpoint.NewTargets("203.0.113.10"), adjusted[0].Targets)
+		require.Equal(t, endpoint.NewTargets("2001:db8::1"), adjusted[1].Targets)
+		require.Equal(t, endpoint.NewTargets("192.168.1.10"), adjusted[2].Targets)
+		require.Equal(t, endpoint.NewTargets("home.example.com"), adjusted[3].Targets)
+	})
+
+	t.Run("resolves to the same address whatever the order of the answer", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: map[string][]string{"lb.example.org": {"203.0.113.20", "203.0.113.10"}}}
+		provider := resolving(resolver, 0)
+
+		first, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "lb.example.org")})
+		require.NoError(t, err)
+
+		resolver.mu.Lock()
+		resolver.hosts["lb.example.org"] = []string{"203.0.113.10", "203.0.113.20"}
+		resolver.mu.Unlock()
+
+		second, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "lb.example.org")})
+		require.NoError(t, err)
+		require.Equal(t, first[0].Targets, second[0].Targets)
+		require.Equal(t, 2, resolver.lookupCount())
+	})
+
+	t.Run("caches resolved addresses", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: map[string][]string{"lb.example.org": {"203.0.113.10"}}}
+		provider := resolving(resolver, time.Minute)
+
+		for range 3 {
+			_, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "lb.example.org")})
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, resolver.lookupCount())
+
+		_, err := provider.resolver.resolve(time.Now().Add(time.Minute), "ip4", "lb.example.org")
+		require.NoError(t, err)
+		require.Equal(t, 2, resolver.lookupCount())
+	})
+
+	t.Run("leaves out endpoints with a target that fails to resolve", func(t *testing.T) {
+		logs := recordLogs(t)
+		resolver := &fakeResolver{hosts: map[string][]string{"lb.example.org": {"203.0.113.10"}}}
+		provider := resolving(resolver, time.Minute)
+		dropped := testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustDropUnresolved))
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "lb.example.org", "gone.example.org"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"nas.example.com"}, dnsNames(adjusted))
+		require.Equal(t, dropped+1, testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustDropUnresolved)))
+
+		_, attrs, ok := logs.find("ignoring record with a target that failed to resolve")
+		require.True(t, ok)
+		require.Equal(t, "gone.example.org", attrs["target"].String())
+
+		_, err = provider.resolver.resolve(time.Now(), "ip4", "gone.example.org")
+		require.Error(t, err)
+		require.Equal(t, 3, resolver.lookupCount(), "failures aren't cached")
+	})
+
+	t.Run("gives up resolving after the timeout", func(t *testing.T) {
+		provider := resolving(blockingResolver{}, 0)
+		provider.resolver.timeout = 10 * time.Millisecond
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "lb.example.org")})
+		require.NoError(t, err)
+		require.Empty(t, adjusted)
+	})
+
+	t.Run("rewrites resolved addresses", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: map[string][]string{"home.dyndns.example.org": {"203.0.113.10"}}}
+		provider := resolving(resolver, time.Minute)
+		rewrite, err := ParseTargetRewrite("203.0.113.0/24=192.168.10.5")
+		require.NoError(t, err)
+		WithTargetRewrites([]TargetRewrite{rewrite})(provider)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("home.example.com", endpoint.RecordTypeA, "home.dyndns.example.org"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("192.168.10.5"), adjusted[0].Targets)
+	})
+}
+
+// blockingResolver never answers before ctx is done.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupNetIP(ctx context.Context, _, _ string) ([]netip.Addr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
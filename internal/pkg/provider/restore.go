@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ErrNotSoftDeleted is returned when restoring a record that external-dns didn't soft-delete.
+var ErrNotSoftDeleted = errors.New("record not soft-deleted by external-dns")
+
+// RestoredRecord is a soft-deleted record enabled again by Restore, or to be in a dry run.
+type RestoredRecord struct {
+	Instance   string `json:"instance,omitempty"`
+	DNSName    string `json:"dnsName"`
+	RecordType string `json:"recordType"`
+}
+
+// Restore enables the soft-deleted records named names again, or every soft-deleted record when names is empty,
+// strips the deletion tag off their description and reconfigures Unbound. Nothing is restored if any of names
+// has no record, or only records external-dns didn't soft-delete. A dry run only returns the records to restore;
+// it is the only one allowed in read-only mode.
+func (p *unboundProvider) Restore(ctx context.Context, names []string, dryRun bool) ([]RestoredRecord, error) {
+	if p.readOnly != "" && !dryRun {
+		return nil, ErrReadOnly
+	}
+
+	snap, err := p.listSnapshot(ctx, p.api)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+
+	overrides, aliases, err := softDeletedRecords(snap.state, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []RestoredRecord
+	if dryRun {
+		for _, ho := range overrides {
+			restored = append(restored, RestoredRecord{DNSName: ho.DNSName(), RecordType: endpoint.RecordTypeA})
+		}
+		for _, ha := range aliases {
+			restored = append(restored, RestoredRecord{DNSName: ha.DNSName(), RecordType: endpoint.RecordTypeCNAME})
+		}
+		return restored, nil
+	}
+
+	// Overrides first, so that restored aliases point to enabled records
+	var errs []error
+	restoredOverrides := map[unbound.HostOverrideID]bool{}
+	for _, ho := range overrides {
+		if err := p.restoreHostOverride(ctx, ho); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		restoredOverrides[ho.ID] = true
+		restored = append(restored, RestoredRecord{DNSName: ho.DNSName(), RecordType: endpoint.RecordTypeA})
+	}
+	for _, ha := range aliases {
+		if err := p.restoreHostAlias(ctx, ha); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ho, ok := snap.state.HostOverrideByID(ha.HostID); ok && overrideSoftDeleted(ho) && !restoredOverrides[ho.ID] {
+			p.log().Warn("restored Host Alias points to a soft-deleted Host Override",
+				slog.Any("hostAlias", ha), slog.Any("hostOverride", ho))
+		}
+		restored = append(restored, RestoredRecord{DNSName: ha.DNSName(), RecordType: endpoint.RecordTypeCNAME})
+	}
+
+	if len(restored) > 0 {
+		if p.cache != nil {
+			p.cache.invalidate("manual")
+		}
+		if p.snapshots != nil {
+			p.snapshots.invalidate()
+		}
+		if err := p.api.Reconfigure(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reconfigure Unbound: %w", err))
+		}
+	}
+	return restored, errors.Join(errs...)
+}
+
+// softDeletedRecords returns the soft-deleted records of st named names, or all of them when names is empty.
+func softDeletedRecords(st *state.State, names []string) ([]unbound.HostOverride, []unbound.HostAlias, error) {
+	var overrides []unbound.HostOverride
+	var aliases []unbound.HostAlias
+	if len(names) == 0 {
+		for _, ho := range st.HostOverrides() {
+			if overrideSoftDeleted(ho) {
+				overrides = append(overrides, ho)
+			}
+		}
+		for _, ha := range st.HostAliases() {
+			if aliasSoftDeleted(ha) {
+				aliases = append(aliases, ha)
+			}
+		}
+		return overrides, aliases, nil
+	}
+
+	var errs []error
+	for _, name := range names {
+		ho, hasOverride := st.HostOverride(name)
+		ha, hasAlias := st.HostAlias(name)
+		switch {
+		case hasOverride && overrideSoftDeleted(ho):
+			overrides = append(overrides, ho)
+		case hasAlias && aliasSoftDeleted(ha):
+			aliases = append(aliases, ha)
+		case hasOverride || hasAlias:
+			errs = append(errs, fmt.Errorf("%s: %w", name, ErrNotSoftDeleted))
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", name, unbound.ErrNotFound))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return overrides, aliases, nil
+}
+
+// restoreHostOverride strips the deletion tag off the description of ho, then enables it.
+func (p *unboundProvider) restoreHostOverride(ctx context.Context, ho unbound.HostOverride) error {
+	current, err := p.api.GetHostOverride(ctx, ho.ID)
+	if err == nil {
+		current.Description = untagSoftDeleted(current.Description)
+		err = p.api.UpdateHostOverride(ctx, current)
+	}
+	if err == nil {
+		err = p.api.ToggleHostOverride(ctx, ho.ID, true)
+	}
+	if err != nil {
+		p.log().Error("failed to restore soft-deleted host override", slog.Any("hostOverride", ho), slog.Any("error", err))
+		return fmt.Errorf("failed to restore %s: %w", ho.DNSName(), err)
+	}
+	p.log().Info("restored soft-deleted Host Override", slog.Any("hostOverride", current))
+	return nil
+}
+
+// restoreHostAlias strips the deletion tag off the description of ha, then enables it.
+func (p *unboundProvider) restoreHostAlias(ctx context.Context, ha unbound.HostAlias) error {
+	current, err := p.api.GetHostAlias(ctx, ha.ID)
+	if err == nil {
+		current.Description = untagSoftDeleted(current.Description)
+		err = p.api.UpdateHostAlias(ctx, current)
+	}
+	if err == nil {
+		err = p.api.ToggleHostAlias(ctx, ha.ID, true)
+	}
+	if err != nil {
+		p.log().Error("failed to restore soft-deleted host alias", slog.Any("hostAlias", ha), slog.Any("error", err))
+		return fmt.Errorf("failed to restore %s: %w", ha.DNSName(), err)
+	}
+	p.log().Info("restored soft-deleted Host Alias", slog.Any("hostAlias", current))
+	return nil
+}
@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestRestore(t *testing.T) {
+	deletedAt := time.Now().Add(-time.Hour)
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: tagSoftDeleted("NAS", deletedAt, ""), Enabled: "0"},
+				{ID: "2", Hostname: "vpn", Domain: "example.com", Server: "192.168.1.2", Description: tagSoftDeleted("", deletedAt, ""), Enabled: "0"},
+				{ID: "3", Hostname: "printer", Domain: "example.com", Server: "192.168.1.20", Description: "Disabled by hand", Enabled: "0"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "4", HostID: "2", Hostname: "wg", Domain: "example.com", Host: "vpn.example.com", Description: tagSoftDeleted("", deletedAt, ""), Enabled: "0"},
+			},
+		}
+	}
+
+	enabled := func(fake *unboundtest.Fake) map[string]string {
+		records := map[string]string{}
+		for _, ho := range fake.HostOverrides {
+			records[ho.DNSName()] = ho.Enabled
+		}
+		for _, ha := range fake.HostAliases {
+			records[ha.DNSName()] = ha.Enabled
+		}
+		return records
+	}
+
+	t.Run("restores records by name", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		restored, err := provider.Restore(context.Background(), []string{"NAS.example.com."}, false)
+		require.NoError(t, err)
+		require.Equal(t, []RestoredRecord{{DNSName: "nas.example.com", RecordType: endpoint.RecordTypeA}}, restored)
+		require.Equal(t, map[string]string{
+			"nas.example.com":     "1",
+			"vpn.example.com":     "0",
+			"printer.example.com": "0",
+			"wg.example.com":      "0",
+		}, enabled(fake))
+		require.Equal(t, "NAS", fake.HostOverrides[0].Description)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("restores every soft-deleted record", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		restored, err := provider.Restore(context.Background(), nil, false)
+		require.NoError(t, err)
+		require.Equal(t, []RestoredRecord{
+			{DNSName: "nas.example.com", RecordType: endpoint.RecordTypeA},
+			{DNSName: "vpn.example.com", RecordType: endpoint.RecordTypeA},
+			{DNSName: "wg.example.com", RecordType: endpoint.RecordTypeCNAME},
+		}, restored)
+		require.Equal(t, map[string]string{
+			"nas.example.com":     "1",
+			"vpn.example.com":     "1",
+			"printer.example.com": "0",
+			"wg.example.com":      "1",
+		}, enabled(fake))
+		require.Empty(t, fake.HostAliases[0].Description)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("refuses records not soft-deleted by external-dns", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		_, err := provider.Restore(context.Background(), []string{"nas.example.com", "printer.example.com", "gone.example.com"}, false)
+		require.ErrorIs(t, err, ErrNotSoftDeleted)
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		require.ErrorContains(t, err, "printer.example.com")
+		require.ErrorContains(t, err, "gone.example.com")
+		require.Equal(t, enabled(existing()), enabled(fake), "nothing is restored")
+		require.Zero(t, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("only lists records to restore in a dry run", func(t *testing.T) {
+		fake := existing()
+		provider := &unboundProvider{api: fake}
+
+		restored, err := provider.Restore(context.Background(), []string{"wg.example.com"}, true)
+		require.NoError(t, err)
+		require.Equal(t, []RestoredRecord{{DNSName: "wg.example.com", RecordType: endpoint.RecordTypeCNAME}}, restored)
+		require.Equal(t, existing().HostAliases, fake.HostAliases)
+		require.Zero(t, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("warns of aliases restored without their record", func(t *testing.T) {
+		logs := recordLogs(t)
+		provider := &unboundProvider{api: existing()}
+
+		_, err := provider.Restore(context.Background(), []string{"wg.example.com"}, false)
+		require.NoError(t, err)
+		level, _, ok := logs.find("restored Host Alias points to a soft-deleted Host Override")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+	})
+
+	t.Run("restores on the instance serving each name", func(t *testing.T) {
+		home, lab := existing(), &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "k8s", Domain: "lab.example.com", Server: "10.0.0.1", Description: tagSoftDeleted("", deletedAt, ""), Enabled: "0"},
+		}}
+		multi := &multiProvider{logger: slog.Default(), instances: []*instance{
+			{unboundProvider: &unboundProvider{api: home}, name: "home", domains: []string{"example.com"}},
+			{unboundProvider: &unboundProvider{api: lab}, name: "lab", domains: []string{"lab.example.com"}},
+		}}
+
+		restored, err := multi.Restore(context.Background(), []string{"k8s.lab.example.com"}, false)
+		require.NoError(t, err)
+		require.Equal(t, []RestoredRecord{{Instance: "lab", DNSName: "k8s.lab.example.com", RecordType: endpoint.RecordTypeA}}, restored)
+		require.Equal(t, "1", lab.HostOverrides[0].Enabled)
+		require.Zero(t, home.Calls("ListHostOverrides"))
+
+		_, err = multi.Restore(context.Background(), []string{"nas.example.org"}, false)
+		require.ErrorContains(t, err, "no instance serves")
+	})
+}
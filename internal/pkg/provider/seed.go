@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// Seed makes sure the records seeds, such as those of a RecordsFile, exist in Unbound as they are, creating
+// or updating them in a single apply, whatever external-dns plans. From then on ApplyChanges refuses
+// external-dns changes to records with a seeded DNS name, favoring the seed, so that they are never deleted.
+// Each call replaces the seeds of the previous one; records no longer seeded are left in Unbound as they are.
+func (p *unboundProvider) Seed(ctx context.Context, seeds []*endpoint.Endpoint) error {
+	names := make(map[string]bool, len(seeds))
+	for _, ep := range seeds {
+		names[state.Normalize(ep.DNSName)] = true
+	}
+	p.seedMu.Lock()
+	p.seeds = names
+	p.seedMu.Unlock()
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	// Listing first, so that descriptions left as they are get adjusted against the records listed
+	current, err := p.Records(WithFreshRecords(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to list records to seed: %w", err)
+	}
+	desired, err := p.adjustEndpoints(seeds)
+	if err != nil {
+		return err
+	}
+	if len(desired) < len(seeds) {
+		p.log().Warn("some seed records were dropped by the domain filter, exclusions or allowed targets",
+			slog.Int("seeds", len(seeds)), slog.Int("kept", len(desired)))
+	}
+
+	filter := p.GetDomainFilter()
+	changes := (&plan.Plan{
+		Current:        current,
+		Desired:        desired,
+		Policies:       []plan.Policy{&plan.UpsertOnlyPolicy{}},
+		DomainFilter:   endpoint.MatchAllDomainFilters{&filter},
+		ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeCNAME},
+	}).Calculate().Changes
+	if !changes.HasChanges() {
+		p.log().Info("seed records up to date", slog.Int("seeds", len(desired)))
+		return nil
+	}
+
+	p.log().Info("seeding records", slog.Int("created", len(changes.Create)), slog.Int("updated", len(changes.UpdateNew)))
+	return p.applyAll(ctx, changes)
+}
+
+// isSeeded tells whether dnsName is the name of a seed record.
+func (p *unboundProvider) isSeeded(dnsName string) bool {
+	p.seedMu.RLock()
+	defer p.seedMu.RUnlock()
+	return p.seeds[state.Normalize(dnsName)]
+}
+
+// hasSeeds tells whether any record is seeded.
+func (p *unboundProvider) hasSeeds() bool {
+	p.seedMu.RLock()
+	defer p.seedMu.RUnlock()
+	return len(p.seeds) > 0
+}
+
+// refuseSeeded returns changes without the ones to seed records, logging and counting each of them.
+// Updates are refused when either the old or the new DNS name is seeded.
+func (p *unboundProvider) refuseSeeded(changes *plan.Changes) *plan.Changes {
+	refuse := func(op string, ep *endpoint.Endpoint) {
+		p.log().Warn("external-dns change conflicts with a seed record, keeping the seed",
+			slog.String("op", op), slog.Any("endpoint", ep))
+		metrics.For(p.webhook).SeedConflicts.WithLabelValues(op).Inc()
+	}
+
+	allowed := &plan.Changes{}
+	for _, ep := range changes.Create {
+		if p.isSeeded(ep.DNSName) {
+			refuse("create", ep)
+			continue
+		}
+		allowed.Create = append(allowed.Create, ep)
+	}
+	for i, oldEP := range changes.UpdateOld {
+		newEP := changes.UpdateNew[i]
+		if p.isSeeded(oldEP.DNSName) || p.isSeeded(newEP.DNSName) {
+			refuse("update", newEP)
+			continue
+		}
+		allowed.UpdateOld = append(allowed.UpdateOld, oldEP)
+		allowed.UpdateNew = append(allowed.UpdateNew, newEP)
+	}
+	for _, ep := range changes.Delete {
+		if p.isSeeded(ep.DNSName) {
+			refuse("delete", ep)
+			continue
+		}
+		allowed.Delete = append(allowed.Delete, ep)
+	}
+	return allowed
+}
@@ -0,0 +1,142 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestSeed(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.9", Description: "NAS", Enabled: "1"},
+				{ID: "2", Hostname: "app", Domain: "example.com", Server: "10.0.0.1", Enabled: "1"},
+			},
+		}
+	}
+
+	seeds := func() []*endpoint.Endpoint {
+		router := endpoint.NewEndpoint("router.example.com", endpoint.RecordTypeA, "192.168.1.1")
+		router.SetProviderSpecificProperty(unbound.DescriptionProperty, "Router")
+		return []*endpoint.Endpoint{
+			router,
+			endpoint.NewEndpoint("NAS.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+		}
+	}
+
+	seeding := func(t *testing.T, fake *unboundtest.Fake) *unboundProvider {
+		t.Helper()
+		provider, err := NewUnboundProviderWithAPI(fake)
+		require.NoError(t, err)
+		require.NoError(t, provider.Seed(context.Background(), seeds()))
+		return provider
+	}
+
+	servers := func(fake *unboundtest.Fake) map[string]string {
+		records := map[string]string{}
+		for _, ho := range fake.HostOverrides {
+			records[ho.DNSName()] = ho.Server + " " + ho.Description
+		}
+		for _, ha := range fake.HostAliases {
+			records[ha.DNSName()] = ha.Host + " " + ha.Description
+		}
+		return records
+	}
+
+	t.Run("creates and updates seed records in a single apply", func(t *testing.T) {
+		fake := existing()
+		seeding(t, fake)
+
+		require.Equal(t, map[string]string{
+			"nas.example.com":    "192.168.1.10 NAS",
+			"app.example.com":    "10.0.0.1 ",
+			"router.example.com": "192.168.1.1 Router",
+			"files.example.com":  "nas.example.com ",
+		}, servers(fake))
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("leaves seed records up to date alone", func(t *testing.T) {
+		fake := existing()
+		provider := seeding(t, fake)
+
+		require.NoError(t, provider.Seed(context.Background(), seeds()))
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("refuses external-dns changes to seed records", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := existing()
+		provider := seeding(t, fake)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("web.example.com", endpoint.RecordTypeA, "10.0.0.2")},
+			UpdateOld: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "10.0.0.5"),
+				endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "10.0.0.3"),
+			},
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("router.example.com", endpoint.RecordTypeA, "192.168.1.1"),
+				endpoint.NewEndpoint("files.example.com", endpoint.RecordTypeCNAME, "nas.example.com"),
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"nas.example.com":    "192.168.1.10 NAS",
+			"app.example.com":    "10.0.0.3 ",
+			"router.example.com": "192.168.1.1 Router",
+			"files.example.com":  "nas.example.com ",
+			"web.example.com":    "10.0.0.2 ",
+		}, servers(fake))
+
+		level, attrs, ok := logs.find("external-dns change conflicts with a seed record, keeping the seed")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "update", attrs["op"].String())
+	})
+
+	t.Run("stops protecting records no longer seeded", func(t *testing.T) {
+		fake := existing()
+		provider := seeding(t, fake)
+		require.NoError(t, provider.Seed(context.Background(), nil))
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("router.example.com", endpoint.RecordTypeA, "192.168.1.1")},
+		})
+		require.NoError(t, err)
+		require.NotContains(t, servers(fake), "router.example.com")
+	})
+
+	t.Run("seeds each instance its records", func(t *testing.T) {
+		home, lab := existing(), &unboundtest.Fake{}
+		multi := &multiProvider{logger: slog.Default(), instances: []*instance{
+			{unboundProvider: &unboundProvider{api: home}, name: "home", domains: []string{"example.com"}},
+			{unboundProvider: &unboundProvider{api: lab}, name: "lab", domains: []string{"lab.example.com"}},
+		}}
+
+		err := multi.Seed(context.Background(), []*endpoint.Endpoint{
+			endpoint.NewEndpoint("router.example.com", endpoint.RecordTypeA, "192.168.1.1"),
+			endpoint.NewEndpoint("k8s.lab.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		})
+		require.NoError(t, err)
+		require.Contains(t, servers(home), "router.example.com")
+		require.Equal(t, map[string]string{"k8s.lab.example.com": "10.0.0.1 "}, servers(lab))
+
+		err = multi.Seed(context.Background(), []*endpoint.Endpoint{
+			endpoint.NewEndpoint("router.example.org", endpoint.RecordTypeA, "192.168.1.1"),
+		})
+		require.ErrorContains(t, err, "no instance serves")
+	})
+}
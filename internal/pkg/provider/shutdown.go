@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Shutdown waits for the apply in progress, if any, runs the Unbound reconfigure still pending, and closes
+// the journal file, so that the process can exit without leaving changes saved but not served.
+// It gives up once ctx is done.
+func (p *unboundProvider) Shutdown(ctx context.Context) error {
+	applied := make(chan struct{})
+	go func() {
+		p.applyMu.Lock()
+		p.applyMu.Unlock()
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-ctx.Done():
+		return fmt.Errorf("apply still in progress: %w", ctx.Err())
+	}
+
+	var errs []error
+	if p.reconfigurer != nil {
+		if p.reconfigurer.Pending() {
+			p.log().Info("reconfiguring unbound before shutting down")
+		}
+		if err := p.reconfigurer.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.journal != nil {
+		if err := p.journal.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.notifier != nil {
+		if err := p.notifier.wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts every instance down, see unboundProvider.Shutdown.
+func (m *multiProvider) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(m.instances))
+	m.each(func(i int, in *instance) {
+		if err := in.Shutdown(ctx); err != nil {
+			errs[i] = fmt.Errorf("instance %s: %w", in.name, err)
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+// gatedAPI holds creates of host overrides until released.
+type gatedAPI struct {
+	*unboundtest.Fake
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g gatedAPI) CreateHostOverride(ctx context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	close(g.started)
+	<-g.release
+	return g.Fake.CreateHostOverride(ctx, ho)
+}
+
+func TestShutdown(t *testing.T) {
+	// applying starts an apply held until released, with the reconfigure debounced past the end of the test
+	applying := func(t *testing.T) (*unboundtest.Fake, *unboundProvider, chan struct{}, chan error) {
+		fake := &unboundtest.Fake{}
+		api := gatedAPI{Fake: fake, started: make(chan struct{}), release: make(chan struct{})}
+		provider := &unboundProvider{api: api, reconfigurer: newReconfigurer(fake, time.Hour, 3, slog.Default())}
+
+		applied := make(chan error, 1)
+		go func() { applied <- provider.ApplyChanges(context.Background(), createChanges("a.example.com")) }()
+		<-api.started
+		return fake, provider, api.release, applied
+	}
+
+	t.Run("waits for the apply in progress and runs the pending reconfigure", func(t *testing.T) {
+		fake, provider, release, applied := applying(t)
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- provider.Shutdown(context.Background()) }()
+
+		select {
+		case <-shutdown:
+			t.Fatal("shut down before the apply finished")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(release)
+		require.NoError(t, <-shutdown)
+		require.NoError(t, <-applied)
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, 1, fake.Calls("Reconfigure"))
+		require.False(t, provider.reconfigurer.Pending())
+	})
+
+	t.Run("gives up on an apply outlasting the grace period", func(t *testing.T) {
+		fake, provider, release, applied := applying(t)
+		t.Cleanup(func() {
+			close(release)
+			<-applied
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, provider.Shutdown(ctx), context.DeadlineExceeded)
+		require.Zero(t, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("doesn't reconfigure without changes pending", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, time.Hour, 3, slog.Default())}
+
+		require.NoError(t, provider.Shutdown(context.Background()))
+		require.Zero(t, fake.Calls("Reconfigure"))
+	})
+
+	t.Run("closes the journal file", func(t *testing.T) {
+		provider, err := NewUnboundProviderWithAPI(&unboundtest.Fake{}, WithJournalFile(filepath.Join(t.TempDir(), "journal")))
+		require.NoError(t, err)
+
+		require.NoError(t, provider.Shutdown(context.Background()))
+		require.Nil(t, provider.journal.file)
+	})
+}
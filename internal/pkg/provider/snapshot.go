@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// snapshot is the state of OPNsense as listed at a point in time.
+// Only the ApplyChanges that takes a snapshot from the store may modify it.
+type snapshot struct {
+	state *state.State
+	taken time.Time
+
+	// fromFallback is set for snapshots listed from the fallback OPNsense
+	fromFallback bool
+}
+
+func (p *unboundProvider) listSnapshot(ctx context.Context, a unbound.API) (*snapshot, error) {
+	taken := time.Now()
+
+	if sa, ok := p.settingsLister(a); ok {
+		hostOverrides, hostAliases, err := p.listSettings(ctx, sa)
+		switch {
+		case err == nil:
+			return &snapshot{state: state.FromListing(hostOverrides, hostAliases), taken: taken}, nil
+		case isUnimplemented(err) || errors.Is(err, unbound.ErrBadResponse):
+			p.settingsListingUnsupported.Store(true)
+			p.log().Warn("can't list records from the Unbound settings, searching for them instead", slog.Any("error", err))
+		default:
+			p.log().Error("failed to list records from the Unbound settings", slog.Any("error", err))
+			return nil, fmt.Errorf("failed to list records: %w", err)
+		}
+	}
+
+	hostOverrides, err := a.ListHostOverrides(ctx)
+	if err != nil {
+		p.log().Error("failed to list A records", slog.Any("error", err))
+		return nil, fmt.Errorf("failed to list A records: %w", err)
+	}
+
+	var hostAliases [][]unbound.HostAlias
+	if p.aliases.shouldList(taken) {
+		hostAliases, err = p.listHostAliases(ctx, a, hostOverrides)
+		switch {
+		case isUnimplemented(err):
+			p.aliases.markUnavailable(taken, err, p.log())
+			hostAliases = nil
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	return &snapshot{state: state.FromListing(hostOverrides, hostAliases), taken: taken}, nil
+}
+
+// snapshotStore keeps the snapshot listed by the last Records call for the ApplyChanges that usually follows it.
+// Like recordsCache, it uses a generation to drop listings that started before an invalidation.
+type snapshotStore struct {
+	maxAge time.Duration
+
+	mu         sync.Mutex
+	snap       *snapshot
+	generation uint64
+}
+
+func (s *snapshotStore) currentGeneration() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+func (s *snapshotStore) put(generation uint64, snap *snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return
+	}
+	s.snap = snap
+}
+
+// take hands out the stored snapshot if it is younger than maxAge. Either way the store is emptied,
+// so that a snapshot is used by at most one ApplyChanges.
+func (s *snapshotStore) take(now time.Time) *snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.snap
+	s.snap = nil
+	if snap == nil || now.Sub(snap.taken) >= s.maxAge {
+		return nil
+	}
+	return snap
+}
+
+func (s *snapshotStore) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snap = nil
+	s.generation++
+}
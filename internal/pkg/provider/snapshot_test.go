@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestSnapshotReuse(t *testing.T) {
+	newProvider := func(maxAge time.Duration) (*unboundProvider, *unboundtest.Fake) {
+		fake := &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			},
+		}
+		provider := &unboundProvider{api: fake}
+		WithSnapshotReuse(maxAge)(provider)
+		return provider, fake
+	}
+
+	t.Run("reuses a fresh listing from Records", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("lists again when the snapshot is stale", func(t *testing.T) {
+		provider, fake := newProvider(10 * time.Millisecond)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("uses a snapshot for at most one apply", func(t *testing.T) {
+		provider, fake := newProvider(time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+		err = provider.ApplyChanges(context.Background(), createChanges("c.example.com"))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, fake.Calls("ListHostOverrides"))
+		require.Len(t, fake.HostOverrides, 3)
+	})
+
+	t.Run("lists every time when disabled", func(t *testing.T) {
+		provider, fake := newProvider(0)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		err = provider.ApplyChanges(context.Background(), createChanges("b.example.com"))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("drops listings that started before an invalidation", func(t *testing.T) {
+		store := &snapshotStore{maxAge: time.Hour}
+
+		generation := store.currentGeneration()
+		store.invalidate()
+		store.put(generation, &snapshot{taken: time.Now()})
+
+		require.Nil(t, store.take(time.Now()))
+	})
+}
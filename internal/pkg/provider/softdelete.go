@@ -0,0 +1,369 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// WithSoftDelete makes ApplyChanges disable records instead of deleting them, tagging their description
+// with the time they were deleted at. Records leaves soft-deleted records out, and creating one of them
+// again enables it. Soft-deleted records are deleted for good by the first listing more than grace after;
+// 0 never deletes them.
+func WithSoftDelete(grace time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.softDelete = true
+		p.softDeleteGrace = grace
+	}
+}
+
+// softDeleteTag prefixes the time a record was soft-deleted at, and the owner ID of the webhook that did,
+// at the end of its description.
+const softDeleteTag = "[external-dns deleted "
+
+// tagSoftDeleted returns description tagged as soft-deleted at the given time by owner, which may be empty.
+func tagSoftDeleted(description string, at time.Time, owner string) string {
+	tag := softDeleteTag + at.UTC().Format(time.RFC3339)
+	if owner != "" {
+		tag += " by " + owner
+	}
+	tag += "]"
+	// Soft-deleted records are no longer desired, and restoring them mustn't bring back their last stamps
+	if description = bareDescription(description); description == "" {
+		return tag
+	}
+	return description + " " + tag
+}
+
+// untagSoftDeleted returns description without its soft-delete tag.
+func untagSoftDeleted(description string) string {
+	if i := strings.LastIndex(description, softDeleteTag); i >= 0 && strings.HasSuffix(description, "]") {
+		return strings.TrimSuffix(description[:i], " ")
+	}
+	return description
+}
+
+// softDeletedAt returns when a record was soft-deleted, if it is disabled and its description tagged as such.
+func softDeletedAt(enabled, description string) (time.Time, bool) {
+	i := strings.LastIndex(description, softDeleteTag)
+	if enabled != "0" || i < 0 || !strings.HasSuffix(description, "]") {
+		return time.Time{}, false
+	}
+	stamp, _, _ := strings.Cut(description[i+len(softDeleteTag):len(description)-1], " by ")
+	at, err := time.Parse(time.RFC3339, stamp)
+	return at, err == nil
+}
+
+func overrideSoftDeleted(ho unbound.HostOverride) bool {
+	_, ok := softDeletedAt(ho.Enabled, ho.Description)
+	return ok
+}
+
+func aliasSoftDeleted(ha unbound.HostAlias) bool {
+	_, ok := softDeletedAt(ha.Enabled, ha.Description)
+	return ok
+}
+
+// withoutSoftDeleted returns the endpoints of st without those of soft-deleted records.
+func withoutSoftDeleted(st *state.State, endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	deleted := map[string]bool{}
+	for _, ho := range st.HostOverrides() {
+		if overrideSoftDeleted(ho) {
+			deleted[endpoint.RecordTypeA+" "+state.Normalize(ho.DNSName())] = true
+		}
+	}
+	for _, ha := range st.HostAliases() {
+		if aliasSoftDeleted(ha) {
+			deleted[endpoint.RecordTypeCNAME+" "+state.Normalize(ha.DNSName())] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return endpoints
+	}
+
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints)-len(deleted))
+	for _, e := range endpoints {
+		if !deleted[e.RecordType+" "+state.Normalize(e.DNSName)] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// pruneSoftDeleted deletes the records of st soft-deleted more than the grace period ago. Failures are
+// only logged, as the next listing tries again. Disabled records aren't served, so Unbound doesn't need reconfiguring.
+func (p *unboundProvider) pruneSoftDeleted(ctx context.Context, st *state.State) {
+	expired := func(enabled, description string) bool {
+		at, ok := softDeletedAt(enabled, description)
+		return ok && time.Since(at) > p.softDeleteGrace
+	}
+
+	for _, ha := range st.HostAliases() {
+		if !expired(ha.Enabled, ha.Description) {
+			continue
+		}
+		if err := p.api.DeleteHostAlias(ctx, ha); err != nil && !errors.Is(err, unbound.ErrNotFound) {
+			p.log().Error("failed to prune soft-deleted host alias", slog.Any("hostAlias", ha), slog.Any("error", err))
+			continue
+		}
+		p.log().Info("pruned soft-deleted Host Alias", slog.Any("hostAlias", ha))
+		st.DeleteHostAlias(ha)
+	}
+	for _, ho := range st.HostOverrides() {
+		if !expired(ho.Enabled, ho.Description) {
+			continue
+		}
+		if err := p.api.DeleteHostOverride(ctx, ho); err != nil && !errors.Is(err, unbound.ErrNotFound) {
+			p.log().Error("failed to prune soft-deleted host override", slog.Any("hostOverride", ho), slog.Any("error", err))
+			continue
+		}
+		p.log().Info("pruned soft-deleted Host Override", slog.Any("hostOverride", ho))
+		st.DeleteHostOverride(ho)
+	}
+}
+
+// softDeleteA tags the override of ep as soft-deleted, then disables it.
+func (s *applyState) softDeleteA(ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+		ho, ok := s.state.HostOverride(ep.DNSName)
+		if !ok {
+			logger.Warn("Host Override not found")
+			return nil
+		}
+		if overrideSoftDeleted(ho) {
+			logger.Info("Host Override already soft-deleted", slog.Any("hostOverride", ho))
+			return nil
+		}
+
+		// Updating enables the override, so it is disabled last: should that fail, the tagged override
+		// is still listed, and deleted again on the next apply
+		current, err := s.api.GetHostOverride(ctx, ho.ID)
+		if err == nil {
+			current.Description = tagSoftDeleted(current.Description, time.Now(), s.ownerID)
+			err = s.api.UpdateHostOverride(ctx, current)
+		}
+		if err == nil {
+			err = s.api.ToggleHostOverride(ctx, ho.ID, false)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("Host Override already deleted", slog.Any("hostOverride", ho))
+			s.state.DeleteHostOverride(ho)
+			return nil
+		}
+		if err != nil {
+			logger.Error("failed to soft-delete host override", slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to soft-delete host override: %w", err)
+		}
+
+		current.Enabled = "0"
+		logger.Debug("soft-deleted Host Override", slog.Any("hostOverride", current))
+		s.add("deleted", endpoint.RecordTypeA)
+		s.state.PutHostOverride(current)
+		return nil
+	}
+}
+
+// softDeleteCNAME tags the alias of ep as soft-deleted, then disables it.
+func (s *applyState) softDeleteCNAME(ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+		ha, ok := s.state.HostAlias(ep.DNSName)
+		if !ok {
+			logger.Warn("Host Alias not found")
+			return nil
+		}
+		if aliasSoftDeleted(ha) {
+			logger.Info("Host Alias already soft-deleted", slog.Any("hostAlias", ha))
+			return nil
+		}
+
+		current, err := s.api.GetHostAlias(ctx, ha.ID)
+		if err == nil {
+			current.Description = tagSoftDeleted(current.Description, time.Now(), s.ownerID)
+			err = s.api.UpdateHostAlias(ctx, current)
+		}
+		if err == nil {
+			err = s.api.ToggleHostAlias(ctx, ha.ID, false)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("Host Alias already deleted", slog.Any("hostAlias", ha))
+			s.state.DeleteHostAlias(ha)
+			return nil
+		}
+		if err != nil {
+			logger.Error("failed to soft-delete host alias", slog.Any("hostAlias", ha))
+			return fmt.Errorf("failed to soft-delete host alias: %w", err)
+		}
+
+		current.Enabled = "0"
+		logger.Debug("soft-deleted Host Alias", slog.Any("hostAlias", current))
+		s.add("deleted", endpoint.RecordTypeCNAME)
+		s.state.PutHostAlias(current)
+		return nil
+	}
+}
+
+// restoreA enables the soft-deleted override ho again, as the record of ep.
+func (s *applyState) restoreA(ho unbound.HostOverride, ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+		current, err := s.api.GetHostOverride(ctx, ho.ID)
+		if err == nil {
+			current.Description = untagSoftDeleted(current.Description)
+			current.Update(ep)
+			current.Description = s.stampCreated(current.Description)
+			current.Enabled = "1"
+			err = s.api.UpdateHostOverride(ctx, current)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("soft-deleted Host Override deleted meanwhile, creating it again", slog.Any("hostOverride", ho))
+			s.state.DeleteHostOverride(ho)
+			return s.createA(ep)(ctx)
+		}
+		if err != nil {
+			logger.Error("failed to restore soft-deleted host override", slog.Any("hostOverride", ho))
+			return fmt.Errorf("failed to restore host override: %w", err)
+		}
+
+		logger.Debug("restored soft-deleted Host Override", slog.Any("hostOverride", current))
+		s.add("created", endpoint.RecordTypeA)
+		s.state.PutHostOverride(current)
+		return nil
+	}
+}
+
+// restoreCNAME enables the soft-deleted alias ha again, as the record of ep pointing to the override ho.
+func (s *applyState) restoreCNAME(ha unbound.HostAlias, ho unbound.HostOverride, ep *endpoint.Endpoint) applyOp {
+	return func(ctx context.Context) error {
+		logger := s.logger.With(slog.String("op", "create"), slog.Any("endpoint", ep))
+
+		current, err := s.api.GetHostAlias(ctx, ha.ID)
+		if err == nil {
+			current.Description = untagSoftDeleted(current.Description)
+			current.Update(ep)
+			current.Description = s.stampCreated(current.Description)
+			current.HostID = ho.ID
+			current.Enabled = "1"
+			err = s.api.UpdateHostAlias(ctx, current)
+		}
+		if errors.Is(err, unbound.ErrNotFound) {
+			logger.Info("soft-deleted Host Alias deleted meanwhile, creating it again", slog.Any("hostAlias", ha))
+			s.state.DeleteHostAlias(ha)
+			return s.createCNAME(ep)(ctx)
+		}
+		if err != nil {
+			logger.Error("failed to restore soft-deleted host alias", slog.Any("hostAlias", ha))
+			return fmt.Errorf("failed to restore host alias: %w", err)
+		}
+
+		logger.Debug("restored soft-deleted Host Alias", slog.Any("hostAlias", current), slog.Any("hostOverride", ho))
+		s.add("created", endpoint.RecordTypeCNAME)
+		s.state.PutHostAlias(current)
+		return nil
+	}
+}
+
+// softDeleteA is applyState.softDeleteA for bulk applies.
+func (b *bulkApply) softDeleteA(ep *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+	ho, ok := b.state.HostOverride(ep.DNSName)
+	if !ok {
+		logger.Warn("Host Override not found")
+		return nil
+	}
+	if overrideSoftDeleted(ho) {
+		logger.Info("Host Override already soft-deleted", slog.Any("hostOverride", ho))
+		return nil
+	}
+
+	current, ok := b.settings.HostOverride(ho.ID)
+	if !ok {
+		logger.Info("Host Override already deleted", slog.Any("hostOverride", ho))
+		b.state.DeleteHostOverride(ho)
+		return nil
+	}
+	current.Description = tagSoftDeleted(current.Description, time.Now(), b.ownerID)
+	b.settings.PutHostOverride(current)
+	b.settings.ToggleHostOverride(current.ID, false)
+	current.Enabled = "0"
+	b.stats.add("deleted", endpoint.RecordTypeA)
+	b.state.PutHostOverride(current)
+	return nil
+}
+
+// softDeleteCNAME is applyState.softDeleteCNAME for bulk applies.
+func (b *bulkApply) softDeleteCNAME(ep *endpoint.Endpoint) error {
+	logger := b.logger.With(slog.String("op", "delete"), slog.Any("endpoint", ep))
+
+	ha, ok := b.state.HostAlias(ep.DNSName)
+	if !ok {
+		logger.Warn("Host Alias not found")
+		return nil
+	}
+	if aliasSoftDeleted(ha) {
+		logger.Info("Host Alias already soft-deleted", slog.Any("hostAlias", ha))
+		return nil
+	}
+
+	current, ok := b.settings.HostAlias(ha.ID)
+	if !ok {
+		logger.Info("Host Alias already deleted", slog.Any("hostAlias", ha))
+		b.state.DeleteHostAlias(ha)
+		return nil
+	}
+	current.Description = tagSoftDeleted(current.Description, time.Now(), b.ownerID)
+	b.settings.PutHostAlias(current)
+	b.settings.ToggleHostAlias(current.ID, false)
+	current.Enabled = "0"
+	b.stats.add("deleted", endpoint.RecordTypeCNAME)
+	b.state.PutHostAlias(current)
+	return nil
+}
+
+// restoreA is applyState.restoreA for bulk applies.
+func (b *bulkApply) restoreA(ho unbound.HostOverride, ep *endpoint.Endpoint) error {
+	current, ok := b.settings.HostOverride(ho.ID)
+	if !ok {
+		b.state.DeleteHostOverride(ho)
+		return b.createA(ep)
+	}
+	current.Description = untagSoftDeleted(current.Description)
+	current.Update(ep)
+	current.Description = b.stampCreated(current.Description)
+	current.Enabled = "1"
+	b.settings.PutHostOverride(current)
+	b.stats.add("created", endpoint.RecordTypeA)
+	b.state.PutHostOverride(current)
+	return nil
+}
+
+// restoreCNAME is applyState.restoreCNAME for bulk applies.
+func (b *bulkApply) restoreCNAME(ha unbound.HostAlias, ho unbound.HostOverride, ep *endpoint.Endpoint) error {
+	current, ok := b.settings.HostAlias(ha.ID)
+	if !ok {
+		b.state.DeleteHostAlias(ha)
+		return b.createCNAME(ep)
+	}
+	current.Description = untagSoftDeleted(current.Description)
+	current.Update(ep)
+	current.Description = b.stampCreated(current.Description)
+	current.HostID = ho.ID
+	current.Host = ho.DNSName()
+	current.Enabled = "1"
+	b.settings.PutHostAlias(current)
+	b.stats.add("created", endpoint.RecordTypeCNAME)
+	b.state.PutHostAlias(current)
+	return nil
+}
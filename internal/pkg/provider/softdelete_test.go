@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestSoftDelete(t *testing.T) {
+	existing := func() *unboundtest.Fake {
+		return &unboundtest.Fake{
+			HostOverrides: []unbound.HostOverride{
+				{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.10", Description: "NAS", Enabled: "1"},
+				{ID: "2", Hostname: "vpn", Domain: "example.com", Server: "192.168.1.2", Enabled: "1"},
+			},
+			HostAliases: []unbound.HostAlias{
+				{ID: "3", HostID: "2", Hostname: "wg", Domain: "example.com", Host: "vpn.example.com", Enabled: "1"},
+			},
+		}
+	}
+
+	softDeleting := func(api unbound.API, grace time.Duration) *unboundProvider {
+		provider := &unboundProvider{api: api}
+		WithSoftDelete(grace)(provider)
+		return provider
+	}
+
+	deleted := func(at time.Time, description string) string {
+		return tagSoftDeleted(description, at, "")
+	}
+
+	t.Run("disables deleted records and tags them", func(t *testing.T) {
+		fake := existing()
+		provider := softDeleting(fake, time.Hour)
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("wg.example.com", endpoint.RecordTypeCNAME, "vpn.example.com"),
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 2)
+		require.Len(t, fake.HostAliases, 1)
+
+		nas := fake.HostOverrides[0]
+		require.Equal(t, "0", nas.Enabled)
+		require.Equal(t, "NAS", untagSoftDeleted(nas.Description))
+		at, ok := softDeletedAt(nas.Enabled, nas.Description)
+		require.True(t, ok)
+		require.WithinDuration(t, time.Now(), at, time.Minute)
+
+		require.Equal(t, "0", fake.HostAliases[0].Enabled)
+		require.True(t, aliasSoftDeleted(fake.HostAliases[0]))
+		require.Equal(t, "1", fake.HostOverrides[1].Enabled)
+	})
+
+	t.Run("leaves soft-deleted records out of Records", func(t *testing.T) {
+		fake := existing()
+		fake.HostOverrides[0].Enabled = "0"
+		fake.HostOverrides[0].Description = deleted(time.Now(), "NAS")
+		fake.HostAliases[0].Enabled = "0"
+		fake.HostAliases[0].Description = deleted(time.Now(), "")
+		provider := softDeleting(fake, time.Hour)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"vpn.example.com"}, dnsNames(records))
+	})
+
+	t.Run("keeps listing records disabled by hand", func(t *testing.T) {
+		fake := existing()
+		fake.HostOverrides[0].Enabled = "0"
+		provider := softDeleting(fake, time.Hour)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"nas.example.com", "vpn.example.com", "wg.example.com"}, dnsNames(records))
+	})
+
+	t.Run("enables soft-deleted records created again", func(t *testing.T) {
+		fake := existing()
+		fake.HostOverrides[0].Enabled = "0"
+		fake.HostOverrides[0].Description = deleted(time.Now(), "NAS")
+		fake.HostAliases[0].Enabled = "0"
+		fake.HostAliases[0].Description = deleted(time.Now(), "")
+		provider := softDeleting(fake, time.Hour)
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.11"),
+				endpoint.NewEndpoint("wg.example.com", endpoint.RecordTypeCNAME, "vpn.example.com"),
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostOverride{
+			{ID: "1", Hostname: "nas", Domain: "example.com", Server: "192.168.1.11", Description: "NAS", Enabled: "1"},
+			{ID: "2", Hostname: "vpn", Domain: "example.com", Server: "192.168.1.2", Enabled: "1"},
+		}, fake.HostOverrides)
+		require.Len(t, fake.HostAliases, 1)
+		require.Equal(t, unbound.HostAliasID("3"), fake.HostAliases[0].ID)
+		require.Equal(t, "1", fake.HostAliases[0].Enabled)
+		require.Empty(t, fake.HostAliases[0].Description)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"nas.example.com", "vpn.example.com", "wg.example.com"}, dnsNames(records))
+	})
+
+	t.Run("prunes records soft-deleted longer than the grace period", func(t *testing.T) {
+		fake := existing()
+		fake.HostOverrides[0].Enabled = "0"
+		fake.HostOverrides[0].Description = deleted(time.Now().Add(-8*24*time.Hour), "NAS")
+		fake.HostOverrides[1].Enabled = "0"
+		fake.HostOverrides[1].Description = deleted(time.Now().Add(-time.Hour), "")
+		fake.HostAliases[0].Enabled = "0"
+		fake.HostAliases[0].Description = deleted(time.Now().Add(-8*24*time.Hour), "")
+		provider := softDeleting(fake, 7*24*time.Hour)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Empty(t, records)
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, unbound.HostOverrideID("2"), fake.HostOverrides[0].ID)
+		require.Empty(t, fake.HostAliases)
+	})
+
+	t.Run("never prunes without a grace period or with deletes disabled", func(t *testing.T) {
+		expired := func() *unboundtest.Fake {
+			fake := existing()
+			fake.HostOverrides[0].Enabled = "0"
+			fake.HostOverrides[0].Description = deleted(time.Now().Add(-365*24*time.Hour), "NAS")
+			return fake
+		}
+
+		fake := expired()
+		_, err := softDeleting(fake, 0).Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 2)
+
+		fake = expired()
+		provider := softDeleting(fake, time.Hour)
+		provider.disableDeletes = true
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 2)
+	})
+
+	t.Run("soft-deletes and enables records in bulk", func(t *testing.T) {
+		api := &settingsAPI{Fake: existing()}
+		provider := softDeleting(api, time.Hour)
+		provider.bulkThreshold = 1
+
+		err := provider.ApplyChanges(context.Background(), &plan.Changes{
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("wg.example.com", endpoint.RecordTypeCNAME, "vpn.example.com"),
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, api.setCount())
+		require.Len(t, api.HostOverrides, 2)
+		for _, ho := range api.HostOverrides {
+			require.Equal(t, ho.ID == "1", overrideSoftDeleted(ho), ho.DNSName())
+		}
+		require.True(t, aliasSoftDeleted(api.HostAliases[0]))
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{"vpn.example.com"}, dnsNames(records))
+
+		err = provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+				endpoint.NewEndpoint("wg.example.com", endpoint.RecordTypeCNAME, "vpn.example.com"),
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, api.setCount())
+		for _, ho := range api.HostOverrides {
+			require.Equal(t, "1", ho.Enabled, ho.DNSName())
+			if ho.ID == "1" {
+				require.Equal(t, "NAS", ho.Description)
+			}
+		}
+		require.Equal(t, unbound.HostAliasID("3"), api.HostAliases[0].ID)
+		require.Equal(t, "1", api.HostAliases[0].Enabled)
+	})
+
+	t.Run("tags descriptions", func(t *testing.T) {
+		at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		require.Equal(t, "NAS [external-dns deleted 2024-05-01T12:00:00Z]", tagSoftDeleted("NAS", at, ""))
+		require.Equal(t, "[external-dns deleted 2024-05-01T12:00:00Z]", tagSoftDeleted("", at, ""))
+		require.Equal(t, tagSoftDeleted("NAS", at, ""), tagSoftDeleted(tagSoftDeleted("NAS", at.Add(-time.Hour), ""), at, ""))
+		require.Equal(t, "NAS", untagSoftDeleted(tagSoftDeleted("NAS", at, "")))
+
+		require.Equal(t, "NAS [external-dns deleted 2024-05-01T12:00:00Z by cluster-a]", tagSoftDeleted("NAS", at, "cluster-a"))
+		deletedAt, ok := softDeletedAt("0", tagSoftDeleted("NAS", at, "cluster-a"))
+		require.True(t, ok)
+		require.Equal(t, at, deletedAt)
+
+		_, ok = softDeletedAt("1", tagSoftDeleted("NAS", at, ""))
+		require.False(t, ok, "enabled records aren't soft-deleted")
+		_, ok = softDeletedAt("0", "NAS [external-dns deleted yesterday]")
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// WaitForOPNsense detects the OPNsense version and checks the API key's privileges every interval until
+// it succeeds, keeping the provider not ready meanwhile. It gives up after timeout, or never if timeout is 0.
+// Errors that won't go away by waiting, such as rejected credentials, missing privileges or unparseable
+// responses, are returned right away.
+func (p *unboundProvider) WaitForOPNsense(ctx context.Context, timeout, interval time.Duration) error {
+	p.waitingForStartup.Store(true)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := p.DetectVersion(ctx)
+
+		// API users limited to Unbound may not see the firmware status, but OPNsense is up
+		var statusErr *unbound.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden {
+			p.log().Warn("not allowed to detect OPNsense version", slog.Any("error", err))
+			err = nil
+		}
+
+		if err == nil {
+			err = p.CheckPrivileges(ctx)
+		}
+		if err == nil {
+			p.waitingForStartup.Store(false)
+			return nil
+		}
+		if !unbound.IsTransient(err) {
+			return fmt.Errorf("OPNsense check failed: %w", err)
+		}
+
+		p.log().Warn("waiting for OPNsense",
+			slog.Int("attempt", attempt),
+			slog.Duration("elapsed", time.Since(start).Round(time.Second)),
+			slog.Any("error", err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("OPNsense not reachable after %s: %w", time.Since(start).Round(time.Second), err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// CheckPrivileges checks which privileges the API key has, if the API can tell, and remembers them for Status.
+// It fails with ErrUnauthorized when privileges the provider needs are missing: reading and changing records,
+// and reading the settings when listing from them or applying in bulk.
+func (p *unboundProvider) CheckPrivileges(ctx context.Context) error {
+	checker, ok := p.api.(unbound.PrivilegeChecker)
+	if !ok {
+		return nil
+	}
+	checks, err := checker.CheckPrivileges(ctx)
+	if err != nil {
+		return err
+	}
+	p.status.setPrivileges(checks)
+
+	var missing []string
+	for _, c := range checks {
+		required := c.Privilege != unbound.PrivilegeReadSettings || p.settingsListing || p.bulkThreshold > 0
+		switch {
+		case c.Granted:
+		case required:
+			missing = append(missing, c.String())
+		default:
+			p.log().Warn("API key lacks an optional privilege", slog.String("privilege", c.String()))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("API key lacks privileges to %s, grant its user access to these endpoints in System > Access > Users: %w",
+			strings.Join(missing, ", "), unbound.ErrUnauthorized)
+	}
+	return nil
+}
+
+// recheckPrivileges checks privileges again after err, if OPNsense denied a call, so that Status tells
+// which privilege was revoked.
+func (p *unboundProvider) recheckPrivileges(ctx context.Context, err error) {
+	if !errors.Is(err, unbound.ErrUnauthorized) {
+		return
+	}
+	if err := p.CheckPrivileges(ctx); err != nil {
+		p.log().Error("OPNsense denied a call", slog.Any("error", err))
+	}
+}
+
+// startupReady reports an error while WaitForOPNsense hasn't succeeded yet.
+func (p *unboundProvider) startupReady() error {
+	if p.waitingForStartup.Load() {
+		return fmt.Errorf("waiting for OPNsense")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestWaitForOPNsense(t *testing.T) {
+	server := func(t *testing.T, statuses ...int) *httptest.Server {
+		t.Helper()
+
+		var calls atomic.Int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if n := int(calls.Add(1)); n <= len(statuses) {
+				w.WriteHeader(statuses[n-1])
+				return
+			}
+			w.Write([]byte(`{"product_version":"24.7.1"}`))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	t.Run("is not ready until OPNsense answers", func(t *testing.T) {
+		s := server(t, http.StatusBadGateway, http.StatusServiceUnavailable)
+		provider, err := NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		done := make(chan error)
+		go func() { done <- provider.WaitForOPNsense(context.Background(), time.Minute, 20*time.Millisecond) }()
+
+		time.Sleep(10 * time.Millisecond)
+		require.ErrorContains(t, provider.Ready(), "waiting for OPNsense")
+
+		require.NoError(t, <-done)
+		require.NoError(t, provider.Ready())
+	})
+
+	t.Run("gives up after the timeout", func(t *testing.T) {
+		s := server(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+		provider, err := NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		err = provider.WaitForOPNsense(context.Background(), 30*time.Millisecond, 20*time.Millisecond)
+		require.ErrorContains(t, err, "not reachable")
+		require.Error(t, provider.Ready())
+	})
+
+	t.Run("fails right away on errors that won't go away", func(t *testing.T) {
+		s := server(t, http.StatusUnauthorized)
+		provider, err := NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		err = provider.WaitForOPNsense(context.Background(), 0, time.Hour)
+		require.ErrorContains(t, err, "401")
+	})
+
+	t.Run("accepts users not allowed to see the version", func(t *testing.T) {
+		s := server(t, http.StatusForbidden)
+		provider, err := NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		require.NoError(t, provider.WaitForOPNsense(context.Background(), 0, time.Hour))
+		require.NoError(t, provider.Ready())
+	})
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	// server answers every call but those to the denied endpoints, with a 403
+	server := func(t *testing.T, denied *sync.Map) *httptest.Server {
+		t.Helper()
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := denied.Load(r.URL.Path); ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			switch r.URL.Path {
+			case "/api/unbound/settings/addHostOverride/":
+				w.Write([]byte(`{"result":"failed","validations":{"host.domain":"A valid domain must be specified."}}`))
+			case "/api/unbound/settings/searchHostOverride/":
+				w.Write([]byte(`{"rows":[],"total":0}`))
+			default:
+				w.Write([]byte(`{"product_version":"24.7.1"}`))
+			}
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	deny := func(paths ...string) *sync.Map {
+		denied := &sync.Map{}
+		for _, path := range paths {
+			denied.Store(path, true)
+		}
+		return denied
+	}
+	granted := func(provider *unboundProvider) map[string]bool {
+		granted := map[string]bool{}
+		for _, c := range provider.Status().Privileges {
+			granted[c.Privilege] = c.Granted
+		}
+		return granted
+	}
+
+	t.Run("reports the privileges in the status", func(t *testing.T) {
+		provider, err := NewUnboundProvider(server(t, deny()).URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		require.NoError(t, provider.WaitForOPNsense(context.Background(), 0, time.Hour))
+		require.Equal(t, map[string]bool{
+			unbound.PrivilegeReadRecords:   true,
+			unbound.PrivilegeReadSettings:  true,
+			unbound.PrivilegeChangeRecords: true,
+		}, granted(provider))
+	})
+
+	t.Run("fails right away on missing privileges", func(t *testing.T) {
+		provider, err := NewUnboundProvider(server(t, deny("/api/unbound/settings/addHostOverride/")).URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		err = provider.WaitForOPNsense(context.Background(), 0, time.Hour)
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+		require.ErrorContains(t, err, "change records (/api/unbound/settings/addHostOverride/)")
+		require.Error(t, provider.Ready())
+		require.False(t, granted(provider)[unbound.PrivilegeChangeRecords])
+	})
+
+	t.Run("only requires reading settings when listing from or writing them", func(t *testing.T) {
+		s := server(t, deny("/api/unbound/settings/get"))
+
+		provider, err := NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+		require.NoError(t, provider.WaitForOPNsense(context.Background(), 0, time.Hour))
+
+		provider, err = NewUnboundProvider(s.URL, "fakeapikey", "fakeapisecret", WithBulkApply(10))
+		require.NoError(t, err)
+		err = provider.WaitForOPNsense(context.Background(), 0, time.Hour)
+		require.ErrorContains(t, err, "read settings")
+	})
+
+	t.Run("checks privileges again when OPNsense denies a call", func(t *testing.T) {
+		denied := deny()
+		provider, err := NewUnboundProvider(server(t, denied).URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+		require.NoError(t, provider.WaitForOPNsense(context.Background(), 0, time.Hour))
+
+		denied.Store("/api/unbound/settings/searchHostOverride/", true)
+		_, err = provider.Records(context.Background())
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+		require.False(t, granted(provider)[unbound.PrivilegeReadRecords])
+		require.True(t, granted(provider)[unbound.PrivilegeChangeRecords])
+	})
+}
@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// Status describes the provider's recent activity. It must never contain credentials.
+type Status struct {
+	LastRecords        *RecordsStatus `json:"lastRecords,omitempty"`
+	LastApply          *ApplyStatus   `json:"lastApply,omitempty"`
+	LastError          string         `json:"lastError,omitempty"`
+	LastContact        *time.Time     `json:"lastContact,omitempty"`
+	OPNsenseVersion    string         `json:"opnsenseVersion,omitempty"`
+	ReconfigurePending bool           `json:"reconfigurePending"`
+	Circuit            string         `json:"circuit,omitempty"`
+
+	// AliasesUnavailable is set while OPNsense doesn't support host aliases, so only A records are managed
+	AliasesUnavailable bool `json:"aliasesUnavailable,omitempty"`
+
+	// Privileges tells which OPNsense API privileges the API key has, as last checked
+	Privileges []unbound.PrivilegeCheck `json:"privileges,omitempty"`
+
+	// InterruptedOperations counts operations of interrupted applies the next apply will recover from
+	InterruptedOperations int `json:"interruptedOperations,omitempty"`
+
+	// ReadOnly is set in read-only mode, when changes are not applied
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// ValidationWarnings holds the last validation warnings OPNsense returned along with records it saved
+	ValidationWarnings []unbound.ValidationWarning `json:"validationWarnings,omitempty"`
+
+	// Canary tells how the last canary run went, when the canary is enabled
+	Canary *SyncStatus `json:"canary,omitempty"`
+
+	// Instances holds the status of every instance by name, when records are routed to several OPNsense instances
+	Instances map[string]Status `json:"instances,omitempty"`
+
+	// Webhooks holds the status of every webhook by name, when one process serves several
+	Webhooks map[string]Status `json:"webhooks,omitempty"`
+}
+
+type SyncStatus struct {
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type RecordsStatus struct {
+	SyncStatus
+	Records int `json:"records"`
+}
+
+type ApplyStatus struct {
+	SyncStatus
+	Created map[string]int `json:"created"`
+	Updated map[string]int `json:"updated"`
+	Deleted map[string]int `json:"deleted"`
+}
+
+type statusTracker struct {
+	webhook string
+
+	mu     sync.Mutex
+	status Status
+}
+
+func newSyncStatus(start time.Time, err error) SyncStatus {
+	s := SyncStatus{
+		Time:     start,
+		Duration: time.Since(start).String(),
+		Success:  err == nil,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+func (t *statusTracker) recordsDone(start time.Time, records int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status.LastRecords = &RecordsStatus{SyncStatus: newSyncStatus(start, err), Records: records}
+	if err != nil {
+		t.status.LastError = err.Error()
+	} else {
+		t.contact()
+		metrics.For(t.webhook).LastSuccessfulRecords.Set(float64(time.Now().Unix()))
+	}
+}
+
+func (t *statusTracker) applyDone(start time.Time, stats applyStats, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status.LastApply = &ApplyStatus{
+		SyncStatus: newSyncStatus(start, err),
+		Created:    maps.Clone(stats["created"]),
+		Updated:    maps.Clone(stats["updated"]),
+		Deleted:    maps.Clone(stats["deleted"]),
+	}
+	if err != nil {
+		t.status.LastError = err.Error()
+	} else {
+		t.contact()
+		metrics.For(t.webhook).LastSuccessfulApply.Set(float64(time.Now().Unix()))
+	}
+}
+
+func (t *statusTracker) setPrivileges(checks []unbound.PrivilegeCheck) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Privileges = checks
+	t.contact()
+}
+
+func (t *statusTracker) setVersion(version string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.OPNsenseVersion = version
+	t.contact()
+}
+
+// contact notes a successful call to OPNsense. t.mu must be held.
+func (t *statusTracker) contact() {
+	now := time.Now()
+	t.status.LastContact = &now
+	metrics.For(t.webhook).LastContact.Set(float64(now.Unix()))
+}
+
+func (t *statusTracker) lastContact() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.status.LastContact == nil {
+		return time.Time{}
+	}
+	return *t.status.LastContact
+}
+
+func (t *statusTracker) get() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Status returns a snapshot of the provider's recent activity.
+func (p *unboundProvider) Status() Status {
+	s := p.status.get()
+	if p.reconfigurer != nil {
+		s.ReconfigurePending = p.reconfigurer.Pending()
+	}
+	if p.breaker != nil {
+		s.Circuit = p.breaker.State()
+	}
+	s.ValidationWarnings = p.warnings.Recent()
+	s.AliasesUnavailable = !p.aliases.available()
+	s.ReadOnly = p.readOnly != ""
+	if p.journal != nil {
+		s.InterruptedOperations = p.journal.pendingRecovery()
+	}
+	if p.canary != nil {
+		s.Canary = p.canary.lastRun()
+	}
+	return s
+}
+
+// DetectVersion asks OPNsense for its version and remembers it for Status.
+func (p *unboundProvider) DetectVersion(ctx context.Context) error {
+	version, err := p.api.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.log().Info("detected OPNsense version", slog.String("version", version))
+	p.status.setVersion(version)
+	return nil
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	externaldns "sigs.k8s.io/external-dns/provider"
+)
+
+func TestStatus(t *testing.T) {
+	t.Run("tracks the last records and apply calls", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 3, slog.Default())}
+
+		_, err := provider.Records(context.Background())
+		require.NoError(t, err)
+
+		err = provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.NoError(t, err)
+
+		require.NoError(t, provider.DetectVersion(context.Background()))
+
+		status := provider.Status()
+		require.NotNil(t, status.LastRecords)
+		require.True(t, status.LastRecords.Success)
+		require.Equal(t, 0, status.LastRecords.Records)
+		require.NotNil(t, status.LastApply)
+		require.True(t, status.LastApply.Success)
+		require.Equal(t, map[string]int{"A": 1}, status.LastApply.Created)
+		require.Equal(t, "24.7.1", status.OPNsenseVersion)
+		require.False(t, status.ReconfigurePending)
+		require.Empty(t, status.LastError)
+	})
+
+	t.Run("records errors without leaking credentials", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":401,"message":"Authentication Failed"}`))
+		}))
+		t.Cleanup(server.Close)
+
+		provider, err := NewUnboundProvider(server.URL, "supersecretkey", "supersecretsecret")
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+
+		status := provider.Status()
+		require.False(t, status.LastRecords.Success)
+		require.NotEmpty(t, status.LastError)
+
+		payload, err := json.Marshal(status)
+		require.NoError(t, err)
+		require.NotContains(t, string(payload), "supersecret")
+	})
+	t.Run("reports the last validation warnings of OPNsense", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"result":"saved","uuid":"2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",` +
+				`"validations":{"host.hostname":"Hostname will be lowercased."}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		_, err = provider.api.CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "App", Domain: "example.com"})
+		require.NoError(t, err)
+
+		warnings := provider.Status().ValidationWarnings
+		require.Len(t, warnings, 1)
+		require.Equal(t, map[string]string{"host.hostname": "Hostname will be lowercased."}, warnings[0].Fields)
+	})
+	t.Run("reports an open circuit as a soft error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		t.Cleanup(server.Close)
+
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret", WithCircuitBreaker(1, time.Hour))
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+		require.Equal(t, unbound.CircuitOpen, provider.Status().Circuit)
+
+		_, err = provider.Records(context.Background())
+		require.ErrorIs(t, err, unbound.ErrCircuitOpen)
+		require.ErrorIs(t, err, externaldns.SoftError)
+	})
+	t.Run("reports other errors as hard errors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		t.Cleanup(server.Close)
+
+		provider, err := NewUnboundProvider(server.URL, "fakeapikey", "fakeapisecret")
+		require.NoError(t, err)
+
+		_, err = provider.Records(context.Background())
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+		require.NotErrorIs(t, err, externaldns.SoftError)
+	})
+	t.Run("exports the time of the last successful records and apply calls", func(t *testing.T) {
+		metrics.Default.LastSuccessfulRecords.Set(0)
+		metrics.Default.LastSuccessfulApply.Set(0)
+		fake := &unboundtest.Fake{}
+		provider, err := NewUnboundProviderWithAPI(fake)
+		require.NoError(t, err)
+
+		fake.Fail("ListHostOverrides", errors.New("unreachable"))
+		_, err = provider.Records(context.Background())
+		require.Error(t, err)
+		fake.Fail("CreateHostOverride", errors.New("unreachable"))
+		require.Error(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.Zero(t, testutil.ToFloat64(metrics.Default.LastSuccessfulRecords))
+		require.Zero(t, testutil.ToFloat64(metrics.Default.LastSuccessfulApply))
+
+		fake.Fail("ListHostOverrides", nil)
+		fake.Fail("CreateHostOverride", nil)
+		before := float64(time.Now().Unix())
+		_, err = provider.Records(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+		require.GreaterOrEqual(t, testutil.ToFloat64(metrics.Default.LastSuccessfulRecords), before)
+		require.GreaterOrEqual(t, testutil.ToFloat64(metrics.Default.LastSuccessfulApply), before)
+	})
+}
@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// ParseCIDRs parses CIDRs such as 192.168.0.0/16 or fd00::/8.
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// WithAllowedTargetCIDRs makes AdjustEndpoints drop the targets of A and AAAA endpoints outside every one of cidrs,
+// and the endpoints left without targets. No CIDRs allows every target.
+func WithAllowedTargetCIDRs(cidrs []netip.Prefix) Option {
+	return func(p *unboundProvider) {
+		p.allowedTargets = append(p.allowedTargets, cidrs...)
+	}
+}
+
+// targetAllowed tells whether target is an IP address in one of the allowed CIDRs.
+func (u *unboundProvider) targetAllowed(target string) bool {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range u.allowedTargets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropDisallowedTargets drops the targets of A and AAAA endpoints outside the allowed CIDRs,
+// and leaves out the endpoints without any target left.
+func (u *unboundProvider) dropDisallowedTargets(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	kept := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.RecordType != endpoint.RecordTypeA && e.RecordType != endpoint.RecordTypeAAAA {
+			kept = append(kept, e)
+			continue
+		}
+
+		allowed := make(endpoint.Targets, 0, len(e.Targets))
+		for _, target := range e.Targets {
+			if u.targetAllowed(target) {
+				allowed = append(allowed, target)
+				continue
+			}
+			metrics.For(u.webhook).EndpointAdjustments.WithLabelValues(adjustDropTarget).Inc()
+			u.log().Warn("ignoring target outside the allowed CIDRs",
+				slog.String("dnsName", e.DNSName), slog.String("recordType", e.RecordType), slog.String("target", target))
+		}
+
+		if len(allowed) == 0 {
+			metrics.For(u.webhook).EndpointAdjustments.WithLabelValues(adjustDropEndpoint).Inc()
+			u.log().Warn("ignoring record without targets in the allowed CIDRs",
+				slog.String("dnsName", e.DNSName), slog.String("recordType", e.RecordType))
+			continue
+		}
+		e.Targets = allowed
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// TargetRewrite replaces the targets of A and AAAA records in From with To.
+type TargetRewrite struct {
+	From netip.Prefix
+	To   netip.Addr
+}
+
+// ParseTargetRewrite parses a rewrite written as CIDR=IP, such as 203.0.113.0/24=192.168.10.5.
+func ParseTargetRewrite(s string) (TargetRewrite, error) {
+	cidr, ip, ok := strings.Cut(s, "=")
+	if !ok {
+		return TargetRewrite{}, fmt.Errorf("invalid target rewrite %q, expected CIDR=IP", s)
+	}
+	from, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return TargetRewrite{}, fmt.Errorf("invalid target rewrite %q: %w", s, err)
+	}
+	to, err := netip.ParseAddr(ip)
+	if err != nil {
+		return TargetRewrite{}, fmt.Errorf("invalid target rewrite %q: %w", s, err)
+	}
+	if from.Addr().Is4() != to.Is4() {
+		return TargetRewrite{}, fmt.Errorf("invalid target rewrite %q: %s and %s are of different IP versions", s, from, to)
+	}
+	return TargetRewrite{From: from.Masked(), To: to}, nil
+}
+
+// WithTargetRewrites makes AdjustEndpoints replace the targets of A and AAAA endpoints by the first of rewrites
+// they are in, before checking them against the allowed CIDRs. Records are listed as they are, with the replaced
+// targets, so that they match the adjusted endpoints and external-dns doesn't plan to update them again.
+func WithTargetRewrites(rewrites []TargetRewrite) Option {
+	return func(p *unboundProvider) {
+		p.targetRewrites = append(p.targetRewrites, rewrites...)
+	}
+}
+
+// rewriteTargets replaces the targets of A and AAAA endpoints by the first rewrite they are in,
+// dropping the duplicate targets this makes.
+func (u *unboundProvider) rewriteTargets(endpoints []*endpoint.Endpoint) {
+	for _, e := range endpoints {
+		if e.RecordType != endpoint.RecordTypeA && e.RecordType != endpoint.RecordTypeAAAA {
+			continue
+		}
+
+		rewritten := make(endpoint.Targets, 0, len(e.Targets))
+		for _, target := range e.Targets {
+			if to, ok := u.rewriteTarget(target); ok {
+				u.recordAdjustment(e, adjustRewriteTarget, target, to)
+				target = to
+			}
+			if !slices.Contains(rewritten, target) {
+				rewritten = append(rewritten, target)
+			}
+		}
+		e.Targets = rewritten
+	}
+}
+
+// rewriteTarget returns what target is rewritten to, if it is in one of the rewrites.
+func (u *unboundProvider) rewriteTarget(target string) (string, bool) {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	for _, rewrite := range u.targetRewrites {
+		if rewrite.From.Contains(addr) {
+			return rewrite.To.String(), true
+		}
+	}
+	return "", false
+}
+
+// sortTargets orders the targets of e by IP address, byte by byte, and the ones that aren't IP addresses after
+// them by name, so that the target kept of several doesn't depend on the order the source lists them in.
+func sortTargets(e *endpoint.Endpoint) {
+	slices.SortStableFunc(e.Targets, compareTargets)
+}
+
+func compareTargets(a, b string) int {
+	addrA, errA := netip.ParseAddr(a)
+	addrB, errB := netip.ParseAddr(b)
+	switch {
+	case errA == nil && errB == nil:
+		return addrA.Compare(addrB)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// sortChangedTargets returns changes with the targets of every endpoint sorted as AdjustEndpoints sorts them,
+// for plans made without it. Endpoints with targets out of order are copied, leaving the plan given as it is.
+func sortChangedTargets(changes *plan.Changes) *plan.Changes {
+	sorted := func(eps []*endpoint.Endpoint) []*endpoint.Endpoint {
+		var res []*endpoint.Endpoint
+		for i, e := range eps {
+			if !slices.IsSortedFunc(e.Targets, compareTargets) {
+				if res == nil {
+					res = slices.Clone(eps)
+				}
+				res[i] = e.DeepCopy()
+				sortTargets(res[i])
+			}
+		}
+		if res == nil {
+			return eps
+		}
+		return res
+	}
+	return &plan.Changes{
+		Create:    sorted(changes.Create),
+		UpdateOld: sorted(changes.UpdateOld),
+		UpdateNew: sorted(changes.UpdateNew),
+		Delete:    sorted(changes.Delete),
+	}
+}
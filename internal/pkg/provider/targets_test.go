@@ -0,0 +1,264 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestAllowedTargetCIDRs(t *testing.T) {
+	adjustments := func(kind string) float64 {
+		return testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(kind))
+	}
+
+	allowing := func(t *testing.T, cidrs ...string) *unboundProvider {
+		prefixes, err := ParseCIDRs(cidrs)
+		require.NoError(t, err)
+		provider := &unboundProvider{api: &unboundtest.Fake{}}
+		WithAllowedTargetCIDRs(prefixes)(provider)
+		return provider
+	}
+
+	t.Run("drops the targets outside the allowed CIDRs", func(t *testing.T) {
+		logs := recordLogs(t)
+		provider := allowing(t, "192.168.0.0/16", "10.0.0.0/8")
+		droppedTargets, droppedEndpoints := adjustments(adjustDropTarget), adjustments(adjustDropEndpoint)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "203.0.113.10", "192.168.1.10", "10.0.0.10"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "10.0.0.10"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "10.0.0.20"),
+		}, adjusted)
+
+		require.Equal(t, droppedTargets+1, adjustments(adjustDropTarget))
+		require.Equal(t, droppedEndpoints, adjustments(adjustDropEndpoint))
+
+		level, attrs, ok := logs.find("ignoring target outside the allowed CIDRs")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "203.0.113.10", attrs["target"].String())
+	})
+
+	t.Run("drops endpoints without allowed targets", func(t *testing.T) {
+		provider := allowing(t, "192.168.0.0/16")
+		droppedTargets, droppedEndpoints := adjustments(adjustDropTarget), adjustments(adjustDropEndpoint)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "203.0.113.10", "203.0.113.11"),
+			endpoint.NewEndpoint("v6.example.com", endpoint.RecordTypeAAAA, "2001:db8::1"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "lb.example.com"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"www.example.com"}, dnsNames(adjusted))
+
+		require.Equal(t, droppedTargets+3, adjustments(adjustDropTarget))
+		require.Equal(t, droppedEndpoints+2, adjustments(adjustDropEndpoint))
+	})
+
+	t.Run("matches IPv6 and IPv4-mapped targets", func(t *testing.T) {
+		provider := allowing(t, "fd00::/8", "192.168.0.0/16")
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("v6.example.com", endpoint.RecordTypeAAAA, "fd00::10", "2001:db8::1"),
+			endpoint.NewEndpoint("mapped.example.com", endpoint.RecordTypeA, "::ffff:192.168.1.10"),
+		})
+		require.NoError(t, err)
+		require.Len(t, adjusted, 2)
+		require.Equal(t, endpoint.NewTargets("fd00::10"), adjusted[0].Targets)
+		require.Equal(t, endpoint.NewTargets("::ffff:192.168.1.10"), adjusted[1].Targets)
+	})
+
+	t.Run("allows every target without CIDRs", func(t *testing.T) {
+		provider := allowing(t)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "203.0.113.10"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("203.0.113.10"), adjusted[0].Targets)
+	})
+
+	t.Run("rejects invalid CIDRs", func(t *testing.T) {
+		_, err := ParseCIDRs([]string{"192.168.0.0/16", "192.168.1.1"})
+		require.ErrorContains(t, err, `invalid CIDR "192.168.1.1"`)
+	})
+}
+
+func TestTargetRewrites(t *testing.T) {
+	rewriting := func(t *testing.T, api *unboundtest.Fake, rules ...string) *unboundProvider {
+		var rewrites []TargetRewrite
+		for _, rule := range rules {
+			rewrite, err := ParseTargetRewrite(rule)
+			require.NoError(t, err)
+			rewrites = append(rewrites, rewrite)
+		}
+		provider := &unboundProvider{api: api}
+		WithTargetRewrites(rewrites)(provider)
+		return provider
+	}
+
+	// sync runs a cycle of external-dns against provider, and returns the changes it planned
+	sync := func(t *testing.T, provider *unboundProvider, desired ...*endpoint.Endpoint) *plan.Changes {
+		t.Helper()
+
+		current, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		desired, err = provider.AdjustEndpoints(desired)
+		require.NoError(t, err)
+
+		changes := (&plan.Plan{
+			Current:        current,
+			Desired:        desired,
+			Policies:       []plan.Policy{&plan.SyncPolicy{}},
+			ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeCNAME},
+		}).Calculate().Changes
+		require.NoError(t, provider.ApplyChanges(context.Background(), changes))
+		return changes
+	}
+
+	t.Run("rewrites targets in the first matching rule", func(t *testing.T) {
+		provider := rewriting(t, &unboundtest.Fake{}, "203.0.113.0/25=192.168.10.5", "203.0.113.0/24=192.168.10.6")
+		rewrites := testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustRewriteTarget))
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "203.0.113.10"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "203.0.113.200"),
+			endpoint.NewEndpoint("nas.example.com", endpoint.RecordTypeA, "192.168.1.10"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "203.0.113.10"),
+		})
+		require.NoError(t, err)
+
+		targets := map[string]string{}
+		for _, ep := range adjusted {
+			targets[ep.DNSName] = ep.Targets[0]
+		}
+		require.Equal(t, map[string]string{
+			"app.example.com": "192.168.10.5",
+			"api.example.com": "192.168.10.6",
+			"nas.example.com": "192.168.1.10",
+			"www.example.com": "203.0.113.10",
+		}, targets)
+		require.Equal(t, rewrites+2, testutil.ToFloat64(metrics.Default.EndpointAdjustments.WithLabelValues(adjustRewriteTarget)))
+	})
+
+	t.Run("keeps one of the targets rewritten to the same IP", func(t *testing.T) {
+		provider := rewriting(t, &unboundtest.Fake{}, "203.0.113.0/24=192.168.10.5")
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "203.0.113.10", "203.0.113.11"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("192.168.10.5"), adjusted[0].Targets)
+	})
+
+	t.Run("checks rewritten targets against the allowed CIDRs", func(t *testing.T) {
+		provider := rewriting(t, &unboundtest.Fake{}, "203.0.113.0/24=192.168.10.5")
+		allowed, err := ParseCIDRs([]string{"192.168.0.0/16"})
+		require.NoError(t, err)
+		WithAllowedTargetCIDRs(allowed)(provider)
+
+		adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+			endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "198.51.100.10", "203.0.113.10"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("192.168.10.5"), adjusted[0].Targets)
+	})
+
+	t.Run("converges once rewritten targets are created", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := rewriting(t, fake, "203.0.113.0/24=192.168.10.5")
+		desired := func() []*endpoint.Endpoint {
+			return []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "203.0.113.10")}
+		}
+
+		changes := sync(t, provider, desired()...)
+		require.Len(t, changes.Create, 1)
+		require.Len(t, fake.HostOverrides, 1)
+		require.Equal(t, "192.168.10.5", fake.HostOverrides[0].Server)
+
+		records, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, endpoint.NewTargets("192.168.10.5"), records[0].Targets)
+
+		changes = sync(t, provider, desired()...)
+		require.False(t, changes.HasChanges())
+	})
+
+	t.Run("updates records to the target of a changed rule", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		desired := func() []*endpoint.Endpoint {
+			return []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", endpoint.RecordTypeA, "203.0.113.10")}
+		}
+
+		sync(t, rewriting(t, fake, "203.0.113.0/24=192.168.10.5"), desired()...)
+		changes := sync(t, rewriting(t, fake, "203.0.113.0/24=192.168.10.6"), desired()...)
+		require.Len(t, changes.UpdateNew, 1)
+		require.Equal(t, "192.168.10.6", fake.HostOverrides[0].Server)
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		for _, rule := range []string{"203.0.113.0/24", "203.0.113.0/24=nope", "203.0.113.10=192.168.10.5", "2001:db8::/32=192.168.10.5"} {
+			_, err := ParseTargetRewrite(rule)
+			require.Error(t, err, rule)
+		}
+	})
+}
+
+func TestSortTargets(t *testing.T) {
+	// planned returns the changes external-dns plans against provider for desired
+	planned := func(t *testing.T, provider *unboundProvider, desired ...*endpoint.Endpoint) *plan.Changes {
+		t.Helper()
+
+		current, err := provider.Records(context.Background())
+		require.NoError(t, err)
+		desired, err = provider.AdjustEndpoints(desired)
+		require.NoError(t, err)
+
+		return (&plan.Plan{
+			Current:        current,
+			Desired:        desired,
+			Policies:       []plan.Policy{&plan.SyncPolicy{}},
+			ManagedRecords: []string{endpoint.RecordTypeA, endpoint.RecordTypeCNAME},
+		}).Calculate().Changes
+	}
+
+	t.Run("keeps the same target whatever the order of the source", func(t *testing.T) {
+		provider := &unboundProvider{api: &unboundtest.Fake{}}
+
+		changes := planned(t, provider, endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "10.0.0.20", "10.0.0.3", "9.0.0.1"))
+		require.Equal(t, endpoint.NewTargets("9.0.0.1"), changes.Create[0].Targets)
+		require.NoError(t, provider.ApplyChanges(context.Background(), changes))
+
+		for _, targets := range [][]string{{"10.0.0.3", "9.0.0.1", "10.0.0.20"}, {"10.0.0.20", "9.0.0.1", "10.0.0.3"}} {
+			changes := planned(t, provider, endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, targets...))
+			require.False(t, changes.HasChanges(), "planned %v for targets %v", changes, targets)
+		}
+	})
+
+	t.Run("orders IP addresses before names, and IPv4 before IPv6", func(t *testing.T) {
+		ep := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "b.example.com", "fd00::1", "10.0.0.2", "a.example.com", "10.0.0.1")
+		sortTargets(ep)
+		require.Equal(t, endpoint.NewTargets("10.0.0.1", "10.0.0.2", "fd00::1", "a.example.com", "b.example.com"), ep.Targets)
+	})
+
+	t.Run("applies the first target in order of plans made without adjusting them, leaving them as they are", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := &unboundProvider{api: fake}
+
+		ep := endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "10.0.0.20", "10.0.0.3")
+		require.NoError(t, provider.ApplyChanges(context.Background(), &plan.Changes{Create: []*endpoint.Endpoint{ep}}))
+		require.Equal(t, "10.0.0.3", fake.HostOverrides[0].Server)
+		require.Equal(t, endpoint.NewTargets("10.0.0.20", "10.0.0.3"), ep.Targets)
+	})
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// updateKey identifies the record an update is for.
+type updateKey struct {
+	dnsName       string
+	recordType    string
+	setIdentifier string
+}
+
+func updateKeyOf(ep *endpoint.Endpoint) updateKey {
+	return updateKey{dnsName: state.Normalize(ep.DNSName), recordType: ep.RecordType, setIdentifier: ep.SetIdentifier}
+}
+
+// pairUpdates returns changes with UpdateOld and UpdateNew paired by DNS name, record type and set identifier,
+// rather than by index: the webhook API doesn't guarantee they line up. Entries left unpaired that share an
+// index are kept as a pair, as renames are. A new record left unpaired is created, and an old record left
+// unpaired is ignored, with a warning for both.
+func pairUpdates(changes *plan.Changes, logger *slog.Logger) *plan.Changes {
+	oldEPs, newEPs := changes.UpdateOld, changes.UpdateNew
+
+	newByKey := make(map[updateKey][]int, len(newEPs))
+	for j, ep := range newEPs {
+		key := updateKeyOf(ep)
+		newByKey[key] = append(newByKey[key], j)
+	}
+
+	pairedWith := make([]int, len(oldEPs))
+	newPaired := make([]bool, len(newEPs))
+	pair := func(i, j int) {
+		pairedWith[i] = j
+		newPaired[j] = true
+	}
+	// Well-ordered updates keep their order
+	for i, ep := range oldEPs {
+		pairedWith[i] = -1
+		if i < len(newEPs) && updateKeyOf(newEPs[i]) == updateKeyOf(ep) {
+			pair(i, i)
+		}
+	}
+	for i, ep := range oldEPs {
+		if pairedWith[i] >= 0 {
+			continue
+		}
+		for _, j := range newByKey[updateKeyOf(ep)] {
+			if !newPaired[j] {
+				pair(i, j)
+				break
+			}
+		}
+	}
+	for i := range oldEPs {
+		if pairedWith[i] < 0 && i < len(newEPs) && !newPaired[i] {
+			pair(i, i)
+		}
+	}
+
+	paired := &plan.Changes{Create: slices.Clone(changes.Create), Delete: changes.Delete}
+	for i, ep := range oldEPs {
+		if pairedWith[i] < 0 {
+			logger.Warn("ignoring update without a new record", slog.Any("endpoint", ep))
+			continue
+		}
+		paired.UpdateOld = append(paired.UpdateOld, ep)
+		paired.UpdateNew = append(paired.UpdateNew, newEPs[pairedWith[i]])
+	}
+	for j, ep := range newEPs {
+		if !newPaired[j] {
+			logger.Warn("creating record of an update without an old record", slog.Any("endpoint", ep))
+			paired.Create = append(paired.Create, ep)
+		}
+	}
+	return paired
+}
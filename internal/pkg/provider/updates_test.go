@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestPairUpdates(t *testing.T) {
+	a := func(name, target string) *endpoint.Endpoint {
+		return endpoint.NewEndpoint(name, endpoint.RecordTypeA, target)
+	}
+
+	t.Run("keeps updates in order", func(t *testing.T) {
+		changes := &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{a("a.example.com", "10.0.0.1"), a("b.example.com", "10.0.0.2")},
+			UpdateNew: []*endpoint.Endpoint{a("a.example.com", "10.0.1.1"), a("b.example.com", "10.0.1.2")},
+		}
+
+		require.Equal(t, changes, pairUpdates(changes, slog.Default()))
+	})
+
+	t.Run("pairs shuffled updates by name, type and set identifier", func(t *testing.T) {
+		paired := pairUpdates(&plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{
+				a("a.example.com", "10.0.0.1"),
+				a("b.example.com", "10.0.0.2").WithSetIdentifier("one"),
+				a("b.example.com", "10.0.0.3").WithSetIdentifier("two"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				a("b.example.com", "10.0.1.3").WithSetIdentifier("two"),
+				a("B.example.com.", "10.0.1.2").WithSetIdentifier("one"),
+				a("a.example.com", "10.0.1.1"),
+			},
+		}, slog.Default())
+
+		require.Equal(t, []*endpoint.Endpoint{
+			a("a.example.com", "10.0.1.1"),
+			a("B.example.com.", "10.0.1.2").WithSetIdentifier("one"),
+			a("b.example.com", "10.0.1.3").WithSetIdentifier("two"),
+		}, paired.UpdateNew)
+		require.Empty(t, paired.Create)
+	})
+
+	t.Run("keeps renames paired by index", func(t *testing.T) {
+		changes := &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{a("a.example.com", "10.0.0.1"), a("www.example.com", "10.0.0.2")},
+			UpdateNew: []*endpoint.Endpoint{a("a.example.com", "10.0.1.1"), a("web.example.com", "10.0.0.2")},
+		}
+
+		require.Equal(t, changes, pairUpdates(changes, slog.Default()))
+	})
+
+	t.Run("creates lone new records and ignores lone old ones", func(t *testing.T) {
+		logs := recordLogs(t)
+		paired := pairUpdates(&plan.Changes{
+			Create:    []*endpoint.Endpoint{a("c.example.com", "10.0.0.3")},
+			UpdateOld: []*endpoint.Endpoint{a("a.example.com", "10.0.0.1")},
+			UpdateNew: []*endpoint.Endpoint{a("a.example.com", "10.0.1.1"), a("b.example.com", "10.0.1.2")},
+		}, slog.Default())
+		require.Equal(t, []*endpoint.Endpoint{a("c.example.com", "10.0.0.3"), a("b.example.com", "10.0.1.2")}, paired.Create)
+		require.Equal(t, []*endpoint.Endpoint{a("a.example.com", "10.0.1.1")}, paired.UpdateNew)
+		_, _, ok := logs.find("creating record of an update without an old record")
+		require.True(t, ok)
+
+		paired = pairUpdates(&plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{a("a.example.com", "10.0.0.1"), a("b.example.com", "10.0.0.2")},
+			UpdateNew: []*endpoint.Endpoint{a("b.example.com", "10.0.1.2")},
+		}, slog.Default())
+		require.Equal(t, []*endpoint.Endpoint{a("b.example.com", "10.0.0.2")}, paired.UpdateOld)
+		require.Equal(t, []*endpoint.Endpoint{a("b.example.com", "10.0.1.2")}, paired.UpdateNew)
+		level, attrs, ok := logs.find("ignoring update without a new record")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "a.example.com", attrs["endpoint"].Any().(*endpoint.Endpoint).DNSName)
+	})
+
+	t.Run("applies shuffled updates to the right records", func(t *testing.T) {
+		fake := &unboundtest.Fake{HostOverrides: []unbound.HostOverride{
+			{ID: "1", Hostname: "a", Domain: "example.com", Server: "10.0.0.1", Enabled: "1"},
+			{ID: "2", Hostname: "b", Domain: "example.com", Server: "10.0.0.2", Enabled: "1"},
+		}}
+		provider := &unboundProvider{api: fake}
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), &plan.Changes{
+			UpdateOld: []*endpoint.Endpoint{a("a.example.com", "10.0.0.1"), a("b.example.com", "10.0.0.2")},
+			UpdateNew: []*endpoint.Endpoint{a("b.example.com", "10.0.1.2"), a("a.example.com", "10.0.1.1")},
+		}))
+		require.Equal(t, "10.0.1.1", fake.HostOverrides[0].Server)
+		require.Equal(t, "10.0.1.2", fake.HostOverrides[1].Server)
+	})
+}
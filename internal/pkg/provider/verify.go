@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// verifyRetryInterval is the delay between queries for records that don't resolve as applied yet.
+const verifyRetryInterval = 500 * time.Millisecond
+
+// WithApplyVerification makes ApplyChanges query up to sample of the records it created or updated
+// from Unbound, on the OPNsense host, retrying for up to window until they resolve as applied,
+// as a record saved but never served, such as after a reconfigure that didn't happen, goes unnoticed otherwise.
+// The window must cover WithReconfigureDebounce. Records that don't resolve are reported in the apply log
+// and metrics, and fail the apply with WithStrictVerification only.
+func WithApplyVerification(sample int, window time.Duration) Option {
+	return func(p *unboundProvider) {
+		p.verifier = &verifier{sample: sample, window: window, interval: verifyRetryInterval}
+	}
+}
+
+// WithDNSPort sets the port Unbound serves DNS on, for WithApplyVerification and WithCanary. Defaults to 53.
+func WithDNSPort(port int) Option {
+	return func(p *unboundProvider) {
+		p.dnsPort = port
+	}
+}
+
+// WithStrictVerification makes ApplyChanges fail when records it applied don't resolve, see WithApplyVerification.
+func WithStrictVerification() Option {
+	return func(p *unboundProvider) {
+		p.strictVerification = true
+	}
+}
+
+// verifier checks that records applied resolve as planned.
+type verifier struct {
+	resolver Resolver
+	sample   int
+	window   time.Duration
+	interval time.Duration
+}
+
+// unboundResolver returns a resolver querying Unbound on port of the OPNsense host at baseURL.
+func unboundResolver(baseURL string, port int) (Resolver, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse base URL to query Unbound at: %w", err)
+	}
+	return NewResolver(net.JoinHostPort(u.Hostname(), strconv.Itoa(port))), nil
+}
+
+// verify queries a sample of the records created or updated by changes until they all resolve
+// or the window is over, and returns the ones that don't resolve as planned.
+func (v *verifier) verify(ctx context.Context, changes *plan.Changes) (checked int, unresolved []*endpoint.Endpoint) {
+	applied := slices.Concat(changes.Create, changes.UpdateNew)
+	if len(applied) > v.sample {
+		applied = slices.Clone(applied)
+		rand.Shuffle(len(applied), func(i, j int) { applied[i], applied[j] = applied[j], applied[i] })
+		applied = applied[:v.sample]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.window)
+	defer cancel()
+
+	pending := applied
+	for {
+		pending = slices.DeleteFunc(pending, func(e *endpoint.Endpoint) bool {
+			return v.resolves(ctx, e)
+		})
+		if len(pending) == 0 {
+			return len(applied), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return len(applied), pending
+		case <-time.After(v.interval):
+		}
+	}
+}
+
+// resolves tells whether e resolves as planned: an A record to all its targets,
+// and a CNAME record, served by Unbound as the addresses of its target, to any address.
+func (v *verifier) resolves(ctx context.Context, e *endpoint.Endpoint) bool {
+	addrs, err := v.resolver.LookupNetIP(ctx, "ip4", e.DNSName)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	if e.RecordType != endpoint.RecordTypeA {
+		return true
+	}
+	for _, target := range e.Targets {
+		want, err := netip.ParseAddr(target)
+		if err == nil && !slices.Contains(addrs, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyApplied verifies the records changes created or updated, reporting the ones that don't resolve.
+// It returns an error for them only with strict verification.
+func (p *unboundProvider) verifyApplied(ctx context.Context, changes *plan.Changes) (slog.Attr, error) {
+	checked, unresolved := p.verifier.verify(ctx, changes)
+	if checked == 0 {
+		return slog.Attr{}, nil
+	}
+
+	verified := metrics.For(p.webhook).VerifiedRecords
+	verified.WithLabelValues("resolved").Add(float64(checked - len(unresolved)))
+	verified.WithLabelValues("unresolved").Add(float64(len(unresolved)))
+	attr := slog.Group("verified", slog.Int("resolved", checked-len(unresolved)), slog.Int("unresolved", len(unresolved)))
+	if len(unresolved) == 0 {
+		return attr, nil
+	}
+
+	names := make([]string, 0, len(unresolved))
+	for _, e := range unresolved {
+		names = append(names, e.DNSName)
+	}
+	p.log().Warn("records applied don't resolve as planned", slog.Any("dnsNames", names), slog.Duration("window", p.verifier.window))
+	if p.strictVerification {
+		return attr, fmt.Errorf("%d records applied don't resolve as planned after %s: %v", len(unresolved), p.verifier.window, names)
+	}
+	return attr, nil
+}
@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// servingResolver resolves the Host Overrides of fake as Unbound would serve them once reconfigured.
+type servingResolver struct {
+	fake *unboundtest.Fake
+}
+
+func (r servingResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	if r.fake.Calls("Reconfigure") == 0 {
+		return nil, errors.New("no such host")
+	}
+	r.fake.Lock()
+	defer r.fake.Unlock()
+	for _, ho := range r.fake.HostOverrides {
+		if ho.DNSName() == host {
+			return []netip.Addr{netip.MustParseAddr(ho.Server)}, nil
+		}
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestApplyVerification(t *testing.T) {
+	verifying := func(fake *unboundtest.Fake, resolver Resolver, opts ...Option) *unboundProvider {
+		provider := &unboundProvider{api: fake, reconfigurer: newReconfigurer(fake, 0, 3, slog.Default())}
+		WithApplyVerification(10, 100*time.Millisecond)(provider)
+		for _, opt := range opts {
+			opt(provider)
+		}
+		provider.verifier.resolver = resolver
+		provider.verifier.interval = 10 * time.Millisecond
+		return provider
+	}
+
+	t.Run("reports records applied that resolve", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{}
+		provider := verifying(fake, servingResolver{fake})
+		provider.logger = slog.New(logs)
+		resolved := testutil.ToFloat64(metrics.Default.VerifiedRecords.WithLabelValues("resolved"))
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+
+		_, attrs, ok := logs.find("applied changes")
+		require.True(t, ok)
+		require.Equal(t, map[string]int64{"resolved": 1, "unresolved": 0}, groupValue(t, attrs["verified"]))
+		require.Equal(t, resolved+1, testutil.ToFloat64(metrics.Default.VerifiedRecords.WithLabelValues("resolved")))
+	})
+
+	t.Run("reports records saved but not served without failing the apply", func(t *testing.T) {
+		logs := recordLogs(t)
+		fake := &unboundtest.Fake{}
+		provider := verifying(fake, &fakeResolver{})
+		provider.logger = slog.New(logs)
+		unresolved := testutil.ToFloat64(metrics.Default.VerifiedRecords.WithLabelValues("unresolved"))
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+
+		level, attrs, ok := logs.find("records applied don't resolve as planned")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, []string{"a.example.com"}, attrs["dnsNames"].Any())
+		require.Equal(t, unresolved+1, testutil.ToFloat64(metrics.Default.VerifiedRecords.WithLabelValues("unresolved")))
+	})
+
+	t.Run("fails the apply when strict", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := verifying(fake, &fakeResolver{}, WithStrictVerification())
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.ErrorContains(t, err, "1 records applied don't resolve as planned")
+		require.Len(t, fake.HostOverrides, 1)
+	})
+
+	t.Run("waits for records to resolve within the window", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		provider := verifying(fake, servingResolver{fake}, WithStrictVerification())
+		provider.reconfigurer = newReconfigurer(fake, 30*time.Millisecond, 3, slog.Default())
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), createChanges("a.example.com")))
+	})
+
+	t.Run("checks A records resolve to their targets", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: map[string][]string{
+			"a.example.com":     {"127.0.0.1"},
+			"cname.example.com": {"127.0.0.2"},
+		}}
+		v := &verifier{resolver: resolver, sample: 10, window: 50 * time.Millisecond, interval: 10 * time.Millisecond}
+
+		checked, unresolved := v.verify(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("cname.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+			},
+			UpdateNew: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.9"),
+			},
+		})
+		require.Equal(t, 2, checked)
+		require.Equal(t, []string{"a.example.com"}, dnsNames(unresolved))
+	})
+
+	t.Run("queries a sample of the records applied", func(t *testing.T) {
+		resolver := &fakeResolver{}
+		v := &verifier{resolver: resolver, sample: 2, window: time.Millisecond, interval: time.Second}
+
+		checked, unresolved := v.verify(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+				endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "127.0.0.2"),
+				endpoint.NewEndpoint("c.example.com", endpoint.RecordTypeA, "127.0.0.3"),
+			},
+		})
+		require.Equal(t, 2, checked)
+		require.Len(t, unresolved, 2)
+	})
+
+	t.Run("skips verification of failed applies", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		fake.Fail("CreateHostOverride", unbound.ErrNotFound)
+		resolver := &fakeResolver{}
+		provider := verifying(fake, resolver, WithStrictVerification())
+
+		err := provider.ApplyChanges(context.Background(), createChanges("a.example.com"))
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		require.Zero(t, resolver.lookupCount())
+	})
+}
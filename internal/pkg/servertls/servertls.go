@@ -0,0 +1,82 @@
+// Package servertls serves TLS with a certificate and key read from files, such as those cert-manager
+// mounts from a secret, loaded again whenever they change.
+package servertls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificate is a certificate and key pair read from PEM files.
+type Certificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version [2]fileVersion
+}
+
+// fileVersion tells a file apart from the one it replaces.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the pair in certFile and keyFile, failing when they can't be read or don't match.
+func Load(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the pair, read again first if either file changed, for tls.Config.GetCertificate.
+// While the files fail to load, as they may halfway through being replaced, the last pair loaded is served.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloaded, err := c.reload()
+	if err != nil {
+		slog.Warn("failed to reload TLS certificate, serving the last one loaded",
+			slog.String("certFile", c.certFile), slog.Any("error", err))
+	} else if reloaded {
+		slog.Info("reloaded TLS certificate", slog.String("certFile", c.certFile))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// Config returns a TLS configuration serving the pair.
+func (c *Certificate) Config() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: c.GetCertificate}
+}
+
+// reload reads the pair again if either file changed since it was last read, and tells whether it did.
+func (c *Certificate) reload() (bool, error) {
+	var version [2]fileVersion
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		version[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && version == c.version {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert, c.version = &cert, version
+	return true, nil
+}
@@ -0,0 +1,133 @@
+package servertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writePair writes a self-signed certificate for 127.0.0.1 with commonName, and its key, to dir,
+// and returns the certificate.
+func writePair(t *testing.T, dir, commonName string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert
+}
+
+func TestCertificate(t *testing.T) {
+	// serve serves HTTPS with c, and returns its URL
+	serve := func(t *testing.T, c *Certificate) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+		go server.Serve(tls.NewListener(l, c.Config()))
+		t.Cleanup(func() { server.Close() })
+		return "https://" + l.Addr().String()
+	}
+
+	// get makes a request to url trusting only cert, and returns the certificate served
+	get := func(t *testing.T, url string, cert *x509.Certificate) (*x509.Certificate, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, DisableKeepAlives: true}}
+		res, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		return res.TLS.PeerCertificates[0], nil
+	}
+
+	t.Run("serves HTTPS with the pair", func(t *testing.T) {
+		dir := t.TempDir()
+		cert := writePair(t, dir, "webhook")
+		c, err := Load(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+		require.NoError(t, err)
+
+		served, err := get(t, serve(t, c), cert)
+		require.NoError(t, err)
+		require.Equal(t, "webhook", served.Subject.CommonName)
+	})
+
+	t.Run("serves the pair the files are replaced with", func(t *testing.T) {
+		dir := t.TempDir()
+		first := writePair(t, dir, "first")
+		c, err := Load(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+		require.NoError(t, err)
+		url := serve(t, c)
+
+		_, err = get(t, url, first)
+		require.NoError(t, err)
+
+		second := writePair(t, dir, "second")
+		// Make the change visible even on file systems with coarse modification times
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "tls.crt"), later, later))
+
+		served, err := get(t, url, second)
+		require.NoError(t, err)
+		require.Equal(t, "second", served.Subject.CommonName)
+	})
+
+	t.Run("keeps serving the last pair while the files fail to load", func(t *testing.T) {
+		dir := t.TempDir()
+		cert := writePair(t, dir, "webhook")
+		c, err := Load(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+		require.NoError(t, err)
+
+		require.NoError(t, os.Remove(filepath.Join(dir, "tls.key")))
+		served, err := get(t, serve(t, c), cert)
+		require.NoError(t, err)
+		require.Equal(t, "webhook", served.Subject.CommonName)
+	})
+
+	t.Run("fails to load an unreadable or mismatched pair", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := Load(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+		require.Error(t, err)
+
+		writePair(t, dir, "first")
+		key, err := os.ReadFile(filepath.Join(dir, "tls.key"))
+		require.NoError(t, err)
+		writePair(t, dir, "second")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), key, 0o600))
+
+		_, err = Load(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+		require.ErrorContains(t, err, "failed to load TLS certificate")
+	})
+}
@@ -0,0 +1,336 @@
+// Package state indexes the Unbound host overrides and aliases known to the provider.
+package state
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Normalize returns the form DNS names are indexed by: lowercase, without the trailing dot.
+func Normalize(dnsName string) string {
+	return strings.ToLower(strings.TrimSuffix(dnsName, "."))
+}
+
+// State holds host overrides and aliases keyed by DNS name and by ID, in listing order.
+// When several records share a DNS name, the one listed or stored last wins the name.
+// It is safe for concurrent use.
+type State struct {
+	mu sync.Mutex
+
+	overrides       map[unbound.HostOverrideID]overrideEntry
+	overrideOrder   []unbound.HostOverrideID
+	overridesByName map[string]unbound.HostOverrideID
+
+	aliases       map[unbound.HostAliasID]aliasEntry
+	aliasesByHost map[unbound.HostOverrideID][]unbound.HostAliasID
+	aliasesByName map[string]unbound.HostAliasID
+	// aliasesByTarget indexes aliases by the normalized DNS name they target, as shown by OPNsense
+	aliasesByTarget map[string][]unbound.HostAliasID
+}
+
+// Records are stored with their DNS names, which are derived once rather than on every lookup and listing.
+type overrideEntry struct {
+	unbound.HostOverride
+	name string
+}
+
+type aliasEntry struct {
+	unbound.HostAlias
+	name string
+}
+
+func New() *State {
+	return newSized(0, 0)
+}
+
+func newSized(overrides, aliases int) *State {
+	return &State{
+		overrides:       make(map[unbound.HostOverrideID]overrideEntry, overrides),
+		overrideOrder:   make([]unbound.HostOverrideID, 0, overrides),
+		overridesByName: make(map[string]unbound.HostOverrideID, overrides),
+		aliases:         make(map[unbound.HostAliasID]aliasEntry, aliases),
+		aliasesByHost:   make(map[unbound.HostOverrideID][]unbound.HostAliasID, overrides),
+		aliasesByName:   make(map[string]unbound.HostAliasID, aliases),
+		aliasesByTarget: make(map[string][]unbound.HostAliasID, overrides),
+	}
+}
+
+// FromListing builds a State from a listing. hostAliases[i] holds the aliases of hostOverrides[i].
+func FromListing(hostOverrides []unbound.HostOverride, hostAliases [][]unbound.HostAlias) *State {
+	aliases := 0
+	for _, has := range hostAliases {
+		aliases += len(has)
+	}
+
+	s := newSized(len(hostOverrides), aliases)
+	s.Refresh(hostOverrides, hostAliases)
+	return s
+}
+
+// Refresh replaces everything in s with a listing. hostAliases[i] holds the aliases of hostOverrides[i].
+func (s *State) Refresh(hostOverrides []unbound.HostOverride, hostAliases [][]unbound.HostAlias) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.overrides)
+	clear(s.overridesByName)
+	clear(s.aliases)
+	clear(s.aliasesByHost)
+	clear(s.aliasesByName)
+	clear(s.aliasesByTarget)
+	s.overrideOrder = s.overrideOrder[:0]
+
+	for i, ho := range hostOverrides {
+		s.putHostOverride(ho)
+		if i < len(hostAliases) {
+			for _, ha := range hostAliases[i] {
+				if ha.HostID == "" {
+					ha.HostID = ho.ID
+				}
+				s.putHostAlias(ha)
+			}
+		}
+	}
+}
+
+func (s *State) HostOverride(dnsName string) (unbound.HostOverride, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.overridesByName[Normalize(dnsName)]
+	if !ok {
+		return unbound.HostOverride{}, false
+	}
+	return s.overrides[id].HostOverride, true
+}
+
+func (s *State) HostOverrideByID(id unbound.HostOverrideID) (unbound.HostOverride, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.overrides[id]
+	return e.HostOverride, ok
+}
+
+func (s *State) HostAlias(dnsName string) (unbound.HostAlias, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.aliasesByName[Normalize(dnsName)]
+	if !ok {
+		return unbound.HostAlias{}, false
+	}
+	return s.aliases[id].HostAlias, true
+}
+
+func (s *State) HostAliasByID(id unbound.HostAliasID) (unbound.HostAlias, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.aliases[id]
+	return e.HostAlias, ok
+}
+
+// HostOverrides returns every override, in listing order.
+func (s *State) HostOverrides() []unbound.HostOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	overrides := make([]unbound.HostOverride, 0, len(s.overrideOrder))
+	for _, id := range s.overrideOrder {
+		overrides = append(overrides, s.overrides[id].HostOverride)
+	}
+	return overrides
+}
+
+// HostAliases returns every alias, those of each override in the order they were stored, in listing order of the overrides.
+func (s *State) HostAliases() []unbound.HostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	aliases := make([]unbound.HostAlias, 0, len(s.aliases))
+	for _, id := range s.overrideOrder {
+		for _, aliasID := range s.aliasesByHost[id] {
+			aliases = append(aliases, s.aliases[aliasID].HostAlias)
+		}
+	}
+	return aliases
+}
+
+// HostAliasesTargeting returns the aliases targeting dnsName, in the order they were stored. Aliases point to their
+// override by ID, so these are usually the aliases of the override of dnsName, but also those left pointing to the
+// override that had the name before it was deleted.
+func (s *State) HostAliasesTargeting(dnsName string) []unbound.HostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := s.aliasesByTarget[Normalize(dnsName)]
+	aliases := make([]unbound.HostAlias, 0, len(ids))
+	for _, aliasID := range ids {
+		aliases = append(aliases, s.aliases[aliasID].HostAlias)
+	}
+	return aliases
+}
+
+// HostAliasesOf returns the aliases of the override with the given ID, in the order they were stored.
+func (s *State) HostAliasesOf(id unbound.HostOverrideID) []unbound.HostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := s.aliasesByHost[id]
+	aliases := make([]unbound.HostAlias, 0, len(ids))
+	for _, aliasID := range ids {
+		aliases = append(aliases, s.aliases[aliasID].HostAlias)
+	}
+	return aliases
+}
+
+// PutHostOverride adds or replaces ho by ID. A renamed override is no longer found by its old name,
+// and its aliases target its new name, as they do in OPNsense.
+func (s *State) PutHostOverride(ho unbound.HostOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putHostOverride(ho)
+}
+
+func (s *State) putHostOverride(ho unbound.HostOverride) {
+	old, existed := s.overrides[ho.ID]
+	if existed {
+		s.unindexOverrideName(old)
+	} else {
+		s.overrideOrder = append(s.overrideOrder, ho.ID)
+	}
+	e := overrideEntry{HostOverride: ho, name: ho.DNSName()}
+	s.overrides[ho.ID] = e
+	s.overridesByName[Normalize(e.name)] = ho.ID
+
+	if existed && Normalize(old.name) != Normalize(e.name) {
+		for _, aliasID := range slices.Clone(s.aliasesByHost[ho.ID]) {
+			ha := s.aliases[aliasID].HostAlias
+			ha.Host = e.name
+			s.putHostAlias(ha)
+		}
+	}
+}
+
+// DeleteHostOverride forgets ho. Its aliases are kept, as OPNsense keeps them too.
+func (s *State) DeleteHostOverride(ho unbound.HostOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.overrides[ho.ID]
+	if !ok {
+		return
+	}
+	s.unindexOverrideName(old)
+	delete(s.overrides, ho.ID)
+	s.overrideOrder = slices.DeleteFunc(s.overrideOrder, func(id unbound.HostOverrideID) bool { return id == ho.ID })
+}
+
+func (s *State) unindexOverrideName(e overrideEntry) {
+	name := Normalize(e.name)
+	if s.overridesByName[name] == e.ID {
+		delete(s.overridesByName, name)
+	}
+}
+
+// PutHostAlias adds or replaces ha by ID. A renamed or re-pointed alias is no longer found by its old name or override.
+func (s *State) PutHostAlias(ha unbound.HostAlias) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putHostAlias(ha)
+}
+
+func (s *State) putHostAlias(ha unbound.HostAlias) {
+	if old, ok := s.aliases[ha.ID]; ok {
+		s.unindexAlias(old)
+	}
+	e := aliasEntry{HostAlias: ha, name: ha.DNSName()}
+	s.aliases[ha.ID] = e
+	s.aliasesByHost[ha.HostID] = append(s.aliasesByHost[ha.HostID], ha.ID)
+	s.aliasesByName[Normalize(e.name)] = ha.ID
+	target := Normalize(ha.Host)
+	s.aliasesByTarget[target] = append(s.aliasesByTarget[target], ha.ID)
+}
+
+func (s *State) DeleteHostAlias(ha unbound.HostAlias) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.aliases[ha.ID]
+	if !ok {
+		return
+	}
+	s.unindexAlias(old)
+	delete(s.aliases, ha.ID)
+}
+
+func (s *State) unindexAlias(e aliasEntry) {
+	name := Normalize(e.name)
+	if s.aliasesByName[name] == e.ID {
+		delete(s.aliasesByName, name)
+	}
+	s.aliasesByHost[e.HostID] = slices.DeleteFunc(s.aliasesByHost[e.HostID], func(id unbound.HostAliasID) bool { return id == e.ID })
+	if len(s.aliasesByHost[e.HostID]) == 0 {
+		delete(s.aliasesByHost, e.HostID)
+	}
+	target := Normalize(e.Host)
+	s.aliasesByTarget[target] = slices.DeleteFunc(s.aliasesByTarget[target], func(id unbound.HostAliasID) bool { return id == e.ID })
+	if len(s.aliasesByTarget[target]) == 0 {
+		delete(s.aliasesByTarget, target)
+	}
+}
+
+// Len returns the number of host overrides and aliases in s.
+func (s *State) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.overrides) + len(s.aliases)
+}
+
+// Endpoints returns every override, each followed by its aliases, in listing order.
+// Descriptions are returned as unbound.DescriptionProperty.
+// The endpoints are allocated together, as polls on large zones list thousands of them.
+func (s *State) Endpoints() []*endpoint.Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.overrideOrder)
+	for _, id := range s.overrideOrder {
+		n += len(s.aliasesByHost[id])
+	}
+
+	endpoints := make([]endpoint.Endpoint, n)
+	targets := make([]string, n)
+	result := make([]*endpoint.Endpoint, 0, n)
+
+	add := func(name, recordType, target, description string) {
+		i := len(result)
+		targets[i] = target
+		endpoints[i] = endpoint.Endpoint{
+			DNSName:    name,
+			Targets:    targets[i : i+1 : i+1],
+			RecordType: recordType,
+		}
+		if description != "" {
+			endpoints[i].ProviderSpecific = endpoint.ProviderSpecific{{Name: unbound.DescriptionProperty, Value: description}}
+		}
+		result = append(result, &endpoints[i])
+	}
+
+	for _, id := range s.overrideOrder {
+		ho := s.overrides[id]
+		add(ho.name, endpoint.RecordTypeA, ho.Server, ho.Description)
+
+		for _, aliasID := range s.aliasesByHost[id] {
+			ha := s.aliases[aliasID]
+			add(ha.name, endpoint.RecordTypeCNAME, ha.Host, ha.Description)
+		}
+	}
+	return result
+}
@@ -0,0 +1,216 @@
+package state_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/state"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func listing() *state.State {
+	return state.FromListing(
+		[]unbound.HostOverride{
+			{ID: "o1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+			{ID: "o2", Hostname: "B", Domain: "Example.com", Server: "127.0.0.2"},
+		},
+		[][]unbound.HostAlias{
+			{{ID: "a1", Hostname: "www", Domain: "example.com", Host: "a.example.com"}},
+			{{ID: "a2", Hostname: "api", Domain: "example.com", Host: "b.example.com"}},
+		},
+	)
+}
+
+func TestLookup(t *testing.T) {
+	s := listing()
+
+	t.Run("finds records by normalized DNS name", func(t *testing.T) {
+		ho, ok := s.HostOverride("b.example.com.")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverrideID("o2"), ho.ID)
+
+		ha, ok := s.HostAlias("WWW.example.com")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostAliasID("a1"), ha.ID)
+	})
+
+	t.Run("finds records by ID", func(t *testing.T) {
+		ho, ok := s.HostOverrideByID("o1")
+		require.True(t, ok)
+		require.Equal(t, "a.example.com", ho.DNSName())
+
+		ha, ok := s.HostAliasByID("a2")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverrideID("o2"), ha.HostID)
+	})
+
+	t.Run("finds the aliases of an override", func(t *testing.T) {
+		aliases := s.HostAliasesOf("o1")
+		require.Len(t, aliases, 1)
+		require.Equal(t, unbound.HostAliasID("a1"), aliases[0].ID)
+		require.Empty(t, s.HostAliasesOf("missing"))
+	})
+
+	t.Run("lists every record in listing order", func(t *testing.T) {
+		overrides := s.HostOverrides()
+		require.Len(t, overrides, 2)
+		require.Equal(t, unbound.HostOverrideID("o1"), overrides[0].ID)
+		require.Equal(t, unbound.HostOverrideID("o2"), overrides[1].ID)
+
+		aliases := s.HostAliases()
+		require.Len(t, aliases, 2)
+		require.Equal(t, unbound.HostAliasID("a1"), aliases[0].ID)
+		require.Equal(t, unbound.HostAliasID("a2"), aliases[1].ID)
+	})
+
+	t.Run("does not find unknown records", func(t *testing.T) {
+		_, ok := s.HostOverride("c.example.com")
+		require.False(t, ok)
+		_, ok = s.HostAlias("a.example.com")
+		require.False(t, ok)
+	})
+}
+
+func TestMutations(t *testing.T) {
+	t.Run("counts overrides and aliases", func(t *testing.T) {
+		s := listing()
+		require.Equal(t, 4, s.Len())
+
+		s.PutHostOverride(unbound.HostOverride{ID: "o1", Hostname: "c", Domain: "example.com", Server: "127.0.0.1"})
+		s.DeleteHostAlias(unbound.HostAlias{ID: "a2"})
+		require.Equal(t, 3, s.Len())
+	})
+
+	t.Run("renaming an override frees its old name", func(t *testing.T) {
+		s := listing()
+
+		s.PutHostOverride(unbound.HostOverride{ID: "o1", Hostname: "c", Domain: "example.com", Server: "127.0.0.1"})
+
+		_, ok := s.HostOverride("a.example.com")
+		require.False(t, ok)
+		ho, ok := s.HostOverride("c.example.com")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverrideID("o1"), ho.ID)
+	})
+
+	t.Run("renaming an override re-targets its aliases, rename after rename", func(t *testing.T) {
+		s := listing()
+
+		s.PutHostOverride(unbound.HostOverride{ID: "o1", Hostname: "c", Domain: "example.com", Server: "127.0.0.1"})
+		s.PutHostOverride(unbound.HostOverride{ID: "o1", Hostname: "d", Domain: "example.com", Server: "127.0.0.1"})
+
+		require.Empty(t, s.HostAliasesTargeting("a.example.com"))
+		require.Empty(t, s.HostAliasesTargeting("c.example.com"))
+		aliases := s.HostAliasesTargeting("D.example.com.")
+		require.Len(t, aliases, 1)
+		require.Equal(t, unbound.HostAliasID("a1"), aliases[0].ID)
+		require.Equal(t, "d.example.com", aliases[0].Host)
+		require.Equal(t, endpoint.NewTargets("d.example.com"), s.Endpoints()[1].Targets)
+	})
+
+	t.Run("finds aliases by target, whatever override they point to", func(t *testing.T) {
+		s := listing()
+
+		s.DeleteHostOverride(unbound.HostOverride{ID: "o1"})
+		s.PutHostOverride(unbound.HostOverride{ID: "o3", Hostname: "a", Domain: "example.com", Server: "127.0.0.3"})
+
+		aliases := s.HostAliasesTargeting("a.example.com")
+		require.Len(t, aliases, 1)
+		require.Equal(t, unbound.HostOverrideID("o1"), aliases[0].HostID)
+		require.Empty(t, s.HostAliasesOf("o3"))
+
+		s.DeleteHostAlias(aliases[0])
+		require.Empty(t, s.HostAliasesTargeting("a.example.com"))
+	})
+
+	t.Run("the last record stored wins a shared name", func(t *testing.T) {
+		s := listing()
+
+		s.PutHostOverride(unbound.HostOverride{ID: "o3", Hostname: "a", Domain: "example.com", Server: "127.0.0.3"})
+		ho, ok := s.HostOverride("a.example.com")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverrideID("o3"), ho.ID)
+
+		// Deleting the previous holder of the name does not unindex the new one
+		s.DeleteHostOverride(unbound.HostOverride{ID: "o1"})
+		ho, ok = s.HostOverride("a.example.com")
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverrideID("o3"), ho.ID)
+	})
+
+	t.Run("re-pointing an alias moves it to its new override", func(t *testing.T) {
+		s := listing()
+
+		ha, _ := s.HostAlias("www.example.com")
+		ha.HostID = "o2"
+		ha.Host = "b.example.com"
+		s.PutHostAlias(ha)
+
+		require.Equal(t, []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			endpoint.NewEndpoint("B.Example.com", endpoint.RecordTypeA, "127.0.0.2"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeCNAME, "b.example.com"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "b.example.com"),
+		}, withoutLabels(s.Endpoints()))
+	})
+
+	t.Run("deletes records", func(t *testing.T) {
+		s := listing()
+
+		s.DeleteHostAlias(unbound.HostAlias{ID: "a1"})
+		s.DeleteHostOverride(unbound.HostOverride{ID: "o1"})
+
+		_, ok := s.HostAlias("www.example.com")
+		require.False(t, ok)
+		_, ok = s.HostOverride("a.example.com")
+		require.False(t, ok)
+		require.Len(t, s.Endpoints(), 2)
+	})
+
+	t.Run("refresh replaces everything", func(t *testing.T) {
+		s := listing()
+
+		s.Refresh([]unbound.HostOverride{{ID: "o9", Hostname: "z", Domain: "example.com", Server: "127.0.0.9"}}, nil)
+
+		_, ok := s.HostOverride("a.example.com")
+		require.False(t, ok)
+		require.Len(t, s.Endpoints(), 1)
+	})
+
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		s := listing()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.PutHostOverride(unbound.HostOverride{ID: "o3", Hostname: "c", Domain: "example.com", Server: "127.0.0.3"})
+				s.HostOverride("c.example.com")
+				s.Endpoints()
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestEndpoints(t *testing.T) {
+	t.Run("lists overrides followed by their aliases in listing order", func(t *testing.T) {
+		require.Equal(t, []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "127.0.0.1"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+			endpoint.NewEndpoint("B.Example.com", endpoint.RecordTypeA, "127.0.0.2"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeCNAME, "b.example.com"),
+		}, withoutLabels(listing().Endpoints()))
+	})
+}
+
+// withoutLabels makes endpoints comparable with ones made by endpoint.NewEndpoint.
+func withoutLabels(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	for _, e := range endpoints {
+		e.Labels = endpoint.NewLabels()
+	}
+	return endpoints
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MetricsSocketName is the FileDescriptorName= of the socket systemd passes for metrics and health checks.
+// Sockets with any other name are for the webhook API.
+const MetricsSocketName = "metrics"
+
+// listenFDsStart is the first file descriptor systemd passes sockets from.
+const listenFDsStart = 3
+
+// ListenActivated returns the sockets systemd passed by socket activation: the one for the webhook API, and
+// the one named MetricsSocketName for metrics, either nil when not passed. Both are nil when the process wasn't
+// socket-activated. The activation variables are unset, so that commands run by the webhook don't see them.
+func ListenActivated() (webhook, metrics net.Listener, err error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listenActivated(os.Getenv, os.Getpid(), func(i int, name string) *os.File {
+		return os.NewFile(uintptr(listenFDsStart+i), name)
+	})
+}
+
+// listenActivated returns the listeners of the files passed, as described by the activation variables in getenv,
+// if they are for pid. file returns the i-th file passed.
+func listenActivated(getenv func(string) string, pid int, file func(i int, name string) *os.File) (webhook, metrics net.Listener, err error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	fail := func(err error) (net.Listener, net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, nil, err
+	}
+	for i := range n {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := file(i, name)
+		l, err := net.FileListener(f)
+		// The listener has a descriptor of its own
+		f.Close()
+		if err != nil {
+			return fail(fmt.Errorf("socket %d (%s) passed by systemd is not a listening socket: %w", i, name, err))
+		}
+		listeners = append(listeners, l)
+
+		switch {
+		case name == MetricsSocketName && metrics == nil:
+			metrics = l
+		case name != MetricsSocketName && webhook == nil:
+			webhook = l
+		default:
+			return fail(fmt.Errorf("systemd passed more than one socket for %s; name the metrics one %q with FileDescriptorName=",
+				socketPurpose(name), MetricsSocketName))
+		}
+	}
+	return webhook, metrics, nil
+}
+
+func socketPurpose(name string) string {
+	if name == MetricsSocketName {
+		return "metrics"
+	}
+	return "the webhook API"
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// passedSockets fakes systemd passing a listening socket for each of names, returning the activation variables
+// and the files, along with the addresses the sockets listen on.
+func passedSockets(t *testing.T, pid string, names ...string) (func(string) string, func(int, string) *os.File, []string) {
+	t.Helper()
+
+	var files []*os.File
+	var addresses []string
+	for range names {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		l.Close()
+		files = append(files, f)
+		addresses = append(addresses, l.Addr().String())
+	}
+
+	env := map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": strconv.Itoa(len(names)), "LISTEN_FDNAMES": strings.Join(names, ":")}
+	return func(key string) string { return env[key] }, func(i int, _ string) *os.File { return files[i] }, addresses
+}
+
+// requireServes checks that l accepts connections made to address.
+func requireServes(t *testing.T, l net.Listener, address string) {
+	t.Helper()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	resp, err := http.Get("http://" + address)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListenActivated(t *testing.T) {
+	t.Run("uses the socket passed for the webhook", func(t *testing.T) {
+		getenv, file, addresses := passedSockets(t, "42", "")
+
+		webhook, metrics, err := listenActivated(getenv, 42, file)
+
+		require.NoError(t, err)
+		require.Nil(t, metrics)
+		require.Equal(t, addresses[0], webhook.Addr().String())
+		requireServes(t, webhook, addresses[0])
+	})
+
+	t.Run("uses the socket named metrics for metrics", func(t *testing.T) {
+		getenv, file, addresses := passedSockets(t, "42", MetricsSocketName, "webhook.socket")
+
+		webhook, metrics, err := listenActivated(getenv, 42, file)
+
+		require.NoError(t, err)
+		require.Equal(t, addresses[0], metrics.Addr().String())
+		require.Equal(t, addresses[1], webhook.Addr().String())
+		requireServes(t, metrics, addresses[0])
+		requireServes(t, webhook, addresses[1])
+	})
+
+	t.Run("uses no socket when not activated", func(t *testing.T) {
+		webhook, metrics, err := listenActivated(func(string) string { return "" }, 42, nil)
+
+		require.NoError(t, err)
+		require.Nil(t, webhook)
+		require.Nil(t, metrics)
+	})
+
+	t.Run("ignores sockets passed to another process", func(t *testing.T) {
+		getenv, file, _ := passedSockets(t, "41", "")
+
+		webhook, metrics, err := listenActivated(getenv, 42, file)
+
+		require.NoError(t, err)
+		require.Nil(t, webhook)
+		require.Nil(t, metrics)
+	})
+
+	t.Run("fails on several sockets for the webhook", func(t *testing.T) {
+		getenv, file, _ := passedSockets(t, "42", "a.socket", "b.socket")
+
+		_, _, err := listenActivated(getenv, 42, file)
+
+		require.ErrorContains(t, err, "more than one socket for the webhook API")
+	})
+
+	t.Run("fails on files that aren't listening sockets", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+		require.NoError(t, err)
+		getenv := func(key string) string {
+			return map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}[key]
+		}
+
+		_, _, err = listenActivated(getenv, 42, func(int, string) *os.File { return f })
+
+		require.ErrorContains(t, err, "not a listening socket")
+	})
+
+	t.Run("fails on an invalid LISTEN_FDS", func(t *testing.T) {
+		getenv := func(key string) string {
+			return map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "many"}[key]
+		}
+
+		_, _, err := listenActivated(getenv, 42, nil)
+
+		require.ErrorContains(t, err, `invalid LISTEN_FDS "many"`)
+	})
+}
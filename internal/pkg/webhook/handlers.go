@@ -0,0 +1,285 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	externaldnsprovider "sigs.k8s.io/external-dns/provider"
+)
+
+// The media type of the webhook API, and its version. external-dns sends mediaTypeFormatAndVersion as Accept and
+// Content-Type, and refuses webhooks answering the negotiation with a Content-Type other than exactly it.
+const (
+	mediaType                 = "application/external.dns.webhook+json"
+	mediaTypeVersion          = "1"
+	mediaTypeFormatAndVersion = mediaType + ";version=" + mediaTypeVersion
+)
+
+// errorResponse is the body of error responses: the error, and the details of the errors it wraps
+// that tell what went wrong.
+type errorResponse struct {
+	Error string `json:"error"`
+	// Kind names the kind of failure, such as validation or unavailable
+	Kind string `json:"kind,omitempty"`
+	// Fields are the fields OPNsense rejected, for validation failures
+	Fields map[string]string `json:"fields,omitempty"`
+	// Retryable tells whether the same request may succeed later
+	Retryable bool `json:"retryable"`
+	// Failures are the changes of endpoints that failed, for applies
+	Failures []endpointFailure `json:"failures,omitempty"`
+}
+
+// endpointFailure is the failure of the change of one endpoint.
+type endpointFailure struct {
+	DNSName    string            `json:"dnsName"`
+	RecordType string            `json:"recordType"`
+	Op         string            `json:"op"`
+	Error      string            `json:"error"`
+	Kind       string            `json:"kind,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// newErrorResponse describes err, as returned by the provider.
+func newErrorResponse(err error) errorResponse {
+	retryable := unbound.IsTransient(err) || errors.Is(err, unbound.ErrLocked) || errors.Is(err, unbound.ErrSettingsChanged) ||
+		errors.Is(err, externaldnsprovider.SoftError)
+	res := errorResponse{
+		Error:     err.Error(),
+		Retryable: retryable,
+	}
+	res.Kind, res.Fields = errorKind(err)
+
+	for _, e := range provider.EndpointErrors(err) {
+		f := endpointFailure{
+			DNSName:    e.Endpoint.DNSName,
+			RecordType: e.Endpoint.RecordType,
+			Op:         e.Op,
+			Error:      e.Err.Error(),
+		}
+		f.Kind, f.Fields = errorKind(e.Err)
+		res.Failures = append(res.Failures, f)
+	}
+	return res
+}
+
+// errorKind names the kind of failure err is, with the fields OPNsense rejected for validation failures.
+func errorKind(err error) (string, map[string]string) {
+	var validation *unbound.ValidationError
+	var tlsErr *unbound.TLSError
+	var pinErr *unbound.PinMismatchError
+	switch {
+	case errors.As(err, &validation):
+		return "validation", validation.Fields
+	case errors.Is(err, provider.ErrReadOnly):
+		return "readOnly", nil
+	case errors.Is(err, unbound.ErrLocked):
+		return "locked", nil
+	case errors.Is(err, unbound.ErrSettingsChanged):
+		return "settingsChanged", nil
+	case errors.As(err, &tlsErr), errors.As(err, &pinErr):
+		return "tls", nil
+	case errors.Is(err, unbound.ErrUnauthorized):
+		return "unauthorized", nil
+	case errors.Is(err, provider.ErrBudgetExhausted):
+		return "budgetExhausted", nil
+	case unbound.IsTransient(err):
+		return "unavailable", nil
+	case errors.Is(err, unbound.ErrBadResponse):
+		return "badResponse", nil
+	case errors.Is(err, unbound.ErrNotFound):
+		return "notFound", nil
+	}
+	return "", nil
+}
+
+// validationOnly reports whether every change that failed was rejected by OPNsense.
+func (res errorResponse) validationOnly() bool {
+	if len(res.Failures) == 0 {
+		return false
+	}
+	for _, f := range res.Failures {
+		if f.Kind != "validation" {
+			return false
+		}
+	}
+	return true
+}
+
+// handlers serve the routes of the external-dns webhook API for p.
+type handlers struct {
+	p externaldnsprovider.Provider
+
+	// unprocessableValidation answers 422 to applies failing only because OPNsense rejected records
+	unprocessableValidation bool
+}
+
+// negotiate answers GET / with the domain filter, in the media type external-dns checks.
+func (h *handlers) negotiate(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, r, http.StatusNotFound, errorResponse{Error: "no such route: " + r.URL.Path})
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet) || !acceptable(w, r) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, h.p.GetDomainFilter())
+}
+
+// records answers GET /records with the records, and applies the changes POSTed to it. GET /records?fresh
+// bypasses the provider's records cache, for debugging.
+func (h *handlers) records(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if !acceptable(w, r) {
+			return
+		}
+		ctx := r.Context()
+		if r.URL.Query().Has("fresh") {
+			ctx = provider.WithFreshRecords(ctx)
+		}
+		records, err := h.p.Records(ctx)
+		if err != nil {
+			providerError(w, r, "failed to list records", err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, records)
+		return
+	}
+
+	var changes plan.Changes
+	if !decode(w, r, &changes) {
+		return
+	}
+	// Changes stop being applied between operations once the request is canceled, as when external-dns
+	// goes away or the server runs out of shutdown grace. The next sync plans the rest again
+	if err := h.p.ApplyChanges(r.Context(), &changes); err != nil {
+		res := newErrorResponse(err)
+		status := http.StatusInternalServerError
+		if h.unprocessableValidation && res.validationOnly() {
+			status = http.StatusUnprocessableEntity
+		}
+		slog.Error("failed to apply changes", slog.String("path", r.URL.Path), slog.String("kind", res.Kind),
+			slog.Int("failures", len(res.Failures)), slog.Any("error", err))
+		writeJSON(w, r, status, res)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adjustEndpoints answers the endpoints POSTed to /adjustendpoints, adjusted by the provider.
+func (h *handlers) adjustEndpoints(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) || !acceptable(w, r) {
+		return
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	if !decode(w, r, &endpoints) {
+		return
+	}
+	adjusted, err := h.p.AdjustEndpoints(endpoints)
+	if err != nil {
+		providerError(w, r, "failed to adjust endpoints", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, adjusted)
+}
+
+// allowMethods answers 405 to requests made with a method other than methods, and reports whether r was one of them.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed: " + r.Method})
+	return false
+}
+
+// acceptable answers 406 to requests that don't accept the media type of the webhook API, in its version,
+// and reports whether r does. Requests without an Accept header accept anything.
+func acceptable(w http.ResponseWriter, r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch t {
+		case "*/*", "application/*":
+			return true
+		case mediaType:
+			if v, ok := params["version"]; !ok || v == mediaTypeVersion {
+				return true
+			}
+		}
+	}
+	writeError(w, r, http.StatusNotAcceptable, errorResponse{Error: "only " + mediaTypeFormatAndVersion + " is served"})
+	return false
+}
+
+// decode decodes the body of r, of the webhook API media type or plain JSON, into v. It answers 415 to
+// bodies of another media type and 400 to bodies it can't decode, and reports whether it decoded it.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		t, params, err := mime.ParseMediaType(ct)
+		supported := err == nil && (t == "application/json" ||
+			t == mediaType && (params["version"] == "" || params["version"] == mediaTypeVersion))
+		if !supported {
+			writeError(w, r, http.StatusUnsupportedMediaType, errorResponse{Error: "unsupported media type: " + ct})
+			return false
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request body: %s", err)})
+		return false
+	}
+	return true
+}
+
+// providerError answers 500 with the details of err, which the provider returned. external-dns retries
+// requests answered with any 5xx on its next sync, and stops on others.
+func providerError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	res := newErrorResponse(err)
+	slog.Error(msg, slog.String("path", r.URL.Path), slog.String("kind", res.Kind), slog.Any("error", err))
+	writeError(w, r, http.StatusInternalServerError, res)
+}
+
+// writeError answers status with res as the body.
+func writeError(w http.ResponseWriter, r *http.Request, status int, res errorResponse) {
+	if status < http.StatusInternalServerError {
+		slog.Debug("webhook request refused", slog.String("path", r.URL.Path), slog.String("method", r.Method),
+			slog.Int("status", status), slog.String("error", res.Error))
+	}
+	writeJSON(w, r, status, res)
+}
+
+// writeJSON answers status with v encoded as the body, in the webhook API media type.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	// Encoding first answers 500 to values that can't be encoded, rather than a truncated body
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		slog.Error("failed to encode webhook response", slog.String("path", r.URL.Path), slog.Any("error", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaTypeFormatAndVersion)
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
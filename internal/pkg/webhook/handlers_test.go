@@ -0,0 +1,345 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider/webhook"
+)
+
+func serve(t *testing.T, handler http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func errorBody(t *testing.T, w *httptest.ResponseRecorder) errorResponse {
+	t.Helper()
+
+	require.Equal(t, mediaTypeFormatAndVersion, w.Header().Get("Content-Type"))
+	var res errorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res), w.Body.String())
+	return res
+}
+
+func TestHandshake(t *testing.T) {
+	prov := &fakeProvider{
+		domainFilter: endpoint.NewDomainFilter([]string{"example.com"}),
+		records:      []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+	}
+	srv := httptest.NewServer(NewHandler(prov))
+	t.Cleanup(srv.Close)
+
+	// The webhook client of external-dns, as it calls the webhook
+	client, err := webhook.NewWebhookProvider(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com"}, client.GetDomainFilter().Filters)
+
+	records, err := client.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "a.example.com", records[0].DNSName)
+	require.Equal(t, endpoint.Targets{"10.0.0.1"}, records[0].Targets)
+
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2")}}
+	require.NoError(t, client.ApplyChanges(context.Background(), changes))
+	require.Len(t, prov.changes.Create, 1)
+	require.Equal(t, "b.example.com", prov.changes.Create[0].DNSName)
+
+	adjusted, err := client.AdjustEndpoints([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeTXT, "heritage=external-dns"),
+	})
+	require.NoError(t, err)
+	require.Len(t, adjusted, 1)
+
+	t.Run("fails when the provider fails", func(t *testing.T) {
+		prov.applyErr = errors.New("boom")
+		t.Cleanup(func() { prov.applyErr = nil })
+
+		require.Error(t, client.ApplyChanges(context.Background(), changes))
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	handler := NewHandler(&fakeProvider{domainFilter: endpoint.NewDomainFilter([]string{"example.com"})})
+
+	for accept, want := range map[string]int{
+		"":                                       http.StatusOK,
+		mediaTypeFormatAndVersion:                http.StatusOK,
+		mediaType:                                http.StatusOK,
+		"text/html, */*;q=0.8":                   http.StatusOK,
+		"application/*":                          http.StatusOK,
+		mediaType + ";version=2":                 http.StatusNotAcceptable,
+		"text/html":                              http.StatusNotAcceptable,
+		"text/html, " + mediaType + ";version=1": http.StatusOK,
+	} {
+		t.Run("accept "+accept, func(t *testing.T) {
+			w := serve(t, handler, "GET", "/", "", "Accept", accept)
+
+			require.Equal(t, want, w.Code)
+			require.Equal(t, mediaTypeFormatAndVersion, w.Header().Get("Content-Type"))
+			if want == http.StatusOK {
+				require.JSONEq(t, `{"include":["example.com"]}`, w.Body.String())
+			} else {
+				require.Contains(t, errorBody(t, w).Error, mediaTypeFormatAndVersion)
+			}
+		})
+	}
+
+	t.Run("answers 405 to other methods", func(t *testing.T) {
+		w := serve(t, handler, "POST", "/", "{}")
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		require.Equal(t, "GET", w.Header().Get("Allow"))
+		require.Equal(t, "method not allowed: POST", errorBody(t, w).Error)
+	})
+
+	t.Run("answers 404 to other paths", func(t *testing.T) {
+		w := serve(t, handler, "GET", "/zones", "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, "no such route: /zones", errorBody(t, w).Error)
+	})
+}
+
+func TestRecords(t *testing.T) {
+	t.Run("lists records", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+		})
+
+		w := serve(t, handler, "GET", "/records", "", "Accept", mediaTypeFormatAndVersion)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, mediaTypeFormatAndVersion, w.Header().Get("Content-Type"))
+		var records []*endpoint.Endpoint
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+		require.Len(t, records, 1)
+		require.Equal(t, "a.example.com", records[0].DNSName)
+	})
+
+	t.Run("applies changes", func(t *testing.T) {
+		prov := &fakeProvider{}
+		handler := NewHandler(prov)
+
+		for _, contentType := range []string{mediaTypeFormatAndVersion, "application/json", ""} {
+			w := serve(t, handler, "POST", "/records",
+				`{"Delete":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}]}`, "Content-Type", contentType)
+
+			require.Equal(t, http.StatusNoContent, w.Code, contentType)
+			require.Empty(t, w.Body.String())
+			require.Len(t, prov.changes.Delete, 1)
+			require.Equal(t, "a.example.com", prov.changes.Delete[0].DNSName)
+		}
+	})
+
+	t.Run("answers 400 to plans it can't decode", func(t *testing.T) {
+		prov := &fakeProvider{}
+		w := serve(t, NewHandler(prov), "POST", "/records", `{"Create":`, "Content-Type", mediaTypeFormatAndVersion)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, errorBody(t, w).Error, "invalid request body")
+		require.Zero(t, prov.applied)
+	})
+
+	t.Run("answers 415 to other media types", func(t *testing.T) {
+		prov := &fakeProvider{}
+		handler := NewHandler(prov)
+
+		for _, contentType := range []string{"application/x-www-form-urlencoded", mediaType + ";version=2"} {
+			w := serve(t, handler, "POST", "/records", `{}`, "Content-Type", contentType)
+
+			require.Equal(t, http.StatusUnsupportedMediaType, w.Code, contentType)
+			require.Equal(t, "unsupported media type: "+contentType, errorBody(t, w).Error)
+		}
+		require.Zero(t, prov.applied)
+	})
+
+	t.Run("answers 405 to other methods", func(t *testing.T) {
+		w := serve(t, NewHandler(&fakeProvider{}), "DELETE", "/records", "")
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		require.Equal(t, "GET, POST", w.Header().Get("Allow"))
+	})
+}
+
+func TestAdjustEndpoints(t *testing.T) {
+	t.Run("answers the endpoints adjusted", func(t *testing.T) {
+		w := serve(t, NewHandler(&fakeProvider{}), "POST", "/adjustendpoints",
+			`[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]},`+
+				`{"dnsName":"a.example.com","recordType":"TXT","targets":["heritage=external-dns"]}]`,
+			"Content-Type", mediaTypeFormatAndVersion, "Accept", mediaTypeFormatAndVersion)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, mediaTypeFormatAndVersion, w.Header().Get("Content-Type"))
+		var adjusted []*endpoint.Endpoint
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &adjusted))
+		require.Len(t, adjusted, 1)
+		require.Equal(t, endpoint.RecordTypeA, adjusted[0].RecordType)
+	})
+
+	t.Run("answers 405 to other methods", func(t *testing.T) {
+		w := serve(t, NewHandler(&fakeProvider{}), "GET", "/adjustendpoints", "")
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		require.Equal(t, "POST", w.Header().Get("Allow"))
+	})
+}
+
+func TestErrorResponses(t *testing.T) {
+	validation := fmt.Errorf("failed to create host override: %w",
+		fmt.Errorf("addHostOverride failed: %w", &unbound.ValidationError{Fields: map[string]string{"host.server": "invalid IP"}}))
+
+	for name, tc := range map[string]struct {
+		err  error
+		want errorResponse
+	}{
+		"validation": {validation, errorResponse{
+			Error:  validation.Error(),
+			Kind:   "validation",
+			Fields: map[string]string{"host.server": "invalid IP"},
+		}},
+		"read-only": {provider.ErrReadOnly, errorResponse{Error: provider.ErrReadOnly.Error(), Kind: "readOnly"}},
+		"locked": {&unbound.LockedError{Op: "set", Message: "locked"}, errorResponse{
+			Error:     "set failed: configuration locked by another session: locked",
+			Kind:      "locked",
+			Retryable: true,
+		}},
+		"settings changed": {fmt.Errorf("setSettings failed: %w", unbound.ErrSettingsChanged), errorResponse{
+			Error:     "setSettings failed: settings changed since they were read",
+			Kind:      "settingsChanged",
+			Retryable: true,
+		}},
+		"unavailable": {unbound.ErrCircuitOpen, errorResponse{
+			Error:     unbound.ErrCircuitOpen.Error(),
+			Kind:      "unavailable",
+			Retryable: true,
+		}},
+		"budget exhausted": {fmt.Errorf("%w after 1s: %w", provider.ErrBudgetExhausted, context.DeadlineExceeded), errorResponse{
+			Error:     provider.ErrBudgetExhausted.Error() + " after 1s: context deadline exceeded",
+			Kind:      "budgetExhausted",
+			Retryable: true,
+		}},
+		"unauthorized": {&unbound.StatusError{StatusCode: http.StatusUnauthorized}, errorResponse{
+			Error: "request failed: 401",
+			Kind:  "unauthorized",
+		}},
+		"tls": {&unbound.TLSError{Problem: "expired", Remedy: "renew it"}, errorResponse{
+			Error: "TLS handshake with OPNsense failed: expired: renew it",
+			Kind:  "tls",
+		}},
+		"other": {errors.New("boom"), errorResponse{Error: "boom"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLogs(t)
+			handler := NewHandler(&fakeProvider{applyErr: tc.err, recordsErr: tc.err, adjustErr: tc.err})
+
+			for _, w := range []*httptest.ResponseRecorder{
+				serve(t, handler, "GET", "/records", ""),
+				serve(t, handler, "POST", "/records", `{}`),
+				serve(t, handler, "POST", "/adjustendpoints", `[]`),
+			} {
+				require.Equal(t, http.StatusInternalServerError, w.Code)
+				require.Equal(t, tc.want, errorBody(t, w))
+			}
+			require.Contains(t, logs.String(), "failed to apply changes")
+		})
+	}
+}
+
+func TestApplyFailures(t *testing.T) {
+	rejected := func(name string) error {
+		return &provider.EndpointError{
+			Op:       "create",
+			Endpoint: endpoint.NewEndpoint(name, endpoint.RecordTypeA, "10.0.0.300"),
+			Err: fmt.Errorf("failed to create host override: %w",
+				&unbound.ValidationError{Fields: map[string]string{"host.server": "invalid IP"}}),
+		}
+	}
+	unavailable := &provider.EndpointError{
+		Op:       "delete",
+		Endpoint: endpoint.NewEndpoint("c.example.com", endpoint.RecordTypeCNAME, "a.example.com"),
+		Err:      fmt.Errorf("failed to delete host alias: %w", unbound.ErrCallTimeout),
+	}
+
+	t.Run("lists each change that failed", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{applyErr: errors.Join(rejected("a.example.com"), unavailable)})
+
+		w := serve(t, handler, "POST", "/records", `{}`)
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.JSONEq(t, `{
+			"error": "failed to create host override: validation failed: host.server: invalid IP\nfailed to delete host alias: OPNsense call timed out",
+			"kind": "validation",
+			"fields": {"host.server": "invalid IP"},
+			"retryable": true,
+			"failures": [
+				{
+					"dnsName": "a.example.com",
+					"recordType": "A",
+					"op": "create",
+					"error": "failed to create host override: validation failed: host.server: invalid IP",
+					"kind": "validation",
+					"fields": {"host.server": "invalid IP"}
+				},
+				{
+					"dnsName": "c.example.com",
+					"recordType": "CNAME",
+					"op": "delete",
+					"error": "failed to delete host alias: OPNsense call timed out",
+					"kind": "unavailable"
+				}
+			]
+		}`, w.Body.String())
+	})
+
+	t.Run("answers 422 to validation failures when asked to", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{applyErr: errors.Join(rejected("a.example.com"), rejected("b.example.com"))},
+			WithUnprocessableValidation())
+
+		w := serve(t, handler, "POST", "/records", `{}`)
+
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		res := errorBody(t, w)
+		require.False(t, res.Retryable)
+		require.Len(t, res.Failures, 2)
+		require.Equal(t, "b.example.com", res.Failures[1].DNSName)
+	})
+
+	t.Run("answers 500 to validation failures by default", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{applyErr: rejected("a.example.com")})
+
+		w := serve(t, handler, "POST", "/records", `{}`)
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.Len(t, errorBody(t, w).Failures, 1)
+	})
+
+	t.Run("answers 500 to failures of other kinds", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{applyErr: errors.Join(rejected("a.example.com"), unavailable)},
+			WithUnprocessableValidation())
+
+		w := serve(t, handler, "POST", "/records", `{}`)
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
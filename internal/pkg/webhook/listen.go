@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// UnixPrefix marks a listen address that is the path of a unix domain socket, as in unix:/run/webhook/webhook.sock.
+const UnixPrefix = "unix:"
+
+// Listen listens on address: a TCP address such as :8888, or the path of a unix domain socket after UnixPrefix,
+// made with permissions mode. A socket left behind by a process that didn't shut down is replaced, any other
+// file is not. The socket is removed when the listener is closed.
+func Listen(address string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	socketClient := func(path string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}}
+	}
+
+	t.Run("serves the webhook API on a unix socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		l, err := Listen(UnixPrefix+path, 0o660)
+		require.NoError(t, err)
+
+		srv := &http.Server{Handler: NewHandler(&fakeProvider{})}
+		go srv.Serve(l)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSocket, info.Mode().Type())
+		require.Equal(t, fs.FileMode(0o660), info.Mode().Perm())
+
+		res, err := socketClient(path).Get("http://webhook/records")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		require.NoError(t, srv.Shutdown(context.Background()))
+		_, err = os.Stat(path)
+		require.ErrorIs(t, err, fs.ErrNotExist, "the socket is removed on shutdown")
+	})
+
+	t.Run("replaces a stale socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		stale, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		l, err := Listen(UnixPrefix+path, 0o600)
+		require.NoError(t, err)
+		l.Close()
+	})
+
+	t.Run("refuses to replace other files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+
+		_, err := Listen(UnixPrefix+path, 0o600)
+		require.ErrorContains(t, err, "is not a socket")
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+	})
+
+	t.Run("listens on TCP addresses", func(t *testing.T) {
+		l, err := Listen("127.0.0.1:0", 0o600)
+		require.NoError(t, err)
+		require.Equal(t, "tcp", l.Addr().Network())
+		l.Close()
+	})
+}
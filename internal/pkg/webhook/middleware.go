@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrument records request counts and durations for route, and logs slow requests.
+func (s *server) instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+
+		m := metrics.For(s.webhook)
+		m.WebhookRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		m.WebhookRequestDuration.WithLabelValues(route, r.Method).Observe(duration.Seconds())
+
+		if s.slowRequestThreshold > 0 && duration > s.slowRequestThreshold {
+			slog.Warn("slow webhook request",
+				slog.String("route", route),
+				slog.String("method", r.Method),
+				slog.Int("status", rec.status),
+				slog.Duration("duration", duration),
+			)
+		}
+	})
+}
+
+// recoverPanics answers 500 to requests for route whose handler panics, such as on a plan the provider
+// doesn't expect, rather than dropping the connection, and logs the panic with its stack.
+func (s *server) recoverPanics(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			metrics.For(s.webhook).WebhookPanics.WithLabelValues(route).Inc()
+			slog.Error("webhook request panicked",
+				slog.String("route", route),
+				slog.String("method", r.Method),
+				slog.Any("panic", err),
+				slog.String("stack", string(debug.Stack())),
+			)
+			// The handler may have started answering already
+			if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate answers 401 to requests without the bearer token set with WithAuthToken.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	if s.authToken == "" {
+		return next
+	}
+	// Comparing digests takes the same time whatever the length of the token sent
+	want := sha256.Sum256([]byte(s.authToken))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		got := sha256.Sum256([]byte(token))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 || !ok {
+			slog.Warn("unauthorized webhook request", slog.String("path", r.URL.Path), slog.String("remoteAddr", r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody answers 413 to requests for route with a body larger than set with WithMaxRequestSize.
+// The body is read before next is called: the webhook API handlers answer 400 to any body they fail to decode.
+func (s *server) limitBody(route string, next http.Handler) http.Handler {
+	if s.maxRequestSize <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.maxRequestSize {
+			s.tooLarge(w, r, route, r.ContentLength)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxRequestSize))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			s.tooLarge(w, r, route, -1)
+			return
+		case err != nil:
+			slog.Warn("failed to read webhook request", slog.String("route", route), slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge answers 413 to a request of size bytes, or of an unknown size when it's negative.
+func (s *server) tooLarge(w http.ResponseWriter, r *http.Request, route string, size int64) {
+	attrs := []any{
+		slog.String("route", route),
+		slog.String("method", r.Method),
+		slog.String("remoteAddr", r.RemoteAddr),
+		slog.Int64("limit", s.maxRequestSize),
+	}
+	if size >= 0 {
+		attrs = append(attrs, slog.Int64("size", size))
+	}
+	slog.Warn("webhook request too large", attrs...)
+	http.Error(w, fmt.Sprintf("request body larger than %d bytes; raise -webhook-max-request-size to accept it",
+		s.maxRequestSize), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+type fakeProvider struct {
+	delay        time.Duration
+	records      []*endpoint.Endpoint
+	recordsErr   error
+	applyErr     error
+	adjustErr    error
+	domainFilter endpoint.DomainFilter
+
+	applied int
+	changes *plan.Changes
+}
+
+func (f *fakeProvider) Records(context.Context) ([]*endpoint.Endpoint, error) {
+	time.Sleep(f.delay)
+	if f.records == nil {
+		return []*endpoint.Endpoint{}, f.recordsErr
+	}
+	return f.records, f.recordsErr
+}
+
+func (f *fakeProvider) ApplyChanges(_ context.Context, changes *plan.Changes) error {
+	// Like a provider trusting every record to have a target
+	for _, ep := range changes.Create {
+		_ = ep.Targets[0]
+	}
+	f.applied++
+	f.changes = changes
+	return f.applyErr
+}
+
+func (f *fakeProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	if f.adjustErr != nil {
+		return nil, f.adjustErr
+	}
+	// Like a provider dropping the records it doesn't support
+	adjusted := []*endpoint.Endpoint{}
+	for _, ep := range endpoints {
+		if ep.RecordType != endpoint.RecordTypeTXT {
+			adjusted = append(adjusted, ep)
+		}
+	}
+	return adjusted, nil
+}
+
+func (f *fakeProvider) GetDomainFilter() endpoint.DomainFilter {
+	return f.domainFilter
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestInstrument(t *testing.T) {
+	requests := func(route, method, code string) float64 {
+		return testutil.ToFloat64(metrics.Default.WebhookRequests.WithLabelValues(route, method, code))
+	}
+
+	t.Run("counts requests per route, method and status", func(t *testing.T) {
+		handler := NewHandler(&fakeProvider{recordsErr: context.DeadlineExceeded})
+
+		okBefore := requests("/", "GET", "200")
+		errBefore := requests("/records", "GET", "500")
+
+		for _, path := range []string{"/", "/records"} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		}
+
+		require.Equal(t, okBefore+1, requests("/", "GET", "200"))
+		require.Equal(t, errBefore+1, requests("/records", "GET", "500"))
+		require.GreaterOrEqual(t, testutil.CollectAndCount(metrics.Default.WebhookRequestDuration), 2)
+	})
+
+	t.Run("logs requests slower than the threshold", func(t *testing.T) {
+		logs := captureLogs(t)
+		handler := NewHandler(&fakeProvider{delay: 20 * time.Millisecond}, WithSlowRequestThreshold(10*time.Millisecond))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/records", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, logs.String(), "slow webhook request")
+		require.Contains(t, logs.String(), "route=/records")
+	})
+
+	t.Run("does not log fast requests", func(t *testing.T) {
+		logs := captureLogs(t)
+		handler := NewHandler(&fakeProvider{}, WithSlowRequestThreshold(time.Second))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/records", nil))
+
+		require.NotContains(t, logs.String(), "slow webhook request")
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler := NewHandler(&fakeProvider{}, WithAuthToken("s3cret"))
+
+	for name, tc := range map[string]struct {
+		authorization string
+		want          int
+	}{
+		"missing token":           {"", http.StatusUnauthorized},
+		"wrong token":             {"Bearer wrong", http.StatusUnauthorized},
+		"token prefix":            {"Bearer s3cre", http.StatusUnauthorized},
+		"token of another scheme": {"Basic s3cret", http.StatusUnauthorized},
+		"correct token":           {"Bearer s3cret", http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/", "/records"} {
+				req := httptest.NewRequest("GET", path, nil)
+				if tc.authorization != "" {
+					req.Header.Set("Authorization", tc.authorization)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				require.Equal(t, tc.want, w.Code, path)
+			}
+		})
+	}
+
+	t.Run("lets every request through without a token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		NewHandler(&fakeProvider{}).ServeHTTP(w, httptest.NewRequest("GET", "/records", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLogs(t)
+	prov := &fakeProvider{}
+	handler := NewHandler(prov)
+
+	panicsBefore := testutil.ToFloat64(metrics.Default.WebhookPanics.WithLabelValues("/records"))
+	requestsBefore := testutil.ToFloat64(metrics.Default.WebhookRequests.WithLabelValues("/records", "POST", "500"))
+
+	apply := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/records", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := apply(`{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":[]}]}`)
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, panicsBefore+1, testutil.ToFloat64(metrics.Default.WebhookPanics.WithLabelValues("/records")))
+	require.Equal(t, requestsBefore+1, testutil.ToFloat64(metrics.Default.WebhookRequests.WithLabelValues("/records", "POST", "500")))
+	require.Contains(t, logs.String(), "webhook request panicked")
+	require.Contains(t, logs.String(), "index out of range")
+	require.Contains(t, logs.String(), "runtime/debug.Stack")
+
+	t.Run("keeps serving", func(t *testing.T) {
+		w := apply(`{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}]}`)
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, 1, prov.applied)
+	})
+}
+
+func TestLimitBody(t *testing.T) {
+	plan := func(records int) string {
+		creates := make([]string, records)
+		for i := range creates {
+			creates[i] = fmt.Sprintf(`{"dnsName":"host-%d.example.com","recordType":"A","targets":["10.0.0.1"]}`, i)
+		}
+		return `{"Create":[` + strings.Join(creates, ",") + `]}`
+	}
+	apply := func(handler http.Handler, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/records", body)
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("answers 413 to oversized plans", func(t *testing.T) {
+		logs := captureLogs(t)
+		prov := &fakeProvider{}
+		handler := NewHandler(prov, WithMaxRequestSize(1024))
+
+		w := apply(handler, strings.NewReader(plan(100)))
+
+		require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		require.Contains(t, w.Body.String(), "larger than 1024 bytes")
+		require.Contains(t, logs.String(), "webhook request too large")
+		require.Contains(t, logs.String(), "size=")
+		require.Zero(t, prov.applied)
+	})
+
+	t.Run("answers 413 to oversized plans of an unknown length", func(t *testing.T) {
+		logs := captureLogs(t)
+		prov := &fakeProvider{}
+		handler := NewHandler(prov, WithMaxRequestSize(1024))
+
+		// A reader of its own hides the length from httptest.NewRequest
+		w := apply(handler, io.MultiReader(strings.NewReader(plan(100))))
+
+		require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		require.Contains(t, logs.String(), "webhook request too large")
+		require.Zero(t, prov.applied)
+	})
+
+	t.Run("serves plans within the limit", func(t *testing.T) {
+		prov := &fakeProvider{}
+		handler := NewHandler(prov, WithMaxRequestSize(1024))
+
+		w := apply(handler, strings.NewReader(plan(1)))
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, 1, prov.applied)
+	})
+
+	t.Run("0 disables the limit", func(t *testing.T) {
+		prov := &fakeProvider{}
+		handler := NewHandler(prov, WithMaxRequestSize(0))
+
+		w := apply(handler, strings.NewReader(plan(100)))
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, 1, prov.applied)
+	})
+}
@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	externaldnsprovider "sigs.k8s.io/external-dns/provider"
+)
+
+const (
+	defaultSlowRequestThreshold = 2 * time.Second
+	defaultMaxRequestSize       = 4 << 20
+)
+
+// Routes of the external-dns webhook API, besides / to negotiate on.
+const (
+	urlRecords         = "/records"
+	urlAdjustEndpoints = "/adjustendpoints"
+)
+
+type Option func(*server)
+
+// WithSlowRequestThreshold logs a warning for requests taking longer than d. 0 disables.
+func WithSlowRequestThreshold(d time.Duration) Option {
+	return func(s *server) {
+		s.slowRequestThreshold = d
+	}
+}
+
+// WithPathPrefix serves the webhook API under prefix, such as /cluster-a, for external-dns configured with
+// a webhook provider URL ending with it, so that several webhooks can share a listen address.
+func WithPathPrefix(prefix string) Option {
+	return func(s *server) {
+		s.pathPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithWebhookName reports the metrics of the handler as those of the webhook named, for processes serving
+// several webhooks. They are metrics.Default otherwise.
+func WithWebhookName(name string) Option {
+	return func(s *server) {
+		s.webhook = name
+	}
+}
+
+// WithAuthToken requires every request to carry token as a bearer token, answering 401 to the others.
+// An empty token lets every request through.
+func WithAuthToken(token string) Option {
+	return func(s *server) {
+		s.authToken = token
+	}
+}
+
+// WithMaxRequestSize answers 413 to requests with a body larger than n bytes. 0 disables.
+func WithMaxRequestSize(n int64) Option {
+	return func(s *server) {
+		s.maxRequestSize = n
+	}
+}
+
+// WithUnprocessableValidation answers 422, rather than 500, to applies failing only because OPNsense rejected
+// records, which retrying won't fix. external-dns up to at least v0.14 exits on such answers instead of retrying.
+func WithUnprocessableValidation() Option {
+	return func(s *server) {
+		s.unprocessableValidation = true
+	}
+}
+
+type server struct {
+	slowRequestThreshold time.Duration
+	pathPrefix           string
+	webhook              string
+	authToken            string
+	maxRequestSize       int64
+
+	unprocessableValidation bool
+}
+
+// NewHandler serves the external-dns webhook API for p.
+func NewHandler(p externaldnsprovider.Provider, opts ...Option) http.Handler {
+	s := &server{slowRequestThreshold: defaultSlowRequestThreshold, maxRequestSize: defaultMaxRequestSize}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	h := &handlers{p: p, unprocessableValidation: s.unprocessableValidation}
+
+	route := func(route string, next http.Handler) http.Handler {
+		return s.instrument(route, s.recoverPanics(route, s.authenticate(s.limitBody(route, next))))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", route("/", http.HandlerFunc(h.negotiate)))
+	mux.Handle(urlRecords, route(urlRecords, http.HandlerFunc(h.records)))
+	mux.Handle(urlAdjustEndpoints, route(urlAdjustEndpoints, http.HandlerFunc(h.adjustEndpoints)))
+
+	if s.pathPrefix != "" {
+		return underPrefix(s.pathPrefix, mux)
+	}
+	return mux
+}
+
+// underPrefix serves the requests for prefix and the paths below it with next, as if they were for / and
+// the paths below it, and answers 404 to others. Unlike http.StripPrefix, the request for prefix itself,
+// which external-dns negotiates with, is served rather than redirected.
+func underPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok || path != "" && !strings.HasPrefix(path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if path == "" {
+			path = "/"
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	unbound "github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/provider"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	api "github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestFreshRecords(t *testing.T) {
+	var listings atomic.Int32
+	opnsense := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/searchHostOverride/") {
+			listings.Add(1)
+			w.Write([]byte(`{"rows":[{"uuid":"1","enabled":"1","hostname":"a","domain":"example.com","server":"127.0.0.1"}]}`))
+			return
+		}
+		w.Write([]byte(`{"rows":[]}`))
+	}))
+	t.Cleanup(opnsense.Close)
+
+	p, err := unbound.NewUnboundProvider(opnsense.URL, "key", "secret", unbound.WithCacheTTL(time.Hour))
+	require.NoError(t, err)
+	handler := NewHandler(p)
+
+	get := func(target string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), "a.example.com")
+	}
+
+	get("/records")
+	get("/records")
+	require.Equal(t, int32(1), listings.Load(), "the second listing is served from the cache")
+
+	get("/records?fresh")
+	require.Equal(t, int32(2), listings.Load(), "a fresh listing bypasses the cache")
+}
+
+func TestPathPrefix(t *testing.T) {
+	handler := NewHandler(&fakeProvider{}, WithPathPrefix("/cluster-a/"))
+
+	for path, want := range map[string]int{
+		"/cluster-a":          http.StatusOK,
+		"/cluster-a/":         http.StatusOK,
+		"/cluster-a/records":  http.StatusOK,
+		"/cluster-b/records":  http.StatusNotFound,
+		"/cluster-ab/records": http.StatusNotFound,
+		"/records":            http.StatusNotFound,
+	} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			require.Equal(t, want, w.Code)
+		})
+	}
+}
+
+// cancelAfter cancels the request once the after-th host override has been created through it.
+type cancelAfter struct {
+	after   int
+	cancel  context.CancelFunc
+	created atomic.Int32
+}
+
+func (c *cancelAfter) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil && strings.Contains(r.URL.Path, "/addHostOverride") && c.created.Add(1) == int32(c.after) {
+		c.cancel()
+	}
+	return res, err
+}
+
+func TestCanceledApply(t *testing.T) {
+	opnsense := opnsensetest.NewServer()
+	t.Cleanup(opnsense.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := &cancelAfter{after: 2, cancel: cancel}
+	p, err := unbound.NewUnboundProvider(opnsense.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret,
+		unbound.WithAPIOptions(api.WithHTTPClient(&http.Client{Transport: transport})))
+	require.NoError(t, err)
+
+	var creates []string
+	for i := 1; i <= 5; i++ {
+		creates = append(creates, fmt.Sprintf(`{"dnsName":"r%d.example.com","recordType":"A","targets":["10.0.0.%d"]}`, i, i))
+	}
+	body := `{"Create":[` + strings.Join(creates, ",") + `]}`
+
+	w := httptest.NewRecorder()
+	NewHandler(p).ServeHTTP(w, httptest.NewRequest("POST", "/records", strings.NewReader(body)).WithContext(ctx))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Contains(t, w.Body.String(), context.Canceled.Error())
+	require.Len(t, opnsense.HostOverrides(), 2, "no change is made once the request is canceled")
+	require.Equal(t, 2, opnsense.Calls("addHostOverride"))
+	require.Equal(t, 1, opnsense.Calls("reconfigure"), "Unbound is reconfigured for the changes made")
+}
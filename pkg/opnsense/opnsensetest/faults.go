@@ -0,0 +1,141 @@
+package opnsensetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+// AnyEndpoint injects a fault into requests to every endpoint without a fault of its own.
+const AnyEndpoint = "*"
+
+// Fault is how the server misbehaves on requests to an endpoint. Faulted requests are counted by Calls.
+type Fault struct {
+	// Delay holds the request this long before it is served, as told by the server's clock, see WithClock.
+	// The request is dropped if the client gives up waiting.
+	Delay time.Duration
+	// Status answers the request with this status, and Body or an OPNsense-like error, instead of serving it.
+	Status int
+	// Body answers the request with this body, and Status or 200, instead of serving it, such as malformed JSON.
+	Body string
+	// Truncate serves the request, taking effect, then cuts its response off after this many bytes,
+	// while announcing the full length. 0 doesn't truncate.
+	Truncate int
+	// Drop closes the connection without answering, instead of serving the request.
+	Drop bool
+	// Times is how many requests the fault is injected into before it is cleared; 0 injects it into every
+	// request until ClearFaults.
+	Times int
+}
+
+// WithClock makes the server wait for Fault.Delay on the channel after returns, instead of time.After,
+// so that tests can control time.
+func WithClock(after func(time.Duration) <-chan time.Time) Option {
+	return func(s *Server) {
+		s.after = after
+	}
+}
+
+// InjectFault makes the server misbehave as f says on requests to endpoint, named as for Calls, or to
+// AnyEndpoint. It replaces the fault the endpoint had.
+func (s *Server) InjectFault(endpoint string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &f
+}
+
+// FailNext answers the next n requests to endpoint with status.
+func (s *Server) FailNext(endpoint string, n, status int) {
+	s.InjectFault(endpoint, Fault{Status: status, Times: n})
+}
+
+// ClearFaults makes the server behave again.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.faults)
+}
+
+// call counts a request to endpoint, returning the fault to inject into it, if any.
+func (s *Server) call(endpoint string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[endpoint]++
+	key := endpoint
+	f, ok := s.faults[key]
+	if !ok {
+		key = AnyEndpoint
+		if f, ok = s.faults[key]; !ok {
+			return Fault{}
+		}
+	}
+	if f.Times > 0 {
+		if f.Times--; f.Times == 0 {
+			delete(s.faults, key)
+		}
+	}
+	return *f
+}
+
+// serve serves r with handler, one request at a time, misbehaving as f says.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, f Fault, handler http.HandlerFunc) {
+	if f.Delay > 0 {
+		// The server only notices the client giving up once the body is read
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.after(f.Delay):
+		}
+	}
+
+	switch {
+	case f.Drop:
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	case f.Status != 0 || f.Body != "":
+		status := f.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		body := f.Body
+		switch {
+		case body != "":
+		case status == http.StatusUnauthorized:
+			body = authenticationFailed
+		default:
+			body = fmt.Sprintf(`{"status":%d,"message":%q}`, status, http.StatusText(status))
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Truncate <= 0 {
+		handler(w, r)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	body := rec.Body.Bytes()
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(rec.Code)
+	// The server closes the connection short of the length announced, failing the client's read
+	w.Write(body[:min(f.Truncate, len(body))])
+}
@@ -0,0 +1,131 @@
+package opnsensetest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	nas := unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"}
+
+	t.Run("fails the next requests to an endpoint", func(t *testing.T) {
+		server := newServer(t)
+		server.FailNext("addHostOverride", 2, http.StatusServiceUnavailable)
+		client := server.UnboundClient()
+
+		for range 2 {
+			_, err := client.CreateHostOverride(ctx, nas)
+			require.ErrorIs(t, err, unbound.ErrUnavailable)
+		}
+		require.Empty(t, server.HostOverrides())
+		_, err := client.ListHostOverrides(ctx)
+		require.NoError(t, err, "other endpoints behave")
+
+		_, err = client.CreateHostOverride(ctx, nas)
+		require.NoError(t, err)
+		require.Equal(t, 3, server.Calls("addHostOverride"), "failed requests count too")
+	})
+
+	t.Run("answers with the status injected", func(t *testing.T) {
+		server := newServer(t)
+		client := server.UnboundClient()
+
+		server.InjectFault(opnsensetest.AnyEndpoint, opnsensetest.Fault{Status: http.StatusUnauthorized})
+		_, err := client.ListHostOverrides(ctx)
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+
+		server.InjectFault(opnsensetest.AnyEndpoint, opnsensetest.Fault{Status: http.StatusTooManyRequests})
+		var status *unbound.StatusError
+		_, err = client.ListHostOverrides(ctx)
+		require.ErrorAs(t, err, &status)
+		require.Equal(t, http.StatusTooManyRequests, status.StatusCode)
+
+		server.ClearFaults()
+		_, err = client.ListHostOverrides(ctx)
+		require.NoError(t, err)
+	})
+
+	t.Run("prefers the fault of the endpoint to the fault of any endpoint", func(t *testing.T) {
+		server := newServer(t)
+		server.InjectFault(opnsensetest.AnyEndpoint, opnsensetest.Fault{Status: http.StatusBadGateway})
+		server.InjectFault("status", opnsensetest.Fault{Body: `{"product":{"product_version":"broken"}}`})
+
+		version, err := server.UnboundClient().Version(ctx)
+
+		require.NoError(t, err)
+		require.Equal(t, "broken", version)
+	})
+
+	t.Run("answers with malformed JSON", func(t *testing.T) {
+		server := newServer(t)
+		server.InjectFault("addHostOverride", opnsensetest.Fault{Body: `{"result":`})
+
+		_, err := server.UnboundClient().CreateHostOverride(ctx, nas)
+
+		var responseErr *unbound.ResponseError
+		require.ErrorAs(t, err, &responseErr)
+		require.Empty(t, server.HostOverrides(), "the request isn't served")
+	})
+
+	t.Run("truncates responses of requests taking effect", func(t *testing.T) {
+		server := newServer(t)
+		server.InjectFault("addHostOverride", opnsensetest.Fault{Truncate: 5, Times: 1})
+
+		_, err := server.UnboundClient().CreateHostOverride(ctx, nas)
+
+		require.Error(t, err)
+		require.Len(t, server.HostOverrides(), 1)
+		require.True(t, server.Unapplied())
+	})
+
+	t.Run("drops connections", func(t *testing.T) {
+		server := newServer(t)
+		server.InjectFault("reconfigure", opnsensetest.Fault{Drop: true})
+
+		err := server.UnboundClient().Reconfigure(ctx)
+
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+	})
+
+	t.Run("delays requests by the server's clock", func(t *testing.T) {
+		delays := make(chan time.Duration, 1)
+		elapsed := make(chan time.Time)
+		server := newServer(t, opnsensetest.WithClock(func(d time.Duration) <-chan time.Time {
+			delays <- d
+			return elapsed
+		}))
+		server.InjectFault("reconfigure", opnsensetest.Fault{Delay: time.Hour})
+
+		done := make(chan error)
+		go func() { done <- server.UnboundClient().Reconfigure(ctx) }()
+
+		require.Equal(t, time.Hour, <-delays)
+		select {
+		case err := <-done:
+			t.Fatalf("answered before the delay elapsed: %v", err)
+		default:
+		}
+		elapsed <- time.Now()
+		require.NoError(t, <-done)
+	})
+
+	t.Run("drops delayed requests the client gave up on", func(t *testing.T) {
+		server := newServer(t, opnsensetest.WithClock(func(time.Duration) <-chan time.Time { return nil }))
+		server.InjectFault("reconfigure", opnsensetest.Fault{Delay: time.Hour})
+		client := server.UnboundClient(unbound.WithPerCallTimeout(10 * time.Millisecond))
+
+		err := client.Reconfigure(ctx)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.False(t, server.Unapplied())
+		_, err = client.ListHostOverrides(ctx)
+		require.NoError(t, err, "the delayed request doesn't hold the server")
+	})
+}
@@ -0,0 +1,275 @@
+// Package opnsensetest provides an OPNsense serving the Unbound endpoints of its API over HTTP, with the host
+// overrides and aliases kept in memory, for testing clients of the API end to end: requests are authenticated,
+// validated and answered with the JSON OPNsense answers with.
+//
+//	server := opnsensetest.NewServer()
+//	defer server.Close()
+//	server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+//	client := server.UnboundClient()
+//	// ... exercise code calling client ...
+//	if server.Unapplied() {
+//		t.Fatal("changes were saved, but Unbound wasn't reconfigured")
+//	}
+//
+// It serves what unbound.Client calls: searching, adding, getting, setting, toggling and deleting host overrides
+// and aliases, getting and setting the Unbound settings, reconfiguring Unbound and getting the firmware status.
+//
+// InjectFault makes it misbehave on demand, to test how clients cope: answering slowly, with errors,
+// with malformed or truncated bodies, or not at all.
+package opnsensetest
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// Defaults of a Server.
+const (
+	DefaultAPIKey    = "opnsensetest-key"
+	DefaultAPISecret = "opnsensetest-secret"
+	DefaultVersion   = "24.7.1"
+)
+
+// Server is an OPNsense listening on a local address. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	apiKey, apiSecret string
+	version           string
+
+	mu        sync.Mutex
+	settings  *unbound.HostSettings
+	calls     map[string]int
+	faults    map[string]*Fault
+	after     func(time.Duration) <-chan time.Time
+	unapplied bool
+}
+
+type Option func(*Server)
+
+// WithCredentials makes the server accept only the given API key and secret, instead of DefaultAPIKey
+// and DefaultAPISecret.
+func WithCredentials(apiKey, apiSecret string) Option {
+	return func(s *Server) {
+		s.apiKey, s.apiSecret = apiKey, apiSecret
+	}
+}
+
+// WithVersion makes the server report version as its firmware version, instead of DefaultVersion.
+func WithVersion(version string) Option {
+	return func(s *Server) {
+		s.version = version
+	}
+}
+
+// NewServer starts a server without host overrides or aliases. Close it when done.
+func NewServer(opts ...Option) *Server {
+	s := NewUnstartedServer(opts...)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer makes a server like NewServer without starting it, so that its Listener can be replaced.
+// Start it with Start, or StartTLS to serve HTTPS with a self-signed certificate.
+func NewUnstartedServer(opts ...Option) *Server {
+	s := &Server{
+		apiKey:    DefaultAPIKey,
+		apiSecret: DefaultAPISecret,
+		version:   DefaultVersion,
+		settings:  emptySettings(),
+		calls:     map[string]int{},
+		faults:    map[string]*Fault{},
+		after:     time.After,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewUnstartedServer(s.authenticate(s.routes()))
+	return s
+}
+
+// UnboundClient returns a client of the server, authenticating with the credentials it accepts.
+func (s *Server) UnboundClient(opts ...unbound.Option) *unbound.Client {
+	client, err := unbound.New(s.URL, s.apiKey, s.apiSecret, append([]unbound.Option{unbound.WithHTTPClient(s.Client())}, opts...)...)
+	if err != nil {
+		// The URL of an httptest.Server always parses
+		panic(err)
+	}
+	return client
+}
+
+// AddHostOverride adds the A record ho as if created in the web UI, under a new UUID unless it has an ID,
+// and returns it with its ID. It is added as it is, without validation. An empty Enabled enables it.
+func (s *Server) AddHostOverride(ho unbound.HostOverride) unbound.HostOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ho.ID == "" {
+		ho.ID = unbound.HostOverrideID(newUUID())
+	}
+	if ho.Enabled == "" {
+		ho.Enabled = "1"
+	}
+	s.settings.PutHostOverride(ho)
+	s.settings.ToggleHostOverride(ho.ID, ho.Enabled == "1")
+	return ho
+}
+
+// AddHostAlias adds ha, an alias of the host override with the ID ha.HostID, like AddHostOverride.
+// Its Host is set from the host override, if there is one.
+func (s *Server) AddHostAlias(ha unbound.HostAlias) unbound.HostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ha.ID == "" {
+		ha.ID = unbound.HostAliasID(newUUID())
+	}
+	if ha.Enabled == "" {
+		ha.Enabled = "1"
+	}
+	s.settings.PutHostAlias(ha)
+	s.settings.ToggleHostAlias(ha.ID, ha.Enabled == "1")
+	ha, _ = s.settings.HostAlias(ha.ID)
+	return ha
+}
+
+// SetHostSettings replaces every host override and alias with those of settings, without validation,
+// which can hold records of any type, such as AAAA and MX records.
+func (s *Server) SetHostSettings(settings *unbound.HostSettings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings = cloneSettings(settings)
+}
+
+// HostSettings returns every host override and alias the server has.
+func (s *Server) HostSettings() *unbound.HostSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneSettings(s.settings)
+}
+
+// HostOverrides returns the host overrides of every record type the server has, sorted by domain, then hostname.
+func (s *Server) HostOverrides() []unbound.HostOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hos := make([]unbound.HostOverride, 0, len(s.settings.Hosts))
+	for _, id := range sortedIDs(s.settings.Hosts) {
+		ho, _ := s.settings.HostOverride(id)
+		hos = append(hos, ho)
+	}
+	return hos
+}
+
+// HostAliases returns the aliases the server has, sorted by domain, then hostname.
+func (s *Server) HostAliases() []unbound.HostAlias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	has := make([]unbound.HostAlias, 0, len(s.settings.Aliases))
+	for _, id := range sortedIDs(s.settings.Aliases) {
+		ha, _ := s.settings.HostAlias(id)
+		has = append(has, ha)
+	}
+	return has
+}
+
+// Calls returns how many authenticated requests were made to endpoint, named like the last part of its path
+// before any ID, such as "addHostOverride", "reconfigure", or "status" for the firmware status.
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+// Unapplied reports whether host overrides or aliases were changed through the API since Unbound was
+// last reconfigured.
+func (s *Server) Unapplied() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unapplied
+}
+
+// authenticationFailed is how OPNsense answers requests it can't authenticate.
+const authenticationFailed = `{"status":401,"message":"Authentication Failed"}`
+
+// authenticate answers requests without the API key and secret of the server like OPNsense does.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(secret), []byte(s.apiSecret)) != 1 {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, authenticationFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sortedIDs returns the IDs of records sorted by domain, then hostname.
+func sortedIDs[K ~string](records map[K]unbound.SettingsFields) []K {
+	ids := make([]K, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b K) int {
+		return cmp.Or(
+			strings.Compare(records[a]["domain"], records[b]["domain"]),
+			strings.Compare(records[a]["hostname"], records[b]["hostname"]),
+			strings.Compare(string(a), string(b)),
+		)
+	})
+	return ids
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func emptySettings() *unbound.HostSettings {
+	return &unbound.HostSettings{
+		Hosts:   map[unbound.HostOverrideID]unbound.SettingsFields{},
+		Aliases: map[unbound.HostAliasID]unbound.SettingsFields{},
+	}
+}
+
+func cloneSettings(settings *unbound.HostSettings) *unbound.HostSettings {
+	clone := emptySettings()
+	for id, f := range settings.Hosts {
+		clone.Hosts[id] = cloneFields(f)
+	}
+	for id, f := range settings.Aliases {
+		clone.Aliases[id] = cloneFields(f)
+	}
+	return clone
+}
+
+func cloneFields(f unbound.SettingsFields) unbound.SettingsFields {
+	clone := make(unbound.SettingsFields, len(f))
+	for k, v := range f {
+		clone[k] = v
+	}
+	return clone
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
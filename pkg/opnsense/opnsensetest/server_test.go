@@ -0,0 +1,289 @@
+package opnsensetest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func newServer(t *testing.T, opts ...opnsensetest.Option) *opnsensetest.Server {
+	t.Helper()
+
+	server := opnsensetest.NewServer(opts...)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHostOverrides(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates, updates, toggles and deletes host overrides", func(t *testing.T) {
+		server := newServer(t)
+		client := server.UnboundClient()
+
+		ho, err := client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2", Description: "NAS"})
+		require.NoError(t, err)
+		require.True(t, server.Unapplied())
+
+		ho.Server = "10.0.0.3"
+		require.NoError(t, client.UpdateHostOverride(ctx, ho))
+		require.NoError(t, client.ToggleHostOverride(ctx, ho.ID, false))
+
+		got, err := client.GetHostOverride(ctx, ho.ID)
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverride{
+			ID: ho.ID, Enabled: "0", Hostname: "nas", Domain: "example.com", Server: "10.0.0.3", Description: "NAS",
+		}, got)
+		listed, err := client.ListHostOverrides(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostOverride{got}, listed)
+		require.Equal(t, listed, server.HostOverrides())
+
+		require.NoError(t, client.DeleteHostOverride(ctx, ho))
+		require.Empty(t, server.HostOverrides())
+		require.NoError(t, client.DeleteHostOverride(ctx, ho), "deleting a deleted record succeeds")
+
+		require.NoError(t, client.Reconfigure(ctx))
+		require.False(t, server.Unapplied())
+		require.Equal(t, 2, server.Calls("delHostOverride"))
+	})
+
+	t.Run("refuses invalid host overrides", func(t *testing.T) {
+		server := newServer(t)
+		client := server.UnboundClient()
+
+		_, err := client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "bad name", Domain: "example.com", Server: "fd00::1"})
+
+		var validation *unbound.ValidationError
+		require.ErrorAs(t, err, &validation)
+		require.Equal(t, map[string]string{
+			"host.hostname": "A valid hostname is required.",
+			"host.server":   "A valid IPv4 address must be specified for A records.",
+		}, validation.Fields)
+		require.Empty(t, server.HostOverrides())
+		require.False(t, server.Unapplied())
+	})
+
+	t.Run("refuses duplicate host overrides", func(t *testing.T) {
+		server := newServer(t)
+		server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		client := server.UnboundClient()
+
+		_, err := client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		require.ErrorIs(t, err, unbound.ErrValidation)
+
+		_, err = client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.3"})
+		require.NoError(t, err, "round-robin records differ in their address")
+	})
+
+	t.Run("answers for host overrides it doesn't have like OPNsense", func(t *testing.T) {
+		client := newServer(t).UnboundClient()
+
+		_, err := client.GetHostOverride(ctx, "0c1b2a3d-0000-4000-8000-000000000000")
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		err = client.UpdateHostOverride(ctx, unbound.HostOverride{ID: "0c1b2a3d-0000-4000-8000-000000000000", Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		require.ErrorIs(t, client.ToggleHostOverride(ctx, "0c1b2a3d-0000-4000-8000-000000000000", true), unbound.ErrNotFound)
+	})
+}
+
+func TestHostAliases(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("keeps aliases of the host overrides they point to", func(t *testing.T) {
+		server := newServer(t)
+		nas := server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		web := server.AddHostOverride(unbound.HostOverride{Hostname: "web", Domain: "example.com", Server: "10.0.0.3"})
+		server.AddHostAlias(unbound.HostAlias{HostID: web.ID, Hostname: "www", Domain: "example.com"})
+		client := server.UnboundClient()
+
+		ha, err := client.CreateHostAlias(ctx, unbound.HostAlias{HostID: nas.ID, Hostname: "files", Domain: "example.com"})
+		require.NoError(t, err)
+
+		listed, err := client.ListHostAliases(ctx, nas.ID)
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+		require.Equal(t, ha.ID, listed[0].ID)
+		require.Equal(t, "nas.example.com", listed[0].Host)
+
+		got, err := client.GetHostAlias(ctx, ha.ID)
+		require.NoError(t, err)
+		require.Equal(t, nas.ID, got.HostID)
+		require.Equal(t, "nas.example.com", got.Host)
+
+		got.HostID = web.ID
+		require.NoError(t, client.UpdateHostAlias(ctx, got))
+		require.NoError(t, client.ToggleHostAlias(ctx, ha.ID, false))
+		aliases := server.HostAliases()
+		require.Len(t, aliases, 2)
+		require.Equal(t, "files", aliases[0].Hostname)
+		require.Equal(t, "web.example.com", aliases[0].Host)
+		require.Equal(t, "0", aliases[0].Enabled)
+
+		require.NoError(t, client.DeleteHostAlias(ctx, got))
+		require.Len(t, server.HostAliases(), 1)
+	})
+
+	t.Run("refuses aliases of host overrides it doesn't have, and duplicates", func(t *testing.T) {
+		server := newServer(t)
+		nas := server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		server.AddHostAlias(unbound.HostAlias{HostID: nas.ID, Hostname: "files", Domain: "example.com"})
+		client := server.UnboundClient()
+
+		_, err := client.CreateHostAlias(ctx, unbound.HostAlias{HostID: "0c1b2a3d-0000-4000-8000-000000000000", Hostname: "www", Domain: "example.com"})
+		var validation *unbound.ValidationError
+		require.ErrorAs(t, err, &validation)
+		require.Contains(t, validation.Fields, "alias.host")
+
+		_, err = client.CreateHostAlias(ctx, unbound.HostAlias{HostID: nas.ID, Hostname: "files", Domain: "example.com"})
+		require.ErrorAs(t, err, &validation)
+		require.Contains(t, validation.Fields, "alias.hostname")
+	})
+}
+
+func TestSearch(t *testing.T) {
+	server := newServer(t)
+	for _, name := range []string{"c", "a", "b"} {
+		server.AddHostOverride(unbound.HostOverride{Hostname: name, Domain: "example.com", Server: "10.0.0.2"})
+	}
+
+	search := func(t *testing.T, body string) map[string]any {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/unbound/settings/searchHostOverride/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth(opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret)
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var res map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res
+	}
+	hostnames := func(res map[string]any) []string {
+		var names []string
+		for _, row := range res["rows"].([]any) {
+			names = append(names, row.(map[string]any)["hostname"].(string))
+		}
+		return names
+	}
+
+	t.Run("pages rows as asked", func(t *testing.T) {
+		res := search(t, `{"current":2,"rowCount":2,"sort":{"hostname":"asc"}}`)
+
+		require.Equal(t, []string{"c"}, hostnames(res))
+		require.Equal(t, float64(1), res["rowCount"])
+		require.Equal(t, float64(3), res["total"])
+		require.Equal(t, float64(2), res["current"])
+	})
+
+	t.Run("returns every row for a row count of -1", func(t *testing.T) {
+		res := search(t, `{"current":1,"rowCount":-1,"sort":{"hostname":"desc"}}`)
+
+		require.Equal(t, []string{"c", "b", "a"}, hostnames(res))
+		require.Equal(t, float64(3), res["total"])
+	})
+
+	t.Run("filters rows by the search phrase", func(t *testing.T) {
+		server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.9"})
+
+		res := search(t, `{"current":1,"rowCount":-1,"searchPhrase":"10.0.0.9"}`)
+
+		require.Equal(t, []string{"nas"}, hostnames(res))
+	})
+}
+
+func TestSettings(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	nas := server.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+	server.AddHostAlias(unbound.HostAlias{HostID: nas.ID, Hostname: "files", Domain: "example.com"})
+	settings := server.HostSettings()
+	settings.Hosts["5b1c3f0e-9d1a-4b8e-8f0a-2c6d7e8f9a0b"] = unbound.SettingsFields{
+		"enabled": "1", "hostname": "", "domain": "example.com", "rr": "MX", "mxprio": "10", "mx": "mail.example.com",
+		"server": "", "description": "",
+	}
+	server.SetHostSettings(settings)
+	client := server.UnboundClient()
+
+	t.Run("reads the records of every type", func(t *testing.T) {
+		got, err := client.GetHostSettings(ctx)
+
+		require.NoError(t, err)
+		require.Equal(t, settings.Hosts, got.Hosts)
+		require.Equal(t, settings.Aliases, got.Aliases)
+	})
+
+	t.Run("writes every record at once", func(t *testing.T) {
+		got, err := client.GetHostSettings(ctx)
+		require.NoError(t, err)
+		got.PutHostOverride(unbound.HostOverride{Hostname: "web", Domain: "example.com", Server: "10.0.0.3"})
+		got.DeleteHostAlias(server.HostAliases()[0].ID)
+
+		require.NoError(t, client.SetHostSettings(ctx, got))
+
+		require.Equal(t, got.Hosts, server.HostSettings().Hosts)
+		require.Empty(t, server.HostAliases())
+		require.True(t, server.Unapplied())
+	})
+
+	t.Run("writes nothing unless every record is valid", func(t *testing.T) {
+		before := server.HostSettings()
+		got := server.HostSettings()
+		got.PutHostOverride(unbound.HostOverride{Hostname: "bad name", Domain: "example.com", Server: "10.0.0.4"})
+
+		err := client.SetHostSettings(ctx, got)
+
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.Equal(t, before, server.HostSettings())
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	server := newServer(t, opnsensetest.WithCredentials("key", "secret"))
+
+	t.Run("accepts its credentials", func(t *testing.T) {
+		checks, err := server.UnboundClient().CheckPrivileges(context.Background())
+
+		require.NoError(t, err)
+		for _, check := range checks {
+			require.True(t, check.Granted, check.String())
+		}
+		require.Empty(t, server.HostOverrides(), "the privilege check adds nothing")
+	})
+
+	t.Run("rejects other credentials", func(t *testing.T) {
+		client, err := unbound.NewClient(server.URL, "key", "wrong", server.Client())
+		require.NoError(t, err)
+
+		_, err = client.ListHostOverrides(context.Background())
+
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+	})
+}
+
+func TestVersion(t *testing.T) {
+	version, err := newServer(t, opnsensetest.WithVersion("25.1")).UnboundClient().Version(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "25.1", version)
+}
+
+func TestTLS(t *testing.T) {
+	server := opnsensetest.NewUnstartedServer()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	_, err := server.UnboundClient().ListHostOverrides(context.Background())
+
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(server.URL, "https://"))
+}
@@ -0,0 +1,517 @@
+package opnsensetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// routes serves the endpoints, one request at a time, as OPNsense locks the configuration while changing it.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern, endpoint string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			s.serve(w, r, s.call(endpoint), handler)
+		})
+	}
+
+	const settings = "/api/unbound/settings/"
+	handle("POST "+settings+"searchHostOverride/{$}", "searchHostOverride", s.searchHostOverride)
+	handle("POST "+settings+"addHostOverride/{$}", "addHostOverride", s.addHostOverride)
+	handle("GET "+settings+"getHostOverride/{uuid}", "getHostOverride", s.getHostOverride)
+	handle("POST "+settings+"setHostOverride/{uuid}", "setHostOverride", s.setHostOverride)
+	handle("POST "+settings+"toggleHostOverride/{uuid}", "toggleHostOverride", s.toggleHostOverride)
+	handle("POST "+settings+"toggleHostOverride/{uuid}/{enabled}", "toggleHostOverride", s.toggleHostOverride)
+	handle("POST "+settings+"delHostOverride/{uuid}", "delHostOverride", s.delHostOverride)
+	handle("POST "+settings+"searchHostAlias/{$}", "searchHostAlias", s.searchHostAlias)
+	handle("POST "+settings+"addHostAlias/{$}", "addHostAlias", s.addHostAlias)
+	handle("GET "+settings+"getHostAlias/{uuid}", "getHostAlias", s.getHostAlias)
+	handle("POST "+settings+"setHostAlias/{uuid}", "setHostAlias", s.setHostAlias)
+	handle("POST "+settings+"toggleHostAlias/{uuid}", "toggleHostAlias", s.toggleHostAlias)
+	handle("POST "+settings+"toggleHostAlias/{uuid}/{enabled}", "toggleHostAlias", s.toggleHostAlias)
+	handle("POST "+settings+"delHostAlias/{uuid}", "delHostAlias", s.delHostAlias)
+	handle("GET "+settings+"get", "get", s.getSettings)
+	handle("POST "+settings+"set", "set", s.setSettings)
+	handle("POST /api/unbound/service/reconfigure", "reconfigure", s.reconfigure)
+	handle("GET /api/core/firmware/status", "status", s.firmwareStatus)
+	return mux
+}
+
+// recordTypes are the record types of host overrides, with how OPNsense names them.
+var recordTypes = []struct{ key, name string }{
+	{"A", "A (IPv4 address)"},
+	{"AAAA", "AAAA (IPv6 address)"},
+	{"MX", "MX (Mail server)"},
+}
+
+// hostFieldNames and aliasFieldNames are the fields of host overrides and aliases.
+var (
+	hostFieldNames  = []string{"enabled", "hostname", "domain", "rr", "mxprio", "mx", "server", "description"}
+	aliasFieldNames = []string{"enabled", "host", "hostname", "domain", "description"}
+)
+
+// searchRequest is the body of a search. rowCount -1 asks for every row.
+type searchRequest struct {
+	Current      int               `json:"current"`
+	RowCount     int               `json:"rowCount"`
+	Sort         map[string]string `json:"sort"`
+	SearchPhrase string            `json:"searchPhrase"`
+	Host         string            `json:"host"`
+}
+
+// row is a record as a search returns it.
+type row map[string]string
+
+func (s *Server) searchHostOverride(w http.ResponseWriter, r *http.Request) {
+	var req searchRequest
+	decode(r, &req)
+
+	rows := make([]row, 0, len(s.settings.Hosts))
+	for id, f := range s.settings.Hosts {
+		rr := f["rr"]
+		if i := slices.IndexFunc(recordTypes, func(t struct{ key, name string }) bool { return t.key == rr }); i >= 0 {
+			rr = recordTypes[i].name
+		}
+		rows = append(rows, row{
+			"uuid": string(id), "enabled": f["enabled"], "hostname": f["hostname"], "domain": f["domain"], "rr": rr,
+			"mxprio": f["mxprio"], "mx": f["mx"], "server": f["server"], "description": f["description"],
+		})
+	}
+	writeJSON(w, search(req, rows))
+}
+
+func (s *Server) searchHostAlias(w http.ResponseWriter, r *http.Request) {
+	var req searchRequest
+	decode(r, &req)
+
+	rows := make([]row, 0, len(s.settings.Aliases))
+	for id, f := range s.settings.Aliases {
+		if req.Host != "" && f["host"] != req.Host {
+			continue
+		}
+		ha, _ := s.settings.HostAlias(id)
+		rows = append(rows, row{
+			"uuid": string(id), "enabled": f["enabled"], "host": ha.Host, "hostname": f["hostname"], "domain": f["domain"],
+			"description": f["description"],
+		})
+	}
+	writeJSON(w, search(req, rows))
+}
+
+// search answers req with a page of rows: those containing the search phrase, sorted as asked.
+// JSON objects have no order, so the fields to sort by are compared in the order of their names.
+func search(req searchRequest, rows []row) map[string]any {
+	if phrase := strings.ToLower(req.SearchPhrase); phrase != "" {
+		rows = slices.DeleteFunc(rows, func(r row) bool {
+			for field, value := range r {
+				if field != "uuid" && strings.Contains(strings.ToLower(value), phrase) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	sortBy := make([]string, 0, len(req.Sort))
+	for field := range req.Sort {
+		sortBy = append(sortBy, field)
+	}
+	slices.Sort(sortBy)
+	slices.SortFunc(rows, func(a, b row) int {
+		for _, field := range sortBy {
+			c := strings.Compare(a[field], b[field])
+			if req.Sort[field] == "desc" {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return strings.Compare(a["uuid"], b["uuid"])
+	})
+
+	total, current := len(rows), max(req.Current, 1)
+	if req.RowCount > 0 {
+		start := min((current-1)*req.RowCount, total)
+		rows = rows[start:min(start+req.RowCount, total)]
+	}
+	return map[string]any{"rows": rows, "rowCount": len(rows), "total": total, "current": current}
+}
+
+func (s *Server) addHostOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host unbound.SettingsFields `json:"host"`
+	}
+	decode(r, &req)
+
+	id := unbound.HostOverrideID(newUUID())
+	host := fields(hostFieldNames, nil, req.Host)
+	if v := validateHost(id, host, s.settings.Hosts); len(v) > 0 {
+		writeJSON(w, failed("host.", v))
+		return
+	}
+	s.settings.Hosts[id] = host
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "saved", "uuid": id})
+}
+
+func (s *Server) getHostOverride(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.settings.Hosts[unbound.HostOverrideID(r.PathValue("uuid"))]
+	if !ok {
+		writeJSON(w, []any{})
+		return
+	}
+	writeJSON(w, map[string]any{"host": s.renderHost(f)})
+}
+
+func (s *Server) setHostOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Host unbound.SettingsFields `json:"host"`
+	}
+	decode(r, &req)
+
+	id := unbound.HostOverrideID(r.PathValue("uuid"))
+	existing, ok := s.settings.Hosts[id]
+	if !ok {
+		writeJSON(w, map[string]any{"result": "failed"})
+		return
+	}
+	host := fields(hostFieldNames, existing, req.Host)
+	if v := validateHost(id, host, s.settings.Hosts); len(v) > 0 {
+		writeJSON(w, failed("host.", v))
+		return
+	}
+	s.settings.Hosts[id] = host
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "saved"})
+}
+
+func (s *Server) toggleHostOverride(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.toggle(s.settings.Hosts[unbound.HostOverrideID(r.PathValue("uuid"))], r.PathValue("enabled")))
+}
+
+func (s *Server) delHostOverride(w http.ResponseWriter, r *http.Request) {
+	id := unbound.HostOverrideID(r.PathValue("uuid"))
+	if _, ok := s.settings.Hosts[id]; !ok {
+		writeJSON(w, map[string]any{"result": "not found"})
+		return
+	}
+	delete(s.settings.Hosts, id)
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "deleted"})
+}
+
+func (s *Server) addHostAlias(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias unbound.SettingsFields `json:"alias"`
+	}
+	decode(r, &req)
+
+	id := unbound.HostAliasID(newUUID())
+	alias := fields(aliasFieldNames, nil, req.Alias)
+	if v := validateAlias(id, alias, s.settings.Hosts, s.settings.Aliases); len(v) > 0 {
+		writeJSON(w, failed("alias.", v))
+		return
+	}
+	s.settings.Aliases[id] = alias
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "saved", "uuid": id})
+}
+
+func (s *Server) getHostAlias(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.settings.Aliases[unbound.HostAliasID(r.PathValue("uuid"))]
+	if !ok {
+		writeJSON(w, []any{})
+		return
+	}
+	writeJSON(w, map[string]any{"alias": s.renderAlias(f)})
+}
+
+func (s *Server) setHostAlias(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias unbound.SettingsFields `json:"alias"`
+	}
+	decode(r, &req)
+
+	id := unbound.HostAliasID(r.PathValue("uuid"))
+	existing, ok := s.settings.Aliases[id]
+	if !ok {
+		writeJSON(w, map[string]any{"result": "failed"})
+		return
+	}
+	alias := fields(aliasFieldNames, existing, req.Alias)
+	if v := validateAlias(id, alias, s.settings.Hosts, s.settings.Aliases); len(v) > 0 {
+		writeJSON(w, failed("alias.", v))
+		return
+	}
+	s.settings.Aliases[id] = alias
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "saved"})
+}
+
+func (s *Server) toggleHostAlias(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.toggle(s.settings.Aliases[unbound.HostAliasID(r.PathValue("uuid"))], r.PathValue("enabled")))
+}
+
+func (s *Server) delHostAlias(w http.ResponseWriter, r *http.Request) {
+	id := unbound.HostAliasID(r.PathValue("uuid"))
+	if _, ok := s.settings.Aliases[id]; !ok {
+		writeJSON(w, map[string]any{"result": "not found"})
+		return
+	}
+	delete(s.settings.Aliases, id)
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "deleted"})
+}
+
+// toggle sets the enabled field of f to enabled, or flips it when enabled is empty. f is nil for records
+// that don't exist.
+func (s *Server) toggle(f unbound.SettingsFields, enabled string) map[string]any {
+	if f == nil || enabled != "" && enabled != "0" && enabled != "1" {
+		return map[string]any{"result": "failed"}
+	}
+	if enabled == "" {
+		enabled = "1"
+		if f["enabled"] == "1" {
+			enabled = "0"
+		}
+	}
+	f["enabled"] = enabled
+	s.unapplied = true
+	if enabled == "1" {
+		return map[string]any{"result": "Enabled", "changed": true}
+	}
+	return map[string]any{"result": "Disabled", "changed": true}
+}
+
+func (s *Server) getSettings(w http.ResponseWriter, _ *http.Request) {
+	// Empty sections come as arrays
+	var hosts, aliases any = []any{}, []any{}
+	if len(s.settings.Hosts) > 0 {
+		rendered := map[unbound.HostOverrideID]any{}
+		for id, f := range s.settings.Hosts {
+			rendered[id] = s.renderHost(f)
+		}
+		hosts = rendered
+	}
+	if len(s.settings.Aliases) > 0 {
+		rendered := map[unbound.HostAliasID]any{}
+		for id, f := range s.settings.Aliases {
+			rendered[id] = s.renderAlias(f)
+		}
+		aliases = rendered
+	}
+	writeJSON(w, map[string]any{"unbound": map[string]any{
+		"general": map[string]any{"enabled": "1"},
+		"hosts":   map[string]any{"host": hosts},
+		"aliases": map[string]any{"alias": aliases},
+	}})
+}
+
+// setSettings replaces the host overrides and aliases with those sent, for each of the two sent.
+// Nothing is changed unless every record sent is valid.
+func (s *Server) setSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Unbound struct {
+			Hosts *struct {
+				Host map[unbound.HostOverrideID]unbound.SettingsFields `json:"host"`
+			} `json:"hosts"`
+			Aliases *struct {
+				Alias map[unbound.HostAliasID]unbound.SettingsFields `json:"alias"`
+			} `json:"aliases"`
+		} `json:"unbound"`
+	}
+	decode(r, &req)
+
+	settings := cloneSettings(s.settings)
+	if req.Unbound.Hosts != nil {
+		settings.Hosts = map[unbound.HostOverrideID]unbound.SettingsFields{}
+		for id, f := range req.Unbound.Hosts.Host {
+			settings.Hosts[id] = fields(hostFieldNames, nil, f)
+		}
+	}
+	if req.Unbound.Aliases != nil {
+		settings.Aliases = map[unbound.HostAliasID]unbound.SettingsFields{}
+		for id, f := range req.Unbound.Aliases.Alias {
+			settings.Aliases[id] = fields(aliasFieldNames, nil, f)
+		}
+	}
+
+	validations := map[string]string{}
+	for id, f := range settings.Hosts {
+		for field, msg := range validateHost(id, f, settings.Hosts) {
+			validations["hosts.host."+string(id)+"."+field] = msg
+		}
+	}
+	for id, f := range settings.Aliases {
+		for field, msg := range validateAlias(id, f, settings.Hosts, settings.Aliases) {
+			validations["aliases.alias."+string(id)+"."+field] = msg
+		}
+	}
+	if len(validations) > 0 {
+		writeJSON(w, failed("unbound.", validations))
+		return
+	}
+
+	s.settings = settings
+	s.unapplied = true
+	writeJSON(w, map[string]any{"result": "saved"})
+}
+
+func (s *Server) reconfigure(w http.ResponseWriter, _ *http.Request) {
+	s.unapplied = false
+	writeJSON(w, map[string]any{"status": "ok"})
+}
+
+func (s *Server) firmwareStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]any{
+		"product": map[string]any{"product_name": "OPNsense", "product_version": s.version},
+		"status":  "none",
+	})
+}
+
+// renderHost renders the fields of a host override as getting it does, with its record type as options.
+func (s *Server) renderHost(f unbound.SettingsFields) map[string]any {
+	rendered := map[string]any{}
+	for _, name := range hostFieldNames {
+		rendered[name] = f[name]
+	}
+	rr := unbound.SelectOptions{}
+	for _, t := range recordTypes {
+		rr[t.key] = selectOption(t.name, t.key == f["rr"])
+	}
+	rendered["rr"] = rr
+	return rendered
+}
+
+// renderAlias renders the fields of an alias as getting it does, with its host override as options.
+func (s *Server) renderAlias(f unbound.SettingsFields) map[string]any {
+	rendered := map[string]any{}
+	for _, name := range aliasFieldNames {
+		rendered[name] = f[name]
+	}
+	hosts := unbound.SelectOptions{"": selectOption("none", f["host"] == "")}
+	for id := range s.settings.Hosts {
+		ho, _ := s.settings.HostOverride(id)
+		hosts[string(id)] = selectOption(ho.DNSName(), string(id) == f["host"])
+	}
+	rendered["host"] = hosts
+	return rendered
+}
+
+func selectOption(value string, selected bool) unbound.SelectOption {
+	if selected {
+		return unbound.SelectOption{Value: value, Selected: 1}
+	}
+	return unbound.SelectOption{Value: value}
+}
+
+var (
+	hostnamePattern = regexp.MustCompile(`^(\*|[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?)$`)
+	domainPattern   = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?(\.[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?)*$`)
+)
+
+// validateHost returns the problems with the host override f, with the given id among hosts, by field.
+func validateHost(id unbound.HostOverrideID, f unbound.SettingsFields, hosts map[unbound.HostOverrideID]unbound.SettingsFields) map[string]string {
+	v := map[string]string{}
+	if f["enabled"] != "0" && f["enabled"] != "1" {
+		v["enabled"] = "Value should be a boolean (0,1)."
+	}
+	if f["hostname"] != "" && !hostnamePattern.MatchString(f["hostname"]) {
+		v["hostname"] = "A valid hostname is required."
+	}
+	if !domainPattern.MatchString(f["domain"]) {
+		v["domain"] = "A valid domain must be specified."
+	}
+	switch f["rr"] {
+	case "A":
+		if addr, err := netip.ParseAddr(f["server"]); err != nil || !addr.Is4() {
+			v["server"] = "A valid IPv4 address must be specified for A records."
+		}
+	case "AAAA":
+		if addr, err := netip.ParseAddr(f["server"]); err != nil || !addr.Is6() {
+			v["server"] = "A valid IPv6 address must be specified for AAAA records."
+		}
+	case "MX":
+		if !domainPattern.MatchString(f["mx"]) {
+			v["mx"] = "A valid mail server must be specified for MX records."
+		}
+		if _, err := strconv.ParseUint(f["mxprio"], 10, 16); err != nil {
+			v["mxprio"] = "A valid priority must be specified for MX records."
+		}
+	default:
+		v["rr"] = "Option not in list."
+	}
+
+	for other, o := range hosts {
+		if other != id && o["hostname"] == f["hostname"] && o["domain"] == f["domain"] && o["rr"] == f["rr"] &&
+			o["server"] == f["server"] && o["mx"] == f["mx"] {
+			v["hostname"] = "A host override with this hostname, domain and value already exists."
+		}
+	}
+	return v
+}
+
+// validateAlias returns the problems with the alias f, with the given id among aliases, by field.
+func validateAlias(id unbound.HostAliasID, f unbound.SettingsFields, hosts map[unbound.HostOverrideID]unbound.SettingsFields, aliases map[unbound.HostAliasID]unbound.SettingsFields) map[string]string {
+	v := map[string]string{}
+	if f["enabled"] != "0" && f["enabled"] != "1" {
+		v["enabled"] = "Value should be a boolean (0,1)."
+	}
+	if _, ok := hosts[unbound.HostOverrideID(f["host"])]; !ok {
+		v["host"] = "Related item not found."
+	}
+	if f["hostname"] != "" && !hostnamePattern.MatchString(f["hostname"]) {
+		v["hostname"] = "A valid hostname is required."
+	}
+	if !domainPattern.MatchString(f["domain"]) {
+		v["domain"] = "A valid domain must be specified."
+	}
+
+	for other, o := range aliases {
+		if other != id && o["hostname"] == f["hostname"] && o["domain"] == f["domain"] {
+			v["hostname"] = "An alias with this hostname and domain already exists."
+		}
+	}
+	return v
+}
+
+// failed is the answer to a change refused for validations, each prefixed with prefix.
+func failed(prefix string, validations map[string]string) map[string]any {
+	prefixed := make(map[string]string, len(validations))
+	for field, msg := range validations {
+		prefixed[prefix+field] = msg
+	}
+	return map[string]any{"result": "failed", "validations": prefixed}
+}
+
+// fieldDefaults are the fields of records added without them.
+var fieldDefaults = unbound.SettingsFields{"enabled": "1", "rr": "A"}
+
+// fields returns the fields of a record named by names: those sent, or else those of the existing record,
+// if any, or else their defaults.
+func fields(names []string, existing, sent unbound.SettingsFields) unbound.SettingsFields {
+	f := unbound.SettingsFields{}
+	for _, name := range names {
+		switch value, ok := sent[name]; {
+		case ok:
+			f[name] = value
+		case existing != nil:
+			f[name] = existing[name]
+		default:
+			f[name] = fieldDefaults[name]
+		}
+	}
+	return f
+}
+
+// decode decodes the JSON body of r into v, leaving v as it is if it can't: OPNsense treats such bodies as empty.
+func decode(r *http.Request, v any) {
+	json.NewDecoder(r.Body).Decode(v)
+}
@@ -0,0 +1,1210 @@
+package unbound
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// API is the subset of the OPNsense Unbound API used to manage host overrides and their aliases.
+// Client implements it; unboundtest.Fake fakes it in memory for tests.
+type API interface {
+	ListHostOverrides(context.Context) ([]HostOverride, error)
+	CreateHostOverride(context.Context, HostOverride) (HostOverride, error)
+	DeleteHostOverride(context.Context, HostOverride) error
+	UpdateHostOverride(context.Context, HostOverride) error
+	GetHostOverride(context.Context, HostOverrideID) (HostOverride, error)
+	ToggleHostOverride(context.Context, HostOverrideID, bool) error
+	ListHostAliases(context.Context, HostOverrideID) ([]HostAlias, error)
+	CreateHostAlias(context.Context, HostAlias) (HostAlias, error)
+	UpdateHostAlias(context.Context, HostAlias) error
+	GetHostAlias(context.Context, HostAliasID) (HostAlias, error)
+	ToggleHostAlias(context.Context, HostAliasID, bool) error
+	DeleteHostAlias(context.Context, HostAlias) error
+	Reconfigure(context.Context) error
+	Version(context.Context) (string, error)
+}
+
+// DefaultMaxResponseSize is the default limit on the size of an OPNsense API response body.
+const DefaultMaxResponseSize = 32 << 20
+
+// maxPresize caps how many rows are preallocated based on the total reported by a search response.
+const maxPresize = 4096
+
+// Client calls the OPNsense Unbound API. It is safe for concurrent use.
+type Client struct {
+	url *url.URL
+
+	// maxResponseSize limits the size of response bodies. Larger responses fail to decode.
+	maxResponseSize int64
+
+	client      *http.Client
+	credentials func() (apiKey, apiSecret string)
+	userAgent   string
+	logger      *slog.Logger
+	webhook     string
+	debugHTTP   bool
+	middleware  []func(http.RoundTripper) http.RoundTripper
+	retry       RetryPolicy
+	breaker     *CircuitBreaker
+	warnings    *ValidationWarnings
+	callTimeout time.Duration
+	inflight    inflightLimiter
+
+	// lockMessages are the lower case messages of changes refused because the configuration is locked
+	lockMessages []string
+
+	slowCallThreshold time.Duration
+}
+
+type Option func(*Client)
+
+// WithCredentials authenticates every request with the API key and secret credentials returns at the time,
+// instead of those given to New, so that they can change while the client is in use.
+func WithCredentials(credentials func() (apiKey, apiSecret string)) Option {
+	return func(u *Client) {
+		u.credentials = credentials
+	}
+}
+
+// WithHTTPClient makes requests with c, which should trust the OPNsense certificate. Defaults to a client
+// with the default transport.
+func WithHTTPClient(c *http.Client) Option {
+	return func(u *Client) {
+		if c != nil {
+			u.client = c
+		}
+	}
+}
+
+// WithUserAgent sets the User-Agent header of every request. Defaults to Go's.
+func WithUserAgent(ua string) Option {
+	return func(u *Client) {
+		u.userAgent = ua
+	}
+}
+
+// WithWebhookName reports the metrics of the client as those of the webhook named, for processes serving
+// several webhooks. They are metrics.Default otherwise.
+func WithWebhookName(name string) Option {
+	return func(u *Client) {
+		u.webhook = name
+	}
+}
+
+// WithLogger logs with l instead of slog.Default(). Records carry component=api.
+func WithLogger(l *slog.Logger) Option {
+	return func(u *Client) {
+		if l != nil {
+			u.logger = l
+		}
+	}
+}
+
+// WithMaxResponseSize limits the size of response bodies to n bytes. Defaults to DefaultMaxResponseSize.
+func WithMaxResponseSize(n int64) Option {
+	return func(u *Client) {
+		u.maxResponseSize = n
+	}
+}
+
+// WithPerCallTimeout bounds every call, including its retries, to d, so that a single slow call
+// can't use up the caller's whole deadline. 0 disables the timeout.
+func WithPerCallTimeout(d time.Duration) Option {
+	return func(u *Client) {
+		u.callTimeout = d
+	}
+}
+
+// New returns a client for the OPNsense at baseURL, authenticating with an API key and secret
+// created under System > Access > Users.
+func New(baseURL, apiKey, apiSecret string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad base url %q: %w", baseURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("bad base url %q: scheme and host are required", baseURL)
+	}
+
+	c := &Client{
+		url:             u,
+		maxResponseSize: DefaultMaxResponseSize,
+		client:          &http.Client{},
+		logger:          slog.Default(),
+		retry:           RetryPolicy{MaxAttempts: 1},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.logger = c.logger.With(slog.String("component", "api"))
+
+	client := *c.client
+	client.Transport = c.transport(client.Transport, apiKey, apiSecret)
+	c.client = &client
+
+	return c, nil
+}
+
+// NewClient is New with WithHTTPClient(client).
+func NewClient(baseURL string, apiKey, apiSecret string, client *http.Client, opts ...Option) (*Client, error) {
+	return New(baseURL, apiKey, apiSecret, append([]Option{WithHTTPClient(client)}, opts...)...)
+}
+
+// DescriptionProperty is the endpoint provider-specific property holding the description of a record.
+// external-dns sets it from the external-dns.alpha.kubernetes.io/webhook-opnsense-description annotation.
+const DescriptionProperty = "webhook/opnsense-description"
+
+type HostOverrideID string
+
+type HostOverride struct {
+	ID       HostOverrideID
+	Enabled  string // "1", or "0" for disabled records. Create and update always enable records
+	Hostname string
+	Domain   string
+	Server   string
+
+	// Description is only managed by external-dns for endpoints with DescriptionProperty.
+	// MXPrio and MX aren't managed by external-dns, but are kept on update.
+	Description string
+	MXPrio      string
+	MX          string
+}
+
+func (r *HostOverride) Endpoint() *endpoint.Endpoint {
+	return withDescription(&endpoint.Endpoint{
+		DNSName:    r.DNSName(),
+		Targets:    endpoint.NewTargets(r.Server),
+		RecordType: "A",
+	}, r.Description)
+}
+
+// Update sets the fields managed by external-dns from ep. The description is left as it is
+// unless ep has DescriptionProperty, which may be empty to clear it.
+func (r *HostOverride) Update(ep *endpoint.Endpoint) {
+	parts := strings.SplitN(ep.DNSName, ".", 2)
+	r.Hostname = parts[0]
+	r.Domain = parts[1]
+	r.Server = ep.Targets[0]
+	if description, ok := ep.GetProviderSpecificProperty(DescriptionProperty); ok {
+		r.Description = description
+	}
+}
+
+func (r *HostOverride) DNSName() string {
+	return joinDNSName(r.Hostname, r.Domain)
+}
+
+type HostAliasID string
+
+type HostAlias struct {
+	ID          HostAliasID    `json:"uuid"`        // "f61b5bdb-8b51-46ff-a47f-ace0f5ca94b7"
+	Enabled     string         `json:"enabled"`     // "1"
+	Host        string         `json:"host"`        // "traefik.home.yarotsky.me"
+	HostID      HostOverrideID `json:"-"`           // "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"
+	Hostname    string         `json:"hostname"`    // "test"
+	Domain      string         `json:"domain"`      // "home.yarotsky.me"
+	Description string         `json:"description"` // ""
+}
+
+func (r *HostAlias) Endpoint() *endpoint.Endpoint {
+	return withDescription(&endpoint.Endpoint{
+		DNSName:    r.DNSName(),
+		Targets:    endpoint.NewTargets(r.Host),
+		RecordType: "CNAME",
+	}, r.Description)
+}
+
+// Update sets the fields managed by external-dns from ep, and the description like HostOverride.Update.
+func (r *HostAlias) Update(ep *endpoint.Endpoint) {
+	parts := strings.SplitN(ep.DNSName, ".", 2)
+	r.Hostname = parts[0]
+	r.Domain = parts[1]
+	r.Host = ep.Targets[0]
+	if description, ok := ep.GetProviderSpecificProperty(DescriptionProperty); ok {
+		r.Description = description
+	}
+}
+
+// withDescription sets DescriptionProperty on ep, unless the description is empty.
+func withDescription(ep *endpoint.Endpoint, description string) *endpoint.Endpoint {
+	if description != "" {
+		ep.SetProviderSpecificProperty(DescriptionProperty, description)
+	}
+	return ep
+}
+
+func (r *HostAlias) DNSName() string {
+	return joinDNSName(r.Hostname, r.Domain)
+}
+
+func joinDNSName(hostname, domain string) string {
+	var b strings.Builder
+	b.Grow(len(hostname) + 1 + len(domain))
+	b.WriteString(hostname)
+	b.WriteByte('.')
+	b.WriteString(domain)
+	return b.String()
+}
+
+type HostOverrideRequest struct {
+	Host HostOverrideRequestHost `json:"host"`
+}
+
+type HostOverrideRequestHost struct {
+	Enabled     string `json:"enabled"`     // "1"
+	Hostname    string `json:"hostname"`    // "ha"
+	Domain      string `json:"domain"`      // "home.yarotsky.me"
+	RR          string `json:"rr"`          // "A"
+	MXPrio      string `json:"mxprio"`      // ""
+	MX          string `json:"mx"`          // ""
+	Server      string `json:"server"`      // "192.168.1.13"
+	Description string `json:"description"` // ""
+}
+
+type AddHostOverrideResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	ID          HostOverrideID         `json:"uuid"`   // "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+type UpdateHostOverrideResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+type DeleteHostOverrideResponse struct {
+	Result string `json:"result"` // "deleted"
+}
+
+type SearchHostOverrideRequest struct {
+	Current  int `json:"current"`
+	RowCount int `json:"rowCount"`
+	// Sort maps the fields to sort rows by to "asc" or "desc"
+	Sort map[string]string `json:"sort,omitempty"`
+}
+
+type SearchHostOverrideResponse struct {
+	Rows     []SearchHostOverride `json:"rows"`
+	RowCount int                  `json:"rowCount"`
+	Total    int                  `json:"total"`
+	Current  int                  `json:"current"`
+}
+
+type SearchHostOverride struct {
+	ID          HostOverrideID `json:"uuid"`        // "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"
+	Enabled     string         `json:"enabled"`     // "1"
+	Hostname    string         `json:"hostname"`    // "ha"
+	Domain      string         `json:"domain"`      // "home.yarotsky.me"
+	MXPrio      string         `json:"mxprio"`      // ""
+	MX          string         `json:"mx"`          // ""
+	Server      string         `json:"server"`      // "192.168.1.13"
+	Description string         `json:"description"` // ""
+}
+
+type SetHostOverrideResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+type SearchHostAliasRequest struct {
+	Current  int            `json:"current"`
+	RowCount int            `json:"rowCount"`
+	HostID   HostOverrideID `json:"host"`
+	// Sort maps the fields to sort rows by to "asc" or "desc"
+	Sort map[string]string `json:"sort,omitempty"`
+}
+
+type SearchHostAliasResponse struct {
+	Rows     []SearchHostAlias `json:"rows"`
+	RowCount int               `json:"rowCount"`
+	Total    int               `json:"total"`
+	Current  int               `json:"current"`
+}
+
+type SearchHostAlias struct {
+	ID          HostAliasID `json:"uuid"`        // "18b07c57-fce4-43ad-8bd8-5fb0e8777800"
+	Enabled     string      `json:"enabled"`     // "1"
+	Hostname    string      `json:"hostname"`    // "ha"
+	Domain      string      `json:"domain"`      // "home.yarotsky.me"
+	Host        string      `json:"host"`        // "traefik.home.yarotsky.me"
+	Description string      `json:"description"` // ""
+}
+
+type HostAliasRequest struct {
+	Alias HostAliasRequestAlias `json:"alias"`
+}
+
+type HostAliasRequestAlias struct {
+	Enabled     string         `json:"enabled"`     // "1"
+	HostID      HostOverrideID `json:"host"`        // "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"
+	Hostname    string         `json:"hostname"`    // "ha"
+	Domain      string         `json:"domain"`      // "home.yarotsky.me"
+	Description string         `json:"description"` // ""
+}
+
+type AddHostAliasResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	ID          HostAliasID            `json:"uuid"`   // "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+type UpdateHostAliasResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+type DeleteHostAliasResponse struct {
+	Result string `json:"result"` // "deleted"
+}
+
+// SelectOptions is how OPNsense renders an option field when getting a single object:
+// every option it could take, keyed by value, with the chosen ones selected.
+type SelectOptions map[string]SelectOption
+
+type SelectOption struct {
+	Value    string `json:"value"`    // "A (IPv4 address)"
+	Selected int    `json:"selected"` // 1
+}
+
+// Selected returns the key of the selected option, or "" if none is.
+func (o SelectOptions) Selected() string {
+	for key, opt := range o {
+		if opt.Selected == 1 {
+			return key
+		}
+	}
+	return ""
+}
+
+type GetHostOverrideResponse struct {
+	Host GetHostOverride `json:"host"`
+}
+
+type GetHostOverride struct {
+	Enabled     string        `json:"enabled"`     // "1"
+	Hostname    string        `json:"hostname"`    // "ha"
+	Domain      string        `json:"domain"`      // "home.yarotsky.me"
+	RR          SelectOptions `json:"rr"`          // {"A": {"value": "A (IPv4 address)", "selected": 1}, ...}
+	MXPrio      string        `json:"mxprio"`      // ""
+	MX          string        `json:"mx"`          // ""
+	Server      string        `json:"server"`      // "192.168.1.13"
+	Description string        `json:"description"` // ""
+}
+
+type GetHostAliasResponse struct {
+	Alias GetHostAlias `json:"alias"`
+}
+
+type GetHostAlias struct {
+	Enabled     string        `json:"enabled"`     // "1"
+	Host        SelectOptions `json:"host"`        // {"2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c": {"value": "ha.home.yarotsky.me", "selected": 1}, ...}
+	Hostname    string        `json:"hostname"`    // "test"
+	Domain      string        `json:"domain"`      // "home.yarotsky.me"
+	Description string        `json:"description"` // ""
+}
+
+type ToggleResponse struct {
+	Result string `json:"result"` // "Enabled"
+}
+
+type ReconfigureResponse struct {
+	Status string `json:"status"` // "ok"
+}
+
+type FirmwareStatusResponse struct {
+	ProductVersion string                `json:"product_version"` // "24.7.1"
+	Product        FirmwareStatusProduct `json:"product"`
+}
+
+type FirmwareStatusProduct struct {
+	ProductVersion string `json:"product_version"` // "24.7.1"
+}
+
+// searchSort sorts search rows by name, so that they don't shift between pages.
+func searchSort() map[string]string {
+	return map[string]string{"hostname": "asc", "domain": "asc"}
+}
+
+// ListHostOverrides returns the host overrides sorted by domain, then hostname.
+func (u *Client) ListHostOverrides(ctx context.Context) ([]HostOverride, error) {
+	req := &SearchHostOverrideRequest{Current: 1, RowCount: -1, Sort: searchSort()}
+
+	result := []HostOverride{}
+
+	err := u.post(ctx, "/api/unbound/settings/searchHostOverride/", req, func(r io.Reader) error {
+		return decodeSearchRows(r,
+			func(total int) { result = make([]HostOverride, 0, min(total, maxPresize)) },
+			func(row SearchHostOverride) {
+				rec := HostOverride{
+					ID:          HostOverrideID(row.ID),
+					Enabled:     row.Enabled,
+					Hostname:    row.Hostname,
+					Domain:      row.Domain,
+					Server:      row.Server,
+					Description: row.Description,
+					MXPrio:      row.MXPrio,
+					MX:          row.MX,
+				}
+				result = append(result, rec)
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted here too, so that the order doesn't depend on how OPNsense applies the sort
+	sortHostOverrides(result)
+
+	return result, nil
+}
+
+func (u *Client) CreateHostOverride(ctx context.Context, rec HostOverride) (HostOverride, error) {
+	req := &HostOverrideRequest{
+		Host: HostOverrideRequestHost{
+			Enabled:     "1",
+			Hostname:    rec.Hostname,
+			Domain:      rec.Domain,
+			RR:          "A",
+			MXPrio:      rec.MXPrio,
+			MX:          rec.MX,
+			Server:      rec.Server,
+			Description: rec.Description,
+		},
+	}
+
+	var res AddHostOverrideResponse
+
+	raw, err := u.postResult(ctx, "addHostOverride", "/api/unbound/settings/addHostOverride/", req, &res)
+	if err != nil {
+		return rec, err
+	}
+	if err := checkResult("addHostOverride", res.Result, raw); err != nil {
+		u.logger.Error("addHostOverride failed", slog.Any("hostOverride", rec), slog.Any("error", err))
+		return rec, err
+	}
+
+	if res.Result != "saved" {
+		u.logger.Error("addHostOverride failed", slog.Any("hostOverride", rec), slog.Any("response", res))
+		return rec, resultError("addHostOverride", res.Result, res.Validations)
+	}
+	u.warnValidations("addHostOverride", res.Validations, slog.Any("hostOverride", rec))
+
+	if err := checkUUID("addHostOverride", string(res.ID), raw); err != nil {
+		u.logger.Error("addHostOverride failed", slog.Any("hostOverride", rec), slog.Any("error", err))
+		return rec, err
+	}
+
+	rec.ID = res.ID
+
+	return rec, nil
+}
+
+// DeleteHostOverride deletes an A record. A record OPNsense doesn't find is taken as already deleted.
+// rec MUST have ID set.
+func (u *Client) DeleteHostOverride(ctx context.Context, rec HostOverride) error {
+	if err := requireID("delHostOverride", string(rec.ID)); err != nil {
+		return err
+	}
+
+	var res DeleteHostOverrideResponse
+
+	raw, err := u.postResult(ctx, "delHostOverride", "/api/unbound/settings/delHostOverride/"+string(rec.ID), map[string]interface{}{}, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult("delHostOverride", res.Result, raw); err != nil {
+		u.logger.Error("delHostOverride failed", slog.Any("hostOverride", rec), slog.Any("error", err))
+		return err
+	}
+
+	// OPNsense answers so for UUIDs it doesn't know: the record is gone, as after a retried delete
+	if res.Result == "not found" {
+		u.logger.Debug("delHostOverride: already deleted", slog.Any("hostOverride", rec))
+		return nil
+	}
+
+	if res.Result != "deleted" {
+		u.logger.Error("delHostOverride failed", slog.Any("hostOverride", rec), slog.Any("response", res))
+		return resultError("delHostOverride", res.Result, nil)
+	}
+
+	return nil
+}
+
+func (u *Client) UpdateHostOverride(ctx context.Context, rec HostOverride) error {
+	if err := requireID("setHostOverride", string(rec.ID)); err != nil {
+		return err
+	}
+
+	var res UpdateHostOverrideResponse
+
+	req := &HostOverrideRequest{
+		Host: HostOverrideRequestHost{
+			Enabled:     "1",
+			Hostname:    rec.Hostname,
+			Domain:      rec.Domain,
+			RR:          "A",
+			MXPrio:      rec.MXPrio,
+			MX:          rec.MX,
+			Server:      rec.Server,
+			Description: rec.Description,
+		},
+	}
+
+	raw, err := u.postResult(ctx, "setHostOverride", "/api/unbound/settings/setHostOverride/"+string(rec.ID), req, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult("setHostOverride", res.Result, raw); err != nil {
+		u.logger.Error("setHostOverride failed", slog.Any("hostOverride", rec), slog.Any("error", err))
+		return err
+	}
+
+	// OPNsense answers so for UUIDs it doesn't know
+	if res.Result == "failed" && len(res.Validations) == 0 {
+		return fmt.Errorf("setHostOverride failed: %w", ErrNotFound)
+	}
+
+	if res.Result != "saved" {
+		u.logger.Error("setHostOverride failed", slog.Any("hostOverride", rec), slog.Any("response", res))
+		return resultError("setHostOverride", res.Result, res.Validations)
+	}
+	u.warnValidations("setHostOverride", res.Validations, slog.Any("hostOverride", rec))
+
+	return nil
+}
+
+// GetHostOverride returns the host override with the given ID, or ErrNotFound.
+func (u *Client) GetHostOverride(ctx context.Context, id HostOverrideID) (HostOverride, error) {
+	if err := requireID("getHostOverride", string(id)); err != nil {
+		return HostOverride{}, err
+	}
+
+	var res GetHostOverrideResponse
+
+	found, err := u.getObject(ctx, "/api/unbound/settings/getHostOverride/"+string(id), &res)
+	if err != nil {
+		return HostOverride{}, err
+	}
+	if !found {
+		return HostOverride{}, fmt.Errorf("getHostOverride failed: %w", ErrNotFound)
+	}
+
+	return HostOverride{
+		ID:          id,
+		Enabled:     res.Host.Enabled,
+		Hostname:    res.Host.Hostname,
+		Domain:      res.Host.Domain,
+		Server:      res.Host.Server,
+		Description: res.Host.Description,
+		MXPrio:      res.Host.MXPrio,
+		MX:          res.Host.MX,
+	}, nil
+}
+
+// ToggleHostOverride enables or disables the host override with the given ID, leaving its other fields as they are.
+func (u *Client) ToggleHostOverride(ctx context.Context, id HostOverrideID, enabled bool) error {
+	return u.toggle(ctx, "toggleHostOverride", string(id), enabled)
+}
+
+// ListHostAliases returns the aliases of the host override with the given ID, sorted by domain, then hostname.
+func (u *Client) ListHostAliases(ctx context.Context, id HostOverrideID) ([]HostAlias, error) {
+	req := &SearchHostAliasRequest{
+		Current:  1,
+		RowCount: -1,
+		HostID:   id,
+		Sort:     searchSort(),
+	}
+
+	result := []HostAlias{}
+
+	err := u.post(ctx, "/api/unbound/settings/searchHostAlias/", req, func(r io.Reader) error {
+		return decodeSearchRows(r,
+			func(total int) { result = make([]HostAlias, 0, min(total, maxPresize)) },
+			func(row SearchHostAlias) {
+				rec := HostAlias{
+					ID:          HostAliasID(row.ID),
+					Enabled:     row.Enabled,
+					Hostname:    row.Hostname,
+					Domain:      row.Domain,
+					Host:        row.Host,
+					HostID:      id,
+					Description: row.Description,
+				}
+				result = append(result, rec)
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortHostAliases(result)
+
+	return result, nil
+}
+
+// sortHostOverrides sorts overrides by domain, then hostname, as listings return them.
+func sortHostOverrides(hos []HostOverride) {
+	slices.SortStableFunc(hos, func(a, b HostOverride) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), strings.Compare(a.Hostname, b.Hostname), strings.Compare(string(a.ID), string(b.ID)))
+	})
+}
+
+// sortHostAliases sorts aliases by domain, then hostname, as listings return them.
+func sortHostAliases(has []HostAlias) {
+	slices.SortStableFunc(has, func(a, b HostAlias) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), strings.Compare(a.Hostname, b.Hostname), strings.Compare(string(a.ID), string(b.ID)))
+	})
+}
+
+func (u *Client) CreateHostAlias(ctx context.Context, rec HostAlias) (HostAlias, error) {
+	req := &HostAliasRequest{
+		Alias: HostAliasRequestAlias{
+			Enabled:     "1",
+			Hostname:    rec.Hostname,
+			Domain:      rec.Domain,
+			HostID:      rec.HostID,
+			Description: rec.Description,
+		},
+	}
+
+	var res AddHostAliasResponse
+
+	raw, err := u.postResult(ctx, "addHostAlias", "/api/unbound/settings/addHostAlias/", req, &res)
+	if err != nil {
+		return rec, err
+	}
+	if err := checkResult("addHostAlias", res.Result, raw); err != nil {
+		u.logger.Error("addHostAlias failed", slog.Any("alias", rec), slog.Any("error", err))
+		return rec, err
+	}
+
+	if res.Result != "saved" {
+		u.logger.Error("addHostAlias failed", slog.Any("alias", rec), slog.Any("response", res))
+		return rec, resultError("addHostAlias", res.Result, res.Validations)
+	}
+	u.warnValidations("addHostAlias", res.Validations, slog.Any("alias", rec))
+
+	if err := checkUUID("addHostAlias", string(res.ID), raw); err != nil {
+		u.logger.Error("addHostAlias failed", slog.Any("alias", rec), slog.Any("error", err))
+		return rec, err
+	}
+
+	rec.ID = res.ID
+
+	return rec, nil
+}
+
+func (u *Client) UpdateHostAlias(ctx context.Context, rec HostAlias) error {
+	if err := requireID("setHostAlias", string(rec.ID)); err != nil {
+		return err
+	}
+
+	req := &HostAliasRequest{
+		Alias: HostAliasRequestAlias{
+			Enabled:     "1",
+			Hostname:    rec.Hostname,
+			Domain:      rec.Domain,
+			HostID:      rec.HostID,
+			Description: rec.Description,
+		},
+	}
+
+	var res UpdateHostAliasResponse
+
+	raw, err := u.postResult(ctx, "setHostAlias", "/api/unbound/settings/setHostAlias/"+string(rec.ID), req, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult("setHostAlias", res.Result, raw); err != nil {
+		u.logger.Error("setHostAlias failed", slog.Any("alias", rec), slog.Any("error", err))
+		return err
+	}
+
+	// OPNsense answers so for UUIDs it doesn't know
+	if res.Result == "failed" && len(res.Validations) == 0 {
+		return fmt.Errorf("setHostAlias failed: %w", ErrNotFound)
+	}
+
+	if res.Result != "saved" {
+		u.logger.Error("setHostAlias failed", slog.Any("alias", rec), slog.Any("response", res))
+		return resultError("setHostAlias", res.Result, res.Validations)
+	}
+	u.warnValidations("setHostAlias", res.Validations, slog.Any("alias", rec))
+
+	return nil
+}
+
+// GetHostAlias returns the host alias with the given ID, or ErrNotFound.
+// The alias' Host is the name of the host override it points to.
+func (u *Client) GetHostAlias(ctx context.Context, id HostAliasID) (HostAlias, error) {
+	if err := requireID("getHostAlias", string(id)); err != nil {
+		return HostAlias{}, err
+	}
+
+	var res GetHostAliasResponse
+
+	found, err := u.getObject(ctx, "/api/unbound/settings/getHostAlias/"+string(id), &res)
+	if err != nil {
+		return HostAlias{}, err
+	}
+	if !found {
+		return HostAlias{}, fmt.Errorf("getHostAlias failed: %w", ErrNotFound)
+	}
+
+	hostID := res.Alias.Host.Selected()
+	return HostAlias{
+		ID:          id,
+		Enabled:     res.Alias.Enabled,
+		Host:        res.Alias.Host[hostID].Value,
+		HostID:      HostOverrideID(hostID),
+		Hostname:    res.Alias.Hostname,
+		Domain:      res.Alias.Domain,
+		Description: res.Alias.Description,
+	}, nil
+}
+
+// ToggleHostAlias enables or disables the host alias with the given ID, leaving its other fields as they are.
+func (u *Client) ToggleHostAlias(ctx context.Context, id HostAliasID, enabled bool) error {
+	return u.toggle(ctx, "toggleHostAlias", string(id), enabled)
+}
+
+func (u *Client) toggle(ctx context.Context, op, id string, enabled bool) error {
+	if err := requireID(op, id); err != nil {
+		return err
+	}
+
+	var res ToggleResponse
+
+	state, want := "0", "Disabled"
+	if enabled {
+		state, want = "1", "Enabled"
+	}
+
+	raw, err := u.postResult(ctx, op, "/api/unbound/settings/"+op+"/"+id+"/"+state, map[string]interface{}{}, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult(op, res.Result, raw); err != nil {
+		u.logger.Error(op+" failed", slog.String("id", id), slog.Bool("enabled", enabled), slog.Any("error", err))
+		return err
+	}
+
+	// OPNsense answers so for UUIDs it doesn't know
+	if res.Result == "failed" {
+		return fmt.Errorf("%s failed: %w", op, ErrNotFound)
+	}
+
+	if res.Result != want {
+		u.logger.Error(op+" failed", slog.String("id", id), slog.Bool("enabled", enabled), slog.Any("response", res))
+		return resultError(op, res.Result, nil)
+	}
+
+	return nil
+}
+
+// DelHostAlias deletes a CNAME record. A record OPNsense doesn't find is taken as already deleted.
+// rec MUST have ID set.
+func (u *Client) DeleteHostAlias(ctx context.Context, rec HostAlias) error {
+	if err := requireID("delHostAlias", string(rec.ID)); err != nil {
+		return err
+	}
+
+	var res DeleteHostAliasResponse
+
+	raw, err := u.postResult(ctx, "delHostAlias", "/api/unbound/settings/delHostAlias/"+string(rec.ID), map[string]interface{}{}, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult("delHostAlias", res.Result, raw); err != nil {
+		u.logger.Error("delHostAlias failed", slog.Any("alias", rec), slog.Any("error", err))
+		return err
+	}
+
+	// OPNsense answers so for UUIDs it doesn't know: the record is gone, as after a retried delete
+	if res.Result == "not found" {
+		u.logger.Debug("delHostAlias: already deleted", slog.Any("alias", rec))
+		return nil
+	}
+
+	if res.Result != "deleted" {
+		u.logger.Error("delHostAlias failed", slog.Any("alias", rec), slog.Any("response", res))
+		return resultError("delHostAlias", res.Result, nil)
+	}
+
+	return nil
+}
+
+// Reconfigure applies saved settings to the running Unbound service.
+func (u *Client) Reconfigure(ctx context.Context) error {
+	var res ReconfigureResponse
+
+	if err := u.postJSON(ctx, "/api/unbound/service/reconfigure", map[string]interface{}{}, &res); err != nil {
+		return err
+	}
+
+	if res.Status != "ok" {
+		u.logger.Error("reconfigure failed", slog.Any("response", res))
+		return fmt.Errorf("reconfigure failed: %s", res.Status)
+	}
+
+	return nil
+}
+
+// Version returns the OPNsense product version.
+func (u *Client) Version(ctx context.Context) (string, error) {
+	var res FirmwareStatusResponse
+
+	if err := u.getJSON(ctx, "/api/core/firmware/status", &res); err != nil {
+		return "", err
+	}
+
+	// Older firmware reports the version at the top level
+	if res.Product.ProductVersion != "" {
+		return res.Product.ProductVersion, nil
+	}
+	return res.ProductVersion, nil
+}
+
+func (u *Client) postJSON(ctx context.Context, path string, body interface{}, out interface{}) error {
+	return u.post(ctx, path, body, decodeInto(out))
+}
+
+func (u *Client) getJSON(ctx context.Context, path string, out interface{}) error {
+	return u.do(ctx, "GET", path, nil, decodeInto(out))
+}
+
+// getObject gets a single object into out. OPNsense answers with an empty array for IDs it doesn't know,
+// in which case found is false.
+func (u *Client) getObject(ctx context.Context, path string, out interface{}) (found bool, err error) {
+	err = u.do(ctx, "GET", path, nil, func(r io.Reader) error {
+		var raw json.RawMessage
+		if err := json.NewDecoder(r).Decode(&raw); err != nil {
+			return err
+		}
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("[]")) {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, out)
+	})
+	return found, err
+}
+
+func (u *Client) post(ctx context.Context, path string, body interface{}, decode func(io.Reader) error) error {
+	return u.do(ctx, "POST", path, body, decode)
+}
+
+// postResult posts body to the op endpoint at path, and decodes the response into out.
+// It returns the raw response, for ResponseErrors. Changes refused because the configuration is locked
+// are retried as set by WithRetry.
+func (u *Client) postResult(ctx context.Context, op, path string, body interface{}, out interface{}) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		raw, err := u.postResultOnce(ctx, op, path, body, out)
+		if !errors.Is(err, ErrLocked) || attempt >= u.retry.MaxAttempts {
+			return raw, err
+		}
+
+		delay := u.retry.delay(attempt)
+		u.logger.Warn("retrying request",
+			slog.String("path", path),
+			slog.Int("attempt", attempt),
+			slog.String("reason", "locked"),
+			slog.Duration("delay", delay),
+			slog.Any("error", err),
+		)
+		metrics.For(u.webhook).APIRetries.WithLabelValues("locked").Inc()
+
+		select {
+		case <-ctx.Done():
+			return raw, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (u *Client) postResultOnce(ctx context.Context, op, path string, body interface{}, out interface{}) ([]byte, error) {
+	var raw []byte
+	err := u.post(ctx, path, body, func(r io.Reader) error {
+		var err error
+		if raw, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		if err := u.lockedResponse(op, raw); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, out); err != nil {
+			return &ResponseError{Op: op, Reason: err.Error(), Body: raw}
+		}
+		return nil
+	})
+	return raw, err
+}
+
+// knownResults are the results OPNsense answers changes with.
+var knownResults = map[string]bool{
+	"saved": true, "failed": true, "deleted": true, "not found": true, "Enabled": true, "Disabled": true,
+}
+
+// checkResult returns a ResponseError when result isn't one OPNsense answers with.
+func checkResult(op, result string, raw []byte) error {
+	if !knownResults[result] {
+		return &ResponseError{Op: op, Reason: fmt.Sprintf("unknown result %q", result), Body: raw}
+	}
+	return nil
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// checkUUID returns a ResponseError when id, returned by OPNsense for a new record, isn't a UUID.
+func checkUUID(op, id string, raw []byte) error {
+	if !uuidPattern.MatchString(id) {
+		return &ResponseError{Op: op, Reason: fmt.Sprintf("malformed UUID %q", id), Body: raw}
+	}
+	return nil
+}
+
+// requireID returns ErrInvalidID for an empty id, which would make OPNsense act on no record
+// or on a new one instead of failing.
+func requireID(op, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s failed: %w", op, ErrInvalidID)
+	}
+	return nil
+}
+
+func decodeInto(out interface{}) func(io.Reader) error {
+	return func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(out)
+	}
+}
+
+func (u *Client) do(ctx context.Context, method, path string, body interface{}, decode func(io.Reader) error) error {
+	start := time.Now()
+	defer func() {
+		u.observeCall(ctx, method, path, time.Since(start))
+	}()
+
+	if u.callTimeout <= 0 {
+		return u.doCall(ctx, method, path, body, decode)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, u.callTimeout)
+	defer cancel()
+
+	err := u.doCall(callCtx, method, path, body, decode)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %w", ErrCallTimeout, u.callTimeout, err)
+	}
+	return err
+}
+
+func (u *Client) doCall(ctx context.Context, method, path string, body interface{}, decode func(io.Reader) error) error {
+	logger := u.logger.With(slog.String("path", path), slog.Any("body", body))
+
+	var reqBodyJSON []byte
+	if body != nil {
+		var err error
+		if reqBodyJSON, err = json.Marshal(body); err != nil {
+			logger.Error("failed to serialize request body", slog.Any("error", err))
+			return fmt.Errorf("failed to serialize request body: %w", err)
+		}
+	}
+
+	if u.breaker != nil && !u.breaker.allow(time.Now(), metrics.For(u.webhook)) {
+		logger.Debug("circuit open, not sending request")
+		return ErrCircuitOpen
+	}
+
+	res, err := u.send(ctx, logger, method, path, body != nil, reqBodyJSON)
+	if u.breaker != nil {
+		u.breaker.done(time.Now(), isOutage(res, err), u.logger, metrics.For(u.webhook))
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Error responses, often HTML from a proxy in front of OPNsense, aren't worth decoding
+	if res.StatusCode != http.StatusOK {
+		logger.Error("request failed", slog.Any("status", res.StatusCode))
+		return &StatusError{StatusCode: res.StatusCode}
+	}
+
+	resBody := io.Reader(res.Body)
+	if u.maxResponseSize > 0 {
+		resBody = http.MaxBytesReader(nil, res.Body, u.maxResponseSize)
+	}
+
+	err = decode(resBody)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.Error("response too large", slog.Int64("limit", tooLarge.Limit))
+		return fmt.Errorf("response exceeds the %d byte limit", tooLarge.Limit)
+	}
+	// Responses refused because of the lock are well-formed, and retried by postResult
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	if err != nil {
+		logger.Error("failed to deserialize response", slog.Any("error", err))
+		return fmt.Errorf("failed to deserialize response: %w", err)
+	}
+
+	return nil
+}
+
+// send makes the request, retrying transient failures as configured by WithRetry.
+func (u *Client) send(ctx context.Context, logger *slog.Logger, method, path string, hasBody bool, reqBodyJSON []byte) (*http.Response, error) {
+	url := u.url.JoinPath(path)
+
+	for attempt := 1; ; attempt++ {
+		var reqBody io.Reader
+		if hasBody {
+			reqBody = bytes.NewReader(reqBodyJSON)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, url.String(), reqBody)
+		if err != nil {
+			logger.Error("failed to prepare request", slog.Any("error", err))
+			return nil, fmt.Errorf("failed to prepare request: %w", err)
+		}
+
+		if hasBody {
+			req.Header.Add("Content-Type", "application/json;charset=UTF-8")
+		}
+
+		release, err := u.inflight.acquire(ctx)
+		if err != nil {
+			logger.Error("request failed waiting for a free slot", slog.Any("error", err))
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+
+		res, err := u.client.Do(req)
+		if err != nil {
+			release()
+		} else {
+			res.Body = releasingBody{ReadCloser: res.Body, release: release}
+		}
+
+		// TLS problems won't go away by retrying, and deserve a better message than the x509 error
+		if tlsErr := classifyTLSError(err); tlsErr != nil {
+			logger.Error("request failed", slog.Any("error", tlsErr))
+			return nil, tlsErr
+		}
+
+		reason := retryReason(ctx, res, err)
+		if reason == "" || attempt >= u.retry.MaxAttempts {
+			if err != nil {
+				logger.Error("request failed", slog.Any("error", err))
+				if errors.Is(err, context.Canceled) {
+					return nil, fmt.Errorf("request failed: %w", err)
+				}
+				return nil, fmt.Errorf("request failed: %w: %w", ErrUnavailable, err)
+			}
+			return res, nil
+		}
+
+		delay := u.retry.delay(attempt)
+		attrs := []any{slog.Int("attempt", attempt), slog.String("reason", reason), slog.Duration("delay", delay)}
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		} else {
+			attrs = append(attrs, slog.Int("status", res.StatusCode))
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		logger.Warn("retrying request", attrs...)
+		metrics.For(u.webhook).APIRetries.WithLabelValues(reason).Inc()
+
+		select {
+		case <-ctx.Done():
+			logger.Error("request failed", slog.Any("error", ctx.Err()))
+			return nil, fmt.Errorf("request failed: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// decodeSearchRows decodes a search response one row at a time, so that the rows are never held in memory twice.
+// total is called with the total number of rows if the response reports it before the rows.
+func decodeSearchRows[T any](r io.Reader, total func(int), row func(T)) error {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	seenRows := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case "rows":
+			seenRows = true
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				var t T
+				if err := dec.Decode(&t); err != nil {
+					return err
+				}
+				row(t)
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		case "total":
+			var n int
+			if err := dec.Decode(&n); err != nil {
+				return err
+			}
+			if !seenRows {
+				total(n)
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q, got %v", delim, tok)
+	}
+	return nil
+}
+
+var _ API = &Client{}
@@ -0,0 +1,676 @@
+package unbound_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+var (
+	mux    *http.ServeMux
+	server *httptest.Server
+	client unbound.API
+)
+
+func setup(t *testing.T) (unbound.API, func()) {
+	t.Helper()
+
+	mux = http.NewServeMux()
+	server = httptest.NewServer(mux)
+
+	client, _ = unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", http.DefaultClient)
+
+	return client, func() {
+		server.Close()
+	}
+}
+
+func fixture(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile("testdata/fixtures/" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestListHostOverrides(t *testing.T) {
+	t.Run("returns host overrides", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.SearchHostOverrideRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, 1, req.Current)
+			require.Equal(t, -1, req.RowCount)
+			require.Equal(t, map[string]string{"hostname": "asc", "domain": "asc"}, req.Sort)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/searchHostOverride.json"))
+		})
+
+		got, err := client.ListHostOverrides(context.Background())
+		require.NoError(t, err)
+
+		want := []unbound.HostOverride{
+			{
+				ID:          "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",
+				Enabled:     "1",
+				Hostname:    "ha",
+				Domain:      "home.yarotsky.me",
+				Server:      "192.168.1.13",
+				Description: "Home Assistant",
+			},
+		}
+		require.ElementsMatch(t, want, got)
+	})
+
+	t.Run("sorts host overrides by domain, then hostname", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"total":4,"rowCount":4,"current":1,"rows":[`+
+				`{"uuid":"3","hostname":"b","domain":"a.example.com","server":"127.0.0.1"},`+
+				`{"uuid":"2","hostname":"a","domain":"b.example.com","server":"127.0.0.1"},`+
+				`{"uuid":"4","hostname":"a","domain":"a.example.com","server":"127.0.0.1"},`+
+				`{"uuid":"1","hostname":"a","domain":"a.example.com","server":"127.0.0.1"}]}`)
+		})
+
+		got, err := client.ListHostOverrides(context.Background())
+		require.NoError(t, err)
+
+		ids := make([]unbound.HostOverrideID, 0, len(got))
+		for _, ho := range got {
+			ids = append(ids, ho.ID)
+		}
+		require.Equal(t, []unbound.HostOverrideID{"1", "4", "3", "2"}, ids)
+	})
+}
+
+func TestCreateHostOverride(t *testing.T) {
+	t.Run("creates a host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/addHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.HostOverrideRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, "1", req.Host.Enabled)
+			require.Equal(t, "ha", req.Host.Hostname)
+			require.Equal(t, "home.yarotsky.me", req.Host.Domain)
+			require.Equal(t, "A", req.Host.RR)
+			require.Equal(t, "192.168.1.13", req.Host.Server)
+			require.Equal(t, "Home Assistant", req.Host.Description)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/addHostOverride.json"))
+		})
+
+		rec, err := client.CreateHostOverride(context.Background(), unbound.HostOverride{
+			Hostname:    "ha",
+			Domain:      "home.yarotsky.me",
+			Server:      "192.168.1.13",
+			Description: "Home Assistant",
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"), rec.ID)
+	})
+}
+
+func TestUpdateHostOverride(t *testing.T) {
+	t.Run("updates a host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/setHostOverride/59641e80-1f40-4d28-a7df-314c09c30800", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.HostOverrideRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, "1", req.Host.Enabled)
+			require.Equal(t, "ha", req.Host.Hostname)
+			require.Equal(t, "home.yarotsky.me", req.Host.Domain)
+			require.Equal(t, "A", req.Host.RR)
+			require.Equal(t, "192.168.1.13", req.Host.Server)
+			require.Equal(t, "Home Assistant", req.Host.Description)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/setHostOverride.json"))
+		})
+
+		err := client.UpdateHostOverride(context.Background(), unbound.HostOverride{
+			ID:          "59641e80-1f40-4d28-a7df-314c09c30800",
+			Hostname:    "ha",
+			Domain:      "home.yarotsky.me",
+			Server:      "192.168.1.13",
+			Description: "Home Assistant",
+		})
+
+		require.NoError(t, err)
+	})
+}
+
+func TestGetHostOverride(t *testing.T) {
+	t.Run("returns a host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/getHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodGet, r.Method)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/getHostOverride.json"))
+		})
+
+		ho, err := client.GetHostOverride(context.Background(), "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c")
+
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverride{
+			ID:          "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",
+			Enabled:     "1",
+			Hostname:    "ha",
+			Domain:      "home.yarotsky.me",
+			Server:      "192.168.1.13",
+			Description: "Home Assistant",
+		}, ho)
+	})
+
+	t.Run("fails with ErrNotFound for unknown IDs", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/getHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `[]`)
+		})
+
+		_, err := client.GetHostOverride(context.Background(), "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c")
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+	})
+}
+
+func TestToggleHostOverride(t *testing.T) {
+	for _, tc := range []struct {
+		enabled bool
+		state   string
+		fixture string
+	}{
+		{true, "1", "unbound/toggleHostOverrideEnabled.json"},
+		{false, "0", "unbound/toggleHostOverrideDisabled.json"},
+	} {
+		t.Run(fmt.Sprintf("sets enabled to %v", tc.enabled), func(t *testing.T) {
+			client, teardown := setup(t)
+			t.Cleanup(teardown)
+
+			mux.HandleFunc("/api/unbound/settings/toggleHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c/"+tc.state, func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPost, r.Method)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, fixture(t, tc.fixture))
+			})
+
+			err := client.ToggleHostOverride(context.Background(), "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", tc.enabled)
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("fails when OPNsense reports the other state", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/toggleHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c/1", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/toggleHostOverrideDisabled.json"))
+		})
+
+		err := client.ToggleHostOverride(context.Background(), "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", true)
+		require.EqualError(t, err, "toggleHostOverride failed: Disabled")
+	})
+}
+
+func TestDeleteHostOverride(t *testing.T) {
+	t.Run("deletes a host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, map[string]interface{}{}, req)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/delHostOverride.json"))
+		})
+
+		err := client.DeleteHostOverride(context.Background(), unbound.HostOverride{
+			ID: "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("succeeds for a host override already deleted", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/delHostOverrideNotFound.json"))
+		})
+
+		err := client.DeleteHostOverride(context.Background(), unbound.HostOverride{
+			ID: "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("fails when OPNsense fails to delete the host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostOverride/2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"result":"failed"}`)
+		})
+
+		err := client.DeleteHostOverride(context.Background(), unbound.HostOverride{
+			ID: "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c",
+		})
+
+		require.EqualError(t, err, "delHostOverride failed: failed")
+	})
+}
+
+func TestListHostAliases(t *testing.T) {
+	t.Run("returns host aliases", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostAlias/", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.SearchHostAliasRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, 1, req.Current)
+			require.Equal(t, -1, req.RowCount)
+			require.Equal(t, unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"), req.HostID)
+			require.Equal(t, map[string]string{"hostname": "asc", "domain": "asc"}, req.Sort)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/searchHostAlias.json"))
+		})
+
+		got, err := client.ListHostAliases(context.Background(), unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"))
+		require.NoError(t, err)
+
+		want := []unbound.HostAlias{
+			{
+				ID:          "18b07c57-fce4-43ad-8bd8-5fb0e8777800",
+				Enabled:     "1",
+				Hostname:    "test",
+				Domain:      "home.yarotsky.me",
+				Host:        "traefik.home.yarotsky.me",
+				HostID:      unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"),
+				Description: "Dashboard",
+			},
+		}
+		require.ElementsMatch(t, want, got)
+	})
+
+	t.Run("sorts host aliases by domain, then hostname", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostAlias/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"total":3,"rowCount":3,"current":1,"rows":[`+
+				`{"uuid":"3","hostname":"www","domain":"b.example.com","host":"a.example.com"},`+
+				`{"uuid":"2","hostname":"www","domain":"a.example.com","host":"a.example.com"},`+
+				`{"uuid":"1","hostname":"api","domain":"a.example.com","host":"a.example.com"}]}`)
+		})
+
+		got, err := client.ListHostAliases(context.Background(), "1")
+		require.NoError(t, err)
+
+		ids := make([]unbound.HostAliasID, 0, len(got))
+		for _, ha := range got {
+			ids = append(ids, ha.ID)
+		}
+		require.Equal(t, []unbound.HostAliasID{"1", "2", "3"}, ids)
+	})
+}
+
+func TestCreateHostAlias(t *testing.T) {
+	t.Run("creates a host alias", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/addHostAlias/", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.HostAliasRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, "1", req.Alias.Enabled)
+			require.Equal(t, "test2", req.Alias.Hostname)
+			require.Equal(t, "home.yarotsky.me", req.Alias.Domain)
+			require.Equal(t, unbound.HostOverrideID("a7a9f5ef-4ac1-4df4-bc8e-f122d02001ec"), req.Alias.HostID)
+			require.Equal(t, "Dashboard", req.Alias.Description)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/addHostAlias.json"))
+		})
+
+		rec, err := client.CreateHostAlias(context.Background(), unbound.HostAlias{
+			Hostname:    "test2",
+			Domain:      "home.yarotsky.me",
+			HostID:      "a7a9f5ef-4ac1-4df4-bc8e-f122d02001ec",
+			Description: "Dashboard",
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostAliasID("d7c20457-cad1-4ca2-afb4-7343354f0f1d"), rec.ID)
+	})
+}
+
+func TestUpdateHostAlias(t *testing.T) {
+	t.Run("updates a host alias", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/setHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d", func(w http.ResponseWriter, r *http.Request) {
+			var req unbound.HostAliasRequest
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, "1", req.Alias.Enabled)
+			require.Equal(t, "test2", req.Alias.Hostname)
+			require.Equal(t, "home.yarotsky.me", req.Alias.Domain)
+			require.Equal(t, unbound.HostOverrideID("a7a9f5ef-4ac1-4df4-bc8e-f122d02001ec"), req.Alias.HostID)
+			require.Equal(t, "Dashboard", req.Alias.Description)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/setHostAlias.json"))
+		})
+
+		err := client.UpdateHostAlias(context.Background(), unbound.HostAlias{
+			ID:          "d7c20457-cad1-4ca2-afb4-7343354f0f1d",
+			Hostname:    "test2",
+			Domain:      "home.yarotsky.me",
+			HostID:      "a7a9f5ef-4ac1-4df4-bc8e-f122d02001ec",
+			Description: "Dashboard",
+		})
+
+		require.NoError(t, err)
+	})
+}
+
+func TestGetHostAlias(t *testing.T) {
+	t.Run("returns a host alias with the selected host override", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/getHostAlias/18b07c57-fce4-43ad-8bd8-5fb0e8777800", func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodGet, r.Method)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/getHostAlias.json"))
+		})
+
+		ha, err := client.GetHostAlias(context.Background(), "18b07c57-fce4-43ad-8bd8-5fb0e8777800")
+
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostAlias{
+			ID:          "18b07c57-fce4-43ad-8bd8-5fb0e8777800",
+			Enabled:     "1",
+			Host:        "traefik.home.yarotsky.me",
+			HostID:      "59641e80-1f40-4d28-a7df-314c09c30800",
+			Hostname:    "test",
+			Domain:      "home.yarotsky.me",
+			Description: "Dashboard",
+		}, ha)
+	})
+
+	t.Run("fails with ErrNotFound for unknown IDs", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/getHostAlias/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `[]`)
+		})
+
+		_, err := client.GetHostAlias(context.Background(), "18b07c57-fce4-43ad-8bd8-5fb0e8777800")
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+	})
+}
+
+func TestToggleHostAlias(t *testing.T) {
+	for _, tc := range []struct {
+		enabled bool
+		state   string
+		fixture string
+	}{
+		{true, "1", "unbound/toggleHostAliasEnabled.json"},
+		{false, "0", "unbound/toggleHostAliasDisabled.json"},
+	} {
+		t.Run(fmt.Sprintf("sets enabled to %v", tc.enabled), func(t *testing.T) {
+			client, teardown := setup(t)
+			t.Cleanup(teardown)
+
+			mux.HandleFunc("/api/unbound/settings/toggleHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d/"+tc.state, func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPost, r.Method)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, fixture(t, tc.fixture))
+			})
+
+			err := client.ToggleHostAlias(context.Background(), "d7c20457-cad1-4ca2-afb4-7343354f0f1d", tc.enabled)
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("fails when OPNsense reports the other state", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/toggleHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d/1", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/toggleHostAliasDisabled.json"))
+		})
+
+		err := client.ToggleHostAlias(context.Background(), "d7c20457-cad1-4ca2-afb4-7343354f0f1d", true)
+		require.EqualError(t, err, "toggleHostAlias failed: Disabled")
+	})
+}
+
+func TestDeleteHostAlias(t *testing.T) {
+	t.Run("deletes a host alias", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d", func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&req)
+
+			require.Equal(t, map[string]interface{}{}, req)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/delHostAlias.json"))
+		})
+
+		err := client.DeleteHostAlias(context.Background(), unbound.HostAlias{
+			ID: "d7c20457-cad1-4ca2-afb4-7343354f0f1d",
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("succeeds for a host alias already deleted", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/delHostAliasNotFound.json"))
+		})
+
+		err := client.DeleteHostAlias(context.Background(), unbound.HostAlias{
+			ID: "d7c20457-cad1-4ca2-afb4-7343354f0f1d",
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("fails when OPNsense fails to delete the host alias", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/delHostAlias/d7c20457-cad1-4ca2-afb4-7343354f0f1d", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"result":"failed"}`)
+		})
+
+		err := client.DeleteHostAlias(context.Background(), unbound.HostAlias{
+			ID: "d7c20457-cad1-4ca2-afb4-7343354f0f1d",
+		})
+
+		require.EqualError(t, err, "delHostAlias failed: failed")
+	})
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Run("reconfigures unbound", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/service/reconfigure", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "unbound/reconfigure.json"))
+		})
+
+		err := client.Reconfigure(context.Background())
+		require.NoError(t, err)
+	})
+
+	t.Run("fails when unbound does not report ok", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/service/reconfigure", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"status":"failed"}`)
+		})
+
+		err := client.Reconfigure(context.Background())
+		require.ErrorContains(t, err, "reconfigure failed: failed")
+	})
+}
+
+func TestVersion(t *testing.T) {
+	t.Run("returns the product version", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/core/firmware/status", func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "GET", r.Method)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, fixture(t, "core/firmwareStatus.json"))
+		})
+
+		version, err := client.Version(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "24.7.1", version)
+	})
+}
+
+func TestResponseSize(t *testing.T) {
+	t.Run("fails cleanly on oversized responses", func(t *testing.T) {
+		_, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"rows":[`)
+			for i := 0; i < 100000; i++ {
+				fmt.Fprintf(w, `{"uuid":"%d","enabled":"1","hostname":"host%d","domain":"example.com","server":"127.0.0.1"},`, i, i)
+			}
+			fmt.Fprint(w, `{}],"total":100001}`)
+		})
+
+		c, err := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", http.DefaultClient,
+			unbound.WithMaxResponseSize(64<<10))
+		require.NoError(t, err)
+
+		_, err = c.ListHostOverrides(context.Background())
+		require.EqualError(t, err, "response exceeds the 65536 byte limit")
+	})
+
+	t.Run("decodes rows reported after the total", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"total":1000000000,"rowCount":1,"current":1,"rows":[`+
+				`{"uuid":"1","enabled":"1","hostname":"a","domain":"example.com","server":"127.0.0.1","extra":{"nested":[1,2]}}]}`)
+		})
+
+		hostOverrides, err := client.ListHostOverrides(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostOverride{
+			{ID: "1", Enabled: "1", Hostname: "a", Domain: "example.com", Server: "127.0.0.1"},
+		}, hostOverrides)
+	})
+
+	t.Run("rejects malformed listings", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"rows":{}}`)
+		})
+
+		_, err := client.ListHostOverrides(context.Background())
+		require.ErrorContains(t, err, "failed to deserialize response")
+	})
+}
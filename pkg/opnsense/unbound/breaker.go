@@ -0,0 +1,137 @@
+package unbound
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// ErrCircuitOpen is returned without calling OPNsense while the circuit breaker is open. It is an ErrUnavailable.
+var ErrCircuitOpen error = &unavailableError{"circuit open: OPNsense is unavailable"}
+
+// Circuit breaker states, as reported by CircuitBreaker.State.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker fails calls fast after threshold consecutive failures, for cooldown.
+// After the cooldown a single probe call is let through: its success closes the circuit,
+// its failure opens it for another cooldown.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// WithCircuitBreaker guards every request with b.
+func WithCircuitBreaker(b *CircuitBreaker) Option {
+	return func(u *Client) {
+		u.breaker = b
+	}
+}
+
+// State returns one of CircuitClosed, CircuitOpen or CircuitHalfOpen.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a call may proceed, reporting the state to m. A call allowed in the half-open state
+// is the probe.
+func (b *CircuitBreaker) allow(now time.Time, m *metrics.Set) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(CircuitHalfOpen, m)
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// done records the outcome of an allowed call, logs the circuit opening or closing with logger and reports
+// the state to m.
+func (b *CircuitBreaker) done(now time.Time, failed bool, logger *slog.Logger, m *metrics.Set) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+	}
+
+	if !failed {
+		b.failures = 0
+		if b.state != CircuitClosed {
+			logger.Info("OPNsense is reachable again, closing circuit")
+			b.setState(CircuitClosed, m)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		if b.state != CircuitOpen {
+			logger.Warn("OPNsense is unavailable, opening circuit",
+				slog.Int("failures", b.failures),
+				slog.Duration("cooldown", b.cooldown),
+			)
+		}
+		b.openedAt = now
+		b.setState(CircuitOpen, m)
+	}
+}
+
+// setState updates the state and its metric in m. b.mu must be held.
+func (b *CircuitBreaker) setState(state string, m *metrics.Set) {
+	b.state = state
+
+	switch state {
+	case CircuitClosed:
+		m.APICircuitState.Set(0)
+	case CircuitHalfOpen:
+		m.APICircuitState.Set(1)
+	case CircuitOpen:
+		m.APICircuitState.Set(2)
+	}
+}
+
+// isOutage reports whether the outcome of a request suggests OPNsense is unavailable,
+// as opposed to rejecting the request or the caller giving up.
+func isOutage(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,87 @@
+package unbound_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("opens after consecutive failures and fails fast", func(t *testing.T) {
+		server, calls := faultyServer(t, 0, http.StatusBadGateway, http.StatusBadGateway)
+		breaker := unbound.NewCircuitBreaker(2, time.Hour)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithCircuitBreaker(breaker))
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitClosed, breaker.State())
+		require.Error(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitOpen, breaker.State())
+
+		err := client.Reconfigure(context.Background())
+		require.ErrorIs(t, err, unbound.ErrCircuitOpen)
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("stops calling an OPNsense dropping connections", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		t.Cleanup(server.Close)
+		server.InjectFault(opnsensetest.AnyEndpoint, opnsensetest.Fault{Drop: true})
+		breaker := unbound.NewCircuitBreaker(2, time.Hour)
+		client := server.UnboundClient(unbound.WithCircuitBreaker(breaker))
+
+		for range 2 {
+			_, err := client.ListHostOverrides(context.Background())
+			require.ErrorIs(t, err, unbound.ErrUnavailable)
+		}
+		server.ClearFaults()
+		_, err := client.ListHostOverrides(context.Background())
+		require.ErrorIs(t, err, unbound.ErrCircuitOpen)
+		require.Equal(t, 2, server.Calls("searchHostOverride"))
+	})
+
+	t.Run("closes after a successful probe", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusServiceUnavailable)
+		breaker := unbound.NewCircuitBreaker(1, 10*time.Millisecond)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithCircuitBreaker(breaker))
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitOpen, breaker.State())
+
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitClosed, breaker.State())
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("reopens after a failed probe", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		breaker := unbound.NewCircuitBreaker(1, 10*time.Millisecond)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithCircuitBreaker(breaker))
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		time.Sleep(20 * time.Millisecond)
+		require.Error(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitOpen, breaker.State())
+
+		require.ErrorIs(t, client.Reconfigure(context.Background()), unbound.ErrCircuitOpen)
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("does not count 4xx as failures", func(t *testing.T) {
+		server, _ := faultyServer(t, http.StatusBadRequest, http.StatusBadRequest)
+		breaker := unbound.NewCircuitBreaker(1, time.Hour)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithCircuitBreaker(breaker))
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		require.Equal(t, unbound.CircuitClosed, breaker.State())
+	})
+}
@@ -0,0 +1,74 @@
+package unbound
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WithSlowCallThreshold logs a warning for calls taking longer than d, retries included. 0 disables.
+func WithSlowCallThreshold(d time.Duration) Option {
+	return func(u *Client) {
+		u.slowCallThreshold = d
+	}
+}
+
+// CallDurations collects the durations of the calls made with a context from WithCallDurations.
+// It is safe for concurrent use.
+type CallDurations struct {
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+type callDurationsKey struct{}
+
+// WithCallDurations returns a context making the calls made with it add their durations to d.
+func WithCallDurations(ctx context.Context, d *CallDurations) context.Context {
+	return context.WithValue(ctx, callDurationsKey{}, d)
+}
+
+func (d *CallDurations) add(duration time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.durations = append(d.durations, duration)
+}
+
+// Len returns the number of calls collected.
+func (d *CallDurations) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.durations)
+}
+
+// Percentile returns the duration p percent of the calls collected took at most, by the nearest rank,
+// or 0 without calls.
+func (d *CallDurations) Percentile(p float64) time.Duration {
+	d.mu.Lock()
+	sorted := slices.Clone(d.durations)
+	d.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	slices.Sort(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// observeCall notes how long a call took, for WithCallDurations and WithSlowCallThreshold.
+func (u *Client) observeCall(ctx context.Context, method, path string, duration time.Duration) {
+	if d, ok := ctx.Value(callDurationsKey{}).(*CallDurations); ok {
+		d.add(duration)
+	}
+	if u.slowCallThreshold > 0 && duration > u.slowCallThreshold {
+		u.logger.Warn("slow OPNsense API call",
+			slog.String("method", method),
+			slog.String("path", path),
+			slog.Duration("duration", duration),
+			slog.Duration("threshold", u.slowCallThreshold),
+		)
+	}
+}
@@ -0,0 +1,97 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestCalls(t *testing.T) {
+	server := func(t *testing.T, delay time.Duration) *httptest.Server {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status":"ok"}`)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("warns about calls slower than the threshold", func(t *testing.T) {
+		logs := &recordingHandler{}
+		c, err := unbound.New(server(t, 20*time.Millisecond).URL, "key", "secret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithSlowCallThreshold(10*time.Millisecond))
+		require.NoError(t, err)
+
+		require.NoError(t, c.Reconfigure(context.Background()))
+
+		level, attrs, ok := logs.find("slow OPNsense API call")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "/api/unbound/service/reconfigure", attrs["path"].String())
+		require.Equal(t, "POST", attrs["method"].String())
+		require.GreaterOrEqual(t, attrs["duration"].Duration(), 20*time.Millisecond)
+	})
+
+	t.Run("stays quiet about calls within the threshold", func(t *testing.T) {
+		logs := &recordingHandler{}
+		c, err := unbound.New(server(t, 0).URL, "key", "secret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithSlowCallThreshold(time.Minute))
+		require.NoError(t, err)
+
+		require.NoError(t, c.Reconfigure(context.Background()))
+
+		_, _, ok := logs.find("slow OPNsense API call")
+		require.False(t, ok)
+	})
+
+	t.Run("collects call durations", func(t *testing.T) {
+		c, err := unbound.New(server(t, 5*time.Millisecond).URL, "key", "secret")
+		require.NoError(t, err)
+
+		calls := &unbound.CallDurations{}
+		ctx := unbound.WithCallDurations(context.Background(), calls)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, c.Reconfigure(ctx))
+		}
+		require.NoError(t, c.Reconfigure(context.Background()))
+
+		require.Equal(t, 3, calls.Len())
+		require.GreaterOrEqual(t, calls.Percentile(50), 5*time.Millisecond)
+	})
+}
+
+func TestCallDurationsPercentile(t *testing.T) {
+	calls := &unbound.CallDurations{}
+	require.Zero(t, calls.Percentile(95))
+
+	// The i-th call takes at least 2i ms
+	delay := time.Duration(0)
+	c, err := unbound.New("https://opnsense.invalid", "key", "secret", unbound.WithHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			delay += 2 * time.Millisecond
+			time.Sleep(delay)
+			return nil, fmt.Errorf("unreachable")
+		}),
+	}))
+	require.NoError(t, err)
+
+	ctx := unbound.WithCallDurations(context.Background(), calls)
+	for i := 0; i < 10; i++ {
+		require.Error(t, c.Reconfigure(ctx))
+	}
+
+	require.Equal(t, 10, calls.Len())
+	require.GreaterOrEqual(t, calls.Percentile(50), 10*time.Millisecond)
+	require.Less(t, calls.Percentile(50), calls.Percentile(95))
+	require.GreaterOrEqual(t, calls.Percentile(95), 20*time.Millisecond)
+	require.Equal(t, calls.Percentile(95), calls.Percentile(100))
+}
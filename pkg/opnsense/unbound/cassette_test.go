@@ -0,0 +1,361 @@
+package unbound_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+var record = flag.Bool("record", false, "Record cassettes against the OPNsense set by OPNSENSE_TEST_BASE_URL, "+
+	"OPNSENSE_TEST_KEY, OPNSENSE_TEST_SECRET and OPNSENSE_TEST_DOMAIN, instead of replaying them")
+
+// Cassettes are recorded with the domain, address and credentials of the OPNsense replaced by these.
+const (
+	cassetteDomain  = "example.com"
+	cassetteBaseURL = "https://opnsense.example"
+	cassetteSecret  = "REDACTED"
+)
+
+// interaction is a request and the response OPNsense answered it with.
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// recordedResponse has its body as JSON, or as text when OPNsense didn't answer with JSON.
+type recordedResponse struct {
+	Status   int             `json:"status"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	BodyText string          `json:"bodyText,omitempty"`
+}
+
+// cassette is a transport replaying the interactions of testdata/cassettes/<name>.json in order,
+// or recording them against a real OPNsense with -record.
+type cassette struct {
+	t            testing.TB
+	path         string
+	next         http.RoundTripper
+	scrub        *strings.Replacer
+	mu           sync.Mutex
+	interactions []interaction
+	played       int
+}
+
+// cassetteClient returns a client of the OPNsense recorded in the cassette name, and the domain to make records in.
+func cassetteClient(t *testing.T, name string) (*unbound.Client, string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "cassettes", name+".json")
+	baseURL, apiKey, apiSecret, domain := cassetteBaseURL, "key", "secret", cassetteDomain
+	var c *cassette
+	if *record {
+		baseURL, apiKey, apiSecret, domain = os.Getenv("OPNSENSE_TEST_BASE_URL"), os.Getenv("OPNSENSE_TEST_KEY"),
+			os.Getenv("OPNSENSE_TEST_SECRET"), os.Getenv("OPNSENSE_TEST_DOMAIN")
+		if baseURL == "" || apiKey == "" || apiSecret == "" || domain == "" {
+			t.Fatal("-record requires OPNSENSE_TEST_BASE_URL, OPNSENSE_TEST_KEY, OPNSENSE_TEST_SECRET and OPNSENSE_TEST_DOMAIN")
+		}
+		// OPNsense certificates are self-signed by default
+		next := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		c = recordCassette(t, path, next, baseURL, apiKey, apiSecret, domain)
+	} else {
+		var err error
+		c, err = replayCassette(t, path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Only cassettes recorded against a real OPNsense are committed
+			t.Skipf("no cassette %s, record it with -record", path)
+		}
+		require.NoError(t, err)
+	}
+
+	client, err := unbound.New(baseURL, apiKey, apiSecret, unbound.WithHTTPClient(&http.Client{Transport: c}))
+	require.NoError(t, err)
+	return client, domain
+}
+
+// recordCassette returns a cassette recording the interactions with the OPNsense at baseURL through next,
+// saved to path once the test is done, with the address, credentials and domain of the OPNsense scrubbed.
+func recordCassette(t testing.TB, path string, next http.RoundTripper, baseURL, apiKey, apiSecret, domain string) *cassette {
+	t.Helper()
+
+	u, err := url.Parse(baseURL)
+	require.NoError(t, err)
+	c := &cassette{
+		t:     t,
+		path:  path,
+		next:  next,
+		scrub: strings.NewReplacer(apiKey, cassetteSecret, apiSecret, cassetteSecret, u.Host, "opnsense.example", domain, cassetteDomain),
+	}
+	t.Cleanup(c.save)
+	return c
+}
+
+// replayCassette returns a cassette replaying the interactions saved to path, failing the test unless they
+// are all replayed once it is done.
+func replayCassette(t testing.TB, path string) (*cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{t: t, path: path}
+	if err := json.Unmarshal(b, &c.interactions); err != nil {
+		return nil, fmt.Errorf("bad cassette %s: %w", path, err)
+	}
+	t.Cleanup(c.finish)
+	return c, nil
+}
+
+func (c *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if c.next != nil {
+		return c.record(req, body)
+	}
+	return c.replay(req, body)
+}
+
+func (c *cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	res, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	i := interaction{
+		Request:  recordedRequest{Method: req.Method, Path: c.scrub.Replace(req.URL.RequestURI())},
+		Response: recordedResponse{Status: res.StatusCode},
+	}
+	if len(body) > 0 {
+		i.Request.Body = json.RawMessage(c.scrub.Replace(string(body)))
+	}
+	if scrubbed := c.scrub.Replace(string(resBody)); json.Valid([]byte(scrubbed)) {
+		i.Response.Body = json.RawMessage(scrubbed)
+	} else {
+		i.Response.BodyText = scrubbed
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, i)
+	c.mu.Unlock()
+
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	return res, nil
+}
+
+func (c *cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.played >= len(c.interactions) {
+		c.t.Errorf("%s %s isn't in cassette %s, record it again with -record", req.Method, req.URL.RequestURI(), c.path)
+		return nil, errors.New("request not recorded")
+	}
+	i := c.interactions[c.played]
+	if req.Method != i.Request.Method || req.URL.RequestURI() != i.Request.Path || !sameJSON(body, i.Request.Body) {
+		c.t.Errorf("request %d of cassette %s is %s %s %s, not %s %s %s, record it again with -record",
+			c.played+1, c.path, i.Request.Method, i.Request.Path, i.Request.Body, req.Method, req.URL.RequestURI(), body)
+		return nil, errors.New("request doesn't match the cassette")
+	}
+	c.played++
+
+	resBody := []byte(i.Response.BodyText)
+	contentType := "text/html; charset=UTF-8"
+	if i.Response.Body != nil {
+		resBody, contentType = i.Response.Body, "application/json; charset=UTF-8"
+	}
+	return &http.Response{
+		StatusCode:    i.Response.Status,
+		Status:        fmt.Sprintf("%d %s", i.Response.Status, http.StatusText(i.Response.Status)),
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          io.NopCloser(bytes.NewReader(resBody)),
+		ContentLength: int64(len(resBody)),
+		Request:       req,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+	}, nil
+}
+
+// finish fails the test if it didn't make every request of the cassette.
+func (c *cassette) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.played < len(c.interactions) {
+		c.t.Errorf("only %d of the %d requests of cassette %s were made", c.played, len(c.interactions), c.path)
+	}
+}
+
+// save writes the interactions recorded, unless the test failed.
+func (c *cassette) save() {
+	if c.t.Failed() {
+		c.t.Logf("not saving cassette %s of a failed test", c.path)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		c.t.Errorf("failed to save cassette %s: %v", c.path, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		c.t.Errorf("failed to save cassette %s: %v", c.path, err)
+		return
+	}
+	if err := os.WriteFile(c.path, append(b, '\n'), 0o644); err != nil {
+		c.t.Errorf("failed to save cassette %s: %v", c.path, err)
+	}
+}
+
+func sameJSON(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+// failures stands in for the test a cassette reports to, keeping what it reports failed.
+type failures struct {
+	testing.TB
+	mu     sync.Mutex
+	errors []string
+}
+
+func (f *failures) Errorf(format string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *failures) Failed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.errors) > 0
+}
+
+func TestCassette(t *testing.T) {
+	ctx := context.Background()
+	const domain = "lan.internal"
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	opnsense := opnsensetest.NewServer()
+	t.Cleanup(opnsense.Close)
+	calls := func() int {
+		return opnsense.Calls("addHostOverride") + opnsense.Calls("getHostOverride") + opnsense.Calls("reconfigure")
+	}
+
+	// exchange creates a host override in domain, reads it back and applies it
+	exchange := func(client *unbound.Client, domain, server string) error {
+		ho, err := client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: domain, Server: server})
+		if err != nil {
+			return err
+		}
+		if _, err := client.GetHostOverride(ctx, ho.ID); err != nil {
+			return err
+		}
+		return client.Reconfigure(ctx)
+	}
+	replay := func(t *testing.T, tb testing.TB) *unbound.Client {
+		c, err := replayCassette(tb, path)
+		require.NoError(t, err)
+		client, err := unbound.New(cassetteBaseURL, "key", "secret", unbound.WithHTTPClient(&http.Client{Transport: c}))
+		require.NoError(t, err)
+		return client
+	}
+
+	t.Run("records with the address, credentials and domain of OPNsense scrubbed", func(t *testing.T) {
+		t.Run("recording", func(t *testing.T) {
+			c := recordCassette(t, path, http.DefaultTransport, opnsense.URL,
+				opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret, domain)
+			client, err := unbound.New(opnsense.URL, opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret,
+				unbound.WithHTTPClient(&http.Client{Transport: c}))
+			require.NoError(t, err)
+			require.NoError(t, exchange(client, domain, "192.0.2.10"))
+		})
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		u, err := url.Parse(opnsense.URL)
+		require.NoError(t, err)
+		for _, leaked := range []string{opnsensetest.DefaultAPIKey, opnsensetest.DefaultAPISecret, u.Host, domain} {
+			require.NotContains(t, string(b), leaked)
+		}
+		var interactions []interaction
+		require.NoError(t, json.Unmarshal(b, &interactions))
+		require.Len(t, interactions, 3)
+		require.Contains(t, string(interactions[0].Request.Body), cassetteDomain, "request bodies are scrubbed, not dropped")
+		require.Contains(t, string(interactions[1].Response.Body), cassetteDomain, "response bodies are scrubbed, not dropped")
+	})
+
+	t.Run("replays the interactions recorded", func(t *testing.T) {
+		made := calls()
+		require.NoError(t, exchange(replay(t, t), cassetteDomain, "192.0.2.10"))
+		require.Equal(t, made, calls(), "OPNsense isn't asked again")
+	})
+
+	t.Run("fails requests not as recorded", func(t *testing.T) {
+		failed := &failures{TB: t}
+		require.Error(t, exchange(replay(t, failed), cassetteDomain, "192.0.2.99"))
+		require.Len(t, failed.errors, 1)
+		require.Contains(t, failed.errors[0], "request 1 of cassette")
+		require.Contains(t, failed.errors[0], "192.0.2.99")
+	})
+
+	t.Run("fails requests past the end of the cassette", func(t *testing.T) {
+		failed := &failures{TB: t}
+		client := replay(t, failed)
+		require.NoError(t, exchange(client, cassetteDomain, "192.0.2.10"))
+		require.Error(t, client.Reconfigure(ctx))
+		require.Len(t, failed.errors, 1)
+		require.Contains(t, failed.errors[0], "isn't in cassette")
+	})
+
+	t.Run("fails unless every request recorded is made", func(t *testing.T) {
+		var failed *failures
+		t.Run("replaying", func(t *testing.T) {
+			failed = &failures{TB: t}
+			_, err := replay(t, failed).CreateHostOverride(ctx, unbound.HostOverride{
+				Hostname: "nas", Domain: cassetteDomain, Server: "192.0.2.10",
+			})
+			require.NoError(t, err)
+		})
+		require.Equal(t, []string{"only 1 of the 3 requests of cassette " + path + " were made"}, failed.errors)
+	})
+}
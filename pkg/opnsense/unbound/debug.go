@@ -0,0 +1,153 @@
+package unbound
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// DebugBodyLimit caps how much of each request and response body is logged.
+const DebugBodyLimit = 4096
+
+const redacted = "REDACTED"
+
+var credentialFieldRe = regexp.MustCompile(
+	`(?i)"([^"]*(?:secret|password|passwd|token|apikey|api_key|credential)[^"]*|key)"(\s*:\s*)"(?:[^"\\]|\\.)*"`,
+)
+
+type debugTransport struct {
+	next http.RoundTripper
+	// logger defaults to slog.Default() at the time of each exchange
+	logger *slog.Logger
+}
+
+// NewDebugTransport wraps next with a RoundTripper that logs every exchange at Debug level.
+// Bodies are logged up to DebugBodyLimit bytes and are left intact for the caller.
+// The Authorization header and credential-looking JSON fields are redacted.
+func NewDebugTransport(next http.RoundTripper) http.RoundTripper {
+	return &debugTransport{next: next}
+}
+
+// WithDebugHTTP logs every exchange with OPNsense at Debug level, like NewDebugTransport,
+// with the client's logger.
+func WithDebugHTTP() Option {
+	return func(u *Client) {
+		u.debugHTTP = true
+	}
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	logger := t.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	ctx := req.Context()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return next.RoundTrip(req)
+	}
+
+	logger = logger.With(slog.String("method", req.Method), slog.String("path", req.URL.Path))
+
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var body io.ReadCloser
+		var err error
+		if reqBody, body, err = peekBody(req.Body); err != nil {
+			return nil, err
+		}
+		// RoundTrippers must not modify the caller's request.
+		req = req.Clone(ctx)
+		req.Body = body
+	}
+
+	start := time.Now()
+	res, err := next.RoundTrip(req)
+	latency := time.Since(start)
+
+	reqAttrs := slog.Group("request",
+		slog.Any("header", redactHeader(req.Header)),
+		slog.String("body", redactBody(reqBody)),
+	)
+
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelDebug, "http exchange failed",
+			slog.Duration("latency", latency),
+			reqAttrs,
+			slog.Any("error", err),
+		)
+		return res, err
+	}
+
+	var resBody []byte
+	resBody, res.Body, err = peekBody(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.LogAttrs(ctx, slog.LevelDebug, "http exchange",
+		slog.Int("status", res.StatusCode),
+		slog.Duration("latency", latency),
+		reqAttrs,
+		slog.Group("response",
+			slog.Any("header", redactHeader(res.Header)),
+			slog.String("body", redactBody(resBody)),
+		),
+	)
+
+	return res, nil
+}
+
+// peekBody reads just over DebugBodyLimit bytes of body and returns them together with
+// a replacement ReadCloser that yields the complete, unconsumed body.
+func peekBody(body io.ReadCloser) ([]byte, io.ReadCloser, error) {
+	buf := make([]byte, DebugBodyLimit+1)
+	n, err := io.ReadFull(body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		body.Close()
+		return nil, nil, err
+	}
+	buf = buf[:n]
+
+	return buf, &peekedBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), body),
+		Closer: body,
+	}, nil
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func redactHeader(h http.Header) http.Header {
+	res := h.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+		if res.Get(name) != "" {
+			res.Set(name, redacted)
+		}
+	}
+	return res
+}
+
+func redactBody(body []byte) string {
+	truncated := len(body) > DebugBodyLimit
+	if truncated {
+		body = body[:DebugBodyLimit]
+	}
+
+	res := string(credentialFieldRe.ReplaceAll(body, []byte(`"$1"$2"`+redacted+`"`)))
+	if truncated {
+		res += "...(truncated)"
+	}
+	return res
+}
+
+var _ http.RoundTripper = &debugTransport{}
@@ -0,0 +1,115 @@
+package unbound_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func debugLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestDebugTransport(t *testing.T) {
+	t.Run("logs the exchange without consuming bodies", func(t *testing.T) {
+		logs := debugLogs(t)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			require.JSONEq(t, `{"host":{"hostname":"ha"}}`, string(body))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"result":"saved"}`))
+		}))
+		t.Cleanup(server.Close)
+
+		client := &http.Client{Transport: unbound.NewDebugTransport(http.DefaultTransport)}
+		req, _ := http.NewRequest("POST", server.URL+"/api/unbound/settings/addHostOverride/", strings.NewReader(`{"host":{"hostname":"ha"}}`))
+		res, err := client.Do(req)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"result":"saved"}`, string(body))
+
+		out := logs.String()
+		require.Contains(t, out, `"msg":"http exchange"`)
+		require.Contains(t, out, `"method":"POST"`)
+		require.Contains(t, out, `"path":"/api/unbound/settings/addHostOverride/"`)
+		require.Contains(t, out, `"status":200`)
+		require.Contains(t, out, `"latency"`)
+		require.Contains(t, out, `{\"host\":{\"hostname\":\"ha\"}}`)
+		require.Contains(t, out, `{\"result\":\"saved\"}`)
+	})
+
+	t.Run("redacts credentials", func(t *testing.T) {
+		logs := debugLogs(t)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			require.True(t, ok)
+			require.Equal(t, "fakeapikey", user)
+			require.Equal(t, "fakeapisecret", pass)
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"api_key":"leaked-key","secret": "leaked-secret","result":"ok"}`))
+		}))
+		t.Cleanup(server.Close)
+
+		client := &http.Client{Transport: unbound.NewDebugTransport(http.DefaultTransport)}
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"key":"leaked-key","password":"leaked-password","hostname":"ha"}`))
+		req.SetBasicAuth("fakeapikey", "fakeapisecret")
+		_, err := client.Do(req)
+		require.NoError(t, err)
+
+		out := logs.String()
+		require.NotContains(t, out, "fakeapikey")
+		require.NotContains(t, out, "fakeapisecret")
+		require.NotContains(t, out, "leaked")
+		require.Contains(t, out, `"Authorization":["REDACTED"]`)
+		require.Contains(t, out, `\"key\":\"REDACTED\"`)
+		require.Contains(t, out, `\"password\":\"REDACTED\"`)
+		require.Contains(t, out, `\"hostname\":\"ha\"`)
+		require.Contains(t, out, `\"api_key\":\"REDACTED\"`)
+		require.Contains(t, out, `\"secret\": \"REDACTED\"`)
+	})
+
+	t.Run("caps logged body size", func(t *testing.T) {
+		logs := debugLogs(t)
+
+		large := `{"rows":"` + strings.Repeat("x", 2*unbound.DebugBodyLimit) + `"}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(large))
+		}))
+		t.Cleanup(server.Close)
+
+		client := &http.Client{Transport: unbound.NewDebugTransport(http.DefaultTransport)}
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, large, string(body))
+
+		out := logs.String()
+		require.Contains(t, out, "...(truncated)")
+		require.Less(t, len(out), 2*unbound.DebugBodyLimit)
+	})
+}
@@ -0,0 +1,19 @@
+// Package unbound is a client for the Unbound DNS part of the OPNsense API: host overrides,
+// their aliases, and applying saved changes with Reconfigure.
+//
+//	client, err := unbound.NewClient("https://192.168.1.1", key, secret, http.DefaultClient,
+//		unbound.WithRetry(3, 200*time.Millisecond, 5*time.Second))
+//	if err != nil {
+//		return err
+//	}
+//	overrides, err := client.ListHostOverrides(ctx)
+//
+// # Compatibility
+//
+// The package follows the module's semantic versioning: within a major version, exported
+// identifiers are not removed or changed incompatibly. Methods may be added to the API
+// interface in minor versions, so implementations outside this package should embed
+// another API rather than implement it from scratch. Error messages are not part of the
+// contract; match errors with errors.Is and errors.As against the exported errors instead.
+// OPNsense 24.7 and later are supported.
+package unbound
@@ -0,0 +1,169 @@
+package unbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Errors returned by Client methods, wrapped with details. Match them with errors.Is.
+var (
+	// ErrNotFound is returned when OPNsense doesn't have the record, or the endpoint, called for.
+	ErrNotFound = errors.New("not found")
+
+	// ErrUnauthorized is returned when OPNsense rejects the API key, or the user lacks the privileges for the call.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrValidation is returned when OPNsense rejects a record. The details are in a *ValidationError.
+	ErrValidation = errors.New("validation failed")
+
+	// ErrUnavailable is returned when OPNsense can't be reached or is overloaded, so that the same call
+	// may succeed later or against another node: network errors, timeouts, 5xx and 429 responses,
+	// and calls refused by an open circuit breaker.
+	ErrUnavailable = errors.New("OPNsense is unavailable")
+
+	// ErrBadResponse is returned for responses OPNsense wouldn't send, such as ones mangled by a proxy
+	// or cut short. The details are in a *ResponseError.
+	ErrBadResponse = errors.New("unexpected response")
+
+	// ErrLocked is returned when OPNsense refuses a change because another session holds the configuration.
+	// The details are in a *LockedError.
+	ErrLocked = errors.New("configuration locked by another session")
+
+	// ErrSettingsChanged is returned by SetHostSettings, without writing anything, when the settings changed
+	// since they were read, as writing them back would undo the changes made meanwhile.
+	ErrSettingsChanged = errors.New("settings changed since they were read")
+
+	// ErrInvalidID is returned, without calling OPNsense, for calls on records without an ID.
+	ErrInvalidID = errors.New("record ID is required")
+)
+
+// ErrCallTimeout is returned when a call exceeds the timeout set with WithPerCallTimeout,
+// as opposed to the caller's context being canceled or expiring. It is an ErrUnavailable.
+var ErrCallTimeout error = &unavailableError{"OPNsense call timed out"}
+
+// unavailableError is a more specific ErrUnavailable.
+type unavailableError struct {
+	msg string
+}
+
+func (e *unavailableError) Error() string {
+	return e.msg
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// StatusError is returned for responses with a status other than 200.
+// It unwraps to ErrUnauthorized, ErrNotFound or ErrUnavailable, depending on the status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request failed: %d", e.StatusCode)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// maxErrorBodySize caps how much of a response body ResponseError.Error includes.
+const maxErrorBodySize = 512
+
+// ResponseError is returned for a response to Op that can't be right, with its body. It unwraps to ErrBadResponse.
+type ResponseError struct {
+	Op     string
+	Reason string
+	Body   []byte
+}
+
+func (e *ResponseError) Error() string {
+	body := e.Body
+	if len(body) > maxErrorBodySize {
+		body = body[:maxErrorBodySize]
+	}
+	return fmt.Sprintf("%s failed: %s: %s: %q", e.Op, ErrBadResponse, e.Reason, body)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return ErrBadResponse
+}
+
+// ValidationError lists the fields OPNsense rejected, by field path such as "host.hostname". It unwraps to ErrValidation.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func newValidationError(validations map[string]interface{}) *ValidationError {
+	e := &ValidationError{Fields: make(map[string]string, len(validations))}
+	for field, msg := range validations {
+		// A field failing several checks has a list of messages
+		if msgs, ok := msg.([]interface{}); ok {
+			parts := make([]string, 0, len(msgs))
+			for _, m := range msgs {
+				parts = append(parts, fmt.Sprint(m))
+			}
+			e.Fields[field] = strings.Join(parts, ", ")
+			continue
+		}
+		e.Fields[field] = fmt.Sprint(msg)
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var b strings.Builder
+	b.WriteString(ErrValidation.Error())
+	for i, field := range fields {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s: %s", field, e.Fields[field])
+	}
+	return b.String()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// resultError returns the error for an op whose response reports result other than success.
+func resultError(op, result string, validations map[string]interface{}) error {
+	switch {
+	case len(validations) > 0:
+		return fmt.Errorf("%s failed: %w", op, newValidationError(validations))
+	case result == "not found":
+		return fmt.Errorf("%s failed: %w", op, ErrNotFound)
+	}
+	return fmt.Errorf("%s failed: %s", op, result)
+}
+
+// IsTransient reports whether err suggests OPNsense is temporarily unavailable, that is whether it is
+// an ErrUnavailable or the caller's deadline expiring.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, context.DeadlineExceeded)
+}
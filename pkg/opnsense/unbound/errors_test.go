@@ -0,0 +1,272 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+var sentinels = []error{
+	unbound.ErrNotFound, unbound.ErrUnauthorized, unbound.ErrValidation, unbound.ErrUnavailable,
+	unbound.ErrBadResponse, unbound.ErrInvalidID,
+}
+
+// requireSentinel checks that err is want and none of the other sentinel errors. A nil want means none of them.
+func requireSentinel(t *testing.T, want, err error) {
+	t.Helper()
+
+	require.Error(t, err)
+	for _, sentinel := range sentinels {
+		if sentinel == want {
+			require.ErrorIs(t, err, sentinel)
+		} else {
+			require.NotErrorIs(t, err, sentinel)
+		}
+	}
+}
+
+// respondingClient returns a client for a server answering every request with status and body.
+func respondingClient(t *testing.T, status int, body string) unbound.API {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+	require.NoError(t, err)
+	return client
+}
+
+var calls = map[string]func(unbound.API) error{
+	"ListHostOverrides": func(c unbound.API) error {
+		_, err := c.ListHostOverrides(context.Background())
+		return err
+	},
+	"CreateHostOverride": func(c unbound.API) error {
+		_, err := c.CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "a", Domain: "example.com"})
+		return err
+	},
+	"UpdateHostOverride": func(c unbound.API) error {
+		return c.UpdateHostOverride(context.Background(), unbound.HostOverride{ID: "1", Hostname: "a", Domain: "example.com"})
+	},
+	"GetHostOverride": func(c unbound.API) error {
+		_, err := c.GetHostOverride(context.Background(), "1")
+		return err
+	},
+	"ToggleHostOverride": func(c unbound.API) error {
+		return c.ToggleHostOverride(context.Background(), "1", false)
+	},
+	"DeleteHostOverride": func(c unbound.API) error {
+		return c.DeleteHostOverride(context.Background(), unbound.HostOverride{ID: "1"})
+	},
+	"ListHostAliases": func(c unbound.API) error {
+		_, err := c.ListHostAliases(context.Background(), "1")
+		return err
+	},
+	"CreateHostAlias": func(c unbound.API) error {
+		_, err := c.CreateHostAlias(context.Background(), unbound.HostAlias{HostID: "1", Hostname: "www", Domain: "example.com"})
+		return err
+	},
+	"UpdateHostAlias": func(c unbound.API) error {
+		return c.UpdateHostAlias(context.Background(), unbound.HostAlias{ID: "2", HostID: "1", Hostname: "www", Domain: "example.com"})
+	},
+	"GetHostAlias": func(c unbound.API) error {
+		_, err := c.GetHostAlias(context.Background(), "2")
+		return err
+	},
+	"ToggleHostAlias": func(c unbound.API) error {
+		return c.ToggleHostAlias(context.Background(), "2", false)
+	},
+	"DeleteHostAlias": func(c unbound.API) error {
+		return c.DeleteHostAlias(context.Background(), unbound.HostAlias{ID: "2"})
+	},
+	"Reconfigure": func(c unbound.API) error {
+		return c.Reconfigure(context.Background())
+	},
+	"Version": func(c unbound.API) error {
+		_, err := c.Version(context.Background())
+		return err
+	},
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("by status code", func(t *testing.T) {
+		for _, tc := range []struct {
+			status int
+			want   error
+		}{
+			{http.StatusBadRequest, nil},
+			{http.StatusUnauthorized, unbound.ErrUnauthorized},
+			{http.StatusForbidden, unbound.ErrUnauthorized},
+			{http.StatusNotFound, unbound.ErrNotFound},
+			{http.StatusTooManyRequests, unbound.ErrUnavailable},
+			{http.StatusInternalServerError, unbound.ErrUnavailable},
+			{http.StatusBadGateway, unbound.ErrUnavailable},
+			{http.StatusServiceUnavailable, unbound.ErrUnavailable},
+		} {
+			for name, call := range calls {
+				t.Run(fmt.Sprintf("%s %d", name, tc.status), func(t *testing.T) {
+					err := call(respondingClient(t, tc.status, `<html>oops</html>`))
+					requireSentinel(t, tc.want, err)
+
+					var statusErr *unbound.StatusError
+					require.ErrorAs(t, err, &statusErr)
+					require.Equal(t, tc.status, statusErr.StatusCode)
+				})
+			}
+		}
+	})
+
+	t.Run("by result", func(t *testing.T) {
+		const invalid = `{"result":"failed","validations":{"host.hostname":"A valid hostname is required.","host.server":["Invalid address.","Required."]}}`
+
+		for _, tc := range []struct {
+			call string
+			body string
+			want error
+		}{
+			{"CreateHostOverride", invalid, unbound.ErrValidation},
+			{"CreateHostOverride", `{"result":"failed"}`, nil},
+			{"UpdateHostOverride", invalid, unbound.ErrValidation},
+			{"UpdateHostOverride", `{"result":"failed"}`, unbound.ErrNotFound},
+			{"GetHostOverride", `[]`, unbound.ErrNotFound},
+			{"ToggleHostOverride", `{"result":"failed"}`, unbound.ErrNotFound},
+			{"DeleteHostOverride", `{"result":"failed"}`, nil},
+			{"CreateHostAlias", invalid, unbound.ErrValidation},
+			{"CreateHostAlias", `{"result":"failed"}`, nil},
+			{"UpdateHostAlias", invalid, unbound.ErrValidation},
+			{"UpdateHostAlias", `{"result":"failed"}`, unbound.ErrNotFound},
+			{"GetHostAlias", `[]`, unbound.ErrNotFound},
+			{"ToggleHostAlias", `{"result":"failed"}`, unbound.ErrNotFound},
+			{"DeleteHostAlias", `{"result":"failed"}`, nil},
+			{"Reconfigure", `{"status":"failed"}`, nil},
+		} {
+			t.Run(fmt.Sprintf("%s %s", tc.call, tc.body), func(t *testing.T) {
+				err := calls[tc.call](respondingClient(t, http.StatusOK, tc.body))
+				requireSentinel(t, tc.want, err)
+			})
+		}
+	})
+
+	t.Run("by malformed response", func(t *testing.T) {
+		for _, tc := range []struct {
+			call string
+			body string
+		}{
+			{"CreateHostOverride", `{"result":"saved"}`},
+			{"CreateHostOverride", `{"result":"saved","uuid":"not-a-uuid"}`},
+			{"CreateHostOverride", `{"result":"sav`},
+			{"CreateHostOverride", `{"result":""}`},
+			{"UpdateHostOverride", `{"result":"OK"}`},
+			{"ToggleHostOverride", `{}`},
+			{"DeleteHostOverride", `{"result":"<html>"}`},
+			{"CreateHostAlias", `{"result":"saved","uuid":""}`},
+			{"UpdateHostAlias", `{"status":"ok"}`},
+			{"ToggleHostAlias", `{"result":"enabled"}`},
+			{"DeleteHostAlias", `"deleted"`},
+		} {
+			t.Run(fmt.Sprintf("%s %s", tc.call, tc.body), func(t *testing.T) {
+				err := calls[tc.call](respondingClient(t, http.StatusOK, tc.body))
+				requireSentinel(t, unbound.ErrBadResponse, err)
+
+				var responseErr *unbound.ResponseError
+				require.ErrorAs(t, err, &responseErr)
+				require.Equal(t, tc.body, string(responseErr.Body))
+			})
+		}
+	})
+
+	t.Run("records without an ID", func(t *testing.T) {
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { requests++ }))
+		t.Cleanup(server.Close)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+
+		for name, call := range map[string]func() error{
+			"UpdateHostOverride": func() error { return client.UpdateHostOverride(context.Background(), unbound.HostOverride{}) },
+			"GetHostOverride": func() error {
+				_, err := client.GetHostOverride(context.Background(), "")
+				return err
+			},
+			"ToggleHostOverride": func() error { return client.ToggleHostOverride(context.Background(), "", true) },
+			"DeleteHostOverride": func() error { return client.DeleteHostOverride(context.Background(), unbound.HostOverride{}) },
+			"UpdateHostAlias":    func() error { return client.UpdateHostAlias(context.Background(), unbound.HostAlias{HostID: "1"}) },
+			"GetHostAlias": func() error {
+				_, err := client.GetHostAlias(context.Background(), "")
+				return err
+			},
+			"ToggleHostAlias": func() error { return client.ToggleHostAlias(context.Background(), "", true) },
+			"DeleteHostAlias": func() error { return client.DeleteHostAlias(context.Background(), unbound.HostAlias{}) },
+		} {
+			t.Run(name, func(t *testing.T) {
+				requireSentinel(t, unbound.ErrInvalidID, call())
+			})
+		}
+		require.Zero(t, requests)
+	})
+
+	t.Run("validation errors carry the rejected fields", func(t *testing.T) {
+		client := respondingClient(t, http.StatusOK,
+			`{"result":"failed","validations":{"host.hostname":"A valid hostname is required.","host.server":["Invalid address.","Required."]}}`)
+
+		_, err := client.CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "-", Domain: "example.com"})
+
+		var validationErr *unbound.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, map[string]string{
+			"host.hostname": "A valid hostname is required.",
+			"host.server":   "Invalid address., Required.",
+		}, validationErr.Fields)
+		require.EqualError(t, err, "addHostOverride failed: validation failed: "+
+			"host.hostname: A valid hostname is required.; host.server: Invalid address., Required.")
+	})
+
+	t.Run("network errors", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+
+		for name, call := range calls {
+			t.Run(name, func(t *testing.T) {
+				requireSentinel(t, unbound.ErrUnavailable, call(client))
+			})
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		require.ErrorIs(t, unbound.ErrCallTimeout, unbound.ErrUnavailable)
+	})
+
+	t.Run("open circuit", func(t *testing.T) {
+		server, _ := faultyServer(t, http.StatusBadGateway)
+		breaker := unbound.NewCircuitBreaker(1, time.Hour)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithCircuitBreaker(breaker))
+
+		_ = client.Reconfigure(context.Background())
+		err := client.Reconfigure(context.Background())
+		require.ErrorIs(t, err, unbound.ErrCircuitOpen)
+		requireSentinel(t, unbound.ErrUnavailable, err)
+	})
+
+	t.Run("caller cancellation is none of them", func(t *testing.T) {
+		server, _ := faultyServer(t)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := client.Reconfigure(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		requireSentinel(t, nil, err)
+	})
+}
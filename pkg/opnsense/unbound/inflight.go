@@ -0,0 +1,49 @@
+package unbound
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// WithMaxInflight caps the number of requests to OPNsense in flight at once to n, however many
+// goroutines use the client. A request holds its slot until its response body is closed,
+// but not while waiting to be retried. 0 means no limit.
+func WithMaxInflight(n int) Option {
+	return func(u *Client) {
+		if n > 0 {
+			u.inflight = make(inflightLimiter, n)
+		} else {
+			u.inflight = nil
+		}
+	}
+}
+
+// inflightLimiter is a semaphore of requests in flight. A nil inflightLimiter doesn't limit anything.
+type inflightLimiter chan struct{}
+
+// acquire waits for a slot until ctx is done, and returns the function releasing it.
+func (l inflightLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-l }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// releasingBody releases the request's slot when the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
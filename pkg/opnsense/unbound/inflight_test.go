@@ -0,0 +1,75 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestMaxInflight(t *testing.T) {
+	t.Run("caps concurrent requests", func(t *testing.T) {
+		var inFlight, maxInFlight, calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			fmt.Fprint(w, `{"status":"ok"}`)
+		}))
+		t.Cleanup(server.Close)
+
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(), unbound.WithMaxInflight(3))
+
+		var wg sync.WaitGroup
+		for range 12 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, client.Reconfigure(context.Background()))
+			}()
+		}
+		wg.Wait()
+
+		require.EqualValues(t, 12, calls.Load())
+		require.EqualValues(t, 3, maxInFlight.Load())
+	})
+
+	t.Run("stops waiting for a slot when the context is done", func(t *testing.T) {
+		release := make(chan struct{})
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+			fmt.Fprint(w, `{"status":"ok"}`)
+		}))
+		t.Cleanup(server.Close)
+		t.Cleanup(func() { close(release) })
+
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(), unbound.WithMaxInflight(1))
+
+		go client.Reconfigure(context.Background())
+		require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := client.Reconfigure(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.EqualValues(t, 1, calls.Load())
+	})
+}
@@ -0,0 +1,172 @@
+//go:build integration
+
+package unbound_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// liveOPNsense is an OPNsense to run destructive tests against, set by environment variables:
+// OPNSENSE_TEST_BASE_URL, OPNSENSE_TEST_KEY, OPNSENSE_TEST_SECRET, and OPNSENSE_TEST_DOMAIN, the domain
+// of the records the tests make. OPNSENSE_TEST_DNS_ADDRESS is where Unbound answers, the base URL host
+// on port 53 by default.
+type liveOPNsense struct {
+	baseURL, apiKey, apiSecret, domain string
+	resolver                           *net.Resolver
+}
+
+func newLiveOPNsense(t *testing.T) *liveOPNsense {
+	t.Helper()
+
+	o := &liveOPNsense{
+		baseURL:   os.Getenv("OPNSENSE_TEST_BASE_URL"),
+		apiKey:    os.Getenv("OPNSENSE_TEST_KEY"),
+		apiSecret: os.Getenv("OPNSENSE_TEST_SECRET"),
+		domain:    os.Getenv("OPNSENSE_TEST_DOMAIN"),
+	}
+	if o.baseURL == "" || o.apiKey == "" || o.apiSecret == "" || o.domain == "" {
+		t.Skip("set OPNSENSE_TEST_BASE_URL, OPNSENSE_TEST_KEY, OPNSENSE_TEST_SECRET and OPNSENSE_TEST_DOMAIN to test against an OPNsense")
+	}
+
+	address := os.Getenv("OPNSENSE_TEST_DNS_ADDRESS")
+	if address == "" {
+		u, err := url.Parse(o.baseURL)
+		require.NoError(t, err)
+		address = net.JoinHostPort(u.Hostname(), "53")
+	}
+	o.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	return o
+}
+
+// client returns a client of the OPNsense, which doesn't verify its certificate, self-signed by default.
+func (o *liveOPNsense) client(t *testing.T) *unbound.Client {
+	t.Helper()
+
+	client, err := unbound.New(o.baseURL, o.apiKey, o.apiSecret, unbound.WithHTTPClient(&http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}))
+	require.NoError(t, err)
+	return client
+}
+
+// hostname returns a hostname no other test run uses, deleting the records with it when the test is done.
+func (o *liveOPNsense) hostname(t *testing.T, name string) string {
+	t.Helper()
+
+	var b [4]byte
+	rand.Read(b[:])
+	hostname := "test-" + name + "-" + hex.EncodeToString(b[:])
+
+	client := o.client(t)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		hos, err := client.ListHostOverrides(ctx)
+		if err != nil {
+			t.Errorf("failed to clean up %s: %v", hostname, err)
+			return
+		}
+		for _, ho := range hos {
+			has, err := client.ListHostAliases(ctx, ho.ID)
+			if err != nil {
+				t.Errorf("failed to clean up %s: %v", hostname, err)
+				return
+			}
+			for _, ha := range has {
+				if ha.Hostname == hostname && ha.Domain == o.domain {
+					if err := client.DeleteHostAlias(ctx, ha); err != nil {
+						t.Errorf("failed to clean up %s: %v", ha.DNSName(), err)
+					}
+				}
+			}
+			if ho.Hostname == hostname && ho.Domain == o.domain {
+				if err := client.DeleteHostOverride(ctx, ho); err != nil {
+					t.Errorf("failed to clean up %s: %v", ho.DNSName(), err)
+				}
+			}
+		}
+		if err := client.Reconfigure(ctx); err != nil {
+			t.Errorf("failed to reconfigure unbound after cleaning up: %v", err)
+		}
+	})
+	return hostname
+}
+
+// requireResolves waits for name to resolve to addrs through Unbound, and to nothing for no addrs.
+func (o *liveOPNsense) requireResolves(t *testing.T, name string, addrs ...string) {
+	t.Helper()
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		got, err := o.resolver.LookupHost(context.Background(), name)
+		if len(addrs) == 0 {
+			var dnsErr *net.DNSError
+			assert.True(c, errors.As(err, &dnsErr) && dnsErr.IsNotFound, "%s resolves to %v (%v), expected nothing", name, got, err)
+			return
+		}
+		slices.Sort(got)
+		assert.NoError(c, err)
+		assert.Equal(c, addrs, got, "%s resolves", name)
+	}, 30*time.Second, 500*time.Millisecond)
+}
+
+func TestLiveClient(t *testing.T) {
+	o := newLiveOPNsense(t)
+	client := o.client(t)
+	ctx := context.Background()
+	host := o.hostname(t, "a")
+	alias := o.hostname(t, "cname")
+	hostName, aliasName := host+"."+o.domain, alias+"."+o.domain
+
+	ho, err := client.CreateHostOverride(ctx, unbound.HostOverride{Hostname: host, Domain: o.domain, Server: "192.0.2.10"})
+	require.NoError(t, err)
+	ha, err := client.CreateHostAlias(ctx, unbound.HostAlias{HostID: ho.ID, Hostname: alias, Domain: o.domain})
+	require.NoError(t, err)
+	require.NoError(t, client.Reconfigure(ctx))
+	o.requireResolves(t, hostName, "192.0.2.10")
+	o.requireResolves(t, aliasName, "192.0.2.10")
+	cname, err := o.resolver.LookupCNAME(ctx, aliasName)
+	require.NoError(t, err)
+	require.Equal(t, hostName+".", strings.ToLower(cname))
+
+	ho.Server = "192.0.2.11"
+	require.NoError(t, client.UpdateHostOverride(ctx, ho))
+	require.NoError(t, client.Reconfigure(ctx))
+	o.requireResolves(t, hostName, "192.0.2.11")
+	o.requireResolves(t, aliasName, "192.0.2.11")
+
+	hos, err := client.ListHostOverrides(ctx)
+	require.NoError(t, err)
+	require.True(t, slices.ContainsFunc(hos, func(e unbound.HostOverride) bool { return e.ID == ho.ID && e.Server == "192.0.2.11" }))
+	has, err := client.ListHostAliases(ctx, ho.ID)
+	require.NoError(t, err)
+	require.True(t, slices.ContainsFunc(has, func(e unbound.HostAlias) bool { return e.ID == ha.ID }))
+
+	require.NoError(t, client.DeleteHostAlias(ctx, ha))
+	require.NoError(t, client.DeleteHostOverride(ctx, ho))
+	require.NoError(t, client.Reconfigure(ctx))
+	o.requireResolves(t, aliasName)
+	o.requireResolves(t, hostName)
+}
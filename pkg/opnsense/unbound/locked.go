@@ -0,0 +1,84 @@
+package unbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WithLockMessages sets the messages, or parts of them, OPNsense fails changes with while another session,
+// such as the web UI in the middle of an edit, holds the configuration. Changes failing with one of them are
+// returned as a *LockedError, and retried as set by WithRetry. Matching ignores case.
+// No lock messages are known by default, as none has been captured from a real OPNsense yet.
+func WithLockMessages(messages ...string) Option {
+	return func(u *Client) {
+		for _, msg := range messages {
+			if msg = strings.TrimSpace(msg); msg != "" {
+				u.lockMessages = append(u.lockMessages, strings.ToLower(msg))
+			}
+		}
+	}
+}
+
+// LockedError is returned for changes OPNsense refused because another session holds the configuration,
+// with the message it gave. It unwraps to ErrLocked, and is retried as set by WithRetry.
+type LockedError struct {
+	Op      string
+	Message string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s failed: %s: %s", e.Op, ErrLocked, e.Message)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// lockedResponse returns a *LockedError if raw, the response to op, is a failure because the configuration
+// is locked: a failed result with a lock message, among its validations or as its message.
+func (u *Client) lockedResponse(op string, raw []byte) error {
+	if len(u.lockMessages) == 0 {
+		return nil
+	}
+
+	var res struct {
+		Result      string                 `json:"result"`
+		Message     string                 `json:"message"`
+		Validations map[string]interface{} `json:"validations"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil || res.Result != "failed" {
+		return nil
+	}
+
+	messages := []string{res.Message}
+	if len(res.Validations) > 0 {
+		v := newValidationError(res.Validations)
+		fields := make([]string, 0, len(v.Fields))
+		for field := range v.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			messages = append(messages, v.Fields[field])
+		}
+	}
+
+	for _, msg := range messages {
+		if u.isLockMessage(msg) {
+			return &LockedError{Op: op, Message: msg}
+		}
+	}
+	return nil
+}
+
+func (u *Client) isLockMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, lock := range u.lockMessages {
+		if strings.Contains(msg, lock) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// No lock response has been captured from a real OPNsense, so these use a made-up message,
+// set with WithLockMessages as it would be with the one OPNsense gives.
+const (
+	lockMessage         = "Held by the test session"
+	lockedValidation    = `{"result":"failed","validations":{"host.hostname":"Held by the test session, try again later."}}`
+	lockedResultMessage = `{"result":"failed","message":"Held by the test session."}`
+)
+
+// lockedServer answers the first locked requests to path with lockedBody, and the rest with the fixture at okFixture.
+func lockedServer(t *testing.T, path, lockedBody, okFixture string, locked int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, path, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if int(calls.Add(1)) <= locked {
+			fmt.Fprint(w, lockedBody)
+			return
+		}
+		fmt.Fprint(w, fixture(t, okFixture))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+// lockingClient returns a client retrying attempts times, that knows lockMessage.
+func lockingClient(t *testing.T, server *httptest.Server, attempts int, opts ...unbound.Option) unbound.API {
+	t.Helper()
+
+	opts = append([]unbound.Option{
+		unbound.WithRetry(attempts, time.Millisecond, 5*time.Millisecond),
+		unbound.WithLockMessages(lockMessage),
+	}, opts...)
+	client, err := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(), opts...)
+	require.NoError(t, err)
+	return client
+}
+
+func TestLocked(t *testing.T) {
+	override := unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "192.168.1.10"}
+
+	t.Run("retries changes refused while the configuration is locked", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/addHostOverride/",
+			lockedValidation, "unbound/addHostOverride.json", 2)
+
+		created, err := lockingClient(t, server, 3).CreateHostOverride(context.Background(), override)
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"), created.ID)
+		require.EqualValues(t, 3, calls.Load())
+	})
+
+	t.Run("recognizes lock messages outside validations", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/delHostAlias/18b07c57-fce4-43ad-8bd8-5fb0e8777800",
+			lockedResultMessage, "unbound/delHostAlias.json", 1)
+
+		err := lockingClient(t, server, 2).DeleteHostAlias(context.Background(), unbound.HostAlias{ID: "18b07c57-fce4-43ad-8bd8-5fb0e8777800"})
+		require.NoError(t, err)
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("gives up after the last attempt", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/addHostOverride/",
+			lockedValidation, "unbound/addHostOverride.json", 5)
+
+		_, err := lockingClient(t, server, 2).CreateHostOverride(context.Background(), override)
+		require.ErrorIs(t, err, unbound.ErrLocked)
+		var locked *unbound.LockedError
+		require.ErrorAs(t, err, &locked)
+		require.Equal(t, "addHostOverride", locked.Op)
+		require.Equal(t, "Held by the test session, try again later.", locked.Message)
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("doesn't retry other validation failures", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/addHostOverride/",
+			fixture(t, "unbound/addHostOverrideInvalid.json"), "unbound/addHostOverride.json", 1)
+
+		_, err := lockingClient(t, server, 3).CreateHostOverride(context.Background(), override)
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.NotErrorIs(t, err, unbound.ErrLocked)
+		require.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("knows no lock messages by default", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/addHostOverride/",
+			lockedValidation, "unbound/addHostOverride.json", 1)
+
+		_, err := retryingClient(t, server, 3).CreateHostOverride(context.Background(), override)
+		require.ErrorIs(t, err, unbound.ErrValidation)
+		require.NotErrorIs(t, err, unbound.ErrLocked)
+		require.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("stops retrying when the context is done", func(t *testing.T) {
+		server, calls := lockedServer(t, "/api/unbound/settings/addHostOverride/",
+			lockedValidation, "unbound/addHostOverride.json", 5)
+		client := lockingClient(t, server, 5, unbound.WithRetry(5, time.Hour, time.Hour))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := client.CreateHostOverride(ctx, override)
+		require.ErrorIs(t, err, unbound.ErrLocked)
+		require.EqualValues(t, 1, calls.Load())
+	})
+}
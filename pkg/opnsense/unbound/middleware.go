@@ -0,0 +1,62 @@
+package unbound
+
+import "net/http"
+
+// WithTransportMiddleware wraps the transport of every request with mw, to observe or alter the exchanges
+// with OPNsense. It may be given several times: the first middleware given sees requests first.
+// Requests reaching middleware are authenticated already, and are sent once per retry attempt.
+func WithTransportMiddleware(mw func(http.RoundTripper) http.RoundTripper) Option {
+	return func(u *Client) {
+		if mw != nil {
+			u.middleware = append(u.middleware, mw)
+		}
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// authenticate sets the credentials and the User-Agent of requests.
+func authenticate(credentials func() (apiKey, apiSecret string), userAgent string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// RoundTrippers must not modify the request they are given
+			req = req.Clone(req.Context())
+			req.SetBasicAuth(credentials())
+			if userAgent != "" {
+				req.Header.Set("User-Agent", userAgent)
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// transport chains the client's middleware around next: authentication first, then the middleware
+// given with WithTransportMiddleware in order, then debug logging, so that it logs what is sent.
+func (u *Client) transport(next http.RoundTripper, apiKey, apiSecret string) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	credentials := u.credentials
+	if credentials == nil {
+		credentials = func() (string, string) { return apiKey, apiSecret }
+	}
+
+	chain := []func(http.RoundTripper) http.RoundTripper{authenticate(credentials, u.userAgent)}
+	chain = append(chain, u.middleware...)
+	if u.debugHTTP {
+		chain = append(chain, func(next http.RoundTripper) http.RoundTripper {
+			return &debugTransport{next: next, logger: u.logger}
+		})
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = chain[i](next)
+	}
+	return next
+}
@@ -0,0 +1,280 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// recordingHandler is a slog.Handler that keeps every record it handles, with the attributes of its loggers.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+
+	parent *recordingHandler
+	attrs  []slog.Attr
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	r = r.Clone()
+	root := h
+	for ; root.parent != nil; root = root.parent {
+		r.AddAttrs(root.attrs...)
+	}
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.records = append(root.records, r)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordingHandler{parent: h, attrs: attrs}
+}
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// find returns the level and attributes of the first record with the given message.
+func (h *recordingHandler) find(msg string) (slog.Level, map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		return r.Level, attrs, true
+	}
+	return 0, nil, false
+}
+
+func TestOptions(t *testing.T) {
+	reconfigureServer := func(t *testing.T, handle func(r *http.Request)) *httptest.Server {
+		t.Helper()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handle(r)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status":"ok"}`)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("uses the HTTP client given", func(t *testing.T) {
+		server := reconfigureServer(t, func(*http.Request) {})
+
+		var requests int
+		httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret", unbound.WithHTTPClient(httpClient))
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("sets the user agent", func(t *testing.T) {
+		var userAgent string
+		server := reconfigureServer(t, func(r *http.Request) { userAgent = r.UserAgent() })
+
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret", unbound.WithUserAgent("my-cli/1.0"))
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, "my-cli/1.0", userAgent)
+	})
+
+	t.Run("authenticates with the credentials of the time", func(t *testing.T) {
+		var users []string
+		server := reconfigureServer(t, func(r *http.Request) {
+			user, _, _ := r.BasicAuth()
+			users = append(users, user)
+		})
+
+		key := "oldkey"
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithCredentials(func() (string, string) { return key, "secret" }))
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		key = "newkey"
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, []string{"oldkey", "newkey"}, users)
+	})
+
+	t.Run("logs with the logger given", func(t *testing.T) {
+		server, _ := faultyServer(t, http.StatusBadRequest)
+
+		logs := &recordingHandler{}
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret", unbound.WithLogger(slog.New(logs)))
+		require.NoError(t, err)
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		level, attrs, ok := logs.find("request failed")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelError, level)
+		require.Equal(t, "api", attrs["component"].String())
+		require.Equal(t, "/api/unbound/service/reconfigure", attrs["path"].String())
+		require.Equal(t, int64(400), attrs["status"].Int64())
+	})
+
+	t.Run("logs exchanges with the logger given when debugging HTTP", func(t *testing.T) {
+		server := reconfigureServer(t, func(*http.Request) {})
+
+		logs := &recordingHandler{}
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithDebugHTTP())
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		level, attrs, ok := logs.find("http exchange")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelDebug, level)
+		require.Equal(t, "api", attrs["component"].String())
+		require.Equal(t, "/api/unbound/service/reconfigure", attrs["path"].String())
+	})
+
+	t.Run("logs the circuit opening with the logger given", func(t *testing.T) {
+		server, _ := faultyServer(t, http.StatusServiceUnavailable)
+
+		logs := &recordingHandler{}
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithCircuitBreaker(unbound.NewCircuitBreaker(1, time.Minute)))
+		require.NoError(t, err)
+
+		require.Error(t, client.Reconfigure(context.Background()))
+		level, attrs, ok := logs.find("OPNsense is unavailable, opening circuit")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, "api", attrs["component"].String())
+		require.Equal(t, int64(1), attrs["failures"].Int64())
+	})
+
+	t.Run("retries as set by the retry policy", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusBadGateway, http.StatusBadGateway)
+
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithRetryPolicy(unbound.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}))
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.EqualValues(t, 3, calls.Load())
+	})
+
+	t.Run("NewClient is New with the HTTP client given", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status":"ok"}`)
+		}))
+		t.Cleanup(server.Close)
+
+		client, err := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+		require.NoError(t, err)
+		require.NoError(t, client.Reconfigure(context.Background()))
+	})
+}
+
+func TestTransportMiddleware(t *testing.T) {
+	// tracing records the order in which requests and responses pass through it
+	tracing := func(name string, trace *[]string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				*trace = append(*trace, name+" request")
+				res, err := next.RoundTrip(req)
+				*trace = append(*trace, name+" response")
+				return res, err
+			})
+		}
+	}
+
+	t.Run("applies middleware in the order given", func(t *testing.T) {
+		server, _ := faultyServer(t)
+
+		var trace []string
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithTransportMiddleware(tracing("first", &trace)),
+			unbound.WithTransportMiddleware(tracing("second", &trace)),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, []string{"first request", "second request", "second response", "first response"}, trace)
+	})
+
+	t.Run("wraps the transport of the HTTP client given", func(t *testing.T) {
+		server, _ := faultyServer(t)
+
+		var trace []string
+		base := server.Client()
+		base.Transport = tracing("base", &trace)(base.Transport)
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithTransportMiddleware(tracing("middleware", &trace)),
+			unbound.WithHTTPClient(base),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, []string{"middleware request", "base request", "base response", "middleware response"}, trace)
+	})
+
+	t.Run("sees requests authenticated", func(t *testing.T) {
+		server, _ := faultyServer(t)
+
+		var user, password, userAgent string
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithUserAgent("my-cli/1.0"),
+			unbound.WithTransportMiddleware(func(next http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					user, password, _ = req.BasicAuth()
+					userAgent = req.UserAgent()
+					return next.RoundTrip(req)
+				})
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.Equal(t, "fakeapikey", user)
+		require.Equal(t, "fakeapisecret", password)
+		require.Equal(t, "my-cli/1.0", userAgent)
+	})
+
+	t.Run("sees every retry attempt", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusBadGateway)
+
+		var trace []string
+		client, err := unbound.New(server.URL, "fakeapikey", "fakeapisecret",
+			unbound.WithTransportMiddleware(tracing("middleware", &trace)),
+			unbound.WithRetry(2, time.Millisecond, time.Millisecond),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Reconfigure(context.Background()))
+		require.EqualValues(t, 2, calls.Load())
+		require.Len(t, trace, 4)
+	})
+}
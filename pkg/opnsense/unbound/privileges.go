@@ -0,0 +1,107 @@
+package unbound
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Privileges the client relies on, as named by PrivilegeCheck.
+const (
+	PrivilegeReadRecords   = "read records"
+	PrivilegeReadSettings  = "read settings"
+	PrivilegeChangeRecords = "change records"
+)
+
+// PrivilegeCheck tells whether the API key is allowed to call an endpoint.
+type PrivilegeCheck struct {
+	// Privilege is what calling the endpoint allows, one of the Privilege constants
+	Privilege string `json:"privilege"`
+	// Endpoint is the endpoint probed
+	Endpoint string `json:"endpoint"`
+	Granted  bool   `json:"granted"`
+}
+
+func (c PrivilegeCheck) String() string {
+	return fmt.Sprintf("%s (%s)", c.Privilege, c.Endpoint)
+}
+
+// PrivilegeChecker is implemented by APIs that can check the privileges of their API key, as Client does.
+type PrivilegeChecker interface {
+	CheckPrivileges(context.Context) ([]PrivilegeCheck, error)
+}
+
+var _ PrivilegeChecker = &Client{}
+
+// CheckPrivileges probes the endpoints the client calls, without changing anything, to tell which ones
+// the API key may call: it searches for a single host override, gets the settings, and adds a host override
+// invalid enough that OPNsense rejects it before saving. Failures other than being denied, such as OPNsense
+// being unavailable, are returned instead.
+// Reconfiguring Unbound can't be probed harmlessly, so it isn't.
+func (u *Client) CheckPrivileges(ctx context.Context) ([]PrivilegeCheck, error) {
+	probes := []struct {
+		privilege, endpoint string
+		probe               func(context.Context) error
+	}{
+		{PrivilegeReadRecords, "/api/unbound/settings/searchHostOverride/", u.probeSearch},
+		{PrivilegeReadSettings, "/api/unbound/settings/get", u.probeSettings},
+		{PrivilegeChangeRecords, "/api/unbound/settings/addHostOverride/", u.probeAdd},
+	}
+
+	checks := make([]PrivilegeCheck, 0, len(probes))
+	for _, p := range probes {
+		err := p.probe(ctx)
+		if err != nil && !denied(err) {
+			return nil, fmt.Errorf("failed to check privilege to %s: %w", p.privilege, err)
+		}
+		checks = append(checks, PrivilegeCheck{Privilege: p.privilege, Endpoint: p.endpoint, Granted: err == nil})
+	}
+	return checks, nil
+}
+
+// denied tells whether err means the API key isn't allowed to call the endpoint. OPNsense answers
+// with 401 or 403, or, behind some proxies, with its HTML login page.
+func denied(err error) bool {
+	var respErr *ResponseError
+	return errors.Is(err, ErrUnauthorized) ||
+		errors.As(err, &respErr) && bytes.HasPrefix(bytes.TrimSpace(respErr.Body), []byte("<"))
+}
+
+func (u *Client) probeSearch(ctx context.Context) error {
+	req := &SearchHostOverrideRequest{Current: 1, RowCount: 1, Sort: searchSort()}
+	_, err := u.postResult(ctx, "searchHostOverride", "/api/unbound/settings/searchHostOverride/", req, &map[string]any{})
+	return err
+}
+
+func (u *Client) probeSettings(ctx context.Context) error {
+	return u.do(ctx, "GET", "/api/unbound/settings/get", nil, func(r io.Reader) error {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(raw) {
+			return &ResponseError{Op: "getSettings", Reason: "invalid JSON", Body: raw}
+		}
+		return nil
+	})
+}
+
+// probeAdd adds a host override without a domain and with a server that isn't an address, which OPNsense
+// rejects. Should it be saved all the same, it is deleted right away.
+func (u *Client) probeAdd(ctx context.Context) error {
+	req := &HostOverrideRequest{Host: HostOverrideRequestHost{Enabled: "0", RR: "A", Server: "invalid", Description: "privilege check"}}
+
+	var res AddHostOverrideResponse
+	if _, err := u.postResult(ctx, "addHostOverride", "/api/unbound/settings/addHostOverride/", req, &res); err != nil {
+		return err
+	}
+	if res.Result == "saved" && res.ID != "" {
+		u.logger.Warn("privilege check host override saved, deleting it", slog.String("id", string(res.ID)))
+		return u.DeleteHostOverride(ctx, HostOverride{ID: res.ID})
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package unbound_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestCheckPrivileges(t *testing.T) {
+	// allow serves the endpoints probed that the test hasn't, denying those in deny
+	allow := func(t *testing.T, deny ...string) {
+		denied := map[string]bool{}
+		for _, path := range deny {
+			denied[path] = true
+		}
+		handle := func(path, body string) {
+			if _, pattern := mux.Handler(&http.Request{Method: "POST", URL: &url.URL{Path: path}}); pattern != "" {
+				return
+			}
+			mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				if denied[path] {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(w, `{"status":403,"message":"Forbidden"}`)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, body)
+			})
+		}
+		handle("/api/unbound/settings/searchHostOverride/", `{"rows":[],"rowCount":0,"total":0,"current":1}`)
+		handle("/api/unbound/settings/get", `{"unbound":{"hosts":{"host":[]}}}`)
+		handle("/api/unbound/settings/addHostOverride/", `{"result":"failed","validations":{"host.domain":"A valid domain must be specified."}}`)
+	}
+
+	checker := func(api unbound.API) unbound.PrivilegeChecker {
+		return api.(unbound.PrivilegeChecker)
+	}
+
+	t.Run("reports every privilege granted", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+		allow(t)
+
+		checks, err := checker(client).CheckPrivileges(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []unbound.PrivilegeCheck{
+			{Privilege: unbound.PrivilegeReadRecords, Endpoint: "/api/unbound/settings/searchHostOverride/", Granted: true},
+			{Privilege: unbound.PrivilegeReadSettings, Endpoint: "/api/unbound/settings/get", Granted: true},
+			{Privilege: unbound.PrivilegeChangeRecords, Endpoint: "/api/unbound/settings/addHostOverride/", Granted: true},
+		}, checks)
+	})
+
+	t.Run("reports the privileges denied", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+		allow(t, "/api/unbound/settings/get", "/api/unbound/settings/addHostOverride/")
+
+		checks, err := checker(client).CheckPrivileges(context.Background())
+		require.NoError(t, err)
+		granted := map[string]bool{}
+		for _, c := range checks {
+			granted[c.Privilege] = c.Granted
+		}
+		require.Equal(t, map[string]bool{
+			unbound.PrivilegeReadRecords:   true,
+			unbound.PrivilegeReadSettings:  false,
+			unbound.PrivilegeChangeRecords: false,
+		}, granted)
+	})
+
+	t.Run("takes an HTML page for a denial", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+		mux.HandleFunc("/api/unbound/settings/addHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "<!doctype html><html><body>Login</body></html>")
+		})
+		allow(t)
+
+		checks, err := checker(client).CheckPrivileges(context.Background())
+		require.NoError(t, err)
+		require.False(t, checks[2].Granted)
+	})
+
+	t.Run("probes writes with a record OPNsense rejects", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		var added unbound.HostOverrideRequest
+		deleted := ""
+		mux.HandleFunc("/api/unbound/settings/addHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&added))
+			fmt.Fprint(w, `{"result":"saved","uuid":"7f5a2b1c-3d4e-4f60-8a9b-0c1d2e3f4a5b"}`)
+		})
+		mux.HandleFunc("/api/unbound/settings/delHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			deleted = r.URL.Path
+			fmt.Fprint(w, `{"result":"deleted"}`)
+		})
+		allow(t)
+
+		checks, err := checker(client).CheckPrivileges(context.Background())
+		require.NoError(t, err)
+		require.True(t, checks[2].Granted)
+		require.Empty(t, added.Host.Domain)
+		require.Equal(t, "0", added.Host.Enabled)
+		require.Equal(t, "/api/unbound/settings/delHostOverride/7f5a2b1c-3d4e-4f60-8a9b-0c1d2e3f4a5b", deleted,
+			"a probe saved anyway is deleted")
+	})
+
+	t.Run("fails when OPNsense is unavailable", func(t *testing.T) {
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+		mux.HandleFunc("/api/unbound/settings/searchHostOverride/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		_, err := checker(client).CheckPrivileges(context.Background())
+		require.ErrorIs(t, err, unbound.ErrUnavailable)
+	})
+}
@@ -0,0 +1,87 @@
+package unbound_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// TestReplay runs the client through exchanges with OPNsense recorded in testdata/cassettes, skipping
+// those not recorded yet. Record them against a scratch OPNsense with go test -run TestReplay -record, as
+// they hold all it answers, with only its address, credentials and OPNSENSE_TEST_DOMAIN scrubbed.
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("host overrides", func(t *testing.T) {
+		client, domain := cassetteClient(t, "host_overrides")
+
+		ho, err := client.CreateHostOverride(ctx, unbound.HostOverride{
+			Hostname: "cassette-nas", Domain: domain, Server: "192.0.2.10", Description: "cassette",
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, ho.ID)
+
+		got, err := client.GetHostOverride(ctx, ho.ID)
+		require.NoError(t, err)
+		require.Equal(t, "cassette-nas."+domain, got.DNSName())
+		require.Equal(t, "192.0.2.10", got.Server)
+		require.Equal(t, "cassette", got.Description)
+
+		ho.Server = "192.0.2.11"
+		require.NoError(t, client.UpdateHostOverride(ctx, ho))
+		require.NoError(t, client.ToggleHostOverride(ctx, ho.ID, false))
+		hos, err := client.ListHostOverrides(ctx)
+		require.NoError(t, err)
+		require.True(t, slices.ContainsFunc(hos, func(e unbound.HostOverride) bool {
+			return e.ID == ho.ID && e.Server == "192.0.2.11" && e.Enabled == "0"
+		}), "%v has the updated, disabled host override", hos)
+
+		require.NoError(t, client.DeleteHostOverride(ctx, ho))
+		_, err = client.GetHostOverride(ctx, ho.ID)
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		require.NoError(t, client.Reconfigure(ctx))
+	})
+
+	t.Run("host aliases", func(t *testing.T) {
+		client, domain := cassetteClient(t, "host_aliases")
+
+		ho, err := client.CreateHostOverride(ctx, unbound.HostOverride{
+			Hostname: "cassette-files", Domain: domain, Server: "192.0.2.20",
+		})
+		require.NoError(t, err)
+		ha, err := client.CreateHostAlias(ctx, unbound.HostAlias{
+			HostID: ho.ID, Hostname: "cassette-share", Domain: domain, Description: "cassette",
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, ha.ID)
+
+		got, err := client.GetHostAlias(ctx, ha.ID)
+		require.NoError(t, err)
+		require.Equal(t, "cassette-share."+domain, got.DNSName())
+		require.Equal(t, "cassette", got.Description)
+
+		ha.Hostname = "cassette-files-share"
+		require.NoError(t, client.UpdateHostAlias(ctx, ha))
+		require.NoError(t, client.ToggleHostAlias(ctx, ha.ID, false))
+		has, err := client.ListHostAliases(ctx, ho.ID)
+		require.NoError(t, err)
+		require.Len(t, has, 1)
+		require.Equal(t, "cassette-files-share", has[0].Hostname)
+		require.Equal(t, "0", has[0].Enabled)
+
+		require.NoError(t, client.DeleteHostAlias(ctx, ha))
+		require.NoError(t, client.DeleteHostOverride(ctx, ho))
+		require.NoError(t, client.Reconfigure(ctx))
+	})
+
+	t.Run("version", func(t *testing.T) {
+		client, _ := cassetteClient(t, "version")
+
+		version, err := client.Version(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, version)
+	})
+}
@@ -0,0 +1,67 @@
+package unbound
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides how requests that failed with a network error, a 5xx or a 429 are retried,
+// and changes refused because the configuration is locked, see LockedError.
+// Other 4xx responses are definitive and never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts in total, 1 meaning no retries
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for every next one, with jitter
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+}
+
+// WithRetryPolicy retries requests as set by p. By default requests aren't retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(u *Client) {
+		p.MaxAttempts = max(p.MaxAttempts, 1)
+		u.retry = p
+	}
+}
+
+// WithRetry retries requests up to maxAttempts attempts in total, with exponential backoff
+// starting at baseDelay and capped at maxDelay. See RetryPolicy.
+func WithRetry(maxAttempts int, baseDelay, maxDelay time.Duration) Option {
+	return WithRetryPolicy(RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: baseDelay, MaxDelay: maxDelay})
+}
+
+// delay returns how long to wait after the given failed attempt: a random duration
+// between half and all of BaseDelay doubled for every previous attempt, capped at MaxDelay.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryReason returns why an attempt should be retried, or "" if it shouldn't.
+func retryReason(ctx context.Context, res *http.Response, err error) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if err != nil {
+		return "network"
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return "throttled"
+	}
+	if res.StatusCode >= 500 {
+		return "server_error"
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/opnsensetest"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// faultyServer fails the first len(faults) requests with the given status codes, 0 meaning a dropped connection,
+// and answers the rest with a successful reconfigure.
+func faultyServer(t *testing.T, faults ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(faults) {
+			if faults[n-1] == 0 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(faults[n-1])
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func retryingClient(t *testing.T, server *httptest.Server, attempts int) unbound.API {
+	t.Helper()
+
+	client, err := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+		unbound.WithRetry(attempts, time.Millisecond, 5*time.Millisecond))
+	require.NoError(t, err)
+	return client
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("retries network errors, 5xx and 429", func(t *testing.T) {
+		server, calls := faultyServer(t, 0, http.StatusBadGateway, http.StatusTooManyRequests)
+
+		err := retryingClient(t, server, 4).Reconfigure(context.Background())
+		require.NoError(t, err)
+		require.EqualValues(t, 4, calls.Load())
+	})
+
+	t.Run("saves a change OPNsense failed before saving it once", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		t.Cleanup(server.Close)
+		server.FailNext("addHostOverride", 2, http.StatusServiceUnavailable)
+		server.FailNext("searchHostOverride", 1, http.StatusTooManyRequests)
+		client := server.UnboundClient(unbound.WithRetry(3, time.Millisecond, 5*time.Millisecond))
+
+		_, err := client.CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		require.NoError(t, err)
+		hos, err := client.ListHostOverrides(context.Background())
+		require.NoError(t, err)
+		require.Len(t, hos, 1)
+		require.Equal(t, 3, server.Calls("addHostOverride"))
+		require.Equal(t, 2, server.Calls("searchHostOverride"))
+	})
+
+	t.Run("gives up after maxAttempts", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+		err := retryingClient(t, server, 2).Reconfigure(context.Background())
+		require.ErrorContains(t, err, "503")
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("does not retry 4xx", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusBadRequest)
+
+		_, err := retryingClient(t, server, 3).CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "ha"})
+		require.Error(t, err)
+		require.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("does not retry rejected credentials", func(t *testing.T) {
+		server := opnsensetest.NewServer()
+		t.Cleanup(server.Close)
+		server.FailNext("reconfigure", 1, http.StatusUnauthorized)
+
+		err := server.UnboundClient(unbound.WithRetry(3, time.Millisecond, 5*time.Millisecond)).Reconfigure(context.Background())
+		require.ErrorIs(t, err, unbound.ErrUnauthorized)
+		require.Equal(t, 1, server.Calls("reconfigure"))
+	})
+
+	t.Run("does not retry without the option", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusBadGateway)
+
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+		err := client.Reconfigure(context.Background())
+		require.Error(t, err)
+		require.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		server, calls := faultyServer(t, http.StatusBadGateway, http.StatusBadGateway)
+
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithRetry(3, time.Hour, time.Hour))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := client.Reconfigure(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.EqualValues(t, 1, calls.Load())
+	})
+}
+
+func TestPerCallTimeout(t *testing.T) {
+	slowServer := func(t *testing.T) *httptest.Server {
+		t.Helper()
+
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		t.Cleanup(server.Close)
+		t.Cleanup(func() { close(release) })
+		return server
+	}
+
+	t.Run("fails a call exceeding its timeout", func(t *testing.T) {
+		server := slowServer(t)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithPerCallTimeout(10*time.Millisecond))
+
+		err := client.Reconfigure(context.Background())
+		require.ErrorIs(t, err, unbound.ErrCallTimeout)
+		require.ErrorContains(t, err, "timed out after 10ms")
+	})
+
+	t.Run("fails a call OPNsense answers too late", func(t *testing.T) {
+		server := opnsensetest.NewServer(opnsensetest.WithClock(func(time.Duration) <-chan time.Time { return nil }))
+		t.Cleanup(server.Close)
+		server.InjectFault("addHostOverride", opnsensetest.Fault{Delay: time.Minute})
+
+		_, err := server.UnboundClient(unbound.WithPerCallTimeout(10*time.Millisecond)).
+			CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		require.ErrorIs(t, err, unbound.ErrCallTimeout)
+		require.Empty(t, server.HostOverrides())
+	})
+
+	t.Run("reports the caller's cancellation as such", func(t *testing.T) {
+		server := slowServer(t)
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client(),
+			unbound.WithPerCallTimeout(time.Minute))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		err := client.Reconfigure(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotErrorIs(t, err, unbound.ErrCallTimeout)
+	})
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&unbound.StatusError{StatusCode: http.StatusBadGateway}, true},
+		{&unbound.StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&unbound.StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{fmt.Errorf("failed to list A records: %w", unbound.ErrCircuitOpen), true},
+		{unbound.ErrCallTimeout, true},
+		{context.Canceled, false},
+		{fmt.Errorf("failed to deserialize response: %w", io.ErrUnexpectedEOF), false},
+	} {
+		require.Equal(t, tc.want, unbound.IsTransient(tc.err), "%v", tc.err)
+	}
+
+	t.Run("network errors", func(t *testing.T) {
+		server, _ := faultyServer(t, 0)
+
+		client, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", server.Client())
+		err := client.Reconfigure(context.Background())
+		require.True(t, unbound.IsTransient(err), "%v", err)
+	})
+}
@@ -0,0 +1,515 @@
+package unbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// SettingsAPI reads and writes every host override and alias of the Unbound settings at once,
+// for changes too large to make one record at a time. Client implements it.
+type SettingsAPI interface {
+	GetSettings(context.Context) (*Settings, error)
+	GetHostSettings(context.Context) (*HostSettings, error)
+	SetHostSettings(context.Context, *HostSettings) error
+}
+
+// Settings are the host overrides and aliases listed by ListHostOverrides and ListHostAliases,
+// read from the Unbound settings in a single call instead.
+type Settings struct {
+	HostOverrides []HostOverride
+	// HostAliases of every override, with HostID set. Aliases of overrides that don't exist are left out.
+	HostAliases []HostAlias
+}
+
+// HostSettings holds the host overrides and aliases of the Unbound settings by UUID.
+//
+// Records are kept field by field as OPNsense returns them, with option lists reduced to the
+// options selected, so that writing the settings back leaves records and fields the caller
+// doesn't change as they are.
+type HostSettings struct {
+	Hosts   map[HostOverrideID]SettingsFields
+	Aliases map[HostAliasID]SettingsFields
+
+	// read is a copy of the settings as GetHostSettings read them, to tell whether they changed since
+	read *HostSettings
+
+	// hostIDs and aliasIDs map the IDs records were put under to the ones OPNsense gave them, where they differ
+	hostIDs  map[HostOverrideID]HostOverrideID
+	aliasIDs map[HostAliasID]HostAliasID
+}
+
+// WrittenHostOverrideID returns the ID OPNsense gave the host override put under id, once SetHostSettings wrote it.
+// OPNsense may not keep the UUIDs of records added to the settings.
+func (s *HostSettings) WrittenHostOverrideID(id HostOverrideID) HostOverrideID {
+	if written, ok := s.hostIDs[id]; ok {
+		return written
+	}
+	return id
+}
+
+// WrittenHostAliasID returns the ID OPNsense gave the host alias put under id, once SetHostSettings wrote it.
+func (s *HostSettings) WrittenHostAliasID(id HostAliasID) HostAliasID {
+	if written, ok := s.aliasIDs[id]; ok {
+		return written
+	}
+	return id
+}
+
+// clone returns a copy of the records of s.
+func (s *HostSettings) clone() *HostSettings {
+	c := &HostSettings{
+		Hosts:   make(map[HostOverrideID]SettingsFields, len(s.Hosts)),
+		Aliases: make(map[HostAliasID]SettingsFields, len(s.Aliases)),
+	}
+	for id, f := range s.Hosts {
+		c.Hosts[id] = maps.Clone(f)
+	}
+	for id, f := range s.Aliases {
+		c.Aliases[id] = maps.Clone(f)
+	}
+	return c
+}
+
+// sameRecords tells whether s and other hold the same records with the same fields.
+func (s *HostSettings) sameRecords(other *HostSettings) bool {
+	return maps.EqualFunc(s.Hosts, other.Hosts, maps.Equal[SettingsFields]) &&
+		maps.EqualFunc(s.Aliases, other.Aliases, maps.Equal[SettingsFields])
+}
+
+// SettingsFields are the fields of a record in the settings, such as "hostname" or "server".
+type SettingsFields map[string]string
+
+// HostOverride returns the host override with the given ID.
+func (s *HostSettings) HostOverride(id HostOverrideID) (HostOverride, bool) {
+	f, ok := s.Hosts[id]
+	if !ok {
+		return HostOverride{}, false
+	}
+	return HostOverride{
+		ID:          id,
+		Enabled:     f["enabled"],
+		Hostname:    f["hostname"],
+		Domain:      f["domain"],
+		Server:      f["server"],
+		Description: f["description"],
+		MXPrio:      f["mxprio"],
+		MX:          f["mx"],
+	}, true
+}
+
+// PutHostOverride sets the enabled A record ho, adding it under a new UUID if it has no ID, and returns it with its ID.
+func (s *HostSettings) PutHostOverride(ho HostOverride) HostOverride {
+	if ho.ID == "" {
+		ho.ID = HostOverrideID(newUUID())
+	}
+	f := s.Hosts[ho.ID]
+	if f == nil {
+		f = SettingsFields{}
+		s.Hosts[ho.ID] = f
+	}
+	f["enabled"] = "1"
+	f["hostname"] = ho.Hostname
+	f["domain"] = ho.Domain
+	f["rr"] = "A"
+	f["server"] = ho.Server
+	f["description"] = ho.Description
+	f["mxprio"] = ho.MXPrio
+	f["mx"] = ho.MX
+	return ho
+}
+
+// DeleteHostOverride removes the host override with the given ID.
+func (s *HostSettings) DeleteHostOverride(id HostOverrideID) {
+	delete(s.Hosts, id)
+}
+
+// ToggleHostOverride enables or disables the host override with the given ID, leaving its other fields as they are.
+func (s *HostSettings) ToggleHostOverride(id HostOverrideID, enabled bool) {
+	if f, ok := s.Hosts[id]; ok {
+		f["enabled"] = enabledField(enabled)
+	}
+}
+
+// HostAlias returns the host alias with the given ID.
+func (s *HostSettings) HostAlias(id HostAliasID) (HostAlias, bool) {
+	f, ok := s.Aliases[id]
+	if !ok {
+		return HostAlias{}, false
+	}
+	hostID := HostOverrideID(f["host"])
+	ha := HostAlias{
+		ID:          id,
+		Enabled:     f["enabled"],
+		HostID:      hostID,
+		Hostname:    f["hostname"],
+		Domain:      f["domain"],
+		Description: f["description"],
+	}
+	if ho, ok := s.HostOverride(hostID); ok {
+		ha.Host = ho.DNSName()
+	}
+	return ha, true
+}
+
+// PutHostAlias sets the enabled alias ha, adding it under a new UUID if it has no ID, and returns it with its ID.
+func (s *HostSettings) PutHostAlias(ha HostAlias) HostAlias {
+	if ha.ID == "" {
+		ha.ID = HostAliasID(newUUID())
+	}
+	f := s.Aliases[ha.ID]
+	if f == nil {
+		f = SettingsFields{}
+		s.Aliases[ha.ID] = f
+	}
+	f["enabled"] = "1"
+	f["host"] = string(ha.HostID)
+	f["hostname"] = ha.Hostname
+	f["domain"] = ha.Domain
+	f["description"] = ha.Description
+	return ha
+}
+
+// DeleteHostAlias removes the host alias with the given ID.
+func (s *HostSettings) DeleteHostAlias(id HostAliasID) {
+	delete(s.Aliases, id)
+}
+
+// ToggleHostAlias enables or disables the host alias with the given ID, leaving its other fields as they are.
+func (s *HostSettings) ToggleHostAlias(id HostAliasID, enabled bool) {
+	if f, ok := s.Aliases[id]; ok {
+		f["enabled"] = enabledField(enabled)
+	}
+}
+
+func enabledField(enabled bool) string {
+	if enabled {
+		return "1"
+	}
+	return "0"
+}
+
+type getSettingsResponse struct {
+	Unbound struct {
+		Hosts *struct {
+			Host json.RawMessage `json:"host"`
+		} `json:"hosts"`
+		Aliases *struct {
+			Alias json.RawMessage `json:"alias"`
+		} `json:"aliases"`
+	} `json:"unbound"`
+}
+
+type setSettingsRequest struct {
+	Unbound setSettingsUnbound `json:"unbound"`
+}
+
+type setSettingsUnbound struct {
+	Hosts struct {
+		Host map[HostOverrideID]SettingsFields `json:"host"`
+	} `json:"hosts"`
+	Aliases struct {
+		Alias map[HostAliasID]SettingsFields `json:"alias"`
+	} `json:"aliases"`
+}
+
+type SetSettingsResponse struct {
+	Result      string                 `json:"result"` // "saved"
+	Validations map[string]interface{} `json:"validations,omitempty"`
+}
+
+// GetHostSettings reads every host override and alias from the Unbound settings.
+func (u *Client) GetHostSettings(ctx context.Context) (*HostSettings, error) {
+	var res getSettingsResponse
+	var raw []byte
+	err := u.do(ctx, "GET", "/api/unbound/settings/get", nil, func(r io.Reader) error {
+		var err error
+		if raw, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &res); err != nil {
+			return &ResponseError{Op: "getSettings", Reason: err.Error(), Body: raw}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Listing nothing for a document without them would look like every record was deleted
+	if res.Unbound.Hosts == nil || res.Unbound.Aliases == nil {
+		return nil, &ResponseError{Op: "getSettings", Reason: "no host overrides or aliases in the settings", Body: raw}
+	}
+
+	hosts, err := settingsRecords[HostOverrideID](res.Unbound.Hosts.Host)
+	if err != nil {
+		return nil, &ResponseError{Op: "getSettings", Reason: "host overrides: " + err.Error(), Body: raw}
+	}
+	aliases, err := settingsRecords[HostAliasID](res.Unbound.Aliases.Alias)
+	if err != nil {
+		return nil, &ResponseError{Op: "getSettings", Reason: "host aliases: " + err.Error(), Body: raw}
+	}
+
+	settings := &HostSettings{
+		Hosts:   make(map[HostOverrideID]SettingsFields, len(hosts)),
+		Aliases: make(map[HostAliasID]SettingsFields, len(aliases)),
+	}
+	for id, fields := range hosts {
+		f, err := settingsFields(fields)
+		if err != nil {
+			return nil, &ResponseError{Op: "getSettings", Reason: fmt.Sprintf("host override %s: %s", id, err), Body: raw}
+		}
+		settings.Hosts[id] = f
+	}
+	for id, fields := range aliases {
+		f, err := settingsFields(fields)
+		if err != nil {
+			return nil, &ResponseError{Op: "getSettings", Reason: fmt.Sprintf("host alias %s: %s", id, err), Body: raw}
+		}
+		settings.Aliases[id] = f
+	}
+	settings.read = settings.clone()
+	return settings, nil
+}
+
+// GetSettings lists every host override and alias with one call, sorted like ListHostOverrides and ListHostAliases.
+func (u *Client) GetSettings(ctx context.Context) (*Settings, error) {
+	hs, err := u.GetHostSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &Settings{
+		HostOverrides: make([]HostOverride, 0, len(hs.Hosts)),
+		HostAliases:   make([]HostAlias, 0, len(hs.Aliases)),
+	}
+	for id := range hs.Hosts {
+		ho, _ := hs.HostOverride(id)
+		settings.HostOverrides = append(settings.HostOverrides, ho)
+	}
+	for id := range hs.Aliases {
+		ha, _ := hs.HostAlias(id)
+		if _, ok := hs.Hosts[ha.HostID]; !ok {
+			continue
+		}
+		settings.HostAliases = append(settings.HostAliases, ha)
+	}
+	sortHostOverrides(settings.HostOverrides)
+	sortHostAliases(settings.HostAliases)
+	return settings, nil
+}
+
+// SetHostSettings writes the host overrides and aliases of settings in one call. OPNsense validates
+// the whole Unbound configuration once, instead of once per record.
+//
+// Settings read with GetHostSettings are read again first, and not written if they changed meanwhile,
+// failing with ErrSettingsChanged. Once written, they are read back: records OPNsense gave other IDs than
+// the ones they were put under are found by their fields, aliases of such host overrides are pointed at
+// their new ID, and settings are updated to the IDs OPNsense has. See WrittenHostOverrideID.
+func (u *Client) SetHostSettings(ctx context.Context, settings *HostSettings) error {
+	if settings.read != nil {
+		current, err := u.GetHostSettings(ctx)
+		if err != nil {
+			return fmt.Errorf("setSettings failed: %w", err)
+		}
+		if !current.sameRecords(settings.read) {
+			u.logger.Warn("unbound settings changed since they were read, not writing them")
+			return fmt.Errorf("setSettings failed: %w", ErrSettingsChanged)
+		}
+	}
+
+	if err := u.setHostSettings(ctx, settings); err != nil {
+		return err
+	}
+
+	written, err := u.GetHostSettings(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back the settings written: %w", err)
+	}
+	repointed, err := settings.reassign(written)
+	if err != nil {
+		return err
+	}
+	if repointed {
+		u.logger.Warn("OPNsense gave host overrides other IDs than written, pointing their aliases at them",
+			slog.Int("hostOverrides", len(settings.hostIDs)))
+		if err := u.setHostSettings(ctx, written); err != nil {
+			return err
+		}
+	}
+
+	settings.Hosts, settings.Aliases = written.Hosts, written.Aliases
+	settings.read = written.clone()
+	return nil
+}
+
+// setHostSettings writes settings once, as they are.
+func (u *Client) setHostSettings(ctx context.Context, settings *HostSettings) error {
+	req := &setSettingsRequest{}
+	req.Unbound.Hosts.Host = settings.Hosts
+	req.Unbound.Aliases.Alias = settings.Aliases
+
+	var res SetSettingsResponse
+	raw, err := u.postResult(ctx, "setSettings", "/api/unbound/settings/set", req, &res)
+	if err != nil {
+		return err
+	}
+	if err := checkResult("setSettings", res.Result, raw); err != nil {
+		u.logger.Error("setSettings failed", slog.Any("error", err))
+		return err
+	}
+
+	if res.Result != "saved" {
+		u.logger.Error("setSettings failed", slog.Any("response", res))
+		return resultError("setSettings", res.Result, res.Validations)
+	}
+	u.warnValidations("setSettings", res.Validations)
+
+	return nil
+}
+
+// reassign maps the records of s missing from written, the settings read back after writing s, to the records
+// of written with the same fields, which OPNsense added under other IDs. Aliases of written pointing at a
+// host override by the ID it was put under are pointed at its new ID; reassign tells whether there were any.
+func (s *HostSettings) reassign(written *HostSettings) (bool, error) {
+	s.hostIDs, s.aliasIDs = nil, nil
+
+	hostIDs, err := reassigned(s.Hosts, written.Hosts)
+	if err != nil {
+		return false, fmt.Errorf("setSettings failed: %w: host override %w", ErrBadResponse, err)
+	}
+	repointed := false
+	for _, f := range written.Aliases {
+		if id, ok := hostIDs[HostOverrideID(f["host"])]; ok {
+			f["host"] = string(id)
+			repointed = true
+		}
+	}
+
+	// Aliases of reassigned host overrides are compared by the ID they were put under
+	aliases := make(map[HostAliasID]SettingsFields, len(s.Aliases))
+	for id, f := range s.Aliases {
+		if hostID, ok := hostIDs[HostOverrideID(f["host"])]; ok {
+			f = maps.Clone(f)
+			f["host"] = string(hostID)
+		}
+		aliases[id] = f
+	}
+	aliasIDs, err := reassigned(aliases, written.Aliases)
+	if err != nil {
+		return false, fmt.Errorf("setSettings failed: %w: host alias %w", ErrBadResponse, err)
+	}
+
+	s.hostIDs, s.aliasIDs = hostIDs, aliasIDs
+	return repointed, nil
+}
+
+// reassigned returns the IDs written gives the records of put missing from it, found by their fields.
+// It fails if any can't be found.
+func reassigned[K ~string](put, written map[K]SettingsFields) (map[K]K, error) {
+	var ids map[K]K
+	var missing []K
+	for id := range put {
+		if _, ok := written[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+
+	taken := map[K]bool{}
+	for _, id := range missing {
+		found := false
+		for writtenID, f := range written {
+			if _, ok := put[writtenID]; ok || taken[writtenID] || !sameFields(put[id], f) {
+				continue
+			}
+			if ids == nil {
+				ids = map[K]K{}
+			}
+			ids[id], taken[writtenID], found = writtenID, true, true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("%s not found in the settings written", id)
+		}
+	}
+	return ids, nil
+}
+
+// sameFields tells whether written has the fields put.
+func sameFields(put, written SettingsFields) bool {
+	for name, value := range put {
+		if written[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// settingsRecords decodes the records of a settings section by UUID. OPNsense sends an empty array when there are none.
+func settingsRecords[K ~string](raw json.RawMessage) (map[K]map[string]json.RawMessage, error) {
+	records := map[K]map[string]json.RawMessage{}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("[]")) {
+		return records, nil
+	}
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// settingsFields reduces the fields of a record as returned by the settings to their values:
+// strings are kept as they are, and option lists, such as {"A":{"value":"A (IPv4 address)","selected":1}},
+// become the comma-separated keys of the selected options.
+func settingsFields(fields map[string]json.RawMessage) (SettingsFields, error) {
+	f := make(SettingsFields, len(fields))
+	for name, raw := range fields {
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case len(raw) > 0 && raw[0] == '"':
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, fmt.Errorf("field %s: %w", name, err)
+			}
+			f[name] = s
+		case len(raw) > 0 && raw[0] == '{':
+			var options SelectOptions
+			if err := json.Unmarshal(raw, &options); err != nil {
+				return nil, fmt.Errorf("field %s: %w", name, err)
+			}
+			var selected []string
+			for key, option := range options {
+				if option.Selected != 0 {
+					selected = append(selected, key)
+				}
+			}
+			sort.Strings(selected)
+			f[name] = strings.Join(selected, ",")
+		case bytes.Equal(raw, []byte("[]")):
+			// Empty option lists come as arrays
+			f[name] = ""
+		default:
+			f[name] = string(raw)
+		}
+	}
+	return f, nil
+}
+
+// newUUID returns a random UUID, as OPNsense identifies records with.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var _ SettingsAPI = &Client{}
@@ -0,0 +1,322 @@
+package unbound_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestHostSettings(t *testing.T) {
+	const (
+		ha    = unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c")
+		nas   = unbound.HostOverrideID("a7a9f5ef-4ac1-4df4-bc8e-f122d02001ec")
+		mx    = unbound.HostOverrideID("5b1c3f0e-9d1a-4b8e-8f0a-2c6d7e8f9a0b")
+		alias = unbound.HostAliasID("18b07c57-fce4-43ad-8bd8-5fb0e8777800")
+	)
+
+	// setupSettings serves the recorded settings, then the settings last written with a saved result
+	setupSettings := func(t *testing.T, setResponse string) (unbound.SettingsAPI, *settingsServer) {
+		t.Helper()
+
+		client, teardown := setup(t)
+		t.Cleanup(teardown)
+
+		server := &settingsServer{current: fixture(t, "unbound/getSettings.json")}
+		mux.HandleFunc("/api/unbound/settings/get", func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodGet, r.Method)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, server.current)
+		})
+		mux.HandleFunc("/api/unbound/settings/set", func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPost, r.Method)
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			server.bodies = append(server.bodies, string(b))
+			server.body = string(b)
+			if strings.Contains(setResponse, `"saved"`) {
+				server.current = server.body
+				if server.onSet != nil {
+					server.current = server.onSet(server.body)
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, setResponse)
+		})
+
+		return client.(unbound.SettingsAPI), server
+	}
+
+	t.Run("reads host overrides and aliases", func(t *testing.T) {
+		client, _ := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		require.Len(t, settings.Hosts, 3)
+		require.Len(t, settings.Aliases, 1)
+
+		ho, ok := settings.HostOverride(ha)
+		require.True(t, ok)
+		require.Equal(t, unbound.HostOverride{
+			ID:          ha,
+			Enabled:     "1",
+			Hostname:    "ha",
+			Domain:      "home.yarotsky.me",
+			Server:      "192.168.1.13",
+			Description: "Home Assistant",
+		}, ho)
+
+		require.Equal(t, unbound.SettingsFields{
+			"enabled":     "0",
+			"hostname":    "nas",
+			"domain":      "home.yarotsky.me",
+			"rr":          "AAAA",
+			"mxprio":      "",
+			"mx":          "",
+			"server":      "fd00::20",
+			"description": "Added in the UI",
+		}, settings.Hosts[nas])
+
+		a, ok := settings.HostAlias(alias)
+		require.True(t, ok)
+		require.Equal(t, unbound.HostAlias{
+			ID:       alias,
+			Enabled:  "1",
+			Host:     "ha.home.yarotsky.me",
+			HostID:   ha,
+			Hostname: "test",
+			Domain:   "home.yarotsky.me",
+		}, a)
+
+		_, ok = settings.HostOverride("missing")
+		require.False(t, ok)
+	})
+
+	t.Run("lists host overrides and aliases", func(t *testing.T) {
+		client, _ := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetSettings(context.Background())
+		require.NoError(t, err)
+
+		var names []string
+		for _, ho := range settings.HostOverrides {
+			names = append(names, ho.DNSName())
+		}
+		require.Equal(t, []string{".home.yarotsky.me", "ha.home.yarotsky.me", "nas.home.yarotsky.me"}, names)
+		require.Equal(t, []unbound.HostAlias{{
+			ID:       alias,
+			Enabled:  "1",
+			Host:     "ha.home.yarotsky.me",
+			HostID:   ha,
+			Hostname: "test",
+			Domain:   "home.yarotsky.me",
+		}}, settings.HostAliases)
+	})
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want error
+	}{
+		{"reads settings without records", `{"unbound":{"hosts":{"host":[]},"aliases":{"alias":[]}}}`, nil},
+		{"rejects settings without host overrides", `{"unbound":{"general":{"enabled":"1"}}}`, unbound.ErrBadResponse},
+		{"rejects malformed records", `{"unbound":{"hosts":{"host":{"1":"ha"}},"aliases":{"alias":[]}}}`, unbound.ErrBadResponse},
+		{"rejects malformed settings", `<html>`, unbound.ErrBadResponse},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, teardown := setup(t)
+			t.Cleanup(teardown)
+
+			mux.HandleFunc("/api/unbound/settings/get", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, tc.body)
+			})
+
+			settings, err := client.(unbound.SettingsAPI).GetSettings(context.Background())
+			if tc.want != nil {
+				require.ErrorIs(t, err, tc.want)
+				return
+			}
+			require.NoError(t, err)
+			require.Empty(t, settings.HostOverrides)
+			require.Empty(t, settings.HostAliases)
+		})
+	}
+
+	t.Run("writes back the settings read unchanged", func(t *testing.T) {
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, client.SetHostSettings(context.Background(), settings))
+
+		require.JSONEq(t, fixture(t, "unbound/setSettings.json"), server.body)
+	})
+
+	t.Run("writes changes without touching other records", func(t *testing.T) {
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+
+		ho, _ := settings.HostOverride(ha)
+		ho.Server = "192.168.1.14"
+		settings.PutHostOverride(ho)
+		added := settings.PutHostOverride(unbound.HostOverride{Hostname: "grafana", Domain: "home.yarotsky.me", Server: "192.168.1.15"})
+		require.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, string(added.ID))
+		settings.PutHostAlias(unbound.HostAlias{HostID: added.ID, Hostname: "dashboards", Domain: "home.yarotsky.me"})
+		settings.DeleteHostAlias(alias)
+		require.NoError(t, client.SetHostSettings(context.Background(), settings))
+
+		var want, got map[string]map[string]map[string]map[string]unbound.SettingsFields
+		require.NoError(t, json.Unmarshal([]byte(fixture(t, "unbound/setSettings.json")), &want))
+		require.NoError(t, json.Unmarshal([]byte(server.body), &got))
+
+		hosts := got["unbound"]["hosts"]["host"]
+		require.Len(t, hosts, 4)
+		require.Equal(t, want["unbound"]["hosts"]["host"][string(nas)], hosts[string(nas)])
+		require.Equal(t, want["unbound"]["hosts"]["host"][string(mx)], hosts[string(mx)])
+		require.Equal(t, "192.168.1.14", hosts[string(ha)]["server"])
+		require.Equal(t, "Home Assistant", hosts[string(ha)]["description"])
+		require.Equal(t, unbound.SettingsFields{
+			"enabled":     "1",
+			"hostname":    "grafana",
+			"domain":      "home.yarotsky.me",
+			"rr":          "A",
+			"mxprio":      "",
+			"mx":          "",
+			"server":      "192.168.1.15",
+			"description": "",
+		}, hosts[string(added.ID)])
+
+		aliases := got["unbound"]["aliases"]["alias"]
+		require.Len(t, aliases, 1)
+		for _, f := range aliases {
+			require.Equal(t, string(added.ID), f["host"])
+			require.Equal(t, "dashboards", f["hostname"])
+		}
+	})
+
+	t.Run("toggles records", func(t *testing.T) {
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+
+		settings.ToggleHostOverride(ha, false)
+		settings.ToggleHostAlias(alias, false)
+		settings.ToggleHostOverride("missing", false)
+		require.NoError(t, client.SetHostSettings(context.Background(), settings))
+
+		var got map[string]map[string]map[string]map[string]unbound.SettingsFields
+		require.NoError(t, json.Unmarshal([]byte(server.body), &got))
+		require.Len(t, got["unbound"]["hosts"]["host"], 3)
+		require.Equal(t, "0", got["unbound"]["hosts"]["host"][string(ha)]["enabled"])
+		require.Equal(t, "Home Assistant", got["unbound"]["hosts"]["host"][string(ha)]["description"])
+		require.Equal(t, "0", got["unbound"]["aliases"]["alias"][string(alias)]["enabled"])
+
+		ho, ok := settings.HostOverride(ha)
+		require.True(t, ok)
+		require.Equal(t, "0", ho.Enabled)
+	})
+
+	t.Run("fails with validation errors", func(t *testing.T) {
+		client, _ := setupSettings(t, `{"result":"failed","validations":{"unbound.hosts.host.2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c.server":"A valid IP address must be specified."}}`)
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+
+		err = client.SetHostSettings(context.Background(), settings)
+		require.ErrorIs(t, err, unbound.ErrValidation)
+
+		var validationErr *unbound.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+	})
+
+	t.Run("fails on malformed responses", func(t *testing.T) {
+		client, _ := setupSettings(t, `{"result":"OK"}`)
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		require.ErrorIs(t, client.SetHostSettings(context.Background(), settings), unbound.ErrBadResponse)
+	})
+
+	t.Run("doesn't write settings changed since they were read", func(t *testing.T) {
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		settings.PutHostOverride(unbound.HostOverride{Hostname: "grafana", Domain: "home.yarotsky.me", Server: "192.168.1.15"})
+
+		// Someone edits a record in the UI meanwhile
+		server.current = strings.Replace(server.current, `"Added in the UI"`, `"Edited in the UI"`, 1)
+		err = client.SetHostSettings(context.Background(), settings)
+		require.ErrorIs(t, err, unbound.ErrSettingsChanged)
+		require.Empty(t, server.bodies)
+	})
+
+	t.Run("follows host overrides OPNsense gives other IDs", func(t *testing.T) {
+		const assigned = unbound.HostOverrideID("9d3e1c1a-7b0e-4c55-9a43-6f0f3d2b8e11")
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		added := settings.PutHostOverride(unbound.HostOverride{Hostname: "grafana", Domain: "home.yarotsky.me", Server: "192.168.1.15"})
+		alias := settings.PutHostAlias(unbound.HostAlias{HostID: added.ID, Hostname: "dashboards", Domain: "home.yarotsky.me"})
+
+		// OPNsense keeps the new host override under another UUID, leaving the alias pointing at the one sent
+		server.onSet = func(body string) string {
+			return strings.ReplaceAll(body, `"`+string(added.ID)+`":`, `"`+string(assigned)+`":`)
+		}
+		require.NoError(t, client.SetHostSettings(context.Background(), settings))
+
+		require.Len(t, server.bodies, 2, "the alias is written again, pointing at the new UUID")
+		require.Equal(t, assigned, settings.WrittenHostOverrideID(added.ID))
+		require.Equal(t, alias.ID, settings.WrittenHostAliasID(alias.ID))
+		ho, ok := settings.HostOverride(assigned)
+		require.True(t, ok)
+		require.Equal(t, "grafana", ho.Hostname)
+		ha, ok := settings.HostAlias(alias.ID)
+		require.True(t, ok)
+		require.Equal(t, assigned, ha.HostID)
+		require.Equal(t, "grafana.home.yarotsky.me", ha.Host)
+
+		// The settings read back are those written next
+		server.onSet = nil
+		require.NoError(t, client.SetHostSettings(context.Background(), settings))
+	})
+
+	t.Run("fails when records written can't be found", func(t *testing.T) {
+		client, server := setupSettings(t, fixture(t, "unbound/setSettingsSaved.json"))
+
+		settings, err := client.GetHostSettings(context.Background())
+		require.NoError(t, err)
+		added := settings.PutHostOverride(unbound.HostOverride{Hostname: "grafana", Domain: "home.yarotsky.me", Server: "192.168.1.15"})
+
+		// OPNsense keeps the new host override under another UUID, but not as it was sent
+		server.onSet = func(body string) string {
+			body = strings.ReplaceAll(body, string(added.ID), "9d3e1c1a-7b0e-4c55-9a43-6f0f3d2b8e11")
+			return strings.Replace(body, `"grafana"`, `"grafana-renamed"`, 1)
+		}
+		require.ErrorIs(t, client.SetHostSettings(context.Background(), settings), unbound.ErrBadResponse)
+	})
+}
+
+// settingsServer is the state of the Unbound settings served to TestHostSettings.
+type settingsServer struct {
+	// current is the body of the settings served
+	current string
+	// body is that of the last set request, and bodies that of every one
+	body   string
+	bodies []string
+
+	// onSet, if set, turns the body of a set request into the settings kept
+	onSet func(body string) string
+}
@@ -0,0 +1,174 @@
+package unbound
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TLSError explains why the TLS handshake with OPNsense failed, and what to do about it.
+type TLSError struct {
+	// Problem is what is wrong with the connection or certificate
+	Problem string
+	// Remedy is what to change to fix it
+	Remedy string
+
+	// Subject and NotAfter describe the certificate OPNsense presented, if any
+	Subject  string
+	NotAfter time.Time
+
+	err error
+}
+
+func (e *TLSError) Error() string {
+	var b strings.Builder
+	b.WriteString("TLS handshake with OPNsense failed: ")
+	b.WriteString(e.Problem)
+	if e.Subject != "" {
+		fmt.Fprintf(&b, " (certificate %q, expires %s)", e.Subject, e.NotAfter.UTC().Format(time.DateOnly))
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Remedy)
+	return b.String()
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.err
+}
+
+// classifyTLSError returns a *TLSError for common TLS failures, or nil if err isn't one of them.
+func classifyTLSError(err error) *TLSError {
+	if err == nil {
+		return nil
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var pin *PinMismatchError
+
+	switch {
+	case errors.As(err, &pin):
+		return withCert(&TLSError{
+			Problem: fmt.Sprintf("certificate public key fingerprint %s matches no pin", pin.Fingerprint),
+			Remedy:  "if it is the certificate OPNsense should present, pin its fingerprint with -tls-pin-sha256",
+			err:     err,
+		}, pin.Cert)
+
+	case errors.As(err, &unknownAuthority):
+		return withCert(&TLSError{
+			Problem: "certificate signed by unknown authority",
+			Remedy:  "provide the CA that signed it with -tls-ca-file",
+			err:     err,
+		}, unknownAuthority.Cert)
+
+	case errors.As(err, &hostname):
+		names := hostname.Certificate.DNSNames
+		for _, ip := range hostname.Certificate.IPAddresses {
+			names = append(names, ip.String())
+		}
+		return withCert(&TLSError{
+			Problem: fmt.Sprintf("certificate is not valid for %s", hostname.Host),
+			Remedy:  fmt.Sprintf("set -tls-server-name to one of %s, or use it in the base URL", strings.Join(names, ", ")),
+			err:     err,
+		}, hostname.Certificate)
+
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		tlsErr := &TLSError{err: err}
+		if now := time.Now(); now.Before(invalid.Cert.NotBefore) {
+			tlsErr.Problem = "certificate is not valid yet"
+			tlsErr.Remedy = fmt.Sprintf("the OPNsense certificate is valid from %s, check the clocks of OPNsense and this host",
+				invalid.Cert.NotBefore.UTC().Format(time.RFC3339))
+		} else {
+			tlsErr.Problem = "certificate expired"
+			tlsErr.Remedy = fmt.Sprintf("the OPNsense certificate expired on %s, renew it in System > Trust > Certificates",
+				invalid.Cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		return withCert(tlsErr, invalid.Cert)
+
+	// crypto/tls doesn't export these errors. The first is the server's alert, the second the client's.
+	case strings.Contains(err.Error(), "tls: protocol version not supported"),
+		strings.Contains(err.Error(), "tls: server selected unsupported protocol version"):
+		return &TLSError{
+			Problem: "no TLS protocol version in common",
+			Remedy:  "allow TLS 1.2 or later, or 1.3 with -tls-min-version 1.3, for the OPNsense web GUI in System > Settings > Administration",
+			err:     err,
+		}
+	}
+
+	return nil
+}
+
+func withCert(e *TLSError, cert *x509.Certificate) *TLSError {
+	if cert != nil {
+		e.Subject = cert.Subject.String()
+		e.NotAfter = cert.NotAfter
+	}
+	return e
+}
+
+// Pin is the SHA-256 hash of a certificate's SubjectPublicKeyInfo.
+type Pin [sha256.Size]byte
+
+// ParsePin parses the SHA-256 fingerprint of a certificate's public key, in hex, optionally colon-separated,
+// or in base64 as HPKP pins are:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256
+func ParsePin(s string) (Pin, error) {
+	var pin Pin
+	decoded, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(decoded) != len(pin) {
+		decoded, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256/"))
+	}
+	if err != nil || len(decoded) != len(pin) {
+		return pin, fmt.Errorf("invalid SHA-256 fingerprint %q: must be 64 hex digits or 44 base64 characters", s)
+	}
+	copy(pin[:], decoded)
+	return pin, nil
+}
+
+// PinOf returns the pin of cert.
+func PinOf(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+func (p Pin) String() string {
+	return hex.EncodeToString(p[:])
+}
+
+// PinMismatchError is returned when the public key of the certificate OPNsense presents matches none of the pins.
+type PinMismatchError struct {
+	// Fingerprint is the pin of the certificate presented, in hex
+	Fingerprint string
+	Cert        *x509.Certificate
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("certificate public key fingerprint %s matches no pin", e.Fingerprint)
+}
+
+// VerifyPins returns a tls.Config VerifyPeerCertificate callback accepting only leaf certificates
+// whose public key matches one of pins. It checks the certificate presented whether or not its chain was
+// verified, so pins either replace CA verification, with InsecureSkipVerify, or come on top of it.
+func VerifyPins(pins []Pin) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		presented := PinOf(cert)
+		if slices.Contains(pins, presented) {
+			return nil
+		}
+		return &PinMismatchError{Fingerprint: presented.String(), Cert: cert}
+	}
+}
@@ -0,0 +1,211 @@
+package unbound_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// selfSignedCert makes a certificate for 127.0.0.1 and opnsense.example.com, valid between notBefore and notAfter.
+func selfSignedCert(t *testing.T, notBefore, notAfter time.Time) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OPNsense.localdomain"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		DNSNames:              []string{"opnsense.example.com"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func tlsServer(t *testing.T, cert tls.Certificate, maxVersion uint16) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: maxVersion}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func trusting(certs ...*x509.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+}
+
+func TestTLSErrors(t *testing.T) {
+	now := time.Now()
+	valid, validCert := selfSignedCert(t, now.Add(-time.Hour), now.Add(24*time.Hour))
+
+	reconfigure := func(t *testing.T, baseURL string, client *http.Client) *unbound.TLSError {
+		t.Helper()
+
+		c, err := unbound.NewClient(baseURL, "fakeapikey", "fakeapisecret", client, unbound.WithRetry(3, time.Millisecond, time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Reconfigure(context.Background())
+		var tlsErr *unbound.TLSError
+		require.ErrorAs(t, err, &tlsErr)
+		require.False(t, unbound.IsTransient(err))
+		return tlsErr
+	}
+
+	t.Run("unknown authority", func(t *testing.T) {
+		server := tlsServer(t, valid, 0)
+
+		tlsErr := reconfigure(t, server.URL, &http.Client{})
+		require.Contains(t, tlsErr.Error(), "-tls-ca-file")
+		require.Equal(t, "CN=OPNsense.localdomain", tlsErr.Subject)
+		require.WithinDuration(t, validCert.NotAfter, tlsErr.NotAfter, time.Second)
+	})
+
+	t.Run("hostname mismatch", func(t *testing.T) {
+		server := tlsServer(t, valid, 0)
+
+		tlsErr := reconfigure(t, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), trusting(validCert))
+		require.Contains(t, tlsErr.Error(), "not valid for localhost")
+		require.Contains(t, tlsErr.Error(), "-tls-server-name to one of opnsense.example.com, 127.0.0.1")
+	})
+
+	t.Run("expired certificate", func(t *testing.T) {
+		expired, expiredCert := selfSignedCert(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+		server := tlsServer(t, expired, 0)
+
+		tlsErr := reconfigure(t, server.URL, trusting(expiredCert))
+		require.Contains(t, tlsErr.Error(), "expired on "+expiredCert.NotAfter.UTC().Format(time.RFC3339))
+		require.Equal(t, "CN=OPNsense.localdomain", tlsErr.Subject)
+	})
+
+	t.Run("protocol version", func(t *testing.T) {
+		server := tlsServer(t, valid, tls.VersionTLS11)
+
+		client := trusting(validCert)
+		client.Transport.(*http.Transport).TLSClientConfig.MinVersion = tls.VersionTLS12
+		tlsErr := reconfigure(t, server.URL, client)
+		require.Contains(t, tlsErr.Error(), "TLS 1.2 or later")
+	})
+
+	t.Run("leaves other errors alone", func(t *testing.T) {
+		server := tlsServer(t, valid, 0)
+
+		c, _ := unbound.NewClient(server.URL, "fakeapikey", "fakeapisecret", trusting(validCert))
+		require.NoError(t, c.Reconfigure(context.Background()))
+	})
+}
+
+func TestTLSPins(t *testing.T) {
+	now := time.Now()
+	current, currentCert := selfSignedCert(t, now.Add(-time.Hour), now.Add(24*time.Hour))
+	next, nextCert := selfSignedCert(t, now.Add(-time.Hour), now.Add(48*time.Hour))
+
+	pinning := func(client *http.Client, certs ...*x509.Certificate) *http.Client {
+		var pins []unbound.Pin
+		for _, cert := range certs {
+			pins = append(pins, unbound.PinOf(cert))
+		}
+		config := client.Transport.(*http.Transport).TLSClientConfig
+		config.VerifyPeerCertificate = unbound.VerifyPins(pins)
+		return client
+	}
+	insecure := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	reconfigure := func(t *testing.T, baseURL string, client *http.Client) error {
+		t.Helper()
+		c, err := unbound.NewClient(baseURL, "fakeapikey", "fakeapisecret", client, unbound.WithRetry(3, time.Millisecond, time.Millisecond))
+		require.NoError(t, err)
+		return c.Reconfigure(context.Background())
+	}
+
+	t.Run("accepts a certificate matching the pin", func(t *testing.T) {
+		server := tlsServer(t, current, 0)
+		require.NoError(t, reconfigure(t, server.URL, pinning(insecure(), currentCert)))
+	})
+
+	t.Run("refuses a certificate matching no pin, showing its fingerprint", func(t *testing.T) {
+		server := tlsServer(t, next, 0)
+
+		err := reconfigure(t, server.URL, pinning(insecure(), currentCert))
+		var tlsErr *unbound.TLSError
+		require.ErrorAs(t, err, &tlsErr)
+		require.False(t, unbound.IsTransient(err))
+		require.Contains(t, tlsErr.Error(), unbound.PinOf(nextCert).String())
+		require.Contains(t, tlsErr.Error(), "-tls-pin-sha256")
+		require.Equal(t, "CN=OPNsense.localdomain", tlsErr.Subject)
+	})
+
+	t.Run("accepts either certificate while rotating", func(t *testing.T) {
+		client := pinning(insecure(), currentCert, nextCert)
+		require.NoError(t, reconfigure(t, tlsServer(t, current, 0).URL, client))
+		require.NoError(t, reconfigure(t, tlsServer(t, next, 0).URL, client))
+	})
+
+	t.Run("applies on top of CA verification", func(t *testing.T) {
+		server := tlsServer(t, current, 0)
+
+		require.NoError(t, reconfigure(t, server.URL, pinning(trusting(currentCert), currentCert)))
+
+		var tlsErr *unbound.TLSError
+		require.ErrorAs(t, reconfigure(t, server.URL, pinning(trusting(currentCert), nextCert)), &tlsErr)
+		require.Contains(t, tlsErr.Error(), "matches no pin")
+
+		require.ErrorAs(t, reconfigure(t, server.URL, pinning(trusting(), currentCert)), &tlsErr)
+		require.Contains(t, tlsErr.Error(), "unknown authority")
+	})
+
+	t.Run("parses pins in hex and base64", func(t *testing.T) {
+		want := unbound.PinOf(currentCert)
+		hexPin := want.String()
+		colons := make([]string, 0, len(want))
+		for i := 0; i < len(hexPin); i += 2 {
+			colons = append(colons, strings.ToUpper(hexPin[i:i+2]))
+		}
+		b64 := base64.StdEncoding.EncodeToString(want[:])
+
+		for _, s := range []string{hexPin, strings.Join(colons, ":"), b64, "sha256/" + b64} {
+			pin, err := unbound.ParsePin(s)
+			require.NoError(t, err, s)
+			require.Equal(t, want, pin, s)
+		}
+
+		for _, s := range []string{"", "abcd", hexPin[:62], "not a pin"} {
+			_, err := unbound.ParsePin(s)
+			require.ErrorContains(t, err, "invalid SHA-256 fingerprint", s)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+// Package unboundtest provides an in-memory fake of the OPNsense Unbound API, for testing code that uses
+// unbound.API without an OPNsense to call.
+//
+//	fake := &unboundtest.Fake{}
+//	nas := fake.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2", Enabled: "1"})
+//	fake.Fail("CreateHostOverride", unbound.ErrUnavailable)
+//	// ... exercise code calling fake as an unbound.API ...
+//	if fake.Calls("Reconfigure") != 1 {
+//		t.Fatal("expected a single reconfigure")
+//	}
+package unboundtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+// DefaultVersion is the OPNsense version a Fake reports unless told otherwise.
+const DefaultVersion = "24.7.1"
+
+// Fake is an in-memory unbound.API. The zero value has no records and is ready to use; it is safe for
+// concurrent use.
+//
+// Records created are given IDs of their own. Records are kept as they are given: unlike OPNsense, the fake
+// doesn't validate them.
+type Fake struct {
+	// Lock the fake to read or change HostOverrides and HostAliases while it may be called concurrently.
+	sync.Mutex
+
+	// HostOverrides are the host overrides OPNsense has, in the order they were created.
+	HostOverrides []unbound.HostOverride
+	// HostAliases are the aliases of the host overrides, with HostID set, in the order they were created.
+	HostAliases []unbound.HostAlias
+	// OPNsenseVersion is the version the fake reports. Defaults to DefaultVersion.
+	OPNsenseVersion string
+
+	nextID int
+	calls  map[string]int
+	errs   map[string]error
+}
+
+var _ unbound.API = &Fake{}
+
+var apiType = reflect.TypeFor[unbound.API]()
+
+// mustBeMethod panics unless method is the name of a method of unbound.API, so that a typo doesn't
+// leave a test checking nothing.
+func mustBeMethod(method string) {
+	if _, ok := apiType.MethodByName(method); !ok {
+		panic(fmt.Sprintf("unboundtest: %q is not a method of unbound.API", method))
+	}
+}
+
+// Fail makes every later call to method, the name of an unbound.API method such as "CreateHostOverride",
+// fail with err instead of taking effect. A nil err makes calls succeed again.
+func (f *Fake) Fail(method string, err error) {
+	mustBeMethod(method)
+	f.Lock()
+	defer f.Unlock()
+	if f.errs == nil {
+		f.errs = map[string]error{}
+	}
+	f.errs[method] = err
+}
+
+// Calls returns how many times method, the name of an unbound.API method, was called, failed calls included.
+func (f *Fake) Calls(method string) int {
+	mustBeMethod(method)
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[method]
+}
+
+// AddHostOverride adds ho to the records of the fake as if it already existed, giving it an ID unless it has one.
+// It returns the host override added.
+func (f *Fake) AddHostOverride(ho unbound.HostOverride) unbound.HostOverride {
+	f.Lock()
+	defer f.Unlock()
+	if ho.ID == "" {
+		ho.ID = unbound.HostOverrideID(f.newID())
+	}
+	f.HostOverrides = append(f.HostOverrides, ho)
+	return ho
+}
+
+// AddHostAlias adds ha to the records of the fake as if it already existed, giving it an ID unless it has one.
+// It returns the alias added.
+func (f *Fake) AddHostAlias(ha unbound.HostAlias) unbound.HostAlias {
+	f.Lock()
+	defer f.Unlock()
+	if ha.ID == "" {
+		ha.ID = unbound.HostAliasID(f.newID())
+	}
+	f.HostAliases = append(f.HostAliases, ha)
+	return ha
+}
+
+// newID returns an ID no record of the fake was given yet. f must be locked.
+func (f *Fake) newID() string {
+	for {
+		f.nextID++
+		id := "fake-" + strconv.Itoa(f.nextID)
+		taken := slices.ContainsFunc(f.HostOverrides, func(ho unbound.HostOverride) bool { return string(ho.ID) == id }) ||
+			slices.ContainsFunc(f.HostAliases, func(ha unbound.HostAlias) bool { return string(ha.ID) == id })
+		if !taken {
+			return id
+		}
+	}
+}
+
+// call counts a call to method, returning the error it is to fail with. f must be locked.
+func (f *Fake) call(method string) error {
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[method]++
+	return f.errs[method]
+}
+
+func (f *Fake) ListHostOverrides(_ context.Context) ([]unbound.HostOverride, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("ListHostOverrides"); err != nil {
+		return nil, err
+	}
+	return slices.Clone(f.HostOverrides), nil
+}
+
+func (f *Fake) CreateHostOverride(_ context.Context, ho unbound.HostOverride) (unbound.HostOverride, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("CreateHostOverride"); err != nil {
+		return unbound.HostOverride{}, err
+	}
+	ho.ID = unbound.HostOverrideID(f.newID())
+	f.HostOverrides = append(f.HostOverrides, ho)
+	return ho, nil
+}
+
+// DeleteHostOverride deletes the host override with the ID of ho. Like OPNsense, it takes a host override
+// that doesn't exist as already deleted.
+func (f *Fake) DeleteHostOverride(_ context.Context, ho unbound.HostOverride) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("DeleteHostOverride"); err != nil {
+		return err
+	}
+	f.HostOverrides = slices.DeleteFunc(f.HostOverrides, func(e unbound.HostOverride) bool { return e.ID == ho.ID })
+	return nil
+}
+
+func (f *Fake) UpdateHostOverride(_ context.Context, ho unbound.HostOverride) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("UpdateHostOverride"); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(f.HostOverrides, func(e unbound.HostOverride) bool { return e.ID == ho.ID })
+	if i < 0 {
+		return fmt.Errorf("setHostOverride failed: %w", unbound.ErrNotFound)
+	}
+	f.HostOverrides[i] = ho
+	return nil
+}
+
+func (f *Fake) GetHostOverride(_ context.Context, id unbound.HostOverrideID) (unbound.HostOverride, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetHostOverride"); err != nil {
+		return unbound.HostOverride{}, err
+	}
+	i := slices.IndexFunc(f.HostOverrides, func(e unbound.HostOverride) bool { return e.ID == id })
+	if i < 0 {
+		return unbound.HostOverride{}, fmt.Errorf("getHostOverride failed: %w", unbound.ErrNotFound)
+	}
+	return f.HostOverrides[i], nil
+}
+
+func (f *Fake) ToggleHostOverride(_ context.Context, id unbound.HostOverrideID, enabled bool) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("ToggleHostOverride"); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(f.HostOverrides, func(e unbound.HostOverride) bool { return e.ID == id })
+	if i < 0 {
+		return fmt.Errorf("toggleHostOverride failed: %w", unbound.ErrNotFound)
+	}
+	f.HostOverrides[i].Enabled = enabledField(enabled)
+	return nil
+}
+
+// ListHostAliases returns the aliases of the host override with the given ID.
+func (f *Fake) ListHostAliases(_ context.Context, id unbound.HostOverrideID) ([]unbound.HostAlias, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("ListHostAliases"); err != nil {
+		return nil, err
+	}
+	var aliases []unbound.HostAlias
+	for _, ha := range f.HostAliases {
+		if ha.HostID == id {
+			aliases = append(aliases, ha)
+		}
+	}
+	return aliases, nil
+}
+
+func (f *Fake) CreateHostAlias(_ context.Context, ha unbound.HostAlias) (unbound.HostAlias, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("CreateHostAlias"); err != nil {
+		return unbound.HostAlias{}, err
+	}
+	ha.ID = unbound.HostAliasID(f.newID())
+	f.HostAliases = append(f.HostAliases, ha)
+	return ha, nil
+}
+
+func (f *Fake) UpdateHostAlias(_ context.Context, ha unbound.HostAlias) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("UpdateHostAlias"); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(f.HostAliases, func(e unbound.HostAlias) bool { return e.ID == ha.ID })
+	if i < 0 {
+		return fmt.Errorf("setHostAlias failed: %w", unbound.ErrNotFound)
+	}
+	f.HostAliases[i] = ha
+	return nil
+}
+
+func (f *Fake) GetHostAlias(_ context.Context, id unbound.HostAliasID) (unbound.HostAlias, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetHostAlias"); err != nil {
+		return unbound.HostAlias{}, err
+	}
+	i := slices.IndexFunc(f.HostAliases, func(e unbound.HostAlias) bool { return e.ID == id })
+	if i < 0 {
+		return unbound.HostAlias{}, fmt.Errorf("getHostAlias failed: %w", unbound.ErrNotFound)
+	}
+	return f.HostAliases[i], nil
+}
+
+func (f *Fake) ToggleHostAlias(_ context.Context, id unbound.HostAliasID, enabled bool) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("ToggleHostAlias"); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(f.HostAliases, func(e unbound.HostAlias) bool { return e.ID == id })
+	if i < 0 {
+		return fmt.Errorf("toggleHostAlias failed: %w", unbound.ErrNotFound)
+	}
+	f.HostAliases[i].Enabled = enabledField(enabled)
+	return nil
+}
+
+// DeleteHostAlias deletes the alias with the ID of ha. Like OPNsense, it takes an alias that doesn't exist
+// as already deleted.
+func (f *Fake) DeleteHostAlias(_ context.Context, ha unbound.HostAlias) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("DeleteHostAlias"); err != nil {
+		return err
+	}
+	f.HostAliases = slices.DeleteFunc(f.HostAliases, func(e unbound.HostAlias) bool { return e.ID == ha.ID })
+	return nil
+}
+
+func (f *Fake) Reconfigure(_ context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	return f.call("Reconfigure")
+}
+
+func (f *Fake) Version(_ context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("Version"); err != nil {
+		return "", err
+	}
+	if f.OPNsenseVersion == "" {
+		return DefaultVersion, nil
+	}
+	return f.OPNsenseVersion, nil
+}
+
+func enabledField(enabled bool) string {
+	if enabled {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,130 @@
+package unboundtest_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound/unboundtest"
+)
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("keeps the records created", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+
+		ho, err := fake.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2"})
+		require.NoError(t, err)
+		require.NotEmpty(t, ho.ID)
+		ha, err := fake.CreateHostAlias(ctx, unbound.HostAlias{HostID: ho.ID, Hostname: "files", Domain: "example.com"})
+		require.NoError(t, err)
+		require.NotEmpty(t, ha.ID)
+
+		overrides, err := fake.ListHostOverrides(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostOverride{ho}, overrides)
+		aliases, err := fake.ListHostAliases(ctx, ho.ID)
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostAlias{ha}, aliases)
+	})
+
+	t.Run("lists the aliases of the override asked for", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		a := fake.AddHostOverride(unbound.HostOverride{Hostname: "a", Domain: "example.com"})
+		b := fake.AddHostOverride(unbound.HostOverride{ID: "b", Hostname: "b", Domain: "example.com"})
+		www := fake.AddHostAlias(unbound.HostAlias{HostID: a.ID, Hostname: "www", Domain: "example.com"})
+		fake.AddHostAlias(unbound.HostAlias{HostID: b.ID, Hostname: "api", Domain: "example.com"})
+
+		aliases, err := fake.ListHostAliases(ctx, a.ID)
+
+		require.NoError(t, err)
+		require.Equal(t, []unbound.HostAlias{www}, aliases)
+		require.Equal(t, unbound.HostOverrideID("b"), b.ID)
+		require.NotEqual(t, a.ID, b.ID)
+	})
+
+	t.Run("updates, toggles and deletes records by ID", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		ho := fake.AddHostOverride(unbound.HostOverride{Hostname: "nas", Domain: "example.com", Server: "10.0.0.2", Enabled: "1"})
+
+		ho.Server = "10.0.0.3"
+		require.NoError(t, fake.UpdateHostOverride(ctx, ho))
+		require.NoError(t, fake.ToggleHostOverride(ctx, ho.ID, false))
+		got, err := fake.GetHostOverride(ctx, ho.ID)
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.3", got.Server)
+		require.Equal(t, "0", got.Enabled)
+
+		require.NoError(t, fake.DeleteHostOverride(ctx, unbound.HostOverride{ID: ho.ID}))
+		require.Empty(t, fake.HostOverrides)
+		require.NoError(t, fake.DeleteHostOverride(ctx, ho), "deleting a deleted record succeeds")
+	})
+
+	t.Run("fails for records it doesn't have", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+
+		_, err := fake.GetHostOverride(ctx, "missing")
+		require.ErrorIs(t, err, unbound.ErrNotFound)
+		require.ErrorIs(t, fake.UpdateHostAlias(ctx, unbound.HostAlias{ID: "missing"}), unbound.ErrNotFound)
+		require.ErrorIs(t, fake.ToggleHostAlias(ctx, "missing", true), unbound.ErrNotFound)
+	})
+
+	t.Run("fails the calls it is told to", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		boom := errors.New("boom")
+		fake.Fail("CreateHostOverride", boom)
+
+		_, err := fake.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com"})
+		require.ErrorIs(t, err, boom)
+		require.Empty(t, fake.HostOverrides)
+		require.NoError(t, fake.Reconfigure(ctx), "other methods still succeed")
+
+		fake.Fail("CreateHostOverride", nil)
+		_, err = fake.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com"})
+		require.NoError(t, err)
+		require.Len(t, fake.HostOverrides, 1)
+	})
+
+	t.Run("counts calls", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+		fake.Fail("Reconfigure", errors.New("boom"))
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fake.Reconfigure(ctx)
+				fake.CreateHostOverride(ctx, unbound.HostOverride{Hostname: "nas", Domain: "example.com"})
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, 10, fake.Calls("Reconfigure"), "failed calls count too")
+		require.Equal(t, 10, fake.Calls("CreateHostOverride"))
+		require.Zero(t, fake.Calls("ListHostOverrides"))
+	})
+
+	t.Run("reports a version", func(t *testing.T) {
+		version, err := (&unboundtest.Fake{}).Version(ctx)
+		require.NoError(t, err)
+		require.Equal(t, unboundtest.DefaultVersion, version)
+
+		version, err = (&unboundtest.Fake{OPNsenseVersion: "25.1"}).Version(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "25.1", version)
+	})
+
+	t.Run("rejects methods unbound.API doesn't have", func(t *testing.T) {
+		fake := &unboundtest.Fake{}
+
+		require.PanicsWithValue(t, `unboundtest: "CreateHostOverrides" is not a method of unbound.API`, func() {
+			fake.Fail("CreateHostOverrides", errors.New("boom"))
+		})
+		require.Panics(t, func() { fake.Calls("Reconfig") })
+	})
+}
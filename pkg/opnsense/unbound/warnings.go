@@ -0,0 +1,77 @@
+package unbound
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+)
+
+// ValidationWarning holds the validation messages OPNsense returned along with a record it saved all the same,
+// such as that a hostname will be lowercased, by field.
+type ValidationWarning struct {
+	Time   time.Time         `json:"time"`
+	Op     string            `json:"op"`
+	Fields map[string]string `json:"fields"`
+}
+
+// ValidationWarnings keeps the last validation warnings of the clients it is given to.
+type ValidationWarnings struct {
+	size int
+
+	mu     sync.Mutex
+	recent []ValidationWarning
+}
+
+func NewValidationWarnings(size int) *ValidationWarnings {
+	return &ValidationWarnings{size: max(size, 1)}
+}
+
+// WithValidationWarnings keeps the validation warnings OPNsense returns with saved records in w.
+// They are logged and counted either way.
+func WithValidationWarnings(w *ValidationWarnings) Option {
+	return func(u *Client) {
+		u.warnings = w
+	}
+}
+
+// Recent returns the last validation warnings, oldest first.
+func (w *ValidationWarnings) Recent() []ValidationWarning {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.recent)
+}
+
+func (w *ValidationWarnings) add(warning ValidationWarning) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.recent) == w.size {
+		w.recent = slices.Delete(w.recent, 0, 1)
+	}
+	w.recent = append(w.recent, warning)
+}
+
+// warnValidations logs, counts and keeps the validations OPNsense returned for op along with a saved result.
+func (u *Client) warnValidations(op string, validations map[string]interface{}, attrs ...any) {
+	if len(validations) == 0 {
+		return
+	}
+
+	fields := newValidationError(validations).Fields
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	slices.Sort(names)
+	u.logger.Warn(op+" saved with validation warnings",
+		append(attrs, slog.Any("fields", names), slog.Any("warnings", fields))...)
+	metrics.For(u.webhook).APIValidationWarnings.WithLabelValues(op).Inc()
+	if u.warnings != nil {
+		u.warnings.add(ValidationWarning{Time: time.Now(), Op: op, Fields: fields})
+	}
+}
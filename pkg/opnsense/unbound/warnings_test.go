@@ -0,0 +1,83 @@
+package unbound_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/internal/pkg/metrics"
+	"github.com/v-yarotsky/external-dns-opnsense-unbound-webhook-provider/pkg/opnsense/unbound"
+)
+
+func TestValidationWarnings(t *testing.T) {
+	client := func(t *testing.T, warnings *unbound.ValidationWarnings, logs *recordingHandler) unbound.API {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, fixture(t, "unbound/addHostOverrideWarnings.json"))
+		}))
+		t.Cleanup(server.Close)
+
+		c, err := unbound.New(server.URL, "key", "secret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithValidationWarnings(warnings))
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("logs, counts and keeps the warnings of saved records", func(t *testing.T) {
+		logs := &recordingHandler{}
+		warnings := unbound.NewValidationWarnings(5)
+		before := testutil.ToFloat64(metrics.Default.APIValidationWarnings.WithLabelValues("addHostOverride"))
+
+		created, err := client(t, warnings, logs).CreateHostOverride(context.Background(),
+			unbound.HostOverride{Hostname: "App", Domain: "example.com", Server: "10.0.0.1"})
+		require.NoError(t, err)
+		require.Equal(t, unbound.HostOverrideID("2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c"), created.ID)
+
+		level, attrs, ok := logs.find("addHostOverride saved with validation warnings")
+		require.True(t, ok)
+		require.Equal(t, slog.LevelWarn, level)
+		require.Equal(t, []string{"host.hostname"}, attrs["fields"].Any())
+		require.Equal(t, before+1, testutil.ToFloat64(metrics.Default.APIValidationWarnings.WithLabelValues("addHostOverride")))
+
+		recent := warnings.Recent()
+		require.Len(t, recent, 1)
+		require.Equal(t, "addHostOverride", recent[0].Op)
+		require.Equal(t, map[string]string{"host.hostname": "Hostname will be lowercased."}, recent[0].Fields)
+	})
+
+	t.Run("keeps only the last warnings", func(t *testing.T) {
+		warnings := unbound.NewValidationWarnings(2)
+		c := client(t, warnings, &recordingHandler{})
+
+		for range 3 {
+			_, err := c.CreateHostOverride(context.Background(), unbound.HostOverride{Hostname: "app", Domain: "example.com"})
+			require.NoError(t, err)
+		}
+		require.Len(t, warnings.Recent(), 2)
+	})
+
+	t.Run("stays quiet about saved records without warnings", func(t *testing.T) {
+		logs := &recordingHandler{}
+		warnings := unbound.NewValidationWarnings(5)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, fixture(t, "unbound/setHostOverride.json"))
+		}))
+		t.Cleanup(server.Close)
+		c, err := unbound.New(server.URL, "key", "secret",
+			unbound.WithLogger(slog.New(logs)), unbound.WithValidationWarnings(warnings))
+		require.NoError(t, err)
+
+		require.NoError(t, c.UpdateHostOverride(context.Background(),
+			unbound.HostOverride{ID: "2f0e73f7-fe3f-43fa-b8b0-fdf0ba48452c", Hostname: "app", Domain: "example.com"}))
+		_, _, ok := logs.find("setHostOverride saved with validation warnings")
+		require.False(t, ok)
+		require.Empty(t, warnings.Recent())
+	})
+}